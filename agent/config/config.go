@@ -5,14 +5,22 @@ import (
 	"crypto/x509"
 	"fmt"
 	"net"
+	"net/netip"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/spf13/pflag"
 
+	"github.com/andydunstall/piko/pkg/backoff"
+	"github.com/andydunstall/piko/pkg/encrypt"
+	"github.com/andydunstall/piko/pkg/goruntime"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/pkg/websocket"
 )
 
 type ListenerProtocol string
@@ -20,32 +28,433 @@ type ListenerProtocol string
 const (
 	ListenerProtocolHTTP ListenerProtocol = "http"
 	ListenerProtocolTCP  ListenerProtocol = "tcp"
+	ListenerProtocolUDP  ListenerProtocol = "udp"
 )
 
+type TCPConfig struct {
+	// IdleTimeout closes connections with no traffic in either direction for
+	// the given duration.
+	//
+	// Zero disables the idle timeout.
+	IdleTimeout time.Duration `json:"idle_timeout" yaml:"idle_timeout"`
+
+	// KeepAlive is the TCP keep-alive period of connections to the upstream.
+	//
+	// Zero uses the system default, and a negative value disables
+	// keep-alives.
+	KeepAlive time.Duration `json:"keep_alive" yaml:"keep_alive"`
+
+	// BufferSize is the size of the buffer in bytes used when copying data
+	// between the client and upstream, which bounds the maximum chunk of
+	// data forwarded at once, and so the size of each mux frame sent to the
+	// server.
+	//
+	// Zero uses the default (32 KB).
+	BufferSize int `json:"buffer_size" yaml:"buffer_size"`
+}
+
+func (c *TCPConfig) Validate() error {
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("idle timeout cannot be negative")
+	}
+	if c.BufferSize < 0 {
+		return fmt.Errorf("buffer size cannot be negative")
+	}
+	return nil
+}
+
+type HealthCheckConfig struct {
+	// GRPCServices contains the gRPC service names to health check using the
+	// standard gRPC health checking protocol (grpc.health.v1). An empty name
+	// checks the overall health of the upstream server.
+	//
+	// If empty, health checks are disabled.
+	GRPCServices []string `json:"grpc_services" yaml:"grpc_services"`
+
+	// Path is the HTTP path to probe, such as '/healthz'.
+	//
+	// The agent only registers the endpoint with Piko while the probe
+	// succeeds, and withdraws the endpoint when the probe fails, so requests
+	// are routed to other upstreams for the endpoint.
+	//
+	// If empty, the upstream isn't probed.
+	Path string `json:"path" yaml:"path"`
+
+	// ExpectedStatus is the HTTP status code the probe must return. If zero,
+	// any 2xx status is healthy.
+	ExpectedStatus int `json:"expected_status" yaml:"expected_status"`
+
+	// Interval is the interval between health checks.
+	Interval time.Duration `json:"interval" yaml:"interval"`
+
+	// Timeout is the timeout for each health check.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+}
+
+// Enabled returns whether health checks are enabled.
+func (c *HealthCheckConfig) Enabled() bool {
+	return len(c.GRPCServices) != 0 || c.ProbeEnabled()
+}
+
+// ProbeEnabled returns whether HTTP probes are enabled.
+func (c *HealthCheckConfig) ProbeEnabled() bool {
+	return c.Path != ""
+}
+
+func (c *HealthCheckConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.Interval == 0 {
+		return fmt.Errorf("missing interval")
+	}
+	if c.Timeout == 0 {
+		return fmt.Errorf("missing timeout")
+	}
+	if c.ProbeEnabled() && !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("path must start with '/'")
+	}
+	if c.ExpectedStatus != 0 && (c.ExpectedStatus < 100 || c.ExpectedStatus > 599) {
+		return fmt.Errorf("invalid expected status: %d", c.ExpectedStatus)
+	}
+	return nil
+}
+
+type CertCheckConfig struct {
+	// Enabled indicates whether to periodically check the upstream TLS
+	// certificate. Only supported by HTTPS upstreams.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// Interval is the interval between certificate checks.
+	Interval time.Duration `json:"interval" yaml:"interval"`
+
+	// Timeout is the timeout for each certificate check.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+
+	// Enforce rejects requests to the upstream when the upstream certificate
+	// fails validation.
+	Enforce bool `json:"enforce" yaml:"enforce"`
+}
+
+func (c *CertCheckConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Interval == 0 {
+		return fmt.Errorf("missing interval")
+	}
+	if c.Timeout == 0 {
+		return fmt.Errorf("missing timeout")
+	}
+	return nil
+}
+
+type RecordMode string
+
+const (
+	// RecordModeRecord forwards requests to the upstream and records the
+	// responses.
+	RecordModeRecord RecordMode = "record"
+	// RecordModeReplay responds with recorded responses without forwarding
+	// requests to the upstream.
+	RecordModeReplay RecordMode = "replay"
+)
+
+type RecordConfig struct {
+	// Mode is either "record" to record upstream responses, or "replay" to
+	// replay recorded responses. If empty, recording is disabled.
+	Mode RecordMode `json:"mode" yaml:"mode"`
+
+	// Path is the directory to store recorded responses.
+	Path string `json:"path" yaml:"path"`
+}
+
+// Enabled returns whether recording or replaying is enabled.
+func (c *RecordConfig) Enabled() bool {
+	return c.Mode != ""
+}
+
+func (c *RecordConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.Mode != RecordModeRecord && c.Mode != RecordModeReplay {
+		return fmt.Errorf("unsupported mode: %s", c.Mode)
+	}
+	if c.Path == "" {
+		return fmt.Errorf("missing path")
+	}
+	return nil
+}
+
+// CompressionConfig configures decompressing requests and compressing
+// responses on behalf of upstream services that don't support compression.
+type CompressionConfig struct {
+	// DecompressRequests decompresses gzip and deflate encoded request
+	// bodies before forwarding to the upstream.
+	//
+	// Requests with other content encodings are rejected, since the upstream
+	// is assumed not to support them.
+	DecompressRequests bool `json:"decompress_requests" yaml:"decompress_requests"`
+
+	// MaxRequestSize is the maximum size of a decompressed request body in
+	// bytes. Requests that exceed the limit are rejected, to protect the
+	// agent and upstream from decompression bombs.
+	MaxRequestSize int64 `json:"max_request_size" yaml:"max_request_size"`
+
+	// CompressResponses gzip compresses responses before returning to
+	// clients that accept gzip, unless the upstream already compressed the
+	// response.
+	CompressResponses bool `json:"compress_responses" yaml:"compress_responses"`
+
+	// MinResponseSize is the minimum response size in bytes to compress,
+	// since compressing small responses adds overhead without reducing the
+	// size. Responses of unknown size are always compressed.
+	MinResponseSize int64 `json:"min_response_size" yaml:"min_response_size"`
+}
+
+// Enabled returns whether either decompressing requests or compressing
+// responses is enabled.
+func (c *CompressionConfig) Enabled() bool {
+	return c.DecompressRequests || c.CompressResponses
+}
+
+func (c *CompressionConfig) Validate() error {
+	if c.DecompressRequests && c.MaxRequestSize <= 0 {
+		return fmt.Errorf("missing max request size")
+	}
+	if c.MinResponseSize < 0 {
+		return fmt.Errorf("min response size cannot be negative")
+	}
+	return nil
+}
+
+// MirrorConfig configures mirroring a sampled copy of requests and responses
+// to a local HTTP collector, such as for debugging or analytics.
+type MirrorConfig struct {
+	// URL is the URL of the collector to POST mirrored requests to. If
+	// empty, mirroring is disabled.
+	URL string `json:"url" yaml:"url"`
+
+	// SampleRate mirrors 1 in every SampleRate requests.
+	//
+	// Zero or one mirrors all requests.
+	SampleRate int `json:"sample_rate" yaml:"sample_rate"`
+
+	// MaxBodySize is the maximum number of bytes of the request and response
+	// bodies to mirror. Larger bodies are truncated.
+	MaxBodySize int64 `json:"max_body_size" yaml:"max_body_size"`
+
+	// QueueSize is the maximum number of mirrored requests queued to be sent
+	// to the collector. Once full, new requests aren't mirrored, so a slow
+	// collector never delays proxied requests.
+	QueueSize int `json:"queue_size" yaml:"queue_size"`
+
+	// Timeout is the timeout sending each mirrored request to the collector.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+}
+
+// Enabled returns whether mirroring is enabled.
+func (c *MirrorConfig) Enabled() bool {
+	return c.URL != ""
+}
+
+func (c *MirrorConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url")
+	}
+	if c.SampleRate < 0 {
+		return fmt.Errorf("sample rate cannot be negative")
+	}
+	if c.MaxBodySize < 0 {
+		return fmt.Errorf("max body size cannot be negative")
+	}
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("missing queue size")
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("missing timeout")
+	}
+	return nil
+}
+
+// UpstreamHostPort returns the host and port of the collector URL. Return
+// false if the URL is invalid.
+func (c *MirrorConfig) UpstreamHostPort() (string, int, bool) {
+	listener := ListenerConfig{Addr: c.URL}
+	return listener.UpstreamHostPort()
+}
+
+// RedirectConfig configures following upstream redirects inside the agent.
+type RedirectConfig struct {
+	// Follow follows redirects to the upstream host inside the agent,
+	// rather than returning them to the client, for upstreams that redirect
+	// to internal-only addresses.
+	//
+	// Redirects to other hosts are returned to the client.
+	Follow bool `json:"follow" yaml:"follow"`
+
+	// MaxHops is the maximum number of redirects to follow for each
+	// request. Once reached, the last redirect is returned to the client.
+	MaxHops int `json:"max_hops" yaml:"max_hops"`
+}
+
+func (c *RedirectConfig) Validate() error {
+	if c.Follow && c.MaxHops <= 0 {
+		return fmt.Errorf("missing max hops")
+	}
+	return nil
+}
+
+// RewriteConfig configures rewriting absolute URLs in upstream responses
+// from the upstream's internal origin to the public endpoint origin, for
+// upstreams that emit absolute links.
+type RewriteConfig struct {
+	// Enabled rewrites the Location header and the bodies of HTML and JSON
+	// responses.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// Origins are internal origins to replace in addition to the origin of
+	// the listener address, such as 'http://127.0.0.1:3000'.
+	Origins []string `json:"origins" yaml:"origins"`
+
+	// PublicOrigin is the origin to replace internal origins with, such as
+	// 'https://my-endpoint.example.com'.
+	//
+	// If empty, uses the request host, with the scheme from the
+	// 'X-Forwarded-Proto' header or 'http' if not set.
+	PublicOrigin string `json:"public_origin" yaml:"public_origin"`
+}
+
+func (c *RewriteConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	for _, origin := range c.Origins {
+		if !validOrigin(origin) {
+			return fmt.Errorf("invalid origin: %s", origin)
+		}
+	}
+	if c.PublicOrigin != "" && !validOrigin(c.PublicOrigin) {
+		return fmt.Errorf("invalid public origin")
+	}
+	return nil
+}
+
+// validOrigin returns whether origin is an HTTP(S) scheme and host without a
+// path.
+func validOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	return u.Host != "" && u.Path == "" && u.RawQuery == "" && u.Fragment == ""
+}
+
 type ListenerConfig struct {
 	// EndpointID is the endpoint ID to register.
+	//
+	// The endpoint ID may be in a namespace, such as 'team-a/service-b', or
+	// be a wildcard that serves every endpoint in the namespace without a
+	// listener of its own, such as 'team-a/*'.
 	EndpointID string `json:"endpoint_id" yaml:"endpoint_id"`
 
 	// Addr is the address of the upstream service to forward to.
 	Addr string `json:"addr" yaml:"addr"`
 
-	// Protocol is the protocol to listen on. Supports "http" and "tcp".
-	// Defaults to "http".
+	// Protocol is the protocol to listen on. Supports "http", "tcp" and
+	// "udp". Defaults to "http".
 	Protocol ListenerProtocol `json:"protocol" yaml:"protocol"`
 
 	// AccessLog indicates whether to log all incoming connections and requests
 	// for the endpoint.
 	AccessLog bool `json:"access_log" yaml:"access_log"`
 
+	// SampleRate enables sampling the access log and request/response size
+	// metrics for the endpoint, where only 1 in every SampleRate requests is
+	// sampled. Requests that fail with a server error are always sampled.
+	//
+	// Zero or one samples all requests.
+	SampleRate int `json:"sample_rate" yaml:"sample_rate"`
+
 	// Timeout is the timeout to forward incoming requests to the upstream.
 	Timeout time.Duration `json:"timeout" yaml:"timeout"`
 
+	// MaxConcurrent is the maximum number of concurrent requests (or
+	// connections for TCP listeners) to forward to the upstream.
+	//
+	// Zero means no limit.
+	MaxConcurrent int `json:"max_concurrent" yaml:"max_concurrent"`
+
+	// QueueTimeout is the maximum duration to queue requests (or
+	// connections) waiting for a slot when at MaxConcurrent, before
+	// rejecting them.
+	//
+	// Zero rejects requests above the limit without queueing.
+	QueueTimeout time.Duration `json:"queue_timeout" yaml:"queue_timeout"`
+
+	// TCP configures TCP listeners. Only supported by TCP listeners.
+	TCP TCPConfig `json:"tcp" yaml:"tcp"`
+
+	// HealthCheck configures health checking the upstream service. Only
+	// supported by HTTP listeners.
+	HealthCheck HealthCheckConfig `json:"health_check" yaml:"health_check"`
+
+	// CertCheck configures checking the upstream TLS certificate expiry and
+	// validation status. Only supported by HTTPS upstreams.
+	CertCheck CertCheckConfig `json:"cert_check" yaml:"cert_check"`
+
+	// Record configures recording upstream responses and replaying them
+	// without the upstream. Only supported by HTTP listeners.
+	Record RecordConfig `json:"record" yaml:"record"`
+
+	// Compression configures decompressing requests and compressing
+	// responses on behalf of the upstream. Only supported by HTTP listeners.
+	Compression CompressionConfig `json:"compression" yaml:"compression"`
+
+	// Rewrite configures rewriting absolute URLs in upstream responses. Only
+	// supported by HTTP listeners.
+	Rewrite RewriteConfig `json:"rewrite" yaml:"rewrite"`
+
+	// Redirects configures following upstream redirects. Only supported by
+	// HTTP listeners.
+	Redirects RedirectConfig `json:"redirects" yaml:"redirects"`
+
+	// Mirror configures mirroring requests to a local collector. Only
+	// supported by HTTP listeners.
+	Mirror MirrorConfig `json:"mirror" yaml:"mirror"`
+
 	// TLS configures the client TLS config when connecting to the upstream
 	// service.
 	//
 	// Note the client can only use TLS when connecting to the upstream with
 	// HTTPS.
 	TLS TLSConfig `json:"tls" yaml:"tls"`
+
+	// LocalAddrs contains local IP addresses to connect to the Piko server
+	// from, such as the addresses of an ethernet and an LTE interface.
+	//
+	// The agent opens a connection for the endpoint from each address, so
+	// Piko spreads requests across the connections and fails over to the
+	// remaining connections if one disconnects.
+	//
+	// If empty, the agent opens a single connection.
+	LocalAddrs []string `json:"local_addrs" yaml:"local_addrs"`
+
+	// Routes forwards requests matching a route to the route address rather
+	// than Addr, so a single listener can split requests between multiple
+	// upstream services. Only supported by HTTP listeners.
+	//
+	// Requests are forwarded to the first matching route, or Addr if no
+	// routes match.
+	Routes []RouteConfig `json:"routes" yaml:"routes"`
 }
 
 // Host parses the given upstream address into a host and port. Return false if
@@ -100,10 +509,91 @@ func (c *ListenerConfig) URL() (*url.URL, bool) {
 	return nil, false
 }
 
+// UpstreamHostPort returns the host and port of the upstream address. Return
+// false if the address is invalid.
+//
+// If the address of an HTTP listener is a URL without a port, the port
+// defaults to that of the URL scheme.
+func (c *ListenerConfig) UpstreamHostPort() (string, int, bool) {
+	hostPort, ok := c.Host()
+	if c.Protocol == "" || c.Protocol == ListenerProtocolHTTP {
+		var u *url.URL
+		u, ok = c.URL()
+		if ok {
+			hostPort = u.Host
+			if u.Port() == "" {
+				port := "80"
+				if u.Scheme == "https" {
+					port = "443"
+				}
+				hostPort = net.JoinHostPort(u.Hostname(), port)
+			}
+		}
+	}
+	if !ok {
+		return "", 0, false
+	}
+
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", 0, false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, false
+	}
+	return host, port, true
+}
+
+// isHTTP returns whether the listener is an HTTP listener.
+func (c *ListenerConfig) isHTTP() bool {
+	return c.Protocol == "" || c.Protocol == ListenerProtocolHTTP
+}
+
+// PermittedBy returns whether the egress policy permits the listener
+// upstream address, the address of each route and the mirror collector
+// address.
+func (c *ListenerConfig) PermittedBy(egress *EgressPolicy) bool {
+	host, port, _ := c.UpstreamHostPort()
+	if !egress.PermitsHost(host, port) {
+		return false
+	}
+	if c.Mirror.Enabled() {
+		host, port, _ := c.Mirror.UpstreamHostPort()
+		if !egress.PermitsHost(host, port) {
+			return false
+		}
+	}
+	for _, route := range c.Routes {
+		host, port, _ := route.UpstreamHostPort()
+		if !egress.PermitsHost(host, port) {
+			return false
+		}
+	}
+	return true
+}
+
+// LocalTCPAddrs returns the parsed local addresses to connect to the Piko
+// server from.
+func (c *ListenerConfig) LocalTCPAddrs() ([]net.Addr, error) {
+	var addrs []net.Addr
+	for _, addr := range c.LocalAddrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip: %s", addr)
+		}
+		addrs = append(addrs, &net.TCPAddr{IP: ip})
+	}
+	return addrs, nil
+}
+
 func (c *ListenerConfig) Validate() error {
 	if c.EndpointID == "" {
 		return fmt.Errorf("missing endpoint id")
 	}
+	if err := protocol.ValidateEndpointID(c.EndpointID); err != nil {
+		return fmt.Errorf("invalid endpoint id: %w", err)
+	}
 	if c.Addr == "" {
 		return fmt.Errorf("missing addr")
 	}
@@ -111,7 +601,7 @@ func (c *ListenerConfig) Validate() error {
 		if _, ok := c.URL(); !ok {
 			return fmt.Errorf("invalid addr")
 		}
-	} else if c.Protocol == ListenerProtocolTCP {
+	} else if c.Protocol == ListenerProtocolTCP || c.Protocol == ListenerProtocolUDP {
 		if _, ok := c.Host(); !ok {
 			return fmt.Errorf("invalid addr")
 		}
@@ -121,9 +611,137 @@ func (c *ListenerConfig) Validate() error {
 	if c.Timeout == 0 {
 		return fmt.Errorf("missing timeout")
 	}
+	if c.SampleRate < 0 {
+		return fmt.Errorf("sample rate cannot be negative")
+	}
+	if c.MaxConcurrent < 0 {
+		return fmt.Errorf("max concurrent cannot be negative")
+	}
+	if c.QueueTimeout < 0 {
+		return fmt.Errorf("queue timeout cannot be negative")
+	}
+	if c.HealthCheck.Enabled() && !c.isHTTP() {
+		return fmt.Errorf("health check: unsupported protocol")
+	}
+	if err := c.HealthCheck.Validate(); err != nil {
+		return fmt.Errorf("health check: %w", err)
+	}
+	if c.Record.Enabled() && !c.isHTTP() {
+		return fmt.Errorf("record: unsupported protocol")
+	}
+	if err := c.Record.Validate(); err != nil {
+		return fmt.Errorf("record: %w", err)
+	}
+	if c.Compression.Enabled() && !c.isHTTP() {
+		return fmt.Errorf("compression: unsupported protocol")
+	}
+	if err := c.Compression.Validate(); err != nil {
+		return fmt.Errorf("compression: %w", err)
+	}
+	if c.Rewrite.Enabled && !c.isHTTP() {
+		return fmt.Errorf("rewrite: unsupported protocol")
+	}
+	if err := c.Rewrite.Validate(); err != nil {
+		return fmt.Errorf("rewrite: %w", err)
+	}
+	if c.Redirects.Follow && !c.isHTTP() {
+		return fmt.Errorf("redirects: unsupported protocol")
+	}
+	if err := c.Redirects.Validate(); err != nil {
+		return fmt.Errorf("redirects: %w", err)
+	}
+	if c.Mirror.Enabled() && !c.isHTTP() {
+		return fmt.Errorf("mirror: unsupported protocol")
+	}
+	if err := c.Mirror.Validate(); err != nil {
+		return fmt.Errorf("mirror: %w", err)
+	}
+	if c.CertCheck.Enabled {
+		if u, ok := c.URL(); !ok || u.Scheme != "https" {
+			return fmt.Errorf("cert check: upstream must use https")
+		}
+	}
+	if err := c.CertCheck.Validate(); err != nil {
+		return fmt.Errorf("cert check: %w", err)
+	}
+	if err := c.TCP.Validate(); err != nil {
+		return fmt.Errorf("tcp: %w", err)
+	}
 	if err := c.TLS.Validate(); err != nil {
 		return fmt.Errorf("tls: %w", err)
 	}
+	if _, err := c.LocalTCPAddrs(); err != nil {
+		return fmt.Errorf("local addrs: %w", err)
+	}
+	if len(c.Routes) > 0 && !c.isHTTP() {
+		return fmt.Errorf("routes: unsupported protocol")
+	}
+	for i, route := range c.Routes {
+		if err := route.Validate(); err != nil {
+			return fmt.Errorf("routes: %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// RouteConfig configures forwarding requests matching the route to a
+// different upstream address than the listener.
+//
+// A request matches if it matches all configured conditions.
+type RouteConfig struct {
+	// PathPrefix matches requests whose path starts with the prefix.
+	//
+	// The prefix matches whole path segments, so '/api' matches '/api' and
+	// '/api/users' though not '/apiv2'.
+	PathPrefix string `json:"path_prefix" yaml:"path_prefix"`
+
+	// Headers matches requests with each header set to the given value.
+	Headers map[string]string `json:"headers" yaml:"headers"`
+
+	// Addr is the address of the upstream service to forward matching
+	// requests to, with the same format as the listener address.
+	Addr string `json:"addr" yaml:"addr"`
+
+	// StripPrefix removes PathPrefix from the request path before
+	// forwarding.
+	StripPrefix bool `json:"strip_prefix" yaml:"strip_prefix"`
+}
+
+// URL parses the route address into a URL. Return false if the address is
+// invalid.
+func (c *RouteConfig) URL() (*url.URL, bool) {
+	listener := ListenerConfig{Addr: c.Addr}
+	return listener.URL()
+}
+
+// UpstreamHostPort returns the host and port of the route address. Return
+// false if the address is invalid.
+func (c *RouteConfig) UpstreamHostPort() (string, int, bool) {
+	listener := ListenerConfig{Addr: c.Addr}
+	return listener.UpstreamHostPort()
+}
+
+func (c *RouteConfig) Validate() error {
+	if c.PathPrefix == "" && len(c.Headers) == 0 {
+		return fmt.Errorf("missing path prefix or headers")
+	}
+	if c.PathPrefix != "" && !strings.HasPrefix(c.PathPrefix, "/") {
+		return fmt.Errorf("path prefix must start with '/'")
+	}
+	if c.StripPrefix && c.PathPrefix == "" {
+		return fmt.Errorf("strip prefix requires path prefix")
+	}
+	for name := range c.Headers {
+		if name == "" {
+			return fmt.Errorf("headers: missing name")
+		}
+	}
+	if c.Addr == "" {
+		return fmt.Errorf("missing addr")
+	}
+	if _, ok := c.URL(); !ok {
+		return fmt.Errorf("invalid addr")
+	}
 	return nil
 }
 
@@ -235,6 +853,45 @@ type ConnectConfig struct {
 	// boot.
 	Timeout time.Duration `json:"timeout" yaml:"timeout"`
 
+	// WriteCoalesceDelay is the duration to wait for more frames before
+	// writing small frames to the Piko server, so frames are coalesced into
+	// a single WebSocket message.
+	//
+	// Zero only coalesces frames that are already queued.
+	WriteCoalesceDelay time.Duration `json:"write_coalesce_delay" yaml:"write_coalesce_delay"`
+
+	// MaxStreams is the maximum number of concurrent streams to accept on
+	// each connection to the Piko server.
+	//
+	// Zero uses the server limit.
+	MaxStreams int `json:"max_streams" yaml:"max_streams"`
+
+	// StreamWindow is the maximum receive window of each stream in bytes.
+	//
+	// Zero sizes the window from the measured round trip time to the server.
+	StreamWindow uint32 `json:"stream_window" yaml:"stream_window"`
+
+	// MaxMessageSize is the maximum size of each WebSocket message written
+	// to the Piko server in bytes.
+	//
+	// Zero uses the default of 64KB.
+	MaxMessageSize int `json:"max_message_size" yaml:"max_message_size"`
+
+	// MinMessageSize is the minimum size the message size is reduced to
+	// after repeated write timeouts.
+	//
+	// Zero disables reducing the message size.
+	MinMessageSize int `json:"min_message_size" yaml:"min_message_size"`
+
+	// MultiplexEndpoints is the maximum number of listeners that share each
+	// connection to the Piko server. Listeners are packed into connections
+	// in the order they're configured.
+	//
+	// Zero or one uses a connection for each listener.
+	MultiplexEndpoints int `json:"multiplex_endpoints" yaml:"multiplex_endpoints"`
+
+	Reconnect ReconnectConfig `json:"reconnect" yaml:"reconnect"`
+
 	TLS TLSConfig `json:"tls" yaml:"tls"`
 }
 
@@ -248,6 +905,45 @@ func (c *ConnectConfig) Validate() error {
 	if c.Timeout == 0 {
 		return fmt.Errorf("missing timeout")
 	}
+	if c.WriteCoalesceDelay < 0 {
+		return fmt.Errorf("write coalesce delay cannot be negative")
+	}
+	if c.MaxStreams < 0 {
+		return fmt.Errorf("max streams cannot be negative")
+	}
+	if c.StreamWindow != 0 && c.StreamWindow < protocol.InitialStreamWindow {
+		return fmt.Errorf("stream window must be at least %d", protocol.InitialStreamWindow)
+	}
+	if c.MaxMessageSize != 0 &&
+		(c.MaxMessageSize < websocket.MinMessageSize || c.MaxMessageSize > websocket.MaxMessageSize) {
+		return fmt.Errorf(
+			"max message size must be between %d and %d",
+			websocket.MinMessageSize, websocket.MaxMessageSize,
+		)
+	}
+	if c.MinMessageSize != 0 {
+		maxMessageSize := c.MaxMessageSize
+		if maxMessageSize == 0 {
+			maxMessageSize = websocket.MaxMessageSize
+		}
+		if c.MinMessageSize < websocket.MinMessageSize || c.MinMessageSize > maxMessageSize {
+			return fmt.Errorf(
+				"min message size must be between %d and the max message size",
+				websocket.MinMessageSize,
+			)
+		}
+	}
+	if c.MultiplexEndpoints < 0 {
+		return fmt.Errorf("multiplex endpoints cannot be negative")
+	}
+	if c.MultiplexEndpoints > protocol.MaxMultiplexedEndpoints {
+		return fmt.Errorf(
+			"multiplex endpoints cannot exceed %d", protocol.MaxMultiplexedEndpoints,
+		)
+	}
+	if err := c.Reconnect.Validate(); err != nil {
+		return fmt.Errorf("reconnect: %w", err)
+	}
 	if err := c.TLS.Validate(); err != nil {
 		return fmt.Errorf("tls: %w", err)
 	}
@@ -279,12 +975,190 @@ Token is a token to authenticate with the Piko server.`,
 		`
 Timeout attempting to connect to the Piko server on boot. Note if the agent
 is disconnected after the initial connection succeeds it will keep trying to
-reconnect.`,
+reconnect (see '--connect.reconnect.max-retries').`,
+	)
+
+	fs.DurationVar(
+		&c.WriteCoalesceDelay,
+		"connect.write-coalesce-delay",
+		c.WriteCoalesceDelay,
+		`
+Duration to wait for more frames before writing small frames to the Piko
+server, so frames from chatty protocols are coalesced into a single
+WebSocket message, reducing syscall and TLS record overhead at the cost of
+added latency.
+
+The delay only applies when few bytes are queued, so it doesn't slow bulk
+transfers, and control frames (such as pings) are never delayed.
+
+Zero only coalesces frames that are already queued, which adds no latency.`,
+	)
+
+	fs.IntVar(
+		&c.MaxStreams,
+		"connect.max-streams",
+		c.MaxStreams,
+		`
+Maximum number of concurrent streams (connections or in-flight HTTP requests)
+to accept on each listener connection to the Piko server.
+
+The server uses the lower of this limit and its own configured limit. Once a
+connection reaches the limit, the server sends new streams to the endpoint's
+other connections, or queues them until a stream closes.
+
+Zero uses the server limit.`,
+	)
+
+	fs.Uint32Var(
+		&c.StreamWindow,
+		"connect.stream-window",
+		c.StreamWindow,
+		`
+Maximum receive window of each stream in bytes, which bounds the throughput
+of each stream to the window divided by the round trip time.
+
+Zero sizes the window from the bandwidth-delay product of the link, using the
+round trip time measured when connecting to the server, between 256KB and
+16MB, which improves throughput on high latency links without manual tuning.
+
+Otherwise the window must be at least 256KB (262144).`,
+	)
+
+	fs.IntVar(
+		&c.MaxMessageSize,
+		"connect.max-message-size",
+		c.MaxMessageSize,
+		`
+Maximum size of each WebSocket message written to the Piko server in bytes,
+between 1KB (1024) and 64KB (65536). The server limits the messages it writes
+to the agent to the same size.
+
+Smaller messages bound the size of each WebSocket frame and TLS record, which
+can improve reliability on networks that drop large packets, such as networks
+with broken path MTU discovery, at the cost of more per-message overhead.
+
+Zero uses the default of 64KB.`,
+	)
+
+	fs.IntVar(
+		&c.MinMessageSize,
+		"connect.min-message-size",
+		c.MinMessageSize,
+		`
+Enables automatically reducing the message size when the connection to the
+Piko server repeatedly fails due to write or keep-alive timeouts, which
+suggests large packets are being dropped.
+
+After consecutive timeouts, the message size is halved each time the agent
+reconnects, down to this minimum. The reduced size is kept until the agent
+restarts.
+
+Zero disables reducing the message size.`,
+	)
+
+	fs.IntVar(
+		&c.MultiplexEndpoints,
+		"connect.multiplex-endpoints",
+		c.MultiplexEndpoints,
+		`
+Maximum number of listeners that share each connection to the Piko server,
+rather than opening a connection for each listener, which reduces the number
+of connections for agents with many listeners.
+
+Listeners are packed into connections in the order they're configured, such
+as 50 listeners with '--connect.multiplex-endpoints 20' use 3 connections.
+Listeners with local addresses (multipath) always use their own connections.
+A multiplexed connection applies '--connect.max-streams' to the connection
+as a whole, and if it disconnects, all of its listeners reconnect together.
+
+Requires a Piko server that supports multiplexed connections.
+
+Zero or one uses a connection for each listener.`,
 	)
 
+	c.Reconnect.RegisterFlags(fs)
 	c.TLS.RegisterFlags(fs, "connect")
 }
 
+// ReconnectConfig configures how the agent reconnects to the Piko server
+// after the connection drops.
+type ReconnectConfig struct {
+	// MinBackoff is the backoff after the first failed reconnect attempt.
+	MinBackoff time.Duration `json:"min_backoff" yaml:"min_backoff"`
+
+	// MaxBackoff is the maximum backoff between reconnect attempts.
+	MaxBackoff time.Duration `json:"max_backoff" yaml:"max_backoff"`
+
+	// Jitter is the maximum fraction of each backoff added as random jitter.
+	Jitter float64 `json:"jitter" yaml:"jitter"`
+
+	// MaxRetries is the maximum number of consecutive failed reconnect
+	// attempts before the agent gives up and exits.
+	//
+	// Zero retries forever.
+	MaxRetries int `json:"max_retries" yaml:"max_retries"`
+}
+
+func (c *ReconnectConfig) Validate() error {
+	if c.MinBackoff <= 0 {
+		return fmt.Errorf("min backoff must be positive")
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		return fmt.Errorf("max backoff cannot be less than min backoff")
+	}
+	if c.Jitter <= 0 || c.Jitter > 1 {
+		return fmt.Errorf("jitter must be greater than 0 and at most 1")
+	}
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("max retries cannot be negative")
+	}
+	return nil
+}
+
+func (c *ReconnectConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.DurationVar(
+		&c.MinBackoff,
+		"connect.reconnect.min-backoff",
+		c.MinBackoff,
+		`
+Backoff after the first failed attempt to reconnect to the Piko server. The
+backoff doubles after each failed attempt, up to
+'--connect.reconnect.max-backoff'.`,
+	)
+
+	fs.DurationVar(
+		&c.MaxBackoff,
+		"connect.reconnect.max-backoff",
+		c.MaxBackoff,
+		`
+Maximum backoff between attempts to reconnect to the Piko server.`,
+	)
+
+	fs.Float64Var(
+		&c.Jitter,
+		"connect.reconnect.jitter",
+		c.Jitter,
+		`
+Maximum fraction of each reconnect backoff added as random jitter, greater
+than 0 and at most 1, such as 0.5 adds up to 50% to each backoff.
+
+Jitter spreads out reconnects from agents that disconnect at the same time,
+such as when a Piko server restarts, so they don't all reconnect at once.`,
+	)
+
+	fs.IntVar(
+		&c.MaxRetries,
+		"connect.reconnect.max-retries",
+		c.MaxRetries,
+		`
+Maximum number of consecutive failed attempts to reconnect to the Piko server
+before the agent gives up and exits, such as to let a supervisor restart the
+agent.
+
+Zero retries forever.`,
+	)
+}
+
 type ServerConfig struct {
 	// Enabled indicates whether to enable the agent metrics server.
 	Enabled bool `json:"enabled" yaml:"enabled"`
@@ -326,6 +1200,317 @@ If the host is unspecified it defaults to all listeners, such as
 	)
 }
 
+// EgressConfig configures which upstream addresses listeners may forward
+// to.
+//
+// This prevents a listener configuration from being used to reach
+// arbitrary systems on the agent's network, such as when the listeners are
+// configured by another team or system.
+type EgressConfig struct {
+	// Allow contains the upstream addresses listeners may forward to.
+	//
+	// Each entry is a host name, IP address or CIDR, with an optional port
+	// or port range, such as 'localhost:3000', '10.0.0.0/8:443' or
+	// '127.0.0.1:8000-8100'. IPv6 addresses with a port must be enclosed
+	// in square brackets, such as '[fd00::/8]:443'. An entry without a
+	// port permits all ports.
+	//
+	// Host name entries only match listeners configured with that host
+	// name. IP and CIDR entries match the address the agent connects to,
+	// so also match host names that resolve to a permitted address.
+	//
+	// If empty, listeners may forward to any address, unless
+	// DenyByDefault is set.
+	Allow []string `json:"allow" yaml:"allow"`
+
+	// DenyByDefault denies forwarding to any address not in Allow, even if
+	// Allow is empty, so a configuration missing the allow list fails
+	// closed.
+	DenyByDefault bool `json:"deny_by_default" yaml:"deny_by_default"`
+}
+
+// Enabled returns whether upstream addresses are restricted.
+func (c *EgressConfig) Enabled() bool {
+	return len(c.Allow) > 0 || c.DenyByDefault
+}
+
+// Policy returns the parsed egress policy, or nil if upstream addresses
+// aren't restricted.
+func (c *EgressConfig) Policy() (*EgressPolicy, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+
+	policy := &EgressPolicy{}
+	for _, entry := range c.Allow {
+		rule, err := parseEgressRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry: %s: %w", entry, err)
+		}
+		policy.rules = append(policy.rules, rule)
+	}
+	return policy, nil
+}
+
+func (c *EgressConfig) Validate() error {
+	if _, err := c.Policy(); err != nil {
+		return fmt.Errorf("allow: %w", err)
+	}
+	return nil
+}
+
+func (c *EgressConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(
+		&c.Allow,
+		"egress.allow",
+		c.Allow,
+		`
+Upstream addresses listeners may forward to.
+
+Each entry is a host name, IP address or CIDR, with an optional port or
+port range, such as 'localhost:3000', '10.0.0.0/8:443' or
+'127.0.0.1:8000-8100'. IPv6 addresses with a port must be enclosed in
+square brackets, such as '[fd00::/8]:443'. An entry without a port permits
+all ports.
+
+Host name entries only match listeners configured with that host name. IP
+and CIDR entries match the address the agent connects to, so also match
+host names that resolve to a permitted address.
+
+The agent fails to start if a listener forwards to an address that isn't
+permitted, and refuses to connect to any resolved address that isn't
+permitted.
+
+Note if the agent connects to upstreams via an HTTP proxy (such as
+configured with 'HTTP_PROXY'), the proxy address must also be permitted.
+
+If empty, listeners may forward to any address, unless
+'--egress.deny-by-default' is set.`,
+	)
+
+	fs.BoolVar(
+		&c.DenyByDefault,
+		"egress.deny-by-default",
+		c.DenyByDefault,
+		`
+Deny forwarding to any address not in '--egress.allow', even if
+'--egress.allow' is empty, so a configuration missing the allow list fails
+closed.`,
+	)
+}
+
+// EncryptionConfig configures encrypting data the agent stores on disk, such
+// as recorded upstream responses.
+type EncryptionConfig struct {
+	// KeyFiles are paths to files containing 32 byte AES-256 keys, either
+	// base64 or hex encoded, such as generated with
+	// 'openssl rand -base64 32'.
+	//
+	// The first key encrypts new data, and all keys decrypt existing data.
+	// To rotate keys, add the new key first and keep the previous key until
+	// existing data has been re-encrypted with the new key.
+	//
+	// If empty, stored data isn't encrypted.
+	KeyFiles []string `json:"key_files" yaml:"key_files"`
+}
+
+// Enabled returns whether stored data is encrypted.
+func (c *EncryptionConfig) Enabled() bool {
+	return len(c.KeyFiles) > 0
+}
+
+func (c *EncryptionConfig) Validate() error {
+	for _, path := range c.KeyFiles {
+		if path == "" {
+			return fmt.Errorf("missing key file")
+		}
+	}
+	return nil
+}
+
+// Keyring loads the keyring from the key files, or returns nil if stored
+// data isn't encrypted.
+func (c *EncryptionConfig) Keyring() (*encrypt.Keyring, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	return encrypt.LoadKeyring(c.KeyFiles)
+}
+
+func (c *EncryptionConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(
+		&c.KeyFiles,
+		"encryption.key-files",
+		c.KeyFiles,
+		`
+Paths to files containing 32 byte AES-256 keys, either base64 or hex encoded,
+used to encrypt data the agent stores on disk, such as recorded responses.
+Generate a key with 'openssl rand -base64 32'.
+
+The first key encrypts new data, and all keys decrypt existing data. To rotate
+keys, add the new key first and keep the previous key until existing data has
+been re-encrypted with the new key.
+
+If not given, stored data isn't encrypted.`,
+	)
+}
+
+// EgressPolicy checks whether listeners may forward to an upstream address.
+//
+// A nil policy permits all addresses.
+type EgressPolicy struct {
+	rules []egressRule
+}
+
+// PermitsHost returns whether the policy may permit forwarding to the given
+// upstream host and port.
+//
+// If the host is a host name not matched by a host name rule, it may still
+// resolve to a permitted address, so is permitted if any IP rule matches the
+// port. The resolved address is checked when connecting with Control.
+func (p *EgressPolicy) PermitsHost(host string, port int) bool {
+	if p == nil {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(host)
+	for _, rule := range p.rules {
+		if !rule.matchesPort(port) {
+			continue
+		}
+		if err == nil {
+			if rule.matchesAddr(addr) {
+				return true
+			}
+			continue
+		}
+		if rule.matchesHost(host) || rule.prefix.IsValid() {
+			return true
+		}
+	}
+	return false
+}
+
+// Permits returns whether the policy permits connecting to the given
+// address and port, resolved from the given configured upstream host.
+func (p *EgressPolicy) Permits(host string, addr netip.Addr, port int) bool {
+	if p == nil {
+		return true
+	}
+
+	for _, rule := range p.rules {
+		if !rule.matchesPort(port) {
+			continue
+		}
+		if rule.matchesHost(host) || rule.matchesAddr(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Control returns a net.Dialer Control function that refuses to connect to
+// addresses the policy doesn't permit, where host is the configured upstream
+// host.
+//
+// Returns nil if the policy is nil.
+func (p *EgressPolicy) Control(host string) func(string, string, syscall.RawConn) error {
+	if p == nil {
+		return nil
+	}
+
+	return func(_ string, address string, _ syscall.RawConn) error {
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return fmt.Errorf("egress policy: invalid address: %s", address)
+		}
+		if !p.Permits(host, addrPort.Addr(), int(addrPort.Port())) {
+			return fmt.Errorf("egress policy: address not permitted: %s", address)
+		}
+		return nil
+	}
+}
+
+type egressRule struct {
+	// host is the lowercase host name to match, or empty if the rule matches
+	// an IP prefix.
+	host string
+
+	prefix netip.Prefix
+
+	minPort int
+	maxPort int
+}
+
+func parseEgressRule(s string) (egressRule, error) {
+	host := s
+	ports := ""
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host = h
+		ports = p
+	}
+	if host == "" {
+		return egressRule{}, fmt.Errorf("missing host")
+	}
+
+	rule := egressRule{
+		minPort: 0,
+		maxPort: 0xffff,
+	}
+	if ports != "" {
+		minPort, maxPort, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			maxPort = minPort
+		}
+		var err error
+		rule.minPort, err = parseEgressPort(minPort)
+		if err != nil {
+			return egressRule{}, err
+		}
+		rule.maxPort, err = parseEgressPort(maxPort)
+		if err != nil {
+			return egressRule{}, err
+		}
+		if rule.minPort > rule.maxPort {
+			return egressRule{}, fmt.Errorf("invalid port range")
+		}
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		rule.prefix = netip.PrefixFrom(addr, addr.BitLen())
+	} else if strings.Contains(host, "/") {
+		prefix, err := netip.ParsePrefix(host)
+		if err != nil {
+			return egressRule{}, fmt.Errorf("invalid cidr")
+		}
+		rule.prefix = prefix.Masked()
+	} else {
+		rule.host = strings.ToLower(host)
+	}
+	return rule, nil
+}
+
+func parseEgressPort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 0xffff {
+		return 0, fmt.Errorf("invalid port: %s", s)
+	}
+	return port, nil
+}
+
+func (r *egressRule) matchesPort(port int) bool {
+	return port >= r.minPort && port <= r.maxPort
+}
+
+func (r *egressRule) matchesHost(host string) bool {
+	return r.host != "" && r.host == strings.ToLower(host)
+}
+
+func (r *egressRule) matchesAddr(addr netip.Addr) bool {
+	return r.prefix.IsValid() && r.prefix.Contains(addr.Unmap())
+}
+
 type Config struct {
 	Listeners []ListenerConfig `json:"listeners" yaml:"listeners"`
 
@@ -333,8 +1518,21 @@ type Config struct {
 
 	Server ServerConfig `json:"server" yaml:"server"`
 
+	Egress EgressConfig `json:"egress" yaml:"egress"`
+
+	Encryption EncryptionConfig `json:"encryption" yaml:"encryption"`
+
+	Runtime goruntime.Config `json:"runtime" yaml:"runtime"`
+
 	Log log.Config `json:"log" yaml:"log"`
 
+	// HeaderPrefix is the prefix of the names of the headers the agent adds
+	// when connecting to the Piko server and to proxied responses, and the
+	// headers the server adds to proxied requests.
+	//
+	// Must match the prefix configured by the Piko server.
+	HeaderPrefix string `json:"header_prefix" yaml:"header_prefix"`
+
 	// GracePeriod is the duration to gracefully shutdown the agent. During
 	// the grace period, listeners and idle connections are closed, then waits
 	// for active requests to complete and closes their connections.
@@ -346,6 +1544,11 @@ func Default() *Config {
 		Connect: ConnectConfig{
 			URL:     "http://localhost:8001",
 			Timeout: time.Second * 30,
+			Reconnect: ReconnectConfig{
+				MinBackoff: time.Millisecond * 100,
+				MaxBackoff: time.Second * 15,
+				Jitter:     backoff.DefaultJitter,
+			},
 		},
 		Server: ServerConfig{
 			BindAddr: ":5000",
@@ -353,11 +1556,18 @@ func Default() *Config {
 		Log: log.Config{
 			Level: "info",
 		},
-		GracePeriod: time.Minute,
+		HeaderPrefix: protocol.DefaultHeaderPrefix,
+		GracePeriod:  time.Minute,
 	}
 }
 
 func (c *Config) Validate() error {
+	if err := c.Egress.Validate(); err != nil {
+		return fmt.Errorf("egress: %w", err)
+	}
+	// Already validated.
+	egress, _ := c.Egress.Policy()
+
 	// Note don't validate the number of listeners, as some commands don't
 	// require any.
 	for _, e := range c.Listeners {
@@ -367,6 +1577,11 @@ func (c *Config) Validate() error {
 			}
 			return fmt.Errorf("listener: %w", err)
 		}
+		if !e.PermittedBy(egress) {
+			return fmt.Errorf(
+				"listener: %s: addr not permitted by egress policy", e.EndpointID,
+			)
+		}
 	}
 
 	if err := c.Connect.Validate(); err != nil {
@@ -377,10 +1592,22 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("server: %w", err)
 	}
 
+	if err := c.Encryption.Validate(); err != nil {
+		return fmt.Errorf("encryption: %w", err)
+	}
+
+	if err := c.Runtime.Validate(); err != nil {
+		return fmt.Errorf("runtime: %w", err)
+	}
+
 	if err := c.Log.Validate(); err != nil {
 		return fmt.Errorf("log: %w", err)
 	}
 
+	if err := protocol.ValidateHeaderPrefix(c.HeaderPrefix); err != nil {
+		return fmt.Errorf("header prefix: %w", err)
+	}
+
 	if c.GracePeriod == 0 {
 		return fmt.Errorf("missing grace period")
 	}
@@ -391,8 +1618,23 @@ func (c *Config) Validate() error {
 func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
 	c.Connect.RegisterFlags(fs)
 	c.Server.RegisterFlags(fs)
+	c.Egress.RegisterFlags(fs)
+	c.Encryption.RegisterFlags(fs)
+	c.Runtime.RegisterFlags(fs)
 	c.Log.RegisterFlags(fs)
 
+	fs.StringVar(
+		&c.HeaderPrefix,
+		"header-prefix",
+		c.HeaderPrefix,
+		`
+Prefix of the names of the headers the agent adds when connecting to Piko
+and to proxied responses, and the headers Piko adds to proxied requests,
+such as 'x-piko-request-id'.
+
+Must match the '--header-prefix' configured by the Piko server.`,
+	)
+
 	fs.DurationVar(
 		&c.GracePeriod,
 		"grace-period",
@@ -1,10 +1,14 @@
 package config
 
 import (
+	"net"
+	"net/netip"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // Tests the default configuration is valid.
@@ -73,3 +77,385 @@ func TestListenerConfig_URL(t *testing.T) {
 		})
 	}
 }
+
+func TestListenerConfig_LocalTCPAddrs(t *testing.T) {
+	conf := &ListenerConfig{
+		LocalAddrs: []string{"10.0.0.1", "::1"},
+	}
+	addrs, err := conf.LocalTCPAddrs()
+	assert.NoError(t, err)
+	assert.Equal(t, []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("10.0.0.1")},
+		&net.TCPAddr{IP: net.ParseIP("::1")},
+	}, addrs)
+
+	conf.LocalAddrs = []string{"eth0"}
+	_, err = conf.LocalTCPAddrs()
+	assert.Error(t, err)
+}
+
+func TestListenerConfig_UpstreamHostPort(t *testing.T) {
+	tests := []struct {
+		addr     string
+		protocol ListenerProtocol
+		host     string
+		port     int
+	}{
+		{addr: "8080", host: "localhost", port: 8080},
+		{addr: "https://google.com", host: "google.com", port: 443},
+		{addr: "http://10.0.0.1", host: "10.0.0.1", port: 80},
+		{addr: "[::1]:8080", host: "::1", port: 8080},
+		{addr: "10.0.0.1:22", protocol: ListenerProtocolTCP, host: "10.0.0.1", port: 22},
+		{addr: "53", protocol: ListenerProtocolUDP, host: "localhost", port: 53},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.addr, func(t *testing.T) {
+			conf := &ListenerConfig{Addr: tt.addr, Protocol: tt.protocol}
+			host, port, ok := conf.UpstreamHostPort()
+			assert.True(t, ok)
+			assert.Equal(t, tt.host, host)
+			assert.Equal(t, tt.port, port)
+		})
+	}
+}
+
+func TestEgressConfig_Policy(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		conf := &EgressConfig{}
+		policy, err := conf.Policy()
+		assert.NoError(t, err)
+		assert.Nil(t, policy)
+		assert.True(t, policy.PermitsHost("10.0.0.1", 22))
+	})
+
+	t.Run("deny by default", func(t *testing.T) {
+		conf := &EgressConfig{DenyByDefault: true}
+		policy, err := conf.Policy()
+		assert.NoError(t, err)
+		assert.False(t, policy.PermitsHost("localhost", 3000))
+		assert.False(t, policy.Permits("localhost", netip.MustParseAddr("127.0.0.1"), 3000))
+	})
+
+	t.Run("allow", func(t *testing.T) {
+		conf := &EgressConfig{
+			Allow: []string{
+				"localhost:3000",
+				"10.0.0.0/8:443",
+				"127.0.0.1:8000-8100",
+				"[fd00::/8]:443",
+				"192.168.1.1",
+			},
+		}
+		policy, err := conf.Policy()
+		require.NoError(t, err)
+
+		assert.True(t, policy.PermitsHost("LOCALHOST", 3000))
+		assert.True(t, policy.PermitsHost("10.1.2.3", 443))
+		assert.False(t, policy.PermitsHost("10.1.2.3", 80))
+		assert.True(t, policy.PermitsHost("127.0.0.1", 8050))
+		assert.False(t, policy.PermitsHost("127.0.0.1", 8101))
+		assert.True(t, policy.PermitsHost("fd00::1", 443))
+		assert.True(t, policy.PermitsHost("192.168.1.1", 22))
+		assert.False(t, policy.PermitsHost("169.254.169.254", 80))
+		// Host names may resolve to a permitted address.
+		assert.True(t, policy.PermitsHost("internal.example.com", 443))
+
+		assert.True(t, policy.Permits(
+			"localhost", netip.MustParseAddr("127.0.0.1"), 3000,
+		))
+		assert.True(t, policy.Permits(
+			"internal.example.com", netip.MustParseAddr("::ffff:10.0.0.1"), 443,
+		))
+		assert.False(t, policy.Permits(
+			"internal.example.com", netip.MustParseAddr("169.254.169.254"), 443,
+		))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, entry := range []string{
+			":443", "10.0.0.0/33", "localhost:abc", "localhost:100-10", "localhost:70000",
+		} {
+			conf := &EgressConfig{Allow: []string{entry}}
+			_, err := conf.Policy()
+			assert.Error(t, err, entry)
+		}
+	})
+}
+
+func TestConfig_ValidateEgress(t *testing.T) {
+	conf := Default()
+	conf.Listeners = []ListenerConfig{{
+		EndpointID: "my-endpoint",
+		Addr:       "169.254.169.254:80",
+		Timeout:    time.Second,
+	}}
+	conf.Egress.Allow = []string{"127.0.0.1"}
+	assert.EqualError(
+		t, conf.Validate(), "listener: my-endpoint: addr not permitted by egress policy",
+	)
+
+	conf.Egress.Allow = []string{"169.254.169.254:80"}
+	assert.NoError(t, conf.Validate())
+
+	// Route addresses must also be permitted.
+	conf.Listeners[0].Routes = []RouteConfig{{
+		PathPrefix: "/api",
+		Addr:       "http://127.0.0.1:9000",
+	}}
+	assert.EqualError(
+		t, conf.Validate(), "listener: my-endpoint: addr not permitted by egress policy",
+	)
+}
+
+func TestListenerConfig_ValidateRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []RouteConfig
+		err    string
+	}{
+		{
+			name: "ok",
+			routes: []RouteConfig{
+				{PathPrefix: "/api", Addr: "9000", StripPrefix: true},
+				{Headers: map[string]string{"X-Version": "2"}, Addr: "http://localhost:9001"},
+			},
+		},
+		{
+			name:   "missing match",
+			routes: []RouteConfig{{Addr: "9000"}},
+			err:    "routes: 0: missing path prefix or headers",
+		},
+		{
+			name:   "invalid path prefix",
+			routes: []RouteConfig{{PathPrefix: "api", Addr: "9000"}},
+			err:    "routes: 0: path prefix must start with '/'",
+		},
+		{
+			name: "strip without prefix",
+			routes: []RouteConfig{{
+				Headers:     map[string]string{"X-Version": "2"},
+				Addr:        "9000",
+				StripPrefix: true,
+			}},
+			err: "routes: 0: strip prefix requires path prefix",
+		},
+		{
+			name:   "missing addr",
+			routes: []RouteConfig{{PathPrefix: "/api"}},
+			err:    "routes: 0: missing addr",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := ListenerConfig{
+				EndpointID: "my-endpoint",
+				Addr:       "8000",
+				Timeout:    time.Second,
+				Routes:     tt.routes,
+			}
+			if tt.err == "" {
+				assert.NoError(t, conf.Validate())
+			} else {
+				assert.EqualError(t, conf.Validate(), tt.err)
+			}
+		})
+	}
+
+	t.Run("tcp", func(t *testing.T) {
+		conf := ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       "8000",
+			Protocol:   ListenerProtocolTCP,
+			Timeout:    time.Second,
+			Routes:     []RouteConfig{{PathPrefix: "/api", Addr: "9000"}},
+		}
+		assert.EqualError(t, conf.Validate(), "routes: unsupported protocol")
+	})
+}
+
+func TestListenerConfig_ValidateCompression(t *testing.T) {
+	tests := []struct {
+		name        string
+		protocol    ListenerProtocol
+		compression CompressionConfig
+		err         string
+	}{
+		{
+			name: "ok",
+			compression: CompressionConfig{
+				DecompressRequests: true,
+				MaxRequestSize:     1024,
+				CompressResponses:  true,
+			},
+		},
+		{
+			name:        "missing max request size",
+			compression: CompressionConfig{DecompressRequests: true},
+			err:         "compression: missing max request size",
+		},
+		{
+			name: "negative min response size",
+			compression: CompressionConfig{
+				CompressResponses: true,
+				MinResponseSize:   -1,
+			},
+			err: "compression: min response size cannot be negative",
+		},
+		{
+			name:        "tcp",
+			protocol:    ListenerProtocolTCP,
+			compression: CompressionConfig{CompressResponses: true},
+			err:         "compression: unsupported protocol",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := ListenerConfig{
+				EndpointID:  "my-endpoint",
+				Addr:        "8000",
+				Protocol:    tt.protocol,
+				Timeout:     time.Second,
+				Compression: tt.compression,
+			}
+			if tt.err == "" {
+				assert.NoError(t, conf.Validate())
+			} else {
+				assert.EqualError(t, conf.Validate(), tt.err)
+			}
+		})
+	}
+}
+
+func TestListenerConfig_ValidateRewrite(t *testing.T) {
+	tests := []struct {
+		name    string
+		rewrite RewriteConfig
+		err     string
+	}{
+		{
+			name: "ok",
+			rewrite: RewriteConfig{
+				Enabled:      true,
+				Origins:      []string{"http://127.0.0.1:8000"},
+				PublicOrigin: "https://example.com",
+			},
+		},
+		{
+			name: "invalid origin",
+			rewrite: RewriteConfig{
+				Enabled: true,
+				Origins: []string{"http://127.0.0.1:8000/foo"},
+			},
+			err: "rewrite: invalid origin: http://127.0.0.1:8000/foo",
+		},
+		{
+			name: "invalid public origin",
+			rewrite: RewriteConfig{
+				Enabled:      true,
+				PublicOrigin: "example.com",
+			},
+			err: "rewrite: invalid public origin",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := ListenerConfig{
+				EndpointID: "my-endpoint",
+				Addr:       "8000",
+				Timeout:    time.Second,
+				Rewrite:    tt.rewrite,
+			}
+			if tt.err == "" {
+				assert.NoError(t, conf.Validate())
+			} else {
+				assert.EqualError(t, conf.Validate(), tt.err)
+			}
+		})
+	}
+}
+
+func TestListenerConfig_ValidateRedirects(t *testing.T) {
+	conf := ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       "8000",
+		Timeout:    time.Second,
+		Redirects:  RedirectConfig{Follow: true, MaxHops: 5},
+	}
+	assert.NoError(t, conf.Validate())
+
+	conf.Redirects.MaxHops = 0
+	assert.EqualError(t, conf.Validate(), "redirects: missing max hops")
+
+	conf.Redirects.MaxHops = 5
+	conf.Protocol = ListenerProtocolTCP
+	assert.EqualError(t, conf.Validate(), "redirects: unsupported protocol")
+
+	conf.Protocol = ListenerProtocolUDP
+	assert.EqualError(t, conf.Validate(), "redirects: unsupported protocol")
+}
+
+func TestListenerConfig_ValidateMirror(t *testing.T) {
+	conf := ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       "8000",
+		Timeout:    time.Second,
+		Mirror: MirrorConfig{
+			URL:         "http://localhost:9000/mirror",
+			MaxBodySize: 1024,
+			QueueSize:   100,
+			Timeout:     time.Second,
+		},
+	}
+	assert.NoError(t, conf.Validate())
+
+	conf.Mirror.URL = "localhost:9000"
+	assert.EqualError(t, conf.Validate(), "mirror: invalid url")
+
+	conf.Mirror.URL = "http://localhost:9000/mirror"
+	conf.Mirror.SampleRate = -1
+	assert.EqualError(t, conf.Validate(), "mirror: sample rate cannot be negative")
+
+	conf.Mirror.SampleRate = 0
+	conf.Mirror.QueueSize = 0
+	assert.EqualError(t, conf.Validate(), "mirror: missing queue size")
+
+	conf.Mirror.QueueSize = 100
+	conf.Mirror.Timeout = 0
+	assert.EqualError(t, conf.Validate(), "mirror: missing timeout")
+
+	conf.Mirror.Timeout = time.Second
+	conf.Protocol = ListenerProtocolTCP
+	assert.EqualError(t, conf.Validate(), "mirror: unsupported protocol")
+}
+
+func TestListenerConfig_ValidateHealthCheck(t *testing.T) {
+	conf := ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       "8000",
+		Timeout:    time.Second,
+		HealthCheck: HealthCheckConfig{
+			Path:           "/healthz",
+			ExpectedStatus: 204,
+			Interval:       time.Second,
+			Timeout:        time.Second,
+		},
+	}
+	assert.NoError(t, conf.Validate())
+
+	conf.HealthCheck.Path = "healthz"
+	assert.EqualError(t, conf.Validate(), "health check: path must start with '/'")
+
+	conf.HealthCheck.Path = "/healthz"
+	conf.HealthCheck.ExpectedStatus = 1000
+	assert.EqualError(t, conf.Validate(), "health check: invalid expected status: 1000")
+
+	conf.HealthCheck.ExpectedStatus = 0
+	conf.HealthCheck.Interval = 0
+	assert.EqualError(t, conf.Validate(), "health check: missing interval")
+
+	conf.HealthCheck.Interval = time.Second
+	conf.Protocol = ListenerProtocolTCP
+	assert.EqualError(t, conf.Validate(), "health check: unsupported protocol")
+}
@@ -0,0 +1,93 @@
+// Package connect records the state of the agent connections to the Piko
+// server.
+package connect
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/andydunstall/piko/client"
+	"github.com/andydunstall/piko/pkg/websocket"
+)
+
+// Metrics records connect and reconnect attempts to the Piko server,
+// labelled by endpoint ID.
+type Metrics struct {
+	// AttemptsTotal is the number of attempts to connect to the Piko
+	// server, labelled by endpoint ID and result ('success' or 'failure').
+	AttemptsTotal *prometheus.CounterVec
+
+	// AbandonedTotal is the number of times a listener gave up connecting to
+	// the Piko server, either due to a non-retryable error or reaching the
+	// maximum number of retries.
+	AbandonedTotal *prometheus.CounterVec
+
+	// DisconnectsTotal is the number of times the connection to the Piko
+	// server dropped, labelled by endpoint ID and the close reason sent by
+	// the server (such as 'drained' or 'auth_expired'), or 'abnormal' if the
+	// connection dropped without a close reason.
+	DisconnectsTotal *prometheus.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		AttemptsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "agent",
+				Name:      "connect_attempts_total",
+				Help:      "Number of attempts to connect to the Piko server",
+			},
+			[]string{"endpoint", "result"},
+		),
+		AbandonedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "agent",
+				Name:      "connect_abandoned_total",
+				Help:      "Number of times a listener gave up connecting to the Piko server",
+			},
+			[]string{"endpoint"},
+		),
+		DisconnectsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "agent",
+				Name:      "disconnects_total",
+				Help:      "Number of times the connection to the Piko server dropped",
+			},
+			[]string{"endpoint", "reason"},
+		),
+	}
+}
+
+func (m *Metrics) OnConnect(endpointIDs []string, _ int) {
+	for _, endpointID := range endpointIDs {
+		m.AttemptsTotal.WithLabelValues(endpointID, "success").Inc()
+	}
+}
+
+func (m *Metrics) OnConnectFailed(endpointIDs []string, _ error, retry bool) {
+	for _, endpointID := range endpointIDs {
+		m.AttemptsTotal.WithLabelValues(endpointID, "failure").Inc()
+		if !retry {
+			m.AbandonedTotal.WithLabelValues(endpointID).Inc()
+		}
+	}
+}
+
+func (m *Metrics) OnDisconnect(endpointIDs []string, err error) {
+	reason := websocket.CloseCodeOf(err).String()
+	for _, endpointID := range endpointIDs {
+		m.DisconnectsTotal.WithLabelValues(endpointID, reason).Inc()
+	}
+}
+
+func (m *Metrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.AttemptsTotal,
+		m.AbandonedTotal,
+		m.DisconnectsTotal,
+	)
+}
+
+var _ client.ConnectObserver = &Metrics{}
@@ -0,0 +1,568 @@
+package doctor
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/doctor"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/pkg/websocket"
+)
+
+const (
+	// maxClockSkew is the maximum difference between the agent and server
+	// clocks before warning. This allows for the server 'Date' header
+	// having second precision.
+	maxClockSkew = 30 * time.Second
+
+	// certExpiryWarning is how long before the server certificate expires
+	// to warn.
+	certExpiryWarning = 7 * 24 * time.Hour
+
+	// defaultEndpointID is the endpoint to check when no listeners are
+	// configured.
+	defaultEndpointID = "piko-doctor"
+)
+
+// Doctor runs diagnostic checks of the agent configuration and its
+// connectivity to the Piko server and upstream services.
+//
+// The checks are ordered so each check depends on the previous checks
+// passing, such as the TLS check depends on the TCP check, so once a
+// server check fails the remaining server checks are skipped.
+type Doctor struct {
+	conf *config.Config
+
+	// timeout is the timeout of each check.
+	timeout time.Duration
+
+	resolver *net.Resolver
+}
+
+func NewDoctor(conf *config.Config, timeout time.Duration) *Doctor {
+	return &Doctor{
+		conf:     conf,
+		timeout:  timeout,
+		resolver: net.DefaultResolver,
+	}
+}
+
+// Run runs all checks and returns their results.
+func (d *Doctor) Run(ctx context.Context) []doctor.Result {
+	results := d.checkServer(ctx)
+	for _, listener := range d.conf.Listeners {
+		results = append(results, d.checkUpstream(ctx, listener))
+
+		for _, route := range listener.Routes {
+			routeConf := listener
+			routeConf.Addr = route.Addr
+			result := d.checkUpstream(ctx, routeConf)
+			result.Check += " (route " + route.Addr + ")"
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// checkServer checks connectivity to the Piko server.
+func (d *Doctor) checkServer(ctx context.Context) []doctor.Result {
+	checks := []string{"dns", "tcp", "tls", "clock", "token", "websocket"}
+
+	var results []doctor.Result
+	skip := func(reason string) []doctor.Result {
+		for _, check := range checks[len(results):] {
+			results = append(results, doctor.Result{
+				Check:   check,
+				Status:  doctor.StatusSkip,
+				Message: reason,
+			})
+		}
+		return results
+	}
+
+	u, err := url.Parse(d.conf.Connect.URL)
+	if err != nil || u.Hostname() == "" {
+		results = append(results, doctor.Result{
+			Check:   "dns",
+			Status:  doctor.StatusFail,
+			Message: fmt.Sprintf("invalid server url: %s", d.conf.Connect.URL),
+			Hint:    "Configure the Piko server URL with '--connect.url', such as 'https://piko.example.com:8001'.",
+		})
+		return skip("invalid server url")
+	}
+
+	results = append(results, d.checkDNS(ctx, u))
+	if results[len(results)-1].Status == doctor.StatusFail {
+		return skip("dns check failed")
+	}
+
+	results = append(results, d.checkTCP(ctx, u))
+	if results[len(results)-1].Status == doctor.StatusFail {
+		return skip("tcp check failed")
+	}
+
+	tlsConfig, err := d.conf.Connect.TLS.Load()
+	if err != nil {
+		results = append(results, doctor.Result{
+			Check:   "tls",
+			Status:  doctor.StatusFail,
+			Message: fmt.Sprintf("load tls config: %s", err.Error()),
+			Hint:    "Check the '--connect.tls.*' paths exist and contain PEM encoded files.",
+		})
+		return skip("tls check failed")
+	}
+	results = append(results, d.checkTLS(ctx, u, tlsConfig))
+	if results[len(results)-1].Status == doctor.StatusFail {
+		return skip("tls check failed")
+	}
+
+	clock, token := d.checkAuth(ctx, u, tlsConfig)
+	results = append(results, clock, token)
+	if token.Status == doctor.StatusFail {
+		return skip("token check failed")
+	}
+
+	results = append(results, d.checkWebSocket(ctx, u, tlsConfig))
+	return results
+}
+
+func (d *Doctor) checkDNS(ctx context.Context, u *url.URL) doctor.Result {
+	host := u.Hostname()
+	if net.ParseIP(host) != nil {
+		return doctor.Result{
+			Check:   "dns",
+			Status:  doctor.StatusSkip,
+			Message: fmt.Sprintf("server url uses ip address %s", host),
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	addrs, err := d.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return doctor.Result{
+			Check:   "dns",
+			Status:  doctor.StatusFail,
+			Message: fmt.Sprintf("resolve %s: %s", host, err.Error()),
+			Hint:    "Check the host in '--connect.url' is correct and the agent host can resolve public DNS names.",
+		}
+	}
+	return doctor.Result{
+		Check:   "dns",
+		Status:  doctor.StatusOK,
+		Message: fmt.Sprintf("resolved %s to %s", host, strings.Join(addrs, ", ")),
+	}
+}
+
+func (d *Doctor) checkTCP(ctx context.Context, u *url.URL) doctor.Result {
+	addr := serverAddr(u)
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	start := time.Now()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return doctor.Result{
+			Check:   "tcp",
+			Status:  doctor.StatusFail,
+			Message: fmt.Sprintf("connect %s: %s", addr, err.Error()),
+			Hint:    "Check the Piko server is running, '--connect.url' uses the server 'upstream' port, and no firewall blocks outbound connections to the port.",
+		}
+	}
+	rtt := time.Since(start)
+	conn.Close()
+
+	return doctor.Result{
+		Check:   "tcp",
+		Status:  doctor.StatusOK,
+		Message: fmt.Sprintf("connected to %s in %s", addr, rtt.Round(time.Millisecond)),
+	}
+}
+
+func (d *Doctor) checkTLS(ctx context.Context, u *url.URL, tlsConfig *tls.Config) doctor.Result {
+	if u.Scheme != "https" {
+		return doctor.Result{
+			Check:   "tls",
+			Status:  doctor.StatusSkip,
+			Message: "server url doesn't use https",
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	dialer := &tls.Dialer{
+		Config: tlsConfig,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", serverAddr(u))
+	if err != nil {
+		result := doctor.Result{
+			Check:   "tls",
+			Status:  doctor.StatusFail,
+			Message: fmt.Sprintf("handshake: %s", err.Error()),
+			Hint:    "Check '--connect.url' uses the server 'upstream' port and the server has TLS enabled.",
+		}
+		var unknownAuthorityErr x509.UnknownAuthorityError
+		var hostnameErr x509.HostnameError
+		var invalidErr x509.CertificateInvalidError
+		switch {
+		case errors.As(err, &unknownAuthorityErr):
+			result.Hint = "The server certificate isn't signed by a trusted CA. If the server uses a private CA, configure it with '--connect.tls.root-cas'."
+		case errors.As(err, &hostnameErr):
+			result.Hint = "The server certificate isn't valid for the host in '--connect.url'. Check the URL uses a host name in the certificate."
+		case errors.As(err, &invalidErr):
+			result.Hint = "The server certificate is invalid, such as it has expired. Check the server certificate and the agent system clock."
+		}
+		return result
+	}
+	defer conn.Close()
+
+	state := conn.(*tls.Conn).ConnectionState()
+	message := fmt.Sprintf("handshake succeeded using %s", tls.VersionName(state.Version))
+	if len(state.PeerCertificates) == 0 {
+		return doctor.Result{
+			Check:   "tls",
+			Status:  doctor.StatusOK,
+			Message: message,
+		}
+	}
+
+	expiry := state.PeerCertificates[0].NotAfter
+	message += fmt.Sprintf("; certificate expires %s", expiry.UTC().Format(time.RFC3339))
+	if time.Until(expiry) < certExpiryWarning {
+		return doctor.Result{
+			Check:   "tls",
+			Status:  doctor.StatusWarn,
+			Message: message,
+			Hint:    "The server certificate expires soon, so check it will be renewed.",
+		}
+	}
+	return doctor.Result{
+		Check:   "tls",
+		Status:  doctor.StatusOK,
+		Message: message,
+	}
+}
+
+// checkAuth checks the clock skew and token by sending a plain HTTP request
+// to the upstream path.
+//
+// The server authenticates the request and checks the endpoint is permitted
+// before attempting the WebSocket upgrade, so a rejected upgrade means the
+// token was accepted, without registering a listener.
+func (d *Doctor) checkAuth(
+	ctx context.Context,
+	u *url.URL,
+	tlsConfig *tls.Config,
+) (doctor.Result, doctor.Result) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	endpointID := d.endpointID()
+	reqURL := *u
+	reqURL.Path += protocol.UpstreamPath(endpointID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL.String(), nil)
+	if err != nil {
+		fail := doctor.Result{
+			Check:   "token",
+			Status:  doctor.StatusFail,
+			Message: fmt.Sprintf("request: %s", err.Error()),
+		}
+		return doctor.Result{Check: "clock", Status: doctor.StatusSkip, Message: "request failed"}, fail
+	}
+	if d.conf.Connect.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.conf.Connect.Token)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		fail := doctor.Result{
+			Check:   "token",
+			Status:  doctor.StatusFail,
+			Message: fmt.Sprintf("request: %s", err.Error()),
+			Hint:    "Check no proxy between the agent and server blocks the request.",
+		}
+		return doctor.Result{Check: "clock", Status: doctor.StatusSkip, Message: "request failed"}, fail
+	}
+	defer resp.Body.Close()
+
+	return checkClock(resp), d.checkToken(resp, endpointID)
+}
+
+func checkClock(resp *http.Response) doctor.Result {
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return doctor.Result{
+			Check:   "clock",
+			Status:  doctor.StatusSkip,
+			Message: "server response doesn't include a valid date",
+		}
+	}
+
+	skew := time.Since(serverTime).Round(time.Second)
+	if skew.Abs() > maxClockSkew {
+		return doctor.Result{
+			Check:   "clock",
+			Status:  doctor.StatusWarn,
+			Message: fmt.Sprintf("agent clock differs from the server by %s", skew),
+			Hint:    "Synchronize the system clock, such as using NTP, otherwise tokens may be rejected as expired or not yet valid.",
+		}
+	}
+	// The server date is truncated to the second, so a skew of up to a
+	// second is expected.
+	if skew.Abs() <= time.Second {
+		return doctor.Result{
+			Check:   "clock",
+			Status:  doctor.StatusOK,
+			Message: "agent clock matches the server",
+		}
+	}
+	return doctor.Result{
+		Check:   "clock",
+		Status:  doctor.StatusOK,
+		Message: fmt.Sprintf("agent clock differs from the server by %s", skew),
+	}
+}
+
+func (d *Doctor) checkToken(resp *http.Response, endpointID string) doctor.Result {
+	message := responseError(resp)
+
+	switch resp.StatusCode {
+	case http.StatusBadRequest:
+		// The request was authenticated but isn't a WebSocket upgrade.
+		if d.conf.Connect.Token == "" {
+			return doctor.Result{
+				Check:   "token",
+				Status:  doctor.StatusOK,
+				Message: "no token configured and the server accepted the request",
+			}
+		}
+		return doctor.Result{
+			Check:   "token",
+			Status:  doctor.StatusOK,
+			Message: fmt.Sprintf("token accepted for endpoint %s", endpointID),
+		}
+	case http.StatusUnauthorized:
+		result := doctor.Result{
+			Check:   "token",
+			Status:  doctor.StatusFail,
+			Message: fmt.Sprintf("server rejected the token: %s", message),
+			Hint:    "Check '--connect.token' is a valid token for the server.",
+		}
+		switch message {
+		case "missing authorization":
+			result.Hint = "The server requires authentication, so configure a token with '--connect.token'."
+		case "expired token":
+			result.Hint = "Generate a new token, or if the token should still be valid, check the agent system clock."
+		case "endpoint not permitted":
+			result.Hint = fmt.Sprintf("The token doesn't permit endpoint %s, so use a token that includes the endpoint.", endpointID)
+		}
+		return result
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return doctor.Result{
+			Check:   "token",
+			Status:  doctor.StatusWarn,
+			Message: fmt.Sprintf("server rejected the request: %d: %s", resp.StatusCode, message),
+			Hint:    "The server is overloaded or rate limiting the agent, so the token couldn't be checked. Retry later.",
+		}
+	default:
+		return doctor.Result{
+			Check:   "token",
+			Status:  doctor.StatusFail,
+			Message: fmt.Sprintf("unexpected response: %d: %s", resp.StatusCode, message),
+			Hint:    "Check '--connect.url' is the Piko server 'upstream' port, not the 'proxy' or 'admin' port.",
+		}
+	}
+}
+
+func (d *Doctor) checkWebSocket(ctx context.Context, u *url.URL, tlsConfig *tls.Config) doctor.Result {
+	if len(d.conf.Listeners) == 0 {
+		return doctor.Result{
+			Check:   "websocket",
+			Status:  doctor.StatusSkip,
+			Message: "no listeners configured",
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	endpointID := d.endpointID()
+	wsURL := *u
+	wsURL.Path += protocol.UpstreamPath(endpointID)
+	if wsURL.Scheme == "https" {
+		wsURL.Scheme = "wss"
+	} else {
+		wsURL.Scheme = "ws"
+	}
+
+	opts := []websocket.DialOption{
+		websocket.WithToken(d.conf.Connect.Token),
+		websocket.WithTLSConfig(tlsConfig),
+	}
+	conn, err := websocket.Dial(ctx, wsURL.String(), opts...)
+	if err != nil {
+		return doctor.Result{
+			Check:   "websocket",
+			Status:  doctor.StatusFail,
+			Message: fmt.Sprintf("connect: %s", err.Error()),
+			Hint:    "Check any proxies or load balancers between the agent and server support WebSocket upgrades.",
+		}
+	}
+	conn.Close()
+
+	return doctor.Result{
+		Check:   "websocket",
+		Status:  doctor.StatusOK,
+		Message: fmt.Sprintf("connected to endpoint %s", endpointID),
+	}
+}
+
+// checkUpstream checks the agent can connect to the listener upstream.
+func (d *Doctor) checkUpstream(ctx context.Context, conf config.ListenerConfig) doctor.Result {
+	check := "upstream " + conf.EndpointID
+	hint := fmt.Sprintf("Check the upstream service is running and listening on %s.", conf.Addr)
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	if conf.Protocol == config.ListenerProtocolUDP {
+		return doctor.Result{
+			Check:   check,
+			Status:  doctor.StatusSkip,
+			Message: "udp upstreams can't be checked without sending a datagram",
+		}
+	}
+	if conf.Protocol == config.ListenerProtocolTCP {
+		host, ok := conf.Host()
+		if !ok {
+			return doctor.Result{
+				Check:   check,
+				Status:  doctor.StatusFail,
+				Message: fmt.Sprintf("invalid addr: %s", conf.Addr),
+			}
+		}
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", host)
+		if err != nil {
+			return doctor.Result{
+				Check:   check,
+				Status:  doctor.StatusFail,
+				Message: fmt.Sprintf("connect %s: %s", host, err.Error()),
+				Hint:    hint,
+			}
+		}
+		conn.Close()
+		return doctor.Result{
+			Check:   check,
+			Status:  doctor.StatusOK,
+			Message: fmt.Sprintf("connected to %s", host),
+		}
+	}
+
+	u, ok := conf.URL()
+	if !ok {
+		return doctor.Result{
+			Check:   check,
+			Status:  doctor.StatusFail,
+			Message: fmt.Sprintf("invalid addr: %s", conf.Addr),
+		}
+	}
+	tlsConfig, err := conf.TLS.Load()
+	if err != nil {
+		return doctor.Result{
+			Check:   check,
+			Status:  doctor.StatusFail,
+			Message: fmt.Sprintf("load tls config: %s", err.Error()),
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return doctor.Result{
+			Check:   check,
+			Status:  doctor.StatusFail,
+			Message: fmt.Sprintf("request: %s", err.Error()),
+		}
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+		},
+		// Any response means the upstream is reachable.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return doctor.Result{
+			Check:   check,
+			Status:  doctor.StatusFail,
+			Message: fmt.Sprintf("request %s: %s", u.String(), err.Error()),
+			Hint:    hint,
+		}
+	}
+	resp.Body.Close()
+
+	return doctor.Result{
+		Check:   check,
+		Status:  doctor.StatusOK,
+		Message: fmt.Sprintf("%s responded with %d", u.String(), resp.StatusCode),
+	}
+}
+
+// endpointID returns the endpoint to check, which is the first configured
+// listener so the token check also checks the token permits the endpoint.
+func (d *Doctor) endpointID() string {
+	if len(d.conf.Listeners) == 0 {
+		return defaultEndpointID
+	}
+	return d.conf.Listeners[0].EndpointID
+}
+
+// serverAddr returns the host and port of the server URL.
+func serverAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// responseError returns the error message from a JSON error response, or
+// the status text if the response isn't a JSON error.
+func responseError(resp *http.Response) string {
+	var m struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil || m.Error == "" {
+		return http.StatusText(resp.StatusCode)
+	}
+	return m.Error
+}
@@ -0,0 +1,143 @@
+package doctor
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/doctor"
+	"github.com/andydunstall/piko/pkg/protocol"
+)
+
+// fakeServer emulates the server upstream route, which authenticates the
+// request before attempting the WebSocket upgrade.
+func fakeServer(token string, date string) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if date != "" {
+				w.Header().Set("Date", date)
+			}
+			if r.URL.Path != protocol.UpstreamPath("my-endpoint") {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Header.Get("Authorization") != "Bearer "+token {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte(`{"error": "invalid token"}`))
+				return
+			}
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			conn.Close()
+		},
+	))
+}
+
+func results(conf *config.Config) map[string]doctor.Result {
+	d := NewDoctor(conf, time.Second*5)
+	m := make(map[string]doctor.Result)
+	for _, result := range d.Run(context.Background()) {
+		m[result.Check] = result
+	}
+	return m
+}
+
+func TestDoctor(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		server := fakeServer("my-token", "")
+		defer server.Close()
+
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			},
+		))
+		defer upstream.Close()
+
+		conf := config.Default()
+		conf.Connect.URL = server.URL
+		conf.Connect.Token = "my-token"
+		conf.Listeners = []config.ListenerConfig{{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+			Protocol:   config.ListenerProtocolHTTP,
+		}}
+
+		r := results(conf)
+		assert.Equal(t, doctor.StatusSkip, r["dns"].Status)
+		assert.Equal(t, doctor.StatusOK, r["tcp"].Status)
+		assert.Equal(t, doctor.StatusSkip, r["tls"].Status)
+		assert.Equal(t, doctor.StatusOK, r["clock"].Status)
+		assert.Equal(t, doctor.StatusOK, r["token"].Status)
+		assert.Equal(t, doctor.StatusOK, r["websocket"].Status)
+		assert.Equal(t, doctor.StatusOK, r["upstream my-endpoint"].Status)
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		server := fakeServer("my-token", "")
+		defer server.Close()
+
+		conf := config.Default()
+		conf.Connect.URL = server.URL
+		conf.Connect.Token = "invalid"
+		conf.Listeners = []config.ListenerConfig{{
+			EndpointID: "my-endpoint",
+			Addr:       "localhost:1",
+			Protocol:   config.ListenerProtocolTCP,
+		}}
+
+		r := results(conf)
+		assert.Equal(t, doctor.StatusFail, r["token"].Status)
+		assert.Equal(t, "server rejected the token: invalid token", r["token"].Message)
+		assert.NotEmpty(t, r["token"].Hint)
+		// Skipped after the token check fails.
+		assert.Equal(t, doctor.StatusSkip, r["websocket"].Status)
+		assert.Equal(t, doctor.StatusFail, r["upstream my-endpoint"].Status)
+	})
+
+	t.Run("clock skew", func(t *testing.T) {
+		server := fakeServer(
+			"", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat),
+		)
+		defer server.Close()
+
+		conf := config.Default()
+		conf.Connect.URL = server.URL
+		conf.Listeners = []config.ListenerConfig{{
+			EndpointID: "my-endpoint",
+			Addr:       server.URL,
+		}}
+
+		r := results(conf)
+		assert.Equal(t, doctor.StatusWarn, r["clock"].Status)
+		assert.NotEmpty(t, r["clock"].Hint)
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := ln.Addr().String()
+		ln.Close()
+
+		conf := config.Default()
+		conf.Connect.URL = "http://" + addr
+
+		r := results(conf)
+		assert.Equal(t, doctor.StatusFail, r["tcp"].Status)
+		assert.Equal(t, doctor.StatusSkip, r["tls"].Status)
+		assert.Equal(t, doctor.StatusSkip, r["token"].Status)
+		assert.Equal(t, "tcp check failed", r["token"].Message)
+	})
+}
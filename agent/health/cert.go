@@ -0,0 +1,210 @@
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// CertMonitor periodically checks the TLS certificate of an HTTPS upstream,
+// recording its expiry and whether it passes validation.
+//
+// The certificate is validated against the listener TLS root CAs (or the
+// system roots if not configured), even if the listener is configured to
+// skip verification, so expired or misconfigured certificates are still
+// reported.
+//
+// The certificate is considered valid until the first check completes, so
+// requests aren't rejected while the agent starts.
+type CertMonitor struct {
+	endpointID string
+	addr       string
+	tlsConfig  *tls.Config
+
+	interval time.Duration
+	timeout  time.Duration
+
+	valid bool
+	mu    sync.Mutex
+
+	metrics *CertMetrics
+
+	logger log.Logger
+}
+
+// NewCertMonitor creates a certificate monitor for the upstream at the given
+// host and port.
+//
+// metrics may be nil to disable metrics.
+func NewCertMonitor(
+	endpointID string,
+	addr string,
+	tlsConfig *tls.Config,
+	interval time.Duration,
+	timeout time.Duration,
+	metrics *CertMetrics,
+	logger log.Logger,
+) *CertMonitor {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	return &CertMonitor{
+		endpointID: endpointID,
+		addr:       addr,
+		tlsConfig:  tlsConfig,
+		interval:   interval,
+		timeout:    timeout,
+		valid:      true,
+		metrics:    metrics,
+		logger:     logger,
+	}
+}
+
+// Run checks the upstream certificate until the context is cancelled.
+func (m *CertMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.check(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Valid returns whether the upstream certificate passed the last check.
+func (m *CertMonitor) Valid() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.valid
+}
+
+func (m *CertMonitor) check(ctx context.Context) {
+	checkCtx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	leaf, err := m.verify(checkCtx)
+	if ctx.Err() != nil {
+		// Shutting down.
+		return
+	}
+
+	var verifyErr *verificationError
+	isVerifyErr := errors.As(err, &verifyErr)
+
+	if m.metrics != nil {
+		result := "valid"
+		if isVerifyErr {
+			result = "invalid"
+		} else if err != nil {
+			result = "error"
+		}
+		m.metrics.ChecksTotal.WithLabelValues(m.endpointID, result).Inc()
+
+		if leaf != nil {
+			m.metrics.Expiry.WithLabelValues(m.endpointID).Set(
+				float64(leaf.NotAfter.Unix()),
+			)
+		}
+		if err == nil {
+			m.metrics.Valid.WithLabelValues(m.endpointID).Set(1)
+		} else if isVerifyErr {
+			m.metrics.Valid.WithLabelValues(m.endpointID).Set(0)
+		}
+	}
+
+	if err != nil && !isVerifyErr {
+		// If we can't connect to the upstream, the validation status is
+		// unknown so leave it unchanged.
+		m.logger.Warn("failed to check upstream certificate", zap.Error(err))
+		return
+	}
+
+	valid := err == nil
+
+	m.mu.Lock()
+	prev := m.valid
+	m.valid = valid
+	m.mu.Unlock()
+
+	if prev == valid {
+		return
+	}
+	if valid {
+		m.logger.Info(
+			"upstream certificate valid",
+			zap.Time("expiry", leaf.NotAfter),
+		)
+		return
+	}
+	m.logger.Warn("upstream certificate invalid", zap.Error(err))
+}
+
+// verify connects to the upstream and validates its certificate chain. If
+// validation fails, returns a verificationError. Returns the upstream leaf
+// certificate if the upstream presented one.
+func (m *CertMonitor) verify(ctx context.Context) (*x509.Certificate, error) {
+	host, _, err := net.SplitHostPort(m.addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid addr: %w", err)
+	}
+
+	tlsConfig := m.tlsConfig.Clone()
+	// Verify the certificate below rather than in the handshake, so we can
+	// inspect invalid certificates.
+	tlsConfig.InsecureSkipVerify = true
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+
+	dialer := &tls.Dialer{Config: tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, &verificationError{err: errors.New("no certificate")}
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         tlsConfig.RootCAs,
+		DNSName:       tlsConfig.ServerName,
+		Intermediates: intermediates,
+	}); err != nil {
+		return certs[0], &verificationError{err: err}
+	}
+	return certs[0], nil
+}
+
+type verificationError struct {
+	err error
+}
+
+func (e *verificationError) Error() string {
+	return "verify: " + e.err.Error()
+}
+
+func (e *verificationError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,102 @@
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func TestCertMonitor(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer upstream.Close()
+
+	t.Run("valid", func(t *testing.T) {
+		rootCAs := x509.NewCertPool()
+		rootCAs.AddCert(upstream.Certificate())
+
+		metrics := NewCertMetrics()
+		monitor := NewCertMonitor(
+			"my-endpoint",
+			upstream.Listener.Addr().String(),
+			&tls.Config{RootCAs: rootCAs},
+			time.Minute,
+			time.Second,
+			metrics,
+			log.NewNopLogger(),
+		)
+		monitor.check(context.Background())
+
+		assert.True(t, monitor.Valid())
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.Valid.WithLabelValues("my-endpoint"),
+		))
+		assert.Equal(t, float64(upstream.Certificate().NotAfter.Unix()), testutil.ToFloat64(
+			metrics.Expiry.WithLabelValues("my-endpoint"),
+		))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		metrics := NewCertMetrics()
+		// The test certificate isn't trusted by the system roots, even though
+		// the listener skips verification.
+		monitor := NewCertMonitor(
+			"my-endpoint",
+			upstream.Listener.Addr().String(),
+			&tls.Config{InsecureSkipVerify: true},
+			time.Minute,
+			time.Second,
+			metrics,
+			log.NewNopLogger(),
+		)
+
+		// Valid before the first check.
+		assert.True(t, monitor.Valid())
+
+		monitor.check(context.Background())
+
+		assert.False(t, monitor.Valid())
+		assert.Equal(t, 0.0, testutil.ToFloat64(
+			metrics.Valid.WithLabelValues("my-endpoint"),
+		))
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.ChecksTotal.WithLabelValues("my-endpoint", "invalid"),
+		))
+		// The expiry is still recorded for invalid certificates.
+		assert.Equal(t, float64(upstream.Certificate().NotAfter.Unix()), testutil.ToFloat64(
+			metrics.Expiry.WithLabelValues("my-endpoint"),
+		))
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		metrics := NewCertMetrics()
+		monitor := NewCertMonitor(
+			"my-endpoint",
+			"127.0.0.1:1",
+			nil,
+			time.Minute,
+			time.Second,
+			metrics,
+			log.NewNopLogger(),
+		)
+		monitor.check(context.Background())
+
+		// The validation status is unknown so is unchanged.
+		assert.True(t, monitor.Valid())
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.ChecksTotal.WithLabelValues("my-endpoint", "error"),
+		))
+	})
+}
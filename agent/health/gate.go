@@ -0,0 +1,261 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/client"
+	"github.com/andydunstall/piko/pkg/backoff"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// ListenFunc connects a listener to Piko.
+type ListenFunc func(ctx context.Context) (client.Listener, error)
+
+// GatedListener is a [client.Listener] that's only connected to Piko, and so
+// only registers its endpoint, while the upstream is healthy.
+//
+// The upstream is healthy once the first health check of the monitor passes.
+// When the upstream becomes unhealthy, the listener closes its connection to
+// Piko, which withdraws the endpoint, then reconnects once the upstream
+// recovers. Since the connection is closed, requests in progress when the
+// endpoint is withdrawn fail.
+//
+// If connecting to Piko fails, such as if the server is briefly unavailable,
+// the listener retries with the backoff returned by newBackoff until the
+// listener is closed.
+type GatedListener struct {
+	endpointID string
+
+	monitor    *Monitor
+	listen     ListenFunc
+	newBackoff func() *backoff.Backoff
+
+	// ln is the listener connected to Piko, or nil if the endpoint isn't
+	// registered.
+	ln client.Listener
+	mu sync.Mutex
+
+	ctx    context.Context
+	cancel func()
+
+	logger log.Logger
+}
+
+func NewGatedListener(
+	endpointID string,
+	monitor *Monitor,
+	listen ListenFunc,
+	newBackoff func() *backoff.Backoff,
+	logger log.Logger,
+) *GatedListener {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &GatedListener{
+		endpointID: endpointID,
+		monitor:    monitor,
+		listen:     listen,
+		newBackoff: newBackoff,
+		ctx:        ctx,
+		cancel:     cancel,
+		logger:     logger,
+	}
+}
+
+// Accept waits for the next connection. While the upstream is unhealthy, no
+// connections are accepted.
+func (l *GatedListener) Accept() (net.Conn, error) {
+	for {
+		ln, err := l.connect()
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := ln.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		if l.ctx.Err() != nil {
+			return nil, client.ErrClosed
+		}
+
+		l.mu.Lock()
+		withdrawn := l.ln != ln
+		l.mu.Unlock()
+		if !withdrawn {
+			return nil, err
+		}
+		// The endpoint was withdrawn so wait for the upstream to recover.
+	}
+}
+
+func (l *GatedListener) Addr() net.Addr {
+	return &gatedAddr{endpointID: l.endpointID}
+}
+
+func (l *GatedListener) Close() error {
+	l.cancel()
+
+	l.mu.Lock()
+	ln := l.ln
+	l.ln = nil
+	l.mu.Unlock()
+
+	if ln != nil {
+		return ln.Close()
+	}
+	return nil
+}
+
+func (l *GatedListener) EndpointID() string {
+	return l.endpointID
+}
+
+// Registered returns whether the endpoint is registered with Piko.
+func (l *GatedListener) Registered() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.ln != nil
+}
+
+// connect waits for the upstream to be healthy and returns the listener
+// connected to Piko, connecting if the endpoint isn't registered.
+//
+// If connecting fails, retries with backoff until the listener is closed.
+func (l *GatedListener) connect() (client.Listener, error) {
+	var b *backoff.Backoff
+	for {
+		if err := l.waitHealthy(); err != nil {
+			return nil, err
+		}
+
+		l.mu.Lock()
+		ln := l.ln
+		l.mu.Unlock()
+		if ln != nil {
+			return ln, nil
+		}
+
+		ln, err := l.listen(l.ctx)
+		if err == nil {
+			return l.register(ln)
+		}
+		if l.ctx.Err() != nil {
+			return nil, client.ErrClosed
+		}
+
+		if b == nil {
+			b = l.newBackoff()
+		}
+		wait, ok := b.Backoff()
+		if !ok {
+			return nil, fmt.Errorf("listen: %w", err)
+		}
+		l.logger.Warn(
+			"failed to register endpoint; retrying",
+			zap.String("endpoint-id", l.endpointID),
+			zap.Duration("backoff", wait),
+			zap.Error(err),
+		)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-l.ctx.Done():
+			timer.Stop()
+			return nil, client.ErrClosed
+		}
+	}
+}
+
+// register registers the listener connected to Piko, and withdraws the
+// endpoint once the upstream is unhealthy.
+func (l *GatedListener) register(ln client.Listener) (client.Listener, error) {
+	l.mu.Lock()
+	if l.ctx.Err() != nil {
+		l.mu.Unlock()
+		ln.Close()
+		return nil, client.ErrClosed
+	}
+	l.ln = ln
+	l.mu.Unlock()
+
+	l.logger.Info(
+		"upstream healthy; registered endpoint",
+		zap.String("endpoint-id", l.endpointID),
+	)
+
+	go l.withdrawWhenUnhealthy(ln)
+
+	return ln, nil
+}
+
+// waitHealthy waits for the upstream to be healthy, or the listener to be
+// closed.
+func (l *GatedListener) waitHealthy() error {
+	for {
+		changed := l.monitor.Changed()
+		if l.monitor.Checked() && l.monitor.Healthy("") {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-l.ctx.Done():
+			return client.ErrClosed
+		}
+	}
+}
+
+// withdrawWhenUnhealthy closes the given listener once the upstream is
+// unhealthy, to withdraw the endpoint from Piko.
+func (l *GatedListener) withdrawWhenUnhealthy(ln client.Listener) {
+	for {
+		changed := l.monitor.Changed()
+		if !l.monitor.Healthy("") {
+			break
+		}
+
+		select {
+		case <-changed:
+		case <-l.ctx.Done():
+			return
+		}
+	}
+
+	l.mu.Lock()
+	if l.ln != ln {
+		l.mu.Unlock()
+		return
+	}
+	l.ln = nil
+	l.mu.Unlock()
+
+	l.logger.Warn(
+		"upstream unhealthy; withdrawing endpoint",
+		zap.String("endpoint-id", l.endpointID),
+	)
+
+	if err := ln.Close(); err != nil {
+		l.logger.Warn("failed to close listener", zap.Error(err))
+	}
+}
+
+type gatedAddr struct {
+	endpointID string
+}
+
+func (a *gatedAddr) Network() string {
+	return "tcp"
+}
+
+func (a *gatedAddr) String() string {
+	return a.endpointID
+}
+
+var _ client.Listener = &GatedListener{}
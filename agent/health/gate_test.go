@@ -0,0 +1,194 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/client"
+	"github.com/andydunstall/piko/pkg/backoff"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+type fakeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeListener() *fakeListener {
+	return &fakeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, client.ErrClosed
+	}
+}
+
+func (l *fakeListener) Addr() net.Addr {
+	return nil
+}
+
+func (l *fakeListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *fakeListener) EndpointID() string {
+	return "my-endpoint"
+}
+
+func newTestBackoff() *backoff.Backoff {
+	return backoff.New(0, time.Millisecond, time.Millisecond*10)
+}
+
+func TestGatedListener(t *testing.T) {
+	checker := &fakeChecker{
+		statuses: map[string]ServingStatus{
+			"": StatusNotServing,
+		},
+	}
+	monitor := NewMonitor(
+		checker, []string{""}, time.Minute, time.Second, log.NewNopLogger(),
+	)
+
+	listeners := make(chan *fakeListener, 2)
+	listen := func(context.Context) (client.Listener, error) {
+		ln := newFakeListener()
+		listeners <- ln
+		return ln, nil
+	}
+	gated := NewGatedListener(
+		"my-endpoint", monitor, listen, newTestBackoff, log.NewNopLogger(),
+	)
+	defer gated.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := gated.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// The endpoint isn't registered before the first health check or while
+	// unhealthy.
+	monitor.checkAll(context.Background())
+	assert.False(t, gated.Registered())
+	select {
+	case <-listeners:
+		t.Fatal("registered while unhealthy")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	setStatus := func(status ServingStatus) {
+		checker.mu.Lock()
+		checker.statuses[""] = status
+		checker.mu.Unlock()
+		monitor.checkAll(context.Background())
+	}
+
+	// Registered once healthy.
+	setStatus(StatusServing)
+	ln := <-listeners
+
+	conn, _ := net.Pipe()
+	ln.conns <- conn
+	assert.Equal(t, conn, <-accepted)
+	assert.True(t, gated.Registered())
+
+	// Withdrawn when unhealthy.
+	setStatus(StatusNotServing)
+	<-ln.closed
+	assert.False(t, gated.Registered())
+
+	// Registered again on recovery.
+	setStatus(StatusServing)
+	ln = <-listeners
+
+	conn, _ = net.Pipe()
+	ln.conns <- conn
+	assert.Equal(t, conn, <-accepted)
+
+	require.NoError(t, gated.Close())
+	<-ln.closed
+	_, ok := <-accepted
+	assert.False(t, ok)
+}
+
+// Tests the listener retries if connecting to Piko fails when the upstream
+// recovers, rather than failing Accept.
+func TestGatedListener_ListenFailure(t *testing.T) {
+	checker := &fakeChecker{
+		statuses: map[string]ServingStatus{
+			"": StatusServing,
+		},
+	}
+	monitor := NewMonitor(
+		checker, []string{""}, time.Minute, time.Second, log.NewNopLogger(),
+	)
+
+	var attempts atomic.Int32
+	listeners := make(chan *fakeListener, 1)
+	listen := func(context.Context) (client.Listener, error) {
+		// Fail the first attempts as if Piko is unreachable.
+		if attempts.Add(1) <= 2 {
+			return nil, errors.New("connection refused")
+		}
+		ln := newFakeListener()
+		listeners <- ln
+		return ln, nil
+	}
+	gated := NewGatedListener(
+		"my-endpoint", monitor, listen, newTestBackoff, log.NewNopLogger(),
+	)
+	defer gated.Close()
+
+	accepted := make(chan net.Conn)
+	acceptErr := make(chan error, 1)
+	go func() {
+		conn, err := gated.Accept()
+		if err != nil {
+			acceptErr <- err
+			return
+		}
+		accepted <- conn
+	}()
+
+	monitor.checkAll(context.Background())
+	ln := <-listeners
+	assert.Equal(t, int32(3), attempts.Load())
+
+	conn, _ := net.Pipe()
+	ln.conns <- conn
+	select {
+	case c := <-accepted:
+		assert.Equal(t, conn, c)
+	case err := <-acceptErr:
+		t.Fatalf("accept: %s", err)
+	}
+
+	require.NoError(t, gated.Close())
+	_, err := gated.Accept()
+	assert.ErrorIs(t, err, client.ErrClosed)
+}
@@ -0,0 +1,208 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ServingStatus is the grpc.health.v1.HealthCheckResponse.ServingStatus.
+type ServingStatus int32
+
+const (
+	StatusUnknown        ServingStatus = 0
+	StatusServing        ServingStatus = 1
+	StatusNotServing     ServingStatus = 2
+	StatusServiceUnknown ServingStatus = 3
+)
+
+func (s ServingStatus) String() string {
+	switch s {
+	case StatusUnknown:
+		return "UNKNOWN"
+	case StatusServing:
+		return "SERVING"
+	case StatusNotServing:
+		return "NOT_SERVING"
+	case StatusServiceUnknown:
+		return "SERVICE_UNKNOWN"
+	default:
+		return "INVALID"
+	}
+}
+
+const (
+	healthCheckPath = "/grpc.health.v1.Health/Check"
+
+	// maxResponseSize is the maximum size of a health check response.
+	maxResponseSize = 1 << 12
+
+	// grpcStatusNotFound is the gRPC status returned by the health service
+	// when the service name is unknown.
+	grpcStatusNotFound = 5
+)
+
+// GRPCChecker checks the health of an upstream gRPC server using the
+// standard gRPC health checking protocol (grpc.health.v1).
+//
+// Since the checker only needs the unary Check RPC, it implements the protocol
+// directly on HTTP/2 rather than depending on a full gRPC client.
+type GRPCChecker struct {
+	url *url.URL
+
+	client *http.Client
+}
+
+// NewGRPCChecker creates a checker for the gRPC server at the given URL. If
+// the URL scheme is 'http', connects using HTTP/2 without TLS (h2c).
+func NewGRPCChecker(u *url.URL, tlsConfig *tls.Config) *GRPCChecker {
+	transport := &http2.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+	if u.Scheme == "http" {
+		transport.AllowHTTP = true
+		transport.DialTLSContext = func(
+			ctx context.Context,
+			network, addr string,
+			_ *tls.Config,
+		) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+
+	return &GRPCChecker{
+		url: u,
+		client: &http.Client{
+			Transport: transport,
+		},
+	}
+}
+
+// Check returns the serving status of the gRPC service with the given name.
+// An empty name checks the overall health of the server.
+func (c *GRPCChecker) Check(ctx context.Context, service string) (ServingStatus, error) {
+	u := *c.url
+	u.Path = healthCheckPath
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, u.String(), bytes.NewReader(encodeRequest(service)),
+	)
+	if err != nil {
+		return StatusUnknown, fmt.Errorf("request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return StatusUnknown, fmt.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return StatusUnknown, fmt.Errorf("bad status: %d", resp.StatusCode)
+	}
+
+	// Read the body before checking the trailers, since trailers are only
+	// available once the body has been read.
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return StatusUnknown, fmt.Errorf("read response: %w", err)
+	}
+
+	// The status is normally in the trailers, though if the server fails
+	// without a response it may be in the headers.
+	grpcStatus := resp.Trailer.Get("Grpc-Status")
+	if grpcStatus == "" {
+		grpcStatus = resp.Header.Get("Grpc-Status")
+	}
+	code, err := strconv.Atoi(grpcStatus)
+	if err != nil {
+		return StatusUnknown, fmt.Errorf("invalid grpc status: %q", grpcStatus)
+	}
+	if code == grpcStatusNotFound {
+		return StatusServiceUnknown, nil
+	}
+	if code != 0 {
+		message := resp.Trailer.Get("Grpc-Message")
+		if message == "" {
+			message = resp.Header.Get("Grpc-Message")
+		}
+		return StatusUnknown, fmt.Errorf("grpc status: %d: %s", code, message)
+	}
+
+	status, err := decodeResponse(b)
+	if err != nil {
+		return StatusUnknown, fmt.Errorf("decode response: %w", err)
+	}
+	return status, nil
+}
+
+// encodeRequest encodes a HealthCheckRequest message in a gRPC frame.
+func encodeRequest(service string) []byte {
+	var msg []byte
+	if service != "" {
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendString(msg, service)
+	}
+
+	frame := make([]byte, 5, 5+len(msg))
+	// Uncompressed.
+	frame[0] = 0
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// decodeResponse decodes a HealthCheckResponse message from a gRPC frame.
+func decodeResponse(b []byte) (ServingStatus, error) {
+	if len(b) < 5 {
+		return StatusUnknown, errors.New("invalid frame")
+	}
+	if b[0] != 0 {
+		return StatusUnknown, errors.New("compressed response not supported")
+	}
+	size := binary.BigEndian.Uint32(b[1:5])
+	msg := b[5:]
+	if uint32(len(msg)) != size {
+		return StatusUnknown, errors.New("invalid frame size")
+	}
+
+	// Defaults to unknown if the status field is omitted.
+	status := StatusUnknown
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return StatusUnknown, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+
+		if num == 1 && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(msg)
+			if n < 0 {
+				return StatusUnknown, protowire.ParseError(n)
+			}
+			msg = msg[n:]
+			status = ServingStatus(int32(v))
+			continue
+		}
+
+		// Skip unknown fields.
+		n = protowire.ConsumeFieldValue(num, typ, msg)
+		if n < 0 {
+			return StatusUnknown, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	return status, nil
+}
@@ -0,0 +1,105 @@
+package health
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fakeHealthServer implements the grpc.health.v1 Check RPC, returning the
+// status of each service in 'statuses'.
+func fakeHealthServer(t *testing.T, statuses map[string]ServingStatus) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, healthCheckPath, r.URL.Path)
+		assert.Equal(t, "application/grpc", r.Header.Get("Content-Type"))
+
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, len(b), 5)
+
+		// Decode the service name.
+		var service string
+		msg := b[5:]
+		if len(msg) > 0 {
+			_, _, n := protowire.ConsumeTag(msg)
+			require.Greater(t, n, 0)
+			service, n = protowire.ConsumeString(msg[n:])
+			require.Greater(t, n, 0)
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+
+		status, ok := statuses[service]
+		if !ok {
+			w.Header().Set("Grpc-Status", strconv.Itoa(grpcStatusNotFound))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		var resp []byte
+		resp = protowire.AppendTag(resp, 1, protowire.VarintType)
+		resp = protowire.AppendVarint(resp, uint64(status))
+		frame := make([]byte, 5)
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(resp)))
+
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(append(frame, resp...))
+		w.Header().Set("Grpc-Status", "0")
+	})
+	return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+}
+
+func TestGRPCChecker(t *testing.T) {
+	server := fakeHealthServer(t, map[string]ServingStatus{
+		"":              StatusServing,
+		"my.ServiceA":   StatusServing,
+		"my.ServiceB":   StatusNotServing,
+		"my.ServiceNil": StatusUnknown,
+	})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	checker := NewGRPCChecker(u, nil)
+
+	tests := []struct {
+		service string
+		status  ServingStatus
+	}{
+		{"", StatusServing},
+		{"my.ServiceA", StatusServing},
+		{"my.ServiceB", StatusNotServing},
+		{"my.ServiceNil", StatusUnknown},
+		{"my.Unknown", StatusServiceUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			status, err := checker.Check(context.Background(), tt.service)
+			require.NoError(t, err)
+			assert.Equal(t, tt.status, status)
+		})
+	}
+}
+
+func TestGRPCChecker_Unreachable(t *testing.T) {
+	server := fakeHealthServer(t, nil)
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	server.Close()
+
+	checker := NewGRPCChecker(u, nil)
+	_, err = checker.Check(context.Background(), "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,77 @@
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// HTTPChecker checks the health of an upstream HTTP server by requesting a
+// health check path, such as '/healthz'.
+type HTTPChecker struct {
+	url *url.URL
+
+	// expectedStatus is the status code the server must return, or zero to
+	// accept any 2xx status.
+	expectedStatus int
+
+	client *http.Client
+}
+
+// NewHTTPChecker creates a checker that requests the given path from the
+// HTTP server at the given URL.
+func NewHTTPChecker(
+	u *url.URL,
+	path string,
+	expectedStatus int,
+	tlsConfig *tls.Config,
+) *HTTPChecker {
+	probeURL := *u
+	probeURL.Path = path
+	probeURL.RawQuery = ""
+	return &HTTPChecker{
+		url:            &probeURL,
+		expectedStatus: expectedStatus,
+		client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+			// Redirects are considered a failure unless expected.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Check requests the health check path. Since the server has a single
+// status, the service name is ignored.
+func (c *HTTPChecker) Check(ctx context.Context, _ string) (ServingStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url.String(), nil)
+	if err != nil {
+		return StatusUnknown, fmt.Errorf("request: %w", err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return StatusUnknown, fmt.Errorf("request: %w", err)
+	}
+	// Discard the body so the connection can be reused.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseSize))
+	resp.Body.Close()
+
+	if !c.expected(resp.StatusCode) {
+		return StatusNotServing, fmt.Errorf("bad status: %d", resp.StatusCode)
+	}
+	return StatusServing, nil
+}
+
+func (c *HTTPChecker) expected(status int) bool {
+	if c.expectedStatus != 0 {
+		return status == c.expectedStatus
+	}
+	return status >= 200 && status < 300
+}
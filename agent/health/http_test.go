@@ -0,0 +1,66 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPChecker(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/healthz", r.URL.Path)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	t.Run("any 2xx", func(t *testing.T) {
+		checker := NewHTTPChecker(u, "/healthz", 0, nil)
+
+		status = http.StatusNoContent
+		s, err := checker.Check(context.Background(), "")
+		assert.NoError(t, err)
+		assert.Equal(t, StatusServing, s)
+
+		status = http.StatusServiceUnavailable
+		s, err = checker.Check(context.Background(), "")
+		assert.EqualError(t, err, "bad status: 503")
+		assert.Equal(t, StatusNotServing, s)
+
+		// Redirects aren't followed.
+		status = http.StatusFound
+		_, err = checker.Check(context.Background(), "")
+		assert.EqualError(t, err, "bad status: 302")
+	})
+
+	t.Run("expected status", func(t *testing.T) {
+		checker := NewHTTPChecker(u, "/healthz", http.StatusAccepted, nil)
+
+		status = http.StatusAccepted
+		s, err := checker.Check(context.Background(), "")
+		assert.NoError(t, err)
+		assert.Equal(t, StatusServing, s)
+
+		status = http.StatusOK
+		_, err = checker.Check(context.Background(), "")
+		assert.EqualError(t, err, "bad status: 200")
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		unreachable, err := url.Parse("http://127.0.0.1:1")
+		require.NoError(t, err)
+		checker := NewHTTPChecker(unreachable, "/healthz", 0, nil)
+
+		s, err := checker.Check(context.Background(), "")
+		assert.Error(t, err)
+		assert.Equal(t, StatusUnknown, s)
+	})
+}
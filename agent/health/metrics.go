@@ -0,0 +1,58 @@
+package health
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// CertMetrics contains the upstream TLS certificate metrics, labelled by
+// endpoint ID.
+type CertMetrics struct {
+	// Expiry is the expiry time of the upstream leaf certificate as a Unix
+	// timestamp.
+	Expiry *prometheus.GaugeVec
+
+	// Valid is 1 if the upstream certificate passed validation, 0 otherwise.
+	Valid *prometheus.GaugeVec
+
+	// ChecksTotal is the number of certificate checks, labelled by endpoint
+	// ID and result ('valid', 'invalid' or 'error').
+	ChecksTotal *prometheus.CounterVec
+}
+
+func NewCertMetrics() *CertMetrics {
+	return &CertMetrics{
+		Expiry: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "agent",
+				Name:      "upstream_cert_expiry_timestamp_seconds",
+				Help:      "Expiry time of the upstream TLS certificate as a Unix timestamp",
+			},
+			[]string{"endpoint"},
+		),
+		Valid: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "agent",
+				Name:      "upstream_cert_valid",
+				Help:      "Whether the upstream TLS certificate passed validation",
+			},
+			[]string{"endpoint"},
+		),
+		ChecksTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "agent",
+				Name:      "upstream_cert_checks_total",
+				Help:      "Number of upstream TLS certificate checks",
+			},
+			[]string{"endpoint", "result"},
+		),
+	}
+}
+
+func (m *CertMetrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.Expiry,
+		m.Valid,
+		m.ChecksTotal,
+	)
+}
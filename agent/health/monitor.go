@@ -0,0 +1,184 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// Checker checks the serving status of a service.
+type Checker interface {
+	Check(ctx context.Context, service string) (ServingStatus, error)
+}
+
+// Monitor periodically health checks a set of upstream services and tracks
+// whether each service is healthy.
+//
+// Services are considered healthy until the first health check completes, so
+// requests aren't rejected while the agent starts.
+type Monitor struct {
+	checker  Checker
+	services []string
+
+	interval time.Duration
+	timeout  time.Duration
+
+	// healthy maps service name to whether the service is healthy.
+	healthy map[string]bool
+
+	// checked indicates whether the first health check has completed.
+	checked bool
+
+	// changed is closed and replaced whenever the health of a service
+	// changes, or the first health check completes.
+	changed chan struct{}
+
+	mu sync.Mutex
+
+	logger log.Logger
+}
+
+func NewMonitor(
+	checker Checker,
+	services []string,
+	interval time.Duration,
+	timeout time.Duration,
+	logger log.Logger,
+) *Monitor {
+	healthy := make(map[string]bool)
+	for _, service := range services {
+		healthy[service] = true
+	}
+	return &Monitor{
+		checker:  checker,
+		services: services,
+		interval: interval,
+		timeout:  timeout,
+		healthy:  healthy,
+		changed:  make(chan struct{}),
+		logger:   logger,
+	}
+}
+
+// Run health checks the services until the context is cancelled.
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.checkAll(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Healthy returns whether the given service is healthy.
+//
+// If the overall server health is checked (using an empty service name) and
+// the server is unhealthy, all services are unhealthy. Services that aren't
+// checked are considered healthy.
+func (m *Monitor) Healthy(service string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if healthy, ok := m.healthy[""]; ok && !healthy {
+		return false
+	}
+	if healthy, ok := m.healthy[service]; ok {
+		return healthy
+	}
+	return true
+}
+
+// Checked returns whether the first health check has completed.
+func (m *Monitor) Checked() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.checked
+}
+
+// Changed returns a channel that's closed when the health of a service next
+// changes, or the first health check completes.
+func (m *Monitor) Changed() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.changed
+}
+
+func (m *Monitor) checkAll(ctx context.Context) {
+	for _, service := range m.services {
+		m.check(ctx, service)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.checked {
+		m.checked = true
+		m.notifyLocked()
+	}
+}
+
+// notifyLocked wakes any goroutines waiting on the changed channel.
+func (m *Monitor) notifyLocked() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *Monitor) check(ctx context.Context, service string) {
+	checkCtx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	status, err := m.checker.Check(checkCtx, service)
+	if ctx.Err() != nil {
+		// Shutting down.
+		return
+	}
+
+	healthy := err == nil && status == StatusServing
+
+	m.mu.Lock()
+	prev := m.healthy[service]
+	m.healthy[service] = healthy
+	if prev != healthy {
+		m.notifyLocked()
+	}
+	m.mu.Unlock()
+
+	if prev == healthy {
+		return
+	}
+	if healthy {
+		m.logger.Info(
+			"service healthy",
+			zap.String("service", service),
+		)
+		return
+	}
+	if err != nil {
+		m.logger.Warn(
+			"service unhealthy",
+			zap.String("service", service),
+			zap.Error(err),
+		)
+		return
+	}
+	m.logger.Warn(
+		"service unhealthy",
+		zap.String("service", service),
+		zap.String("status", status.String()),
+	)
+}
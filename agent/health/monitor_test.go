@@ -0,0 +1,87 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+type fakeChecker struct {
+	statuses map[string]ServingStatus
+	mu       sync.Mutex
+}
+
+func (c *fakeChecker) Check(_ context.Context, service string) (ServingStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status, ok := c.statuses[service]
+	if !ok {
+		return StatusUnknown, errors.New("unreachable")
+	}
+	return status, nil
+}
+
+func TestMonitor(t *testing.T) {
+	t.Run("service", func(t *testing.T) {
+		checker := &fakeChecker{
+			statuses: map[string]ServingStatus{
+				"my.ServiceA": StatusServing,
+				"my.ServiceB": StatusNotServing,
+			},
+		}
+		monitor := NewMonitor(
+			checker,
+			[]string{"my.ServiceA", "my.ServiceB", "my.ServiceC"},
+			time.Minute,
+			time.Second,
+			log.NewNopLogger(),
+		)
+
+		// Healthy before the first check.
+		assert.True(t, monitor.Healthy("my.ServiceB"))
+
+		monitor.checkAll(context.Background())
+
+		assert.True(t, monitor.Healthy("my.ServiceA"))
+		assert.False(t, monitor.Healthy("my.ServiceB"))
+		// Check fails.
+		assert.False(t, monitor.Healthy("my.ServiceC"))
+		// Not checked.
+		assert.True(t, monitor.Healthy("my.ServiceD"))
+
+		checker.mu.Lock()
+		checker.statuses["my.ServiceB"] = StatusServing
+		checker.mu.Unlock()
+
+		monitor.checkAll(context.Background())
+		assert.True(t, monitor.Healthy("my.ServiceB"))
+	})
+
+	t.Run("server", func(t *testing.T) {
+		checker := &fakeChecker{
+			statuses: map[string]ServingStatus{
+				"":            StatusNotServing,
+				"my.ServiceA": StatusServing,
+			},
+		}
+		monitor := NewMonitor(
+			checker,
+			[]string{"", "my.ServiceA"},
+			time.Minute,
+			time.Second,
+			log.NewNopLogger(),
+		)
+		monitor.checkAll(context.Background())
+
+		// The server is unhealthy so all services are unhealthy.
+		assert.False(t, monitor.Healthy("my.ServiceA"))
+		assert.False(t, monitor.Healthy("my.ServiceD"))
+	})
+}
@@ -0,0 +1,80 @@
+package limit
+
+import (
+	"context"
+	"time"
+)
+
+// Limiter limits the number of concurrent requests or connections forwarded
+// to an upstream, so fragile upstreams (such as the web server of an
+// embedded device) aren't overwhelmed by parallel traffic from the tunnel.
+//
+// Requests above the limit are queued for up to the queue timeout waiting
+// for a slot, then rejected.
+type Limiter struct {
+	// slots contains an entry for each active request.
+	slots chan struct{}
+
+	queueTimeout time.Duration
+}
+
+// NewLimiter returns a limiter allowing up to maxConcurrent active
+// requests, or nil if maxConcurrent is zero.
+//
+// A nil limiter has no limit.
+func NewLimiter(maxConcurrent int, queueTimeout time.Duration) *Limiter {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	return &Limiter{
+		slots:        make(chan struct{}, maxConcurrent),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// Acquire waits for a slot, returning false if no slot became available
+// within the queue timeout or ctx is cancelled. If Acquire returns true, the
+// caller must call Release once the request completes.
+func (l *Limiter) Acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if l.queueTimeout == 0 {
+		return false
+	}
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Release releases a slot acquired with Acquire.
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// Active returns the number of active requests.
+func (l *Limiter) Active() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.slots)
+}
@@ -0,0 +1,56 @@
+package limit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	t.Run("reject", func(t *testing.T) {
+		l := NewLimiter(2, 0)
+
+		assert.True(t, l.Acquire(context.Background()))
+		assert.True(t, l.Acquire(context.Background()))
+		assert.False(t, l.Acquire(context.Background()))
+		assert.Equal(t, 2, l.Active())
+
+		l.Release()
+		assert.True(t, l.Acquire(context.Background()))
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		l := NewLimiter(1, time.Second*5)
+		assert.True(t, l.Acquire(context.Background()))
+
+		go func() {
+			time.Sleep(time.Millisecond * 10)
+			l.Release()
+		}()
+		assert.True(t, l.Acquire(context.Background()))
+	})
+
+	t.Run("queue timeout", func(t *testing.T) {
+		l := NewLimiter(1, time.Millisecond*10)
+		assert.True(t, l.Acquire(context.Background()))
+		assert.False(t, l.Acquire(context.Background()))
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		l := NewLimiter(1, time.Minute)
+		assert.True(t, l.Acquire(context.Background()))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.False(t, l.Acquire(ctx))
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		l := NewLimiter(0, 0)
+		assert.Nil(t, l)
+		assert.True(t, l.Acquire(context.Background()))
+		l.Release()
+	})
+}
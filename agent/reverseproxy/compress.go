@@ -0,0 +1,226 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// compressor decompresses request bodies and compresses responses on behalf
+// of upstreams that don't support compression, such as legacy local apps.
+type compressor struct {
+	decompressRequests bool
+	maxRequestSize     int64
+	compressResponses  bool
+	minResponseSize    int64
+
+	next http.Handler
+
+	logger log.Logger
+}
+
+func newCompressor(conf config.CompressionConfig, next http.Handler, logger log.Logger) *compressor {
+	return &compressor{
+		decompressRequests: conf.DecompressRequests,
+		maxRequestSize:     conf.MaxRequestSize,
+		compressResponses:  conf.CompressResponses,
+		minResponseSize:    conf.MinResponseSize,
+		next:               next,
+		logger:             logger,
+	}
+}
+
+func (c *compressor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.decompressRequests && !c.decompress(w, r) {
+		return
+	}
+
+	// Upgraded connections are hijacked so can't be compressed.
+	if !c.compressResponses || r.Method == http.MethodHead ||
+		r.Header.Get("upgrade") != "" || !acceptsGzip(r.Header) {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	// Request an uncompressed response, which is compressed below.
+	r.Header.Del("Accept-Encoding")
+
+	cw := &compressingWriter{
+		ResponseWriter: w,
+		minSize:        c.minResponseSize,
+	}
+	defer cw.Close()
+	c.next.ServeHTTP(cw, r)
+}
+
+// decompress replaces the request body with the decompressed body. Returns
+// false if the request was rejected.
+//
+// The decompressed body is buffered, both to enforce the size limit before
+// forwarding and so the upstream receives a Content-Length.
+func (c *compressor) decompress(w http.ResponseWriter, r *http.Request) bool {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+
+	var zr io.Reader
+	switch encoding {
+	case "", "identity":
+		return true
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			c.logger.Warn("invalid compressed request body", zap.Error(err))
+			_ = errorResponse(w, http.StatusBadRequest, "invalid compressed request body")
+			return false
+		}
+		zr = gr
+	case "deflate":
+		fr, err := zlib.NewReader(r.Body)
+		if err != nil {
+			c.logger.Warn("invalid compressed request body", zap.Error(err))
+			_ = errorResponse(w, http.StatusBadRequest, "invalid compressed request body")
+			return false
+		}
+		zr = fr
+	default:
+		c.logger.Warn(
+			"unsupported content encoding",
+			zap.String("encoding", encoding),
+		)
+		_ = errorResponse(w, http.StatusUnsupportedMediaType, "unsupported content encoding")
+		return false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(zr, c.maxRequestSize+1))
+	if err != nil {
+		c.logger.Warn("invalid compressed request body", zap.Error(err))
+		_ = errorResponse(w, http.StatusBadRequest, "invalid compressed request body")
+		return false
+	}
+	if int64(len(body)) > c.maxRequestSize {
+		c.logger.Warn(
+			"decompressed request body too large",
+			zap.Int64("max-request-size", c.maxRequestSize),
+		)
+		_ = errorResponse(w, http.StatusRequestEntityTooLarge, "request body too large")
+		return false
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	return true
+}
+
+// acceptsGzip returns whether the Accept-Encoding header accepts gzip.
+func acceptsGzip(h http.Header) bool {
+	for _, value := range h.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "gzip" && coding != "*" {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !ok {
+				return true
+			}
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+	}
+	return false
+}
+
+// compressingWriter is a [http.ResponseWriter] that gzip compresses the
+// response, unless the response is already encoded or smaller than the
+// minimum size.
+type compressingWriter struct {
+	http.ResponseWriter
+
+	minSize int64
+
+	// gz is nil if the response isn't compressed.
+	gz *gzip.Writer
+
+	wroteHeader bool
+}
+
+func (w *compressingWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	// Informational responses are followed by the final response.
+	if status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+
+	if w.shouldCompress(status) {
+		h := w.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		h.Add("Vary", "Accept-Encoding")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressingWriter) Flush() {
+	if w.gz != nil {
+		// nolint
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close writes the remaining compressed response.
+func (w *compressingWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+func (w *compressingWriter) shouldCompress(status int) bool {
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	if contentLength := h.Get("Content-Length"); contentLength != "" {
+		size, err := strconv.ParseInt(contentLength, 10, 64)
+		if err == nil && size < w.minSize {
+			return false
+		}
+	}
+	return true
+}
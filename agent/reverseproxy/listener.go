@@ -0,0 +1,76 @@
+package reverseproxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// drainListener is a listener where closing stops accepting connections
+// without closing the underlying listener.
+//
+// When the HTTP server shuts down it closes its listeners before draining
+// in-flight requests. Since closing a Piko listener closes its connection
+// to the server, which would abort the in-flight requests multiplexed over
+// it, the underlying listener must only be closed once the server has
+// drained.
+type drainListener struct {
+	net.Listener
+
+	acceptCh chan acceptResult
+
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func newDrainListener(ln net.Listener) *drainListener {
+	l := &drainListener{
+		Listener: ln,
+		acceptCh: make(chan acceptResult),
+		closeCh:  make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *drainListener) Accept() (net.Conn, error) {
+	select {
+	case res := <-l.acceptCh:
+		return res.conn, res.err
+	case <-l.closeCh:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *drainListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeCh)
+	})
+	return nil
+}
+
+func (l *drainListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		select {
+		case l.acceptCh <- acceptResult{conn: conn, err: err}:
+		case <-l.closeCh:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/middleware"
+)
+
+// mirroredRequest is a copy of a proxied request and response sent to the
+// mirror collector. Bodies are base64 encoded.
+type mirroredRequest struct {
+	EndpointID string    `json:"endpoint_id"`
+	Timestamp  time.Time `json:"timestamp"`
+	// Duration is the time to handle the request in seconds.
+	Duration float64 `json:"duration"`
+
+	Method        string      `json:"method"`
+	RequestURI    string      `json:"request_uri"`
+	RequestHeader http.Header `json:"request_header"`
+	RequestBody   []byte      `json:"request_body"`
+	// RequestBodyTruncated is true if the request body exceeded the
+	// maximum body size.
+	RequestBodyTruncated bool `json:"request_body_truncated"`
+
+	StatusCode     int         `json:"status_code"`
+	ResponseHeader http.Header `json:"response_header"`
+	ResponseBody   []byte      `json:"response_body"`
+	// ResponseBodyTruncated is true if the response body exceeded the
+	// maximum body size.
+	ResponseBodyTruncated bool `json:"response_body_truncated"`
+}
+
+// mirror sends a sampled copy of proxied requests and responses to a
+// collector.
+//
+// Mirrored requests are queued and sent by a background goroutine, so the
+// collector never delays proxied requests. If the queue is full, requests
+// aren't mirrored.
+type mirror struct {
+	endpointID  string
+	url         string
+	maxBodySize int64
+	timeout     time.Duration
+
+	sampler *middleware.Sampler
+
+	client *http.Client
+
+	queue chan *mirroredRequest
+
+	next http.Handler
+
+	ctx    context.Context
+	cancel func()
+
+	logger log.Logger
+}
+
+func newMirror(
+	conf config.ListenerConfig,
+	egress *config.EgressPolicy,
+	next http.Handler,
+	logger log.Logger,
+) *mirror {
+	// Already verified in conf.Validate() so this shouldn't fail.
+	host, _, _ := conf.Mirror.UpstreamHostPort()
+	dialer := &net.Dialer{
+		Timeout: conf.Mirror.Timeout,
+		Control: egress.Control(host),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &mirror{
+		endpointID:  conf.EndpointID,
+		url:         conf.Mirror.URL,
+		maxBodySize: conf.Mirror.MaxBodySize,
+		timeout:     conf.Mirror.Timeout,
+		sampler:     middleware.NewSampler(conf.Mirror.SampleRate),
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: dialer.DialContext,
+			},
+		},
+		queue:  make(chan *mirroredRequest, conf.Mirror.QueueSize),
+		next:   next,
+		ctx:    ctx,
+		cancel: cancel,
+		logger: logger.WithSubsystem("proxy.http.mirror"),
+	}
+	go m.run()
+	return m
+}
+
+func (m *mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Upgraded connections can't be mirrored.
+	if r.Header.Get("upgrade") != "" || !m.sampler.Sample() {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	start := time.Now()
+	mirrored := &mirroredRequest{
+		EndpointID:    m.endpointID,
+		Timestamp:     start,
+		Method:        r.Method,
+		RequestURI:    r.RequestURI,
+		RequestHeader: r.Header.Clone(),
+	}
+
+	// Capture the request and response bodies as they're forwarded, rather
+	// than buffering the bodies before forwarding.
+	var requestBody *capture
+	if r.Body != nil && r.Body != http.NoBody {
+		requestBody = &capture{maxSize: m.maxBodySize}
+		r.Body = &captureReader{ReadCloser: r.Body, capture: requestBody}
+	}
+	mw := &mirrorWriter{
+		ResponseWriter: w,
+		body:           capture{maxSize: m.maxBodySize},
+	}
+
+	m.next.ServeHTTP(mw, r)
+
+	mirrored.Duration = time.Since(start).Seconds()
+	if requestBody != nil {
+		mirrored.RequestBody = requestBody.buf.Bytes()
+		mirrored.RequestBodyTruncated = requestBody.truncated
+	}
+	mirrored.StatusCode = mw.Status()
+	mirrored.ResponseHeader = w.Header().Clone()
+	mirrored.ResponseBody = mw.body.buf.Bytes()
+	mirrored.ResponseBodyTruncated = mw.body.truncated
+
+	select {
+	case m.queue <- mirrored:
+	default:
+		m.logger.Debug("mirror queue full; dropping request")
+	}
+}
+
+func (m *mirror) Close() {
+	m.cancel()
+}
+
+func (m *mirror) run() {
+	for {
+		select {
+		case mirrored := <-m.queue:
+			if err := m.send(mirrored); err != nil {
+				m.logger.Debug("failed to send mirrored request", zap.Error(err))
+			}
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *mirror) send(mirrored *mirroredRequest) error {
+	b, err := json.Marshal(mirrored)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(m.ctx, m.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close()
+	// Discard the response so the connection can be reused.
+	// nolint
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("bad status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// capture captures up to maxSize bytes.
+type capture struct {
+	maxSize   int64
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (c *capture) Write(b []byte) {
+	remaining := c.maxSize - int64(c.buf.Len())
+	if int64(len(b)) > remaining {
+		b = b[:remaining]
+		c.truncated = true
+	}
+	c.buf.Write(b)
+}
+
+// captureReader captures the bytes read from the underlying reader.
+type captureReader struct {
+	io.ReadCloser
+
+	capture *capture
+}
+
+func (r *captureReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.capture.Write(b[:n])
+	return n, err
+}
+
+// mirrorWriter is a [http.ResponseWriter] that captures the response status
+// and body written to the underlying writer.
+type mirrorWriter struct {
+	http.ResponseWriter
+
+	status int
+	body   capture
+}
+
+func (w *mirrorWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *mirrorWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *mirrorWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *mirrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *mirrorWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
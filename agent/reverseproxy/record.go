@@ -0,0 +1,254 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/encrypt"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// recordedResponse is an upstream response stored on disk.
+type recordedResponse struct {
+	Method     string      `json:"method"`
+	RequestURI string      `json:"request_uri"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+// recorder records upstream responses, or replays recorded responses
+// without the upstream.
+//
+// Responses are keyed by a hash of the request method, URI and body, so
+// replaying the same request returns the same response, which enables
+// deterministic tests of clients that call the upstream.
+//
+// If a keyring is configured, responses are encrypted on disk. Responses
+// recorded before encryption was enabled, or encrypted with a key other than
+// the primary key, are re-encrypted with the primary key when replayed, so
+// keys can be rotated without re-recording.
+type recorder struct {
+	mode config.RecordMode
+	path string
+
+	// keyring is nil if recorded responses aren't encrypted.
+	keyring *encrypt.Keyring
+
+	next http.Handler
+
+	logger log.Logger
+}
+
+func newRecorder(
+	conf config.RecordConfig,
+	keyring *encrypt.Keyring,
+	next http.Handler,
+	logger log.Logger,
+) *recorder {
+	return &recorder{
+		mode:    conf.Mode,
+		path:    conf.Path,
+		keyring: keyring,
+		next:    next,
+		logger:  logger,
+	}
+}
+
+func (rec *recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("upgrade") != "" {
+		if rec.mode == config.RecordModeReplay {
+			_ = errorResponse(w, http.StatusBadGateway, "upgrade not supported in replay mode")
+			return
+		}
+		// Upgraded connections can't be recorded so are forwarded as
+		// normal.
+		rec.next.ServeHTTP(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		_ = errorResponse(w, http.StatusBadRequest, "read body")
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	key := requestKey(r, body)
+
+	if rec.mode == config.RecordModeReplay {
+		rec.replay(w, key)
+		return
+	}
+	rec.record(w, r, key)
+}
+
+func (rec *recorder) replay(w http.ResponseWriter, key string) {
+	resp, err := rec.load(key)
+	if errors.Is(err, os.ErrNotExist) {
+		rec.logger.Warn("no recorded response", zap.String("key", key))
+		_ = errorResponse(w, http.StatusBadGateway, "no recorded response")
+		return
+	}
+	if err != nil {
+		rec.logger.Warn("failed to load recorded response", zap.Error(err))
+		_ = errorResponse(w, http.StatusInternalServerError, "load recorded response")
+		return
+	}
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	// nolint
+	w.Write(resp.Body)
+}
+
+func (rec *recorder) record(w http.ResponseWriter, r *http.Request, key string) {
+	rw := &recordingWriter{ResponseWriter: w}
+	rec.next.ServeHTTP(rw, r)
+
+	status := rw.Status()
+	// Don't record gateway errors, which indicate the upstream is
+	// unavailable rather than an upstream response.
+	if status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout {
+		return
+	}
+
+	resp := recordedResponse{
+		Method:     r.Method,
+		RequestURI: r.RequestURI,
+		StatusCode: status,
+		Header:     w.Header().Clone(),
+		Body:       rw.body.Bytes(),
+	}
+	if err := rec.save(key, &resp); err != nil {
+		rec.logger.Warn("failed to record response", zap.Error(err))
+	}
+}
+
+func (rec *recorder) load(key string) (*recordedResponse, error) {
+	b, err := os.ReadFile(filepath.Join(rec.path, key+".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Re-encrypt responses that aren't encrypted with the primary key.
+	reencrypt := false
+	if encrypt.IsEncrypted(b) {
+		if rec.keyring == nil {
+			return nil, fmt.Errorf("response encrypted but no encryption keys")
+		}
+		reencrypt = !rec.keyring.EncryptedWithPrimary(b)
+		b, err = rec.keyring.Decrypt(b)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt: %w", err)
+		}
+	} else if rec.keyring != nil {
+		reencrypt = true
+	}
+
+	var resp recordedResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+
+	if reencrypt {
+		if err := rec.save(key, &resp); err != nil {
+			rec.logger.Warn("failed to re-encrypt recorded response", zap.Error(err))
+		}
+	}
+	return &resp, nil
+}
+
+func (rec *recorder) save(key string, resp *recordedResponse) error {
+	b, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	if rec.keyring != nil {
+		b, err = rec.keyring.Encrypt(b)
+		if err != nil {
+			return fmt.Errorf("encrypt: %w", err)
+		}
+	}
+	if err := os.MkdirAll(rec.path, 0o755); err != nil {
+		return fmt.Errorf("mkdir: %w", err)
+	}
+
+	// Write to a temporary file then rename so a partially written response
+	// is never replayed.
+	path := filepath.Join(rec.path, key+".json")
+	if err := os.WriteFile(path+".tmp", b, 0o644); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return nil
+}
+
+// requestKey returns a hash of the request method, URI and body.
+func requestKey(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method))
+	h.Write([]byte{0})
+	h.Write([]byte(r.URL.RequestURI()))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordingWriter is a [http.ResponseWriter] that records the response
+// status and body written to the underlying writer.
+type recordingWriter struct {
+	http.ResponseWriter
+
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *recordingWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
@@ -0,0 +1,186 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/encrypt"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
+)
+
+func newRecordServer(
+	t *testing.T,
+	addr string,
+	record config.RecordConfig,
+	keyring *encrypt.Keyring,
+) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := NewServer(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       addr,
+		Timeout:    time.Second,
+		Record:     record,
+	}, nil, keyring, protocol.Headers{}, nil, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown(context.TODO())
+	})
+
+	return "http://" + ln.Addr().String()
+}
+
+func postBody(t *testing.T, url string, body string) (int, string) {
+	resp, err := http.Post(url, "text/plain", bytes.NewReader([]byte(body)))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(b)
+}
+
+func TestServer_Record(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			b, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+
+			w.Header().Set("x-my-header", "my-value")
+			w.WriteHeader(http.StatusCreated)
+			// nolint
+			w.Write([]byte(r.URL.Path + ":" + string(b)))
+		},
+	))
+
+	path := t.TempDir()
+
+	addr := newRecordServer(t, upstream.URL, config.RecordConfig{
+		Mode: config.RecordModeRecord,
+		Path: path,
+	}, nil)
+
+	status, body := postBody(t, addr+"/foo", "a")
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "/foo:a", body)
+	status, body = postBody(t, addr+"/foo", "b")
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "/foo:b", body)
+
+	// Replay the responses without the upstream.
+	upstreamAddr := upstream.URL
+	upstream.Close()
+
+	addr = newRecordServer(t, upstreamAddr, config.RecordConfig{
+		Mode: config.RecordModeReplay,
+		Path: path,
+	}, nil)
+
+	resp, err := http.Post(addr+"/foo", "text/plain", bytes.NewReader([]byte("b")))
+	require.NoError(t, err)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "my-value", resp.Header.Get("x-my-header"))
+	assert.Equal(t, "/foo:b", string(b))
+
+	status, body = postBody(t, addr+"/foo", "a")
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "/foo:a", body)
+
+	// Not recorded.
+	status, _ = postBody(t, addr+"/foo", "c")
+	assert.Equal(t, http.StatusBadGateway, status)
+	status, _ = postBody(t, addr+"/bar", "a")
+	assert.Equal(t, http.StatusBadGateway, status)
+}
+
+func TestServer_RecordEncrypted(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			b, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			// nolint
+			w.Write([]byte(r.URL.Path + ":" + string(b)))
+		},
+	))
+	upstreamAddr := upstream.URL
+
+	oldKey := bytes.Repeat([]byte{1}, encrypt.KeySize)
+	newKey := bytes.Repeat([]byte{2}, encrypt.KeySize)
+	oldKeyring, err := encrypt.NewKeyring(oldKey)
+	require.NoError(t, err)
+
+	path := t.TempDir()
+
+	addr := newRecordServer(t, upstreamAddr, config.RecordConfig{
+		Mode: config.RecordModeRecord,
+		Path: path,
+	}, oldKeyring)
+	status, body := postBody(t, addr+"/foo", "a")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "/foo:a", body)
+	upstream.Close()
+
+	recorded := func() []byte {
+		paths, err := filepath.Glob(filepath.Join(path, "*.json"))
+		require.NoError(t, err)
+		require.Len(t, paths, 1)
+		b, err := os.ReadFile(paths[0])
+		require.NoError(t, err)
+		return b
+	}
+
+	// The recorded response is encrypted on disk.
+	b := recorded()
+	assert.True(t, oldKeyring.EncryptedWithPrimary(b))
+	assert.NotContains(t, string(b), "/foo:a")
+
+	// Without the keys, the response can't be replayed.
+	addr = newRecordServer(t, upstreamAddr, config.RecordConfig{
+		Mode: config.RecordModeReplay,
+		Path: path,
+	}, nil)
+	status, _ = postBody(t, addr+"/foo", "a")
+	assert.Equal(t, http.StatusInternalServerError, status)
+
+	// Replaying with a rotated keyring re-encrypts with the new key.
+	rotatedKeyring, err := encrypt.NewKeyring(newKey, oldKey)
+	require.NoError(t, err)
+	addr = newRecordServer(t, upstreamAddr, config.RecordConfig{
+		Mode: config.RecordModeReplay,
+		Path: path,
+	}, rotatedKeyring)
+	status, body = postBody(t, addr+"/foo", "a")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "/foo:a", body)
+	assert.True(t, rotatedKeyring.EncryptedWithPrimary(recorded()))
+
+	// Once re-encrypted, the old key can be removed.
+	newKeyring, err := encrypt.NewKeyring(newKey)
+	require.NoError(t, err)
+	addr = newRecordServer(t, upstreamAddr, config.RecordConfig{
+		Mode: config.RecordModeReplay,
+		Path: path,
+	}, newKeyring)
+	status, body = postBody(t, addr+"/foo", "a")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "/foo:a", body)
+}
@@ -0,0 +1,119 @@
+package reverseproxy
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// redirectTransport is a [http.RoundTripper] that follows redirects to the
+// same host as the request, so clients don't see redirects to internal-only
+// upstream addresses.
+//
+// Redirects to other hosts are returned to the client, as are redirects
+// that would need to resend a request body.
+type redirectTransport struct {
+	next http.RoundTripper
+
+	maxHops int
+
+	// followed is nil if followed redirects aren't recorded.
+	followed prometheus.Counter
+
+	logger log.Logger
+}
+
+func newRedirectTransport(
+	next http.RoundTripper,
+	maxHops int,
+	followed prometheus.Counter,
+	logger log.Logger,
+) *redirectTransport {
+	return &redirectTransport{
+		next:     next,
+		maxHops:  maxHops,
+		followed: followed,
+		logger:   logger,
+	}
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for hops := 0; ; hops++ {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+
+		next, ok := t.redirect(req, resp)
+		if !ok {
+			return resp, nil
+		}
+		if hops == t.maxHops {
+			t.logger.Warn(
+				"redirect hop limit reached",
+				zap.String("location", resp.Header.Get("Location")),
+				zap.Int("max-hops", t.maxHops),
+			)
+			return resp, nil
+		}
+
+		// Discard the redirect response so the connection can be reused.
+		// nolint
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+
+		if t.followed != nil {
+			t.followed.Inc()
+		}
+		req = next
+	}
+}
+
+// redirect returns the request to follow the redirect response, or false if
+// the response isn't a redirect that can be followed.
+func (t *redirectTransport) redirect(req *http.Request, resp *http.Response) (*http.Request, bool) {
+	method := req.Method
+	keepBody := false
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		// Matches http.Client, which follows these redirects with a GET
+		// without a body.
+		if method != http.MethodGet && method != http.MethodHead {
+			method = http.MethodGet
+		}
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		keepBody = true
+	default:
+		return nil, false
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return nil, false
+	}
+	if location.Scheme != req.URL.Scheme || location.Host != req.URL.Host {
+		return nil, false
+	}
+
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	if keepBody && hasBody {
+		// The request body has already been consumed.
+		return nil, false
+	}
+
+	next := req.Clone(req.Context())
+	next.Method = method
+	next.URL = location
+	if !keepBody {
+		next.Body = nil
+		next.GetBody = nil
+		next.ContentLength = 0
+		next.Header.Del("Content-Length")
+		next.Header.Del("Content-Type")
+	}
+	return next, true
+}
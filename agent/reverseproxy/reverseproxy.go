@@ -9,11 +9,20 @@ import (
 	"net/http/httputil"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
 	"github.com/andydunstall/piko/agent/config"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
+)
+
+type contextKey int
+
+const (
+	startContextKey contextKey = iota
 )
 
 type ReverseProxy struct {
@@ -21,10 +30,23 @@ type ReverseProxy struct {
 
 	timeout time.Duration
 
+	headers protocol.Headers
+
 	logger log.Logger
 }
 
-func NewReverseProxy(conf config.ListenerConfig, logger log.Logger) *ReverseProxy {
+// NewReverseProxy returns a reverse proxy forwarding to the listener
+// upstream, refusing to connect to addresses not permitted by the egress
+// policy. A nil policy permits all addresses.
+//
+// If metrics is nil, followed redirects aren't recorded.
+func NewReverseProxy(
+	conf config.ListenerConfig,
+	egress *config.EgressPolicy,
+	headers protocol.Headers,
+	metrics *middleware.LabeledMetrics,
+	logger log.Logger,
+) *ReverseProxy {
 	u, ok := conf.URL()
 	if !ok {
 		// We've already verified the address on boot so don't need to handle
@@ -35,6 +57,7 @@ func NewReverseProxy(conf config.ListenerConfig, logger log.Logger) *ReverseProx
 	dialer := &net.Dialer{
 		Timeout:   conf.Timeout,
 		KeepAlive: 30 * time.Second,
+		Control:   egress.Control(u.Hostname()),
 	}
 	// Same as http.DefaultTransport with custom TLS client config.
 	transport := &http.Transport{
@@ -55,48 +78,96 @@ func NewReverseProxy(conf config.ListenerConfig, logger log.Logger) *ReverseProx
 
 	proxy := httputil.NewSingleHostReverseProxy(u)
 	proxy.Transport = transport
+	if conf.Redirects.Follow {
+		var followed prometheus.Counter
+		if metrics != nil {
+			followed = metrics.RedirectsFollowed.WithLabelValues(conf.EndpointID)
+		}
+		proxy.Transport = newRedirectTransport(
+			transport, conf.Redirects.MaxHops, followed, logger,
+		)
+	}
 	proxy.ErrorLog = logger.StdLogger(zapcore.WarnLevel)
 	rp := &ReverseProxy{
 		proxy:   proxy,
 		timeout: conf.Timeout,
+		headers: headers,
 		logger:  logger,
 	}
 	proxy.ErrorHandler = rp.errorHandler
+	proxy.ModifyResponse = rp.modifyResponse
 	return rp
 }
 
 func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if p.timeout != 0 && r.Header.Get("upgrade") != "websocket" {
+	if p.timeout != 0 && !middleware.IsUpgrade(r) {
 		ctx, cancel := context.WithTimeout(r.Context(), p.timeout)
 		defer cancel()
 
 		r = r.WithContext(ctx)
 	}
 
-	p.proxy.ServeHTTP(w, r)
+	r = r.WithContext(context.WithValue(r.Context(), startContextKey, time.Now()))
+
+	p.proxy.ServeHTTP(middleware.NewInformationalWriter(w, nil), r)
 }
 
-func (p *ReverseProxy) errorHandler(w http.ResponseWriter, _ *http.Request, err error) {
-	p.logger.Warn("proxy request", zap.Error(err))
+// modifyResponse adds the time spent in the upstream service to the
+// response, so the server can tell the tunnel latency apart from the
+// upstream latency.
+func (p *ReverseProxy) modifyResponse(resp *http.Response) error {
+	start, ok := resp.Request.Context().Value(startContextKey).(time.Time)
+	if ok {
+		resp.Header.Set(
+			p.headers.UpstreamDuration(),
+			protocol.FormatSeconds(time.Since(start)),
+		)
+	}
+	return nil
+}
 
+// errorHandler logs the request and connection IDs assigned by the server,
+// and includes the request ID in the response, so failures can be matched
+// to the server logs.
+func (p *ReverseProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	requestID := r.Header.Get(p.headers.RequestID())
+	p.logger.Warn(
+		"proxy request",
+		zap.String("request-id", requestID),
+		zap.String("connection-id", r.Header.Get(p.headers.ConnectionID())),
+		zap.Error(err),
+	)
+
+	if requestID != "" {
+		w.Header().Set(p.headers.RequestID(), requestID)
+	}
 	if errors.Is(err, context.DeadlineExceeded) {
-		_ = errorResponse(w, http.StatusGatewayTimeout, "upstream timeout")
+		_ = errorResponseWithID(w, http.StatusGatewayTimeout, "upstream timeout", requestID)
 		return
 	}
-	_ = errorResponse(w, http.StatusBadGateway, "upstream unreachable")
+	_ = errorResponseWithID(w, http.StatusBadGateway, "upstream unreachable", requestID)
 }
 
 type errorMessage struct {
 	Error string `json:"error"`
+	// RequestID is only set for errors proxying requests.
+	RequestID string `json:"request_id,omitempty"`
 }
 
 func errorResponse(w http.ResponseWriter, statusCode int, message string) error {
+	return errorResponseWithID(w, statusCode, message, "")
+}
+
+func errorResponseWithID(
+	w http.ResponseWriter, statusCode int, message string, requestID string,
+) error {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(statusCode)
 
 	m := &errorMessage{
-		Error: message,
+		Error:     message,
+		RequestID: requestID,
 	}
 	return json.NewEncoder(w).Encode(m)
 }
@@ -14,6 +14,7 @@ import (
 
 	"github.com/andydunstall/piko/agent/config"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
 )
 
 func TestReverseProxy_Forward(t *testing.T) {
@@ -37,7 +38,7 @@ func TestReverseProxy_Forward(t *testing.T) {
 		proxy := NewReverseProxy(config.ListenerConfig{
 			EndpointID: "my-endpoint",
 			Addr:       upstream.URL,
-		}, log.NewNopLogger())
+		}, nil, protocol.Headers{}, nil, log.NewNopLogger())
 
 		b := bytes.NewReader([]byte("foo"))
 		r := httptest.NewRequest(http.MethodGet, "/foo/bar?a=b", b)
@@ -50,12 +51,51 @@ func TestReverseProxy_Forward(t *testing.T) {
 
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 
+		// The response includes the upstream duration.
+		_, ok := protocol.ParseSeconds(
+			resp.Header.Get(protocol.Headers{}.UpstreamDuration()),
+		)
+		assert.True(t, ok)
+
 		buf := new(strings.Builder)
 		// nolint
 		io.Copy(buf, resp.Body)
 		assert.Equal(t, "bar", buf.String())
 	})
 
+	t.Run("trailers", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "trailers", r.Header.Get("TE"))
+
+				w.Header().Set("Trailer", "Grpc-Status")
+				// nolint
+				w.Write([]byte("bar"))
+				w.Header().Set("Grpc-Status", "0")
+				w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+			},
+		))
+		defer upstream.Close()
+
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+		}, nil, protocol.Headers{}, nil, log.NewNopLogger())
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("TE", "trailers")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+		assert.Equal(t, "ok", resp.Trailer.Get("Grpc-Message"))
+	})
+
 	t.Run("timeout", func(t *testing.T) {
 		blockCh := make(chan struct{})
 		upstream := httptest.NewServer(http.HandlerFunc(
@@ -70,7 +110,7 @@ func TestReverseProxy_Forward(t *testing.T) {
 			EndpointID: "my-endpoint",
 			Addr:       upstream.URL,
 			Timeout:    time.Millisecond * 1,
-		}, log.NewNopLogger())
+		}, nil, protocol.Headers{}, nil, log.NewNopLogger())
 
 		r := httptest.NewRequest(http.MethodGet, "/", nil)
 
@@ -91,9 +131,10 @@ func TestReverseProxy_Forward(t *testing.T) {
 		proxy := NewReverseProxy(config.ListenerConfig{
 			EndpointID: "my-endpoint",
 			Addr:       "localhost:55555",
-		}, log.NewNopLogger())
+		}, nil, protocol.Headers{}, nil, log.NewNopLogger())
 
 		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(protocol.Headers{}.RequestID(), "my-request")
 
 		w := httptest.NewRecorder()
 		proxy.ServeHTTP(w, r)
@@ -102,9 +143,11 @@ func TestReverseProxy_Forward(t *testing.T) {
 		defer resp.Body.Close()
 
 		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Equal(t, "my-request", resp.Header.Get(protocol.Headers{}.RequestID()))
 
 		m := errorMessage{}
 		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
 		assert.Equal(t, "upstream unreachable", m.Error)
+		assert.Equal(t, "my-request", m.RequestID)
 	})
 }
@@ -0,0 +1,302 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// rewriter rewrites absolute URLs in upstream responses from the upstream's
+// internal origin to the public endpoint origin, for upstreams that emit
+// absolute links.
+//
+// Only the Location header and the bodies of HTML and JSON responses are
+// rewritten. Bodies are rewritten as they're streamed, so only buffer up to
+// the length of the longest origin.
+type rewriter struct {
+	origins      []string
+	publicOrigin string
+
+	next http.Handler
+
+	logger log.Logger
+}
+
+func newRewriter(conf config.ListenerConfig, next http.Handler, logger log.Logger) *rewriter {
+	var origins []string
+	addOrigin := func(u string) {
+		if parsed, ok := (&config.ListenerConfig{Addr: u}).URL(); ok {
+			origins = append(origins, parsed.Scheme+"://"+parsed.Host)
+		}
+	}
+	addOrigin(conf.Addr)
+	for _, route := range conf.Routes {
+		addOrigin(route.Addr)
+	}
+	for _, origin := range conf.Rewrite.Origins {
+		origins = append(origins, strings.TrimSuffix(origin, "/"))
+	}
+
+	return &rewriter{
+		origins:      origins,
+		publicOrigin: strings.TrimSuffix(conf.Rewrite.PublicOrigin, "/"),
+		next:         next,
+		logger:       logger,
+	}
+}
+
+func (rw *rewriter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Upgraded connections are hijacked so can't be rewritten.
+	if r.Header.Get("upgrade") != "" {
+		rw.next.ServeHTTP(w, r)
+		return
+	}
+
+	publicOrigin := rw.publicOrigin
+	if publicOrigin == "" {
+		scheme := r.Header.Get("X-Forwarded-Proto")
+		if scheme == "" {
+			scheme = "http"
+		}
+		publicOrigin = scheme + "://" + r.Host
+	}
+
+	var patterns []replacePattern
+	for _, origin := range rw.origins {
+		patterns = append(patterns, replacePattern{
+			old: []byte(origin),
+			new: []byte(publicOrigin),
+		})
+		// JSON encoders may escape forward slashes.
+		patterns = append(patterns, replacePattern{
+			old: []byte(strings.ReplaceAll(origin, "/", `\/`)),
+			new: []byte(strings.ReplaceAll(publicOrigin, "/", `\/`)),
+		})
+	}
+
+	// Request an uncompressed response, since compressed bodies can't be
+	// rewritten.
+	r.Header.Del("Accept-Encoding")
+
+	wr := &rewritingWriter{
+		ResponseWriter: w,
+		patterns:       patterns,
+	}
+	defer wr.Close()
+	rw.next.ServeHTTP(wr, r)
+}
+
+// rewritableContentType returns whether responses with the given content
+// type are rewritten.
+func rewritableContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "application/json":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+json")
+}
+
+// rewritingWriter is a [http.ResponseWriter] that rewrites origins in the
+// Location header and in HTML and JSON response bodies.
+type rewritingWriter struct {
+	http.ResponseWriter
+
+	patterns []replacePattern
+
+	// replacer is nil if the response body isn't rewritten.
+	replacer *replacer
+
+	wroteHeader bool
+}
+
+func (w *rewritingWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	// Informational responses are followed by the final response.
+	if status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	if location := h.Get("Location"); location != "" {
+		h.Set("Location", replaceAll(location, w.patterns))
+	}
+	if h.Get("Content-Encoding") == "" && rewritableContentType(h.Get("Content-Type")) {
+		// The rewritten body may have a different length.
+		h.Del("Content-Length")
+		w.replacer = newReplacer(w.ResponseWriter, w.patterns)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *rewritingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replacer != nil {
+		return w.replacer.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush writes any buffered body, so an origin split across a flush isn't
+// rewritten.
+func (w *rewritingWriter) Flush() {
+	if w.replacer != nil {
+		// nolint
+		w.replacer.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *rewritingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close writes the remaining buffered body.
+func (w *rewritingWriter) Close() error {
+	if w.replacer == nil {
+		return nil
+	}
+	return w.replacer.Flush()
+}
+
+type replacePattern struct {
+	old []byte
+	new []byte
+}
+
+// replacer is a streaming [io.Writer] that replaces the patterns in the
+// written bytes and writes the result to the underlying writer.
+//
+// Patterns only match at an origin boundary, so 'http://localhost:3000'
+// doesn't match 'http://localhost:30001'. To match patterns split across
+// writes, the replacer buffers up to the length of the longest pattern.
+type replacer struct {
+	w io.Writer
+
+	patterns []replacePattern
+	maxLen   int
+
+	pending []byte
+}
+
+func newReplacer(w io.Writer, patterns []replacePattern) *replacer {
+	maxLen := 0
+	for _, p := range patterns {
+		maxLen = max(maxLen, len(p.old))
+	}
+	return &replacer{
+		w:        w,
+		patterns: patterns,
+		maxLen:   maxLen,
+	}
+}
+
+func (r *replacer) Write(b []byte) (int, error) {
+	r.pending = append(r.pending, b...)
+	if err := r.replace(false); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush writes the buffered bytes.
+func (r *replacer) Flush() error {
+	return r.replace(true)
+}
+
+// replace writes the pending bytes with the patterns replaced. Unless final
+// is true, holds back bytes that may be the start of a pattern, or a match
+// whose boundary can't yet be checked.
+func (r *replacer) replace(final bool) error {
+	data := r.pending
+	var out []byte
+	i := 0
+	for {
+		idx, p, ok := r.match(data, i)
+		if !ok {
+			break
+		}
+		end := idx + len(p.old)
+		if end == len(data) && !final {
+			break
+		}
+		if end < len(data) && isOriginByte(data[end]) {
+			out = append(out, data[i:idx+1]...)
+			i = idx + 1
+			continue
+		}
+		out = append(out, data[i:idx]...)
+		out = append(out, p.new...)
+		i = end
+	}
+
+	keep := len(data)
+	if !final {
+		keep = max(i, len(data)-r.maxLen)
+	}
+	out = append(out, data[i:keep]...)
+	r.pending = append([]byte(nil), data[keep:]...)
+
+	if len(out) == 0 {
+		return nil
+	}
+	_, err := r.w.Write(out)
+	return err
+}
+
+// match returns the first pattern match in data from offset i, preferring
+// the longest pattern if multiple patterns match at the same index.
+func (r *replacer) match(data []byte, i int) (int, replacePattern, bool) {
+	var match replacePattern
+	matchIdx := -1
+	for _, p := range r.patterns {
+		if len(p.old) == 0 {
+			continue
+		}
+		idx := bytes.Index(data[i:], p.old)
+		if idx < 0 {
+			continue
+		}
+		idx += i
+		if matchIdx < 0 || idx < matchIdx || (idx == matchIdx && len(p.old) > len(match.old)) {
+			matchIdx = idx
+			match = p
+		}
+	}
+	return matchIdx, match, matchIdx >= 0
+}
+
+// isOriginByte returns whether b may continue an origin, in which case a
+// pattern ending before b doesn't match.
+func isOriginByte(b byte) bool {
+	return b >= 'a' && b <= 'z' ||
+		b >= 'A' && b <= 'Z' ||
+		b >= '0' && b <= '9' ||
+		b == '.' || b == '-' || b == '_' || b == ':'
+}
+
+func replaceAll(s string, patterns []replacePattern) string {
+	var buf bytes.Buffer
+	r := newReplacer(&buf, patterns)
+	// nolint
+	r.Write([]byte(s))
+	// nolint
+	r.Flush()
+	return buf.String()
+}
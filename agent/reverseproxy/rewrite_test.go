@@ -0,0 +1,78 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplacer(t *testing.T) {
+	patterns := []replacePattern{
+		{old: []byte("http://localhost:3000"), new: []byte("https://example.com")},
+		{old: []byte(`http:\/\/localhost:3000`), new: []byte(`https:\/\/example.com`)},
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "html",
+			input:    `<a href="http://localhost:3000/foo">foo</a>`,
+			expected: `<a href="https://example.com/foo">foo</a>`,
+		},
+		{
+			name:     "escaped json",
+			input:    `{"url":"http:\/\/localhost:3000\/foo"}`,
+			expected: `{"url":"https:\/\/example.com\/foo"}`,
+		},
+		{
+			name:     "multiple",
+			input:    `http://localhost:3000 http://localhost:3000/bar`,
+			expected: `https://example.com https://example.com/bar`,
+		},
+		{
+			name:     "end",
+			input:    `http://localhost:3000`,
+			expected: `https://example.com`,
+		},
+		{
+			// Only matches at an origin boundary.
+			name:     "different port",
+			input:    `http://localhost:30001/foo`,
+			expected: `http://localhost:30001/foo`,
+		},
+		{
+			name:     "no match",
+			input:    `http://localhost:8000/foo`,
+			expected: `http://localhost:8000/foo`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			r := newReplacer(&buf, patterns)
+			_, err := r.Write([]byte(tt.input))
+			require.NoError(t, err)
+			require.NoError(t, r.Flush())
+			assert.Equal(t, tt.expected, buf.String())
+		})
+
+		// Write one byte at a time to split patterns across writes.
+		t.Run(tt.name+" split", func(t *testing.T) {
+			var buf bytes.Buffer
+			r := newReplacer(&buf, patterns)
+			for i := 0; i != len(tt.input); i++ {
+				_, err := r.Write([]byte{tt.input[i]})
+				require.NoError(t, err)
+				// Only buffers up to the longest pattern.
+				assert.LessOrEqual(t, len(r.pending), r.maxLen)
+			}
+			require.NoError(t, r.Flush())
+			assert.Equal(t, tt.expected, buf.String())
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
+)
+
+type route struct {
+	conf  config.RouteConfig
+	proxy *ReverseProxy
+}
+
+// Match returns whether the request matches all the route conditions.
+func (r *route) Match(req *http.Request) bool {
+	if r.conf.PathPrefix != "" && !hasPathPrefix(req.URL.Path, r.conf.PathPrefix) {
+		return false
+	}
+	for name, value := range r.conf.Headers {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// router forwards requests to the upstream of the first matching route, or
+// the listener upstream if no routes match.
+type router struct {
+	routes []*route
+
+	fallback http.Handler
+}
+
+func newRouter(
+	conf config.ListenerConfig,
+	egress *config.EgressPolicy,
+	headers protocol.Headers,
+	metrics *middleware.LabeledMetrics,
+	fallback http.Handler,
+	logger log.Logger,
+) *router {
+	r := &router{
+		fallback: fallback,
+	}
+	for _, routeConf := range conf.Routes {
+		// Routes inherit the listener configuration, such as the timeout
+		// and TLS configuration, with their own address.
+		proxyConf := conf
+		proxyConf.Addr = routeConf.Addr
+		r.routes = append(r.routes, &route{
+			conf:  routeConf,
+			proxy: NewReverseProxy(proxyConf, egress, headers, metrics, logger),
+		})
+	}
+	return r
+}
+
+func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	for _, route := range r.routes {
+		if !route.Match(req) {
+			continue
+		}
+		if route.conf.StripPrefix {
+			req = stripPathPrefix(req, route.conf.PathPrefix)
+		}
+		route.proxy.ServeHTTP(w, req)
+		return
+	}
+	r.fallback.ServeHTTP(w, req)
+}
+
+// hasPathPrefix returns whether the path starts with the prefix, where the
+// prefix must match whole path segments.
+func hasPathPrefix(path string, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	if len(path) == len(prefix) || strings.HasSuffix(prefix, "/") {
+		return true
+	}
+	return path[len(prefix)] == '/'
+}
+
+// stripPathPrefix returns a copy of the request with the prefix removed from
+// the path.
+func stripPathPrefix(req *http.Request, prefix string) *http.Request {
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	r := new(http.Request)
+	*r = *req
+	r.URL = new(url.URL)
+	*r.URL = *req.URL
+	r.URL.Path = strings.TrimPrefix(req.URL.Path, prefix)
+	if r.URL.Path == "" {
+		r.URL.Path = "/"
+	}
+	// Note if the raw path no longer encodes the path, such as the prefix
+	// was encoded differently, the URL ignores the raw path.
+	r.URL.RawPath = strings.TrimPrefix(req.URL.RawPath, prefix)
+	if r.URL.RawPath != "" && !strings.HasPrefix(r.URL.RawPath, "/") {
+		r.URL.RawPath = "/" + r.URL.RawPath
+	}
+	return r
+}
@@ -5,21 +5,48 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
 	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/agent/health"
+	"github.com/andydunstall/piko/agent/limit"
+	"github.com/andydunstall/piko/pkg/encrypt"
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/pkg/recovery"
 )
 
 type Server struct {
 	proxy *ReverseProxy
 
+	// handler handles proxied requests, which is either the proxy, or a
+	// router between the proxy and route proxies if the listener has routes.
+	// The handler is wrapped by a recorder, mirror, rewriter and compressor
+	// if recording, mirroring, rewriting and compression are enabled
+	// respectively.
+	handler http.Handler
+
+	// mirror is nil if mirroring is disabled.
+	mirror *mirror
+
+	// health is nil if health checks are disabled.
+	health *health.Monitor
+
+	// cert is nil if certificate checks are disabled.
+	cert *health.CertMonitor
+
+	// limiter is nil if the number of concurrent requests isn't limited.
+	limiter *limit.Limiter
+
 	router *gin.Engine
 
+	panics *recovery.Pool
+
 	httpServer *http.Server
 
 	logger log.Logger
@@ -27,7 +54,13 @@ type Server struct {
 
 func NewServer(
 	conf config.ListenerConfig,
+	egress *config.EgressPolicy,
+	keyring *encrypt.Keyring,
+	headers protocol.Headers,
 	metrics *middleware.LabeledMetrics,
+	panicMetrics *recovery.Metrics,
+	healthMonitor *health.Monitor,
+	certMonitor *health.CertMonitor,
 	logger log.Logger,
 ) *Server {
 	logger = logger.WithSubsystem("proxy.http")
@@ -35,55 +68,152 @@ func NewServer(
 
 	router := gin.New()
 	s := &Server{
-		proxy:  NewReverseProxy(conf, logger),
-		router: router,
+		proxy:   NewReverseProxy(conf, egress, headers, metrics, logger),
+		health:  healthMonitor,
+		cert:    certMonitor,
+		limiter: limit.NewLimiter(conf.MaxConcurrent, conf.QueueTimeout),
+		router:  router,
+		panics:  recovery.NewPool("proxy.http", panicMetrics, logger),
 		httpServer: &http.Server{
 			Handler:  router,
 			ErrorLog: logger.StdLogger(zapcore.WarnLevel),
 		},
 		logger: logger,
 	}
+	s.handler = s.proxy
+	if len(conf.Routes) > 0 {
+		s.handler = newRouter(conf, egress, headers, metrics, s.proxy, logger)
+	}
+	if conf.Record.Enabled() {
+		s.handler = newRecorder(conf.Record, keyring, s.handler, logger)
+	}
+	if conf.Mirror.Enabled() {
+		s.mirror = newMirror(conf, egress, s.handler, logger)
+		s.handler = s.mirror
+	}
+	if conf.Rewrite.Enabled {
+		s.handler = newRewriter(conf, s.handler, logger)
+	}
+	if conf.Compression.Enabled() {
+		s.handler = newCompressor(conf.Compression, s.handler, logger)
+	}
 
 	// Recover from panics.
 	s.router.Use(gin.CustomRecoveryWithWriter(nil, s.panicRoute))
 
+	sampler := middleware.NewSampler(conf.SampleRate)
+	s.router.Use(middleware.NewSampling(func(_ *gin.Context) *middleware.Sampler {
+		return sampler
+	}))
+
 	s.router.Use(middleware.NewLogger(conf.AccessLog, logger))
 
 	if metrics != nil {
 		router.Use(metrics.Handler(conf.EndpointID))
 	}
 
+	if healthMonitor != nil {
+		router.Use(s.healthRoute)
+	}
+
+	if certMonitor != nil && conf.CertCheck.Enforce {
+		router.Use(s.certRoute)
+	}
+
+	if s.limiter != nil {
+		router.Use(s.limitRoute)
+	}
+
 	s.router.NoRoute(s.proxyRoute)
 
 	return s
 }
 
+// Serve serves proxied requests from ln until shutdown.
+//
+// Shutting down stops accepting connections but doesn't close ln, so the
+// caller must close ln once the server has drained.
 func (s *Server) Serve(ln net.Listener) error {
 	s.logger.Info("starting reverse proxy")
 
-	if err := s.httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+	if err := s.httpServer.Serve(newDrainListener(ln)); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("http serve: %w", err)
 	}
 	return nil
 }
 
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.httpServer.Shutdown(ctx)
+	err := s.httpServer.Shutdown(ctx)
+	if s.mirror != nil {
+		s.mirror.Close()
+	}
+	return err
 }
 
 func (s *Server) proxyRoute(c *gin.Context) {
-	s.proxy.ServeHTTP(c.Writer, c.Request)
+	s.handler.ServeHTTP(c.Writer, c.Request)
+}
+
+// healthRoute rejects requests to unhealthy gRPC services.
+func (s *Server) healthRoute(c *gin.Context) {
+	service := grpcService(c.Request.URL.Path)
+	if !s.health.Healthy(service) {
+		s.logger.Warn(
+			"upstream service unhealthy",
+			zap.String("service", service),
+		)
+		_ = errorResponse(c.Writer, http.StatusServiceUnavailable, "upstream unhealthy")
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// certRoute rejects requests when the upstream certificate fails
+// validation.
+func (s *Server) certRoute(c *gin.Context) {
+	if !s.cert.Valid() {
+		s.logger.Warn("upstream certificate invalid")
+		_ = errorResponse(c.Writer, http.StatusServiceUnavailable, "upstream certificate invalid")
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// limitRoute limits the number of concurrent requests forwarded to the
+// upstream, queueing requests above the limit for up to the queue timeout
+// then rejecting them.
+//
+// Note upgraded connections, such as WebSockets, hold their slot until the
+// connection closes.
+func (s *Server) limitRoute(c *gin.Context) {
+	if !s.limiter.Acquire(c.Request.Context()) {
+		s.logger.Warn(
+			"upstream concurrency limit reached",
+			zap.Int("active", s.limiter.Active()),
+		)
+		_ = errorResponse(c.Writer, http.StatusServiceUnavailable, "upstream concurrency limit reached")
+		c.Abort()
+		return
+	}
+	defer s.limiter.Release()
+
+	c.Next()
 }
 
 func (s *Server) panicRoute(c *gin.Context, err any) {
-	s.logger.Error(
-		"handler panic",
-		zap.String("path", c.FullPath()),
-		zap.Any("err", err),
-	)
+	s.panics.Observe(err)
 	c.AbortWithStatus(http.StatusInternalServerError)
 }
 
+// grpcService returns the gRPC service name from the request path, which has
+// the format '/<service>/<method>'.
+func grpcService(path string) string {
+	service, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return service
+}
+
 func init() {
 	// Disable Gin debug logs.
 	gin.SetMode(gin.ReleaseMode)
@@ -1,20 +1,34 @@
 package reverseproxy
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/agent/health"
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
 )
 
 func mustGet(t *testing.T, url string) string {
@@ -73,7 +87,7 @@ func TestServer_Forward(t *testing.T) {
 			defer ln.Close()
 			lnPort := ln.Addr().(*net.TCPAddr).Port
 
-			server := NewServer(cfg, metrics, log.NewNopLogger())
+			server := NewServer(cfg, nil, nil, protocol.Headers{}, metrics, nil, nil, nil, log.NewNopLogger())
 			go func() {
 				if err := server.Serve(ln); !errors.Is(err, net.ErrClosed) {
 					panic(err)
@@ -92,3 +106,619 @@ func TestServer_Forward(t *testing.T) {
 		})
 	})
 }
+
+func TestServer_EarlyHints(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Link", "</style.css>; rel=preload")
+			w.WriteHeader(http.StatusEarlyHints)
+			w.Header().Del("Link")
+
+			// nolint
+			w.Write([]byte("bar"))
+		},
+	))
+	defer upstream.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	server := NewServer(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       upstream.URL,
+	}, nil, nil, protocol.Headers{}, nil, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		// nolint
+		server.Serve(ln)
+	}()
+
+	var hints []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(status int, header textproto.MIMEHeader) error {
+			assert.Equal(t, http.StatusEarlyHints, status)
+			hints = append(hints, header.Get("Link"))
+			return nil
+		},
+	}
+	ctx := httptrace.WithClientTrace(context.Background(), trace)
+	req, _ := http.NewRequestWithContext(
+		ctx, http.MethodGet, "http://"+ln.Addr().String()+"/foo", nil,
+	)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"</style.css>; rel=preload"}, hints)
+}
+
+type closeRecordingListener struct {
+	net.Listener
+
+	closed atomic.Bool
+}
+
+func (l *closeRecordingListener) Close() error {
+	l.closed.Store(true)
+	return l.Listener.Close()
+}
+
+// Tests shutting down drains in-flight requests without closing the
+// listener, since closing a Piko listener would abort the in-flight
+// requests.
+func TestServer_Shutdown(t *testing.T) {
+	receivedCh := make(chan struct{})
+	releaseCh := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			close(receivedCh)
+			<-releaseCh
+			// nolint
+			w.Write([]byte("bar"))
+		},
+	))
+	defer upstream.Close()
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ln := &closeRecordingListener{Listener: tcpLn}
+	defer ln.Close()
+
+	server := NewServer(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       upstream.URL,
+	}, nil, nil, protocol.Headers{}, nil, nil, nil, nil, log.NewNopLogger())
+	serveErrCh := make(chan error, 1)
+	go func() {
+		serveErrCh <- server.Serve(ln)
+	}()
+
+	respCh := make(chan string, 1)
+	go func() {
+		respCh <- mustGet(t, "http://"+ln.Addr().String()+"/foo")
+	}()
+	<-receivedCh
+
+	shutdownErrCh := make(chan error, 1)
+	go func() {
+		shutdownErrCh <- server.Shutdown(context.Background())
+	}()
+
+	// Serve returns once shutdown starts, though the in-flight request is
+	// still being handled.
+	require.NoError(t, <-serveErrCh)
+	assert.False(t, ln.closed.Load())
+
+	close(releaseCh)
+	assert.Equal(t, "bar", <-respCh)
+	assert.NoError(t, <-shutdownErrCh)
+
+	assert.False(t, ln.closed.Load())
+}
+
+type fakeChecker struct {
+	statuses map[string]health.ServingStatus
+}
+
+func (c *fakeChecker) Check(_ context.Context, service string) (health.ServingStatus, error) {
+	return c.statuses[service], nil
+}
+
+func TestServer_HealthCheck(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer upstream.Close()
+
+	monitor := health.NewMonitor(
+		&fakeChecker{
+			statuses: map[string]health.ServingStatus{
+				"my.ServiceA": health.StatusServing,
+				"my.ServiceB": health.StatusNotServing,
+			},
+		},
+		[]string{"my.ServiceA", "my.ServiceB"},
+		time.Minute,
+		time.Second,
+		log.NewNopLogger(),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go monitor.Run(ctx)
+
+	assert.Eventually(t, func() bool {
+		return !monitor.Healthy("my.ServiceB")
+	}, time.Second, time.Millisecond*10)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	server := NewServer(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       upstream.URL,
+	}, nil, nil, protocol.Headers{}, nil, nil, monitor, nil, log.NewNopLogger())
+	go func() {
+		_ = server.Serve(ln)
+	}()
+
+	statusCode := func(path string) int {
+		resp, err := http.Post("http://"+ln.Addr().String()+path, "application/grpc", nil)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, statusCode("/my.ServiceA/Method"))
+	assert.Equal(t, http.StatusServiceUnavailable, statusCode("/my.ServiceB/Method"))
+	// Not checked.
+	assert.Equal(t, http.StatusOK, statusCode("/my.ServiceC/Method"))
+}
+
+func TestServer_MaxConcurrent(t *testing.T) {
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/block" {
+				blocked <- struct{}{}
+				<-release
+			}
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer upstream.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	server := NewServer(config.ListenerConfig{
+		EndpointID:    "my-endpoint",
+		Addr:          upstream.URL,
+		MaxConcurrent: 1,
+	}, nil, nil, protocol.Headers{}, nil, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		_ = server.Serve(ln)
+	}()
+
+	statusCode := func(path string) int {
+		resp, err := http.Get("http://" + ln.Addr().String() + path)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	done := make(chan int)
+	go func() {
+		done <- statusCode("/block")
+	}()
+	<-blocked
+
+	// The only slot is in use so the request is rejected.
+	assert.Equal(t, http.StatusServiceUnavailable, statusCode("/"))
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+
+	// Once the blocked request completes the slot is released.
+	assert.Equal(t, http.StatusOK, statusCode("/"))
+}
+
+func TestServer_Routes(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				// nolint
+				w.Write([]byte(name + " " + r.URL.Path))
+			},
+		))
+	}
+	defaultUpstream := newUpstream("default")
+	defer defaultUpstream.Close()
+	apiUpstream := newUpstream("api")
+	defer apiUpstream.Close()
+	v2Upstream := newUpstream("v2")
+	defer v2Upstream.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	server := NewServer(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       defaultUpstream.URL,
+		Routes: []config.RouteConfig{
+			{
+				PathPrefix:  "/api",
+				Addr:        apiUpstream.URL,
+				StripPrefix: true,
+			},
+			{
+				Headers: map[string]string{"X-Version": "2"},
+				Addr:    v2Upstream.URL,
+			},
+		},
+	}, nil, nil, protocol.Headers{}, nil, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		_ = server.Serve(ln)
+	}()
+
+	get := func(path string, header http.Header) string {
+		req, err := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String()+path, nil)
+		require.NoError(t, err)
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	assert.Equal(t, "api /users", get("/api/users", nil))
+	assert.Equal(t, "api /", get("/api", nil))
+	// The prefix only matches whole path segments.
+	assert.Equal(t, "default /apiv2", get("/apiv2", nil))
+	assert.Equal(t, "v2 /foo", get("/foo", http.Header{"X-Version": []string{"2"}}))
+	assert.Equal(t, "default /foo", get("/foo", http.Header{"X-Version": []string{"1"}}))
+	// Routes are matched in order.
+	assert.Equal(t, "api /foo", get("/api/foo", http.Header{"X-Version": []string{"2"}}))
+}
+
+func TestServer_Compression(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			assert.Empty(t, r.Header.Get("Content-Encoding"))
+			assert.Equal(t, int64(len(body)), r.ContentLength)
+
+			if r.URL.Path == "/small" {
+				body = []byte("small")
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.WriteHeader(http.StatusOK)
+			// nolint
+			w.Write(body)
+		},
+	))
+	defer upstream.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	server := NewServer(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       upstream.URL,
+		Compression: config.CompressionConfig{
+			DecompressRequests: true,
+			MaxRequestSize:     1024,
+			CompressResponses:  true,
+			MinResponseSize:    100,
+		},
+	}, nil, nil, protocol.Headers{}, nil, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		_ = server.Serve(ln)
+	}()
+
+	gzipped := func(b []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+		return buf.Bytes()
+	}
+
+	post := func(path string, encoding string, body []byte) *http.Response {
+		req, err := http.NewRequest(
+			http.MethodPost,
+			"http://"+ln.Addr().String()+path,
+			bytes.NewReader(body),
+		)
+		require.NoError(t, err)
+		req.Header.Set("Content-Encoding", encoding)
+		// Setting Accept-Encoding disables the client decompressing the
+		// response.
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		body := bytes.Repeat([]byte("a"), 1024)
+		resp := post("/", "gzip", gzipped(body))
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+		gz, err := gzip.NewReader(resp.Body)
+		require.NoError(t, err)
+		respBody, err := io.ReadAll(gz)
+		require.NoError(t, err)
+		assert.Equal(t, body, respBody)
+	})
+
+	t.Run("small response", func(t *testing.T) {
+		resp := post("/small", "", []byte("foo"))
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+
+		respBody, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "small", string(respBody))
+	})
+
+	t.Run("request too large", func(t *testing.T) {
+		resp := post("/", "gzip", gzipped(bytes.Repeat([]byte("a"), 1025)))
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+
+	t.Run("invalid body", func(t *testing.T) {
+		resp := post("/", "gzip", []byte("foo"))
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("unsupported encoding", func(t *testing.T) {
+		resp := post("/", "br", []byte("foo"))
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	})
+}
+
+func TestServer_Rewrite(t *testing.T) {
+	var upstreamURL string
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/redirect":
+				w.Header().Set("Location", upstreamURL+"/login")
+				w.WriteHeader(http.StatusFound)
+			case "/html":
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				// nolint
+				w.Write([]byte(`<a href="` + upstreamURL + `/foo">foo</a>`))
+			default:
+				w.Header().Set("Content-Type", "text/plain")
+				// nolint
+				w.Write([]byte(upstreamURL))
+			}
+		},
+	))
+	defer upstream.Close()
+	upstreamURL = upstream.URL
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	server := NewServer(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       upstream.URL,
+		Rewrite: config.RewriteConfig{
+			Enabled: true,
+		},
+	}, nil, nil, protocol.Headers{}, nil, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		_ = server.Serve(ln)
+	}()
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(path string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String()+path, nil)
+		require.NoError(t, err)
+		req.Host = "my-endpoint.example.com"
+		req.Header.Set("X-Forwarded-Proto", "https")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := get("/html")
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, `<a href="https://my-endpoint.example.com/foo">foo</a>`, string(body))
+
+	resp = get("/redirect")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "https://my-endpoint.example.com/login", resp.Header.Get("Location"))
+
+	// Other content types aren't rewritten.
+	resp = get("/text")
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, upstream.URL, string(body))
+}
+
+func TestServer_Redirects(t *testing.T) {
+	external := "http://example.com/external"
+	var upstreamURL string
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/a":
+				http.Redirect(w, r, "/b", http.StatusFound)
+			case "/b":
+				http.Redirect(w, r, upstreamURL+"/c", http.StatusSeeOther)
+			case "/loop":
+				http.Redirect(w, r, "/loop", http.StatusFound)
+			case "/external":
+				http.Redirect(w, r, external, http.StatusFound)
+			default:
+				// nolint
+				w.Write([]byte(r.Method + " " + r.URL.Path))
+			}
+		},
+	))
+	defer upstream.Close()
+	upstreamURL = upstream.URL
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	metrics := middleware.NewLabeledMetrics("agent")
+	server := NewServer(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       upstream.URL,
+		Redirects: config.RedirectConfig{
+			Follow:  true,
+			MaxHops: 3,
+		},
+	}, nil, nil, protocol.Headers{}, metrics, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		_ = server.Serve(ln)
+	}()
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	send := func(method string, path string) *http.Response {
+		req, err := http.NewRequest(method, "http://"+ln.Addr().String()+path, strings.NewReader("foo"))
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// Follows same-host redirects, switching to GET.
+	resp := send(http.MethodPost, "/a")
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "GET /c", string(body))
+	assert.Equal(t, 2.0, promtestutil.ToFloat64(
+		metrics.RedirectsFollowed.WithLabelValues("my-endpoint"),
+	))
+
+	// Redirects to other hosts are returned.
+	resp = send(http.MethodGet, "/external")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, external, resp.Header.Get("Location"))
+
+	// Stops at the hop limit.
+	resp = send(http.MethodGet, "/loop")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, 5.0, promtestutil.ToFloat64(
+		metrics.RedirectsFollowed.WithLabelValues("my-endpoint"),
+	))
+}
+
+func TestServer_Mirror(t *testing.T) {
+	mirrored := make(chan mirroredRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var m mirroredRequest
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&m))
+			mirrored <- m
+		},
+	))
+	defer collector.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			w.Header().Set("X-Upstream", "true")
+			w.WriteHeader(http.StatusCreated)
+			// nolint
+			w.Write(append([]byte("resp-"), body...))
+		},
+	))
+	defer upstream.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	server := NewServer(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       upstream.URL,
+		Mirror: config.MirrorConfig{
+			URL:         collector.URL,
+			MaxBodySize: 8,
+			QueueSize:   10,
+			Timeout:     time.Second,
+		},
+	}, nil, nil, protocol.Headers{}, nil, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	defer func() {
+		_ = server.Shutdown(context.Background())
+	}()
+
+	resp, err := http.Post(
+		"http://"+ln.Addr().String()+"/foo?bar=baz", "text/plain", strings.NewReader("hello"),
+	)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	// The proxied response isn't truncated.
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "resp-hello", string(body))
+
+	select {
+	case m := <-mirrored:
+		assert.Equal(t, "my-endpoint", m.EndpointID)
+		assert.Equal(t, http.MethodPost, m.Method)
+		assert.Equal(t, "/foo?bar=baz", m.RequestURI)
+		assert.Equal(t, "text/plain", m.RequestHeader.Get("Content-Type"))
+		assert.Equal(t, "hello", string(m.RequestBody))
+		assert.False(t, m.RequestBodyTruncated)
+
+		assert.Equal(t, http.StatusCreated, m.StatusCode)
+		assert.Equal(t, "true", m.ResponseHeader.Get("X-Upstream"))
+		assert.Equal(t, "resp-hel", string(m.ResponseBody))
+		assert.True(t, m.ResponseBodyTruncated)
+	case <-time.After(time.Second * 5):
+		t.Fatal("request not mirrored")
+	}
+}
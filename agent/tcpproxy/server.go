@@ -1,44 +1,73 @@
 package tcpproxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"time"
 
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 
 	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/agent/limit"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/recovery"
 )
 
+// defaultBufferSize is the default size of the buffer used to copy between
+// connections, which matches io.Copy.
+const defaultBufferSize = 32 << 10
+
 type Server struct {
 	conf config.ListenerConfig
 
+	tcpConf config.TCPConfig
+
 	ln net.Listener
 
 	dialer *net.Dialer
 
+	// limiter is nil if the number of concurrent connections isn't limited.
+	limiter *limit.Limiter
+
 	conns   map[net.Conn]struct{}
 	connsMu sync.Mutex
 
+	// panics runs the goroutine handling each connection, so a panic
+	// handling one connection closes only that connection.
+	panics *recovery.Pool
+
 	logger       log.Logger
 	accessLogger log.Logger
 }
 
 func NewServer(
 	conf config.ListenerConfig,
+	egress *config.EgressPolicy,
+	panicMetrics *recovery.Metrics,
 	logger log.Logger,
 ) *Server {
 	logger = logger.WithSubsystem("proxy.tcp")
 	logger = logger.With(zap.String("endpoint-id", conf.EndpointID))
 
+	tcpConf := conf.TCP
+	// Already verified in conf.Validate() so this shouldn't fail.
+	host, _, _ := conf.UpstreamHostPort()
 	s := &Server{
-		conf: conf,
+		conf:    conf,
+		tcpConf: tcpConf,
 		dialer: &net.Dialer{
-			Timeout: conf.Timeout,
+			Timeout:   conf.Timeout,
+			KeepAlive: tcpConf.KeepAlive,
+			Control:   egress.Control(host),
 		},
+		limiter:      limit.NewLimiter(conf.MaxConcurrent, conf.QueueTimeout),
 		conns:        make(map[net.Conn]struct{}),
+		panics:       recovery.NewPool("proxy.tcp", panicMetrics, logger),
 		logger:       logger,
 		accessLogger: logger.WithSubsystem("proxy.tcp.access"),
 	}
@@ -58,7 +87,9 @@ func (s *Server) Serve(ln net.Listener) error {
 		}
 
 		s.addConn(conn)
-		go s.serveConn(conn)
+		s.panics.Go(func() {
+			s.serveConn(conn)
+		})
 	}
 }
 
@@ -89,6 +120,18 @@ func (s *Server) serveConn(c net.Conn) {
 		// the error.
 		panic("invalid addr: " + s.conf.Addr)
 	}
+
+	// Wait for a slot before dialing, so connections above the limit never
+	// reach the upstream.
+	if !s.limiter.Acquire(context.Background()) {
+		s.logger.Warn(
+			"upstream concurrency limit reached; closing connection",
+			zap.Int("active", s.limiter.Active()),
+		)
+		return
+	}
+	defer s.limiter.Release()
+
 	upstream, err := s.dialer.Dial("tcp", host)
 	if err != nil {
 		s.logger.Warn("failed to dial upstream", zap.Error(err))
@@ -130,12 +173,22 @@ func (s *Server) logConnClosed() {
 }
 
 func (s *Server) forward(conn net.Conn, upstream net.Conn) {
+	var lastActive *atomic.Int64
+	if s.tcpConf.IdleTimeout != 0 {
+		lastActive = atomic.NewInt64(time.Now().UnixNano())
+
+		done := make(chan struct{})
+		defer close(done)
+		go s.closeIdle(conn, upstream, lastActive, done)
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
 		defer conn.Close()
-		_, err := io.Copy(conn, upstream)
+		defer s.panics.Recover()
+		err := s.copy(conn, upstream, lastActive)
 		if err != nil {
 			s.logger.Debug("copy to conn closed", zap.Error(err))
 		}
@@ -143,10 +196,76 @@ func (s *Server) forward(conn net.Conn, upstream net.Conn) {
 	go func() {
 		defer wg.Done()
 		defer upstream.Close()
-		_, err := io.Copy(upstream, conn)
+		defer s.panics.Recover()
+		err := s.copy(upstream, conn, lastActive)
 		if err != nil {
 			s.logger.Debug("copy to upstream closed", zap.Error(err))
 		}
 	}()
 	wg.Wait()
 }
+
+// copy copies from src to dst until either EOF is reached on src or an error
+// occurs. If 'lastActive' is not nil, it is updated with the time of each
+// read.
+//
+// Note this doesn't use io.CopyBuffer, since if dst implements
+// io.ReaderFrom (such as net.TCPConn) the buffer is ignored, so writes
+// wouldn't be bounded by the configured buffer size.
+func (s *Server) copy(dst net.Conn, src net.Conn, lastActive *atomic.Int64) error {
+	bufferSize := s.tcpConf.BufferSize
+	if bufferSize == 0 {
+		bufferSize = defaultBufferSize
+	}
+	buf := make([]byte, bufferSize)
+
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if lastActive != nil {
+				lastActive.Store(time.Now().UnixNano())
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// closeIdle closes the connections once there has been no traffic in either
+// direction for the idle timeout.
+func (s *Server) closeIdle(
+	conn net.Conn,
+	upstream net.Conn,
+	lastActive *atomic.Int64,
+	done <-chan struct{},
+) {
+	// Check at a fraction of the timeout, so connections are closed at most
+	// 25% after the idle timeout expires.
+	ticker := time.NewTicker(max(s.tcpConf.IdleTimeout/4, time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, lastActive.Load()))
+			if idle >= s.tcpConf.IdleTimeout {
+				s.logger.Debug(
+					"closing idle connection",
+					zap.Duration("idle", idle),
+				)
+				conn.Close()
+				upstream.Close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package tcpproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/recovery"
+)
+
+func echoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	upstreamLn := echoServer(t)
+	defer upstreamLn.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := NewServer(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       upstreamLn.Addr().String(),
+		Protocol:   config.ListenerProtocolTCP,
+		Timeout:    time.Second,
+		TCP: config.TCPConfig{
+			IdleTimeout: time.Millisecond * 100,
+			BufferSize:  4,
+		},
+	}, nil, nil, log.NewNopLogger())
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Verify data larger than the buffer is forwarded.
+	_, err = conn.Write([]byte("hello world"))
+	require.NoError(t, err)
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(buf))
+
+	// Wait for the connection to be closed due to being idle.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second*5)))
+	start := time.Now()
+	_, err = conn.Read(buf)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// panicConn is a connection that panics when read once 'after' bytes have
+// been read.
+type panicConn struct {
+	net.Conn
+
+	after int
+}
+
+func (c *panicConn) Read(b []byte) (int, error) {
+	if c.after <= 0 {
+		panic("injected panic")
+	}
+	if len(b) > c.after {
+		b = b[:c.after]
+	}
+	n, err := c.Conn.Read(b)
+	c.after -= n
+	return n, err
+}
+
+// panicListener wraps the first accepted connection with panicConn.
+type panicListener struct {
+	net.Listener
+
+	accepted int
+}
+
+func (l *panicListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.accepted++
+	if l.accepted == 1 {
+		return &panicConn{Conn: conn, after: 5}, nil
+	}
+	return conn, nil
+}
+
+// Tests a panic mid-stream closes only the connection that panicked.
+func TestServer_PanicIsolation(t *testing.T) {
+	upstreamLn := echoServer(t)
+	defer upstreamLn.Close()
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ln := &panicListener{Listener: tcpLn}
+
+	panicMetrics := recovery.NewMetrics()
+	server := NewServer(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       upstreamLn.Addr().String(),
+		Protocol:   config.ListenerProtocolTCP,
+		Timeout:    time.Second,
+	}, nil, panicMetrics, log.NewNopLogger())
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	defer server.Close()
+
+	panicked, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer panicked.Close()
+
+	healthy, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer healthy.Close()
+
+	// The first connection panics after forwarding 'hello'.
+	_, err = panicked.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	// The connection that panicked is closed.
+	require.NoError(t, panicked.SetReadDeadline(time.Now().Add(time.Second*5)))
+	_, err = io.ReadAll(panicked)
+	assert.NoError(t, err)
+
+	// The other connection is unaffected.
+	_, err = healthy.Write([]byte("hello world"))
+	require.NoError(t, err)
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(healthy, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(buf))
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(
+		panicMetrics.PanicsTotal.WithLabelValues("proxy.tcp"),
+	))
+}
+
+func TestServer_MaxConcurrent(t *testing.T) {
+	upstreamLn := echoServer(t)
+	defer upstreamLn.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := NewServer(config.ListenerConfig{
+		EndpointID:    "my-endpoint",
+		Addr:          upstreamLn.Addr().String(),
+		Protocol:      config.ListenerProtocolTCP,
+		Timeout:       time.Second,
+		MaxConcurrent: 1,
+	}, nil, nil, log.NewNopLogger())
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	defer server.Close()
+
+	echo := func(conn net.Conn) error {
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			return err
+		}
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second*5)))
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(conn, buf)
+		return err
+	}
+
+	active, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer active.Close()
+	require.NoError(t, echo(active))
+
+	// The only slot is in use so the connection is closed.
+	rejected, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer rejected.Close()
+	assert.Error(t, echo(rejected))
+
+	// Once the active connection closes the slot is released.
+	active.Close()
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		return echo(conn) == nil
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func TestServer_Egress(t *testing.T) {
+	upstreamLn := echoServer(t)
+	defer upstreamLn.Close()
+
+	echo := func(addr string, egress *config.EgressPolicy) error {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		server := NewServer(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       addr,
+			Protocol:   config.ListenerProtocolTCP,
+			Timeout:    time.Second,
+		}, egress, nil, log.NewNopLogger())
+		go func() {
+			_ = server.Serve(ln)
+		}()
+		defer server.Close()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			return err
+		}
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second*5)))
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		return err
+	}
+
+	_, port, err := net.SplitHostPort(upstreamLn.Addr().String())
+	require.NoError(t, err)
+
+	t.Run("permitted", func(t *testing.T) {
+		conf := config.EgressConfig{Allow: []string{"127.0.0.0/8:" + port}}
+		egress, err := conf.Policy()
+		require.NoError(t, err)
+
+		assert.NoError(t, echo(upstreamLn.Addr().String(), egress))
+	})
+
+	t.Run("resolved addr not permitted", func(t *testing.T) {
+		conf := config.EgressConfig{Allow: []string{"10.0.0.0/8"}}
+		egress, err := conf.Policy()
+		require.NoError(t, err)
+
+		// The host name may resolve to a permitted address so is only
+		// rejected when connecting.
+		assert.Error(t, echo("localhost:"+port, egress))
+	})
+}
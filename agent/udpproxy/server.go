@@ -0,0 +1,217 @@
+package udpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/agent/limit"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/pkg/recovery"
+)
+
+// Server forwards datagrams between incoming streams and the UDP upstream.
+//
+// Each stream carries the datagrams of a single client, framed with
+// [protocol.WriteDatagram], so the server dials the upstream from a new
+// local port for each stream, and the upstream sees each client as a
+// different peer.
+type Server struct {
+	conf config.ListenerConfig
+
+	ln net.Listener
+
+	dialer *net.Dialer
+
+	// limiter is nil if the number of concurrent sessions isn't limited.
+	limiter *limit.Limiter
+
+	conns   map[net.Conn]struct{}
+	connsMu sync.Mutex
+
+	// panics runs the goroutine handling each stream, so a panic handling
+	// one stream closes only that stream.
+	panics *recovery.Pool
+
+	logger       log.Logger
+	accessLogger log.Logger
+}
+
+func NewServer(
+	conf config.ListenerConfig,
+	egress *config.EgressPolicy,
+	panicMetrics *recovery.Metrics,
+	logger log.Logger,
+) *Server {
+	logger = logger.WithSubsystem("proxy.udp")
+	logger = logger.With(zap.String("endpoint-id", conf.EndpointID))
+
+	// Already verified in conf.Validate() so this shouldn't fail.
+	host, _, _ := conf.UpstreamHostPort()
+	return &Server{
+		conf: conf,
+		dialer: &net.Dialer{
+			Timeout: conf.Timeout,
+			Control: egress.Control(host),
+		},
+		limiter:      limit.NewLimiter(conf.MaxConcurrent, conf.QueueTimeout),
+		conns:        make(map[net.Conn]struct{}),
+		panics:       recovery.NewPool("proxy.udp", panicMetrics, logger),
+		logger:       logger,
+		accessLogger: logger.WithSubsystem("proxy.udp.access"),
+	}
+}
+
+func (s *Server) Serve(ln net.Listener) error {
+	s.ln = ln
+
+	s.logger.Info("starting udp proxy")
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("accept: %w", err)
+		}
+
+		s.addConn(conn)
+		s.panics.Go(func() {
+			s.serveConn(conn)
+		})
+	}
+}
+
+func (s *Server) Close() error {
+	if s.ln != nil {
+		s.ln.Close()
+	}
+
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	defer s.removeConn(c)
+	defer c.Close()
+
+	s.logSessionOpened()
+	defer s.logSessionClosed()
+
+	host, ok := s.conf.Host()
+	if !ok {
+		// We've already verified the address on boot so don't need to handle
+		// the error.
+		panic("invalid addr: " + s.conf.Addr)
+	}
+
+	if !s.limiter.Acquire(context.Background()) {
+		s.logger.Warn(
+			"upstream concurrency limit reached; closing session",
+			zap.Int("active", s.limiter.Active()),
+		)
+		return
+	}
+	defer s.limiter.Release()
+
+	upstream, err := s.dialer.Dial("udp", host)
+	if err != nil {
+		s.logger.Warn("failed to dial upstream", zap.Error(err))
+		return
+	}
+	defer upstream.Close()
+
+	s.forward(c, upstream)
+}
+
+// forward forwards datagrams between the stream and upstream until the
+// stream closes.
+func (s *Server) forward(conn net.Conn, upstream net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// Closing the upstream unblocks reading from the upstream below.
+		defer upstream.Close()
+		defer s.panics.Recover()
+
+		buf := make([]byte, protocol.MaxDatagramSize)
+		for {
+			n, err := protocol.ReadDatagram(conn, buf)
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					s.logger.Debug("read datagram from conn", zap.Error(err))
+				}
+				return
+			}
+			if _, err := upstream.Write(buf[:n]); err != nil {
+				// A write may fail if the upstream isn't listening, such
+				// as an ICMP port unreachable, though the upstream may
+				// recover so keep forwarding.
+				s.logger.Debug("write datagram to upstream", zap.Error(err))
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer conn.Close()
+		defer s.panics.Recover()
+
+		buf := make([]byte, protocol.MaxDatagramSize)
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				s.logger.Debug("read datagram from upstream", zap.Error(err))
+				continue
+			}
+			if err := protocol.WriteDatagram(conn, buf[:n]); err != nil {
+				s.logger.Debug("write datagram to conn", zap.Error(err))
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func (s *Server) addConn(c net.Conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	s.conns[c] = struct{}{}
+}
+
+func (s *Server) removeConn(c net.Conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	delete(s.conns, c)
+}
+
+func (s *Server) logSessionOpened() {
+	if s.conf.AccessLog {
+		s.accessLogger.Info("session opened")
+	} else {
+		s.accessLogger.Debug("session opened")
+	}
+}
+
+func (s *Server) logSessionClosed() {
+	if s.conf.AccessLog {
+		s.accessLogger.Info("session closed")
+	} else {
+		s.accessLogger.Debug("session closed")
+	}
+}
@@ -0,0 +1,67 @@
+package udpproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
+)
+
+func echoServer(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		buf := make([]byte, protocol.MaxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestServer_Forward(t *testing.T) {
+	upstream := echoServer(t)
+	defer upstream.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := NewServer(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       upstream.LocalAddr().String(),
+		Protocol:   config.ListenerProtocolUDP,
+		Timeout:    time.Second,
+	}, nil, nil, log.NewNopLogger())
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Datagram boundaries are preserved.
+	require.NoError(t, protocol.WriteDatagram(conn, []byte("foo")))
+	require.NoError(t, protocol.WriteDatagram(conn, []byte("barbaz")))
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second*5)))
+	buf := make([]byte, protocol.MaxDatagramSize)
+	n, err := protocol.ReadDatagram(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "foo", string(buf[:n]))
+	n, err = protocol.ReadDatagram(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "barbaz", string(buf[:n]))
+}
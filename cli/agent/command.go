@@ -2,6 +2,7 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
@@ -9,20 +10,27 @@ import (
 	"os/signal"
 	"syscall"
 
-	rungroup "github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 
 	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/agent/connect"
+	"github.com/andydunstall/piko/agent/health"
 	"github.com/andydunstall/piko/agent/reverseproxy"
 	"github.com/andydunstall/piko/agent/server"
 	"github.com/andydunstall/piko/agent/tcpproxy"
+	"github.com/andydunstall/piko/agent/udpproxy"
 	"github.com/andydunstall/piko/client"
+	"github.com/andydunstall/piko/pkg/backoff"
 	"github.com/andydunstall/piko/pkg/build"
 	pikoconfig "github.com/andydunstall/piko/pkg/config"
+	"github.com/andydunstall/piko/pkg/goruntime"
+	"github.com/andydunstall/piko/pkg/lifecycle"
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/pkg/recovery"
 )
 
 func NewCommand() *cobra.Command {
@@ -42,9 +50,27 @@ connection. Therefore the agent never exposes a port.
 If there are multiple listeners for the same endpoint, Piko load balances
 requests the registered listeners.
 
-Piko supports HTTP and TCP listeners. HTTP listeners parse and log each request
-before forwarding it to the upstream, whereas TCP listeners forward raw
-connections.
+To connect over multiple network paths, such as both an ethernet and an LTE
+interface, configure the local addresses of each interface with
+'--local-addrs' (or 'local_addrs' in the listener configuration). The agent
+opens a connection from each address, so Piko spreads requests across the
+paths and fails over to the remaining paths if one disconnects.
+
+Piko supports HTTP, TCP and UDP listeners. HTTP listeners parse and log each
+request before forwarding it to the upstream, whereas TCP listeners forward
+raw connections and UDP listeners forward datagrams.
+
+HTTP listeners can split requests between multiple upstream services by path
+prefix or header with 'routes' in the listener configuration, where requests
+that don't match a route are forwarded to the listener address.
+
+HTTP listeners can also decompress requests and compress responses on behalf
+of upstreams that don't support compression, with 'compression' in the
+listener configuration, and rewrite absolute URLs to the upstream in HTML and
+JSON responses with 'rewrite'. To avoid exposing redirects to internal-only
+upstream addresses, HTTP listeners can follow redirects to the upstream host
+with 'redirects'. For debugging or analytics, HTTP listeners can mirror a
+sampled copy of requests and responses to a local collector with 'mirror'.
 
 The agent supports both YAML configuration and command line flags. Configure
 a YAML file using '--config.path'. When enabling '--config.expand-env', Piko
@@ -59,6 +85,10 @@ Examples:
   # localhost:3000.
   piko agent tcp my-endpoint 3000
 
+  # Listen for SSH connections from endpoint 'my-device' and forward to
+  # localhost:22.
+  piko agent ssh my-device
+
   # Start all listeners configured in agent.yaml.
   piko agent start --config.file ./agent.yaml
 `,
@@ -93,6 +123,9 @@ Examples:
 	cmd.AddCommand(newStartCommand(conf))
 	cmd.AddCommand(newHTTPCommand(conf))
 	cmd.AddCommand(newTCPCommand(conf))
+	cmd.AddCommand(newUDPCommand(conf))
+	cmd.AddCommand(newSSHCommand(conf))
+	cmd.AddCommand(newDoctorCommand(conf))
 
 	return cmd
 }
@@ -114,63 +147,307 @@ func runAgent(conf *config.Config, logger log.Logger) error {
 		// Already verified in conf.Validate() so this shouldn't happen.
 		return fmt.Errorf("connect url: %w", err)
 	}
+	connectMetrics := connect.NewMetrics()
 	upstream := &client.Upstream{
 		URL:       connectURL,
 		Token:     conf.Connect.Token,
 		TLSConfig: connectTLSConfig,
 		Logger:    logger.WithSubsystem("client"),
+
+		WriteCoalesceDelay: conf.Connect.WriteCoalesceDelay,
+		MaxStreams:         conf.Connect.MaxStreams,
+		StreamWindow:       conf.Connect.StreamWindow,
+		MaxMessageSize:     conf.Connect.MaxMessageSize,
+		MinMessageSize:     conf.Connect.MinMessageSize,
+		HeaderPrefix:       conf.HeaderPrefix,
+
+		MinReconnectBackoff: conf.Connect.Reconnect.MinBackoff,
+		MaxReconnectBackoff: conf.Connect.Reconnect.MaxBackoff,
+		ReconnectJitter:     conf.Connect.Reconnect.Jitter,
+		MaxReconnectRetries: conf.Connect.Reconnect.MaxRetries,
+		ConnectObserver:     connectMetrics,
 	}
 
+	goruntime.Apply(conf.Runtime, logger)
+
 	registry := prometheus.NewRegistry()
+	goruntime.Register(registry)
+
+	// Components are started in the order they're added and stopped in the
+	// reverse order. So when shutting down each listener stops accepting
+	// requests, then drains in-flight requests, then closes its connection
+	// to Piko, and finally the agent flushes its logs.
+	manager := lifecycle.NewManager(logger)
+
+	// Flush buffered logs last.
+	manager.Add(lifecycle.Component{
+		Name: "logs",
+		Stop: func(context.Context) error {
+			// Ignore errors as syncing stdout and stderr fails on some
+			// platforms.
+			_ = logger.Sync()
+			return nil
+		},
+	})
 
-	var group rungroup.Group
+	// Agent server. Started first and stopped last so the agent reports
+	// metrics and status while the listeners drain.
+	if conf.Server.Enabled {
+		serverLn, err := net.Listen("tcp", conf.Server.BindAddr)
+		if err != nil {
+			return fmt.Errorf("server listen: %s: %w", conf.Server.BindAddr, err)
+		}
+		server := server.NewServer(registry, logger)
 
-	agentMetrics := middleware.NewLabeledMetrics("agent")
-	for _, listenerConfig := range conf.Listeners {
-		connectCtx, connectCancel := context.WithTimeout(
-			context.Background(),
-			conf.Connect.Timeout,
-		)
-		defer connectCancel()
+		manager.Add(lifecycle.Component{
+			Name: "server",
+			Run: func() error {
+				if err := server.Serve(serverLn); err != nil {
+					return fmt.Errorf("agent server: %w", err)
+				}
+				return nil
+			},
+			Stop: server.Shutdown,
+		})
+	}
 
-		ln, err := upstream.Listen(connectCtx, listenerConfig.EndpointID)
-		if err != nil {
-			return fmt.Errorf("listen: %s: %w", listenerConfig.EndpointID, err)
+	egress, err := conf.Egress.Policy()
+	if err != nil {
+		// Already verified in conf.Validate() so this shouldn't happen.
+		return fmt.Errorf("egress: %w", err)
+	}
+	keyring, err := conf.Encryption.Keyring()
+	if err != nil {
+		return fmt.Errorf("encryption: %w", err)
+	}
+	// Listeners from the command line are set after the configuration is
+	// validated, so check they're permitted by the egress policy here.
+	for _, listenerConfig := range conf.Listeners {
+		if !listenerConfig.PermittedBy(egress) {
+			return fmt.Errorf(
+				"listener: %s: addr not permitted by egress policy",
+				listenerConfig.EndpointID,
+			)
 		}
-		defer ln.Close()
+	}
 
-		if listenerConfig.Protocol == config.ListenerProtocolHTTP {
-			server := reverseproxy.NewServer(listenerConfig, agentMetrics, logger)
+	headers := protocol.NewHeaders(conf.HeaderPrefix)
 
-			// Listener handler.
-			group.Add(func() error {
-				if err := server.Serve(ln); err != nil {
-					return fmt.Errorf("serve: %w", err)
+	agentMetrics := middleware.NewLabeledMetrics("agent")
+	panicMetrics := recovery.NewMetrics()
+	certMetrics := health.NewCertMetrics()
+
+	// Connect the multiplexed listeners, which share connections to Piko,
+	// before serving the listeners.
+	multiplexed := make(map[*config.ListenerConfig]client.Listener)
+	for i, group := range multiplexGroups(conf.Listeners, conf.Connect.MultiplexEndpoints) {
+		var listeners []client.Listener
+		manager.Add(lifecycle.Component{
+			Name: fmt.Sprintf("connect.multiplexed.%d", i),
+			Start: func(ctx context.Context) error {
+				connectCtx, connectCancel := context.WithTimeout(
+					ctx, conf.Connect.Timeout,
+				)
+				defer connectCancel()
+
+				endpointIDs := make([]string, 0, len(group))
+				for _, listenerConfig := range group {
+					endpointIDs = append(endpointIDs, listenerConfig.EndpointID)
+				}
+				var err error
+				listeners, err = upstream.ListenMultiplexed(connectCtx, endpointIDs)
+				if err != nil {
+					return fmt.Errorf("listen: %w", err)
+				}
+				for i, listenerConfig := range group {
+					multiplexed[listenerConfig] = listeners[i]
 				}
 				return nil
-			}, func(error) {
-				shutdownCtx, cancel := context.WithTimeout(
-					context.Background(), conf.GracePeriod,
-				)
-				defer cancel()
+			},
+			Stop: func(context.Context) error {
+				// Listeners are normally closed by their own connect
+				// component, though may not have started.
+				var errs []error
+				for _, ln := range listeners {
+					if err := ln.Close(); err != nil {
+						errs = append(errs, err)
+					}
+				}
+				return errors.Join(errs...)
+			},
+		})
+	}
 
-				if err := server.Shutdown(shutdownCtx); err != nil {
-					logger.Warn("failed to gracefully shutdown listener", zap.Error(err))
+	for i := range conf.Listeners {
+		listenerConfig := conf.Listeners[i]
+		var ln client.Listener
+
+		var probeMonitor *health.Monitor
+		if listenerConfig.HealthCheck.ProbeEnabled() {
+			probeMonitor = newProbeMonitor(listenerConfig, logger)
+
+			// Probe handler.
+			probeCtx, probeCancel := context.WithCancel(context.Background())
+			manager.Add(lifecycle.Component{
+				Name: "probe." + listenerConfig.EndpointID,
+				Run: func() error {
+					probeMonitor.Run(probeCtx)
+					return nil
+				},
+				Stop: func(context.Context) error {
+					probeCancel()
+					return nil
+				},
+			})
+		}
+
+		// Connect to Piko before serving the listener.
+		manager.Add(lifecycle.Component{
+			Name: "connect." + listenerConfig.EndpointID,
+			Start: func(ctx context.Context) error {
+				if multiplexedLn, ok := multiplexed[&conf.Listeners[i]]; ok {
+					ln = multiplexedLn
+					return nil
+				}
+
+				listen := func(ctx context.Context) (client.Listener, error) {
+					connectCtx, connectCancel := context.WithTimeout(
+						ctx, conf.Connect.Timeout,
+					)
+					defer connectCancel()
+
+					if len(listenerConfig.LocalAddrs) > 0 {
+						localAddrs, err := listenerConfig.LocalTCPAddrs()
+						if err != nil {
+							return nil, fmt.Errorf("local addrs: %w", err)
+						}
+						return upstream.ListenMultipath(
+							connectCtx, listenerConfig.EndpointID, localAddrs,
+						)
+					}
+					return upstream.Listen(connectCtx, listenerConfig.EndpointID)
 				}
+
+				// If the upstream is probed, only register the endpoint
+				// while the upstream is healthy.
+				if probeMonitor != nil {
+					// Retry until the agent shuts down rather than
+					// exiting if Piko is briefly unreachable when the
+					// upstream recovers.
+					newBackoff := func() *backoff.Backoff {
+						return backoff.New(
+							0,
+							conf.Connect.Reconnect.MinBackoff,
+							conf.Connect.Reconnect.MaxBackoff,
+							backoff.WithJitter(conf.Connect.Reconnect.Jitter),
+						)
+					}
+					ln = health.NewGatedListener(
+						listenerConfig.EndpointID, probeMonitor, listen, newBackoff, logger,
+					)
+					return nil
+				}
+
+				var err error
+				ln, err = listen(ctx)
+				if err != nil {
+					return fmt.Errorf("listen: %w", err)
+				}
+				return nil
+			},
+			Stop: func(context.Context) error {
+				return ln.Close()
+			},
+		})
+
+		if listenerConfig.Protocol == config.ListenerProtocolHTTP {
+			var healthMonitor *health.Monitor
+			if len(listenerConfig.HealthCheck.GRPCServices) != 0 {
+				healthMonitor = newHealthMonitor(listenerConfig, logger)
+
+				// Health check handler.
+				healthCtx, healthCancel := context.WithCancel(context.Background())
+				manager.Add(lifecycle.Component{
+					Name: "health." + listenerConfig.EndpointID,
+					Run: func() error {
+						healthMonitor.Run(healthCtx)
+						return nil
+					},
+					Stop: func(context.Context) error {
+						healthCancel()
+						return nil
+					},
+				})
+			}
+
+			var certMonitor *health.CertMonitor
+			if listenerConfig.CertCheck.Enabled {
+				certMonitor = newCertMonitor(listenerConfig, certMetrics, logger)
+
+				// Certificate check handler.
+				certCtx, certCancel := context.WithCancel(context.Background())
+				manager.Add(lifecycle.Component{
+					Name: "cert." + listenerConfig.EndpointID,
+					Run: func() error {
+						certMonitor.Run(certCtx)
+						return nil
+					},
+					Stop: func(context.Context) error {
+						certCancel()
+						return nil
+					},
+				})
+			}
+
+			server := reverseproxy.NewServer(
+				listenerConfig, egress, keyring, headers, agentMetrics, panicMetrics,
+				healthMonitor, certMonitor, logger,
+			)
+
+			// Listener handler. Shutting down the server stops accepting
+			// requests and drains in-flight requests, though doesn't close
+			// the connection to Piko, which is closed once drained.
+			manager.Add(lifecycle.Component{
+				Name: "listener." + listenerConfig.EndpointID,
+				Run: func() error {
+					if err := server.Serve(ln); err != nil {
+						return fmt.Errorf("serve: %w", err)
+					}
+					return nil
+				},
+				Stop: server.Shutdown,
 			})
 		} else if listenerConfig.Protocol == config.ListenerProtocolTCP {
-			server := tcpproxy.NewServer(listenerConfig, logger)
+			server := tcpproxy.NewServer(listenerConfig, egress, panicMetrics, logger)
 
 			// Listener handler.
-			group.Add(func() error {
-				if err := server.Serve(ln); err != nil {
-					return fmt.Errorf("serve: %w", err)
-				}
-				return nil
-			}, func(error) {
-				if err := server.Close(); err != nil {
-					logger.Warn("failed to close listener", zap.Error(err))
-				}
+			manager.Add(lifecycle.Component{
+				Name: "listener." + listenerConfig.EndpointID,
+				Run: func() error {
+					if err := server.Serve(ln); err != nil {
+						return fmt.Errorf("serve: %w", err)
+					}
+					return nil
+				},
+				Stop: func(context.Context) error {
+					return server.Close()
+				},
+			})
+		} else if listenerConfig.Protocol == config.ListenerProtocolUDP {
+			server := udpproxy.NewServer(listenerConfig, egress, panicMetrics, logger)
+
+			// Listener handler.
+			manager.Add(lifecycle.Component{
+				Name: "listener." + listenerConfig.EndpointID,
+				Run: func() error {
+					if err := server.Serve(ln); err != nil {
+						return fmt.Errorf("serve: %w", err)
+					}
+					return nil
+				},
+				Stop: func(context.Context) error {
+					return server.Close()
+				},
 			})
 		} else {
 			// Verified on startup so should never happen.
@@ -179,51 +456,133 @@ func runAgent(conf *config.Config, logger log.Logger) error {
 	}
 	if registry != nil {
 		agentMetrics.Register(registry)
-	}
-
-	// Agent server.
-	if conf.Server.Enabled {
-		serverLn, err := net.Listen("tcp", conf.Server.BindAddr)
-		if err != nil {
-			return fmt.Errorf("server listen: %s: %w", conf.Server.BindAddr, err)
-		}
-		server := server.NewServer(registry, logger)
-
-		group.Add(func() error {
-			if err := server.Serve(serverLn); err != nil {
-				return fmt.Errorf("agent server: %w", err)
-			}
-			return nil
-		}, func(error) {
-			shutdownCtx, cancel := context.WithTimeout(
-				context.Background(), conf.GracePeriod,
-			)
-			defer cancel()
-
-			if err := server.Shutdown(shutdownCtx); err != nil {
-				logger.Warn("failed to gracefully shutdown agent server", zap.Error(err))
-			}
-		})
+		panicMetrics.Register(registry)
+		certMetrics.Register(registry)
+		connectMetrics.Register(registry)
 	}
 
 	// Termination handler.
-	signalCtx, signalCancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
-	group.Add(func() error {
+	defer signal.Stop(signalCh)
+	go func() {
 		select {
 		case sig := <-signalCh:
 			logger.Info(
 				"received shutdown signal",
 				zap.String("signal", sig.String()),
 			)
-			return nil
-		case <-signalCtx.Done():
-			return nil
+			cancel()
+		case <-ctx.Done():
 		}
-	}, func(error) {
-		signalCancel()
-	})
+	}()
+
+	return manager.Run(ctx, conf.GracePeriod)
+}
+
+// multiplexGroups returns the listeners that share each multiplexed
+// connection to Piko, with up to multiplexEndpoints listeners per
+// connection, or nil if listeners aren't multiplexed.
+//
+// Listeners with local addresses connect over their own paths, and probed
+// listeners connect and withdraw independently, so aren't multiplexed.
+// Listeners on the same endpoint use different connections.
+func multiplexGroups(
+	listeners []config.ListenerConfig, multiplexEndpoints int,
+) [][]*config.ListenerConfig {
+	if multiplexEndpoints <= 1 {
+		return nil
+	}
+
+	var groups [][]*config.ListenerConfig
+	var group []*config.ListenerConfig
+	endpoints := make(map[string]struct{})
+	for i := range listeners {
+		listenerConfig := &listeners[i]
+		if len(listenerConfig.LocalAddrs) > 0 ||
+			listenerConfig.HealthCheck.ProbeEnabled() {
+			continue
+		}
+		if _, ok := endpoints[listenerConfig.EndpointID]; ok ||
+			len(group) == multiplexEndpoints {
+			groups = append(groups, group)
+			group = nil
+			endpoints = make(map[string]struct{})
+		}
+		group = append(group, listenerConfig)
+		endpoints[listenerConfig.EndpointID] = struct{}{}
+	}
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+func newHealthMonitor(conf config.ListenerConfig, logger log.Logger) *health.Monitor {
+	// Already verified in conf.Validate() so these shouldn't fail.
+	u, _ := conf.URL()
+	tlsConfig, _ := conf.TLS.Load()
 
-	return group.Run()
+	logger = logger.WithSubsystem("health").With(
+		zap.String("endpoint-id", conf.EndpointID),
+	)
+	return health.NewMonitor(
+		health.NewGRPCChecker(u, tlsConfig),
+		conf.HealthCheck.GRPCServices,
+		conf.HealthCheck.Interval,
+		conf.HealthCheck.Timeout,
+		logger,
+	)
+}
+
+// newProbeMonitor returns a monitor that probes the health check path of the
+// upstream. The upstream has a single status, so is checked as the overall
+// server health.
+func newProbeMonitor(conf config.ListenerConfig, logger log.Logger) *health.Monitor {
+	// Already verified in conf.Validate() so these shouldn't fail.
+	u, _ := conf.URL()
+	tlsConfig, _ := conf.TLS.Load()
+
+	logger = logger.WithSubsystem("health.probe").With(
+		zap.String("endpoint-id", conf.EndpointID),
+	)
+	return health.NewMonitor(
+		health.NewHTTPChecker(
+			u, conf.HealthCheck.Path, conf.HealthCheck.ExpectedStatus, tlsConfig,
+		),
+		[]string{""},
+		conf.HealthCheck.Interval,
+		conf.HealthCheck.Timeout,
+		logger,
+	)
+}
+
+func newCertMonitor(
+	conf config.ListenerConfig,
+	metrics *health.CertMetrics,
+	logger log.Logger,
+) *health.CertMonitor {
+	// Already verified in conf.Validate() so these shouldn't fail.
+	u, _ := conf.URL()
+	tlsConfig, _ := conf.TLS.Load()
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "443")
+	}
+
+	logger = logger.WithSubsystem("health.cert").With(
+		zap.String("endpoint-id", conf.EndpointID),
+	)
+	return health.NewCertMonitor(
+		conf.EndpointID,
+		addr,
+		tlsConfig,
+		conf.CertCheck.Interval,
+		conf.CertCheck.Timeout,
+		metrics,
+		logger,
+	)
 }
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/agent/doctor"
+	pikodoctor "github.com/andydunstall/piko/pkg/doctor"
+)
+
+func newDoctorCommand(conf *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "doctor [flags]",
+		Short: "check the agent configuration and connectivity",
+		Long: `Checks the agent can connect to the Piko server and the
+configured upstream services, and prints the result of each check with hints
+on how to fix any failures.
+
+Checks:
+- dns: Resolves the server host
+- tcp: Connects to the server
+- tls: Performs a TLS handshake with the server, if the server URL uses HTTPS
+- clock: Compares the agent clock with the server clock, since tokens may be
+  rejected if the clocks differ
+- token: Checks the server accepts the token for the first listener endpoint
+- websocket: Opens a WebSocket connection to the server for the first listener
+  endpoint, which checks any proxies between the agent and server support
+  WebSockets
+- upstream: Connects to the upstream service of each listener, and the
+  upstream service of each listener route
+
+Note the WebSocket check briefly registers a listener for the endpoint, which
+Piko may route a request to before the connection closes.
+
+Exits with a non-zero status if any check fails.
+
+Examples:
+  # Check the listeners configured in agent.yaml.
+  piko agent doctor --config.file ./agent.yaml
+
+  # Check connectivity to the server.
+  piko agent doctor --connect.url https://piko.example.com:8001
+`,
+	}
+
+	var timeout time.Duration
+	cmd.Flags().DurationVar(
+		&timeout,
+		"timeout",
+		time.Second*10,
+		`
+Timeout of each check.`,
+	)
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		results := doctor.NewDoctor(conf, timeout).Run(context.Background())
+		pikodoctor.Print(os.Stdout, results)
+
+		if pikodoctor.Failed(results) {
+			os.Exit(1)
+		}
+	}
+
+	return cmd
+}
@@ -32,6 +32,10 @@ Examples:
 
   # Listen and forward to 10.26.104.56:3000 using HTTPS.
   piko agent http my-endpoint https://10.26.104.56:3000
+
+  # Listen for connections from every endpoint in namespace 'team-a' (such
+  # as 'team-a/service-b') and forward to localhost:3000.
+  piko agent http 'team-a/*' 3000
 `,
 	}
 
@@ -44,6 +48,19 @@ Examples:
 Whether to log all incoming HTTP requests and responses as 'info' logs.`,
 	)
 
+	var sampleRate int
+	cmd.Flags().IntVar(
+		&sampleRate,
+		"sample-rate",
+		0,
+		`
+Samples 1 in every N requests when logging requests and recording request
+and response size metrics.
+
+Requests that fail with a server error are always sampled. Zero or one
+samples all requests.`,
+	)
+
 	var timeout time.Duration
 	cmd.Flags().DurationVar(
 		&timeout,
@@ -53,17 +70,328 @@ Whether to log all incoming HTTP requests and responses as 'info' logs.`,
 Timeout forwarding incoming HTTP requests to the upstream.`,
 	)
 
+	var maxConcurrent int
+	cmd.Flags().IntVar(
+		&maxConcurrent,
+		"max-concurrent",
+		0,
+		`
+Maximum number of concurrent requests to forward to the upstream, to
+avoid overwhelming upstreams that can't handle much parallel traffic, such as
+the web server of an embedded device.
+
+Requests rejected due to the limit receive '503 Service Unavailable'.
+
+Zero means no limit.`,
+	)
+
+	var queueTimeout time.Duration
+	cmd.Flags().DurationVar(
+		&queueTimeout,
+		"queue-timeout",
+		0,
+		`
+Maximum duration to queue requests waiting for a slot when at
+'--max-concurrent', before rejecting them.
+
+Zero rejects requests above the limit without queueing.`,
+	)
+
+	var healthCheck config.HealthCheckConfig
+	cmd.Flags().StringArrayVar(
+		&healthCheck.GRPCServices,
+		"health-check.grpc-services",
+		nil,
+		`
+gRPC service names to health check using the standard gRPC health checking
+protocol (grpc.health.v1). Use an empty name ('') to check the overall health
+of the upstream server. The flag can be given multiple times to check
+multiple services.
+
+Such as '--health-check.grpc-services "" --health-check.grpc-services
+my.package.MyService'.
+
+Requests to a service that fails its health check are rejected with
+'503 Service Unavailable'. If the overall server health check fails, all
+requests are rejected.
+
+If not given, gRPC health checks are disabled.`,
+	)
+	cmd.Flags().StringVar(
+		&healthCheck.Path,
+		"health-check.path",
+		"",
+		`
+HTTP path to probe to check the health of the upstream, such as '/healthz'.
+
+The agent only registers the endpoint with Piko while the probe succeeds, and
+withdraws the endpoint when the probe fails, so requests are routed to other
+upstreams for the endpoint.
+
+If not given, the upstream isn't probed.`,
+	)
+	cmd.Flags().IntVar(
+		&healthCheck.ExpectedStatus,
+		"health-check.expected-status",
+		0,
+		`
+HTTP status code the health check probe must return. If zero, any 2xx status
+is healthy.`,
+	)
+	cmd.Flags().DurationVar(
+		&healthCheck.Interval,
+		"health-check.interval",
+		time.Second*10,
+		`
+Interval between health checks.`,
+	)
+	cmd.Flags().DurationVar(
+		&healthCheck.Timeout,
+		"health-check.timeout",
+		time.Second*5,
+		`
+Timeout for each health check.`,
+	)
+
+	var certCheck config.CertCheckConfig
+	cmd.Flags().BoolVar(
+		&certCheck.Enabled,
+		"cert-check.enabled",
+		false,
+		`
+Whether to periodically check the TLS certificate of an HTTPS upstream.
+
+The agent records the certificate expiry and whether it passes validation as
+metrics, so expired or misconfigured certificates are noticed.`,
+	)
+	cmd.Flags().DurationVar(
+		&certCheck.Interval,
+		"cert-check.interval",
+		time.Minute,
+		`
+Interval between certificate checks.`,
+	)
+	cmd.Flags().DurationVar(
+		&certCheck.Timeout,
+		"cert-check.timeout",
+		time.Second*5,
+		`
+Timeout for each certificate check.`,
+	)
+	cmd.Flags().BoolVar(
+		&certCheck.Enforce,
+		"cert-check.enforce",
+		false,
+		`
+Whether to reject requests with '503 Service Unavailable' when the upstream
+certificate fails validation.`,
+	)
+
+	var record config.RecordConfig
+	cmd.Flags().StringVar(
+		(*string)(&record.Mode),
+		"record.mode",
+		"",
+		`
+Records upstream responses or replays recorded responses, to run
+deterministic tests of clients that call the upstream.
+
+Supports 'record', which forwards requests to the upstream and records the
+responses, and 'replay', which responds with the recorded responses without
+forwarding requests to the upstream.
+
+Responses are keyed by the request method, URI and body. Gateway errors and
+WebSocket connections aren't recorded.
+
+If not given, recording is disabled.`,
+	)
+	cmd.Flags().StringVar(
+		&record.Path,
+		"record.path",
+		"",
+		`
+Directory to store recorded responses.`,
+	)
+
+	var compression config.CompressionConfig
+	cmd.Flags().BoolVar(
+		&compression.DecompressRequests,
+		"compression.decompress-requests",
+		false,
+		`
+Whether to decompress gzip and deflate encoded request bodies before
+forwarding to the upstream, for upstreams that don't support compressed
+requests.
+
+Requests with other content encodings are rejected with
+'415 Unsupported Media Type'.`,
+	)
+	cmd.Flags().Int64Var(
+		&compression.MaxRequestSize,
+		"compression.max-request-size",
+		10*1024*1024,
+		`
+Maximum size of a decompressed request body in bytes.
+
+Requests that exceed the limit are rejected with '413 Request Entity Too
+Large', to protect against decompression bombs.`,
+	)
+	cmd.Flags().BoolVar(
+		&compression.CompressResponses,
+		"compression.compress-responses",
+		false,
+		`
+Whether to gzip compress responses on behalf of the upstream, for clients
+that accept gzip. Responses the upstream already compressed are forwarded
+unchanged.`,
+	)
+	cmd.Flags().Int64Var(
+		&compression.MinResponseSize,
+		"compression.min-response-size",
+		1024,
+		`
+Minimum response size in bytes to compress. Responses of unknown size are
+always compressed.`,
+	)
+
+	var rewrite config.RewriteConfig
+	cmd.Flags().BoolVar(
+		&rewrite.Enabled,
+		"rewrite.enabled",
+		false,
+		`
+Whether to rewrite absolute URLs in upstream responses from the upstream
+address origin to the public endpoint origin, for upstreams that emit
+absolute links.
+
+Rewrites the 'Location' header and the bodies of HTML and JSON responses.`,
+	)
+	cmd.Flags().StringSliceVar(
+		&rewrite.Origins,
+		"rewrite.origins",
+		nil,
+		`
+Internal origins to rewrite in addition to the upstream address origin, such
+as '--rewrite.origins http://127.0.0.1:3000'.`,
+	)
+	cmd.Flags().StringVar(
+		&rewrite.PublicOrigin,
+		"rewrite.public-origin",
+		"",
+		`
+Origin to rewrite internal origins to, such as
+'https://my-endpoint.example.com'.
+
+If not given, uses the request host, with the scheme from the
+'X-Forwarded-Proto' header or 'http' if not set.`,
+	)
+
+	var redirects config.RedirectConfig
+	cmd.Flags().BoolVar(
+		&redirects.Follow,
+		"redirects.follow",
+		false,
+		`
+Whether to follow upstream redirects to the upstream host inside the agent,
+rather than returning them to the client, for upstreams that redirect to
+internal-only addresses.
+
+Redirects to other hosts are returned to the client.`,
+	)
+	cmd.Flags().IntVar(
+		&redirects.MaxHops,
+		"redirects.max-hops",
+		5,
+		`
+Maximum number of redirects to follow for each request.`,
+	)
+
+	var mirror config.MirrorConfig
+	cmd.Flags().StringVar(
+		&mirror.URL,
+		"mirror.url",
+		"",
+		`
+URL of a local HTTP collector to mirror a sampled copy of requests and
+responses to, such as 'http://localhost:9000/mirror'.
+
+The agent POSTs each mirrored request and response as JSON, asynchronously
+so the collector never delays proxied requests.
+
+If not given, requests aren't mirrored.`,
+	)
+	cmd.Flags().IntVar(
+		&mirror.SampleRate,
+		"mirror.sample-rate",
+		1,
+		`
+Mirrors 1 in every N requests. Such as '--mirror.sample-rate 10' mirrors 10%
+of requests.`,
+	)
+	cmd.Flags().Int64Var(
+		&mirror.MaxBodySize,
+		"mirror.max-body-size",
+		64*1024,
+		`
+Maximum number of bytes of the request and response bodies to mirror. Larger
+bodies are truncated.`,
+	)
+	cmd.Flags().IntVar(
+		&mirror.QueueSize,
+		"mirror.queue-size",
+		1000,
+		`
+Maximum number of mirrored requests queued to be sent to the collector. Once
+full, new requests aren't mirrored.`,
+	)
+	cmd.Flags().DurationVar(
+		&mirror.Timeout,
+		"mirror.timeout",
+		time.Second*5,
+		`
+Timeout sending each mirrored request to the collector.`,
+	)
+
+	var localAddrs []string
+	cmd.Flags().StringSliceVar(
+		&localAddrs,
+		"local-addrs",
+		nil,
+		`
+Local IP addresses to connect to the Piko server from, such as the addresses
+of an ethernet and an LTE interface.
+
+The agent opens a connection for the endpoint from each address, so Piko
+spreads requests across the connections and fails over to the remaining
+connections if one disconnects.
+
+Such as '--local-addrs 192.168.1.10,10.64.0.2'.
+
+If not given, the agent opens a single connection.`,
+	)
+
 	var logger log.Logger
 
 	cmd.PreRun = func(_ *cobra.Command, args []string) {
 		// Discard any listeners in the configuration file and use from command
 		// line.
 		conf.Listeners = []config.ListenerConfig{{
-			EndpointID: args[0],
-			Addr:       args[1],
-			Protocol:   config.ListenerProtocolHTTP,
-			AccessLog:  accessLog,
-			Timeout:    timeout,
+			EndpointID:    args[0],
+			Addr:          args[1],
+			Protocol:      config.ListenerProtocolHTTP,
+			AccessLog:     accessLog,
+			SampleRate:    sampleRate,
+			Timeout:       timeout,
+			MaxConcurrent: maxConcurrent,
+			QueueTimeout:  queueTimeout,
+			HealthCheck:   healthCheck,
+			CertCheck:     certCheck,
+			Record:        record,
+			Compression:   compression,
+			Rewrite:       rewrite,
+			Redirects:     redirects,
+			Mirror:        mirror,
+			LocalAddrs:    localAddrs,
 		}}
 
 		var err error
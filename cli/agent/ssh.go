@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func newSSHCommand(conf *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ssh [endpoint] [addr] [flags]",
+		Args:  cobra.RangeArgs(1, 2),
+		Short: "register an ssh listener",
+		Long: `Listens for SSH connections on the given endpoint and forwards
+them to your local SSH server.
+
+This is a TCP listener tuned for SSH, which enables TCP keep-alives to the SSH
+server and never closes idle sessions. Clients connect using
+'piko connect ssh' as an SSH ProxyCommand, so Piko can be used instead of a
+bastion host to access devices that aren't publicly routable.
+
+The configured SSH server address may be a port or host and port. Defaults to
+port 22.
+
+Examples:
+  # Listen for connections from endpoint 'my-device' and forward to the
+  # SSH server on localhost:22.
+  piko agent ssh my-device
+
+  # Listen and forward to an SSH server on port 2222.
+  piko agent ssh my-device 2222
+
+  # Then connect from a client.
+  ssh -o ProxyCommand='piko connect ssh %h' user@my-device
+`,
+	}
+
+	var accessLog bool
+	cmd.Flags().BoolVar(
+		&accessLog,
+		"access-log",
+		true,
+		`
+Whether to log all incoming connections as 'info' logs.`,
+	)
+
+	var timeout time.Duration
+	cmd.Flags().DurationVar(
+		&timeout,
+		"timeout",
+		time.Second*10,
+		`
+Timeout connecting to the SSH server.`,
+	)
+
+	var logger log.Logger
+
+	cmd.PreRun = func(_ *cobra.Command, args []string) {
+		addr := "22"
+		if len(args) > 1 {
+			addr = args[1]
+		}
+
+		// Discard any listeners in the configuration file and use from command
+		// line.
+		conf.Listeners = []config.ListenerConfig{{
+			EndpointID: args[0],
+			Addr:       addr,
+			Protocol:   config.ListenerProtocolTCP,
+			AccessLog:  accessLog,
+			Timeout:    timeout,
+		}}
+
+		var err error
+		logger, err = log.NewLogger(conf.Log.Level, conf.Log.Subsystems)
+		if err != nil {
+			fmt.Printf("failed to setup logger: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		if err := runAgent(conf, logger); err != nil {
+			logger.Error("failed to run agent", zap.Error(err))
+			os.Exit(1)
+		}
+	}
+
+	return cmd
+}
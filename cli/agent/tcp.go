@@ -50,17 +50,101 @@ Whether to log all incoming connections as 'info' logs.`,
 Timeout connecting to the upstream.`,
 	)
 
+	var maxConcurrent int
+	cmd.Flags().IntVar(
+		&maxConcurrent,
+		"max-concurrent",
+		0,
+		`
+Maximum number of concurrent connections to forward to the upstream, to
+avoid overwhelming upstreams that can't handle much parallel traffic, such as
+the web server of an embedded device.
+
+Connections rejected due to the limit are closed.
+
+Zero means no limit.`,
+	)
+
+	var queueTimeout time.Duration
+	cmd.Flags().DurationVar(
+		&queueTimeout,
+		"queue-timeout",
+		0,
+		`
+Maximum duration to queue connections waiting for a slot when at
+'--max-concurrent', before rejecting them.
+
+Zero rejects connections above the limit without queueing.`,
+	)
+
+	var tcpConf config.TCPConfig
+	cmd.Flags().DurationVar(
+		&tcpConf.IdleTimeout,
+		"idle-timeout",
+		0,
+		`
+Closes connections with no traffic in either direction for the given
+duration.
+
+Zero disables the idle timeout.`,
+	)
+	cmd.Flags().DurationVar(
+		&tcpConf.KeepAlive,
+		"keep-alive",
+		0,
+		`
+TCP keep-alive period of connections to the upstream.
+
+Zero uses the system default, and a negative value disables keep-alives.`,
+	)
+	cmd.Flags().IntVar(
+		&tcpConf.BufferSize,
+		"buffer-size",
+		0,
+		`
+Size of the buffer in bytes used to copy data between the client and
+upstream.
+
+This bounds the size of each frame sent to the server, so smaller buffers
+mean connections on the listener spend less time queued behind large frames
+from bulk transfers on other connections, at the cost of throughput.
+
+Zero uses the default (32 KB).`,
+	)
+
+	var localAddrs []string
+	cmd.Flags().StringSliceVar(
+		&localAddrs,
+		"local-addrs",
+		nil,
+		`
+Local IP addresses to connect to the Piko server from, such as the addresses
+of an ethernet and an LTE interface.
+
+The agent opens a connection for the endpoint from each address, so Piko
+spreads requests across the connections and fails over to the remaining
+connections if one disconnects.
+
+Such as '--local-addrs 192.168.1.10,10.64.0.2'.
+
+If not given, the agent opens a single connection.`,
+	)
+
 	var logger log.Logger
 
 	cmd.PreRun = func(_ *cobra.Command, args []string) {
 		// Discard any listeners in the configuration file and use from command
 		// line.
 		conf.Listeners = []config.ListenerConfig{{
-			EndpointID: args[0],
-			Addr:       args[1],
-			Protocol:   config.ListenerProtocolTCP,
-			AccessLog:  accessLog,
-			Timeout:    timeout,
+			EndpointID:    args[0],
+			Addr:          args[1],
+			Protocol:      config.ListenerProtocolTCP,
+			AccessLog:     accessLog,
+			Timeout:       timeout,
+			MaxConcurrent: maxConcurrent,
+			QueueTimeout:  queueTimeout,
+			TCP:           tcpConf,
+			LocalAddrs:    localAddrs,
 		}}
 
 		var err error
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func newUDPCommand(conf *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "udp [endpoint] [addr] [flags]",
+		Args:  cobra.ExactArgs(2),
+		Short: "register a udp listener",
+		Long: `Listens for UDP traffic on the given endpoint and forwards
+incoming datagrams to your upstream service, such as a DNS or game server.
+
+Clients send datagrams to the endpoint using 'piko forward udp'. The agent
+forwards each client's datagrams from a different local port, so the
+upstream sees each client as a different peer, and forwards the upstream's
+responses back to the client.
+
+The configured upstream address be a port or host and port.
+
+Examples:
+  # Listen for datagrams from endpoint 'my-endpoint' and forward to
+  # localhost:53.
+  piko agent udp my-endpoint 53
+
+  # Listen and forward to 10.26.104.56:27015.
+  piko agent udp my-endpoint 10.26.104.56:27015
+`,
+	}
+
+	var accessLog bool
+	cmd.Flags().BoolVar(
+		&accessLog,
+		"access-log",
+		true,
+		`
+Whether to log all client sessions as 'info' logs.`,
+	)
+
+	var timeout time.Duration
+	cmd.Flags().DurationVar(
+		&timeout,
+		"timeout",
+		time.Second*10,
+		`
+Timeout resolving the upstream address.`,
+	)
+
+	var maxConcurrent int
+	cmd.Flags().IntVar(
+		&maxConcurrent,
+		"max-concurrent",
+		0,
+		`
+Maximum number of concurrent client sessions to forward to the upstream.
+
+Zero means no limit.`,
+	)
+
+	var logger log.Logger
+
+	cmd.PreRun = func(_ *cobra.Command, args []string) {
+		// Discard any listeners in the configuration file and use from command
+		// line.
+		conf.Listeners = []config.ListenerConfig{{
+			EndpointID:    args[0],
+			Addr:          args[1],
+			Protocol:      config.ListenerProtocolUDP,
+			AccessLog:     accessLog,
+			Timeout:       timeout,
+			MaxConcurrent: maxConcurrent,
+		}}
+
+		var err error
+		logger, err = log.NewLogger(conf.Log.Level, conf.Log.Subsystems)
+		if err != nil {
+			fmt.Printf("failed to setup logger: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		if err := runAgent(conf, logger); err != nil {
+			logger.Error("failed to run agent", zap.Error(err))
+			os.Exit(1)
+		}
+	}
+
+	return cmd
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/andydunstall/piko/cli/agent"
 	"github.com/andydunstall/piko/cli/bench"
+	"github.com/andydunstall/piko/cli/connect"
 	"github.com/andydunstall/piko/cli/forward"
 	"github.com/andydunstall/piko/cli/server"
 	"github.com/andydunstall/piko/cli/test"
@@ -57,6 +58,13 @@ to an upstream listener via Piko. Such as to forward port 3000 to endpoint
 
   $ piko forward tcp 3000 my-endpoint
 
+To use Piko instead of a bastion host for SSH, register your SSH server with
+'piko agent ssh', then connect using 'piko connect ssh' as an SSH
+ProxyCommand:
+
+  $ piko agent ssh my-device
+  $ ssh -o ProxyCommand='piko connect ssh %h' user@my-device
+
 `,
 		Version: build.Version,
 	}
@@ -64,6 +72,7 @@ to an upstream listener via Piko. Such as to forward port 3000 to endpoint
 	cmd.AddCommand(server.NewCommand())
 	cmd.AddCommand(agent.NewCommand())
 	cmd.AddCommand(forward.NewCommand())
+	cmd.AddCommand(connect.NewCommand())
 	cmd.AddCommand(bench.NewCommand())
 	cmd.AddCommand(test.NewCommand())
 
@@ -0,0 +1,44 @@
+package connect
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/andydunstall/piko/forward/config"
+)
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "connect [command] [flags]",
+		Short: "connect to an upstream endpoint",
+		Long: `Piko connect opens a connection to an upstream endpoint and
+forwards it to stdin and stdout.
+
+Unlike 'piko forward', which listens on a local port, this is designed to be
+used as a proxy command by other tools, such as an SSH ProxyCommand.
+
+Examples:
+  # Connect to an SSH server registered with 'piko agent ssh my-device'.
+  ssh -o ProxyCommand='piko connect ssh %h' user@my-device
+`,
+	}
+
+	conf := config.Default().Connect
+
+	// Register flags and set default values.
+	conf.RegisterFlags(cmd.PersistentFlags())
+
+	cmd.PersistentPreRun = func(_ *cobra.Command, _ []string) {
+		if err := conf.Validate(); err != nil {
+			// Write to stderr since stdout is forwarded to the endpoint.
+			fmt.Fprintf(os.Stderr, "config: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	cmd.AddCommand(newSSHCommand(&conf))
+
+	return cmd
+}
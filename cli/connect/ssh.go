@@ -0,0 +1,80 @@
+package connect
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/andydunstall/piko/client"
+	"github.com/andydunstall/piko/forward"
+	"github.com/andydunstall/piko/forward/config"
+)
+
+func newSSHCommand(conf *config.ConnectConfig) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ssh [endpoint] [flags]",
+		Args:  cobra.ExactArgs(1),
+		Short: "connect to an ssh endpoint",
+		Long: `Connects to the SSH server registered with the given endpoint
+and forwards the connection to stdin and stdout.
+
+This is designed to be used as an SSH ProxyCommand, where the SSH client
+runs the command and uses stdin and stdout as the connection to the SSH
+server. Register the SSH server using 'piko agent ssh'.
+
+Examples:
+  # Connect to the SSH server on endpoint 'my-device'.
+  ssh -o ProxyCommand='piko connect ssh %h' user@my-device
+
+  # Or configure in ~/.ssh/config to connect to all hosts ending in '.piko'
+  # using Piko:
+  #
+  # Host *.piko
+  #   ProxyCommand piko connect ssh --connect.url https://piko.example.com %n
+  #
+  # Where %n is the host name of the original command line, such as
+  # 'ssh user@my-device.piko' connects to endpoint 'my-device.piko'.
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, args []string) {
+		if err := runSSH(args[0], conf); err != nil {
+			// Write to stderr since stdout is forwarded to the SSH client.
+			fmt.Fprintf(os.Stderr, "piko: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	return cmd
+}
+
+func runSSH(endpointID string, conf *config.ConnectConfig) error {
+	tlsConfig, err := conf.TLS.Load()
+	if err != nil {
+		return fmt.Errorf("connect tls: %w", err)
+	}
+	connectURL, err := url.Parse(conf.URL)
+	if err != nil {
+		// Already verified in conf.Validate() so this shouldn't happen.
+		return fmt.Errorf("connect url: %w", err)
+	}
+	dialer := &client.Dialer{
+		URL:       connectURL,
+		Token:     conf.Token,
+		TLSConfig: tlsConfig,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Timeout)
+	defer cancel()
+
+	conn, err := dialer.Dial(ctx, endpointID)
+	if err != nil {
+		return fmt.Errorf("dial: %s: %w", endpointID, err)
+	}
+	defer conn.Close()
+
+	return forward.Pipe(conn, os.Stdin, os.Stdout)
+}
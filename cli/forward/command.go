@@ -39,6 +39,9 @@ Examples:
   # Listen for connections on port 3000 and forward to endpoint "my-endpoint".
   piko forward tcp 3000 my-endpoint
 
+  # Listen for datagrams on port 5353 and forward to endpoint "my-endpoint".
+  piko forward udp 5353 my-endpoint
+
   # Start all ports configured in forward.yaml
   piko forward start --config.file ./forward.yaml
 `,
@@ -65,6 +68,7 @@ Examples:
 
 	cmd.AddCommand(newStartCommand(conf))
 	cmd.AddCommand(newTCPCommand(conf))
+	cmd.AddCommand(newUDPCommand(conf))
 
 	return cmd
 }
@@ -96,6 +100,33 @@ func runForward(conf *config.Config, logger log.Logger) error {
 
 	for _, portConfig := range conf.Ports {
 		host, _ := portConfig.Host()
+
+		if portConfig.Protocol == config.PortProtocolUDP {
+			conn, err := net.ListenPacket("udp", host)
+			if err != nil {
+				return fmt.Errorf("listen: %s: %w", host, err)
+			}
+
+			forwarder := forward.NewUDPForwarder(
+				portConfig.EndpointID,
+				dialer,
+				portConfig.IdleTimeout,
+				logger.WithSubsystem("forwarder"),
+			)
+
+			group.Add(func() error {
+				if err := forwarder.Forward(conn); err != nil {
+					return fmt.Errorf("serve: %w", err)
+				}
+				return nil
+			}, func(error) {
+				if err := forwarder.Close(); err != nil {
+					logger.Warn("failed to close forwarder", zap.Error(err))
+				}
+			})
+			continue
+		}
+
 		ln, err := net.Listen("tcp", host)
 		if err != nil {
 			return fmt.Errorf("listen: %s: %w", host, err)
@@ -0,0 +1,75 @@
+package forward
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/forward/config"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func newUDPCommand(conf *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "udp [addr] [endpoint] [flags]",
+		Args:  cobra.ExactArgs(2),
+		Short: "open a udp port",
+		Long: `Opens a UDP port and forwards datagrams to the configured endpoint,
+which must have an agent UDP listener (see 'piko agent udp').
+
+Each client address has its own connection to the endpoint, which is closed
+once the client is idle for '--idle-timeout'.
+
+The configured address may be a port or host and port.
+
+Examples:
+  # Listen for datagrams on port 5353 and forward to endpoint "my-endpoint".
+  piko forward udp 5353 my-endpoint
+
+  # Listen for datagrams on 0.0.0.0:27015.
+  piko forward udp 0.0.0.0:27015 my-endpoint
+`,
+	}
+
+	var idleTimeout time.Duration
+	cmd.Flags().DurationVar(
+		&idleTimeout,
+		"idle-timeout",
+		time.Minute,
+		`
+Closes the connection to the endpoint for a client once no datagrams have been
+sent in either direction for the timeout.`,
+	)
+
+	var logger log.Logger
+
+	cmd.PreRun = func(_ *cobra.Command, args []string) {
+		// Discard any ports in the configuration file and use from command
+		// line.
+		conf.Ports = []config.PortConfig{{
+			Addr:        args[0],
+			EndpointID:  args[1],
+			Protocol:    config.PortProtocolUDP,
+			IdleTimeout: idleTimeout,
+		}}
+
+		var err error
+		logger, err = log.NewLogger(conf.Log.Level, conf.Log.Subsystems)
+		if err != nil {
+			fmt.Printf("failed to setup logger: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		if err := runForward(conf, logger); err != nil {
+			logger.Error("failed to run forward", zap.Error(err))
+			os.Exit(1)
+		}
+	}
+
+	return cmd
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/andydunstall/piko/cli/server/status"
 	pikoconfig "github.com/andydunstall/piko/pkg/config"
+	"github.com/andydunstall/piko/pkg/goruntime"
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/server"
 	"github.com/andydunstall/piko/server/cluster"
@@ -104,11 +105,14 @@ Examples:
 	}
 
 	cmd.AddCommand(status.NewCommand())
+	cmd.AddCommand(newDoctorCommand())
 
 	return cmd
 }
 
 func runServer(conf *config.Config, logger log.Logger) error {
+	goruntime.Apply(conf.Runtime, logger)
+
 	ctx, cancel := signal.NotifyContext(
 		context.Background(), syscall.SIGINT, syscall.SIGTERM,
 	)
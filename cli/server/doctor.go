@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	pikoconfig "github.com/andydunstall/piko/pkg/config"
+	pikodoctor "github.com/andydunstall/piko/pkg/doctor"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/doctor"
+)
+
+func newDoctorCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "doctor [flags]",
+		Short: "run preflight checks of the server configuration",
+		Long: `Runs preflight checks of the server configuration and host
+before starting the server, and prints the result of each check with hints on
+how to fix any failures.
+
+Accepts the same configuration and flags as 'piko server', so can be run
+before starting the server, such as in an init container, to fail fast with
+clear messages.
+
+Checks:
+- config: The configuration is valid
+- tls: Each configured certificate and key are a valid pair and the
+  certificate hasn't expired
+- file limit: The file descriptor limit is high enough for the server to
+  handle many connections
+- port: Each bind address is available
+- cluster: The gossip port of each member in '--cluster.join' is reachable
+
+Exits with a non-zero status if any check fails.
+
+Examples:
+  # Check the server configuration in server.yaml.
+  piko server doctor --config.path ./server.yaml
+`,
+	}
+
+	conf := config.Default()
+	var loadConf pikoconfig.Config
+
+	conf.RegisterFlags(cmd.Flags())
+	loadConf.RegisterFlags(cmd.Flags())
+
+	var timeout time.Duration
+	cmd.Flags().DurationVar(
+		&timeout,
+		"doctor.timeout",
+		time.Second*5,
+		`
+Timeout of each check.`,
+	)
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		if err := pikoconfig.Load(conf, loadConf.Path, loadConf.ExpandEnv); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		if conf.Cluster.NodeID == "" {
+			conf.Cluster.NodeID = conf.Cluster.NodeIDPrefix + cluster.GenerateNodeID()
+		}
+
+		results := doctor.NewDoctor(conf, timeout).Run(context.Background())
+		pikodoctor.Print(os.Stdout, results)
+
+		if pikodoctor.Failed(results) {
+			os.Exit(1)
+		}
+	}
+
+	return cmd
+}
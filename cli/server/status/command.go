@@ -22,6 +22,7 @@ can be used to answer questions such as:
 * What upstream listeners are attached to each node?
 * What cluster state does this node know?
 * What is the gossip state of each known node?
+* What optional features are enabled on this node?
 
 See 'piko server status --help' for the available commands.
 
@@ -53,6 +54,7 @@ Examples:
 	cmd.AddCommand(newUpstreamCommand(c))
 	cmd.AddCommand(newClusterCommand(c))
 	cmd.AddCommand(newGossipCommand(c))
+	cmd.AddCommand(newFeaturesCommand(c))
 
 	return cmd
 }
@@ -0,0 +1,49 @@
+package status
+
+import (
+	"fmt"
+	"os"
+
+	yaml "github.com/goccy/go-yaml"
+	"github.com/spf13/cobra"
+
+	"github.com/andydunstall/piko/server/status/client"
+)
+
+func newFeaturesCommand(c *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "features",
+		Short: "inspect enabled features",
+		Long: `Inspect enabled features.
+
+Queries the server for the optional features enabled on the node, and a hash
+of each feature's configuration. Comparing the hashes across nodes verifies
+the nodes run the same configuration, without exposing the configuration.
+
+Examples:
+  piko server status features
+
+  # Inspect the features of node cv6cdyo.
+  piko server status features --forward cv6cdyo
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		showFeatures(c)
+	}
+
+	return cmd
+}
+
+func showFeatures(c *client.Client) {
+	features := client.NewFeatures(c)
+
+	report, err := features.Report()
+	if err != nil {
+		fmt.Printf("failed to get features: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	b, _ := yaml.Marshal(report)
+	fmt.Print(string(b))
+}
@@ -2,12 +2,19 @@ package client
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/andydunstall/yamux"
 	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/websocket"
 )
 
 type pikoAddr struct {
@@ -32,15 +39,51 @@ type Listener interface {
 	EndpointID() string
 }
 
+// closeFrameTimeout is the maximum duration to wait to send the close frame
+// to the Piko server when the listener is closed.
+const closeFrameTimeout = time.Second
+
+// messageSizeWriteTimeouts is the number of consecutive disconnects due to
+// write timeouts before the listener reduces its message size.
+const messageSizeWriteTimeouts = 2
+
 type listener struct {
 	endpointID string
 
+	// multiplexedEndpoints contains the endpoints of a multiplexed
+	// connection, or is nil if the listener isn't multiplexed.
+	multiplexedEndpoints []string
+
+	// sessionID identifies the listener to the Piko server, so if the
+	// listener reconnects after a brief disconnect, the server resumes the
+	// existing registration.
+	sessionID string
+
 	upstream *Upstream
 
 	// sess contains the connected yamux session to the Piko server.
 	//
 	// This is used to accept incoming multiplexed connections.
 	sess *yamux.Session
+	// conn is the WebSocket connection carrying sess.
+	conn *websocket.Conn
+
+	// acceptCancel cancels the pending accept, so accept moves to the new
+	// session after reconnecting due to the server draining.
+	acceptCancel context.CancelFunc
+	// drained is closed once the listener has reconnected after the server
+	// notified the connection is draining, or is nil if the connection
+	// isn't draining.
+	drained chan struct{}
+
+	mu sync.Mutex
+
+	// messageSize is the message size of the current connection, which is
+	// reduced after repeated write timeouts.
+	messageSize int
+	// writeTimeouts is the number of consecutive disconnects due to write
+	// timeouts.
+	writeTimeouts int
 
 	// closeCtx closes the listener on listener.Close()
 	closeCtx    context.Context
@@ -53,7 +96,9 @@ func newListener(endpointID string, upstream *Upstream, logger Logger) *listener
 	closeCtx, closeCancel := context.WithCancel(context.Background())
 	return &listener{
 		endpointID:  endpointID,
+		sessionID:   newSessionID(),
 		upstream:    upstream,
+		messageSize: upstream.maxMessageSize(),
 		closeCtx:    closeCtx,
 		closeCancel: closeCancel,
 		logger:      logger,
@@ -66,7 +111,14 @@ func (l *listener) Accept() (net.Conn, error) {
 
 func (l *listener) AcceptWithContext(ctx context.Context) (net.Conn, error) {
 	for {
-		conn, err := l.sess.AcceptStreamWithContext(ctx)
+		acceptCtx, cancel := context.WithCancel(ctx)
+		l.mu.Lock()
+		sess := l.sess
+		l.acceptCancel = cancel
+		l.mu.Unlock()
+
+		conn, err := sess.AcceptStreamWithContext(acceptCtx)
+		cancel()
 		if err == nil {
 			return conn, nil
 		}
@@ -75,15 +127,58 @@ func (l *listener) AcceptWithContext(ctx context.Context) (net.Conn, error) {
 			return nil, ctx.Err()
 		}
 
+		l.mu.Lock()
+		current := l.sess
+		drained := l.drained
+		l.mu.Unlock()
+		if current != sess {
+			// Reconnected after the server drained the connection.
+			continue
+		}
+		if drained != nil {
+			// The draining connection closed before the listener
+			// reconnected, so wait for the reconnect rather than opening
+			// another connection.
+			select {
+			case <-drained:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
 		if errors.Is(err, yamux.ErrSessionShutdown) {
 			return nil, ErrClosed
 		}
 
-		l.logger.Warn("disconnected; reconnecting", zap.Error(err))
+		// The server sends a close code when deliberately closing the
+		// connection, such as when the token expires, so only log failures
+		// as warnings.
+		code := websocket.CloseCodeOf(err)
+		if code.Deliberate() {
+			l.logger.Info(
+				"disconnected; reconnecting",
+				zap.String("reason", code.String()),
+				zap.Int("close-code", int(code)),
+			)
+		} else {
+			l.logger.Warn(
+				"disconnected; reconnecting",
+				zap.String("reason", code.String()),
+				zap.Int("close-code", int(code)),
+				zap.Error(err),
+			)
+		}
+		if l.upstream.ConnectObserver != nil {
+			l.upstream.ConnectObserver.OnDisconnect(l.endpointIDs(), err)
+		}
+
+		l.adjustMessageSize(err)
 
 		if err := l.connect(l.closeCtx); err != nil {
 			return nil, fmt.Errorf("connect: %w", err)
 		}
+		l.logger.Info("reconnected")
 	}
 }
 
@@ -94,8 +189,16 @@ func (l *listener) Addr() net.Addr {
 func (l *listener) Close() error {
 	// Cancel to stop reconnect attempts.
 	l.closeCancel()
-	// Close the current session.
-	return l.sess.Close()
+
+	l.mu.Lock()
+	sess := l.sess
+	conn := l.conn
+	l.mu.Unlock()
+
+	// Notify the server the listener closed deliberately, then close the
+	// current session.
+	_ = conn.WriteClose(websocket.CloseNormal, time.Now().Add(closeFrameTimeout))
+	return sess.Close()
 }
 
 func (l *listener) EndpointID() string {
@@ -106,12 +209,128 @@ func (l *listener) EndpointID() string {
 //
 // The endpoint ID and token are included in the initial request.
 func (l *listener) connect(ctx context.Context) error {
-	sess, err := l.upstream.connect(ctx, l.endpointID)
+	sess, conn, err := l.upstream.connect(
+		ctx, l.endpointID, l.multiplexedEndpoints, l.sessionID, l.messageSize, l.onDrain,
+	)
 	if err != nil {
 		return err
 	}
+	l.mu.Lock()
 	l.sess = sess
+	l.conn = conn
+	l.mu.Unlock()
 	return nil
 }
 
+// endpointIDs returns the endpoints of the listener connection.
+func (l *listener) endpointIDs() []string {
+	if l.multiplexedEndpoints != nil {
+		return l.multiplexedEndpoints
+	}
+	return []string{l.endpointID}
+}
+
+func (l *listener) session() *yamux.Session {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.sess
+}
+
+// onDrain is called when the server notifies the connection is draining, such
+// as when the server is shutting down.
+//
+// Requests on the draining connection can still complete, so the listener
+// reconnects without closing the draining connection, which the server closes
+// once its requests complete.
+func (l *listener) onDrain() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.drained != nil {
+		return
+	}
+	l.drained = make(chan struct{})
+	// Called while reading from the connection so must not block.
+	go l.reconnectDrained(l.drained)
+}
+
+func (l *listener) reconnectDrained(drained chan struct{}) {
+	l.logger.Info("server draining connection; reconnecting")
+
+	sess, conn, err := l.upstream.connect(
+		l.closeCtx, l.endpointID, l.multiplexedEndpoints, l.sessionID, l.messageSize, l.onDrain,
+	)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.drained = nil
+	defer close(drained)
+
+	if err != nil {
+		if l.closeCtx.Err() == nil {
+			l.logger.Warn("failed to reconnect", zap.Error(err))
+		}
+		return
+	}
+	if l.closeCtx.Err() != nil {
+		sess.Close()
+		return
+	}
+
+	l.sess = sess
+	l.conn = conn
+	if l.acceptCancel != nil {
+		l.acceptCancel()
+	}
+}
+
+// adjustMessageSize halves the message size after consecutive disconnects
+// due to write timeouts, since timeouts that persist across reconnects
+// suggest large packets are being dropped.
+func (l *listener) adjustMessageSize(err error) {
+	if !isWriteTimeout(err) {
+		l.writeTimeouts = 0
+		return
+	}
+
+	l.writeTimeouts++
+	if l.writeTimeouts < messageSizeWriteTimeouts {
+		return
+	}
+	l.writeTimeouts = 0
+
+	messageSize := max(l.messageSize/2, l.upstream.minMessageSize())
+	if messageSize == l.messageSize {
+		return
+	}
+	l.logger.Warn(
+		"repeated write timeouts; reducing message size",
+		zap.Int("message-size", messageSize),
+		zap.Int("previous-message-size", l.messageSize),
+	)
+	l.messageSize = messageSize
+}
+
+// isWriteTimeout returns whether the session closed due to timing out
+// writing to the Piko server.
+//
+// This includes keep-alive timeouts, since when large packets are dropped
+// the connection stalls with unacknowledged data, so pings aren't answered
+// before the writes themselves time out.
+func isWriteTimeout(err error) bool {
+	return errors.Is(err, yamux.ErrConnectionWriteTimeout) ||
+		errors.Is(err, yamux.ErrKeepAliveTimeout) ||
+		errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("read random: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
 var _ Listener = &listener{}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/yamux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/websocket"
+)
+
+func TestListener_AdjustMessageSize(t *testing.T) {
+	t.Run("reduced after write timeouts", func(t *testing.T) {
+		ln := newListener("my-endpoint", &Upstream{
+			MinMessageSize: 4096,
+		}, (&Upstream{}).logger())
+		assert.Equal(t, websocket.MaxMessageSize, ln.messageSize)
+
+		// A single timeout isn't enough to reduce.
+		ln.adjustMessageSize(yamux.ErrKeepAliveTimeout)
+		assert.Equal(t, websocket.MaxMessageSize, ln.messageSize)
+
+		// Other errors reset the count.
+		ln.adjustMessageSize(io.EOF)
+		ln.adjustMessageSize(yamux.ErrConnectionWriteTimeout)
+		assert.Equal(t, websocket.MaxMessageSize, ln.messageSize)
+
+		ln.adjustMessageSize(yamux.ErrConnectionWriteTimeout)
+		assert.Equal(t, websocket.MaxMessageSize/2, ln.messageSize)
+
+		// Reduced down to the minimum.
+		for i := 0; i != 10; i++ {
+			ln.adjustMessageSize(yamux.ErrConnectionWriteTimeout)
+		}
+		assert.Equal(t, 4096, ln.messageSize)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		ln := newListener("my-endpoint", &Upstream{
+			MaxMessageSize: 8192,
+		}, (&Upstream{}).logger())
+		assert.Equal(t, 8192, ln.messageSize)
+
+		for i := 0; i != 10; i++ {
+			ln.adjustMessageSize(yamux.ErrConnectionWriteTimeout)
+		}
+		assert.Equal(t, 8192, ln.messageSize)
+	})
+}
+
+type fakeConnectObserver struct {
+	failed  int
+	retries int
+	mu      sync.Mutex
+}
+
+func (o *fakeConnectObserver) OnConnect(_ []string, _ int) {}
+
+func (o *fakeConnectObserver) OnConnectFailed(_ []string, _ error, retry bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.failed++
+	if retry {
+		o.retries++
+	}
+}
+
+func (o *fakeConnectObserver) OnDisconnect(_ []string, _ error) {}
+
+func TestUpstream_MaxReconnectRetries(t *testing.T) {
+	// Listen then close to get an address that refuses connections.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	observer := &fakeConnectObserver{}
+	upstream := &Upstream{
+		URL: &url.URL{
+			Scheme: "http",
+			Host:   addr,
+		},
+		MinReconnectBackoff: time.Millisecond,
+		MaxReconnectBackoff: time.Millisecond * 10,
+		MaxReconnectRetries: 3,
+		ConnectObserver:     observer,
+	}
+
+	_, err = upstream.Listen(context.Background(), "my-endpoint")
+	assert.ErrorContains(t, err, "max retries exceeded")
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	// The initial attempt and each retry fail, then the listener gives up.
+	assert.Equal(t, 4, observer.failed)
+	assert.Equal(t, 3, observer.retries)
+}
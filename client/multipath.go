@@ -0,0 +1,181 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// multipathListener is a [Listener] that connects to the Piko server over
+// multiple network paths, such as using both an ethernet and LTE interface.
+//
+// Each path registers a separate upstream connection for the endpoint, so the
+// Piko server spreads incoming connections across the paths, and if a path
+// disconnects, routes connections to the remaining paths until it reconnects.
+type multipathListener struct {
+	endpointID string
+
+	// connected contains the paths that have connected to the Piko server.
+	connected map[*listener]struct{}
+	mu        sync.Mutex
+
+	conns chan net.Conn
+
+	// done is closed once all paths have closed.
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	closeCtx    context.Context
+	closeCancel context.CancelFunc
+
+	logger Logger
+}
+
+// ListenMultipath listens for connections on the given endpoint, connecting
+// to the Piko server from each of the given local addresses.
+//
+// Listen succeeds once any path connects. Paths that fail to connect keep
+// retrying in the background, as do paths that disconnect.
+func (u *Upstream) ListenMultipath(
+	ctx context.Context, endpointID string, localAddrs []net.Addr,
+) (Listener, error) {
+	if len(localAddrs) == 0 {
+		return nil, fmt.Errorf("missing local addrs")
+	}
+
+	closeCtx, closeCancel := context.WithCancel(context.Background())
+	ln := &multipathListener{
+		endpointID:  endpointID,
+		connected:   make(map[*listener]struct{}),
+		conns:       make(chan net.Conn),
+		done:        make(chan struct{}),
+		closeCtx:    closeCtx,
+		closeCancel: closeCancel,
+		logger:      u.logger(),
+	}
+
+	connectCtx, connectCancel := context.WithCancel(ctx)
+	defer connectCancel()
+
+	results := make(chan error, len(localAddrs))
+	for _, localAddr := range localAddrs {
+		pathUpstream := *u
+		pathUpstream.LocalAddr = localAddr
+		path := newListener(endpointID, &pathUpstream, u.logger())
+
+		ln.wg.Add(1)
+		go func() {
+			defer ln.wg.Done()
+			ln.servePath(connectCtx, path, localAddr, results)
+		}()
+	}
+	go func() {
+		ln.wg.Wait()
+		close(ln.done)
+	}()
+
+	var errs []error
+	for range localAddrs {
+		err := <-results
+		if err == nil {
+			return ln, nil
+		}
+		errs = append(errs, err)
+	}
+	ln.Close()
+	return nil, fmt.Errorf("connect: %w", errors.Join(errs...))
+}
+
+func (l *multipathListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrClosed
+	}
+}
+
+func (l *multipathListener) Addr() net.Addr {
+	return &pikoAddr{endpointID: l.endpointID}
+}
+
+func (l *multipathListener) Close() error {
+	l.closeCancel()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var errs []error
+	for path := range l.connected {
+		if err := path.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l *multipathListener) EndpointID() string {
+	return l.endpointID
+}
+
+// servePath connects the path then accepts connections until the listener
+// is closed.
+//
+// The result of the initial connect attempt is sent to results. If the
+// attempt fails the path keeps retrying in the background.
+func (l *multipathListener) servePath(
+	connectCtx context.Context,
+	path *listener,
+	localAddr net.Addr,
+	results chan<- error,
+) {
+	addrField := zap.String("local-addr", localAddr.String())
+
+	err := path.connect(connectCtx)
+	results <- err
+	if err != nil {
+		// If the connect was cancelled as another path connected first, keep
+		// connecting in the background without logging.
+		if connectCtx.Err() == nil {
+			l.logger.Warn("path failed to connect; retrying", addrField, zap.Error(err))
+		}
+		if err := path.connect(l.closeCtx); err != nil {
+			if l.closeCtx.Err() == nil {
+				l.logger.Error("path failed to connect", addrField, zap.Error(err))
+			}
+			return
+		}
+	}
+
+	l.mu.Lock()
+	if l.closeCtx.Err() != nil {
+		l.mu.Unlock()
+		path.Close()
+		return
+	}
+	l.connected[path] = struct{}{}
+	l.mu.Unlock()
+
+	for {
+		conn, err := path.AcceptWithContext(l.closeCtx)
+		if err != nil {
+			if l.closeCtx.Err() == nil && !errors.Is(err, ErrClosed) {
+				l.logger.Error("path failed", addrField, zap.Error(err))
+			}
+			return
+		}
+
+		select {
+		case l.conns <- conn:
+		case <-l.closeCtx.Done():
+			conn.Close()
+			return
+		}
+	}
+}
+
+var _ Listener = &multipathListener{}
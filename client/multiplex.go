@@ -0,0 +1,191 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/protocol"
+)
+
+// streamHeaderTimeout is the maximum duration to wait for the stream header
+// of a stream on a multiplexed connection.
+const streamHeaderTimeout = time.Second * 10
+
+// multiplexedConn is a connection to the Piko server shared by listeners on
+// multiple endpoints.
+//
+// Each stream starts with a stream header containing the endpoint ID, so the
+// connection dispatches streams to the listener for the endpoint.
+type multiplexedConn struct {
+	conn *listener
+
+	// listeners contains the open listeners, keyed by endpoint ID.
+	listeners map[string]*multiplexedListener
+	mu        sync.Mutex
+
+	logger Logger
+}
+
+// ListenMultiplexed listens for connections on each of the given endpoints,
+// using a single connection to the Piko server rather than a connection per
+// endpoint.
+//
+// Returns a listener for each endpoint, in the same order as the endpoints.
+// The connection is closed once all listeners are closed.
+//
+// Requires a Piko server that supports multiplexed connections.
+func (u *Upstream) ListenMultiplexed(
+	ctx context.Context, endpointIDs []string,
+) ([]Listener, error) {
+	if len(endpointIDs) == 0 {
+		return nil, fmt.Errorf("missing endpoints")
+	}
+	if len(endpointIDs) > protocol.MaxMultiplexedEndpoints {
+		return nil, fmt.Errorf("too many endpoints: %d", len(endpointIDs))
+	}
+
+	conn := newListener("", u, u.logger())
+	conn.multiplexedEndpoints = endpointIDs
+	if err := conn.connect(ctx); err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+
+	m := &multiplexedConn{
+		conn:      conn,
+		listeners: make(map[string]*multiplexedListener),
+		logger:    u.logger(),
+	}
+	listeners := make([]Listener, 0, len(endpointIDs))
+	for _, endpointID := range endpointIDs {
+		ln := &multiplexedListener{
+			endpointID: endpointID,
+			conns:      make(chan net.Conn),
+			closed:     make(chan struct{}),
+			conn:       m,
+		}
+		m.listeners[endpointID] = ln
+		listeners = append(listeners, ln)
+	}
+	go m.run()
+	return listeners, nil
+}
+
+// run accepts streams until the connection is closed.
+func (m *multiplexedConn) run() {
+	for {
+		// The listener reconnects if the connection drops.
+		stream, err := m.conn.AcceptWithContext(context.Background())
+		if err != nil {
+			if m.conn.closeCtx.Err() == nil && !errors.Is(err, ErrClosed) {
+				m.logger.Error("multiplexed connection failed", zap.Error(err))
+			}
+			m.closeListeners()
+			return
+		}
+
+		go m.dispatch(stream)
+	}
+}
+
+// dispatch reads the stream header and sends the stream to the listener
+// for the endpoint.
+func (m *multiplexedConn) dispatch(stream net.Conn) {
+	_ = stream.SetReadDeadline(time.Now().Add(streamHeaderTimeout))
+	endpointID, err := protocol.ReadStreamEndpoint(stream)
+	if err != nil {
+		m.logger.Warn("failed to read stream header", zap.Error(err))
+		stream.Close()
+		return
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+
+	m.mu.Lock()
+	ln, ok := m.listeners[endpointID]
+	m.mu.Unlock()
+	if !ok {
+		// The listener for the endpoint may have been closed.
+		m.logger.Debug(
+			"stream for unknown endpoint",
+			zap.String("endpoint-id", endpointID),
+		)
+		stream.Close()
+		return
+	}
+
+	select {
+	case ln.conns <- stream:
+	case <-ln.closed:
+		stream.Close()
+	}
+}
+
+// remove removes the listener, and closes the connection if there are no
+// remaining listeners.
+func (m *multiplexedConn) remove(endpointID string) error {
+	m.mu.Lock()
+	delete(m.listeners, endpointID)
+	remaining := len(m.listeners)
+	m.mu.Unlock()
+
+	if remaining == 0 {
+		return m.conn.Close()
+	}
+	return nil
+}
+
+// closeListeners closes all listeners after the connection fails.
+func (m *multiplexedConn) closeListeners() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, ln := range m.listeners {
+		ln.closeOnce.Do(func() {
+			close(ln.closed)
+		})
+	}
+}
+
+// multiplexedListener is a [Listener] for one of the endpoints of a
+// multiplexed connection.
+type multiplexedListener struct {
+	endpointID string
+
+	conns chan net.Conn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	conn *multiplexedConn
+}
+
+func (l *multiplexedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (l *multiplexedListener) Addr() net.Addr {
+	return &pikoAddr{endpointID: l.endpointID}
+}
+
+func (l *multiplexedListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.conn.remove(l.endpointID)
+}
+
+func (l *multiplexedListener) EndpointID() string {
+	return l.endpointID
+}
+
+var _ Listener = &multiplexedListener{}
@@ -0,0 +1,23 @@
+package client
+
+// ConnectObserver is notified when listeners connect to and disconnect from
+// the Piko server, such as to record reconnect metrics.
+//
+// endpointIDs contains the endpoint of the listener, or each endpoint of a
+// multiplexed connection.
+//
+// Methods may be called concurrently by different listeners.
+type ConnectObserver interface {
+	// OnConnect is called when a connect attempt succeeds, with the number
+	// of failed attempts before it.
+	OnConnect(endpointIDs []string, failedAttempts int)
+
+	// OnConnectFailed is called when a connect attempt fails. retry is false
+	// if the listener gave up, either due to a non-retryable error or
+	// reaching the maximum number of retries.
+	OnConnectFailed(endpointIDs []string, err error, retry bool)
+
+	// OnDisconnect is called when the connection to the Piko server drops
+	// and the listener starts reconnecting.
+	OnDisconnect(endpointIDs []string, err error)
+}
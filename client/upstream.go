@@ -5,13 +5,16 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/andydunstall/yamux"
 	"go.uber.org/zap"
 
 	"github.com/andydunstall/piko/pkg/backoff"
+	"github.com/andydunstall/piko/pkg/protocol"
 	"github.com/andydunstall/piko/pkg/websocket"
 )
 
@@ -46,6 +49,49 @@ type Upstream struct {
 	// If nil, the default configuration is used.
 	TLSConfig *tls.Config
 
+	// LocalAddr is the local address to connect to the Piko server from,
+	// such as to connect using a particular network interface.
+	//
+	// If nil, the local address is chosen automatically.
+	LocalAddr net.Addr
+
+	// WriteCoalesceDelay is the duration to wait for more frames before
+	// writing small frames to the Piko server, so frames from chatty
+	// protocols are coalesced into a single WebSocket message.
+	//
+	// Defaults to zero, which only coalesces frames that are already queued.
+	WriteCoalesceDelay time.Duration
+
+	// MaxStreams is the maximum number of concurrent streams (connections)
+	// to accept on each connection to the Piko server. The server uses the
+	// lower of this limit and its own configured limit.
+	//
+	// Defaults to zero, which uses the server limit.
+	MaxStreams int
+
+	// StreamWindow is the maximum receive window of each stream in bytes.
+	//
+	// Defaults to zero, which sizes the window from the round trip time to
+	// the Piko server measured when connecting (see
+	// [protocol.StreamWindow]).
+	StreamWindow uint32
+
+	// MaxMessageSize is the maximum size of each WebSocket message written
+	// to the Piko server in bytes, between 1KB and 64KB. The server limits
+	// the messages it writes to the same size.
+	//
+	// Defaults to 64KB.
+	MaxMessageSize int
+
+	// MinMessageSize enables reducing the message size when the connection
+	// repeatedly fails due to write timeouts, which suggests large packets
+	// are being dropped, such as on a network with broken path MTU
+	// discovery. After consecutive write timeouts, the message size is
+	// halved each time the listener reconnects, down to MinMessageSize.
+	//
+	// Defaults to zero, which never reduces the message size.
+	MinMessageSize int
+
 	// MinReconnectBackoff is the minimum backoff when reconnecting.
 	//
 	// Defaults to 100ms.
@@ -56,6 +102,32 @@ type Upstream struct {
 	// Defaults to 15s.
 	MaxReconnectBackoff time.Duration
 
+	// ReconnectJitter is the maximum fraction of each reconnect backoff
+	// added as random jitter, so listeners that disconnect at the same time,
+	// such as when a Piko server restarts, don't all reconnect at the same
+	// time.
+	//
+	// Defaults to 0.1, which adds up to 10% to each backoff.
+	ReconnectJitter float64
+
+	// MaxReconnectRetries is the maximum number of consecutive failed
+	// attempts to connect to the Piko server before the listener gives up,
+	// after which accepting from the listener returns an error.
+	//
+	// Defaults to zero, which retries forever.
+	MaxReconnectRetries int
+
+	// ConnectObserver is an optional observer notified when listeners
+	// connect to and disconnect from the Piko server.
+	ConnectObserver ConnectObserver
+
+	// HeaderPrefix is the prefix of the names of the Piko headers included
+	// when connecting, which must match the prefix configured by the Piko
+	// server.
+	//
+	// Defaults to 'x-piko-' (see [protocol.DefaultHeaderPrefix]).
+	HeaderPrefix string
+
 	// Logger is an optional logger to log connection state changes.
 	Logger Logger
 }
@@ -86,7 +158,17 @@ func (u *Upstream) ListenAndForward(
 	return newForwarder(ctx, ln, addr, u.logger()), nil
 }
 
-func (u *Upstream) connect(ctx context.Context, endpointID string) (*yamux.Session, error) {
+// connect connects to the Piko server to listen on the endpoint, or if
+// multiplexedEndpoints is non-nil, to listen on each of the multiplexed
+// endpoints with a single connection.
+func (u *Upstream) connect(
+	ctx context.Context,
+	endpointID string,
+	multiplexedEndpoints []string,
+	sessionID string,
+	messageSize int,
+	onDrain func(),
+) (*yamux.Session, *websocket.Conn, error) {
 	minReconnectBackoff := u.MinReconnectBackoff
 	if minReconnectBackoff == 0 {
 		minReconnectBackoff = time.Millisecond * 100
@@ -96,60 +178,129 @@ func (u *Upstream) connect(ctx context.Context, endpointID string) (*yamux.Sessi
 		maxReconnectBackoff = time.Second * 15
 	}
 
-	backoff := backoff.New(0, minReconnectBackoff, maxReconnectBackoff)
-	for {
-		url := u.listenURL(endpointID)
+	reconnectJitter := u.ReconnectJitter
+	if reconnectJitter == 0 {
+		reconnectJitter = backoff.DefaultJitter
+	}
+
+	backoff := backoff.New(
+		u.MaxReconnectRetries,
+		minReconnectBackoff,
+		maxReconnectBackoff,
+		backoff.WithJitter(reconnectJitter),
+	)
+	url := u.listenURL(protocol.UpstreamPath(endpointID))
+	endpointField := zap.String("endpoint-id", endpointID)
+	endpointIDs := []string{endpointID}
+	if multiplexedEndpoints != nil {
+		url = u.listenURL(protocol.MultiplexedUpstreamPath)
+		endpointField = zap.Strings("endpoint-ids", multiplexedEndpoints)
+		endpointIDs = multiplexedEndpoints
+	}
 
+	for {
 		u.logger().Debug(
 			"connecting",
-			zap.String("endpoint-id", endpointID),
+			endpointField,
 			zap.String("url", url),
 		)
 
-		conn, err := websocket.Dial(
-			ctx,
-			url,
+		headers := protocol.NewHeaders(u.HeaderPrefix)
+		dialOpts := []websocket.DialOption{
 			websocket.WithToken(u.Token),
 			websocket.WithTLSConfig(u.TLSConfig),
-		)
+			websocket.WithHeader(headers.SessionID(), sessionID),
+			websocket.WithLocalAddr(u.LocalAddr),
+			websocket.WithRTTHeader(headers.RTT()),
+		}
+		if multiplexedEndpoints != nil {
+			dialOpts = append(dialOpts, websocket.WithHeader(
+				headers.Endpoints(), protocol.FormatEndpoints(multiplexedEndpoints),
+			))
+		}
+		if u.MaxStreams != 0 {
+			dialOpts = append(dialOpts, websocket.WithHeader(
+				headers.MaxStreams(), strconv.Itoa(u.MaxStreams),
+			))
+		}
+		if messageSize != websocket.MaxMessageSize {
+			dialOpts = append(
+				dialOpts,
+				websocket.WithMessageSize(messageSize),
+				websocket.WithHeader(
+					headers.MaxMessageSize(), strconv.Itoa(messageSize),
+				),
+			)
+		}
+		conn, err := websocket.Dial(ctx, url, dialOpts...)
 		if err == nil {
 			u.logger().Debug(
 				"connected",
-				zap.String("endpoint-id", endpointID),
+				endpointField,
 				zap.String("url", url),
+				zap.Int("message-size", messageSize),
 			)
+			if u.ConnectObserver != nil {
+				u.ConnectObserver.OnConnect(endpointIDs, backoff.Attempts())
+			}
+
+			if onDrain != nil {
+				conn.OnDrain(onDrain)
+			}
 
-			muxConfig := yamux.DefaultConfig()
+			muxConfig := protocol.MuxConfig()
 			muxConfig.Logger = nil
 			muxConfig.LogOutput = &yamuxLogWriter{logger: u.logger()}
-			sess, err := yamux.Client(conn, muxConfig)
+			muxConfig.MaxStreamWindowSize = u.streamWindow(conn.DialRTT())
+			sess, err := yamux.Client(protocol.NewMuxConn(
+				conn, protocol.WithCoalesceDelay(u.WriteCoalesceDelay),
+			), muxConfig)
 			if err != nil {
 				// Will not happen.
 				panic("yamux client: " + err.Error())
 			}
-			return sess, nil
+			return sess, conn, nil
 		}
 
 		if ctx.Err() != nil {
 			// If cancelled return without logging or retrying.
-			return nil, ctx.Err()
+			return nil, nil, ctx.Err()
 		}
 
 		var retryableError *websocket.RetryableError
 		if !errors.As(err, &retryableError) {
 			u.logger().Error(
 				"connect failed; non-retryable",
-				zap.String("endpoint-id", endpointID),
+				endpointField,
 				zap.String("url", url),
 				zap.Error(err),
 			)
-			return nil, err
+			if u.ConnectObserver != nil {
+				u.ConnectObserver.OnConnectFailed(endpointIDs, err, false)
+			}
+			return nil, nil, err
 		}
 
-		backoff, _ := backoff.Backoff()
+		backoff, retry := backoff.Backoff()
+		if !retry {
+			u.logger().Error(
+				"connect failed; max retries exceeded",
+				endpointField,
+				zap.String("url", url),
+				zap.Int("retries", u.MaxReconnectRetries),
+				zap.Error(err),
+			)
+			if u.ConnectObserver != nil {
+				u.ConnectObserver.OnConnectFailed(endpointIDs, err, false)
+			}
+			return nil, nil, fmt.Errorf("max retries exceeded: %w", err)
+		}
+		if u.ConnectObserver != nil {
+			u.ConnectObserver.OnConnectFailed(endpointIDs, err, true)
+		}
 		u.logger().Warn(
 			"connect failed; retrying",
-			zap.String("endpoint-id", endpointID),
+			endpointField,
 			zap.String("url", url),
 			zap.String("backoff", backoff.String()),
 			zap.Error(err),
@@ -159,12 +310,12 @@ func (u *Upstream) connect(ctx context.Context, endpointID string) (*yamux.Sessi
 		case <-time.After(backoff):
 			continue
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return nil, nil, ctx.Err()
 		}
 	}
 }
 
-func (u *Upstream) listenURL(endpointID string) string {
+func (u *Upstream) listenURL(path string) string {
 	var listenURL url.URL
 	if u.URL == nil {
 		listenURL = url.URL{
@@ -176,7 +327,7 @@ func (u *Upstream) listenURL(endpointID string) string {
 	}
 
 	// Add the listen path to the URL.
-	listenURL.Path += "/piko/v1/upstream/" + endpointID
+	listenURL.Path += path
 
 	// Set the scheme to WebSocket.
 	if listenURL.Scheme == "http" {
@@ -195,3 +346,32 @@ func (u *Upstream) logger() Logger {
 	}
 	return u.Logger
 }
+
+// maxMessageSize returns the initial message size of each listener.
+func (u *Upstream) maxMessageSize() int {
+	if u.MaxMessageSize == 0 {
+		return websocket.MaxMessageSize
+	}
+	return min(max(u.MaxMessageSize, websocket.MinMessageSize), websocket.MaxMessageSize)
+}
+
+// minMessageSize returns the minimum size the message size can be reduced
+// to.
+func (u *Upstream) minMessageSize() int {
+	if u.MinMessageSize == 0 {
+		return u.maxMessageSize()
+	}
+	return min(max(u.MinMessageSize, websocket.MinMessageSize), u.maxMessageSize())
+}
+
+// streamWindow returns the maximum stream receive window for a connection
+// with the given round trip time to the server.
+func (u *Upstream) streamWindow(rtt time.Duration) uint32 {
+	if u.StreamWindow != 0 {
+		return u.StreamWindow
+	}
+	if rtt <= 0 {
+		return protocol.InitialStreamWindow
+	}
+	return protocol.StreamWindow(rtt)
+}
@@ -15,12 +15,30 @@ import (
 	"github.com/andydunstall/piko/pkg/log"
 )
 
+type PortProtocol string
+
+const (
+	PortProtocolTCP PortProtocol = "tcp"
+	PortProtocolUDP PortProtocol = "udp"
+)
+
 type PortConfig struct {
 	// Addr is the address to listen on.
 	Addr string `json:"addr" yaml:"addr"`
 
 	// EndpointID is the endpoint ID to connect to.
 	EndpointID string `json:"endpoint_id" yaml:"endpoint_id"`
+
+	// Protocol is the protocol to listen on. Supports "tcp" and "udp".
+	// Defaults to "tcp".
+	//
+	// UDP ports must forward to an agent UDP listener.
+	Protocol PortProtocol `json:"protocol" yaml:"protocol"`
+
+	// IdleTimeout closes the connection to the endpoint for a UDP client
+	// once no datagrams have been sent in either direction for the timeout.
+	// Only supported by UDP ports.
+	IdleTimeout time.Duration `json:"idle_timeout" yaml:"idle_timeout"`
 }
 
 // Host parses the given upstream address into a host and port. Return false if
@@ -53,6 +71,15 @@ func (c *PortConfig) Validate() error {
 	if c.EndpointID == "" {
 		return fmt.Errorf("missing endpoint id")
 	}
+	switch c.Protocol {
+	case "", PortProtocolTCP:
+	case PortProtocolUDP:
+		if c.IdleTimeout <= 0 {
+			return fmt.Errorf("missing idle timeout")
+		}
+	default:
+		return fmt.Errorf("unsupported protocol")
+	}
 	return nil
 }
 
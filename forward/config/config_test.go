@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -11,3 +12,19 @@ func TestConfig_Default(t *testing.T) {
 	conf := Default()
 	assert.NoError(t, conf.Validate())
 }
+
+func TestPortConfig_Validate(t *testing.T) {
+	conf := PortConfig{
+		Addr:        "5353",
+		EndpointID:  "my-endpoint",
+		Protocol:    PortProtocolUDP,
+		IdleTimeout: time.Minute,
+	}
+	assert.NoError(t, conf.Validate())
+
+	conf.IdleTimeout = 0
+	assert.EqualError(t, conf.Validate(), "missing idle timeout")
+
+	conf.Protocol = "sctp"
+	assert.EqualError(t, conf.Validate(), "unsupported protocol")
+}
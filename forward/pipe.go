@@ -0,0 +1,57 @@
+package forward
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// closeWriter is implemented by connections that support half-closing the
+// write side, such as net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Pipe forwards data between the connection and the given reader and writer,
+// such as stdin and stdout when used as an SSH ProxyCommand.
+//
+// When the reader reaches EOF, the write side of the connection is
+// half-closed (if supported by the connection) and Pipe keeps forwarding
+// data from the connection until the remote closes. Returns once the remote
+// closes the connection, or either direction fails.
+//
+// Note if the remote closes first, the reader may still be blocked, though
+// the caller will normally exit.
+func Pipe(conn net.Conn, r io.Reader, w io.Writer) error {
+	writeCh := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn, r)
+		if err == nil {
+			if cw, ok := conn.(closeWriter); ok {
+				err = cw.CloseWrite()
+			}
+		}
+		writeCh <- err
+	}()
+	readCh := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(w, conn)
+		readCh <- err
+	}()
+
+	var err error
+	select {
+	case err = <-readCh:
+	case err = <-writeCh:
+		if err == nil {
+			// The reader reached EOF so wait for the remote to finish.
+			err = <-readCh
+		}
+	}
+	// Close the connection to unblock the other direction.
+	conn.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package forward
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipe(t *testing.T) {
+	t.Run("remote close", func(t *testing.T) {
+		conn, peer := net.Pipe()
+
+		go func() {
+			// Echo the first message back then close.
+			buf := make([]byte, 5)
+			_, err := io.ReadFull(peer, buf)
+			require.NoError(t, err)
+			_, err = peer.Write(buf)
+			require.NoError(t, err)
+			peer.Close()
+		}()
+
+		// Use a reader that doesn't return EOF until the test completes so
+		// Pipe returns when the connection closes.
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		go func() {
+			_, _ = pw.Write([]byte("hello"))
+		}()
+
+		var out bytes.Buffer
+		assert.NoError(t, Pipe(conn, pr, &out))
+		assert.Equal(t, "hello", out.String())
+	})
+
+	t.Run("half close", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		go func() {
+			peer, err := ln.Accept()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer peer.Close()
+
+			// Read until the write side is half-closed, then respond.
+			b, err := io.ReadAll(peer)
+			assert.NoError(t, err)
+			_, err = peer.Write([]byte(strings.ToUpper(string(b))))
+			assert.NoError(t, err)
+		}()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+
+		var out bytes.Buffer
+		assert.NoError(t, Pipe(conn, strings.NewReader("hello"), &out))
+		// The response is received after the reader reaches EOF.
+		assert.Equal(t, "HELLO", out.String())
+	})
+}
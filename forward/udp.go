@@ -0,0 +1,256 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	piko "github.com/andydunstall/piko/client"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
+)
+
+// udpSessionQueueSize is the number of datagrams from a client that are
+// queued while connecting to the endpoint, or while the connection is slow.
+// Once full, datagrams are dropped, as they would be by a congested network.
+const udpSessionQueueSize = 64
+
+// UDPForwarder forwards datagrams from a UDP port to an endpoint with an agent
+// UDP listener.
+//
+// Each client address has its own connection to the endpoint, carrying the
+// client's datagrams framed with [protocol.WriteDatagram], so the upstream
+// sees each client as a different peer. The connection is closed once the
+// client has been idle for the idle timeout.
+type UDPForwarder struct {
+	dialer *piko.Dialer
+
+	endpointID string
+
+	idleTimeout time.Duration
+
+	conn net.PacketConn
+
+	sessions map[string]*udpSession
+	mu       sync.Mutex
+
+	logger log.Logger
+}
+
+func NewUDPForwarder(
+	endpointID string,
+	dialer *piko.Dialer,
+	idleTimeout time.Duration,
+	logger log.Logger,
+) *UDPForwarder {
+	return &UDPForwarder{
+		dialer:      dialer,
+		endpointID:  endpointID,
+		idleTimeout: idleTimeout,
+		sessions:    make(map[string]*udpSession),
+		logger:      logger,
+	}
+}
+
+func (f *UDPForwarder) Forward(conn net.PacketConn) error {
+	f.mu.Lock()
+	f.conn = conn
+	f.mu.Unlock()
+	defer conn.Close()
+
+	buf := make([]byte, protocol.MaxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("read: %w", err)
+		}
+
+		session := f.session(addr)
+		session.Touch()
+		select {
+		case session.datagrams <- append([]byte(nil), buf[:n]...):
+		default:
+			f.logger.Debug(
+				"session queue full; dropping datagram",
+				zap.String("client", addr.String()),
+				zap.String("endpoint-id", f.endpointID),
+			)
+		}
+	}
+}
+
+func (f *UDPForwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, session := range f.sessions {
+		session.Close()
+	}
+	if f.conn != nil {
+		return f.conn.Close()
+	}
+	return nil
+}
+
+// session returns the session for the client address, or starts a new
+// session if the client doesn't have one.
+func (f *UDPForwarder) session(addr net.Addr) *udpSession {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	session, ok := f.sessions[addr.String()]
+	if ok {
+		return session
+	}
+
+	f.logger.Debug(
+		"new session",
+		zap.String("client", addr.String()),
+		zap.String("endpoint-id", f.endpointID),
+	)
+
+	session = newUDPSession(addr)
+	f.sessions[addr.String()] = session
+	go f.forwardSession(session)
+	return session
+}
+
+func (f *UDPForwarder) removeSession(session *udpSession) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.sessions[session.addr.String()] == session {
+		delete(f.sessions, session.addr.String())
+	}
+}
+
+// forwardSession forwards datagrams between the client and endpoint until
+// the session is idle or closed.
+func (f *UDPForwarder) forwardSession(session *udpSession) {
+	defer f.removeSession(session)
+	defer session.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-session.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	upstream, err := f.dialer.Dial(ctx, f.endpointID)
+	cancel()
+	if err != nil {
+		f.logger.Error(
+			"failed to dial endpoint",
+			zap.String("endpoint-id", f.endpointID),
+			zap.Error(err),
+		)
+		return
+	}
+	defer upstream.Close()
+
+	go func() {
+		// Closing the upstream unblocks reading datagrams below.
+		defer session.Close()
+
+		buf := make([]byte, protocol.MaxDatagramSize)
+		for {
+			n, err := protocol.ReadDatagram(upstream, buf)
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					f.logger.Debug(
+						"read datagram from endpoint",
+						zap.String("endpoint-id", f.endpointID),
+						zap.Error(err),
+					)
+				}
+				return
+			}
+			session.Touch()
+			if _, err := f.conn.WriteTo(buf[:n], session.addr); err != nil {
+				f.logger.Debug(
+					"write datagram to client",
+					zap.String("client", session.addr.String()),
+					zap.Error(err),
+				)
+			}
+		}
+	}()
+
+	// Check at a fraction of the timeout, so sessions are closed at most 25%
+	// after the idle timeout expires.
+	ticker := time.NewTicker(max(f.idleTimeout/4, time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case b := <-session.datagrams:
+			if err := protocol.WriteDatagram(upstream, b); err != nil {
+				f.logger.Debug(
+					"write datagram to endpoint",
+					zap.String("endpoint-id", f.endpointID),
+					zap.Error(err),
+				)
+				return
+			}
+		case <-ticker.C:
+			if session.Idle() >= f.idleTimeout {
+				f.logger.Debug(
+					"closing idle session",
+					zap.String("client", session.addr.String()),
+					zap.String("endpoint-id", f.endpointID),
+				)
+				return
+			}
+		case <-session.done:
+			return
+		}
+	}
+}
+
+type udpSession struct {
+	addr net.Addr
+
+	datagrams chan []byte
+
+	// lastActive is the time of the last datagram in either direction as a
+	// Unix timestamp in nanoseconds.
+	lastActive *atomic.Int64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newUDPSession(addr net.Addr) *udpSession {
+	return &udpSession{
+		addr:       addr,
+		datagrams:  make(chan []byte, udpSessionQueueSize),
+		lastActive: atomic.NewInt64(time.Now().UnixNano()),
+		done:       make(chan struct{}),
+	}
+}
+
+func (s *udpSession) Touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) Idle() time.Duration {
+	return time.Since(time.Unix(0, s.lastActive.Load()))
+}
+
+func (s *udpSession) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
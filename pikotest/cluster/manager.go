@@ -6,6 +6,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/andydunstall/piko/pikotest/cluster/config"
+	"github.com/andydunstall/piko/pikotest/cluster/network"
 	"github.com/andydunstall/piko/pkg/log"
 )
 
@@ -14,6 +15,9 @@ type Manager struct {
 
 	mu sync.Mutex
 
+	// network is nil if nodes use the host network.
+	network *network.Network
+
 	logger log.Logger
 }
 
@@ -26,7 +30,8 @@ func NewManager(opts ...Option) *Manager {
 	}
 
 	return &Manager{
-		logger: options.logger.WithSubsystem("cluster.manager"),
+		network: options.network,
+		logger:  options.logger.WithSubsystem("cluster.manager"),
 	}
 }
 
@@ -78,7 +83,9 @@ func (m *Manager) addNodeLocked() {
 		gossipAddrs = append(gossipAddrs, node.GossipAddr())
 	}
 
-	node := NewNode(WithJoin(gossipAddrs), WithLogger(m.logger))
+	node := NewNode(
+		WithJoin(gossipAddrs), WithNetwork(m.network), WithLogger(m.logger),
+	)
 	node.Start()
 
 	m.nodes = append(m.nodes, node)
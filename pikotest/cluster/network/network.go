@@ -0,0 +1,347 @@
+// Package network simulates the network between Piko server nodes running
+// in the same process, so tests can inject faults between nodes, such as
+// partitions, delays, packet loss and reordering.
+//
+// Each node listens and dials using its own [Host], which identifies the
+// node sending traffic so faults can be applied to the link between two
+// nodes. Random faults use a seeded source so a test run can be reproduced.
+package network
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrPartitioned is returned when dialing or writing to a node that is
+// partitioned from the local node.
+var ErrPartitioned = errors.New("network partitioned")
+
+// Link configures the faults injected into traffic sent from one node to
+// another.
+type Link struct {
+	// Partitioned drops all traffic on the link. Stream connections
+	// are closed and new connections are refused.
+	Partitioned bool
+
+	// Delay is the latency added to each packet, and each write to stream
+	// connections dialled over the link.
+	Delay time.Duration
+
+	// Jitter is the maximum random latency added on top of Delay. Since
+	// packets are delayed independently, jitter reorders packets.
+	Jitter time.Duration
+
+	// Loss is the probability of dropping each packet, between 0 and 1.
+	// Stream connections are never lossy.
+	Loss float64
+}
+
+type link struct {
+	from string
+	to   string
+}
+
+// Network is a simulated network connecting a set of hosts.
+type Network struct {
+	// hosts contains the name of the host listening on each address.
+	hosts map[string]string
+
+	links map[link]Link
+
+	// conns contains the open stream connections on each link, so they can
+	// be closed when the link is partitioned.
+	conns map[link]map[*conn]struct{}
+
+	rand *rand.Rand
+
+	mu sync.Mutex
+}
+
+// New creates a network where random faults are generated from seed.
+func New(seed int64) *Network {
+	return &Network{
+		hosts: make(map[string]string),
+		links: make(map[link]Link),
+		conns: make(map[link]map[*conn]struct{}),
+		rand:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Host returns the host with the given name, such as a node ID.
+func (n *Network) Host(name string) *Host {
+	return &Host{
+		name:    name,
+		network: n,
+	}
+}
+
+// SetLink configures the faults on traffic sent from host from to host to.
+func (n *Network) SetLink(from, to string, l Link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.setLinkLocked(link{from: from, to: to}, l)
+}
+
+// Partition partitions the hosts in group a from the hosts in group b in
+// both directions.
+func (n *Network) Partition(a []string, b []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, from := range a {
+		for _, to := range b {
+			for _, key := range []link{{from: from, to: to}, {from: to, to: from}} {
+				l := n.links[key]
+				l.Partitioned = true
+				n.setLinkLocked(key, l)
+			}
+		}
+	}
+}
+
+// Heal removes all faults from the network.
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.links = make(map[link]Link)
+}
+
+func (n *Network) setLinkLocked(key link, l Link) {
+	n.links[key] = l
+	if !l.Partitioned {
+		return
+	}
+	for c := range n.conns[key] {
+		// Close in the background as closing may block on writes.
+		go c.Conn.Close()
+	}
+	delete(n.conns, key)
+}
+
+// link returns the link from host from to the host listening on addr, or
+// false if addr isn't a host in the network.
+func (n *Network) link(from string, addr string) (link, Link, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	to, ok := n.hosts[addr]
+	if !ok {
+		return link{}, Link{}, false
+	}
+	key := link{from: from, to: to}
+	return key, n.links[key], true
+}
+
+func (n *Network) linkFaults(key link) Link {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.links[key]
+}
+
+// latency returns the delay of a write or packet on l.
+func (n *Network) latency(l Link) time.Duration {
+	if l.Jitter <= 0 {
+		return l.Delay
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return l.Delay + time.Duration(n.rand.Int63n(int64(l.Jitter)))
+}
+
+// drop returns whether to drop a packet on l.
+func (n *Network) drop(l Link) bool {
+	if l.Partitioned {
+		return true
+	}
+	if l.Loss <= 0 {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.rand.Float64() < l.Loss
+}
+
+func (n *Network) addConn(key link, c *conn) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.links[key].Partitioned {
+		return false
+	}
+	if n.conns[key] == nil {
+		n.conns[key] = make(map[*conn]struct{})
+	}
+	n.conns[key][c] = struct{}{}
+	return true
+}
+
+func (n *Network) removeConn(key link, c *conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.conns[key], c)
+}
+
+func (n *Network) addHost(addr string, name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.hosts[addr] = name
+}
+
+func (n *Network) removeHost(addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.hosts, addr)
+}
+
+// Host is a host in the network, which implements the network interface
+// used by the Piko server (see server.WithNetwork).
+type Host struct {
+	name    string
+	network *Network
+}
+
+// Listen listens on the host network and registers the listen address so
+// traffic sent to the address is routed through the simulated network.
+func (h *Host) Listen(network, address string) (net.Listener, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	h.network.addHost(ln.Addr().String(), h.name)
+	return &listener{Listener: ln, network: h.network}, nil
+}
+
+// ListenPacket listens on the host network, where packets written by the
+// returned connection have faults applied.
+func (h *Host) ListenPacket(network, address string) (net.PacketConn, error) {
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	h.network.addHost(conn.LocalAddr().String(), h.name)
+	return &packetConn{PacketConn: conn, host: h}, nil
+}
+
+// Dial connects to the address, where writes to the returned connection
+// have faults applied.
+//
+// Addresses that aren't hosts in the network are dialled directly.
+func (h *Host) Dial(network, address string) (net.Conn, error) {
+	key, l, ok := h.network.link(h.name, address)
+	if !ok {
+		return net.Dial(network, address)
+	}
+	if l.Partitioned {
+		return nil, &net.OpError{
+			Op:  "dial",
+			Net: network,
+			Err: ErrPartitioned,
+		}
+	}
+	time.Sleep(h.network.latency(l))
+
+	c, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := &conn{
+		Conn:    c,
+		key:     key,
+		network: h.network,
+	}
+	if !h.network.addConn(key, wrapped) {
+		c.Close()
+		return nil, &net.OpError{
+			Op:  "dial",
+			Net: network,
+			Err: ErrPartitioned,
+		}
+	}
+	return wrapped, nil
+}
+
+type listener struct {
+	net.Listener
+
+	network *Network
+}
+
+func (l *listener) Close() error {
+	l.network.removeHost(l.Addr().String())
+	return l.Listener.Close()
+}
+
+// conn is a stream connection dialled by a host.
+type conn struct {
+	net.Conn
+
+	key     link
+	network *Network
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	l := c.network.linkFaults(c.key)
+	if l.Partitioned {
+		return 0, &net.OpError{
+			Op:  "write",
+			Net: "tcp",
+			Err: ErrPartitioned,
+		}
+	}
+	time.Sleep(c.network.latency(l))
+	return c.Conn.Write(b)
+}
+
+func (c *conn) Close() error {
+	c.network.removeConn(c.key, c)
+	return c.Conn.Close()
+}
+
+type packetConn struct {
+	net.PacketConn
+
+	host *Host
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	_, l, ok := c.host.network.link(c.host.name, addr.String())
+	if !ok {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	// Like a real network, dropped packets aren't reported to the sender.
+	if c.host.network.drop(l) {
+		return len(b), nil
+	}
+
+	delay := c.host.network.latency(l)
+	if delay == 0 {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+
+	// Copy the packet as the caller may reuse the buffer.
+	packet := make([]byte, len(b))
+	copy(packet, b)
+	time.AfterFunc(delay, func() {
+		// nolint
+		c.PacketConn.WriteTo(packet, addr)
+	})
+	return len(b), nil
+}
+
+func (c *packetConn) Close() error {
+	c.host.network.removeHost(c.LocalAddr().String())
+	return c.PacketConn.Close()
+}
@@ -17,6 +17,8 @@ import (
 )
 
 type Node struct {
+	id string
+
 	server *server.Server
 
 	rootCAPool *x509.CertPool
@@ -38,9 +40,13 @@ func NewNode(opts ...Option) *Node {
 	conf.Cluster.Join = options.join
 	conf.Cluster.Gossip.BindAddr = "127.0.0.1:0"
 	conf.Cluster.Gossip.Interval = time.Millisecond * 10
+	conf.Cluster.ForwardSigningKey = "piko-test"
 	conf.Proxy.Auth = options.authConfig
 	conf.Upstream.Auth = options.authConfig
 	conf.Admin.Auth = options.authConfig
+	if options.proxyHTTPConfig != nil {
+		conf.Proxy.HTTP = *options.proxyHTTPConfig
+	}
 
 	// If TLS is enabled, generate a certificate and root CA then write to a
 	// file.
@@ -92,20 +98,33 @@ func NewNode(opts ...Option) *Node {
 		conf.Admin.TLS.Key = f.Name()
 	}
 
+	var serverOpts []server.Option
+	if options.network != nil {
+		serverOpts = append(
+			serverOpts, server.WithNetwork(options.network.Host(conf.Cluster.NodeID)),
+		)
+	}
+
 	server, err := server.NewServer(
 		conf,
 		options.logger.With(zap.String("node", conf.Cluster.NodeID)),
+		serverOpts...,
 	)
 	if err != nil {
 		panic("server: " + err.Error())
 	}
 
 	return &Node{
+		id:         conf.Cluster.NodeID,
 		server:     server,
 		rootCAPool: rootCAPool,
 	}
 }
 
+func (n *Node) ID() string {
+	return n.id
+}
+
 func (n *Node) ProxyAddr() string {
 	return n.server.Config().Proxy.AdvertiseAddr
 }
@@ -1,15 +1,19 @@
 package cluster
 
 import (
+	"github.com/andydunstall/piko/pikotest/cluster/network"
 	"github.com/andydunstall/piko/pkg/auth"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
 )
 
 type options struct {
-	join       []string
-	authConfig auth.Config
-	tls        bool
-	logger     log.Logger
+	join            []string
+	authConfig      auth.Config
+	tls             bool
+	proxyHTTPConfig *config.HTTPConfig
+	network         *network.Network
+	logger          log.Logger
 }
 
 type joinOption struct {
@@ -49,6 +53,35 @@ func WithTLS(tls bool) Option {
 	return tlsOption(tls)
 }
 
+type proxyHTTPConfigOption struct {
+	HTTPConfig config.HTTPConfig
+}
+
+func (o proxyHTTPConfigOption) apply(opts *options) {
+	opts.proxyHTTPConfig = &o.HTTPConfig
+}
+
+// WithProxyHTTPConfig configures the proxy HTTP server, such as its
+// timeouts. Defaults to the server default.
+func WithProxyHTTPConfig(config config.HTTPConfig) Option {
+	return proxyHTTPConfigOption{HTTPConfig: config}
+}
+
+type networkOption struct {
+	Network *network.Network
+}
+
+func (o networkOption) apply(opts *options) {
+	opts.network = o.Network
+}
+
+// WithNetwork configures the nodes to communicate over a simulated network,
+// where each node is a host named by its node ID. Defaults to the host
+// network.
+func WithNetwork(network *network.Network) Option {
+	return networkOption{Network: network}
+}
+
 type loggerOption struct {
 	Logger log.Logger
 }
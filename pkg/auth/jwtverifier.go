@@ -12,6 +12,12 @@ import (
 
 type PikoClaims struct {
 	Endpoints []string `json:"endpoints"`
+	// Role is the admin role. See Role.
+	Role string `json:"role"`
+	// Tenant is the tenant ID the token belongs to.
+	Tenant string `json:"tenant"`
+	// Scopes contains the scopes granted to the token.
+	Scopes []string `json:"scopes"`
 }
 
 type JWTClaims struct {
@@ -99,10 +105,15 @@ func (v *JWTVerifier) Verify(tokenString string) (*Token, error) {
 		opts...,
 	)
 	if err != nil {
+		verifyErr := ErrInvalidToken
 		if errors.Is(err, jwt.ErrTokenExpired) {
-			return nil, ErrExpiredToken
+			verifyErr = ErrExpiredToken
 		}
-		return nil, ErrInvalidToken
+		// Claims are only validated once the signature is verified.
+		if errors.Is(err, jwt.ErrTokenInvalidClaims) {
+			return nil, &ClaimsError{TokenID: claims.ID, Err: verifyErr}
+		}
+		return nil, verifyErr
 	}
 	if !token.Valid {
 		return nil, ErrInvalidToken
@@ -118,6 +129,10 @@ func (v *JWTVerifier) Verify(tokenString string) (*Token, error) {
 	return &Token{
 		Expiry:    expiry,
 		Endpoints: claims.Piko.Endpoints,
+		Role:      Role(claims.Piko.Role),
+		Tenant:    claims.Piko.Tenant,
+		Subject:   claims.Subject,
+		Scopes:    claims.Piko.Scopes,
 	}, nil
 }
 
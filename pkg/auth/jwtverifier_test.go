@@ -226,7 +226,7 @@ func TestJWTVerifier_Invalid(t *testing.T) {
 			Audience:      "foo",
 		})
 		_, err = verifier.Verify(tokenString)
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, ErrInvalidToken)
 	})
 
 	t.Run("issuer", func(t *testing.T) {
@@ -255,6 +255,41 @@ func TestJWTVerifier_Invalid(t *testing.T) {
 	})
 }
 
+// Tests tokens with a valid signature but rejected claims return the
+// verified token ID.
+func TestJWTVerifier_ClaimsError(t *testing.T) {
+	secretKey := generateTestHSKey(t)
+	verifier := NewJWTVerifier(&LoadedConfig{
+		HMACSecretKey: secretKey,
+		Audience:      "foo",
+	})
+
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       "my-token",
+			Audience: jwt.ClaimStrings([]string{"bar"}),
+		},
+	}).SignedString(secretKey)
+	require.NoError(t, err)
+
+	_, err = verifier.Verify(tokenString)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	assert.Equal(t, "my-token", VerifiedTokenID(err))
+
+	// Tokens with an invalid signature don't return the token ID.
+	tokenString, err = jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       "my-token",
+			Audience: jwt.ClaimStrings([]string{"foo"}),
+		},
+	}).SignedString([]byte("invalid key"))
+	require.NoError(t, err)
+
+	_, err = verifier.Verify(tokenString)
+	assert.Equal(t, ErrInvalidToken, err)
+	assert.Equal(t, "", VerifiedTokenID(err))
+}
+
 func TestJWTVerifier_DisableDisconnectOnExpiry(t *testing.T) {
 	secretKey := generateTestHSKey(t)
 
@@ -283,6 +318,111 @@ func TestJWTVerifier_DisableDisconnectOnExpiry(t *testing.T) {
 	assert.True(t, parsedToken.Expiry.IsZero())
 }
 
+// Tests the verifier passes through the role claim without validating it,
+// since roles only apply to the admin server.
+func TestJWTVerifier_Role(t *testing.T) {
+	secretKey := generateTestHSKey(t)
+
+	verifier := NewJWTVerifier(&LoadedConfig{
+		HMACSecretKey: secretKey,
+	})
+
+	for _, role := range []string{"viewer", "admin", "", "unknown"} {
+		t.Run(role, func(t *testing.T) {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+				Piko: PikoClaims{
+					Role: role,
+				},
+			})
+			tokenString, err := token.SignedString([]byte(secretKey))
+			assert.NoError(t, err)
+
+			parsedToken, err := verifier.Verify(tokenString)
+			assert.NoError(t, err)
+			assert.Equal(t, Role(role), parsedToken.Role)
+		})
+	}
+}
+
+func TestParseRole(t *testing.T) {
+	tests := []struct {
+		role     string
+		expected Role
+		err      bool
+	}{
+		{role: "viewer", expected: RoleViewer},
+		{role: "operator", expected: RoleOperator},
+		{role: "admin", expected: RoleAdmin},
+		// Defaults to the least privileged role.
+		{role: "", expected: RoleViewer},
+		{role: "unknown", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			role, err := ParseRole(tt.role)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, role)
+		})
+	}
+}
+
+func TestJWTVerifier_Tenant(t *testing.T) {
+	secretKey := generateTestHSKey(t)
+
+	verifier := NewJWTVerifier(&LoadedConfig{
+		HMACSecretKey: secretKey,
+	})
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+		Piko: PikoClaims{
+			Tenant: "my-tenant",
+		},
+	})
+	tokenString, err := token.SignedString([]byte(secretKey))
+	assert.NoError(t, err)
+
+	parsedToken, err := verifier.Verify(tokenString)
+	assert.NoError(t, err)
+	assert.Equal(t, "my-tenant", parsedToken.Tenant)
+}
+
+func TestJWTVerifier_Identity(t *testing.T) {
+	secretKey := generateTestHSKey(t)
+
+	verifier := NewJWTVerifier(&LoadedConfig{
+		HMACSecretKey: secretKey,
+	})
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject: "my-user",
+		},
+		Piko: PikoClaims{
+			Scopes: []string{"read", "write"},
+		},
+	})
+	tokenString, err := token.SignedString([]byte(secretKey))
+	assert.NoError(t, err)
+
+	parsedToken, err := verifier.Verify(tokenString)
+	assert.NoError(t, err)
+	assert.Equal(t, "my-user", parsedToken.Subject)
+	assert.Equal(t, []string{"read", "write"}, parsedToken.Scopes)
+}
+
+func TestRole_Permits(t *testing.T) {
+	assert.True(t, RoleAdmin.Permits(RoleAdmin))
+	assert.True(t, RoleAdmin.Permits(RoleViewer))
+	assert.True(t, RoleOperator.Permits(RoleViewer))
+	assert.False(t, RoleOperator.Permits(RoleAdmin))
+	assert.False(t, RoleViewer.Permits(RoleOperator))
+	assert.False(t, Role("unknown").Permits(RoleViewer))
+}
+
 func generateTestHSKey(t *testing.T) []byte {
 	b := make([]byte, 10)
 	_, err := rand.Read(b)
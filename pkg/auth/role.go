@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"fmt"
+)
+
+// Role is an admin role, which determines which admin APIs the client can
+// access.
+//
+// Roles are ordered, where each role includes the permissions of the roles
+// before it:
+//   - viewer: Can read state, such as metrics and status APIs
+//   - operator: Can also make changes, such as disconnecting upstreams
+//   - admin: Can also access sensitive debug APIs, such as profiling
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+// ParseRole parses the given role. If the role is empty, defaults to viewer,
+// the least privileged role.
+func ParseRole(s string) (Role, error) {
+	switch Role(s) {
+	case "":
+		return RoleViewer, nil
+	case RoleViewer, RoleOperator, RoleAdmin:
+		return Role(s), nil
+	default:
+		return "", fmt.Errorf("unknown role: %s", s)
+	}
+}
+
+// Permits returns whether the role includes the permissions of the required
+// role.
+func (r Role) Permits(required Role) bool {
+	return r.level() >= required.level()
+}
+
+func (r Role) level() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleOperator:
+		return 2
+	case RoleAdmin:
+		return 3
+	default:
+		return 0
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"slices"
 	"time"
+
+	"github.com/andydunstall/piko/pkg/protocol"
 )
 
 var (
@@ -11,6 +13,38 @@ var (
 	ErrExpiredToken = errors.New("expired token")
 )
 
+// ClaimsError is returned when a token has a valid signature but its claims
+// are rejected, such as the token has expired or has the wrong audience.
+//
+// Since the signature is valid, the token ID identifies a token issued by a
+// trusted issuer.
+type ClaimsError struct {
+	// TokenID is the ID ('jti') of the rejected token, or empty if the token
+	// has no ID.
+	TokenID string
+
+	// Err is either ErrInvalidToken or ErrExpiredToken.
+	Err error
+}
+
+func (e *ClaimsError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ClaimsError) Unwrap() error {
+	return e.Err
+}
+
+// VerifiedTokenID returns the ID of a token rejected with a ClaimsError, or
+// an empty string if the error isn't a ClaimsError.
+func VerifiedTokenID(err error) string {
+	var claimsErr *ClaimsError
+	if errors.As(err, &claimsErr) {
+		return claimsErr.TokenID
+	}
+	return ""
+}
+
 // Token represents an authenticated Piko token.
 type Token struct {
 	// Expiry contains the time the token expires, or zero if there is no
@@ -21,17 +55,39 @@ type Token struct {
 	// to access (either connect to or listen on). If empty then all endpoints
 	// are allowed.
 	Endpoints []string
+
+	// Role is the admin role claim of the token, or empty if the token
+	// doesn't include a role.
+	//
+	// The role isn't validated, as it only applies to the admin server,
+	// which parses the role with ParseRole.
+	Role Role
+
+	// Tenant is the ID of the tenant the token belongs to, or empty if the
+	// token doesn't belong to a tenant.
+	Tenant string
+
+	// Subject identifies the principal the token was issued to, such as a
+	// user ID, or empty if the token doesn't include a subject.
+	Subject string
+
+	// Scopes contains the scopes granted to the token.
+	Scopes []string
 }
 
 // EndpointPermitted returns whether the token it permitted to access the
 // endpoint with the given ID.
 //
 // If the token doesn't include any endpoints, it can access all endpoints.
+// A wildcard endpoint, such as 'team-a/*', permits every endpoint in the
+// namespace (see [protocol.MatchEndpoint]).
 func (t *Token) EndpointPermitted(endpointID string) bool {
 	if len(t.Endpoints) == 0 {
 		return true
 	}
-	return slices.Contains(t.Endpoints, endpointID)
+	return slices.ContainsFunc(t.Endpoints, func(pattern string) bool {
+		return protocol.MatchEndpoint(pattern, endpointID)
+	})
 }
 
 // Verifier verifies client tokens.
@@ -0,0 +1,21 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToken_EndpointPermitted(t *testing.T) {
+	token := &Token{
+		Endpoints: []string{"my-endpoint", "team-a/*"},
+	}
+	assert.True(t, token.EndpointPermitted("my-endpoint"))
+	assert.True(t, token.EndpointPermitted("team-a/service-b"))
+	assert.True(t, token.EndpointPermitted("team-a/*"))
+	assert.False(t, token.EndpointPermitted("team-b/service-b"))
+	assert.False(t, token.EndpointPermitted("other-endpoint"))
+
+	// Tokens without endpoints can access all endpoints.
+	assert.True(t, (&Token{}).EndpointPermitted("team-b/service-b"))
+}
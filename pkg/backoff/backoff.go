@@ -5,12 +5,40 @@ import (
 	"time"
 )
 
+// DefaultJitter is the default maximum fraction of each backoff added as
+// random jitter.
+const DefaultJitter = 0.1
+
+type options struct {
+	jitter float64
+}
+
+type Option interface {
+	apply(*options)
+}
+
+type jitterOption float64
+
+func (o jitterOption) apply(opts *options) {
+	opts.jitter = float64(o)
+}
+
+// WithJitter sets the maximum fraction of each backoff added as random
+// jitter, so clients that disconnect at the same time don't all reconnect at
+// the same time. For example 0.5 adds up to 50% to each backoff.
+//
+// Defaults to [DefaultJitter].
+func WithJitter(jitter float64) Option {
+	return jitterOption(jitter)
+}
+
 // Backoff implements exponential backoff with jitter.
 type Backoff struct {
-	// retries is the maximum number of attempts.
+	// retries is the maximum number of retries.
 	retries    int
 	minBackoff time.Duration
 	maxBackoff time.Duration
+	jitter     float64
 
 	// attempts is the number of attempts so far.
 	attempts    int
@@ -20,18 +48,36 @@ type Backoff struct {
 // New creates a new backoff.
 //
 // Set 'retries' to zero to retry forever.
-func New(retries int, minBackoff time.Duration, maxBackoff time.Duration) *Backoff {
+func New(
+	retries int,
+	minBackoff time.Duration,
+	maxBackoff time.Duration,
+	opts ...Option,
+) *Backoff {
+	options := options{
+		jitter: DefaultJitter,
+	}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
 	return &Backoff{
 		retries:    retries,
 		minBackoff: minBackoff,
 		maxBackoff: maxBackoff,
+		jitter:     options.jitter,
 		attempts:   0,
 	}
 }
 
+// Attempts returns the number of attempts so far.
+func (b *Backoff) Attempts() int {
+	return b.attempts
+}
+
 // Backoff returns whether to retry or abort, and how long to backoff for.
 func (b *Backoff) Backoff() (time.Duration, bool) {
-	if b.retries != 0 && b.attempts > b.retries {
+	if b.retries != 0 && b.attempts >= b.retries {
 		return 0, false
 	}
 	b.attempts++
@@ -53,6 +99,6 @@ func (b *Backoff) nextWait() time.Duration {
 		backoff = b.maxBackoff
 	}
 
-	jitterMultipler := 1.0 + (rand.Float64() * 0.1)
+	jitterMultipler := 1.0 + (rand.Float64() * b.jitter)
 	return time.Duration(float64(backoff) * jitterMultipler)
 }
@@ -0,0 +1,34 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	t.Run("exponential", func(t *testing.T) {
+		b := New(0, time.Second, time.Second*4, WithJitter(0.5))
+		for _, expected := range []time.Duration{
+			time.Second, time.Second * 2, time.Second * 4, time.Second * 4,
+		} {
+			backoff, ok := b.Backoff()
+			assert.True(t, ok)
+			// Jitter adds up to 50% after capping at the max backoff.
+			assert.GreaterOrEqual(t, backoff, expected)
+			assert.LessOrEqual(t, backoff, time.Second*6)
+		}
+	})
+
+	t.Run("max retries", func(t *testing.T) {
+		b := New(3, time.Millisecond, time.Second)
+		for i := 0; i != 3; i++ {
+			_, ok := b.Backoff()
+			assert.True(t, ok)
+		}
+		_, ok := b.Backoff()
+		assert.False(t, ok)
+		assert.Equal(t, 3, b.Attempts())
+	})
+}
@@ -0,0 +1,52 @@
+// Package doctor contains the results of diagnostic checks run by the agent
+// and server doctor commands.
+package doctor
+
+import (
+	"fmt"
+	"io"
+)
+
+type Status string
+
+const (
+	StatusOK   Status = "ok"
+	StatusWarn Status = "warn"
+	StatusFail Status = "fail"
+	StatusSkip Status = "skip"
+)
+
+// Result is the result of a single check.
+type Result struct {
+	// Check is the name of the check, such as 'dns'.
+	Check string
+
+	Status Status
+
+	Message string
+
+	// Hint suggests how to fix a failed check, or is empty if there is
+	// nothing to fix.
+	Hint string
+}
+
+// Failed returns whether any of the results failed.
+func Failed(results []Result) bool {
+	for _, result := range results {
+		if result.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes the results to w, one line per check followed by the hint
+// if there is one.
+func Print(w io.Writer, results []Result) {
+	for _, result := range results {
+		fmt.Fprintf(w, "[%-4s] %s: %s\n", result.Status, result.Check, result.Message)
+		if result.Hint != "" {
+			fmt.Fprintf(w, "       hint: %s\n", result.Hint)
+		}
+	}
+}
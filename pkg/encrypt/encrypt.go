@@ -0,0 +1,194 @@
+// Package encrypt encrypts data stored at rest, such as recorded upstream
+// responses, with AES-256-GCM.
+//
+// A [Keyring] has a primary key used to encrypt, and any number of older
+// keys that are only used to decrypt, so keys can be rotated by adding a new
+// primary key while data encrypted with the previous key is still readable.
+package encrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeySize is the size of an encryption key in bytes.
+const KeySize = 32
+
+// magic prefixes encrypted data, to distinguish it from unencrypted data and
+// to version the format.
+const magic = "PKE1"
+
+const (
+	keyIDSize  = 8
+	headerSize = len(magic) + keyIDSize
+)
+
+var (
+	// ErrNotEncrypted is returned when decrypting data that wasn't encrypted
+	// by a keyring.
+	ErrNotEncrypted = errors.New("not encrypted")
+
+	// ErrUnknownKey is returned when decrypting data encrypted with a key
+	// that isn't in the keyring.
+	ErrUnknownKey = errors.New("unknown key")
+)
+
+type key struct {
+	id   [keyIDSize]byte
+	aead cipher.AEAD
+}
+
+// Keyring encrypts data with its primary key, and decrypts data encrypted
+// with any of its keys.
+//
+// Encrypted data is formatted as a magic prefix, the ID of the key used to
+// encrypt, a random nonce, then the AES-256-GCM ciphertext.
+type Keyring struct {
+	// keys contains the primary key first.
+	keys []key
+}
+
+// NewKeyring returns a keyring with the given keys, where the first key is
+// the primary key.
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("missing key")
+	}
+
+	k := &Keyring{}
+	for _, b := range keys {
+		if len(b) != KeySize {
+			return nil, fmt.Errorf("invalid key size: %d", len(b))
+		}
+		block, err := aes.NewCipher(b)
+		if err != nil {
+			return nil, fmt.Errorf("cipher: %w", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("gcm: %w", err)
+		}
+		k.keys = append(k.keys, key{
+			id:   keyID(b),
+			aead: aead,
+		})
+	}
+	return k, nil
+}
+
+// LoadKeyring loads a keyring from the given key files, where the first file
+// contains the primary key.
+//
+// Each file contains a 32 byte key, either base64 or hex encoded, such as
+// generated with 'openssl rand -base64 32'.
+func LoadKeyring(paths []string) (*Keyring, error) {
+	var keys [][]byte
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read key: %s: %w", path, err)
+		}
+		key, err := decodeKey(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("decode key: %s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return NewKeyring(keys...)
+}
+
+// Encrypt encrypts the plaintext with the primary key.
+func (k *Keyring) Encrypt(plaintext []byte) ([]byte, error) {
+	primary := k.keys[0]
+
+	nonceSize := primary.aead.NonceSize()
+	out := make([]byte, headerSize+nonceSize, headerSize+nonceSize+len(plaintext)+primary.aead.Overhead())
+	copy(out, magic)
+	copy(out[len(magic):], primary.id[:])
+	nonce := out[headerSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("nonce: %w", err)
+	}
+	// Authenticate the header so the key ID can't be modified.
+	return primary.aead.Seal(out, nonce, plaintext, out[:headerSize]), nil
+}
+
+// Decrypt decrypts data encrypted with any key in the keyring.
+func (k *Keyring) Decrypt(b []byte) ([]byte, error) {
+	if !IsEncrypted(b) {
+		return nil, ErrNotEncrypted
+	}
+
+	key, ok := k.key(b)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	nonceSize := key.aead.NonceSize()
+	if len(b) < headerSize+nonceSize {
+		return nil, fmt.Errorf("truncated")
+	}
+	nonce := b[headerSize : headerSize+nonceSize]
+	plaintext, err := key.aead.Open(nil, nonce, b[headerSize+nonceSize:], b[:headerSize])
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+// EncryptedWithPrimary returns whether the data is encrypted with the primary
+// key. If not, the data should be re-encrypted to complete a key rotation.
+func (k *Keyring) EncryptedWithPrimary(b []byte) bool {
+	if !IsEncrypted(b) {
+		return false
+	}
+	return bytes.Equal(b[len(magic):headerSize], k.keys[0].id[:])
+}
+
+func (k *Keyring) key(b []byte) (key, bool) {
+	id := b[len(magic):headerSize]
+	for _, key := range k.keys {
+		if bytes.Equal(id, key.id[:]) {
+			return key, true
+		}
+	}
+	return key{}, false
+}
+
+// IsEncrypted returns whether the data was encrypted by a keyring.
+func IsEncrypted(b []byte) bool {
+	return len(b) >= headerSize && string(b[:len(magic)]) == magic
+}
+
+// keyID identifies a key without revealing it.
+func keyID(b []byte) [keyIDSize]byte {
+	h := sha256.Sum256(b)
+	var id [keyIDSize]byte
+	copy(id[:], h[:])
+	return id
+}
+
+func decodeKey(s string) ([]byte, error) {
+	if len(s) == hex.EncodedLen(KeySize) {
+		if b, err := hex.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encoding: must be base64 or hex")
+	}
+	if len(b) != KeySize {
+		return nil, fmt.Errorf("invalid key size: %d", len(b))
+	}
+	return b, nil
+}
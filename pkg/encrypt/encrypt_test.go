@@ -0,0 +1,112 @@
+package encrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyring(t *testing.T) {
+	t.Run("encrypt", func(t *testing.T) {
+		k, err := NewKeyring(bytes.Repeat([]byte{1}, KeySize))
+		require.NoError(t, err)
+
+		b, err := k.Encrypt([]byte("foo"))
+		require.NoError(t, err)
+		assert.True(t, IsEncrypted(b))
+		assert.True(t, k.EncryptedWithPrimary(b))
+		assert.NotContains(t, string(b), "foo")
+
+		plaintext, err := k.Decrypt(b)
+		require.NoError(t, err)
+		assert.Equal(t, "foo", string(plaintext))
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		oldKey := bytes.Repeat([]byte{1}, KeySize)
+		newKey := bytes.Repeat([]byte{2}, KeySize)
+
+		old, err := NewKeyring(oldKey)
+		require.NoError(t, err)
+		b, err := old.Encrypt([]byte("foo"))
+		require.NoError(t, err)
+
+		// Data encrypted with the old key can still be decrypted.
+		rotated, err := NewKeyring(newKey, oldKey)
+		require.NoError(t, err)
+		assert.False(t, rotated.EncryptedWithPrimary(b))
+		plaintext, err := rotated.Decrypt(b)
+		require.NoError(t, err)
+		assert.Equal(t, "foo", string(plaintext))
+
+		// Once the old key is removed, data encrypted with it can't be
+		// decrypted.
+		removed, err := NewKeyring(newKey)
+		require.NoError(t, err)
+		_, err = removed.Decrypt(b)
+		assert.ErrorIs(t, err, ErrUnknownKey)
+	})
+
+	t.Run("not encrypted", func(t *testing.T) {
+		k, err := NewKeyring(bytes.Repeat([]byte{1}, KeySize))
+		require.NoError(t, err)
+
+		_, err = k.Decrypt([]byte(`{"foo": "bar"}`))
+		assert.ErrorIs(t, err, ErrNotEncrypted)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		k, err := NewKeyring(bytes.Repeat([]byte{1}, KeySize))
+		require.NoError(t, err)
+
+		b, err := k.Encrypt([]byte("foo"))
+		require.NoError(t, err)
+		b[len(b)-1] ^= 0xff
+		_, err = k.Decrypt(b)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		_, err := NewKeyring([]byte("foo"))
+		assert.EqualError(t, err, "invalid key size: 3")
+
+		_, err = NewKeyring()
+		assert.EqualError(t, err, "missing key")
+	})
+}
+
+func TestLoadKeyring(t *testing.T) {
+	dir := t.TempDir()
+
+	primary := bytes.Repeat([]byte{1}, KeySize)
+	primaryPath := filepath.Join(dir, "primary.key")
+	require.NoError(t, os.WriteFile(
+		primaryPath, []byte(base64.StdEncoding.EncodeToString(primary)+"\n"), 0o600,
+	))
+
+	old := bytes.Repeat([]byte{2}, KeySize)
+	oldPath := filepath.Join(dir, "old.key")
+	require.NoError(t, os.WriteFile(
+		oldPath, []byte(hex.EncodeToString(old)), 0o600,
+	))
+
+	k, err := LoadKeyring([]string{primaryPath, oldPath})
+	require.NoError(t, err)
+
+	expected, err := NewKeyring(primary)
+	require.NoError(t, err)
+	b, err := k.Encrypt([]byte("foo"))
+	require.NoError(t, err)
+	assert.True(t, expected.EncryptedWithPrimary(b))
+
+	invalidPath := filepath.Join(dir, "invalid.key")
+	require.NoError(t, os.WriteFile(invalidPath, []byte("foo"), 0o600))
+	_, err = LoadKeyring([]string{invalidPath})
+	assert.Error(t, err)
+}
@@ -0,0 +1,245 @@
+package fingerprint
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	recordTypeHandshake      = 22
+	handshakeTypeClientHello = 1
+
+	extensionServerName          = 0
+	extensionSupportedGroups     = 10
+	extensionECPointFormats      = 11
+	extensionSignatureAlgorithms = 13
+	extensionALPN                = 16
+	extensionSupportedVersions   = 43
+
+	recordHeaderLen    = 5
+	handshakeHeaderLen = 4
+)
+
+var (
+	// errIncomplete is returned when parsing a ClientHello that hasn't been
+	// fully received.
+	errIncomplete = errors.New("incomplete client hello")
+
+	errNotClientHello = errors.New("not a client hello")
+	errMalformed      = errors.New("malformed client hello")
+)
+
+// clientHello contains the ClientHello fields used to compute fingerprints.
+// All fields are in the order sent by the client.
+type clientHello struct {
+	version             uint16
+	cipherSuites        []uint16
+	extensions          []uint16
+	supportedGroups     []uint16
+	ecPointFormats      []uint8
+	signatureAlgorithms []uint16
+	alpnProtocols       []string
+	supportedVersions   []uint16
+	serverName          bool
+}
+
+// parseRecords parses the ClientHello from the TLS records sent by the
+// client at the start of the connection.
+//
+// Returns errIncomplete if the records don't yet contain the full
+// ClientHello, which may span multiple records.
+func parseRecords(b []byte) (*clientHello, error) {
+	var handshake []byte
+	for {
+		if len(b) < recordHeaderLen {
+			return nil, errIncomplete
+		}
+		if b[0] != recordTypeHandshake {
+			return nil, errNotClientHello
+		}
+		recordLen := int(binary.BigEndian.Uint16(b[3:5]))
+		if len(b) < recordHeaderLen+recordLen {
+			return nil, errIncomplete
+		}
+		handshake = append(handshake, b[recordHeaderLen:recordHeaderLen+recordLen]...)
+		b = b[recordHeaderLen+recordLen:]
+
+		if len(handshake) < handshakeHeaderLen {
+			continue
+		}
+		if handshake[0] != handshakeTypeClientHello {
+			return nil, errNotClientHello
+		}
+		msgLen := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+		if len(handshake) < handshakeHeaderLen+msgLen {
+			continue
+		}
+		return parseClientHello(handshake[handshakeHeaderLen : handshakeHeaderLen+msgLen])
+	}
+}
+
+// parseClientHello parses the body of a ClientHello handshake message.
+func parseClientHello(b []byte) (*clientHello, error) {
+	r := reader(b)
+
+	hello := &clientHello{}
+	var ok bool
+	if hello.version, ok = r.uint16(); !ok {
+		return nil, errMalformed
+	}
+	// Random.
+	if !r.skip(32) {
+		return nil, errMalformed
+	}
+	// Session ID.
+	if _, ok := r.vector8(); !ok {
+		return nil, errMalformed
+	}
+
+	cipherSuites, ok := r.vector16()
+	if !ok {
+		return nil, errMalformed
+	}
+	if hello.cipherSuites, ok = cipherSuites.uint16s(); !ok {
+		return nil, errMalformed
+	}
+
+	// Compression methods.
+	if _, ok := r.vector8(); !ok {
+		return nil, errMalformed
+	}
+
+	// Extensions are optional.
+	if len(r) == 0 {
+		return hello, nil
+	}
+	extensions, ok := r.vector16()
+	if !ok {
+		return nil, errMalformed
+	}
+	for len(extensions) > 0 {
+		extType, ok := extensions.uint16()
+		if !ok {
+			return nil, errMalformed
+		}
+		data, ok := extensions.vector16()
+		if !ok {
+			return nil, errMalformed
+		}
+		hello.extensions = append(hello.extensions, extType)
+
+		if err := hello.parseExtension(extType, data); err != nil {
+			return nil, err
+		}
+	}
+	return hello, nil
+}
+
+func (h *clientHello) parseExtension(extType uint16, data reader) error {
+	switch extType {
+	case extensionServerName:
+		h.serverName = true
+	case extensionSupportedGroups:
+		groups, ok := data.vector16()
+		if !ok {
+			return errMalformed
+		}
+		if h.supportedGroups, ok = groups.uint16s(); !ok {
+			return errMalformed
+		}
+	case extensionECPointFormats:
+		formats, ok := data.vector8()
+		if !ok {
+			return errMalformed
+		}
+		h.ecPointFormats = []uint8(formats)
+	case extensionSignatureAlgorithms:
+		algs, ok := data.vector16()
+		if !ok {
+			return errMalformed
+		}
+		if h.signatureAlgorithms, ok = algs.uint16s(); !ok {
+			return errMalformed
+		}
+	case extensionALPN:
+		protos, ok := data.vector16()
+		if !ok {
+			return errMalformed
+		}
+		for len(protos) > 0 {
+			proto, ok := protos.vector8()
+			if !ok {
+				return errMalformed
+			}
+			h.alpnProtocols = append(h.alpnProtocols, string(proto))
+		}
+	case extensionSupportedVersions:
+		versions, ok := data.vector8()
+		if !ok {
+			return errMalformed
+		}
+		if h.supportedVersions, ok = versions.uint16s(); !ok {
+			return errMalformed
+		}
+	}
+	return nil
+}
+
+// reader reads big endian TLS encoded values.
+type reader []byte
+
+func (r *reader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+// vector8 reads a vector with a one byte length prefix.
+func (r *reader) vector8() (reader, bool) {
+	if len(*r) < 1 {
+		return nil, false
+	}
+	n := int((*r)[0])
+	if len(*r) < 1+n {
+		return nil, false
+	}
+	v := (*r)[1 : 1+n]
+	*r = (*r)[1+n:]
+	return v, true
+}
+
+// vector16 reads a vector with a two byte length prefix.
+func (r *reader) vector16() (reader, bool) {
+	if len(*r) < 2 {
+		return nil, false
+	}
+	n := int(binary.BigEndian.Uint16(*r))
+	if len(*r) < 2+n {
+		return nil, false
+	}
+	v := (*r)[2 : 2+n]
+	*r = (*r)[2+n:]
+	return v, true
+}
+
+func (r reader) uint16s() ([]uint16, bool) {
+	if len(r)%2 != 0 {
+		return nil, false
+	}
+	values := make([]uint16, 0, len(r)/2)
+	for i := 0; i < len(r); i += 2 {
+		values = append(values, binary.BigEndian.Uint16(r[i:]))
+	}
+	return values, true
+}
@@ -0,0 +1,199 @@
+// Package fingerprint computes TLS client fingerprints, such as JA3 and JA4,
+// from the ClientHello sent by downstream clients.
+//
+// TLS client libraries send distinctive ClientHello messages, so the
+// fingerprint identifies the client implementation regardless of the client
+// IP or user agent, which is useful to detect abusive clients.
+package fingerprint
+
+import (
+	"crypto/md5" // nolint
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fingerprint contains the fingerprints of a TLS client.
+type Fingerprint struct {
+	// JA3 is the MD5 hash of the JA3 fingerprint.
+	JA3 string `json:"ja3"`
+
+	// JA4 is the JA4 fingerprint (the 'JA4 TLS Client' fingerprint).
+	JA4 string `json:"ja4"`
+}
+
+// FromClientHello computes the fingerprint of the ClientHello in the given
+// TLS records.
+func FromClientHello(records []byte) (Fingerprint, error) {
+	hello, err := parseRecords(records)
+	if err != nil {
+		return Fingerprint{}, err
+	}
+	return Fingerprint{
+		JA3: ja3Hash(hello),
+		JA4: ja4(hello),
+	}, nil
+}
+
+// ja3 returns the JA3 string, which is
+// 'Version,Ciphers,Extensions,Curves,PointFormats', where each list is a
+// '-' separated list of decimal values in the order sent by the client,
+// excluding GREASE values.
+func ja3(hello *clientHello) string {
+	pointFormats := make([]uint16, 0, len(hello.ecPointFormats))
+	for _, f := range hello.ecPointFormats {
+		pointFormats = append(pointFormats, uint16(f))
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(hello.version)),
+		joinDecimal(hello.cipherSuites),
+		joinDecimal(hello.extensions),
+		joinDecimal(hello.supportedGroups),
+		joinDecimal(pointFormats),
+	}, ",")
+}
+
+func ja3Hash(hello *clientHello) string {
+	// nolint
+	sum := md5.Sum([]byte(ja3(hello)))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4 returns the JA4 fingerprint, which has the format
+// '<a>_<b>_<c>' where:
+// - a: The protocol ('t' for TCP), TLS version, whether SNI is included
+// ('d' for domain, 'i' for IP), the number of cipher suites, the number of
+// extensions and the first and last characters of the first ALPN protocol
+// - b: The truncated SHA256 hash of the sorted cipher suites
+// - c: The truncated SHA256 hash of the sorted extensions, excluding SNI and
+// ALPN, followed by the signature algorithms in the order sent by the client
+func ja4(hello *clientHello) string {
+	ciphers := withoutGREASE(hello.cipherSuites)
+	extensions := withoutGREASE(hello.extensions)
+
+	sni := "i"
+	if hello.serverName {
+		sni = "d"
+	}
+
+	a := fmt.Sprintf(
+		"t%s%s%02d%02d%s",
+		ja4Version(hello),
+		sni,
+		min(len(ciphers), 99),
+		min(len(extensions), 99),
+		ja4ALPN(hello.alpnProtocols),
+	)
+
+	var hashedExtensions []uint16
+	for _, ext := range extensions {
+		if ext == extensionServerName || ext == extensionALPN {
+			continue
+		}
+		hashedExtensions = append(hashedExtensions, ext)
+	}
+	c := joinHex(sorted(hashedExtensions))
+	if sigAlgs := withoutGREASE(hello.signatureAlgorithms); len(sigAlgs) > 0 {
+		c += "_" + joinHex(sigAlgs)
+	}
+
+	return a + "_" + ja4Hash(joinHex(sorted(ciphers))) + "_" + ja4Hash(c)
+}
+
+// ja4Version returns the highest TLS version supported by the client.
+func ja4Version(hello *clientHello) string {
+	version := hello.version
+	for _, v := range withoutGREASE(hello.supportedVersions) {
+		if v > version {
+			version = v
+		}
+	}
+
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN returns the first and last characters of the first ALPN protocol,
+// or '00' if there are no protocols. If either character isn't
+// alphanumeric, the first and last characters of the hex encoded protocol
+// are used instead.
+func ja4ALPN(protocols []string) string {
+	if len(protocols) == 0 || protocols[0] == "" {
+		return "00"
+	}
+	proto := protocols[0]
+	first, last := proto[0], proto[len(proto)-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+	encoded := hex.EncodeToString([]byte(proto))
+	return string([]byte{encoded[0], encoded[len(encoded)-1]})
+}
+
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// isGREASE returns whether v is a GREASE value (RFC 8701), which clients
+// send randomly so must be excluded from fingerprints.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	filtered := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
+
+func isAlphanumeric(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func sorted(values []uint16) []uint16 {
+	s := append([]uint16(nil), values...)
+	sort.Slice(s, func(i, j int) bool {
+		return s[i] < s[j]
+	})
+	return s
+}
+
+func joinDecimal(values []uint16) string {
+	var parts []string
+	for _, v := range withoutGREASE(values) {
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	var parts []string
+	for _, v := range values {
+		parts = append(parts, fmt.Sprintf("%04x", v))
+	}
+	return strings.Join(parts, ",")
+}
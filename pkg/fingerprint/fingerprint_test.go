@@ -0,0 +1,166 @@
+package fingerprint
+
+import (
+	"crypto/md5" // nolint
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type extension struct {
+	extType uint16
+	data    []byte
+}
+
+func u16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func vector16(b []byte) []byte {
+	return append(u16(uint16(len(b))), b...)
+}
+
+func vector8(b []byte) []byte {
+	return append([]byte{byte(len(b))}, b...)
+}
+
+func u16s(values ...uint16) []byte {
+	var b []byte
+	for _, v := range values {
+		b = append(b, u16(v)...)
+	}
+	return b
+}
+
+// buildClientHello encodes a ClientHello handshake message.
+func buildClientHello(ciphers []uint16, extensions []extension) []byte {
+	var body []byte
+	body = append(body, u16(0x0303)...)
+	body = append(body, make([]byte, 32)...)
+	body = append(body, vector8(nil)...)
+	body = append(body, vector16(u16s(ciphers...))...)
+	body = append(body, vector8([]byte{0})...)
+
+	var exts []byte
+	for _, ext := range extensions {
+		exts = append(exts, u16(ext.extType)...)
+		exts = append(exts, vector16(ext.data)...)
+	}
+	body = append(body, vector16(exts)...)
+
+	msg := []byte{handshakeTypeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(msg, body...)
+}
+
+// records splits the handshake message into TLS records of at most size
+// bytes.
+func records(msg []byte, size int) []byte {
+	var b []byte
+	for len(msg) > 0 {
+		n := min(size, len(msg))
+		b = append(b, recordTypeHandshake, 0x03, 0x01)
+		b = append(b, u16(uint16(n))...)
+		b = append(b, msg[:n]...)
+		msg = msg[n:]
+	}
+	return b
+}
+
+// chromeClientHello returns a ClientHello with the ciphers, extensions and
+// signature algorithms from the JA4 specification example, including GREASE
+// values.
+func chromeClientHello() []byte {
+	ciphers := []uint16{
+		0x1a1a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+		0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+	}
+	sigAlgs := u16s(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601)
+	extensions := []extension{
+		{extType: 0x2a2a},
+		{extType: extensionServerName, data: vector16(append([]byte{0}, vector16([]byte("example.com"))...))},
+		{extType: 0x0017},
+		{extType: 0xff01, data: []byte{0}},
+		{extType: extensionSupportedGroups, data: vector16(u16s(0x3a3a, 0x001d, 0x0017, 0x0018))},
+		{extType: extensionECPointFormats, data: vector8([]byte{0})},
+		{extType: 0x0023},
+		{extType: extensionALPN, data: vector16(append(vector8([]byte("h2")), vector8([]byte("http/1.1"))...))},
+		{extType: 0x0005, data: []byte{1, 0, 0, 0, 0}},
+		{extType: extensionSignatureAlgorithms, data: vector16(sigAlgs)},
+		{extType: 0x0012},
+		{extType: 0x0033, data: vector16(nil)},
+		{extType: 0x002d, data: vector8([]byte{1})},
+		{extType: extensionSupportedVersions, data: vector8(u16s(0x4a4a, 0x0304, 0x0303))},
+		{extType: 0x001b, data: vector8(u16s(0x0002))},
+		{extType: 0x4469, data: vector16(vector8([]byte("h2")))},
+		{extType: 0x5a5a, data: []byte{0}},
+		{extType: 0x0015, data: make([]byte, 10)},
+	}
+	return buildClientHello(ciphers, extensions)
+}
+
+func TestFromClientHello(t *testing.T) {
+	t.Run("ja4", func(t *testing.T) {
+		f, err := FromClientHello(records(chromeClientHello(), 1<<14))
+		require.NoError(t, err)
+
+		assert.Equal(t, "t13d1516h2_8daaf6152771_e5627efa2ab1", f.JA4)
+	})
+
+	t.Run("ja3", func(t *testing.T) {
+		hello, err := parseRecords(records(chromeClientHello(), 1<<14))
+		require.NoError(t, err)
+
+		expected := strings.Join([]string{
+			"771",
+			"4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53",
+			"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21",
+			"29-23-24",
+			"0",
+		}, ",")
+		assert.Equal(t, expected, ja3(hello))
+
+		// nolint
+		sum := md5.Sum([]byte(expected))
+		f, err := FromClientHello(records(chromeClientHello(), 1<<14))
+		require.NoError(t, err)
+		assert.Equal(t, hex.EncodeToString(sum[:]), f.JA3)
+	})
+
+	t.Run("fragmented", func(t *testing.T) {
+		// The ClientHello may span multiple records.
+		f, err := FromClientHello(records(chromeClientHello(), 50))
+		require.NoError(t, err)
+
+		assert.Equal(t, "t13d1516h2_8daaf6152771_e5627efa2ab1", f.JA4)
+	})
+
+	t.Run("incomplete", func(t *testing.T) {
+		b := records(chromeClientHello(), 50)
+		_, err := FromClientHello(b[:len(b)-1])
+		assert.ErrorIs(t, err, errIncomplete)
+	})
+
+	t.Run("no extensions", func(t *testing.T) {
+		f, err := FromClientHello(records(buildClientHello([]uint16{0x002f}, nil), 1<<14))
+		require.NoError(t, err)
+
+		assert.Equal(t, "t12i010000_"+ja4Hash("002f")+"_000000000000", f.JA4)
+	})
+
+	t.Run("not tls", func(t *testing.T) {
+		_, err := FromClientHello([]byte("GET / HTTP/1.1\r\n\r\n"))
+		assert.ErrorIs(t, err, errNotClientHello)
+	})
+}
+
+func TestJA4ALPN(t *testing.T) {
+	assert.Equal(t, "00", ja4ALPN(nil))
+	assert.Equal(t, "h2", ja4ALPN([]string{"h2", "http/1.1"}))
+	assert.Equal(t, "h1", ja4ALPN([]string{"http/1.1"}))
+	// Non-alphanumeric characters use the hex encoding.
+	assert.Equal(t, "ab", ja4ALPN([]string{"\xab"}))
+}
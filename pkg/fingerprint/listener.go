@@ -0,0 +1,114 @@
+package fingerprint
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+)
+
+// maxClientHelloSize is the maximum number of bytes buffered to parse the
+// ClientHello. Clients sending larger messages aren't fingerprinted.
+const maxClientHelloSize = 64 << 10
+
+type connContextKey struct{}
+
+// Listener is a listener that fingerprints the TLS client of each accepted
+// connection.
+//
+// The ClientHello is copied as it's read by the TLS server, rather than
+// reading ahead, so fingerprinting doesn't add latency.
+type Listener struct {
+	net.Listener
+}
+
+func NewListener(ln net.Listener) *Listener {
+	return &Listener{
+		Listener: ln,
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn}, nil
+}
+
+// Conn is a connection accepted by [Listener].
+type Conn struct {
+	net.Conn
+
+	// buf contains the bytes read until the ClientHello is parsed.
+	buf []byte
+	// done is true once the ClientHello was parsed or failed to parse.
+	done bool
+
+	fingerprint Fingerprint
+	ok          bool
+
+	mu sync.Mutex
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.record(b[:n])
+	}
+	return n, err
+}
+
+// Fingerprint returns the fingerprint of the TLS client, or false if the
+// ClientHello hasn't been received or couldn't be parsed.
+func (c *Conn) Fingerprint() (Fingerprint, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.fingerprint, c.ok
+}
+
+func (c *Conn) record(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.done {
+		return
+	}
+
+	c.buf = append(c.buf, b...)
+	fingerprint, err := FromClientHello(c.buf)
+	if errors.Is(err, errIncomplete) && len(c.buf) < maxClientHelloSize {
+		return
+	}
+	if err == nil {
+		c.fingerprint = fingerprint
+		c.ok = true
+	}
+	c.done = true
+	c.buf = nil
+}
+
+// ConnContext adds the connection to the context so the fingerprint can be
+// retrieved using [FromContext]. Used as the http.Server ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+	if conn, ok := c.(*Conn); ok {
+		return context.WithValue(ctx, connContextKey{}, conn)
+	}
+	return ctx
+}
+
+// FromContext returns the fingerprint of the TLS client of the connection
+// in the context (see [ConnContext]), or false if the client wasn't
+// fingerprinted.
+func FromContext(ctx context.Context) (Fingerprint, bool) {
+	conn, ok := ctx.Value(connContextKey{}).(*Conn)
+	if !ok {
+		return Fingerprint{}, false
+	}
+	return conn.Fingerprint()
+}
@@ -0,0 +1,86 @@
+package fingerprint
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/testutil"
+)
+
+func TestListener(t *testing.T) {
+	rootCAPool, cert, err := testutil.LocalTLSServerCert()
+	require.NoError(t, err)
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ln := NewListener(tcpLn)
+
+	fingerprintCh := make(chan Fingerprint, 1)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			f, ok := FromContext(r.Context())
+			assert.True(t, ok)
+			fingerprintCh <- f
+		}),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+		ConnContext: ConnContext,
+	}
+	go func() {
+		// nolint
+		server.ServeTLS(ln, "", "")
+	}()
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: rootCAPool,
+			},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	resp, err := client.Get("https://" + ln.Addr().String())
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	f := <-fingerprintCh
+	// The Go client supports TLS 1.3, sends an IP rather than domain, and
+	// prefers HTTP/2.
+	assert.True(t, strings.HasPrefix(f.JA4, "t13i"), f.JA4)
+	assert.Equal(t, "h2", f.JA4[8:10])
+	assert.Len(t, f.JA3, 32)
+}
+
+func TestListener_NotTLS(t *testing.T) {
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ln := NewListener(tcpLn)
+
+	okCh := make(chan bool, 1)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			_, ok := FromContext(r.Context())
+			okCh <- ok
+		}),
+		ConnContext: ConnContext,
+	}
+	go func() {
+		// nolint
+		server.Serve(ln)
+	}()
+	defer server.Close()
+
+	resp, err := http.Get("http://" + ln.Addr().String())
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.False(t, <-okCh)
+}
@@ -0,0 +1,110 @@
+package fingerprint
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entry contains the requests observed from a fingerprint.
+type Entry struct {
+	Fingerprint
+
+	// Requests is the number of requests from clients with the fingerprint.
+	Requests uint64 `json:"requests"`
+
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	// LastClientIP is the IP of the client that sent the last request.
+	LastClientIP string `json:"last_client_ip"`
+
+	// LastUserAgent is the user agent of the last request.
+	LastUserAgent string `json:"last_user_agent"`
+}
+
+// Table records the requests from each fingerprint, to find the most common
+// fingerprints and the clients using them.
+//
+// The number of fingerprints is bounded, where the least recently seen
+// fingerprint is evicted once the table is full.
+type Table struct {
+	entries map[Fingerprint]*Entry
+
+	maxEntries int
+
+	mu sync.Mutex
+}
+
+func NewTable(maxEntries int) *Table {
+	return &Table{
+		entries:    make(map[Fingerprint]*Entry),
+		maxEntries: maxEntries,
+	}
+}
+
+// Observe records a request from the fingerprint.
+func (t *Table) Observe(f Fingerprint, clientIP string, userAgent string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	entry, ok := t.entries[f]
+	if !ok {
+		if len(t.entries) >= t.maxEntries {
+			t.evictLocked()
+		}
+		entry = &Entry{
+			Fingerprint: f,
+			FirstSeen:   now,
+		}
+		t.entries[f] = entry
+	}
+	entry.Requests++
+	entry.LastSeen = now
+	entry.LastClientIP = clientIP
+	entry.LastUserAgent = userAgent
+}
+
+// List returns the fingerprints matching the filter, ordered by the number
+// of requests descending. Empty filter fields match all fingerprints. If
+// limit is positive, at most limit entries are returned.
+func (t *Table) List(filter Fingerprint, limit int) []Entry {
+	t.mu.Lock()
+	entries := make([]Entry, 0, len(t.entries))
+	for _, entry := range t.entries {
+		if filter.JA3 != "" && filter.JA3 != entry.JA3 {
+			continue
+		}
+		if filter.JA4 != "" && filter.JA4 != entry.JA4 {
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Requests != entries[j].Requests {
+			return entries[i].Requests > entries[j].Requests
+		}
+		return entries[i].JA4 < entries[j].JA4
+	})
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+// evictLocked evicts the least recently seen fingerprint.
+func (t *Table) evictLocked() {
+	var oldest *Entry
+	for _, entry := range t.entries {
+		if oldest == nil || entry.LastSeen.Before(oldest.LastSeen) {
+			oldest = entry
+		}
+	}
+	if oldest != nil {
+		delete(t.entries, oldest.Fingerprint)
+	}
+}
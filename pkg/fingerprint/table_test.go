@@ -0,0 +1,58 @@
+package fingerprint
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTable(t *testing.T) {
+	t.Run("list", func(t *testing.T) {
+		table := NewTable(10)
+
+		a := Fingerprint{JA3: "a3", JA4: "a4"}
+		b := Fingerprint{JA3: "b3", JA4: "b4"}
+		table.Observe(a, "10.0.0.1", "curl")
+		table.Observe(b, "10.0.0.2", "python")
+		table.Observe(b, "10.0.0.3", "python")
+
+		entries := table.List(Fingerprint{}, 0)
+		assert.Len(t, entries, 2)
+
+		// Ordered by requests.
+		assert.Equal(t, b, entries[0].Fingerprint)
+		assert.Equal(t, uint64(2), entries[0].Requests)
+		assert.Equal(t, "10.0.0.3", entries[0].LastClientIP)
+		assert.Equal(t, "python", entries[0].LastUserAgent)
+		assert.Equal(t, a, entries[1].Fingerprint)
+		assert.Equal(t, uint64(1), entries[1].Requests)
+
+		// Filter.
+		entries = table.List(Fingerprint{JA4: "a4"}, 0)
+		assert.Len(t, entries, 1)
+		assert.Equal(t, a, entries[0].Fingerprint)
+
+		// Limit.
+		entries = table.List(Fingerprint{}, 1)
+		assert.Len(t, entries, 1)
+		assert.Equal(t, b, entries[0].Fingerprint)
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		table := NewTable(2)
+
+		a := Fingerprint{JA3: "a3", JA4: "a4"}
+		b := Fingerprint{JA3: "b3", JA4: "b4"}
+		c := Fingerprint{JA3: "c3", JA4: "c4"}
+		table.Observe(a, "10.0.0.1", "")
+		table.Observe(b, "10.0.0.1", "")
+		// Observe a again so b is the least recently seen.
+		table.Observe(a, "10.0.0.1", "")
+		table.Observe(c, "10.0.0.1", "")
+
+		entries := table.List(Fingerprint{}, 0)
+		assert.Len(t, entries, 2)
+		assert.Equal(t, a, entries[0].Fingerprint)
+		assert.Equal(t, c, entries[1].Fingerprint)
+	})
+}
@@ -0,0 +1,118 @@
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// DB is a MaxMind DB that reloads the database file when it changes, such as
+// when updated by 'geoipupdate'.
+type DB struct {
+	path           string
+	reloadInterval time.Duration
+
+	reader  atomic.Pointer[Reader]
+	modTime time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	logger log.Logger
+}
+
+// OpenDB opens the database at the given path. If reloadInterval is
+// non-zero, Start checks whether the file has changed every interval and
+// reloads the database.
+func OpenDB(path string, reloadInterval time.Duration, logger log.Logger) (*DB, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	db := &DB{
+		path:           path,
+		reloadInterval: reloadInterval,
+		ctx:            ctx,
+		cancel:         cancel,
+		logger:         logger.WithSubsystem("geoip"),
+	}
+	if err := db.load(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Country returns the ISO 3166-1 alpha-2 country code of the given IP, or
+// false if the IP isn't in the database.
+func (db *DB) Country(ip net.IP) (string, bool) {
+	country, ok, err := db.reader.Load().Country(ip)
+	if err != nil {
+		db.logger.Debug("failed to lookup ip", zap.Error(err))
+		return "", false
+	}
+	return country, ok
+}
+
+// Start reloads the database when the file changes, until stopped.
+func (db *DB) Start() {
+	if db.reloadInterval == 0 {
+		<-db.ctx.Done()
+		return
+	}
+
+	ticker := time.NewTicker(db.reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.reloadIfChanged(); err != nil {
+				db.logger.Warn("failed to reload database", zap.Error(err))
+			}
+		case <-db.ctx.Done():
+			return
+		}
+	}
+}
+
+func (db *DB) Stop() {
+	db.cancel()
+}
+
+func (db *DB) reloadIfChanged() error {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(db.modTime) {
+		return nil
+	}
+	if err := db.load(); err != nil {
+		return err
+	}
+	db.logger.Info(
+		"reloaded database",
+		zap.String("path", db.path),
+		zap.String("type", db.reader.Load().DatabaseType()),
+	)
+	return nil
+}
+
+func (db *DB) load() error {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+	reader, err := Open(db.path)
+	if err != nil {
+		return fmt.Errorf("open: %s: %w", db.path, err)
+	}
+	db.reader.Store(reader)
+	db.modTime = info.ModTime()
+	return nil
+}
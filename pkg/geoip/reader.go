@@ -0,0 +1,427 @@
+// Package geoip looks up the country of IP addresses using a MaxMind DB
+// (such as GeoLite2 Country or City).
+//
+// See https://maxmind.github.io/MaxMind-DB/ for the database format.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+const (
+	// dataSectionSeparatorSize is the size of the zero bytes between the
+	// search tree and the data section.
+	dataSectionSeparatorSize = 16
+
+	// maxDecodeDepth is the maximum nesting depth of decoded data, to
+	// avoid unbounded recursion with a corrupt database.
+	maxDecodeDepth = 32
+)
+
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+var errInvalidDatabase = errors.New("invalid database")
+
+// Reader looks up records in a MaxMind DB.
+type Reader struct {
+	buf []byte
+
+	// data is the data section.
+	data []byte
+
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+
+	// ipv4Start is the node to start IPv4 lookups at in an IPv6 database.
+	ipv4Start uint
+
+	databaseType string
+}
+
+// Open reads the MaxMind DB at the given path.
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewReader(buf)
+}
+
+// NewReader creates a reader for the MaxMind DB in buf.
+func NewReader(buf []byte) (*Reader, error) {
+	markerIndex := bytes.LastIndex(buf, metadataMarker)
+	if markerIndex == -1 {
+		return nil, fmt.Errorf("%w: missing metadata", errInvalidDatabase)
+	}
+	metadataStart := markerIndex + len(metadataMarker)
+
+	d := decoder{buf: buf[metadataStart:]}
+	v, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: metadata: %w", errInvalidDatabase, err)
+	}
+	metadata, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata not a map", errInvalidDatabase)
+	}
+
+	r := &Reader{buf: buf}
+	r.nodeCount, ok = metadataUint(metadata, "node_count")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing node count", errInvalidDatabase)
+	}
+	r.recordSize, ok = metadataUint(metadata, "record_size")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing record size", errInvalidDatabase)
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf(
+			"%w: unsupported record size: %d", errInvalidDatabase, r.recordSize,
+		)
+	}
+	r.ipVersion, ok = metadataUint(metadata, "ip_version")
+	if !ok || (r.ipVersion != 4 && r.ipVersion != 6) {
+		return nil, fmt.Errorf("%w: invalid ip version", errInvalidDatabase)
+	}
+	r.databaseType, _ = metadata["database_type"].(string)
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	dataStart := treeSize + dataSectionSeparatorSize
+	if dataStart > uint(markerIndex) {
+		return nil, fmt.Errorf("%w: search tree exceeds file size", errInvalidDatabase)
+	}
+	r.data = buf[dataStart:markerIndex]
+
+	if r.ipVersion == 6 {
+		// IPv4 addresses are stored in the '::/96' subnet.
+		node := uint(0)
+		for i := 0; i != 96 && node < r.nodeCount; i++ {
+			node = r.readNode(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// DatabaseType returns the type of database, such as 'GeoLite2-Country'.
+func (r *Reader) DatabaseType() string {
+	return r.databaseType
+}
+
+// Lookup returns the record for the given IP, or false if the IP isn't in the
+// database.
+func (r *Reader) Lookup(ip net.IP) (map[string]any, bool, error) {
+	node, bits := r.startNode(ip)
+	if bits == 0 {
+		return nil, false, nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		ip = ip.To16()
+	}
+
+	for i := 0; i != bits && node < r.nodeCount; i++ {
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		node = r.readNode(node, uint(bit))
+	}
+	if node == r.nodeCount {
+		return nil, false, nil
+	}
+	if node < r.nodeCount {
+		return nil, false, fmt.Errorf("%w: search tree too deep", errInvalidDatabase)
+	}
+
+	offset := node - r.nodeCount - dataSectionSeparatorSize
+	d := decoder{buf: r.data}
+	v, _, err := d.decode(offset, 0)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: record: %w", errInvalidDatabase, err)
+	}
+	record, ok := v.(map[string]any)
+	if !ok {
+		return nil, false, fmt.Errorf("%w: record not a map", errInvalidDatabase)
+	}
+	return record, true, nil
+}
+
+// Country returns the ISO 3166-1 alpha-2 country code of the given IP, or
+// false if the IP isn't in the database.
+//
+// If the IP has no country (such as anonymous proxies), its registered
+// country is used.
+func (r *Reader) Country(ip net.IP) (string, bool, error) {
+	record, ok, err := r.Lookup(ip)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	for _, key := range []string{"country", "registered_country"} {
+		country, ok := record[key].(map[string]any)
+		if !ok {
+			continue
+		}
+		if code, ok := country["iso_code"].(string); ok && code != "" {
+			return code, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// startNode returns the search tree node to start the lookup from, and the
+// number of bits in the address to look up, or zero bits if the address can't
+// be in the database.
+func (r *Reader) startNode(ip net.IP) (uint, int) {
+	if ip.To4() != nil {
+		if r.ipVersion == 6 {
+			return r.ipv4Start, 32
+		}
+		return 0, 32
+	}
+	if ip.To16() == nil || r.ipVersion == 4 {
+		return 0, 0
+	}
+	return 0, 128
+}
+
+func (r *Reader) readNode(node uint, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.buf[node*6:]
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5])
+	case 28:
+		b := r.buf[node*7:]
+		if bit == 0 {
+			return (uint(b[3])&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return (uint(b[3])&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		b := r.buf[node*8:]
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b[0:4]))
+		}
+		return uint(binary.BigEndian.Uint32(b[4:8]))
+	}
+}
+
+func metadataUint(metadata map[string]any, key string) (uint, bool) {
+	switch v := metadata[key].(type) {
+	case uint64:
+		return uint(v), true
+	default:
+		return 0, false
+	}
+}
+
+const (
+	typePointer   = 1
+	typeString    = 2
+	typeDouble    = 3
+	typeBytes     = 4
+	typeUint16    = 5
+	typeUint32    = 6
+	typeMap       = 7
+	typeInt32     = 8
+	typeUint64    = 9
+	typeUint128   = 10
+	typeArray     = 11
+	typeContainer = 12
+	typeEnd       = 13
+	typeBool      = 14
+	typeFloat     = 15
+)
+
+// decoder decodes values from the data section.
+//
+// Integers are decoded as uint64 (or int64 for int32), floats as float64,
+// maps as map[string]any and arrays as []any. uint128 values are decoded as
+// big-endian bytes.
+type decoder struct {
+	buf []byte
+}
+
+// decode decodes the value at offset, returning the value and the offset of
+// the next value.
+func (d *decoder) decode(offset uint, depth int) (any, uint, error) {
+	if depth > maxDecodeDepth {
+		return nil, 0, fmt.Errorf("exceeded max depth")
+	}
+
+	typ, size, offset, err := d.decodeControl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typ == typePointer {
+		pointer, next, err := d.decodePointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(pointer, depth+1)
+		return v, next, err
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]any, size)
+		for i := uint(0); i != size; i++ {
+			var key any
+			key, offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyStr, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key not a string")
+			}
+			var v any
+			v, offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[keyStr] = v
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]any, 0, min(size, 1024))
+		for i := uint(0); i != size; i++ {
+			var v any
+			v, offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	case typeContainer, typeEnd:
+		return nil, 0, fmt.Errorf("unsupported type: %d", typ)
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, fmt.Errorf("value exceeds data section")
+	}
+	b := d.buf[offset : offset+size]
+	next := offset + size
+
+	switch typ {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes, typeUint128:
+		return append([]byte(nil), b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size: %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size: %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid uint size: %d", size)
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid int32 size: %d", size)
+		}
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), next, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown type: %d", typ)
+	}
+}
+
+// decodeControl decodes the control byte (and any extended type and size
+// bytes) at offset, returning the type, size and offset of the payload.
+func (d *decoder) decodeControl(offset uint) (int, uint, uint, error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, 0, 0, fmt.Errorf("offset exceeds data section")
+	}
+	control := d.buf[offset]
+	offset++
+
+	typ := int(control >> 5)
+	if typ == 0 {
+		// Extended type.
+		if offset >= uint(len(d.buf)) {
+			return 0, 0, 0, fmt.Errorf("offset exceeds data section")
+		}
+		typ = 7 + int(d.buf[offset])
+		offset++
+	}
+
+	size := uint(control & 0x1f)
+	if typ == typePointer {
+		// Pointers encode the size differently, so leave the decoding to
+		// decodePointer.
+		return typ, size, offset, nil
+	}
+
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.buf)) {
+			return 0, 0, 0, fmt.Errorf("size exceeds data section")
+		}
+		var extra uint
+		for _, c := range d.buf[offset : offset+n] {
+			extra = extra<<8 | uint(c)
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + extra
+		case 2:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+	return typ, size, offset, nil
+}
+
+// decodePointer decodes a pointer with the given control byte size bits,
+// returning the pointed to offset and the offset of the next value.
+func (d *decoder) decodePointer(size uint, offset uint) (uint, uint, error) {
+	n := ((size >> 3) & 0x3) + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, fmt.Errorf("pointer exceeds data section")
+	}
+	b := d.buf[offset : offset+n]
+
+	var pointer uint
+	if n != 4 {
+		pointer = size & 0x7
+	}
+	for _, c := range b {
+		pointer = pointer<<8 | uint(c)
+	}
+	switch n {
+	case 2:
+		pointer += 2048
+	case 3:
+		pointer += 526336
+	}
+	return pointer, offset + n, nil
+}
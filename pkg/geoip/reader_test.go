@@ -0,0 +1,301 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// encodeValue encodes the value using the MaxMind DB data section format.
+func encodeValue(v any) []byte {
+	control := func(typ int, size int) []byte {
+		if typ > 7 {
+			return []byte{byte(size), byte(typ - 7)}
+		}
+		return []byte{byte(typ<<5 | size)}
+	}
+
+	switch v := v.(type) {
+	case string:
+		return append(control(typeString, len(v)), v...)
+	case uint16:
+		return append(control(typeUint16, 2), byte(v>>8), byte(v))
+	case uint32:
+		b := binary.BigEndian.AppendUint32(nil, v)
+		return append(control(typeUint32, 4), b...)
+	case uint64:
+		b := binary.BigEndian.AppendUint64(nil, v)
+		return append(control(typeUint64, 8), b...)
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		return control(typeBool, size)
+	case pointer:
+		// Use the 11 bit pointer encoding.
+		return []byte{byte(typePointer<<5 | int(v>>8)&0x7), byte(v)}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b := control(typeMap, len(v))
+		for _, k := range keys {
+			b = append(b, encodeValue(k)...)
+			b = append(b, encodeValue(v[k])...)
+		}
+		return b
+	case []any:
+		b := control(typeArray, len(v))
+		for _, e := range v {
+			b = append(b, encodeValue(e)...)
+		}
+		return b
+	default:
+		panic("unsupported type")
+	}
+}
+
+// pointer is a pointer to an offset in the data section.
+type pointer uint16
+
+type trieNode struct {
+	children [2]*trieNode
+	// data is the offset of the data for leaf nodes, or -1.
+	data int
+}
+
+// dbWriter writes a MaxMind DB for tests.
+type dbWriter struct {
+	ipVersion  int
+	recordSize int
+
+	root *trieNode
+	data []byte
+}
+
+func newDBWriter(ipVersion int, recordSize int) *dbWriter {
+	return &dbWriter{
+		ipVersion:  ipVersion,
+		recordSize: recordSize,
+		root:       &trieNode{data: -1},
+	}
+}
+
+// AddData adds the record to the data section, returning its offset.
+func (w *dbWriter) AddData(record any) int {
+	offset := len(w.data)
+	w.data = append(w.data, encodeValue(record)...)
+	return offset
+}
+
+// Insert adds the subnet with the record at the given data offset.
+func (w *dbWriter) Insert(cidr string, data int) {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	ip := subnet.IP
+	ones, _ := subnet.Mask.Size()
+	if w.ipVersion == 6 && ip.To4() != nil {
+		// Store IPv4 subnets in '::/96'.
+		ip = append(make(net.IP, 12), ip.To4()...)
+		ones += 96
+	}
+
+	node := w.root
+	for i := 0; i != ones; i++ {
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{data: -1}
+		}
+		node = node.children[bit]
+	}
+	node.data = data
+}
+
+func (w *dbWriter) Bytes() []byte {
+	// Number the internal nodes.
+	var nodes []*trieNode
+	numbers := make(map[*trieNode]int)
+	var number func(n *trieNode)
+	number = func(n *trieNode) {
+		numbers[n] = len(nodes)
+		nodes = append(nodes, n)
+		for _, child := range n.children {
+			if child != nil && child.data == -1 {
+				number(child)
+			}
+		}
+	}
+	number(w.root)
+	nodeCount := len(nodes)
+
+	record := func(child *trieNode) uint32 {
+		switch {
+		case child == nil:
+			return uint32(nodeCount)
+		case child.data != -1:
+			return uint32(nodeCount + dataSectionSeparatorSize + child.data)
+		default:
+			return uint32(numbers[child])
+		}
+	}
+
+	var buf []byte
+	for _, n := range nodes {
+		left, right := record(n.children[0]), record(n.children[1])
+		switch w.recordSize {
+		case 24:
+			buf = append(
+				buf,
+				byte(left>>16), byte(left>>8), byte(left),
+				byte(right>>16), byte(right>>8), byte(right),
+			)
+		case 28:
+			buf = append(
+				buf,
+				byte(left>>16), byte(left>>8), byte(left),
+				byte((left>>24)<<4|(right>>24)&0x0F),
+				byte(right>>16), byte(right>>8), byte(right),
+			)
+		case 32:
+			buf = binary.BigEndian.AppendUint32(buf, left)
+			buf = binary.BigEndian.AppendUint32(buf, right)
+		}
+	}
+
+	buf = append(buf, make([]byte, dataSectionSeparatorSize)...)
+	buf = append(buf, w.data...)
+	buf = append(buf, metadataMarker...)
+	buf = append(buf, encodeValue(map[string]any{
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(w.recordSize),
+		"ip_version":                  uint16(w.ipVersion),
+		"database_type":               "Test-Country",
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1700000000),
+		"languages":                   []any{"en"},
+	})...)
+	return buf
+}
+
+func countryRecord(isoCode string) map[string]any {
+	return map[string]any{
+		"country": map[string]any{
+			"iso_code":             isoCode,
+			"is_in_european_union": isoCode == "DE",
+		},
+	}
+}
+
+func TestReader_Country(t *testing.T) {
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			w := newDBWriter(ipVersion, recordSize)
+			gb := w.AddData(countryRecord("GB"))
+			de := w.AddData(countryRecord("DE"))
+			w.Insert("10.0.0.0/8", gb)
+			w.Insert("192.168.1.0/24", de)
+			if ipVersion == 6 {
+				w.Insert("2001:db8::/32", de)
+			}
+
+			r, err := NewReader(w.Bytes())
+			require.NoError(t, err)
+			assert.Equal(t, "Test-Country", r.DatabaseType())
+
+			country, ok, err := r.Country(net.ParseIP("10.1.2.3"))
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, "GB", country)
+
+			country, ok, err = r.Country(net.ParseIP("192.168.1.200"))
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, "DE", country)
+
+			_, ok, err = r.Country(net.ParseIP("192.168.2.1"))
+			require.NoError(t, err)
+			assert.False(t, ok)
+
+			_, ok, err = r.Country(net.ParseIP("2001:db8::1"))
+			require.NoError(t, err)
+			assert.Equal(t, ipVersion == 6, ok)
+		}
+	}
+}
+
+func TestReader_Pointer(t *testing.T) {
+	w := newDBWriter(4, 24)
+	gb := w.AddData(map[string]any{"iso_code": "GB"})
+	// The record references the country using a pointer, as real databases
+	// do to deduplicate data.
+	record := w.AddData(map[string]any{
+		"registered_country": pointer(gb),
+	})
+	w.Insert("10.0.0.0/8", record)
+
+	r, err := NewReader(w.Bytes())
+	require.NoError(t, err)
+
+	country, ok, err := r.Country(net.ParseIP("10.0.0.1"))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "GB", country)
+}
+
+func TestReader_Invalid(t *testing.T) {
+	_, err := NewReader([]byte("foo"))
+	assert.ErrorIs(t, err, errInvalidDatabase)
+
+	// The search tree exceeds the file size.
+	b := append([]byte(nil), metadataMarker...)
+	b = append(b, encodeValue(map[string]any{
+		"node_count":  uint32(1000),
+		"record_size": uint16(24),
+		"ip_version":  uint16(4),
+	})...)
+	_, err = NewReader(b)
+	assert.ErrorIs(t, err, errInvalidDatabase)
+}
+
+func TestDB_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+
+	w := newDBWriter(6, 28)
+	w.Insert("10.0.0.0/8", w.AddData(countryRecord("GB")))
+	require.NoError(t, os.WriteFile(path, w.Bytes(), 0o600))
+
+	db, err := OpenDB(path, 0, log.NewNopLogger())
+	require.NoError(t, err)
+
+	country, ok := db.Country(net.ParseIP("10.0.0.1"))
+	assert.True(t, ok)
+	assert.Equal(t, "GB", country)
+
+	w = newDBWriter(6, 28)
+	w.Insert("10.0.0.0/8", w.AddData(countryRecord("FR")))
+	require.NoError(t, os.WriteFile(path, w.Bytes(), 0o600))
+	// Ensure the modification time changes.
+	future := db.modTime.Add(time.Second)
+	require.NoError(t, os.Chtimes(path, future, future))
+
+	require.NoError(t, db.reloadIfChanged())
+	country, ok = db.Country(net.ParseIP("10.0.0.1"))
+	assert.True(t, ok)
+	assert.Equal(t, "FR", country)
+}
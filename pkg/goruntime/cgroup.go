@@ -0,0 +1,80 @@
+package goruntime
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const defaultCgroupRoot = "/sys/fs/cgroup"
+
+// unlimitedMemory is the threshold above which cgroup v1 memory limits are
+// considered unlimited, since v1 reports no limit as a very large value
+// rather than 'max'.
+const unlimitedMemory = 1 << 62
+
+// cgroupCPUQuota returns the number of CPUs the container is limited to,
+// or false if there is no CPU limit or the process isn't in a container.
+//
+// Note this only supports the process being in the root cgroup of its
+// namespace, which is the case for containers.
+func cgroupCPUQuota(root string) (float64, bool) {
+	// cgroup v2, where 'cpu.max' is '<quota> <period>' or 'max <period>'.
+	if b, err := os.ReadFile(filepath.Join(root, "cpu.max")); err == nil {
+		fields := strings.Fields(string(b))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, false
+		}
+		return parseQuota(fields[0], fields[1])
+	}
+
+	// cgroup v1, where a quota of -1 is unlimited.
+	quota, err := os.ReadFile(filepath.Join(root, "cpu", "cpu.cfs_quota_us"))
+	if err != nil {
+		return 0, false
+	}
+	period, err := os.ReadFile(filepath.Join(root, "cpu", "cpu.cfs_period_us"))
+	if err != nil {
+		return 0, false
+	}
+	return parseQuota(
+		strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)),
+	)
+}
+
+// cgroupMemoryLimit returns the container memory limit in bytes, or false if
+// there is no memory limit or the process isn't in a container.
+func cgroupMemoryLimit(root string) (int64, bool) {
+	// cgroup v2.
+	b, err := os.ReadFile(filepath.Join(root, "memory.max"))
+	if err != nil {
+		// cgroup v1.
+		b, err = os.ReadFile(filepath.Join(root, "memory", "memory.limit_in_bytes"))
+		if err != nil {
+			return 0, false
+		}
+	}
+
+	s := strings.TrimSpace(string(b))
+	if s == "max" {
+		return 0, false
+	}
+	limit, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || limit <= 0 || limit >= unlimitedMemory {
+		return 0, false
+	}
+	return limit, true
+}
+
+func parseQuota(quota string, period string) (float64, bool) {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return float64(q) / float64(p), true
+}
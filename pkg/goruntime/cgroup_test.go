@@ -0,0 +1,176 @@
+package goruntime
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeCgroupFiles(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	for path, content := range files {
+		path = filepath.Join(root, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	return root
+}
+
+func TestCgroupCPUQuota(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		quota float64
+		ok    bool
+	}{
+		{
+			name:  "v2",
+			files: map[string]string{"cpu.max": "150000 100000\n"},
+			quota: 1.5,
+			ok:    true,
+		},
+		{
+			name:  "v2 unlimited",
+			files: map[string]string{"cpu.max": "max 100000\n"},
+		},
+		{
+			name: "v1",
+			files: map[string]string{
+				"cpu/cpu.cfs_quota_us":  "200000\n",
+				"cpu/cpu.cfs_period_us": "100000\n",
+			},
+			quota: 2,
+			ok:    true,
+		},
+		{
+			name: "v1 unlimited",
+			files: map[string]string{
+				"cpu/cpu.cfs_quota_us":  "-1\n",
+				"cpu/cpu.cfs_period_us": "100000\n",
+			},
+		},
+		{
+			name: "no cgroup",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := writeCgroupFiles(t, tt.files)
+
+			quota, ok := cgroupCPUQuota(root)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.quota, quota)
+		})
+	}
+}
+
+func TestCgroupMemoryLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		limit int64
+		ok    bool
+	}{
+		{
+			name:  "v2",
+			files: map[string]string{"memory.max": "1073741824\n"},
+			limit: 1 << 30,
+			ok:    true,
+		},
+		{
+			name:  "v2 unlimited",
+			files: map[string]string{"memory.max": "max\n"},
+		},
+		{
+			name: "v1",
+			files: map[string]string{
+				"memory/memory.limit_in_bytes": "1073741824\n",
+			},
+			limit: 1 << 30,
+			ok:    true,
+		},
+		{
+			name: "v1 unlimited",
+			files: map[string]string{
+				"memory/memory.limit_in_bytes": "9223372036854771712\n",
+			},
+		},
+		{
+			name: "no cgroup",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := writeCgroupFiles(t, tt.files)
+
+			limit, ok := cgroupMemoryLimit(root)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.limit, limit)
+		})
+	}
+}
+
+func TestMaxProcs(t *testing.T) {
+	t.Setenv("GOMAXPROCS", "")
+
+	t.Run("configured", func(t *testing.T) {
+		root := writeCgroupFiles(t, map[string]string{"cpu.max": "100000 100000"})
+		assert.Equal(t, 3, maxProcs(Config{MaxProcs: 3}, root))
+	})
+
+	t.Run("quota rounded up", func(t *testing.T) {
+		if runtime.NumCPU() < 2 {
+			t.Skip("requires 2 cpus")
+		}
+		root := writeCgroupFiles(t, map[string]string{"cpu.max": "50000 100000"})
+		assert.Equal(t, 1, maxProcs(Config{}, root))
+
+		root = writeCgroupFiles(t, map[string]string{"cpu.max": "150000 100000"})
+		assert.Equal(t, 2, maxProcs(Config{}, root))
+	})
+
+	t.Run("quota exceeds cpus", func(t *testing.T) {
+		root := writeCgroupFiles(t, map[string]string{"cpu.max": "100000000 1000"})
+		assert.Equal(t, 0, maxProcs(Config{}, root))
+	})
+
+	t.Run("env", func(t *testing.T) {
+		t.Setenv("GOMAXPROCS", "1")
+		root := writeCgroupFiles(t, map[string]string{"cpu.max": "100000 100000"})
+		assert.Equal(t, 0, maxProcs(Config{}, root))
+	})
+}
+
+func TestMemoryLimit(t *testing.T) {
+	t.Setenv("GOMEMLIMIT", "")
+
+	root := writeCgroupFiles(t, map[string]string{"memory.max": "1000"})
+
+	t.Run("configured", func(t *testing.T) {
+		assert.Equal(t, int64(500), memoryLimit(Config{
+			MemoryLimit:      500,
+			MemoryLimitRatio: 0.9,
+		}, root))
+	})
+
+	t.Run("ratio", func(t *testing.T) {
+		assert.Equal(t, int64(900), memoryLimit(Config{
+			MemoryLimitRatio: 0.9,
+		}, root))
+	})
+
+	t.Run("ratio disabled", func(t *testing.T) {
+		assert.Equal(t, int64(0), memoryLimit(Config{}, root))
+	})
+
+	t.Run("env", func(t *testing.T) {
+		t.Setenv("GOMEMLIMIT", "1GiB")
+		assert.Equal(t, int64(0), memoryLimit(Config{
+			MemoryLimitRatio: 0.9,
+		}, root))
+	})
+}
@@ -0,0 +1,99 @@
+package goruntime
+
+import (
+	"fmt"
+
+	"github.com/spf13/pflag"
+)
+
+// Config configures the Go runtime.
+//
+// Each option overrides the equivalent Go environment variable (such as
+// GOGC) when set, otherwise the environment variable or runtime default is
+// used.
+type Config struct {
+	// GCPercent is the garbage collection target percentage, equivalent to
+	// GOGC. A negative percentage disables garbage collection, unless the
+	// memory limit is reached. Zero uses the default.
+	GCPercent int `json:"gc_percent" yaml:"gc_percent"`
+
+	// MemoryLimit is the soft memory limit in bytes, equivalent to
+	// GOMEMLIMIT. Zero uses the default.
+	MemoryLimit int64 `json:"memory_limit" yaml:"memory_limit"`
+
+	// MemoryLimitRatio sets the soft memory limit to the given ratio of the
+	// container memory limit, such as 0.9 to leave 10% headroom for memory
+	// not managed by the Go runtime. Ignored if MemoryLimit or GOMEMLIMIT is
+	// set, or the process isn't running in a container with a memory limit.
+	// Zero disables.
+	MemoryLimitRatio float64 `json:"memory_limit_ratio" yaml:"memory_limit_ratio"`
+
+	// MaxProcs is the maximum number of CPUs executing Go code
+	// simultaneously, equivalent to GOMAXPROCS.
+	//
+	// Zero uses GOMAXPROCS if set, otherwise the container CPU quota
+	// rounded up, otherwise the number of CPUs.
+	MaxProcs int `json:"max_procs" yaml:"max_procs"`
+}
+
+func (c *Config) Validate() error {
+	if c.MemoryLimit < 0 {
+		return fmt.Errorf("memory limit cannot be negative")
+	}
+	if c.MemoryLimitRatio < 0 || c.MemoryLimitRatio > 1 {
+		return fmt.Errorf("memory limit ratio must be between 0 and 1")
+	}
+	if c.MaxProcs < 0 {
+		return fmt.Errorf("max procs cannot be negative")
+	}
+	return nil
+}
+
+func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
+	fs.IntVar(
+		&c.GCPercent,
+		"runtime.gc-percent",
+		c.GCPercent,
+		`
+Garbage collection target percentage, which overrides GOGC.
+
+A higher percentage collects less often, using more memory though less CPU.
+A negative percentage disables garbage collection unless the memory limit
+is reached. If zero, uses GOGC or the runtime default (100).`,
+	)
+	fs.Int64Var(
+		&c.MemoryLimit,
+		"runtime.memory-limit",
+		c.MemoryLimit,
+		`
+Soft memory limit in bytes, which overrides GOMEMLIMIT.
+
+The garbage collector collects more often as the heap approaches the limit.
+If zero, uses GOMEMLIMIT or '--runtime.memory-limit-ratio'.`,
+	)
+	fs.Float64Var(
+		&c.MemoryLimitRatio,
+		"runtime.memory-limit-ratio",
+		c.MemoryLimitRatio,
+		`
+Sets the soft memory limit to the given ratio of the container memory limit,
+such as '0.9' to leave 10% of the container memory for memory not managed
+by the Go runtime.
+
+Ignored if '--runtime.memory-limit' or GOMEMLIMIT is set, or the process
+isn't running in a container with a memory limit (using cgroups). If zero,
+the memory limit isn't derived from the container.`,
+	)
+	fs.IntVar(
+		&c.MaxProcs,
+		"runtime.max-procs",
+		c.MaxProcs,
+		`
+Maximum number of CPUs executing Go code simultaneously, which overrides
+GOMAXPROCS.
+
+If zero, uses GOMAXPROCS if set, otherwise the containers CPU quota
+(rounded up) when running in a container with a CPU limit (using cgroups),
+otherwise the number of CPUs.`,
+	)
+}
@@ -0,0 +1,104 @@
+// Package goruntime configures and monitors the Go runtime, such as the
+// garbage collector and scheduler.
+package goruntime
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// Apply configures the Go runtime.
+//
+// Since the runtime configuration is global to the process, Apply should
+// only be called once on startup.
+func Apply(conf Config, logger log.Logger) {
+	apply(conf, defaultCgroupRoot, logger.WithSubsystem("runtime"))
+}
+
+// Register registers metrics for the Go runtime, including the garbage
+// collector, memory and scheduler, and the process.
+func Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		collectors.NewGoCollector(
+			collectors.WithGoCollectorRuntimeMetrics(
+				collectors.MetricsGC,
+				collectors.MetricsMemory,
+				collectors.MetricsScheduler,
+			),
+		),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+func apply(conf Config, cgroupRoot string, logger log.Logger) {
+	if conf.GCPercent != 0 {
+		debug.SetGCPercent(conf.GCPercent)
+	}
+
+	if limit := memoryLimit(conf, cgroupRoot); limit != 0 {
+		debug.SetMemoryLimit(limit)
+	}
+
+	if procs := maxProcs(conf, cgroupRoot); procs != 0 {
+		runtime.GOMAXPROCS(procs)
+	}
+
+	samples := []metrics.Sample{
+		{Name: "/gc/gogc:percent"},
+		{Name: "/gc/gomemlimit:bytes"},
+	}
+	metrics.Read(samples)
+	logger.Info(
+		"configured runtime",
+		zap.Uint64("gc-percent", samples[0].Value.Uint64()),
+		zap.Uint64("memory-limit", samples[1].Value.Uint64()),
+		zap.Int("max-procs", runtime.GOMAXPROCS(0)),
+	)
+}
+
+// memoryLimit returns the configured memory limit, or zero to use the
+// default.
+func memoryLimit(conf Config, cgroupRoot string) int64 {
+	if conf.MemoryLimit != 0 {
+		return conf.MemoryLimit
+	}
+	if conf.MemoryLimitRatio == 0 || os.Getenv("GOMEMLIMIT") != "" {
+		return 0
+	}
+	limit, ok := cgroupMemoryLimit(cgroupRoot)
+	if !ok {
+		return 0
+	}
+	return int64(float64(limit) * conf.MemoryLimitRatio)
+}
+
+// maxProcs returns the configured GOMAXPROCS, or zero to use the default.
+func maxProcs(conf Config, cgroupRoot string) int {
+	if conf.MaxProcs != 0 {
+		return conf.MaxProcs
+	}
+	if os.Getenv("GOMAXPROCS") != "" {
+		return 0
+	}
+	quota, ok := cgroupCPUQuota(cgroupRoot)
+	if !ok {
+		return 0
+	}
+	procs := int(math.Ceil(quota))
+	if procs < 1 {
+		procs = 1
+	}
+	if procs > runtime.NumCPU() {
+		return 0
+	}
+	return procs
+}
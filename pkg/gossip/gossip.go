@@ -23,6 +23,11 @@ const (
 	compactThreshold   = 100
 )
 
+// Dialer opens stream connections to other nodes.
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
 type Gossip struct {
 	state *clusterState
 
@@ -31,7 +36,7 @@ type Gossip struct {
 	streamListener *streamListener
 	packetListener *packetListener
 
-	dialer     *net.Dialer
+	dialer     Dialer
 	packetConn net.PacketConn
 
 	metrics *Metrics
@@ -42,11 +47,17 @@ type Gossip struct {
 	shutdownCh chan struct{}
 }
 
+// New creates a gossiper that listens for traffic from other nodes on
+// streamLn and packetLn.
+//
+// dialer opens stream connections to other nodes. If nil, connections are
+// dialled with the host network.
 func New(
 	nodeID string,
 	config *Config,
 	streamLn net.Listener,
 	packetLn net.PacketConn,
+	dialer Dialer,
 	watcher Watcher,
 	logger log.Logger,
 ) *Gossip {
@@ -82,19 +93,23 @@ func New(
 	)
 	go packetListener.Serve()
 
+	if dialer == nil {
+		dialer = &net.Dialer{
+			Timeout: streamTimeout,
+		}
+	}
+
 	gossip := &Gossip{
 		state:          state,
 		config:         config,
 		streamListener: streamListener,
 		packetListener: packetListener,
-		dialer: &net.Dialer{
-			Timeout: streamTimeout,
-		},
-		packetConn: packetLn,
-		metrics:    metrics,
-		logger:     logger,
-		closed:     atomic.NewBool(false),
-		shutdownCh: make(chan struct{}),
+		dialer:         dialer,
+		packetConn:     packetLn,
+		metrics:        metrics,
+		logger:         logger,
+		closed:         atomic.NewBool(false),
+		shutdownCh:     make(chan struct{}),
 	}
 	gossip.schedule()
 	return gossip
@@ -288,6 +288,7 @@ func testNodeWithWatcher(nodeID string, w Watcher, t *testing.T) *Gossip {
 		nodeConfig,
 		streamLn,
 		packetLn,
+		nil,
 		w,
 		log.NewNopLogger(),
 	)
@@ -0,0 +1,228 @@
+// Package lifecycle manages starting and stopping the components of a
+// process in dependency order.
+//
+// Components are started in the order they're added, where each component
+// must be ready before the next is started, and are stopped in the reverse
+// order. So a component is only started once the components it depends on
+// are ready, and is stopped before them, such as to stop accepting traffic,
+// then drain in-flight requests, then close upstream tunnels, then flush
+// logs.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// Component is a component managed by the [Manager]. All functions are
+// optional.
+type Component struct {
+	// Name identifies the component in logs.
+	Name string
+
+	// Start starts the component, returning once the component is ready as
+	// the next component isn't started until Start returns. If Start
+	// returns an error, the manager stops the started components.
+	Start func(ctx context.Context) error
+
+	// Run runs the component in the background after Start returns, such
+	// as serving a listener, until the component is stopped.
+	//
+	// If Run returns before the manager is stopped, whether or not it
+	// returns an error, the component has failed so the process should
+	// shutdown (see [Manager.Done]).
+	Run func() error
+
+	// Stop stops the component, returning once stopped or the context is
+	// cancelled.
+	Stop func(ctx context.Context) error
+}
+
+// Manager manages the lifecycle of a set of components.
+type Manager struct {
+	components []Component
+	// started is the number of components that have been started.
+	started int
+
+	stopped bool
+	// err is the first error returned by a components Run.
+	err error
+	mu  sync.Mutex
+
+	// doneCh is closed when a component fails.
+	doneCh   chan struct{}
+	doneOnce sync.Once
+
+	wg sync.WaitGroup
+
+	logger log.Logger
+}
+
+func NewManager(logger log.Logger) *Manager {
+	return &Manager{
+		doneCh: make(chan struct{}),
+		logger: logger.WithSubsystem("lifecycle"),
+	}
+}
+
+// Add adds a component. The component isn't started until [Manager.Start].
+func (m *Manager) Add(c Component) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.components = append(m.components, c)
+}
+
+// Start starts the components in the order they were added.
+//
+// If a component fails to start, the components that were already started
+// are stopped within the grace period and the error is returned. The
+// components are stopped with a new context rather than ctx, since ctx may
+// be cancelled or live for the lifetime of the process.
+func (m *Manager) Start(ctx context.Context, gracePeriod time.Duration) error {
+	m.mu.Lock()
+	components := m.components
+	m.mu.Unlock()
+
+	for i, c := range components {
+		m.logger.Debug("starting component", zap.String("component", c.Name))
+
+		if c.Start != nil {
+			if err := c.Start(ctx); err != nil {
+				stopCtx, cancel := context.WithTimeout(
+					context.Background(), gracePeriod,
+				)
+				m.Stop(stopCtx)
+				cancel()
+				return fmt.Errorf("%s: %w", c.Name, err)
+			}
+		}
+
+		m.mu.Lock()
+		m.started = i + 1
+		m.mu.Unlock()
+
+		if c.Run != nil {
+			m.wg.Add(1)
+			go func() {
+				defer m.wg.Done()
+				m.run(c)
+			}()
+		}
+	}
+	return nil
+}
+
+// Stop stops the started components in the reverse order they were
+// started, then waits for each components Run to return.
+//
+// ctx bounds the total time to stop all components, such as the shutdown
+// grace period. Once cancelled each remaining component is still stopped
+// but with a cancelled context, so should stop immediately.
+func (m *Manager) Stop(ctx context.Context) {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		m.logger.Warn("already stopped")
+		return
+	}
+	m.stopped = true
+	components := m.components[:m.started]
+	m.mu.Unlock()
+
+	for i := len(components) - 1; i >= 0; i-- {
+		c := components[i]
+		if c.Stop == nil {
+			continue
+		}
+
+		m.logger.Debug("stopping component", zap.String("component", c.Name))
+		if err := c.Stop(ctx); err != nil {
+			m.logger.Warn(
+				"failed to stop component",
+				zap.String("component", c.Name),
+				zap.Error(err),
+			)
+		}
+	}
+
+	m.wg.Wait()
+}
+
+// Run starts the components, waits for ctx to be cancelled or a component
+// to fail, then stops the components within the grace period.
+//
+// Returns an error if a component failed to start or failed while running.
+func (m *Manager) Run(ctx context.Context, gracePeriod time.Duration) error {
+	if err := m.Start(ctx, gracePeriod); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-m.doneCh:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	m.Stop(shutdownCtx)
+
+	return m.Err()
+}
+
+// Done returns a channel that is closed when a component fails.
+func (m *Manager) Done() <-chan struct{} {
+	return m.doneCh
+}
+
+// Err returns the error of the first component that failed, or nil if no
+// components failed.
+func (m *Manager) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.err
+}
+
+func (m *Manager) run(c Component) {
+	err := c.Run()
+
+	m.mu.Lock()
+	stopped := m.stopped
+	if !stopped {
+		if err == nil {
+			err = errors.New("exited unexpectedly")
+		}
+		if m.err == nil {
+			m.err = fmt.Errorf("%s: %w", c.Name, err)
+		}
+	}
+	m.mu.Unlock()
+
+	if stopped {
+		if err != nil {
+			m.logger.Warn(
+				"component stopped with error",
+				zap.String("component", c.Name),
+				zap.Error(err),
+			)
+		}
+		return
+	}
+
+	m.logger.Error(
+		"component failed",
+		zap.String("component", c.Name),
+		zap.Error(err),
+	)
+	m.doneOnce.Do(func() {
+		close(m.doneCh)
+	})
+}
@@ -0,0 +1,172 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func TestManager(t *testing.T) {
+	t.Run("order", func(t *testing.T) {
+		var events []string
+		m := NewManager(log.NewNopLogger())
+		for _, name := range []string{"a", "b", "c"} {
+			m.Add(Component{
+				Name: name,
+				Start: func(context.Context) error {
+					events = append(events, "start "+name)
+					return nil
+				},
+				Stop: func(context.Context) error {
+					events = append(events, "stop "+name)
+					return nil
+				},
+			})
+		}
+
+		require.NoError(t, m.Start(context.Background(), time.Second))
+		m.Stop(context.Background())
+
+		assert.Equal(t, []string{
+			"start a", "start b", "start c",
+			"stop c", "stop b", "stop a",
+		}, events)
+		assert.NoError(t, m.Err())
+	})
+
+	t.Run("start error", func(t *testing.T) {
+		var events []string
+		m := NewManager(log.NewNopLogger())
+		m.Add(Component{
+			Name: "a",
+			Stop: func(context.Context) error {
+				events = append(events, "stop a")
+				return nil
+			},
+		})
+		m.Add(Component{
+			Name: "b",
+			Start: func(context.Context) error {
+				return errors.New("failed")
+			},
+			Stop: func(context.Context) error {
+				events = append(events, "stop b")
+				return nil
+			},
+		})
+		m.Add(Component{
+			Name: "c",
+			Stop: func(context.Context) error {
+				events = append(events, "stop c")
+				return nil
+			},
+		})
+
+		err := m.Start(context.Background(), time.Second)
+		assert.EqualError(t, err, "b: failed")
+
+		// Only the started components are stopped.
+		assert.Equal(t, []string{"stop a"}, events)
+	})
+
+	t.Run("start cancelled", func(t *testing.T) {
+		var stopErr error
+		var hasDeadline bool
+		m := NewManager(log.NewNopLogger())
+		m.Add(Component{
+			Name: "a",
+			Stop: func(ctx context.Context) error {
+				stopErr = ctx.Err()
+				_, hasDeadline = ctx.Deadline()
+				return nil
+			},
+		})
+		m.Add(Component{
+			Name: "b",
+			Start: func(ctx context.Context) error {
+				return ctx.Err()
+			},
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := m.Start(ctx, time.Second)
+		assert.EqualError(t, err, "b: context canceled")
+
+		// The started components are stopped within the grace period,
+		// rather than with the cancelled start context.
+		assert.NoError(t, stopErr)
+		assert.True(t, hasDeadline)
+	})
+
+	t.Run("run exits", func(t *testing.T) {
+		stopped := false
+		m := NewManager(log.NewNopLogger())
+		m.Add(Component{
+			Name: "a",
+			Stop: func(context.Context) error {
+				stopped = true
+				return nil
+			},
+		})
+		m.Add(Component{
+			Name: "b",
+			Run: func() error {
+				return errors.New("failed")
+			},
+		})
+
+		err := m.Run(context.Background(), time.Second)
+		assert.EqualError(t, err, "b: failed")
+		assert.True(t, stopped)
+	})
+
+	t.Run("run exits without error", func(t *testing.T) {
+		m := NewManager(log.NewNopLogger())
+		m.Add(Component{
+			Name: "a",
+			Run: func() error {
+				return nil
+			},
+		})
+
+		err := m.Run(context.Background(), time.Second)
+		assert.EqualError(t, err, "a: exited unexpectedly")
+	})
+
+	t.Run("run stopped", func(t *testing.T) {
+		m := NewManager(log.NewNopLogger())
+
+		stopCh := make(chan struct{})
+		m.Add(Component{
+			Name: "a",
+			Run: func() error {
+				<-stopCh
+				// Errors after stopping aren't failures.
+				return errors.New("closed")
+			},
+			Stop: func(context.Context) error {
+				close(stopCh)
+				return nil
+			},
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		assert.NoError(t, m.Run(ctx, time.Second))
+
+		select {
+		case <-m.Done():
+			t.Fatal("manager failed")
+		default:
+		}
+	})
+}
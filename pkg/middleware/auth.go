@@ -10,29 +10,91 @@ import (
 
 	"github.com/andydunstall/piko/pkg/auth"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
 )
 
 const (
 	TokenContextKey = "_piko_token"
 )
 
+type authOptions struct {
+	lockout *AuthLockout
+	headers protocol.Headers
+}
+
+type AuthOption interface {
+	apply(*authOptions)
+}
+
+type lockoutOption struct {
+	Lockout *AuthLockout
+}
+
+func (o lockoutOption) apply(opts *authOptions) {
+	opts.lockout = o.Lockout
+}
+
+// WithLockout configures the middleware to lock out client IPs and token IDs
+// with repeated authentication failures.
+func WithLockout(lockout *AuthLockout) AuthOption {
+	return lockoutOption{Lockout: lockout}
+}
+
+type authHeadersOption struct {
+	Headers protocol.Headers
+}
+
+func (o authHeadersOption) apply(opts *authOptions) {
+	opts.headers = o.Headers
+}
+
+// WithAuthHeaders configures the names of the Piko headers, such as the
+// header containing the token that takes precedence over 'Authorization'.
+func WithAuthHeaders(headers protocol.Headers) AuthOption {
+	return authHeadersOption{Headers: headers}
+}
+
 // Auth is middleware to verify token requests.
 type Auth struct {
 	verifier auth.Verifier
-	logger   log.Logger
+
+	// lockout is nil if lockouts are disabled.
+	lockout *AuthLockout
+
+	headers protocol.Headers
+
+	logger log.Logger
 }
 
-func NewAuth(verifier auth.Verifier, logger log.Logger) *Auth {
+func NewAuth(verifier auth.Verifier, logger log.Logger, opts ...AuthOption) *Auth {
+	options := authOptions{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
 	return &Auth{
 		verifier: verifier,
+		lockout:  options.lockout,
+		headers:  options.headers,
 		logger:   logger,
 	}
 }
 
 // Verify verifies the request endpoint token and adds to the context.
 //
-// If the token is invalid, returns 401 to the client.
+// If the token is invalid, returns 401 to the client. If lockouts are enabled
+// and the client IP or token ID is locked out, returns 429 to the client.
+//
+// Lockouts use the connection's remote address rather than forwarded
+// headers, since those are set by the client. Token IDs are only tracked once
+// the token signature is verified, otherwise clients could lock out any
+// token or grow the set of tracked IDs without bound.
 func (m *Auth) Verify(c *gin.Context) {
+	clientIP := c.RemoteIP()
+	if m.lockout != nil && !m.lockout.checkIP(c, clientIP) {
+		return
+	}
+
 	tokenString, ok := m.parseToken(c)
 	if !ok {
 		return
@@ -41,6 +103,14 @@ func (m *Auth) Verify(c *gin.Context) {
 	token, err := m.verifier.Verify(tokenString)
 	if err != nil {
 		if errors.Is(err, auth.ErrInvalidToken) {
+			if m.lockout != nil {
+				tokenID := auth.VerifiedTokenID(err)
+				if !m.lockout.checkToken(c, tokenID) {
+					return
+				}
+				m.lockout.failure(clientIP, tokenID)
+			}
+
 			m.logger.Warn(
 				"auth invalid token",
 				zap.Error(err),
@@ -79,7 +149,7 @@ func (m *Auth) parseToken(c *gin.Context) (string, bool) {
 	// Support both x-piko-authorization and authorization, where
 	// x-piko-authorization takes precedence. x-piko-authorization can be used
 	// to avoid conflicts with the upstream authorization header.
-	authorization := c.Request.Header.Get("x-piko-authorization")
+	authorization := c.Request.Header.Get(m.headers.Authorization())
 	if authorization == "" {
 		authorization = c.Request.Header.Get("Authorization")
 	}
@@ -9,10 +9,13 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/andydunstall/piko/pkg/auth"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/ratelimit"
 )
 
 type fakeVerifier struct {
@@ -193,6 +196,118 @@ func TestAuth(t *testing.T) {
 	})
 }
 
+func TestAuth_Lockout(t *testing.T) {
+	verifier := &fakeVerifier{
+		handler: func(_ string) (*auth.Token, error) {
+			return nil, auth.ErrInvalidToken
+		},
+	}
+	lockoutConf := ratelimit.LockoutConfig{
+		MaxFailures:   2,
+		FailureWindow: time.Minute,
+		Duration:      time.Minute,
+		MaxDuration:   time.Hour,
+	}
+
+	verify := func(m *Auth, remoteAddr string, token string) *http.Response {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "http://example.com/foo", nil)
+		c.Request.RemoteAddr = remoteAddr
+		c.Request.Header.Add("Authorization", "Bearer "+token)
+
+		m.Verify(c)
+
+		return w.Result()
+	}
+
+	t.Run("ip lockout", func(t *testing.T) {
+		lockout := NewAuthLockout(lockoutConf, "test", log.NewNopLogger())
+		m := NewAuth(verifier, log.NewNopLogger(), WithLockout(lockout))
+
+		for i := 0; i != 2; i++ {
+			resp := verify(m, "1.2.3.4:1000", "123")
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		}
+
+		resp := verify(m, "1.2.3.4:1000", "123")
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+
+		var errMessage errorMessage
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&errMessage))
+		assert.Equal(t, "too many failed authentication attempts", errMessage.Error)
+
+		// Other IPs are unaffected.
+		resp = verify(m, "5.6.7.8:1000", "123")
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("ip lockout ignores forwarded for", func(t *testing.T) {
+		lockout := NewAuthLockout(lockoutConf, "test", log.NewNopLogger())
+		m := NewAuth(verifier, log.NewNopLogger(), WithLockout(lockout))
+
+		for i := 0; i != 3; i++ {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("GET", "http://example.com/foo", nil)
+			c.Request.RemoteAddr = "1.2.3.4:1000"
+			c.Request.Header.Add("Authorization", "Bearer 123")
+			// Rotating the forwarded address must not bypass the lockout.
+			c.Request.Header.Add("X-Forwarded-For", fmt.Sprintf("10.0.0.%d", i))
+
+			m.Verify(c)
+
+			if i == 2 {
+				assert.Equal(t, http.StatusTooManyRequests, w.Code)
+			} else {
+				assert.Equal(t, http.StatusUnauthorized, w.Code)
+			}
+		}
+	})
+
+	t.Run("token lockout", func(t *testing.T) {
+		// The token signature is verified but the claims are rejected.
+		verifier := &fakeVerifier{
+			handler: func(_ string) (*auth.Token, error) {
+				return nil, &auth.ClaimsError{
+					TokenID: "my-token",
+					Err:     auth.ErrInvalidToken,
+				}
+			},
+		}
+		lockout := NewAuthLockout(lockoutConf, "test", log.NewNopLogger())
+		m := NewAuth(verifier, log.NewNopLogger(), WithLockout(lockout))
+
+		// Use a different IP for each request so only the token ID is
+		// locked out.
+		for i := 0; i != 2; i++ {
+			resp := verify(m, fmt.Sprintf("1.2.3.%d:1000", i), "123")
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		}
+
+		resp := verify(m, "1.2.3.100:1000", "123")
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	})
+
+	t.Run("unverified token id", func(t *testing.T) {
+		lockout := NewAuthLockout(lockoutConf, "test", log.NewNopLogger())
+		m := NewAuth(verifier, log.NewNopLogger(), WithLockout(lockout))
+
+		// The token has an ID but an invalid signature, so the ID can't be
+		// trusted and must not be locked out.
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+			ID: "my-token",
+		}).SignedString([]byte("secret"))
+		require.NoError(t, err)
+
+		for i := 0; i != 3; i++ {
+			resp := verify(m, fmt.Sprintf("1.2.3.%d:1000", i), token)
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		}
+	})
+}
+
 func init() {
 	// Disable Gin debug logs.
 	gin.SetMode(gin.ReleaseMode)
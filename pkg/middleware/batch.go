@@ -0,0 +1,232 @@
+package middleware
+
+import (
+	"math/rand/v2"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// intervalCheckSize is the number of observations between checking
+	// whether the shard flush interval has expired, to avoid reading the
+	// clock on every observation.
+	intervalCheckSize = 16
+
+	cacheLineSize = 64
+)
+
+// batchHistogram is a histogram that aggregates observations in striped
+// shards, then adds each shard's aggregated bucket counts and sum to the
+// histogram totals once per flush.
+//
+// Under very high request rates, Prometheus histograms become a contention
+// hotspot as every observation updates the same counters from every CPU.
+// Instead each observation updates the bucket counts of one of GOMAXPROCS
+// shards. Observations start at a random shard and move to the next shard if
+// it is locked, so concurrent observations rarely contend.
+//
+// Shards are flushed when the shard hasn't been flushed for the configured
+// interval, and whenever the metrics are collected, so scrapes always see all
+// observations.
+type batchHistogram struct {
+	desc        *prometheus.Desc
+	labelValues []string
+	upperBounds []float64
+	interval    time.Duration
+
+	shards []batchShard
+
+	// counts contains the flushed (non-cumulative) count of each bucket,
+	// where the last bucket is +Inf.
+	counts []uint64
+	sum    float64
+	count  uint64
+
+	// mu protects the flushed totals.
+	mu sync.Mutex
+}
+
+type batchShard struct {
+	mu        sync.Mutex
+	counts    []uint64
+	sum       float64
+	count     uint64
+	lastFlush time.Time
+
+	// Pad to avoid false sharing between shards.
+	_ [cacheLineSize]byte
+}
+
+func newBatchHistogram(
+	desc *prometheus.Desc,
+	upperBounds []float64,
+	interval time.Duration,
+	labelValues ...string,
+) *batchHistogram {
+	shards := make([]batchShard, runtime.GOMAXPROCS(0))
+	now := time.Now()
+	for i := range shards {
+		shards[i].counts = make([]uint64, len(upperBounds)+1)
+		shards[i].lastFlush = now
+	}
+	return &batchHistogram{
+		desc:        desc,
+		labelValues: labelValues,
+		upperBounds: upperBounds,
+		interval:    interval,
+		shards:      shards,
+		counts:      make([]uint64, len(upperBounds)+1),
+	}
+}
+
+func (h *batchHistogram) Observe(v float64) {
+	// Buckets are inclusive of their upper bound.
+	bucket := sort.SearchFloat64s(h.upperBounds, v)
+
+	shard := h.lockShard()
+	defer shard.mu.Unlock()
+
+	shard.counts[bucket]++
+	shard.sum += v
+	shard.count++
+
+	if shard.count%intervalCheckSize != 0 {
+		return
+	}
+	if time.Since(shard.lastFlush) < h.interval {
+		return
+	}
+	h.flushLocked(shard)
+}
+
+// Flush adds all aggregated shard observations to the histogram totals.
+func (h *batchHistogram) Flush() {
+	for i := range h.shards {
+		shard := &h.shards[i]
+		shard.mu.Lock()
+		h.flushLocked(shard)
+		shard.mu.Unlock()
+	}
+}
+
+// Metric returns the histogram totals as a constant metric.
+func (h *batchHistogram) Metric() prometheus.Metric {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make(map[float64]uint64, len(h.upperBounds))
+	var cumulative uint64
+	for i, upperBound := range h.upperBounds {
+		cumulative += h.counts[i]
+		buckets[upperBound] = cumulative
+	}
+	return prometheus.MustNewConstHistogram(
+		h.desc, h.count, h.sum, buckets, h.labelValues...,
+	)
+}
+
+// lockShard locks and returns a shard, preferring shards that aren't already
+// locked.
+func (h *batchHistogram) lockShard() *batchShard {
+	start := rand.IntN(len(h.shards))
+	for i := 0; i != len(h.shards); i++ {
+		shard := &h.shards[(start+i)%len(h.shards)]
+		if shard.mu.TryLock() {
+			return shard
+		}
+	}
+	shard := &h.shards[start]
+	shard.mu.Lock()
+	return shard
+}
+
+func (h *batchHistogram) flushLocked(shard *batchShard) {
+	shard.lastFlush = time.Now()
+	if shard.count == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	for i, n := range shard.counts {
+		h.counts[i] += n
+	}
+	h.sum += shard.sum
+	h.count += shard.count
+	h.mu.Unlock()
+
+	clear(shard.counts)
+	shard.sum = 0
+	shard.count = 0
+}
+
+var _ prometheus.Observer = &batchHistogram{}
+
+// batcher tracks the batch histograms for a histogram vector, so they can be
+// collected alongside the vector.
+type batcher struct {
+	interval time.Duration
+
+	desc        *prometheus.Desc
+	upperBounds []float64
+
+	histograms []*batchHistogram
+	mu         sync.Mutex
+}
+
+func newBatcher(interval time.Duration) *batcher {
+	return &batcher{
+		interval: interval,
+	}
+}
+
+// Init configures the histogram vector the batch histograms are collected
+// with.
+func (b *batcher) Init(vec *prometheus.HistogramVec, upperBounds []float64) {
+	descs := make(chan *prometheus.Desc, 1)
+	vec.Describe(descs)
+	b.desc = <-descs
+	b.upperBounds = upperBounds
+}
+
+// Histogram returns a batch histogram with the given label values.
+//
+// The caller must not observe the same label values with the underlying
+// histogram vector, otherwise the series would be collected twice.
+func (b *batcher) Histogram(labelValues ...string) prometheus.Observer {
+	h := newBatchHistogram(b.desc, b.upperBounds, b.interval, labelValues...)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.histograms = append(b.histograms, h)
+	return h
+}
+
+func (b *batcher) Collect(ch chan<- prometheus.Metric) {
+	b.mu.Lock()
+	histograms := make([]*batchHistogram, len(b.histograms))
+	copy(histograms, b.histograms)
+	b.mu.Unlock()
+
+	for _, h := range histograms {
+		h.Flush()
+		ch <- h.Metric()
+	}
+}
+
+// batchCollector collects both the underlying histogram vector and the batch
+// histograms.
+type batchCollector struct {
+	prometheus.Collector
+
+	batcher *batcher
+}
+
+func (c *batchCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Collector.Collect(ch)
+	c.batcher.Collect(ch)
+}
@@ -0,0 +1,185 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// histogramCount returns the sample count of the histogram with the given
+// name in the registry.
+func histogramCount(t *testing.T, registry *prometheus.Registry, name string) uint64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	var count uint64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			count += m.GetHistogram().GetSampleCount()
+		}
+	}
+	return count
+}
+
+func TestBatchObserver(t *testing.T) {
+	t.Run("flush on collect", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		metrics := NewMetrics("test", WithBatchedLatency(time.Hour))
+		metrics.Register(registry)
+
+		router := gin.New()
+		router.Use(metrics.Handler())
+		router.GET("/", func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		for i := 0; i != 10; i++ {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		}
+
+		// Observations are aggregated in the shards (as the interval hasn't
+		// expired) but should be flushed on collect.
+		assert.Equal(t, uint64(10), histogramCount(
+			t, registry, "piko_test_request_latency_seconds",
+		))
+	})
+
+	t.Run("aggregate", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "test",
+			Buckets: []float64{1, 2, 4},
+		}, []string{"label"})
+		b := newBatcher(time.Hour)
+		b.Init(histogram, []float64{1, 2, 4})
+		registry.MustRegister(latencyCollector(histogram, b))
+
+		o := b.Histogram("foo")
+		for _, v := range []float64{0.5, 1, 1.5, 3, 5, 5} {
+			o.Observe(v)
+		}
+
+		families, err := registry.Gather()
+		require.NoError(t, err)
+		require.Len(t, families, 1)
+		require.Len(t, families[0].GetMetric(), 1)
+
+		m := families[0].GetMetric()[0]
+		assert.Equal(t, "foo", m.GetLabel()[0].GetValue())
+		assert.Equal(t, uint64(6), m.GetHistogram().GetSampleCount())
+		assert.Equal(t, 16.0, m.GetHistogram().GetSampleSum())
+
+		var counts []uint64
+		for _, bucket := range m.GetHistogram().GetBucket() {
+			counts = append(counts, bucket.GetCumulativeCount())
+		}
+		assert.Equal(t, []uint64{2, 3, 4}, counts)
+	})
+
+	t.Run("flush on interval", func(t *testing.T) {
+		h := newBatchHistogram(nil, prometheus.DefBuckets, time.Millisecond)
+		h.shards = h.shards[:1]
+
+		<-time.After(time.Millisecond * 5)
+
+		// The interval is only checked every intervalCheckSize observations.
+		for i := 0; i != intervalCheckSize-1; i++ {
+			h.Observe(1)
+		}
+		assert.Equal(t, uint64(intervalCheckSize-1), h.shards[0].count)
+		assert.Equal(t, uint64(0), h.count)
+
+		h.Observe(1)
+		assert.Equal(t, uint64(0), h.shards[0].count)
+		assert.Equal(t, uint64(intervalCheckSize), h.count)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		metrics := NewLabeledMetrics("test", WithBatchedLatency(time.Hour))
+		metrics.Register(registry)
+
+		router := gin.New()
+		router.Use(metrics.Handler("my-endpoint"))
+		router.GET("/", func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		var wg sync.WaitGroup
+		for i := 0; i != 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j != 100; j++ {
+					w := httptest.NewRecorder()
+					router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, uint64(1000), histogramCount(
+			t, registry, "piko_test_request_latency_seconds",
+		))
+	})
+}
+
+func BenchmarkLatency_Observe(b *testing.B) {
+	b.Run("histogram", func(b *testing.B) {
+		histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "bench",
+		})
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				histogram.Observe(0.1)
+			}
+		})
+	})
+
+	b.Run("batched", func(b *testing.B) {
+		o := newBatchHistogram(nil, prometheus.DefBuckets, time.Second)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				o.Observe(0.1)
+			}
+		})
+	})
+}
+
+func BenchmarkMetrics_HandlerBatched(b *testing.B) {
+	metrics := NewMetrics("bench", WithBatchedLatency(time.Second))
+
+	router := gin.New()
+	router.Use(metrics.Handler())
+	router.GET("/foo", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/foo?bar=car", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		w := httptest.NewRecorder()
+		for pb.Next() {
+			router.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/pkg/fingerprint"
+)
+
+const FingerprintContextKey = "_piko_fingerprint"
+
+// NewFingerprint creates middleware that adds the TLS client fingerprint of
+// the connection to the context, so it can be used to tag logs, and records
+// the request in the table. The connection must be accepted by a
+// fingerprint listener (see fingerprint.NewListener).
+func NewFingerprint(table *fingerprint.Table) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if f, ok := fingerprint.FromContext(c.Request.Context()); ok {
+			c.Set(FingerprintContextKey, f)
+			if table != nil {
+				table.Observe(f, c.ClientIP(), c.Request.UserAgent())
+			}
+		}
+		c.Next()
+	}
+}
+
+// Fingerprint returns the TLS client fingerprint of the request, or an empty
+// fingerprint if the client wasn't fingerprinted.
+func Fingerprint(c *gin.Context) fingerprint.Fingerprint {
+	v, ok := c.Get(FingerprintContextKey)
+	if !ok {
+		return fingerprint.Fingerprint{}
+	}
+	f, _ := v.(fingerprint.Fingerprint)
+	return f
+}
@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	CountryContextKey = "_piko_country"
+
+	// UnknownCountryLabel is the country label of requests whose client IP
+	// isn't in the GeoIP database.
+	UnknownCountryLabel = "_unknown"
+)
+
+// CountryLookup looks up the ISO 3166-1 alpha-2 country code of an IP.
+type CountryLookup interface {
+	Country(ip net.IP) (string, bool)
+}
+
+// NewGeoIP creates middleware that adds the country of the client IP to the
+// context, so it can be used to tag logs and metrics.
+func NewGeoIP(lookup CountryLookup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ip := net.ParseIP(c.ClientIP()); ip != nil {
+			if country, ok := lookup.Country(ip); ok && validCountry(country) {
+				c.Set(CountryContextKey, country)
+			}
+		}
+		c.Next()
+	}
+}
+
+// Country returns the country code of the request client, or an empty
+// string if the country is unknown.
+func Country(c *gin.Context) string {
+	return c.GetString(CountryContextKey)
+}
+
+// GeoIPMetrics records request metrics by client country.
+type GeoIPMetrics struct {
+	RequestsTotal *prometheus.CounterVec
+}
+
+func NewGeoIPMetrics(subsystem string) *GeoIPMetrics {
+	return &GeoIPMetrics{
+		RequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: subsystem,
+				Name:      "country_requests_total",
+				Help:      "Total requests by client country.",
+			},
+			[]string{"country", "status"},
+		),
+	}
+}
+
+func (m *GeoIPMetrics) Register(registry prometheus.Registerer) {
+	registry.MustRegister(
+		m.RequestsTotal,
+	)
+}
+
+// Handler returns middleware that records the country metrics. Must be added
+// after the GeoIP middleware (see NewGeoIP).
+func (m *GeoIPMetrics) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		country := Country(c)
+		if country == "" {
+			country = UnknownCountryLabel
+		}
+		m.RequestsTotal.WithLabelValues(
+			country, strconv.Itoa(c.Writer.Status()),
+		).Inc()
+	}
+}
+
+// validCountry returns whether the country is a two letter upper case code,
+// which bounds the cardinality of the country label.
+func validCountry(country string) bool {
+	if len(country) != 2 {
+		return false
+	}
+	for _, r := range []byte(country) {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCountryLookup map[string]string
+
+func (l fakeCountryLookup) Country(ip net.IP) (string, bool) {
+	country, ok := l[ip.String()]
+	return country, ok
+}
+
+func TestGeoIP(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewGeoIPMetrics("test")
+	metrics.Register(registry)
+
+	router := gin.New()
+	router.Use(NewGeoIP(fakeCountryLookup{
+		"10.0.0.1": "GB",
+		// Invalid codes are ignored to bound the label cardinality.
+		"10.0.0.2": "not-a-country",
+	}))
+	router.Use(metrics.Handler())
+
+	var country string
+	router.GET("/", func(c *gin.Context) {
+		country = Country(c)
+		c.String(http.StatusOK, "foo")
+	})
+
+	request := func(remoteAddr string) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	request("10.0.0.1:1234")
+	assert.Equal(t, "GB", country)
+	request("10.0.0.2:1234")
+	assert.Equal(t, "", country)
+	request("10.0.0.3:1234")
+	assert.Equal(t, "", country)
+
+	requestsTotal := func(country string) float64 {
+		return counterValue(t, registry, "piko_test_country_requests_total", map[string]string{
+			"country": country,
+			"status":  "200",
+		})
+	}
+	assert.Equal(t, 1.0, requestsTotal("GB"))
+	assert.Equal(t, 2.0, requestsTotal(UnknownCountryLabel))
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// InformationalWriter is a [http.ResponseWriter] that writes 1xx
+// informational responses, such as '103 Early Hints', to the client
+// immediately.
+//
+// gin's response writer only records the status passed to WriteHeader until
+// the body is written, so would drop informational responses forwarded by
+// [httputil.ReverseProxy] and use their status as the final response status.
+// Instead InformationalWriter writes them directly to the connection's
+// underlying response writer.
+//
+// '100 Continue' responses aren't forwarded, since the HTTP server sends its
+// own '100 Continue' once the proxy starts reading the request body, which
+// the proxy only does once the upstream has sent '100 Continue' (see
+// [http.Transport.ExpectContinueTimeout]).
+type InformationalWriter struct {
+	http.ResponseWriter
+
+	root    http.ResponseWriter
+	observe func(status int)
+}
+
+// NewInformationalWriter wraps w to write informational responses to the
+// client. If observe isn't nil, it is called with the status of each
+// informational response.
+func NewInformationalWriter(
+	w http.ResponseWriter, observe func(status int),
+) *InformationalWriter {
+	root := w
+	for {
+		u, ok := root.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		root = u.Unwrap()
+	}
+	return &InformationalWriter{
+		ResponseWriter: w,
+		root:           root,
+		observe:        observe,
+	}
+}
+
+func (w *InformationalWriter) WriteHeader(status int) {
+	if !isInformational(status) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if w.observe != nil {
+		w.observe(status)
+	}
+	if status == http.StatusContinue {
+		return
+	}
+	w.root.WriteHeader(status)
+}
+
+// Unwrap returns the underlying response writer, for use with
+// [http.ResponseController].
+func (w *InformationalWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// isInformational returns whether the status is an informational response
+// that precedes the final response. '101 Switching Protocols' is a final
+// response.
+func isInformational(status int) bool {
+	return status >= 100 && status < 200 && status != http.StatusSwitchingProtocols
+}
+
+var _ http.ResponseWriter = &InformationalWriter{}
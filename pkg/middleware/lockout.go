@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/ratelimit"
+)
+
+// AuthLockout locks out client IPs and token IDs with repeated authentication
+// failures, to slow down credential guessing attacks.
+//
+// Lockouts are logged as audit events to the 'audit' subsystem.
+type AuthLockout struct {
+	ips    *ratelimit.Lockout
+	tokens *ratelimit.Lockout
+
+	metrics *authLockoutMetrics
+
+	logger log.Logger
+}
+
+// NewAuthLockout creates an auth lockout. 'subsystem' identifies the server
+// in metrics and audit events.
+func NewAuthLockout(
+	conf ratelimit.LockoutConfig,
+	subsystem string,
+	logger log.Logger,
+) *AuthLockout {
+	return &AuthLockout{
+		ips:     ratelimit.NewLockout(conf),
+		tokens:  ratelimit.NewLockout(conf),
+		metrics: newAuthLockoutMetrics(subsystem),
+		logger: logger.WithSubsystem("audit").With(
+			zap.String("server", subsystem),
+		),
+	}
+}
+
+func (l *AuthLockout) Register(registry *prometheus.Registry) {
+	l.metrics.Register(registry)
+}
+
+// checkIP returns false and rejects the request if the client IP is locked
+// out.
+func (l *AuthLockout) checkIP(c *gin.Context, clientIP string) bool {
+	until, locked := l.ips.Locked(clientIP)
+	if !locked {
+		return true
+	}
+	l.metrics.RejectedTotal.WithLabelValues("ip").Inc()
+	l.reject(c, until)
+	return false
+}
+
+// checkToken returns false and rejects the request if the token ID is locked
+// out.
+func (l *AuthLockout) checkToken(c *gin.Context, tokenID string) bool {
+	if tokenID == "" {
+		return true
+	}
+	until, locked := l.tokens.Locked(tokenID)
+	if !locked {
+		return true
+	}
+	l.metrics.RejectedTotal.WithLabelValues("token").Inc()
+	l.reject(c, until)
+	return false
+}
+
+// failure records an authentication failure for the client IP and token ID.
+func (l *AuthLockout) failure(clientIP string, tokenID string) {
+	l.metrics.FailuresTotal.Inc()
+
+	if duration, locked := l.ips.Failure(clientIP); locked {
+		l.metrics.LockoutsTotal.WithLabelValues("ip").Inc()
+		l.logger.Warn(
+			"auth lockout",
+			zap.String("client-ip", clientIP),
+			zap.Duration("duration", duration),
+		)
+	}
+	if tokenID == "" {
+		return
+	}
+	if duration, locked := l.tokens.Failure(tokenID); locked {
+		l.metrics.LockoutsTotal.WithLabelValues("token").Inc()
+		l.logger.Warn(
+			"auth lockout",
+			zap.String("token-id", tokenID),
+			zap.String("client-ip", clientIP),
+			zap.Duration("duration", duration),
+		)
+	}
+}
+
+func (l *AuthLockout) reject(c *gin.Context, until time.Time) {
+	// Round up so clients don't retry before the lockout expires.
+	retryAfter := int(math.Ceil(time.Until(until).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.AbortWithStatusJSON(
+		http.StatusTooManyRequests,
+		gin.H{"error": "too many failed authentication attempts"},
+	)
+}
+
+type authLockoutMetrics struct {
+	// FailuresTotal is the number of authentication failures.
+	FailuresTotal prometheus.Counter
+
+	// LockoutsTotal is the number of lockouts. Labelled by whether a client
+	// IP or token ID was locked out.
+	LockoutsTotal *prometheus.CounterVec
+
+	// RejectedTotal is the number of requests rejected due to a lockout.
+	// Labelled by whether the client IP or token ID was locked out.
+	RejectedTotal *prometheus.CounterVec
+}
+
+func newAuthLockoutMetrics(subsystem string) *authLockoutMetrics {
+	return &authLockoutMetrics{
+		FailuresTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: subsystem,
+				Name:      "auth_failures_total",
+				Help:      "Number of authentication failures",
+			},
+		),
+		LockoutsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: subsystem,
+				Name:      "auth_lockouts_total",
+				Help:      "Number of client IPs and token IDs locked out",
+			},
+			[]string{"type"},
+		),
+		RejectedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: subsystem,
+				Name:      "auth_lockout_rejected_total",
+				Help:      "Number of requests rejected due to an auth lockout",
+			},
+			[]string{"type"},
+		),
+	}
+}
+
+func (m *authLockoutMetrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.FailuresTotal,
+		m.LockoutsTotal,
+		m.RejectedTotal,
+	)
+}
@@ -20,9 +20,17 @@ type loggedRequest struct {
 	ResponseHeaders http.Header `json:"response_headers"`
 	Status          int         `json:"status"`
 	Duration        string      `json:"duration"`
+	Route           string      `json:"route,omitempty"`
+	Tenant          string      `json:"tenant,omitempty"`
+	Country         string      `json:"country,omitempty"`
+	JA3             string      `json:"ja3,omitempty"`
+	JA4             string      `json:"ja4,omitempty"`
 }
 
-// NewLogger creates logging middleware that logs every request.
+// NewLogger creates logging middleware that logs every sampled request.
+//
+// Requests are always sampled unless using sampling middleware (see
+// NewSampling).
 func NewLogger(accessLog bool, logger log.Logger) gin.HandlerFunc {
 	logger = logger.WithSubsystem(logger.Subsystem() + ".access")
 	return func(c *gin.Context) {
@@ -35,6 +43,10 @@ func NewLogger(accessLog bool, logger log.Logger) gin.HandlerFunc {
 			return
 		}
 
+		if !sampled(c) {
+			return
+		}
+
 		req := &loggedRequest{
 			Proto:           c.Request.Proto,
 			Method:          c.Request.Method,
@@ -44,6 +56,11 @@ func NewLogger(accessLog bool, logger log.Logger) gin.HandlerFunc {
 			ResponseHeaders: c.Writer.Header(),
 			Status:          c.Writer.Status(),
 			Duration:        time.Since(s).String(),
+			Route:           Route(c),
+			Tenant:          Tenant(c),
+			Country:         Country(c),
+			JA3:             Fingerprint(c).JA3,
+			JA4:             Fingerprint(c).JA4,
 		}
 		if c.Writer.Status() >= http.StatusInternalServerError {
 			logger.Warn("request", zap.Any("request", req))
@@ -2,11 +2,14 @@ package middleware
 
 import (
 	"net/http"
+	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
 )
 
 type gaugeOptions struct {
@@ -15,6 +18,11 @@ type gaugeOptions struct {
 	RequestLatency   prometheus.HistogramOpts
 	RequestSize      prometheus.HistogramOpts
 	ResponseSize     prometheus.HistogramOpts
+
+	UpstreamsConnected    prometheus.CounterOpts
+	UpstreamsDisconnected prometheus.CounterOpts
+	UpstreamsActive       prometheus.GaugeOpts
+	RedirectsFollowed     prometheus.CounterOpts
 }
 
 func newOptions(subsystem string) gaugeOptions {
@@ -53,15 +61,76 @@ func newOptions(subsystem string) gaugeOptions {
 			Help:      "Response size",
 			Buckets:   sizeBuckets,
 		},
+		UpstreamsConnected: prometheus.CounterOpts{
+			Namespace: "piko",
+			Subsystem: subsystem,
+			Name:      "upstreams_connected_total",
+			Help:      "Total upstream connections connected.",
+		},
+		UpstreamsDisconnected: prometheus.CounterOpts{
+			Namespace: "piko",
+			Subsystem: subsystem,
+			Name:      "upstreams_disconnected_total",
+			Help:      "Total upstream connections disconnected.",
+		},
+		UpstreamsActive: prometheus.GaugeOpts{
+			Namespace: "piko",
+			Subsystem: subsystem,
+			Name:      "upstreams_active",
+			Help:      "Number of upstream connections currently connected.",
+		},
+		RedirectsFollowed: prometheus.CounterOpts{
+			Namespace: "piko",
+			Subsystem: subsystem,
+			Name:      "redirects_followed_total",
+			Help:      "Total upstream redirects followed rather than returned to the client.",
+		},
 	}
 }
 
+type metricsOptions struct {
+	batchInterval time.Duration
+}
+
+type batchLatencyOption time.Duration
+
+func (o batchLatencyOption) apply(opts *metricsOptions) {
+	opts.batchInterval = time.Duration(o)
+}
+
+// WithBatchedLatency configures request latency observations to be
+// aggregated in striped shards, where each shard's bucket counts are added to
+// the latency histogram at most 'interval' apart.
+//
+// This avoids the histogram becoming a contention hotspot under very high
+// request rates. All shards are flushed when the metrics are collected.
+func WithBatchedLatency(interval time.Duration) MetricsOption {
+	return batchLatencyOption(interval)
+}
+
+type MetricsOption interface {
+	apply(*metricsOptions)
+}
+
 type LabeledMetrics struct {
 	RequestsInFlight *prometheus.GaugeVec
 	RequestsTotal    *prometheus.CounterVec
 	RequestLatency   *prometheus.HistogramVec
 	RequestSize      *prometheus.HistogramVec
 	ResponseSize     *prometheus.HistogramVec
+
+	// UpstreamsConnected, UpstreamsDisconnected and UpstreamsActive track
+	// the WebSocket upstream connections for each endpoint.
+	UpstreamsConnected    *prometheus.CounterVec
+	UpstreamsDisconnected *prometheus.CounterVec
+	UpstreamsActive       *prometheus.GaugeVec
+
+	// RedirectsFollowed is the number of upstream redirects the agent
+	// followed for each endpoint.
+	RedirectsFollowed *prometheus.CounterVec
+
+	// batcher is nil if latency observations aren't batched.
+	batcher *batcher
 }
 
 type Metrics struct {
@@ -70,79 +139,164 @@ type Metrics struct {
 	RequestLatency   *prometheus.HistogramVec
 	RequestSize      prometheus.Histogram
 	ResponseSize     prometheus.Histogram
+
+	// batcher is nil if latency observations aren't batched.
+	batcher *batcher
 }
 
-func NewLabeledMetrics(subsystem string) *LabeledMetrics {
-	opts := newOptions(subsystem)
-	return &LabeledMetrics{
+func newMetricsOptions(opts []MetricsOption) metricsOptions {
+	options := metricsOptions{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+	return options
+}
+
+func (o metricsOptions) batcher() *batcher {
+	if o.batchInterval == 0 {
+		return nil
+	}
+	return newBatcher(o.batchInterval)
+}
+
+func NewLabeledMetrics(subsystem string, opts ...MetricsOption) *LabeledMetrics {
+	options := newMetricsOptions(opts)
+	gaugeOpts := newOptions(subsystem)
+	lm := &LabeledMetrics{
 		RequestsInFlight: prometheus.NewGaugeVec(
-			opts.RequestsInFlight,
+			gaugeOpts.RequestsInFlight,
 			[]string{"endpoint"},
 		),
 		RequestsTotal: prometheus.NewCounterVec(
-			opts.RequestsTotal,
+			gaugeOpts.RequestsTotal,
 			[]string{"endpoint", "status", "method"},
 		),
 		RequestLatency: prometheus.NewHistogramVec(
-			opts.RequestLatency,
+			gaugeOpts.RequestLatency,
 			[]string{"endpoint", "status", "method"},
 		),
-		RequestSize:  prometheus.NewHistogramVec(opts.RequestSize, []string{"endpoint"}),
-		ResponseSize: prometheus.NewHistogramVec(opts.ResponseSize, []string{"endpoint"}),
+		RequestSize:  prometheus.NewHistogramVec(gaugeOpts.RequestSize, []string{"endpoint"}),
+		ResponseSize: prometheus.NewHistogramVec(gaugeOpts.ResponseSize, []string{"endpoint"}),
+		UpstreamsConnected: prometheus.NewCounterVec(
+			gaugeOpts.UpstreamsConnected,
+			[]string{"endpoint"},
+		),
+		UpstreamsDisconnected: prometheus.NewCounterVec(
+			gaugeOpts.UpstreamsDisconnected,
+			[]string{"endpoint"},
+		),
+		UpstreamsActive: prometheus.NewGaugeVec(
+			gaugeOpts.UpstreamsActive,
+			[]string{"endpoint"},
+		),
+		RedirectsFollowed: prometheus.NewCounterVec(
+			gaugeOpts.RedirectsFollowed,
+			[]string{"endpoint"},
+		),
+		batcher: options.batcher(),
+	}
+	if lm.batcher != nil {
+		lm.batcher.Init(lm.RequestLatency, gaugeOpts.RequestLatency.Buckets)
 	}
+	return lm
 }
 
 func (lm *LabeledMetrics) Register(registry prometheus.Registerer) {
 	registry.MustRegister(
 		lm.RequestsInFlight,
 		lm.RequestsTotal,
-		lm.RequestLatency,
+		latencyCollector(lm.RequestLatency, lm.batcher),
 		lm.RequestSize,
 		lm.ResponseSize,
+		lm.UpstreamsConnected,
+		lm.UpstreamsDisconnected,
+		lm.UpstreamsActive,
+		lm.RedirectsFollowed,
 	)
 }
 
-func NewMetrics(subsystem string) *Metrics {
-	opts := newOptions(subsystem)
-	return &Metrics{
-		RequestsInFlight: prometheus.NewGauge(opts.RequestsInFlight),
-		RequestsTotal: prometheus.NewCounterVec(opts.RequestsTotal,
+// UpstreamConnected records an upstream connection to the endpoint, and
+// returns a function to record the connection disconnecting.
+func (lm *LabeledMetrics) UpstreamConnected(endpointID string) func() {
+	lm.UpstreamsConnected.WithLabelValues(endpointID).Inc()
+	active := lm.UpstreamsActive.WithLabelValues(endpointID)
+	active.Inc()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			lm.UpstreamsDisconnected.WithLabelValues(endpointID).Inc()
+			active.Dec()
+		})
+	}
+}
+
+func NewMetrics(subsystem string, opts ...MetricsOption) *Metrics {
+	options := newMetricsOptions(opts)
+	gaugeOpts := newOptions(subsystem)
+	m := &Metrics{
+		RequestsInFlight: prometheus.NewGauge(gaugeOpts.RequestsInFlight),
+		RequestsTotal: prometheus.NewCounterVec(gaugeOpts.RequestsTotal,
 			[]string{"status", "method"},
 		),
 		RequestLatency: prometheus.NewHistogramVec(
-			opts.RequestLatency,
+			gaugeOpts.RequestLatency,
 			[]string{"status", "method"},
 		),
-		RequestSize:  prometheus.NewHistogram(opts.RequestSize),
-		ResponseSize: prometheus.NewHistogram(opts.ResponseSize),
+		RequestSize:  prometheus.NewHistogram(gaugeOpts.RequestSize),
+		ResponseSize: prometheus.NewHistogram(gaugeOpts.ResponseSize),
+		batcher:      options.batcher(),
+	}
+	if m.batcher != nil {
+		m.batcher.Init(m.RequestLatency, gaugeOpts.RequestLatency.Buckets)
 	}
+	return m
 }
 
 func (m *Metrics) Register(registry prometheus.Registerer) {
 	registry.MustRegister(
 		m.RequestsInFlight,
 		m.RequestsTotal,
-		m.RequestLatency,
+		latencyCollector(m.RequestLatency, m.batcher),
 		m.RequestSize,
 		m.ResponseSize,
 	)
 }
 
+// latencyCollector returns the collector for the latency histogram, which
+// includes any batch histograms.
+func latencyCollector(
+	latency *prometheus.HistogramVec,
+	batcher *batcher,
+) prometheus.Collector {
+	if batcher == nil {
+		return latency
+	}
+	return &batchCollector{
+		Collector: latency,
+		batcher:   batcher,
+	}
+}
+
 type observer struct {
 	RequestsInFlight prometheus.Gauge
-	RequestsTotal    *prometheus.CounterVec
-	RequestLatency   prometheus.ObserverVec
 	RequestSize      prometheus.Observer
 	ResponseSize     prometheus.Observer
+
+	labels *labelCache
 }
 
 func (lm *LabeledMetrics) Handler(endpointID string) gin.HandlerFunc {
 	obs := observer{
 		RequestsInFlight: lm.RequestsInFlight.WithLabelValues(endpointID),
-		RequestsTotal:    lm.RequestsTotal.MustCurryWith(prometheus.Labels{"endpoint": endpointID}),
-		RequestLatency:   lm.RequestLatency.MustCurryWith(prometheus.Labels{"endpoint": endpointID}),
 		RequestSize:      lm.RequestSize.WithLabelValues(endpointID),
 		ResponseSize:     lm.ResponseSize.WithLabelValues(endpointID),
+		labels: newLabelCache(
+			lm.RequestsTotal.MustCurryWith(prometheus.Labels{"endpoint": endpointID}),
+			lm.RequestLatency.MustCurryWith(prometheus.Labels{"endpoint": endpointID}),
+			lm.batcher,
+			endpointID,
+		),
 	}
 	return obs.Handler()
 }
@@ -150,10 +304,9 @@ func (lm *LabeledMetrics) Handler(endpointID string) gin.HandlerFunc {
 func (m *Metrics) Handler() gin.HandlerFunc {
 	obs := observer{
 		RequestsInFlight: m.RequestsInFlight,
-		RequestsTotal:    m.RequestsTotal,
-		RequestLatency:   m.RequestLatency,
 		RequestSize:      m.RequestSize,
 		ResponseSize:     m.ResponseSize,
+		labels:           newLabelCache(m.RequestsTotal, m.RequestLatency, m.batcher),
 	}
 	return obs.Handler()
 }
@@ -168,24 +321,128 @@ func (o observer) Handler() gin.HandlerFunc {
 		// Process request.
 		c.Next()
 
-		o.RequestsTotal.With(prometheus.Labels{
-			"status": strconv.Itoa(c.Writer.Status()),
-			"method": c.Request.Method,
-		}).Inc()
-		o.RequestLatency.With(prometheus.Labels{
-			"status": strconv.Itoa(c.Writer.Status()),
-			"method": c.Request.Method,
-		}).Observe(float64(time.Since(start).Milliseconds()) / 1000)
+		labeled := o.labels.Get(c.Writer.Status(), c.Request.Method)
+		labeled.RequestsTotal.Inc()
+		labeled.RequestLatency.Observe(float64(time.Since(start).Milliseconds()) / 1000)
+
+		// Only record the size of sampled requests. Note always sampled unless
+		// using sampling middleware.
+		if sampled(c) {
+			o.RequestSize.Observe(float64(computeApproximateRequestSize(c.Request)))
+			o.ResponseSize.Observe(float64(c.Writer.Size()))
+		}
+	}
+}
+
+// maxCachedLabels is the maximum number of (status, method) label pairs
+// cached by each handler.
+//
+// Requests normally only have a handful of distinct status codes and methods,
+// though since the method is controlled by the client the cache is bounded.
+// Requests with labels that don't fit in the cache fall back to looking up
+// the labelled metrics directly.
+const maxCachedLabels = 64
+
+type labelKey struct {
+	status int
+	method string
+}
+
+type labeledObservers struct {
+	RequestsTotal  prometheus.Counter
+	RequestLatency prometheus.Observer
+}
+
+// labelCache caches the labelled request counter and latency histogram for
+// each (status, method) pair.
+//
+// Looking up a labelled metric hashes the label values and, when using
+// prometheus.Labels, allocates a map, which is significant overhead on the
+// hot path. Since there are only a few distinct label pairs, these are
+// looked up once then cached.
+//
+// The cache is copy-on-write so lookups never contend on a lock.
+type labelCache struct {
+	requestsTotal  *prometheus.CounterVec
+	requestLatency prometheus.ObserverVec
+
+	// batcher is nil if latency observations aren't batched.
+	batcher *batcher
+	// batchLabels are the label values the request latency vector is curried
+	// with, which prefix the batch histogram label values.
+	batchLabels []string
+
+	entries *atomic.Pointer[map[labelKey]labeledObservers]
+
+	// mu serialises updates to entries.
+	mu sync.Mutex
+}
+
+func newLabelCache(
+	requestsTotal *prometheus.CounterVec,
+	requestLatency prometheus.ObserverVec,
+	batcher *batcher,
+	batchLabels ...string,
+) *labelCache {
+	entries := make(map[labelKey]labeledObservers)
+	return &labelCache{
+		requestsTotal:  requestsTotal,
+		requestLatency: requestLatency,
+		batcher:        batcher,
+		batchLabels:    batchLabels,
+		entries:        atomic.NewPointer(&entries),
+	}
+}
+
+// Get returns the labelled observers for the given status and method.
+func (c *labelCache) Get(status int, method string) labeledObservers {
+	key := labelKey{status: status, method: method}
+	if o, ok := (*c.entries.Load())[key]; ok {
+		return o
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := *c.entries.Load()
+	if cached, ok := entries[key]; ok {
+		return cached
+	}
+
+	statusLabel := strconv.Itoa(status)
+	o := labeledObservers{
+		RequestsTotal: c.requestsTotal.WithLabelValues(statusLabel, method),
+	}
+	if len(entries) >= maxCachedLabels {
+		o.RequestLatency = c.requestLatency.WithLabelValues(statusLabel, method)
+		return o
+	}
+
+	// Only batch cached observers, since batch histograms are never
+	// released. As the cache is never evicted, labels are either always
+	// batched or never batched, so a series is never collected from both the
+	// batch histograms and the histogram vector.
+	if c.batcher != nil {
+		labelValues := append(append([]string{}, c.batchLabels...), statusLabel, method)
+		o.RequestLatency = c.batcher.Histogram(labelValues...)
+	} else {
+		o.RequestLatency = c.requestLatency.WithLabelValues(statusLabel, method)
+	}
 
-		o.RequestSize.Observe(float64(computeApproximateRequestSize(c.Request)))
-		o.ResponseSize.Observe(float64(c.Writer.Size()))
+	updated := make(map[labelKey]labeledObservers, len(entries)+1)
+	for k, v := range entries {
+		updated[k] = v
 	}
+	updated[key] = o
+	c.entries.Store(&updated)
+
+	return o
 }
 
 func computeApproximateRequestSize(r *http.Request) int {
 	s := 0
 	if r.URL != nil {
-		s += len(r.URL.String())
+		s += approximateURLSize(r.URL)
 	}
 
 	s += len(r.Method)
@@ -203,3 +460,22 @@ func computeApproximateRequestSize(r *http.Request) int {
 	}
 	return s
 }
+
+// approximateURLSize returns the approximate size of the URL without
+// allocating (unlike url.URL.String).
+func approximateURLSize(u *url.URL) int {
+	s := 0
+	if u.Scheme != "" {
+		s += len(u.Scheme) + len("://")
+	}
+	s += len(u.Host)
+	if u.RawPath != "" {
+		s += len(u.RawPath)
+	} else {
+		s += len(u.Path)
+	}
+	if u.RawQuery != "" {
+		s += len("?") + len(u.RawQuery)
+	}
+	return s
+}
@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// counterValue returns the value of the counter with the given name and
+// labels in the registry.
+func counterValue(
+	t *testing.T,
+	registry *prometheus.Registry,
+	name string,
+	labels map[string]string,
+) float64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			matches := 0
+			for _, label := range m.GetLabel() {
+				if labels[label.GetName()] == label.GetValue() {
+					matches++
+				}
+			}
+			if matches == len(labels) {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestLabeledMetrics_Handler(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewLabeledMetrics("test")
+	metrics.Register(registry)
+
+	router := gin.New()
+	router.Use(metrics.Handler("my-endpoint"))
+	router.GET("/:status", func(c *gin.Context) {
+		status, _ := strconv.Atoi(c.Param("status"))
+		c.Status(status)
+	})
+
+	for i := 0; i != 3; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/200", nil))
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/404", nil))
+
+	assert.Equal(t, float64(3), counterValue(
+		t, registry, "piko_test_requests_total", map[string]string{
+			"endpoint": "my-endpoint",
+			"status":   "200",
+			"method":   "GET",
+		},
+	))
+	assert.Equal(t, float64(1), counterValue(
+		t, registry, "piko_test_requests_total", map[string]string{
+			"endpoint": "my-endpoint",
+			"status":   "404",
+			"method":   "GET",
+		},
+	))
+}
+
+// Tests requests are still recorded once the label cache is full.
+func TestLabelCache_Full(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics("test")
+	metrics.Register(registry)
+
+	cache := newLabelCache(metrics.RequestsTotal, metrics.RequestLatency, nil)
+	for i := 0; i != maxCachedLabels*2; i++ {
+		cache.Get(200, "METHOD"+strconv.Itoa(i)).RequestsTotal.Inc()
+	}
+	assert.Len(t, *cache.entries.Load(), maxCachedLabels)
+
+	cache.Get(200, "METHOD"+strconv.Itoa(maxCachedLabels*2-1)).RequestsTotal.Inc()
+	assert.Equal(t, float64(2), counterValue(
+		t, registry, "piko_test_requests_total", map[string]string{
+			"status": "200",
+			"method": "METHOD" + strconv.Itoa(maxCachedLabels*2-1),
+		},
+	))
+}
+
+func BenchmarkMetrics_Handler(b *testing.B) {
+	metrics := NewMetrics("bench")
+
+	router := gin.New()
+	router.Use(metrics.Handler())
+	router.GET("/foo", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/foo?bar=car", nil)
+	w := httptest.NewRecorder()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		router.ServeHTTP(w, r)
+	}
+}
+
+func BenchmarkLabeledMetrics_Handler(b *testing.B) {
+	metrics := NewLabeledMetrics("bench")
+
+	router := gin.New()
+	router.Use(metrics.Handler("my-endpoint"))
+	router.GET("/foo", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/foo?bar=car", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		w := httptest.NewRecorder()
+		for pb.Next() {
+			router.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,242 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	RouteContextKey = "_piko_route"
+
+	// UnmatchedRouteLabel is the route label of requests that don't match
+	// any route.
+	UnmatchedRouteLabel = "_unmatched"
+)
+
+// RouteClassifier classifies requests into a bounded set of routes, such as
+// '/users/{id}' for all requests to a user, so routes can be used to label
+// metrics without exploding cardinality like raw URL paths.
+type RouteClassifier interface {
+	// Route returns the route of the request, or false if the request
+	// doesn't match any route.
+	Route(r *http.Request) (string, bool)
+}
+
+// RouteRule classifies requests whose path matches either the template or
+// regex.
+type RouteRule struct {
+	// Route is the route of matching requests. Defaults to the template.
+	Route string
+
+	// Template matches paths by segment, where a segment in braces, such as
+	// '{id}', matches any segment, and a final '*' segment matches any
+	// remaining segments.
+	Template string
+
+	// Regex matches paths using a regular expression.
+	Regex string
+}
+
+type pathRule struct {
+	route string
+
+	// segments is nil if the rule uses a regex.
+	segments []string
+	regex    *regexp.Regexp
+}
+
+func (r *pathRule) match(path string) bool {
+	if r.regex != nil {
+		return r.regex.MatchString(path)
+	}
+
+	segments := splitPath(path)
+	for i, segment := range r.segments {
+		if segment == "*" {
+			return true
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if isParam(segment) {
+			if segments[i] == "" {
+				return false
+			}
+			continue
+		}
+		if segment != segments[i] {
+			return false
+		}
+	}
+	return len(segments) == len(r.segments)
+}
+
+// PathClassifier is a [RouteClassifier] that classifies requests by path
+// using the first matching rule.
+type PathClassifier struct {
+	rules []*pathRule
+}
+
+func NewPathClassifier(rules []RouteRule) (*PathClassifier, error) {
+	c := &PathClassifier{}
+	for i, rule := range rules {
+		compiled, err := compileRouteRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		c.rules = append(c.rules, compiled)
+	}
+	return c, nil
+}
+
+func (c *PathClassifier) Route(r *http.Request) (string, bool) {
+	for _, rule := range c.rules {
+		if rule.match(r.URL.Path) {
+			return rule.route, true
+		}
+	}
+	return "", false
+}
+
+func compileRouteRule(rule RouteRule) (*pathRule, error) {
+	if (rule.Template == "") == (rule.Regex == "") {
+		return nil, fmt.Errorf("must have either a template or regex")
+	}
+
+	if rule.Regex != "" {
+		if rule.Route == "" {
+			return nil, fmt.Errorf("missing route")
+		}
+		regex, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+		return &pathRule{
+			route: rule.Route,
+			regex: regex,
+		}, nil
+	}
+
+	if !strings.HasPrefix(rule.Template, "/") {
+		return nil, fmt.Errorf("template must start with '/'")
+	}
+	segments := splitPath(rule.Template)
+	for i, segment := range segments {
+		if segment == "*" && i != len(segments)-1 {
+			return nil, fmt.Errorf("'*' must be the last segment")
+		}
+		if strings.ContainsAny(segment, "{}") && !isParam(segment) {
+			return nil, fmt.Errorf("invalid segment: %s", segment)
+		}
+	}
+	route := rule.Route
+	if route == "" {
+		route = rule.Template
+	}
+	return &pathRule{
+		route:    route,
+		segments: segments,
+	}, nil
+}
+
+// splitPath splits the path into segments, ignoring leading and trailing
+// slashes.
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func isParam(segment string) bool {
+	return len(segment) > 2 &&
+		strings.HasPrefix(segment, "{") &&
+		strings.HasSuffix(segment, "}") &&
+		!strings.ContainsAny(segment[1:len(segment)-1], "{}")
+}
+
+// NewRoute creates middleware that adds the route of the request to the
+// context, so it can be used to tag logs and metrics.
+func NewRoute(classifier RouteClassifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if route, ok := classifier.Route(c.Request); ok {
+			c.Set(RouteContextKey, route)
+		}
+		c.Next()
+	}
+}
+
+// Route returns the route of the request, or an empty string if the request
+// doesn't match any route.
+func Route(c *gin.Context) string {
+	return c.GetString(RouteContextKey)
+}
+
+// RouteMetrics records per-route request metrics.
+//
+// Requests that don't match a route are labelled UnmatchedRouteLabel, so
+// cardinality is bounded by the number of configured routes.
+type RouteMetrics struct {
+	RequestsTotal  *prometheus.CounterVec
+	RequestLatency *prometheus.HistogramVec
+}
+
+func NewRouteMetrics(subsystem string) *RouteMetrics {
+	return &RouteMetrics{
+		RequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: subsystem,
+				Name:      "route_requests_total",
+				Help:      "Total requests by route.",
+			},
+			[]string{"route", "status", "method"},
+		),
+		RequestLatency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "piko",
+				Subsystem: subsystem,
+				Name:      "route_request_latency_seconds",
+				Help:      "Request latency by route.",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"route"},
+		),
+	}
+}
+
+func (m *RouteMetrics) Register(registry prometheus.Registerer) {
+	registry.MustRegister(
+		m.RequestsTotal,
+		m.RequestLatency,
+	)
+}
+
+// Handler returns middleware that records the route metrics. Must be added
+// after the route middleware (see NewRoute).
+func (m *RouteMetrics) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		route := Route(c)
+		if route == "" {
+			route = UnmatchedRouteLabel
+		}
+		m.RequestsTotal.WithLabelValues(
+			route, strconv.Itoa(c.Writer.Status()), c.Request.Method,
+		).Inc()
+		m.RequestLatency.WithLabelValues(route).Observe(
+			float64(time.Since(start).Milliseconds()) / 1000,
+		)
+	}
+}
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathClassifier(t *testing.T) {
+	classifier, err := NewPathClassifier([]RouteRule{
+		{Template: "/users/{id}"},
+		{Template: "/users/{id}/orders/{order}", Route: "order"},
+		{Template: "/static/*"},
+		{Regex: `^/v[0-9]+/health$`, Route: "health"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		path  string
+		route string
+	}{
+		{"/users/123", "/users/{id}"},
+		{"/users/123/", "/users/{id}"},
+		{"/users/123/orders/456", "order"},
+		{"/static/css/main.css", "/static/*"},
+		{"/static", "/static/*"},
+		{"/v2/health", "health"},
+		{"/users", ""},
+		{"/users/123/orders", ""},
+		{"/foo", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			route, ok := classifier.Route(httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.route != "", ok)
+			assert.Equal(t, tt.route, route)
+		})
+	}
+}
+
+func TestPathClassifier_Invalid(t *testing.T) {
+	tests := []struct {
+		rule RouteRule
+		err  string
+	}{
+		{RouteRule{}, "rule 0: must have either a template or regex"},
+		{RouteRule{Template: "/a", Regex: "a"}, "rule 0: must have either a template or regex"},
+		{RouteRule{Template: "users"}, "rule 0: template must start with '/'"},
+		{RouteRule{Template: "/*/users"}, "rule 0: '*' must be the last segment"},
+		{RouteRule{Template: "/users/{id"}, "rule 0: invalid segment: {id"},
+		{RouteRule{Regex: "/users"}, "rule 0: missing route"},
+	}
+	for _, tt := range tests {
+		_, err := NewPathClassifier([]RouteRule{tt.rule})
+		assert.EqualError(t, err, tt.err)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	classifier, err := NewPathClassifier([]RouteRule{
+		{Template: "/users/{id}"},
+	})
+	require.NoError(t, err)
+
+	registry := prometheus.NewRegistry()
+	metrics := NewRouteMetrics("test")
+	metrics.Register(registry)
+
+	router := gin.New()
+	router.Use(NewRoute(classifier))
+	router.Use(metrics.Handler())
+
+	var route string
+	router.NoRoute(func(c *gin.Context) {
+		route = Route(c)
+		c.String(http.StatusOK, "foo")
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/1", nil))
+	assert.Equal(t, "/users/{id}", route)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/2", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/foo", nil))
+	assert.Equal(t, "", route)
+
+	requestsTotal := func(route string) float64 {
+		return counterValue(t, registry, "piko_test_route_requests_total", map[string]string{
+			"route":  route,
+			"status": "200",
+			"method": "GET",
+		})
+	}
+	assert.Equal(t, 2.0, requestsTotal("/users/{id}"))
+	assert.Equal(t, 1.0, requestsTotal(UnmatchedRouteLabel))
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"math/rand/v2"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SampledContextKey = "_piko_sampled"
+)
+
+// Sampler makes head-based sampling decisions, where 1 in every 'rate'
+// requests is sampled.
+//
+// Sampled requests are included in the access log and size metrics, so
+// endpoints with very high request rates don't pay the full observability
+// overhead. Note request counts and latencies are always recorded.
+type Sampler struct {
+	rate int
+}
+
+// NewSampler creates a sampler that samples 1 in every 'rate' requests. If
+// the rate is zero or one, all requests are sampled.
+func NewSampler(rate int) *Sampler {
+	return &Sampler{
+		rate: rate,
+	}
+}
+
+// Sample returns whether the next request should be sampled.
+func (s *Sampler) Sample() bool {
+	if s == nil || s.rate <= 1 {
+		return true
+	}
+	// Use a random decision rather than a shared counter to avoid
+	// contention.
+	return rand.IntN(s.rate) == 0
+}
+
+// NewSampling creates middleware that makes a sampling decision for each
+// request using the sampler returned by 'sampler', and adds the decision to
+// the context.
+//
+// This must be registered before the logging and metrics middleware.
+func NewSampling(sampler func(c *gin.Context) *Sampler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(SampledContextKey, sampler(c).Sample())
+		c.Next()
+	}
+}
+
+// sampled returns whether the request was sampled.
+//
+// Requests are sampled if the sampling middleware sampled the request, if
+// there is no sampling middleware, or if the request failed with a server
+// error.
+func sampled(c *gin.Context) bool {
+	if c.Writer.Status() >= http.StatusInternalServerError {
+		return true
+	}
+	v, ok := c.Get(SampledContextKey)
+	if !ok {
+		return true
+	}
+	return v.(bool)
+}
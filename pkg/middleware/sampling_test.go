@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampler(t *testing.T) {
+	t.Run("sample all", func(t *testing.T) {
+		for _, rate := range []int{0, 1} {
+			sampler := NewSampler(rate)
+			for i := 0; i != 100; i++ {
+				assert.True(t, sampler.Sample())
+			}
+		}
+	})
+
+	t.Run("sample rate", func(t *testing.T) {
+		sampler := NewSampler(10)
+
+		sampled := 0
+		for i := 0; i != 10000; i++ {
+			if sampler.Sample() {
+				sampled++
+			}
+		}
+		// Allow a wide margin as sampling is random.
+		assert.Greater(t, sampled, 500)
+		assert.Less(t, sampled, 1500)
+	})
+}
+
+// Tests the metrics middleware only records request and response sizes for
+// sampled requests, though always records server errors.
+func TestSampling_Metrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics("test")
+	metrics.Register(registry)
+
+	neverSampled := &Sampler{rate: 1 << 30}
+
+	router := gin.New()
+	router.Use(NewSampling(func(_ *gin.Context) *Sampler {
+		return neverSampled
+	}))
+	router.Use(metrics.Handler())
+	router.GET("/:status", func(c *gin.Context) {
+		status, _ := strconv.Atoi(c.Param("status"))
+		c.Status(status)
+	})
+
+	for i := 0; i != 5; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/200", nil))
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/500", nil))
+
+	assert.Equal(t, float64(5), counterValue(
+		t, registry, "piko_test_requests_total", map[string]string{"status": "200"},
+	))
+	assert.Equal(t, float64(1), counterValue(
+		t, registry, "piko_test_requests_total", map[string]string{"status": "500"},
+	))
+	// Only the server error should be sampled.
+	assert.Equal(t, uint64(1), histogramCount(t, registry, "piko_test_request_size_bytes"))
+	assert.Equal(t, uint64(1), histogramCount(t, registry, "piko_test_response_size_bytes"))
+}
@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/andydunstall/piko/pkg/auth"
+)
+
+const (
+	TenantContextKey = "_piko_tenant"
+
+	// NoTenantLabel is the tenant label of requests that don't belong to a
+	// tenant.
+	NoTenantLabel = "_none"
+	// OverflowTenantLabel is the tenant label of requests whose tenant
+	// exceeds the tenant metrics cardinality limit.
+	OverflowTenantLabel = "_overflow"
+)
+
+// NewTenant creates middleware that adds the tenant of the authenticated
+// token to the context, so it can be used to tag logs and metrics.
+//
+// Must be added after the auth middleware. Requests that aren't
+// authenticated, or whose token doesn't include a tenant, have no tenant.
+func NewTenant() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token, ok := c.Get(TokenContextKey); ok {
+			if tenant := token.(*auth.Token).Tenant; tenant != "" {
+				c.Set(TenantContextKey, tenant)
+			}
+		}
+		c.Next()
+	}
+}
+
+// Tenant returns the tenant of the request, or an empty string if the
+// request doesn't belong to a tenant.
+func Tenant(c *gin.Context) string {
+	return c.GetString(TenantContextKey)
+}
+
+// TenantMetrics records per-tenant request metrics, such as for per-tenant
+// dashboards and billing.
+//
+// Unlike the request size histograms, request and response bytes are always
+// recorded regardless of sampling, so can be used for billing.
+//
+// To bound cardinality, at most 'maxTenants' distinct tenants are labelled.
+// Requests from any additional tenants are labelled OverflowTenantLabel.
+type TenantMetrics struct {
+	RequestsTotal      *prometheus.CounterVec
+	RequestBytesTotal  *prometheus.CounterVec
+	ResponseBytesTotal *prometheus.CounterVec
+
+	maxTenants int
+	tenants    map[string]struct{}
+
+	mu sync.Mutex
+}
+
+func NewTenantMetrics(subsystem string, maxTenants int) *TenantMetrics {
+	return &TenantMetrics{
+		RequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: subsystem,
+				Name:      "tenant_requests_total",
+				Help:      "Total requests by tenant.",
+			},
+			[]string{"tenant", "status"},
+		),
+		RequestBytesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: subsystem,
+				Name:      "tenant_request_bytes_total",
+				Help:      "Total approximate request bytes by tenant.",
+			},
+			[]string{"tenant"},
+		),
+		ResponseBytesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: subsystem,
+				Name:      "tenant_response_bytes_total",
+				Help:      "Total response bytes by tenant.",
+			},
+			[]string{"tenant"},
+		),
+		maxTenants: maxTenants,
+		tenants:    make(map[string]struct{}),
+	}
+}
+
+func (m *TenantMetrics) Register(registry prometheus.Registerer) {
+	registry.MustRegister(
+		m.RequestsTotal,
+		m.RequestBytesTotal,
+		m.ResponseBytesTotal,
+	)
+}
+
+// Handler returns middleware that records the tenant metrics. Must be added
+// after the tenant middleware (see NewTenant).
+func (m *TenantMetrics) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		tenant := m.label(Tenant(c))
+		m.RequestsTotal.WithLabelValues(
+			tenant, strconv.Itoa(c.Writer.Status()),
+		).Inc()
+		m.RequestBytesTotal.WithLabelValues(tenant).Add(
+			float64(computeApproximateRequestSize(c.Request)),
+		)
+		if size := c.Writer.Size(); size > 0 {
+			m.ResponseBytesTotal.WithLabelValues(tenant).Add(float64(size))
+		}
+	}
+}
+
+// label returns the metrics label for the tenant.
+func (m *TenantMetrics) label(tenant string) string {
+	if tenant == "" {
+		return NoTenantLabel
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tenants[tenant]; ok {
+		return tenant
+	}
+	if len(m.tenants) >= m.maxTenants {
+		return OverflowTenantLabel
+	}
+	m.tenants[tenant] = struct{}{}
+	return tenant
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/pkg/auth"
+)
+
+func TestTenant(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewTenantMetrics("test", 2)
+	metrics.Register(registry)
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		// Mock the auth middleware.
+		if tenant := c.GetHeader("x-tenant"); tenant != "" {
+			c.Set(TokenContextKey, &auth.Token{Tenant: tenant})
+		}
+	})
+	router.Use(NewTenant())
+	router.Use(metrics.Handler())
+
+	var tenant string
+	router.GET("/", func(c *gin.Context) {
+		tenant = Tenant(c)
+		c.String(http.StatusOK, "foo")
+	})
+
+	request := func(tenantHeader string) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tenantHeader != "" {
+			req.Header.Set("x-tenant", tenantHeader)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	request("a")
+	assert.Equal(t, "a", tenant)
+	request("a")
+	request("b")
+	// Exceeds the tenant limit.
+	request("c")
+	assert.Equal(t, "c", tenant)
+	request("")
+	assert.Equal(t, "", tenant)
+
+	requestsTotal := func(tenant string) float64 {
+		return counterValue(t, registry, "piko_test_tenant_requests_total", map[string]string{
+			"tenant": tenant,
+			"status": "200",
+		})
+	}
+	assert.Equal(t, 2.0, requestsTotal("a"))
+	assert.Equal(t, 1.0, requestsTotal("b"))
+	assert.Equal(t, 0.0, requestsTotal("c"))
+	assert.Equal(t, 1.0, requestsTotal(OverflowTenantLabel))
+	assert.Equal(t, 1.0, requestsTotal(NoTenantLabel))
+
+	assert.Equal(t, 6.0, counterValue(
+		t, registry, "piko_test_tenant_response_bytes_total",
+		map[string]string{"tenant": "a"},
+	))
+	assert.Less(t, 0.0, counterValue(
+		t, registry, "piko_test_tenant_request_bytes_total",
+		map[string]string{"tenant": "a"},
+	))
+}
@@ -0,0 +1,18 @@
+package middleware
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// IsUpgrade returns whether the request asks to upgrade the connection to
+// another protocol, such as 'websocket' or 'spdy/3.1' used by 'kubectl exec'.
+//
+// Once the upstream responds with '101 Switching Protocols', the connection
+// is copied in both directions until either side closes, so upgraded
+// requests must not be bound by the request timeout.
+func IsUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" &&
+		httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade")
+}
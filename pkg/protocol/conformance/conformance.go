@@ -0,0 +1,283 @@
+// Package conformance contains a test suite to validate agents implement the
+// Piko upstream wire protocol (see package protocol).
+//
+// The suite runs a minimal Piko server that the agent connects to, and an
+// upstream HTTP service the agent forwards connections to. It then sends
+// requests to the agent over the multiplexed connection and verifies the
+// responses.
+//
+// Agents in other languages can be run with [CommandAgent], such as:
+//
+//	PIKO_CONFORMANCE_AGENT="./my-agent" go test ./pkg/protocol/conformance
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/yamux"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/protocol"
+	pikowebsocket "github.com/andydunstall/piko/pkg/websocket"
+)
+
+const (
+	endpointID = "conformance"
+	token      = "conformance-token"
+
+	// connectTimeout is the time the agent has to connect to the server.
+	connectTimeout = time.Second * 10
+)
+
+// AgentConfig is the configuration for the agent under test.
+type AgentConfig struct {
+	// URL is the URL of the Piko server upstream port.
+	URL string
+
+	// EndpointID is the endpoint the agent must listen on.
+	EndpointID string
+
+	// Token is the token the agent must authenticate with.
+	Token string
+
+	// UpstreamAddr is the address of the upstream service the agent must
+	// forward connections to.
+	UpstreamAddr string
+}
+
+// Agent starts the agent under test with the given configuration. The agent
+// must be stopped when the test completes, such as using [testing.T.Cleanup].
+type Agent func(t *testing.T, conf AgentConfig)
+
+// CommandAgent runs the agent as the given command.
+//
+// The configuration is passed in the environment variables
+// 'PIKO_CONFORMANCE_URL', 'PIKO_CONFORMANCE_ENDPOINT_ID',
+// 'PIKO_CONFORMANCE_TOKEN' and 'PIKO_CONFORMANCE_UPSTREAM_ADDR'.
+func CommandAgent(name string, args ...string) Agent {
+	return func(t *testing.T, conf AgentConfig) {
+		cmd := exec.Command(name, args...)
+		cmd.Env = append(
+			os.Environ(),
+			"PIKO_CONFORMANCE_URL="+conf.URL,
+			"PIKO_CONFORMANCE_ENDPOINT_ID="+conf.EndpointID,
+			"PIKO_CONFORMANCE_TOKEN="+conf.Token,
+			"PIKO_CONFORMANCE_UPSTREAM_ADDR="+conf.UpstreamAddr,
+		)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		require.NoError(t, cmd.Start())
+
+		t.Cleanup(func() {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		})
+	}
+}
+
+// Run runs the conformance suite against the given agent.
+func Run(t *testing.T, agent Agent) {
+	upstream := httptest.NewServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+
+	server := newServer(t)
+
+	agent(t, AgentConfig{
+		URL:          server.URL(),
+		EndpointID:   endpointID,
+		Token:        token,
+		UpstreamAddr: upstream.Listener.Addr().String(),
+	})
+
+	sess := server.WaitForSession(t)
+
+	t.Run("request", func(t *testing.T) {
+		resp, body, err := request(sess, http.MethodGet, "/foo/bar?a=b", nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "/foo/bar", resp.Header.Get("x-echo-path"))
+		assert.Empty(t, body)
+	})
+
+	t.Run("concurrent streams", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i != 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				reqBody := []byte(fmt.Sprintf("request-%d", i))
+				resp, body, err := request(sess, http.MethodPost, "/", reqBody)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, reqBody, body)
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	t.Run("flow control", func(t *testing.T) {
+		// Send a body larger than the stream window, so the agent must send
+		// window updates.
+		reqBody := make([]byte, protocol.InitialStreamWindow*4)
+		_, err := rand.Read(reqBody)
+		require.NoError(t, err)
+
+		resp, body, err := request(sess, http.MethodPost, "/", reqBody)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.True(t, bytes.Equal(reqBody, body))
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		_, err := sess.Ping()
+		assert.NoError(t, err)
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+		// The agent must reconnect when the server closes the session.
+		assert.NoError(t, sess.GoAway())
+		assert.NoError(t, sess.Close())
+
+		sess = server.WaitForSession(t)
+
+		resp, _, err := request(sess, http.MethodGet, "/", nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
+
+// echoHandler responds with the request body and path.
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("x-echo-path", r.URL.Path)
+	// nolint
+	io.Copy(w, r.Body)
+}
+
+// request sends a HTTP request to the agent on a new stream.
+func request(
+	sess *yamux.Session, method string, path string, body []byte,
+) (*http.Response, []byte, error) {
+	stream, err := sess.OpenStream()
+	if err != nil {
+		return nil, nil, fmt.Errorf("open stream: %w", err)
+	}
+	defer stream.Close()
+
+	req, err := http.NewRequest(method, "http://"+endpointID+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("request: %w", err)
+	}
+
+	// Write the request in the background, as the upstream may start
+	// responding before the request is fully written.
+	go func() {
+		// nolint
+		req.Write(stream)
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(stream), req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read response: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read body: %w", err)
+	}
+	return resp, respBody, nil
+}
+
+// server is a minimal Piko server that accepts agent connections.
+type server struct {
+	httpServer *httptest.Server
+
+	upgrader *websocket.Upgrader
+
+	sessions chan *yamux.Session
+}
+
+func newServer(t *testing.T) *server {
+	s := &server{
+		upgrader: &websocket.Upgrader{},
+		sessions: make(chan *yamux.Session, 1),
+	}
+	s.httpServer = httptest.NewServer(http.HandlerFunc(s.upstreamRoute))
+	t.Cleanup(s.httpServer.Close)
+	return s
+}
+
+func (s *server) URL() string {
+	return s.httpServer.URL
+}
+
+// WaitForSession waits for the agent to connect.
+func (s *server) WaitForSession(t *testing.T) *yamux.Session {
+	select {
+	case sess := <-s.sessions:
+		return sess
+	case <-time.After(connectTimeout):
+		require.FailNow(t, "agent not connected")
+		return nil
+	}
+}
+
+func (s *server) upstreamRoute(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != protocol.UpstreamPath(endpointID) {
+		errorResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+	authorization := r.Header.Get("Authorization")
+	if strings.TrimPrefix(authorization, "Bearer ") != token {
+		errorResponse(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	wsConn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn := pikowebsocket.New(wsConn)
+	defer conn.Close()
+
+	muxConfig := protocol.MuxConfig()
+	muxConfig.LogOutput = io.Discard
+	sess, err := yamux.Server(conn, muxConfig)
+	if err != nil {
+		return
+	}
+	defer sess.Close()
+
+	select {
+	case s.sessions <- sess:
+	case <-r.Context().Done():
+		return
+	}
+
+	<-sess.CloseChan()
+}
+
+func errorResponse(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	// nolint
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
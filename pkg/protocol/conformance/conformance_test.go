@@ -0,0 +1,45 @@
+package conformance
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/client"
+)
+
+func goAgent(t *testing.T, conf AgentConfig) {
+	u, err := url.Parse(conf.URL)
+	require.NoError(t, err)
+
+	upstream := &client.Upstream{
+		URL:   u,
+		Token: conf.Token,
+	}
+	forwarder, err := upstream.ListenAndForward(
+		context.Background(), conf.EndpointID, conf.UpstreamAddr,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		forwarder.Close()
+	})
+}
+
+func TestConformance(t *testing.T) {
+	t.Run("go agent", func(t *testing.T) {
+		Run(t, goAgent)
+	})
+
+	// Runs the suite against an external agent, such as an agent
+	// implemented in another language.
+	t.Run("command agent", func(t *testing.T) {
+		command := os.Getenv("PIKO_CONFORMANCE_AGENT")
+		if command == "" {
+			t.Skip("PIKO_CONFORMANCE_AGENT not set")
+		}
+		Run(t, CommandAgent("sh", "-c", command))
+	})
+}
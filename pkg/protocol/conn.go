@@ -0,0 +1,326 @@
+package protocol
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxQueuedDataBytes is the maximum number of bytes of queued data frames
+	// before writes block.
+	maxQueuedDataBytes = InitialStreamWindow
+
+	// maxCoalesceBytes is the maximum number of bytes of frames to coalesce
+	// into a single write.
+	maxCoalesceBytes = 64 * 1024
+)
+
+type connOptions struct {
+	controlFrameLatency prometheus.Observer
+	coalesceDelay       time.Duration
+}
+
+type ConnOption interface {
+	apply(*connOptions)
+}
+
+type controlFrameLatencyOption struct {
+	Observer prometheus.Observer
+}
+
+func (o controlFrameLatencyOption) apply(opts *connOptions) {
+	opts.controlFrameLatency = o.Observer
+}
+
+// WithControlFrameLatency records the duration control frames are queued
+// before being written, in seconds.
+func WithControlFrameLatency(observer prometheus.Observer) ConnOption {
+	return controlFrameLatencyOption{Observer: observer}
+}
+
+type coalesceDelayOption time.Duration
+
+func (o coalesceDelayOption) apply(opts *connOptions) {
+	opts.coalesceDelay = time.Duration(o)
+}
+
+// WithCoalesceDelay configures the duration to wait for more frames before
+// writing small data frames, so frames from chatty streams are coalesced into
+// a single write.
+//
+// Zero only coalesces frames that are already queued, which adds no latency.
+func WithCoalesceDelay(delay time.Duration) ConnOption {
+	return coalesceDelayOption(delay)
+}
+
+type queuedFrame struct {
+	b        []byte
+	queuedAt time.Time
+}
+
+// MuxConn wraps the connection carrying a yamux session, to write control
+// frames ahead of queued data frames.
+//
+// The yamux session writes frames in the order they are sent, so pings and
+// window updates can be stuck behind large data frames from bulk transfers
+// on other streams. Instead MuxConn queues the frames written by the
+// session, and a background writer always writes queued control frames
+// before data frames.
+//
+// Control frames are pings, go aways and window updates that don't close or
+// reset a stream. All other frames are written in the order they were
+// written by the session, so each stream's frames are never reordered.
+//
+// Writes block once the queued data frames exceed [InitialStreamWindow]
+// bytes. Since the session writes frames one at a time, a control frame
+// waits at most for the frames already queued ahead of it.
+//
+// The writer coalesces queued frames into a single write to the underlying
+// connection, up to 64KB, which for a WebSocket connection means a single
+// message (and TLS record) rather than one per frame. If configured with
+// [WithCoalesceDelay], when only a few small data frames are queued, the
+// writer waits for the delay for more frames before writing.
+type MuxConn struct {
+	net.Conn
+
+	// header contains the partially written header of the current frame.
+	header  []byte
+	current *queuedFrame
+	// remaining is the number of payload bytes remaining in the current
+	// frame.
+	remaining int
+	control   bool
+
+	controlFrames []*queuedFrame
+	dataFrames    []*queuedFrame
+	dataBytes     int
+
+	err    error
+	closed bool
+	mu     sync.Mutex
+	cond   *sync.Cond
+
+	controlFrameLatency prometheus.Observer
+	coalesceDelay       time.Duration
+}
+
+func NewMuxConn(conn net.Conn, opts ...ConnOption) *MuxConn {
+	options := connOptions{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
+	c := &MuxConn{
+		Conn:                conn,
+		header:              make([]byte, 0, HeaderSize),
+		controlFrameLatency: options.controlFrameLatency,
+		coalesceDelay:       options.coalesceDelay,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.writeLoop()
+	return c
+}
+
+// Write queues the yamux frames in b to be written.
+//
+// b may contain any number of frames, including partial frames, though the
+// written bytes must be a valid sequence of frames.
+func (c *MuxConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.writeErrLocked(); err != nil {
+		return 0, err
+	}
+
+	n := len(b)
+	for len(b) > 0 {
+		if c.current == nil {
+			// Read the frame header.
+			needed := HeaderSize - len(c.header)
+			if len(b) < needed {
+				c.header = append(c.header, b...)
+				return n, nil
+			}
+			c.header = append(c.header, b[:needed]...)
+			b = b[needed:]
+
+			hdr, err := DecodeHeader(c.header)
+			if err != nil {
+				c.err = err
+				c.cond.Broadcast()
+				return n - len(b), err
+			}
+
+			c.current = &queuedFrame{
+				b: append([]byte(nil), c.header...),
+			}
+			c.header = c.header[:0]
+			c.remaining = 0
+			if hdr.Type == FrameTypeData {
+				c.remaining = int(hdr.Length)
+			}
+			c.control = isControlFrame(hdr)
+		}
+
+		// Read the frame payload.
+		payload := min(c.remaining, len(b))
+		c.current.b = append(c.current.b, b[:payload]...)
+		c.remaining -= payload
+		b = b[payload:]
+
+		if c.remaining == 0 {
+			if err := c.queueLocked(); err != nil {
+				return n - len(b), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close closes the connection, discarding any queued frames.
+func (c *MuxConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	return c.Conn.Close()
+}
+
+// queueLocked queues the current frame, blocking if too many data bytes are
+// already queued.
+func (c *MuxConn) queueLocked() error {
+	frame := c.current
+	c.current = nil
+
+	if c.control {
+		frame.queuedAt = time.Now()
+		c.controlFrames = append(c.controlFrames, frame)
+		c.cond.Broadcast()
+		return nil
+	}
+
+	for c.dataBytes >= maxQueuedDataBytes {
+		if err := c.writeErrLocked(); err != nil {
+			return err
+		}
+		c.cond.Wait()
+	}
+	if err := c.writeErrLocked(); err != nil {
+		return err
+	}
+
+	frame.queuedAt = time.Now()
+	c.dataFrames = append(c.dataFrames, frame)
+	c.dataBytes += len(frame.b)
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *MuxConn) writeLoop() {
+	var batch [][]byte
+	var buf []byte
+	for {
+		c.mu.Lock()
+		for len(c.controlFrames) == 0 && len(c.dataFrames) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+
+		if c.coalesceDelay > 0 &&
+			len(c.controlFrames) == 0 &&
+			c.dataBytes < maxCoalesceBytes {
+			// Wait for more frames to coalesce. Writers aren't blocked as
+			// the queued data is below the limit.
+			c.mu.Unlock()
+			time.Sleep(c.coalesceDelay)
+			c.mu.Lock()
+			if c.closed {
+				c.mu.Unlock()
+				return
+			}
+		}
+
+		batch = batch[:0]
+		var batchBytes, dataBytes int
+		now := time.Now()
+		for len(c.controlFrames) > 0 {
+			frame := c.controlFrames[0]
+			if batchBytes > 0 && batchBytes+len(frame.b) > maxCoalesceBytes {
+				break
+			}
+			c.controlFrames[0] = nil
+			c.controlFrames = c.controlFrames[1:]
+			batch = append(batch, frame.b)
+			batchBytes += len(frame.b)
+
+			if c.controlFrameLatency != nil {
+				c.controlFrameLatency.Observe(now.Sub(frame.queuedAt).Seconds())
+			}
+		}
+		for len(c.dataFrames) > 0 {
+			frame := c.dataFrames[0]
+			if batchBytes > 0 && batchBytes+len(frame.b) > maxCoalesceBytes {
+				break
+			}
+			c.dataFrames[0] = nil
+			c.dataFrames = c.dataFrames[1:]
+			batch = append(batch, frame.b)
+			batchBytes += len(frame.b)
+			dataBytes += len(frame.b)
+		}
+		c.mu.Unlock()
+
+		var err error
+		if len(batch) == 1 {
+			// Avoid copying single frames, which may be large.
+			_, err = c.Conn.Write(batch[0])
+		} else {
+			buf = buf[:0]
+			for _, b := range batch {
+				buf = append(buf, b...)
+			}
+			_, err = c.Conn.Write(buf)
+		}
+		clear(batch)
+
+		c.mu.Lock()
+		c.dataBytes -= dataBytes
+		if err != nil {
+			c.err = err
+		}
+		c.cond.Broadcast()
+		c.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *MuxConn) writeErrLocked() error {
+	if c.closed {
+		return net.ErrClosed
+	}
+	return c.err
+}
+
+// isControlFrame returns whether the frame can be written ahead of queued
+// data frames.
+func isControlFrame(hdr Header) bool {
+	if hdr.Flags&(FlagFIN|FlagRST) != 0 {
+		return false
+	}
+	return hdr.Type == FrameTypeWindowUpdate ||
+		hdr.Type == FrameTypePing ||
+		hdr.Type == FrameTypeGoAway
+}
+
+var _ net.Conn = &MuxConn{}
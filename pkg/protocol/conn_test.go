@@ -0,0 +1,329 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/yamux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodeFrame(hdr Header, payload []byte) []byte {
+	if hdr.Type == FrameTypeData {
+		hdr.Length = uint32(len(payload))
+	}
+	return append(hdr.Encode(), payload...)
+}
+
+// countingConn counts the writes to the underlying connection.
+type countingConn struct {
+	net.Conn
+
+	writes atomic.Int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(b)
+}
+
+// readFrame reads a single frame from r.
+func readFrame(t *testing.T, r io.Reader) (Header, []byte) {
+	b := make([]byte, HeaderSize)
+	_, err := io.ReadFull(r, b)
+	require.NoError(t, err)
+	hdr, err := DecodeHeader(b)
+	require.NoError(t, err)
+
+	if hdr.Type != FrameTypeData {
+		return hdr, nil
+	}
+	payload := make([]byte, hdr.Length)
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+	return hdr, payload
+}
+
+func TestMuxConn(t *testing.T) {
+	t.Run("control frames first", func(t *testing.T) {
+		local, remote := net.Pipe()
+		conn := NewMuxConn(local)
+		defer conn.Close()
+
+		data := bytes.Repeat([]byte("a"), 1024)
+		for i := 0; i != 3; i++ {
+			_, err := conn.Write(encodeFrame(Header{
+				Type:     FrameTypeData,
+				StreamID: 1,
+			}, data))
+			require.NoError(t, err)
+		}
+		_, err := conn.Write(encodeFrame(Header{
+			Type: FrameTypePing,
+		}, nil))
+		require.NoError(t, err)
+
+		// The ping may follow the first data frame if it was already being
+		// written, but must be ahead of the remaining data frames.
+		var types []FrameType
+		for i := 0; i != 4; i++ {
+			hdr, _ := readFrame(t, remote)
+			types = append(types, hdr.Type)
+		}
+		assert.Contains(t, types[:2], FrameTypePing)
+		assert.Equal(t, FrameTypeData, types[3])
+	})
+
+	t.Run("ordered close", func(t *testing.T) {
+		local, remote := net.Pipe()
+		conn := NewMuxConn(local)
+		defer conn.Close()
+
+		for i := 0; i != 3; i++ {
+			_, err := conn.Write(encodeFrame(Header{
+				Type:     FrameTypeData,
+				StreamID: 1,
+			}, []byte("foo")))
+			require.NoError(t, err)
+		}
+		// Window updates that close the stream must stay behind the streams
+		// data.
+		_, err := conn.Write(encodeFrame(Header{
+			Type:     FrameTypeWindowUpdate,
+			Flags:    FlagFIN,
+			StreamID: 1,
+		}, nil))
+		require.NoError(t, err)
+
+		for i := 0; i != 3; i++ {
+			hdr, payload := readFrame(t, remote)
+			assert.Equal(t, FrameTypeData, hdr.Type)
+			assert.Equal(t, []byte("foo"), payload)
+		}
+		hdr, _ := readFrame(t, remote)
+		assert.Equal(t, FrameTypeWindowUpdate, hdr.Type)
+		assert.Equal(t, FlagFIN, hdr.Flags)
+	})
+
+	t.Run("coalesce", func(t *testing.T) {
+		local, remote := net.Pipe()
+		counting := &countingConn{Conn: local}
+		conn := NewMuxConn(counting, WithCoalesceDelay(time.Millisecond*50))
+		defer conn.Close()
+
+		var b []byte
+		for i := 0; i != 5; i++ {
+			frame := encodeFrame(Header{
+				Type:     FrameTypeData,
+				StreamID: 1,
+			}, []byte("foo"))
+			b = append(b, frame...)
+
+			_, err := conn.Write(frame)
+			require.NoError(t, err)
+		}
+
+		received := make([]byte, len(b))
+		_, err := io.ReadFull(remote, received)
+		require.NoError(t, err)
+		assert.Equal(t, b, received)
+
+		// All frames should be queued within the delay so written together.
+		assert.Equal(t, int64(1), counting.writes.Load())
+	})
+
+	t.Run("coalesce control frames first", func(t *testing.T) {
+		local, remote := net.Pipe()
+		conn := NewMuxConn(local, WithCoalesceDelay(time.Millisecond*50))
+		defer conn.Close()
+
+		_, err := conn.Write(encodeFrame(Header{
+			Type:     FrameTypeData,
+			StreamID: 1,
+		}, []byte("foo")))
+		require.NoError(t, err)
+		_, err = conn.Write(encodeFrame(Header{
+			Type: FrameTypePing,
+		}, nil))
+		require.NoError(t, err)
+
+		hdr, _ := readFrame(t, remote)
+		assert.Equal(t, FrameTypePing, hdr.Type)
+		hdr, payload := readFrame(t, remote)
+		assert.Equal(t, FrameTypeData, hdr.Type)
+		assert.Equal(t, []byte("foo"), payload)
+	})
+
+	t.Run("partial writes", func(t *testing.T) {
+		local, remote := net.Pipe()
+		conn := NewMuxConn(local)
+		defer conn.Close()
+
+		var b []byte
+		b = append(b, encodeFrame(Header{
+			Type:     FrameTypeData,
+			Flags:    FlagSYN,
+			StreamID: 1,
+		}, []byte("foo"))...)
+		b = append(b, encodeFrame(Header{
+			Type:     FrameTypeData,
+			StreamID: 1,
+		}, []byte("bar"))...)
+
+		go func() {
+			// Write one byte at a time.
+			for i := range b {
+				if _, err := conn.Write(b[i : i+1]); err != nil {
+					return
+				}
+			}
+		}()
+
+		received := make([]byte, len(b))
+		_, err := io.ReadFull(remote, received)
+		require.NoError(t, err)
+		assert.Equal(t, b, received)
+	})
+
+	t.Run("invalid frame", func(t *testing.T) {
+		local, _ := net.Pipe()
+		conn := NewMuxConn(local)
+		defer conn.Close()
+
+		_, err := conn.Write(make([]byte, HeaderSize))
+		assert.NoError(t, err)
+
+		b := make([]byte, HeaderSize)
+		b[0] = 0xff
+		_, err = conn.Write(b)
+		assert.Error(t, err)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		local, _ := net.Pipe()
+		conn := NewMuxConn(local)
+		conn.Close()
+
+		_, err := conn.Write(encodeFrame(Header{Type: FrameTypePing}, nil))
+		assert.ErrorIs(t, err, net.ErrClosed)
+	})
+
+	t.Run("yamux session", func(t *testing.T) {
+		muxConfig := MuxConfig()
+		muxConfig.LogOutput = io.Discard
+
+		serverConn, agentConn := net.Pipe()
+
+		server, err := yamux.Server(NewMuxConn(serverConn), muxConfig)
+		require.NoError(t, err)
+		defer server.Close()
+		agent, err := yamux.Client(NewMuxConn(agentConn), muxConfig)
+		require.NoError(t, err)
+		defer agent.Close()
+
+		go func() {
+			stream, err := agent.AcceptStream()
+			if err != nil {
+				return
+			}
+			defer stream.Close()
+
+			// nolint
+			io.Copy(stream, stream)
+		}()
+
+		stream, err := server.OpenStream()
+		require.NoError(t, err)
+
+		// Write more than the stream window to require window updates.
+		data := bytes.Repeat([]byte("a"), InitialStreamWindow*4)
+		go func() {
+			// nolint
+			stream.Write(data)
+		}()
+
+		received := make([]byte, len(data))
+		_, err = io.ReadFull(stream, received)
+		require.NoError(t, err)
+		assert.Equal(t, data, received)
+
+		_, err = server.Ping()
+		assert.NoError(t, err)
+	})
+}
+
+// BenchmarkMuxConn_Throughput benchmarks writing small data frames, such as
+// from a chatty protocol, with different coalesce delays.
+//
+// It reports the number of writes to the underlying connection per frame,
+// where each write is a WebSocket message and TLS record.
+func BenchmarkMuxConn_Throughput(b *testing.B) {
+	for _, delay := range []time.Duration{
+		0, time.Microsecond * 100, time.Millisecond,
+	} {
+		b.Run(fmt.Sprintf("delay=%s", delay), func(b *testing.B) {
+			local, remote := net.Pipe()
+			counting := &countingConn{Conn: local}
+			conn := NewMuxConn(counting, WithCoalesceDelay(delay))
+			defer conn.Close()
+
+			go func() {
+				// nolint
+				io.Copy(io.Discard, remote)
+			}()
+
+			frame := encodeFrame(Header{
+				Type:     FrameTypeData,
+				StreamID: 1,
+			}, make([]byte, 64))
+
+			b.SetBytes(int64(len(frame)))
+			b.ResetTimer()
+
+			for i := 0; i != b.N; i++ {
+				if _, err := conn.Write(frame); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportMetric(float64(counting.writes.Load())/float64(b.N), "writes/frame")
+		})
+	}
+}
+
+// BenchmarkMuxConn_Latency benchmarks the latency of writing a single small
+// data frame with different coalesce delays.
+func BenchmarkMuxConn_Latency(b *testing.B) {
+	for _, delay := range []time.Duration{
+		0, time.Microsecond * 100, time.Millisecond,
+	} {
+		b.Run(fmt.Sprintf("delay=%s", delay), func(b *testing.B) {
+			local, remote := net.Pipe()
+			conn := NewMuxConn(local, WithCoalesceDelay(delay))
+			defer conn.Close()
+
+			frame := encodeFrame(Header{
+				Type:     FrameTypeData,
+				StreamID: 1,
+			}, make([]byte, 64))
+			received := make([]byte, len(frame))
+
+			b.ResetTimer()
+
+			for i := 0; i != b.N; i++ {
+				if _, err := conn.Write(frame); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(remote, received); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
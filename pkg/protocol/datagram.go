@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MaxDatagramSize is the maximum size of a datagram carried by a stream,
+// which is the maximum UDP payload size.
+const MaxDatagramSize = 0xffff
+
+// WriteDatagram writes the datagram to w, prefixed by its length as a 2 byte
+// big endian integer.
+func WriteDatagram(w io.Writer, b []byte) error {
+	if len(b) > MaxDatagramSize {
+		return fmt.Errorf("datagram too large: %d", len(b))
+	}
+
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadDatagram reads a datagram written by [WriteDatagram] from r into buf,
+// and returns the datagram size.
+//
+// buf must be at least [MaxDatagramSize] bytes. Returns [io.EOF] if r is
+// closed before a datagram starts, or [io.ErrUnexpectedEOF] if r is closed
+// mid-datagram.
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > len(buf) {
+		return 0, fmt.Errorf("datagram too large: %d", size)
+	}
+	if _, err := io.ReadFull(r, buf[:size]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return size, nil
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatagram(t *testing.T) {
+	var stream bytes.Buffer
+	require.NoError(t, WriteDatagram(&stream, []byte("foo")))
+	require.NoError(t, WriteDatagram(&stream, nil))
+	require.NoError(t, WriteDatagram(&stream, bytes.Repeat([]byte("a"), MaxDatagramSize)))
+
+	buf := make([]byte, MaxDatagramSize)
+	n, err := ReadDatagram(&stream, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "foo", string(buf[:n]))
+
+	n, err = ReadDatagram(&stream, buf)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = ReadDatagram(&stream, buf)
+	require.NoError(t, err)
+	assert.Equal(t, MaxDatagramSize, n)
+
+	_, err = ReadDatagram(&stream, buf)
+	assert.ErrorIs(t, err, io.EOF)
+
+	assert.Error(t, WriteDatagram(&stream, make([]byte, MaxDatagramSize+1)))
+
+	// Closed mid-datagram.
+	_, err = ReadDatagram(bytes.NewReader([]byte{0, 3, 'f'}), buf)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,131 @@
+// Package protocol describes the wire protocol used by upstream agents to
+// connect to the Piko server, so agents can be implemented in languages
+// other than Go.
+//
+// # Handshake
+//
+// An agent listens on an endpoint by opening a WebSocket connection to the
+// server 'upstream' port at path '/piko/v1/upstream/<endpoint ID>' (see
+// [UpstreamPath]). If the server requires authentication, the agent includes
+// its token in the 'Authorization: Bearer <token>' header.
+//
+// Piko header names start with the 'x-piko-' prefix by default (see
+// [Headers]), though the prefix is configurable, so the server and agents
+// must use the same prefix.
+//
+// The agent may include a random session ID in the 'x-piko-session-id'
+// header (see [Headers.SessionID]), of up to [MaxSessionIDLength] bytes,
+// which must be the same each time the agent reconnects to listen on the
+// endpoint. If the agent reconnects within the server's session grace period,
+// it resumes its existing registration rather than re-registering, and
+// requests to the endpoint while the agent was disconnected are sent to the
+// new connection.
+//
+// The agent may include the maximum number of concurrent streams it accepts
+// on the connection in the 'x-piko-max-streams' header (see
+// [Headers.MaxStreams]). The server uses the lower of the agent's limit and
+// its own configured limit, and once the connection reaches the limit, sends
+// new streams to the endpoint's other connections, or queues them until a
+// stream closes.
+//
+// The agent may include the maximum size of the WebSocket messages it writes
+// in bytes in the 'x-piko-max-message-size' header (see
+// [Headers.MaxMessageSize]), between 1KB and 64KB. The server splits its own
+// writes into messages of at most the same size. Agents reduce the message
+// size on networks that drop large packets, such as networks with broken
+// path MTU discovery.
+//
+// The agent may include its estimate of the round trip time to the server in
+// seconds in the 'x-piko-rtt' header (see [Headers.RTT]), such as the duration
+// of the TCP connect. Unless configured with a fixed stream window, the
+// server sizes the receive window of the connection's streams by the RTT (see
+// [StreamWindow]). Agents should do the same for their own receive windows.
+//
+// If the server rejects the connection, it responds with a non-101 status
+// code and a JSON body '{"error": "<message>"}'. The body may include an
+// error code identifying the error, such as '{"error": "<message>", "code":
+// "conn_limit"}' (see [ErrorCodeConnLimit]). Agents should reconnect with
+// backoff if the status is retryable (see [Retryable]), and otherwise give up.
+//
+// To reduce the number of connections, an agent can listen on multiple
+// endpoints with a single connection by connecting to path
+// '/piko/v1/upstream' (see [MultiplexedUpstreamPath]) and including the
+// comma separated endpoint IDs in the 'x-piko-endpoints' header (see
+// [Headers.Endpoints]), of up to [MaxMultiplexedEndpoints] endpoints. The
+// connection is registered for each endpoint, and otherwise behaves the same
+// as a connection for a single endpoint, except each stream starts with a
+// stream header identifying its endpoint (see below).
+//
+// Endpoint IDs may be namespaced with '/', such as 'team-a/service-b' in
+// namespace 'team-a' (see [Namespace]), and an agent may listen on a
+// wildcard such as 'team-a/*', which receives the traffic for every endpoint
+// in the namespace that has no listener of its own (see [MatchEndpoint]).
+// The server rejects invalid endpoint IDs with a '400 Bad Request' (see
+// [ValidateEndpointID]).
+//
+// # Framing
+//
+// Once connected, the WebSocket carries a byte stream in binary messages.
+// Message boundaries have no meaning, so an agent must treat the payloads of
+// consecutive messages as a single stream of bytes, and may split writes into
+// messages of any size. Text messages are a protocol error.
+//
+// # Multiplexing
+//
+// The byte stream carries a yamux session (see
+// https://github.com/hashicorp/yamux/blob/master/spec.md), where the agent is
+// the yamux client and the server is the yamux server.
+//
+// Each yamux frame starts with a 12 byte [Header], followed by Length bytes
+// of payload for data frames. The server opens a stream (with even stream
+// IDs) for each incoming connection to the endpoint, and the agent forwards
+// the stream to its upstream service. The stream carries the raw bytes of
+// the proxied connection, such as an HTTP/1.1 request and response, so
+// the agent doesn't need to understand the proxied protocol. Agents must not
+// open streams.
+//
+// On a multiplexed connection, the server starts each stream with a stream
+// header containing the ID of the endpoint the stream is for, prefixed by
+// its length as a 1 byte integer (see [WriteStreamEndpoint] and
+// [ReadStreamEndpoint]), so the agent can forward the stream to the
+// endpoint's upstream service. The stream header is followed by the
+// proxied bytes as normal.
+//
+// Each stream starts with a receive window of [InitialStreamWindow] bytes,
+// so agents must send window updates as data is consumed. The server sends
+// pings as keep-alives, which the agent must echo back, and may send a
+// go away frame before closing the session.
+//
+// # Datagrams
+//
+// UDP endpoints carry datagrams rather than a byte stream. The server opens
+// a stream for each client address, and each datagram in either direction is
+// prefixed by its length as a 2 byte big endian integer (see [WriteDatagram]
+// and [ReadDatagram]), so datagram boundaries are preserved. The agent sends
+// the datagrams it reads from the stream to its upstream service, and writes
+// the upstream's datagrams back to the stream.
+//
+// # Timing
+//
+// When the agent proxies HTTP requests, it should add the
+// 'x-piko-upstream-duration' header (see [Headers.UpstreamDuration]) to each
+// response, containing the seconds between forwarding the request to its
+// upstream service and receiving the response headers, such as '0.012500'.
+// The server records the remaining request latency as tunnel latency, so
+// operators can tell whether slow requests are due to the network or the
+// upstream service. The header is optional.
+//
+// # Tracing
+//
+// The server adds the 'x-piko-request-id' header (see [Headers.RequestID]) and
+// 'x-piko-connection-id' header (see [Headers.ConnectionID]) to proxied HTTP
+// requests. The server includes the request ID in its error responses, so
+// agents should include both IDs when logging failed requests, so failures
+// reported by users can be matched to the agent logs.
+//
+// # Conformance
+//
+// The canonical encoding of each frame type is described by the test vectors
+// in testdata/vectors.json, and package conformance contains a test suite to
+// validate an agent against the protocol.
+package protocol
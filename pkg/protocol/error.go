@@ -0,0 +1,32 @@
+package protocol
+
+import "fmt"
+
+// Error codes returned by the server when rejecting an upstream connection.
+const (
+	// ErrorCodeConnLimit indicates the server has reached its maximum
+	// number of upstream connections.
+	ErrorCodeConnLimit = "conn_limit"
+
+	// ErrorCodeEndpointConnLimit indicates the endpoint has reached its
+	// maximum number of upstream connections.
+	ErrorCodeEndpointConnLimit = "endpoint_conn_limit"
+
+	// ErrorCodeNamespaceConnLimit indicates the namespace of the endpoint
+	// has reached its maximum number of upstream connections (see
+	// [Namespace]).
+	ErrorCodeNamespaceConnLimit = "namespace_conn_limit"
+)
+
+// Error is an error response from the server when rejecting an upstream
+// connection.
+type Error struct {
+	StatusCode int
+	// Code identifies the error, or is empty if the error has no code.
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d: %s", e.StatusCode, e.Message)
+}
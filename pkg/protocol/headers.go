@@ -0,0 +1,208 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultHeaderPrefix is the default prefix of the names of the headers Piko
+// adds to handshakes, proxied requests and responses.
+const DefaultHeaderPrefix = "x-piko-"
+
+// maxHeaderPrefixLength is the maximum length of a header prefix.
+const maxHeaderPrefixLength = 64
+
+// Headers contains the names of the headers used by Piko, which all share a
+// configurable prefix, so Piko can be used in environments that forbid the
+// default 'x-piko-' prefix.
+//
+// The server and agents must be configured with the same prefix.
+//
+// The zero value uses [DefaultHeaderPrefix].
+type Headers struct {
+	prefix string
+}
+
+// NewHeaders returns the header names with the given prefix, or
+// [DefaultHeaderPrefix] if the prefix is empty.
+//
+// The prefix must be validated with [ValidateHeaderPrefix].
+func NewHeaders(prefix string) Headers {
+	return Headers{
+		prefix: strings.ToLower(prefix),
+	}
+}
+
+// Prefix returns the prefix of the header names.
+func (h Headers) Prefix() string {
+	if h.prefix == "" {
+		return DefaultHeaderPrefix
+	}
+	return h.prefix
+}
+
+// Endpoint is the HTTP request header containing the endpoint ID to route
+// the request to, which takes precedence over the endpoint ID in the 'Host'
+// header.
+func (h Headers) Endpoint() string {
+	return h.Prefix() + "endpoint"
+}
+
+// Authorization is the HTTP request header containing the client token,
+// which takes precedence over the 'Authorization' header, so the
+// 'Authorization' header can be forwarded to the upstream.
+func (h Headers) Authorization() string {
+	return h.Prefix() + "authorization"
+}
+
+// Endpoints is the handshake header containing the comma separated IDs of
+// the endpoints to listen on with a multiplexed connection.
+func (h Headers) Endpoints() string {
+	return h.Prefix() + "endpoints"
+}
+
+// SessionID is the handshake header containing the agent session ID.
+func (h Headers) SessionID() string {
+	return h.Prefix() + "session-id"
+}
+
+// MaxStreams is the handshake header containing the maximum number of
+// concurrent streams the agent accepts on the connection.
+func (h Headers) MaxStreams() string {
+	return h.Prefix() + "max-streams"
+}
+
+// MaxMessageSize is the handshake header containing the maximum size of each
+// WebSocket message the agent writes to the server in bytes. The server
+// limits the messages it writes to the agent to the same size.
+func (h Headers) MaxMessageSize() string {
+	return h.Prefix() + "max-message-size"
+}
+
+// RTT is the handshake header containing the agent's estimate of the round
+// trip time to the server in seconds, measured as the duration of the TCP
+// connect.
+//
+// The server uses the estimate to size the stream windows of the connection
+// (see [StreamWindow]).
+func (h Headers) RTT() string {
+	return h.Prefix() + "rtt"
+}
+
+// RequestID is the HTTP request header the server adds to proxied requests,
+// containing a unique ID of the request. The server also adds the header to
+// the response, and includes the ID in error responses, so a failed request
+// can be matched to the server and agent logs.
+func (h Headers) RequestID() string {
+	return h.Prefix() + "request-id"
+}
+
+// ConnectionID is the HTTP request header the server adds to proxied
+// requests, containing the ID the server assigned to the agent connection
+// that the request is sent to.
+func (h Headers) ConnectionID() string {
+	return h.Prefix() + "connection-id"
+}
+
+// UpstreamDuration is the HTTP response header the agent adds to proxied
+// responses, containing the duration in seconds between the agent forwarding
+// the request to its upstream service and receiving the response headers.
+//
+// The server uses the header to split request latency into the time spent in
+// the tunnel and the time spent in the upstream service, then removes it
+// from the response.
+func (h Headers) UpstreamDuration() string {
+	return h.Prefix() + "upstream-duration"
+}
+
+// Subject is the HTTP request header the server adds to proxied requests
+// containing the subject of the authenticated client token.
+func (h Headers) Subject() string {
+	return h.Prefix() + "subject"
+}
+
+// Tenant is the HTTP request header the server adds to proxied requests
+// containing the tenant of the authenticated client token.
+func (h Headers) Tenant() string {
+	return h.Prefix() + "tenant"
+}
+
+// Scopes is the HTTP request header the server adds to proxied requests
+// containing the space separated scopes of the authenticated client token.
+func (h Headers) Scopes() string {
+	return h.Prefix() + "scopes"
+}
+
+// DeliveryID is the HTTP response header containing the delivery ID of a
+// queued request.
+func (h Headers) DeliveryID() string {
+	return h.Prefix() + "delivery-id"
+}
+
+// Forward is the HTTP request header indicating the request was forwarded by
+// another server node.
+func (h Headers) Forward() string {
+	return h.Prefix() + "forward"
+}
+
+// ForwardClientIP is the HTTP request header containing the IP of the
+// original client of a forwarded request.
+func (h Headers) ForwardClientIP() string {
+	return h.Prefix() + "forward-client-ip"
+}
+
+// ForwardHops is the HTTP request header containing the number of nodes a
+// request has been forwarded by.
+func (h Headers) ForwardHops() string {
+	return h.Prefix() + "forward-hops"
+}
+
+// ForwardTimestamp is the HTTP request header containing the Unix time a
+// forwarded request was signed.
+func (h Headers) ForwardTimestamp() string {
+	return h.Prefix() + "forward-timestamp"
+}
+
+// ForwardNonce is the HTTP request header containing a random nonce unique
+// to a signed forwarded request.
+func (h Headers) ForwardNonce() string {
+	return h.Prefix() + "forward-nonce"
+}
+
+// ForwardSignature is the HTTP request header containing the HMAC of the
+// metadata of a forwarded request.
+func (h Headers) ForwardSignature() string {
+	return h.Prefix() + "forward-signature"
+}
+
+// NoUpstream is the HTTP response header set by a node that has no
+// upstream for the endpoint of a forwarded request, so the forwarding node
+// can retry another node.
+func (h Headers) NoUpstream() string {
+	return h.Prefix() + "no-upstream"
+}
+
+// ValidateHeaderPrefix returns an error if the header prefix is invalid.
+//
+// The prefix may only contain letters, digits and '-', so every header name
+// is a valid HTTP header name, and must end with '-', such as 'x-tunnel-'.
+func ValidateHeaderPrefix(prefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("empty")
+	}
+	if len(prefix) > maxHeaderPrefixLength {
+		return fmt.Errorf("exceeds %d characters", maxHeaderPrefixLength)
+	}
+	for _, c := range prefix {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' {
+			return fmt.Errorf("invalid character %q", c)
+		}
+	}
+	if prefix[0] == '-' {
+		return fmt.Errorf("must start with a letter or digit")
+	}
+	if prefix[len(prefix)-1] != '-' {
+		return fmt.Errorf("must end with '-'")
+	}
+	return nil
+}
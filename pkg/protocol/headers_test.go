@@ -0,0 +1,26 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaders(t *testing.T) {
+	assert.Equal(t, "x-piko-endpoint", Headers{}.Endpoint())
+	assert.Equal(t, "x-piko-session-id", NewHeaders("").SessionID())
+	assert.Equal(t, "x-tunnel-request-id", NewHeaders("X-Tunnel-").RequestID())
+	assert.Equal(t, "x-tunnel-forward-signature", NewHeaders("x-tunnel-").ForwardSignature())
+}
+
+func TestValidateHeaderPrefix(t *testing.T) {
+	assert.NoError(t, ValidateHeaderPrefix(DefaultHeaderPrefix))
+	assert.NoError(t, ValidateHeaderPrefix("X-Tunnel-"))
+	assert.NoError(t, ValidateHeaderPrefix("acme-1-"))
+
+	assert.EqualError(t, ValidateHeaderPrefix(""), "empty")
+	assert.EqualError(t, ValidateHeaderPrefix("x-tunnel"), "must end with '-'")
+	assert.EqualError(t, ValidateHeaderPrefix("-tunnel-"), "must start with a letter or digit")
+	assert.EqualError(t, ValidateHeaderPrefix("x_tunnel-"), "invalid character '_'")
+	assert.EqualError(t, ValidateHeaderPrefix("x tunnel-"), "invalid character ' '")
+}
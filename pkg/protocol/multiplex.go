@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MultiplexedUpstreamPath is the path agents connect to, to listen on
+// multiple endpoints with a single connection.
+const MultiplexedUpstreamPath = "/piko/v1/upstream"
+
+// MaxMultiplexedEndpoints is the maximum number of endpoints an agent can
+// listen on with a single connection.
+const MaxMultiplexedEndpoints = 1000
+
+// maxStreamEndpointLength is the maximum length of the endpoint ID in a
+// stream header.
+const maxStreamEndpointLength = 0xff
+
+// FormatEndpoints formats the endpoint IDs of a multiplexed connection, as
+// used by [Headers.Endpoints].
+func FormatEndpoints(endpointIDs []string) string {
+	return strings.Join(endpointIDs, ",")
+}
+
+// ParseEndpoints parses the endpoint IDs of a multiplexed connection, as used
+// by [Headers.Endpoints].
+//
+// Endpoint IDs must be unique, non-empty and at most 255 bytes.
+func ParseEndpoints(s string) ([]string, error) {
+	endpointIDs := strings.Split(s, ",")
+	if len(endpointIDs) > MaxMultiplexedEndpoints {
+		return nil, fmt.Errorf("too many endpoints: %d", len(endpointIDs))
+	}
+
+	seen := make(map[string]struct{}, len(endpointIDs))
+	for _, endpointID := range endpointIDs {
+		if endpointID == "" {
+			return nil, fmt.Errorf("empty endpoint")
+		}
+		if len(endpointID) > maxStreamEndpointLength {
+			return nil, fmt.Errorf("endpoint too long: %s", endpointID)
+		}
+		if _, ok := seen[endpointID]; ok {
+			return nil, fmt.Errorf("duplicate endpoint: %s", endpointID)
+		}
+		seen[endpointID] = struct{}{}
+	}
+	return endpointIDs, nil
+}
+
+// WriteStreamEndpoint writes the stream header of a stream on a multiplexed
+// connection to w, containing the ID of the endpoint the stream is for
+// prefixed by its length as a 1 byte integer.
+func WriteStreamEndpoint(w io.Writer, endpointID string) error {
+	if len(endpointID) > maxStreamEndpointLength {
+		return fmt.Errorf("endpoint too long: %s", endpointID)
+	}
+
+	header := make([]byte, 1+len(endpointID))
+	header[0] = uint8(len(endpointID))
+	copy(header[1:], endpointID)
+	_, err := w.Write(header)
+	return err
+}
+
+// ReadStreamEndpoint reads the stream header written by
+// [WriteStreamEndpoint] from r, and returns the endpoint ID.
+func ReadStreamEndpoint(r io.Reader) (string, error) {
+	var size [1]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return "", err
+	}
+	endpointID := make([]byte, size[0])
+	if _, err := io.ReadFull(r, endpointID); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return string(endpointID), nil
+}
@@ -0,0 +1,44 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamEndpoint(t *testing.T) {
+	var stream bytes.Buffer
+	require.NoError(t, WriteStreamEndpoint(&stream, "my-endpoint"))
+	stream.WriteString("GET / HTTP/1.1")
+
+	endpointID, err := ReadStreamEndpoint(&stream)
+	require.NoError(t, err)
+	assert.Equal(t, "my-endpoint", endpointID)
+	// The stream header is followed by the proxied bytes.
+	assert.Equal(t, "GET / HTTP/1.1", stream.String())
+
+	assert.Error(t, WriteStreamEndpoint(&stream, strings.Repeat("a", 256)))
+
+	// Closed mid-header.
+	_, err = ReadStreamEndpoint(bytes.NewReader([]byte{3, 'f'}))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestParseEndpoints(t *testing.T) {
+	endpointIDs, err := ParseEndpoints(FormatEndpoints([]string{"foo", "bar"}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo", "bar"}, endpointIDs)
+
+	_, err = ParseEndpoints("")
+	assert.EqualError(t, err, "empty endpoint")
+	_, err = ParseEndpoints("foo,,bar")
+	assert.EqualError(t, err, "empty endpoint")
+	_, err = ParseEndpoints("foo,bar,foo")
+	assert.EqualError(t, err, "duplicate endpoint: foo")
+	_, err = ParseEndpoints(strings.Repeat("a,", MaxMultiplexedEndpoints) + "a")
+	assert.Error(t, err)
+}
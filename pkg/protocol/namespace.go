@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NamespaceSeparator separates the namespaces of an endpoint ID, such as
+// endpoint 'team-a/service-b' in namespace 'team-a'.
+const NamespaceSeparator = "/"
+
+// wildcardSuffix is the suffix of a wildcard endpoint ID, such as 'team-a/*'
+// matching every endpoint in namespace 'team-a'.
+const wildcardSuffix = NamespaceSeparator + "*"
+
+// Namespace returns the namespace of the endpoint, such as 'team-a' for
+// 'team-a/service-b' or 'org/team-a' for 'org/team-a/service-b', or an empty
+// string if the endpoint isn't in a namespace.
+func Namespace(endpointID string) string {
+	i := strings.LastIndex(endpointID, NamespaceSeparator)
+	if i < 0 {
+		return ""
+	}
+	return endpointID[:i]
+}
+
+// IsWildcard returns whether the endpoint ID is a wildcard that matches every
+// endpoint in a namespace, such as 'team-a/*'.
+func IsWildcard(endpointID string) bool {
+	return strings.HasSuffix(endpointID, wildcardSuffix)
+}
+
+// MatchEndpoint returns whether the pattern matches the endpoint ID, where
+// the pattern is either an endpoint ID that matches itself, or a wildcard
+// that matches every endpoint in the namespace, including nested namespaces
+// and other wildcards in the namespace.
+func MatchEndpoint(pattern string, endpointID string) bool {
+	if pattern == endpointID {
+		return true
+	}
+	if !IsWildcard(pattern) {
+		return false
+	}
+	return strings.HasPrefix(endpointID, strings.TrimSuffix(pattern, "*"))
+}
+
+// Wildcards returns the wildcard endpoint IDs that match the endpoint, most
+// specific first, such as 'org/team-a/*' then 'org/*' for endpoint
+// 'org/team-a/service-b'.
+func Wildcards(endpointID string) []string {
+	var wildcards []string
+	namespace := Namespace(endpointID)
+	for namespace != "" {
+		wildcards = append(wildcards, namespace+wildcardSuffix)
+		namespace = Namespace(namespace)
+	}
+	return wildcards
+}
+
+// ValidateEndpointID returns an error if the endpoint ID is invalid.
+//
+// Namespaces in an endpoint ID must not be empty, and a wildcard ('*') is
+// only permitted as the last part of the ID, such as 'team-a/*'.
+func ValidateEndpointID(endpointID string) error {
+	if endpointID == "" {
+		return fmt.Errorf("empty endpoint id")
+	}
+	parts := strings.Split(endpointID, NamespaceSeparator)
+	for i, part := range parts {
+		if part == "" {
+			return fmt.Errorf("empty namespace: %s", endpointID)
+		}
+		if strings.Contains(part, "*") && (part != "*" || i == 0 || i != len(parts)-1) {
+			return fmt.Errorf("invalid wildcard: %s", endpointID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespace(t *testing.T) {
+	assert.Equal(t, "team-a", Namespace("team-a/service-b"))
+	assert.Equal(t, "org/team-a", Namespace("org/team-a/service-b"))
+	assert.Equal(t, "team-a", Namespace("team-a/*"))
+	assert.Equal(t, "", Namespace("service-b"))
+}
+
+func TestMatchEndpoint(t *testing.T) {
+	assert.True(t, MatchEndpoint("team-a/service-b", "team-a/service-b"))
+	assert.True(t, MatchEndpoint("team-a/*", "team-a/service-b"))
+	assert.True(t, MatchEndpoint("team-a/*", "team-a/nested/service-b"))
+	assert.True(t, MatchEndpoint("team-a/*", "team-a/nested/*"))
+	assert.True(t, MatchEndpoint("team-a/*", "team-a/*"))
+
+	assert.False(t, MatchEndpoint("team-a/service-b", "team-a/service-c"))
+	assert.False(t, MatchEndpoint("team-a/*", "team-b/service-b"))
+	assert.False(t, MatchEndpoint("team-a/*", "team-a"))
+	assert.False(t, MatchEndpoint("team-a/*", "team-ab/service-b"))
+}
+
+func TestWildcards(t *testing.T) {
+	assert.Equal(
+		t,
+		[]string{"org/team-a/*", "org/*"},
+		Wildcards("org/team-a/service-b"),
+	)
+	assert.Nil(t, Wildcards("service-b"))
+}
+
+func TestValidateEndpointID(t *testing.T) {
+	for _, endpointID := range []string{
+		"service-b", "team-a/service-b", "org/team-a/service-b", "team-a/*",
+	} {
+		assert.NoError(t, ValidateEndpointID(endpointID), endpointID)
+	}
+
+	for _, endpointID := range []string{
+		"", "*", "team-a/", "/service-b", "team-a//service-b",
+		"team-a/*/service-b", "team-a/service-*",
+	} {
+		assert.Error(t, ValidateEndpointID(endpointID), endpointID)
+	}
+}
@@ -0,0 +1,179 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/andydunstall/yamux"
+)
+
+// Version is the only supported yamux protocol version.
+const Version uint8 = 0
+
+// FrameType is the type of a yamux frame.
+type FrameType uint8
+
+const (
+	// FrameTypeData is followed by Length bytes of stream data.
+	FrameTypeData FrameType = 0
+	// FrameTypeWindowUpdate increases the senders stream receive window by
+	// Length bytes.
+	FrameTypeWindowUpdate FrameType = 1
+	// FrameTypePing is a keep-alive, where Length is an opaque value
+	// echoed back in the response.
+	FrameTypePing FrameType = 2
+	// FrameTypeGoAway terminates the session, where Length is a go away
+	// code.
+	FrameTypeGoAway FrameType = 3
+)
+
+// Flags are the yamux frame flags.
+type Flags uint16
+
+const (
+	// FlagSYN opens a new stream.
+	FlagSYN Flags = 1 << 0
+	// FlagACK acknowledges a new stream, or responds to a ping.
+	FlagACK Flags = 1 << 1
+	// FlagFIN half-closes a stream.
+	FlagFIN Flags = 1 << 2
+	// FlagRST resets a stream.
+	FlagRST Flags = 1 << 3
+)
+
+// Go away codes.
+const (
+	GoAwayNormal        uint32 = 0
+	GoAwayProtocolError uint32 = 1
+	GoAwayInternalError uint32 = 2
+)
+
+const (
+	// HeaderSize is the size of an encoded frame header.
+	HeaderSize = 12
+
+	// InitialStreamWindow is the initial receive window of each stream.
+	InitialStreamWindow = 256 * 1024
+
+	// MaxStreamWindow is the maximum receive window of each stream when
+	// sizing windows by the link RTT (see [StreamWindow]).
+	MaxStreamWindow = 16 * 1024 * 1024
+
+	// StreamWindowBandwidth is the bandwidth in bytes per second that
+	// windows sized by the link RTT target (100 Mbps).
+	StreamWindowBandwidth = 100 * 1000 * 1000 / 8
+)
+
+var (
+	errShortHeader    = errors.New("short header")
+	errInvalidVersion = errors.New("invalid version")
+	errInvalidType    = errors.New("invalid frame type")
+)
+
+// Header is a yamux frame header.
+//
+// Headers are encoded as version (1 byte), type (1 byte), flags (2 bytes),
+// stream ID (4 bytes) and length (4 bytes), with all fields big endian.
+type Header struct {
+	Type     FrameType
+	Flags    Flags
+	StreamID uint32
+	Length   uint32
+}
+
+// Encode returns the encoded header.
+func (h Header) Encode() []byte {
+	b := make([]byte, HeaderSize)
+	b[0] = Version
+	b[1] = uint8(h.Type)
+	binary.BigEndian.PutUint16(b[2:4], uint16(h.Flags))
+	binary.BigEndian.PutUint32(b[4:8], h.StreamID)
+	binary.BigEndian.PutUint32(b[8:12], h.Length)
+	return b
+}
+
+// DecodeHeader decodes the header at the start of b.
+func DecodeHeader(b []byte) (Header, error) {
+	if len(b) < HeaderSize {
+		return Header{}, errShortHeader
+	}
+	if b[0] != Version {
+		return Header{}, fmt.Errorf("%w: %d", errInvalidVersion, b[0])
+	}
+	if b[1] > uint8(FrameTypeGoAway) {
+		return Header{}, fmt.Errorf("%w: %d", errInvalidType, b[1])
+	}
+	return Header{
+		Type:     FrameType(b[1]),
+		Flags:    Flags(binary.BigEndian.Uint16(b[2:4])),
+		StreamID: binary.BigEndian.Uint32(b[4:8]),
+		Length:   binary.BigEndian.Uint32(b[8:12]),
+	}, nil
+}
+
+// MaxSessionIDLength is the maximum length of a session ID.
+const MaxSessionIDLength = 128
+
+// FormatSeconds formats the duration in seconds, as used by
+// [Headers.UpstreamDuration] and [Headers.RTT].
+func FormatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 6, 64)
+}
+
+// ParseSeconds parses a duration in seconds, as used by
+// [Headers.UpstreamDuration] and [Headers.RTT].
+func ParseSeconds(s string) (time.Duration, bool) {
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// UpstreamPath returns the path agents connect to, to listen on the given
+// endpoint.
+func UpstreamPath(endpointID string) string {
+	return "/piko/v1/upstream/" + endpointID
+}
+
+// Retryable returns whether an agent should reconnect if the server rejects
+// the connection with the given status code.
+func Retryable(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// StreamWindow returns the maximum stream receive window for a link with the
+// given RTT.
+//
+// A stream can only have a window of data in flight per RTT, so the window is
+// the bandwidth-delay product of the link at [StreamWindowBandwidth], bounded
+// by [InitialStreamWindow] and [MaxStreamWindow]. Larger windows improve
+// throughput on high latency links, at the cost of buffering more data for
+// streams that aren't read.
+func StreamWindow(rtt time.Duration) uint32 {
+	bdp := rtt.Seconds() * StreamWindowBandwidth
+	return uint32(max(min(bdp, MaxStreamWindow), InitialStreamWindow))
+}
+
+// MuxConfig returns the yamux configuration used by both the server and
+// agents.
+//
+// The returned configuration logs to stderr, so callers should override
+// the logger.
+func MuxConfig() *yamux.Config {
+	return yamux.DefaultConfig()
+}
@@ -0,0 +1,182 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/yamux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type vector struct {
+	Name   string `json:"name"`
+	Frame  string `json:"frame"`
+	Header struct {
+		Type     FrameType `json:"type"`
+		Flags    Flags     `json:"flags"`
+		StreamID uint32    `json:"stream_id"`
+		Length   uint32    `json:"length"`
+	} `json:"header"`
+	Payload string `json:"payload"`
+}
+
+func loadVectors(t *testing.T) map[string]vector {
+	b, err := os.ReadFile("testdata/vectors.json")
+	require.NoError(t, err)
+
+	var vectors []vector
+	require.NoError(t, json.Unmarshal(b, &vectors))
+
+	m := make(map[string]vector)
+	for _, v := range vectors {
+		m[v.Name] = v
+	}
+	return m
+}
+
+func (v vector) frame(t *testing.T) []byte {
+	b, err := hex.DecodeString(v.Frame)
+	require.NoError(t, err)
+	return b
+}
+
+func TestHeader_Vectors(t *testing.T) {
+	for name, v := range loadVectors(t) {
+		t.Run(name, func(t *testing.T) {
+			frame := v.frame(t)
+
+			header, err := DecodeHeader(frame)
+			require.NoError(t, err)
+			assert.Equal(t, v.Header.Type, header.Type)
+			assert.Equal(t, v.Header.Flags, header.Flags)
+			assert.Equal(t, v.Header.StreamID, header.StreamID)
+			assert.Equal(t, v.Header.Length, header.Length)
+
+			assert.Equal(t, frame[:HeaderSize], header.Encode())
+			assert.Equal(t, v.Payload, hex.EncodeToString(frame[HeaderSize:]))
+		})
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	t.Run("short", func(t *testing.T) {
+		_, err := DecodeHeader([]byte{0, 1, 0})
+		assert.ErrorIs(t, err, errShortHeader)
+	})
+
+	t.Run("invalid version", func(t *testing.T) {
+		b := Header{}.Encode()
+		b[0] = 1
+		_, err := DecodeHeader(b)
+		assert.ErrorIs(t, err, errInvalidVersion)
+	})
+
+	t.Run("invalid type", func(t *testing.T) {
+		b := Header{Type: 4}.Encode()
+		_, err := DecodeHeader(b)
+		assert.ErrorIs(t, err, errInvalidType)
+	})
+}
+
+// TestMux_Vectors verifies the mux implementation used by the server and Go
+// agent matches the test vectors.
+func TestMux_Vectors(t *testing.T) {
+	vectors := loadVectors(t)
+
+	muxConfig := MuxConfig()
+	muxConfig.EnableKeepAlive = false
+	muxConfig.LogOutput = io.Discard
+
+	t.Run("server open stream", func(t *testing.T) {
+		serverConn, agentConn := net.Pipe()
+		defer agentConn.Close()
+
+		sess, err := yamux.Server(serverConn, muxConfig)
+		require.NoError(t, err)
+		defer sess.Close()
+
+		go func() {
+			stream, err := sess.OpenStream()
+			if err != nil {
+				return
+			}
+			// nolint
+			stream.Write([]byte("hello"))
+		}()
+
+		b := make([]byte, HeaderSize)
+		_, err = io.ReadFull(agentConn, b)
+		require.NoError(t, err)
+		assert.Equal(t, vectors["open stream"].frame(t), b)
+
+		b = make([]byte, HeaderSize+5)
+		_, err = io.ReadFull(agentConn, b)
+		require.NoError(t, err)
+		assert.Equal(t, vectors["data"].frame(t), b)
+	})
+
+	t.Run("agent accept stream", func(t *testing.T) {
+		serverConn, agentConn := net.Pipe()
+		defer serverConn.Close()
+
+		sess, err := yamux.Client(agentConn, muxConfig)
+		require.NoError(t, err)
+		defer sess.Close()
+
+		go func() {
+			// nolint
+			serverConn.Write(vectors["open stream"].frame(t))
+		}()
+
+		accepted := make(chan struct{})
+		go func() {
+			defer close(accepted)
+			_, err := sess.AcceptStream()
+			assert.NoError(t, err)
+		}()
+
+		b := make([]byte, HeaderSize)
+		_, err = io.ReadFull(serverConn, b)
+		require.NoError(t, err)
+		assert.Equal(t, vectors["accept stream"].frame(t), b)
+
+		<-accepted
+	})
+
+	t.Run("agent ping response", func(t *testing.T) {
+		serverConn, agentConn := net.Pipe()
+		defer serverConn.Close()
+
+		sess, err := yamux.Client(agentConn, muxConfig)
+		require.NoError(t, err)
+		defer sess.Close()
+
+		go func() {
+			// nolint
+			serverConn.Write(vectors["ping"].frame(t))
+		}()
+
+		b := make([]byte, HeaderSize)
+		_, err = io.ReadFull(serverConn, b)
+		require.NoError(t, err)
+		assert.Equal(t, vectors["ping response"].frame(t), b)
+	})
+}
+
+func TestStreamWindow(t *testing.T) {
+	// Low latency links use the initial window.
+	assert.Equal(t, uint32(InitialStreamWindow), StreamWindow(0))
+	assert.Equal(t, uint32(InitialStreamWindow), StreamWindow(time.Millisecond))
+
+	// 100ms at 100Mbps is 1.25MB.
+	assert.Equal(t, uint32(1250000), StreamWindow(time.Millisecond*100))
+
+	// High latency links are bounded by the max window.
+	assert.Equal(t, uint32(MaxStreamWindow), StreamWindow(time.Second*5))
+}
@@ -0,0 +1,77 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// BanList tracks keys, such as client IPs, that are temporarily banned.
+type BanList struct {
+	bans      map[string]time.Time
+	lastPrune time.Time
+
+	mu sync.Mutex
+}
+
+func NewBanList() *BanList {
+	return &BanList{
+		bans: make(map[string]time.Time),
+	}
+}
+
+// Ban bans the key until the given time. If the key is already banned for
+// longer, the existing ban is kept.
+func (b *BanList) Ban(key string, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if existing, ok := b.bans[key]; ok && existing.After(until) {
+		return
+	}
+	b.bans[key] = until
+}
+
+// Banned returns whether the key is banned now, and if so, when the ban
+// expires.
+func (b *BanList) Banned(key string) (time.Time, bool) {
+	return b.BannedAt(key, time.Now())
+}
+
+// BannedAt returns whether the key is banned at the given time, and if so,
+// when the ban expires.
+func (b *BanList) BannedAt(key string, now time.Time) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.Sub(b.lastPrune) >= pruneInterval {
+		b.pruneLocked(now)
+	}
+
+	until, ok := b.bans[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	if !now.Before(until) {
+		delete(b.bans, key)
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// Len returns the number of banned keys, which may include expired bans that
+// haven't yet been pruned.
+func (b *BanList) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.bans)
+}
+
+func (b *BanList) pruneLocked(now time.Time) {
+	for key, until := range b.bans {
+		if !now.Before(until) {
+			delete(b.bans, key)
+		}
+	}
+	b.lastPrune = now
+}
@@ -0,0 +1,34 @@
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SetHeaders sets the 'RateLimit-Limit', 'RateLimit-Remaining' and
+// 'RateLimit-Reset' headers describing the limiter status, as described in
+// the IETF RateLimit header fields draft. If an event isn't permitted,
+// 'Retry-After' is also set.
+//
+// Durations are rounded up to whole seconds, so clients that follow the
+// headers never retry before an event is permitted.
+func SetHeaders(h http.Header, status Status) {
+	h.Set("RateLimit-Limit", strconv.Itoa(status.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(status.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(status.Reset)))
+	if status.RetryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(RetryAfterSeconds(status.RetryAfter)))
+	}
+}
+
+// RetryAfterSeconds returns the 'Retry-After' value for the given duration,
+// rounded up to at least one second so it isn't sent as 'Retry-After: 0'.
+func RetryAfterSeconds(d time.Duration) int {
+	return max(ceilSeconds(d), 1)
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
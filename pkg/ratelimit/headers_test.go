@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetHeaders(t *testing.T) {
+	t.Run("allowed", func(t *testing.T) {
+		h := make(http.Header)
+		SetHeaders(h, Status{
+			Limit:     10,
+			Remaining: 4,
+			Reset:     time.Millisecond * 2500,
+		})
+		assert.Equal(t, "10", h.Get("RateLimit-Limit"))
+		assert.Equal(t, "4", h.Get("RateLimit-Remaining"))
+		// Rounds up.
+		assert.Equal(t, "3", h.Get("RateLimit-Reset"))
+		assert.Equal(t, "", h.Get("Retry-After"))
+	})
+
+	t.Run("limited", func(t *testing.T) {
+		h := make(http.Header)
+		SetHeaders(h, Status{
+			Limit:      10,
+			Remaining:  0,
+			RetryAfter: time.Millisecond * 100,
+			Reset:      time.Second * 10,
+		})
+		assert.Equal(t, "0", h.Get("RateLimit-Remaining"))
+		assert.Equal(t, "10", h.Get("RateLimit-Reset"))
+		// Rounds up to at least one second.
+		assert.Equal(t, "1", h.Get("Retry-After"))
+	})
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	assert.Equal(t, 1, RetryAfterSeconds(0))
+	assert.Equal(t, 1, RetryAfterSeconds(time.Millisecond))
+	assert.Equal(t, 2, RetryAfterSeconds(time.Millisecond*1001))
+	assert.Equal(t, 5, RetryAfterSeconds(time.Second*5))
+}
@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// pruneInterval is the minimum interval between pruning idle keys.
+	pruneInterval = time.Minute
+)
+
+// KeyedLimiter rate limits events separately for each key, such as a client
+// IP.
+//
+// Keys whose bucket has refilled are pruned, so memory usage is bounded by the
+// number of keys active within the refill period.
+type KeyedLimiter struct {
+	rate  float64
+	burst int
+
+	limiters  map[string]*Limiter
+	lastPrune time.Time
+
+	mu sync.Mutex
+}
+
+// NewKeyedLimiter creates a limiter permitting 'rate' events per second per
+// key with bursts of up to 'burst' events.
+func NewKeyedLimiter(rate float64, burst int) *KeyedLimiter {
+	return &KeyedLimiter{
+		rate:     rate,
+		burst:    burst,
+		limiters: make(map[string]*Limiter),
+	}
+}
+
+// Allow returns whether an event for the given key is permitted now.
+func (l *KeyedLimiter) Allow(key string) bool {
+	return l.AllowAt(key, time.Now())
+}
+
+// AllowAt returns whether an event for the given key is permitted at the
+// given time.
+func (l *KeyedLimiter) AllowAt(key string, now time.Time) bool {
+	allowed, _ := l.TakeAt(key, now)
+	return allowed
+}
+
+// TakeAt returns whether an event for the given key is permitted at the
+// given time, along with the status of the keys bucket after the event.
+func (l *KeyedLimiter) TakeAt(key string, now time.Time) (bool, Status) {
+	l.mu.Lock()
+	if now.Sub(l.lastPrune) >= pruneInterval {
+		l.pruneLocked(now)
+	}
+	limiter, ok := l.limiters[key]
+	if !ok {
+		limiter = NewLimiter(l.rate, l.burst)
+		l.limiters[key] = limiter
+	}
+	l.mu.Unlock()
+
+	return limiter.TakeAt(now)
+}
+
+// Len returns the number of tracked keys.
+func (l *KeyedLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.limiters)
+}
+
+func (l *KeyedLimiter) pruneLocked(now time.Time) {
+	for key, limiter := range l.limiters {
+		// If the bucket is full, the key is equivalent to a new key so can
+		// be discarded.
+		if limiter.full(now) {
+			delete(l.limiters, key)
+		}
+	}
+	l.lastPrune = now
+}
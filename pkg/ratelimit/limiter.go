@@ -0,0 +1,114 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Status describes the state of a rate limiter bucket, such as to tell
+// clients when to retry.
+type Status struct {
+	// Limit is the maximum number of events permitted in a burst.
+	Limit int
+
+	// Remaining is the number of events permitted now.
+	Remaining int
+
+	// RetryAfter is the duration until the next event is permitted, or zero
+	// if an event is permitted now.
+	RetryAfter time.Duration
+
+	// Reset is the duration until the bucket is full.
+	Reset time.Duration
+}
+
+// Limiter is a token bucket rate limiter.
+//
+// The bucket holds up to 'burst' tokens and is refilled at 'rate' tokens per
+// second. Each event consumes a token, so events are permitted at 'rate' per
+// second on average, with bursts of up to 'burst' events.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	tokens float64
+	last   time.Time
+
+	mu sync.Mutex
+}
+
+// NewLimiter creates a limiter permitting 'rate' events per second with
+// bursts of up to 'burst' events. The bucket starts full.
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Allow returns whether an event is permitted now, consuming a token if it
+// is.
+func (l *Limiter) Allow() bool {
+	return l.AllowAt(time.Now())
+}
+
+// AllowAt returns whether an event is permitted at the given time, consuming
+// a token if it is.
+func (l *Limiter) AllowAt(now time.Time) bool {
+	allowed, _ := l.TakeAt(now)
+	return allowed
+}
+
+// TakeAt returns whether an event is permitted at the given time, consuming
+// a token if it is, along with the status of the bucket after the event.
+func (l *Limiter) TakeAt(now time.Time) (bool, Status) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(now)
+	allowed := l.tokens >= 1
+	if allowed {
+		l.tokens--
+	}
+	return allowed, l.statusLocked()
+}
+
+// full returns whether the bucket is full at the given time.
+func (l *Limiter) full(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(now)
+	return l.tokens >= l.burst
+}
+
+func (l *Limiter) statusLocked() Status {
+	status := Status{
+		Limit:     int(l.burst),
+		Remaining: int(l.tokens),
+	}
+	if l.rate > 0 {
+		if l.tokens < 1 {
+			status.RetryAfter = secondsToDuration((1 - l.tokens) / l.rate)
+		}
+		status.Reset = secondsToDuration((l.burst - l.tokens) / l.rate)
+	}
+	return status
+}
+
+func (l *Limiter) refill(now time.Time) {
+	if !l.last.IsZero() && now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	if now.After(l.last) {
+		l.last = now
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
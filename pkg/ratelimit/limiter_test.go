@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := NewLimiter(2, 3)
+
+	// Burst.
+	for i := 0; i != 3; i++ {
+		assert.True(t, limiter.AllowAt(now))
+	}
+	assert.False(t, limiter.AllowAt(now))
+
+	// Refills at 2 tokens per second.
+	now = now.Add(time.Millisecond * 500)
+	assert.True(t, limiter.AllowAt(now))
+	assert.False(t, limiter.AllowAt(now))
+
+	// Refills no more than the burst.
+	now = now.Add(time.Minute)
+	for i := 0; i != 3; i++ {
+		assert.True(t, limiter.AllowAt(now))
+	}
+	assert.False(t, limiter.AllowAt(now))
+}
+
+func TestLimiter_Status(t *testing.T) {
+	now := time.Now()
+	limiter := NewLimiter(2, 4)
+
+	allowed, status := limiter.TakeAt(now)
+	assert.True(t, allowed)
+	assert.Equal(t, Status{
+		Limit:     4,
+		Remaining: 3,
+		// Refilling 1 token at 2 tokens per second.
+		Reset: time.Millisecond * 500,
+	}, status)
+
+	for i := 0; i != 3; i++ {
+		assert.True(t, limiter.AllowAt(now))
+	}
+	allowed, status = limiter.TakeAt(now)
+	assert.False(t, allowed)
+	assert.Equal(t, Status{
+		Limit:      4,
+		Remaining:  0,
+		RetryAfter: time.Millisecond * 500,
+		Reset:      time.Second * 2,
+	}, status)
+
+	// Half a token has refilled.
+	allowed, status = limiter.TakeAt(now.Add(time.Millisecond * 250))
+	assert.False(t, allowed)
+	assert.Equal(t, time.Millisecond*250, status.RetryAfter)
+	assert.Equal(t, time.Millisecond*1750, status.Reset)
+}
+
+func TestKeyedLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := NewKeyedLimiter(1, 1)
+
+	assert.True(t, limiter.AllowAt("a", now))
+	assert.False(t, limiter.AllowAt("a", now))
+	// Keys are limited independently.
+	assert.True(t, limiter.AllowAt("b", now))
+	assert.Equal(t, 2, limiter.Len())
+
+	// Idle keys are pruned.
+	now = now.Add(pruneInterval)
+	assert.True(t, limiter.AllowAt("a", now))
+	assert.Equal(t, 1, limiter.Len())
+}
+
+func TestBanList(t *testing.T) {
+	now := time.Now()
+	bans := NewBanList()
+
+	bans.Ban("a", now.Add(time.Minute))
+
+	until, ok := bans.BannedAt("a", now)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(time.Minute), until)
+
+	_, ok = bans.BannedAt("b", now)
+	assert.False(t, ok)
+
+	// A shorter ban doesn't replace a longer ban.
+	bans.Ban("a", now.Add(time.Second))
+	until, ok = bans.BannedAt("a", now)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(time.Minute), until)
+
+	// Expired.
+	_, ok = bans.BannedAt("a", now.Add(time.Minute))
+	assert.False(t, ok)
+	assert.Equal(t, 0, bans.Len())
+}
@@ -0,0 +1,231 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// LockoutConfig configures locking out keys, such as client IPs, with
+// repeated failures.
+type LockoutConfig struct {
+	// MaxFailures is the number of failures within FailureWindow before the
+	// key is locked out.
+	//
+	// Zero disables lockouts.
+	MaxFailures int `json:"max_failures" yaml:"max_failures"`
+
+	// FailureWindow is the window to count failures in.
+	FailureWindow time.Duration `json:"failure_window" yaml:"failure_window"`
+
+	// Duration is the duration of the first lockout. Each subsequent lockout
+	// doubles the duration, up to MaxDuration.
+	Duration time.Duration `json:"duration" yaml:"duration"`
+
+	// MaxDuration is the maximum lockout duration.
+	//
+	// Once a key has had no failures for MaxDuration, the lockout duration
+	// is reset.
+	MaxDuration time.Duration `json:"max_duration" yaml:"max_duration"`
+}
+
+// Enabled returns whether lockouts are enabled.
+func (c *LockoutConfig) Enabled() bool {
+	return c.MaxFailures != 0
+}
+
+func (c *LockoutConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.MaxFailures < 0 {
+		return fmt.Errorf("max failures cannot be negative")
+	}
+	if c.FailureWindow <= 0 {
+		return fmt.Errorf("missing failure window")
+	}
+	if c.Duration <= 0 {
+		return fmt.Errorf("missing duration")
+	}
+	if c.MaxDuration < c.Duration {
+		return fmt.Errorf("max duration is less than duration")
+	}
+	return nil
+}
+
+func (c *LockoutConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".auth-lockout."
+
+	fs.IntVar(
+		&c.MaxFailures,
+		prefix+"max-failures",
+		c.MaxFailures,
+		`
+The number of authentication failures from a client IP or token ID within
+the failure window before the client IP or token ID is locked out.
+
+While locked out, all requests from the client IP or using the token ID are
+rejected with '429 Too Many Requests'.
+
+Zero disables lockouts.`,
+	)
+	fs.DurationVar(
+		&c.FailureWindow,
+		prefix+"failure-window",
+		c.FailureWindow,
+		`
+The window to count authentication failures in.`,
+	)
+	fs.DurationVar(
+		&c.Duration,
+		prefix+"duration",
+		c.Duration,
+		`
+The duration of the first lockout. Each subsequent lockout doubles the
+duration, up to the max duration.`,
+	)
+	fs.DurationVar(
+		&c.MaxDuration,
+		prefix+"max-duration",
+		c.MaxDuration,
+		`
+The maximum lockout duration.
+
+Once a client IP or token ID has had no failures for the max duration, the
+lockout duration is reset.`,
+	)
+}
+
+type lockoutEntry struct {
+	// failures is the number of failures since windowStart.
+	failures    int
+	windowStart time.Time
+
+	lastFailure time.Time
+
+	// lockouts is the number of times the key has been locked out, used to
+	// compute the next lockout duration.
+	lockouts    int
+	lockedUntil time.Time
+}
+
+// Lockout tracks failures by key and locks out keys with repeated failures.
+//
+// Each time a key is locked out, the lockout duration doubles up to a
+// maximum, to slow down attackers making repeated attempts.
+type Lockout struct {
+	maxFailures   int
+	failureWindow time.Duration
+	duration      time.Duration
+	maxDuration   time.Duration
+
+	entries   map[string]*lockoutEntry
+	lastPrune time.Time
+
+	mu sync.Mutex
+}
+
+func NewLockout(conf LockoutConfig) *Lockout {
+	return &Lockout{
+		maxFailures:   conf.MaxFailures,
+		failureWindow: conf.FailureWindow,
+		duration:      conf.Duration,
+		maxDuration:   conf.MaxDuration,
+		entries:       make(map[string]*lockoutEntry),
+	}
+}
+
+// Locked returns whether the key is locked out now, and if so, when the
+// lockout expires.
+func (l *Lockout) Locked(key string) (time.Time, bool) {
+	return l.LockedAt(key, time.Now())
+}
+
+// LockedAt returns whether the key is locked out at the given time, and if
+// so, when the lockout expires.
+func (l *Lockout) LockedAt(key string, now time.Time) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok || !now.Before(e.lockedUntil) {
+		return time.Time{}, false
+	}
+	return e.lockedUntil, true
+}
+
+// Failure records a failure for the key. If the failure causes the key to be
+// locked out, returns the lockout duration.
+func (l *Lockout) Failure(key string) (time.Duration, bool) {
+	return l.FailureAt(key, time.Now())
+}
+
+// FailureAt records a failure for the key at the given time. If the failure
+// causes the key to be locked out, returns the lockout duration.
+func (l *Lockout) FailureAt(key string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPrune) >= pruneInterval {
+		l.pruneLocked(now)
+	}
+
+	e, ok := l.entries[key]
+	if !ok {
+		e = &lockoutEntry{}
+		l.entries[key] = e
+	}
+
+	// Reset the lockout duration if there have been no failures for the
+	// max duration.
+	if now.Sub(e.lastFailure) >= l.maxDuration {
+		e.lockouts = 0
+	}
+	e.lastFailure = now
+
+	if now.Sub(e.windowStart) >= l.failureWindow {
+		e.failures = 0
+		e.windowStart = now
+	}
+	e.failures++
+	if e.failures < l.maxFailures {
+		return 0, false
+	}
+
+	duration := l.duration
+	for i := 0; i != e.lockouts && duration < l.maxDuration; i++ {
+		duration *= 2
+	}
+	if duration > l.maxDuration {
+		duration = l.maxDuration
+	}
+
+	e.lockouts++
+	e.lockedUntil = now.Add(duration)
+	e.failures = 0
+	e.windowStart = now
+	return duration, true
+}
+
+// Len returns the number of tracked keys.
+func (l *Lockout) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.entries)
+}
+
+func (l *Lockout) pruneLocked(now time.Time) {
+	for key, e := range l.entries {
+		// Once the key has had no failures for the max duration, it is
+		// equivalent to a new key so can be discarded.
+		if now.Sub(e.lastFailure) >= l.maxDuration &&
+			now.Sub(e.lastFailure) >= l.failureWindow &&
+			!now.Before(e.lockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+	l.lastPrune = now
+}
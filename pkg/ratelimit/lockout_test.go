@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockout(t *testing.T) {
+	t.Run("lockout", func(t *testing.T) {
+		now := time.Now()
+		lockout := NewLockout(LockoutConfig{
+			MaxFailures:   3,
+			FailureWindow: time.Minute,
+			Duration:      time.Second * 10,
+			MaxDuration:   time.Hour,
+		})
+
+		_, locked := lockout.FailureAt("a", now)
+		assert.False(t, locked)
+		_, locked = lockout.FailureAt("a", now)
+		assert.False(t, locked)
+
+		duration, locked := lockout.FailureAt("a", now)
+		assert.True(t, locked)
+		assert.Equal(t, time.Second*10, duration)
+
+		until, locked := lockout.LockedAt("a", now)
+		assert.True(t, locked)
+		assert.Equal(t, now.Add(time.Second*10), until)
+
+		// Other keys are unaffected.
+		_, locked = lockout.LockedAt("b", now)
+		assert.False(t, locked)
+
+		// Lockout expires.
+		_, locked = lockout.LockedAt("a", now.Add(time.Second*10))
+		assert.False(t, locked)
+	})
+
+	t.Run("exponential", func(t *testing.T) {
+		now := time.Now()
+		lockout := NewLockout(LockoutConfig{
+			MaxFailures:   1,
+			FailureWindow: time.Minute,
+			Duration:      time.Second * 10,
+			MaxDuration:   time.Second * 30,
+		})
+
+		for _, expected := range []time.Duration{
+			time.Second * 10,
+			time.Second * 20,
+			time.Second * 30,
+			time.Second * 30,
+		} {
+			duration, locked := lockout.FailureAt("a", now)
+			assert.True(t, locked)
+			assert.Equal(t, expected, duration)
+			now = now.Add(time.Second)
+		}
+
+		// Resets once there have been no failures for the max duration.
+		now = now.Add(time.Second * 30)
+		duration, locked := lockout.FailureAt("a", now)
+		assert.True(t, locked)
+		assert.Equal(t, time.Second*10, duration)
+	})
+
+	t.Run("failure window", func(t *testing.T) {
+		now := time.Now()
+		lockout := NewLockout(LockoutConfig{
+			MaxFailures:   2,
+			FailureWindow: time.Minute,
+			Duration:      time.Second * 10,
+			MaxDuration:   time.Hour,
+		})
+
+		_, locked := lockout.FailureAt("a", now)
+		assert.False(t, locked)
+
+		// Failures outside the window are discarded.
+		_, locked = lockout.FailureAt("a", now.Add(time.Minute))
+		assert.False(t, locked)
+	})
+}
@@ -0,0 +1,103 @@
+// Package recovery isolates panics in the goroutines handling individual
+// requests and streams.
+//
+// Many streams are multiplexed over each upstream connection, so an
+// unrecovered panic handling one stream would crash the process and tear
+// down every other stream and connection. Instead the panic is recovered,
+// logged with its stack trace and counted, and only the stream that
+// panicked is closed.
+package recovery
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+type Metrics struct {
+	// PanicsTotal is the number of recovered panics. Labelled by the
+	// component that panicked.
+	PanicsTotal *prometheus.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		PanicsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Name:      "panics_total",
+				Help:      "Number of recovered panics",
+			},
+			[]string{"component"},
+		),
+	}
+}
+
+func (m *Metrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.PanicsTotal,
+	)
+}
+
+// Pool runs the goroutines of a component, such as the goroutines copying
+// between the connections of a proxied stream, and recovers their panics.
+type Pool struct {
+	component string
+
+	// metrics is nil if metrics are disabled.
+	metrics *Metrics
+
+	logger log.Logger
+}
+
+// NewPool returns a pool for the named component. metrics may be nil.
+func NewPool(component string, metrics *Metrics, logger log.Logger) *Pool {
+	return &Pool{
+		component: component,
+		metrics:   metrics,
+		logger:    logger,
+	}
+}
+
+// Go runs fn in a new goroutine, recovering any panic.
+func (p *Pool) Go(fn func()) {
+	go func() {
+		defer p.Recover()
+
+		fn()
+	}()
+}
+
+// Recover recovers a panic in the calling goroutine. It must be deferred
+// directly, such as 'defer pool.Recover()'.
+func (p *Pool) Recover() {
+	if err := recover(); err != nil {
+		p.Observe(err)
+	}
+}
+
+// Observe records a panic that was recovered by the caller, such as by an
+// HTTP router.
+func (p *Pool) Observe(err any) {
+	// http.ErrAbortHandler is used to abort a response, such as when the
+	// upstream closes mid-response, so isn't a bug.
+	if err == http.ErrAbortHandler {
+		return
+	}
+
+	if p.metrics != nil {
+		p.metrics.PanicsTotal.With(prometheus.Labels{
+			"component": p.component,
+		}).Inc()
+	}
+	p.logger.Error(
+		"recovered panic",
+		zap.String("component", p.component),
+		zap.Any("err", err),
+		zap.ByteString("stack", debug.Stack()),
+	)
+}
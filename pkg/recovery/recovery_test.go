@@ -0,0 +1,64 @@
+package recovery
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func TestPool(t *testing.T) {
+	t.Run("go", func(t *testing.T) {
+		metrics := NewMetrics()
+		pool := NewPool("test", metrics, log.NewNopLogger())
+
+		doneCh := make(chan struct{})
+		pool.Go(func() {
+			defer close(doneCh)
+			panic("injected panic")
+		})
+		<-doneCh
+
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(metrics.PanicsTotal.WithLabelValues("test")) == 1
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("recover", func(t *testing.T) {
+		metrics := NewMetrics()
+		pool := NewPool("test", metrics, log.NewNopLogger())
+
+		func() {
+			defer pool.Recover()
+			panic("injected panic")
+		}()
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.PanicsTotal.WithLabelValues("test")))
+	})
+
+	t.Run("abort handler", func(t *testing.T) {
+		metrics := NewMetrics()
+		pool := NewPool("test", metrics, log.NewNopLogger())
+
+		// Aborting a response isn't a bug so isn't counted.
+		func() {
+			defer pool.Recover()
+			panic(http.ErrAbortHandler)
+		}()
+
+		assert.Equal(t, 0.0, testutil.ToFloat64(metrics.PanicsTotal.WithLabelValues("test")))
+	})
+
+	t.Run("no metrics", func(t *testing.T) {
+		pool := NewPool("test", nil, log.NewNopLogger())
+
+		func() {
+			defer pool.Recover()
+			panic("injected panic")
+		}()
+	})
+}
@@ -0,0 +1,73 @@
+package spill
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Metrics struct {
+	// SpilledTotal is the number of buffers spilled to disk.
+	SpilledTotal prometheus.Counter
+
+	// RejectedTotal is the number of writes rejected as they exceeded a
+	// limit, labelled by reason ('buffer_size', 'disk_size' or 'quota').
+	RejectedTotal *prometheus.CounterVec
+
+	// DiskBytes is the total size of the spill files in bytes.
+	DiskBytes prometheus.GaugeFunc
+
+	// Files is the number of open spill files.
+	Files prometheus.GaugeFunc
+}
+
+func newMetrics(s *Spiller) *Metrics {
+	return &Metrics{
+		SpilledTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "spill",
+				Name:      "spilled_total",
+				Help:      "Number of buffers spilled to disk",
+			},
+		),
+		RejectedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "spill",
+				Name:      "rejected_total",
+				Help:      "Number of buffer writes rejected as they exceeded a limit",
+			},
+			[]string{"reason"},
+		),
+		DiskBytes: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "spill",
+				Name:      "disk_bytes",
+				Help:      "Total size of the spill files in bytes",
+			},
+			func() float64 {
+				return float64(s.diskSize.Load())
+			},
+		),
+		Files: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "spill",
+				Name:      "files",
+				Help:      "Number of open spill files",
+			},
+			func() float64 {
+				return float64(s.files.Load())
+			},
+		),
+	}
+}
+
+func (m *Metrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.SpilledTotal,
+		m.RejectedTotal,
+		m.DiskBytes,
+		m.Files,
+	)
+}
@@ -0,0 +1,379 @@
+// Package spill buffers bodies in memory up to a threshold, then spills
+// them to temporary files, so buffering large bodies doesn't grow the heap.
+package spill
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// filePattern is the pattern of spill file names.
+const filePattern = "piko-spill-*"
+
+var (
+	// ErrBufferTooLarge is returned when a write would exceed the maximum
+	// size of a buffer.
+	ErrBufferTooLarge = errors.New("buffer too large")
+
+	// ErrDiskFull is returned when spilling a write would exceed the maximum
+	// total size of the spill files.
+	ErrDiskFull = errors.New("spill disk limit exceeded")
+
+	ErrClosed = errors.New("buffer closed")
+)
+
+type options struct {
+	dir           string
+	maxBufferSize int64
+	maxDiskSize   int64
+	quota         Quota
+}
+
+// Quota is a disk usage quota shared with other users of the disk, such as
+// an area of the Piko data directory.
+type Quota interface {
+	// Reserve reserves n bytes, returning an error if the quota would be
+	// exceeded.
+	Reserve(n int64) error
+
+	// Release releases n reserved bytes.
+	Release(n int64)
+}
+
+type Option interface {
+	apply(*options)
+}
+
+type dirOption string
+
+func (o dirOption) apply(opts *options) {
+	opts.dir = string(o)
+}
+
+// WithDir configures the directory to write spill files to.
+//
+// Any spill files left in the directory, such as if the process crashed,
+// are removed by [New], so the directory must not be shared with other
+// processes.
+//
+// Defaults to the systems temporary directory, in which case existing files
+// are never removed.
+func WithDir(dir string) Option {
+	return dirOption(dir)
+}
+
+type maxBufferSizeOption int64
+
+func (o maxBufferSizeOption) apply(opts *options) {
+	opts.maxBufferSize = int64(o)
+}
+
+// WithMaxBufferSize configures the maximum size of each buffer in bytes,
+// including the bytes held in memory.
+//
+// Defaults to zero, which means unlimited.
+func WithMaxBufferSize(size int64) Option {
+	return maxBufferSizeOption(size)
+}
+
+type maxDiskSizeOption int64
+
+func (o maxDiskSizeOption) apply(opts *options) {
+	opts.maxDiskSize = int64(o)
+}
+
+// WithMaxDiskSize configures the maximum total size of all spill files in
+// bytes.
+//
+// Defaults to zero, which means unlimited.
+func WithMaxDiskSize(size int64) Option {
+	return maxDiskSizeOption(size)
+}
+
+type quotaOption struct {
+	Quota Quota
+}
+
+func (o quotaOption) apply(opts *options) {
+	opts.quota = o.Quota
+}
+
+// WithQuota configures a quota shared with other users of the disk. Spill
+// files reserve space from the quota in addition to the spillers own limit.
+func WithQuota(quota Quota) Option {
+	return quotaOption{Quota: quota}
+}
+
+// Spiller creates buffers that spill to disk once they exceed the memory
+// threshold, and enforces the limits across all buffers.
+type Spiller struct {
+	dir             string
+	memoryThreshold int64
+	maxBufferSize   int64
+	maxDiskSize     int64
+	quota           Quota
+
+	// diskSize is the total size of the spill files in bytes.
+	diskSize atomic.Int64
+	// files is the number of open spill files.
+	files atomic.Int64
+
+	metrics *Metrics
+}
+
+// New creates a spiller where buffers hold up to memoryThreshold bytes in
+// memory before spilling to disk.
+func New(memoryThreshold int64, opts ...Option) (*Spiller, error) {
+	options := options{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
+	s := &Spiller{
+		dir:             options.dir,
+		memoryThreshold: memoryThreshold,
+		maxBufferSize:   options.maxBufferSize,
+		maxDiskSize:     options.maxDiskSize,
+		quota:           options.quota,
+	}
+	s.metrics = newMetrics(s)
+
+	if s.dir != "" {
+		if err := os.MkdirAll(s.dir, 0o700); err != nil {
+			return nil, fmt.Errorf("create dir: %w", err)
+		}
+		if err := s.removeFiles(); err != nil {
+			return nil, fmt.Errorf("remove spill files: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// NewBuffer returns an empty buffer. The caller must close the buffer to
+// remove its spill file.
+func (s *Spiller) NewBuffer() *Buffer {
+	return &Buffer{spiller: s}
+}
+
+// DiskSize returns the total size of the spill files in bytes.
+func (s *Spiller) DiskSize() int64 {
+	return s.diskSize.Load()
+}
+
+func (s *Spiller) Metrics() *Metrics {
+	return s.metrics
+}
+
+// reserve reserves n bytes of spill disk space.
+func (s *Spiller) reserve(n int64) error {
+	size := s.diskSize.Add(n)
+	if s.maxDiskSize != 0 && size > s.maxDiskSize {
+		s.diskSize.Add(-n)
+		s.metrics.RejectedTotal.WithLabelValues("disk_size").Inc()
+		return ErrDiskFull
+	}
+	if s.quota != nil {
+		if err := s.quota.Reserve(n); err != nil {
+			s.diskSize.Add(-n)
+			s.metrics.RejectedTotal.WithLabelValues("quota").Inc()
+			return fmt.Errorf("%w: %w", ErrDiskFull, err)
+		}
+	}
+	return nil
+}
+
+func (s *Spiller) release(n int64) {
+	s.diskSize.Add(-n)
+	if s.quota != nil {
+		s.quota.Release(n)
+	}
+}
+
+// removeFiles removes spill files left in the spill directory.
+func (s *Spiller) removeFiles() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, filePattern))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Buffer is a body buffered in memory or a spill file.
+//
+// The buffer is written once then read any number of times, such as to
+// replay a body when retrying. Writes must not be concurrent with reads.
+type Buffer struct {
+	spiller *Spiller
+
+	mem  bytes.Buffer
+	file *os.File
+	size int64
+
+	closed bool
+	mu     sync.Mutex
+}
+
+// Write appends p to the buffer, spilling to disk once the buffer exceeds
+// the memory threshold.
+func (b *Buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return 0, ErrClosed
+	}
+
+	n := int64(len(p))
+	if b.spiller.maxBufferSize != 0 && b.size+n > b.spiller.maxBufferSize {
+		b.spiller.metrics.RejectedTotal.WithLabelValues("buffer_size").Inc()
+		return 0, ErrBufferTooLarge
+	}
+
+	if b.file == nil && b.size+n <= b.spiller.memoryThreshold {
+		b.mem.Write(p)
+		b.size += n
+		return len(p), nil
+	}
+
+	// Reserve the disk space for the write, and for the bytes buffered in
+	// memory if spilling, before creating the spill file.
+	reserved := n
+	if b.file == nil {
+		reserved += b.size
+	}
+	if err := b.spiller.reserve(reserved); err != nil {
+		return 0, err
+	}
+	if b.file == nil {
+		if err := b.spillLocked(); err != nil {
+			b.spiller.release(reserved)
+			return 0, err
+		}
+	}
+
+	written, err := b.file.Write(p)
+	b.size += int64(written)
+	// Release the reserved bytes that weren't written.
+	b.spiller.release(n - int64(written))
+	if err != nil {
+		return written, fmt.Errorf("write spill file: %w", err)
+	}
+	return written, nil
+}
+
+// ReadFrom reads r into the buffer until EOF.
+func (b *Buffer) ReadFrom(r io.Reader) (int64, error) {
+	var read int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			written, werr := b.Write(buf[:n])
+			read += int64(written)
+			if werr != nil {
+				return read, werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+}
+
+// Reader returns a reader of the buffered bytes from the start of the
+// buffer. Each call returns a new independent reader.
+func (b *Buffer) Reader() (*io.SectionReader, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrClosed
+	}
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size), nil
+	}
+	return io.NewSectionReader(bytes.NewReader(b.mem.Bytes()), 0, b.size), nil
+}
+
+// Len returns the number of buffered bytes.
+func (b *Buffer) Len() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.size
+}
+
+// Spilled returns whether the buffer was spilled to disk.
+func (b *Buffer) Spilled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.file != nil
+}
+
+// Close discards the buffer and removes its spill file. Close is safe to
+// call multiple times.
+func (b *Buffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.mem = bytes.Buffer{}
+
+	if b.file == nil {
+		return nil
+	}
+
+	b.spiller.release(b.size)
+	b.spiller.files.Add(-1)
+
+	path := b.file.Name()
+	closeErr := b.file.Close()
+	b.file = nil
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("remove spill file: %w", err)
+	}
+	return closeErr
+}
+
+// spillLocked creates the spill file and moves the bytes buffered in memory
+// to the file. The caller must reserve the disk space.
+func (b *Buffer) spillLocked() error {
+	file, err := os.CreateTemp(b.spiller.dir, filePattern)
+	if err != nil {
+		return fmt.Errorf("create spill file: %w", err)
+	}
+	if _, err := file.Write(b.mem.Bytes()); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return fmt.Errorf("write spill file: %w", err)
+	}
+
+	b.file = file
+	b.mem = bytes.Buffer{}
+	b.spiller.files.Add(1)
+	b.spiller.metrics.SpilledTotal.Inc()
+	return nil
+}
+
+var _ io.Writer = &Buffer{}
+var _ io.ReaderFrom = &Buffer{}
@@ -0,0 +1,128 @@
+package spill
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func spillFiles(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, filePattern))
+	require.NoError(t, err)
+	return paths
+}
+
+func readAll(t *testing.T, b *Buffer) []byte {
+	r, err := b.Reader()
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return data
+}
+
+func TestBuffer(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := New(10, WithDir(dir))
+		require.NoError(t, err)
+
+		b := s.NewBuffer()
+		defer b.Close()
+
+		_, err = b.Write([]byte("foo"))
+		require.NoError(t, err)
+		_, err = b.Write([]byte("bar"))
+		require.NoError(t, err)
+
+		assert.False(t, b.Spilled())
+		assert.Equal(t, int64(6), b.Len())
+		assert.Equal(t, []byte("foobar"), readAll(t, b))
+		assert.Empty(t, spillFiles(t, dir))
+	})
+
+	t.Run("spill", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := New(10, WithDir(dir))
+		require.NoError(t, err)
+
+		b := s.NewBuffer()
+
+		data := bytes.Repeat([]byte("a"), 100)
+		n, err := b.ReadFrom(bytes.NewReader(data))
+		require.NoError(t, err)
+		assert.Equal(t, int64(100), n)
+
+		assert.True(t, b.Spilled())
+		assert.Equal(t, int64(100), s.DiskSize())
+		assert.Len(t, spillFiles(t, dir), 1)
+
+		// Each reader reads from the start.
+		assert.Equal(t, data, readAll(t, b))
+		assert.Equal(t, data, readAll(t, b))
+
+		require.NoError(t, b.Close())
+		assert.Equal(t, int64(0), s.DiskSize())
+		assert.Empty(t, spillFiles(t, dir))
+
+		// Close is idempotent.
+		assert.NoError(t, b.Close())
+		_, err = b.Reader()
+		assert.ErrorIs(t, err, ErrClosed)
+	})
+
+	t.Run("max buffer size", func(t *testing.T) {
+		s, err := New(10, WithDir(t.TempDir()), WithMaxBufferSize(20))
+		require.NoError(t, err)
+
+		b := s.NewBuffer()
+		defer b.Close()
+
+		_, err = b.Write(bytes.Repeat([]byte("a"), 15))
+		require.NoError(t, err)
+		_, err = b.Write(bytes.Repeat([]byte("a"), 10))
+		assert.ErrorIs(t, err, ErrBufferTooLarge)
+	})
+
+	t.Run("max disk size", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := New(10, WithDir(dir), WithMaxDiskSize(30))
+		require.NoError(t, err)
+
+		b1 := s.NewBuffer()
+		defer b1.Close()
+		_, err = b1.Write(bytes.Repeat([]byte("a"), 20))
+		require.NoError(t, err)
+
+		// The limit applies across buffers.
+		b2 := s.NewBuffer()
+		defer b2.Close()
+		_, err = b2.Write(bytes.Repeat([]byte("a"), 20))
+		assert.ErrorIs(t, err, ErrDiskFull)
+		assert.Len(t, spillFiles(t, dir), 1)
+
+		// Closing the first buffer frees its disk space.
+		require.NoError(t, b1.Close())
+		_, err = b2.Write(bytes.Repeat([]byte("a"), 20))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(20), s.DiskSize())
+	})
+
+	t.Run("remove leftover files", func(t *testing.T) {
+		dir := t.TempDir()
+		leftover := filepath.Join(dir, "piko-spill-123")
+		require.NoError(t, os.WriteFile(leftover, []byte("foo"), 0o600))
+		other := filepath.Join(dir, "other")
+		require.NoError(t, os.WriteFile(other, []byte("foo"), 0o600))
+
+		_, err := New(10, WithDir(dir))
+		require.NoError(t, err)
+
+		assert.NoFileExists(t, leftover)
+		assert.FileExists(t, other)
+	})
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Metrics struct {
+	// RejectedTotal is the number of reservations rejected as they would
+	// exceed the quota, labelled by area.
+	RejectedTotal *prometheus.CounterVec
+
+	// EvictedBytesTotal is the number of bytes evicted to make space for
+	// reservations, labelled by area.
+	EvictedBytesTotal *prometheus.CounterVec
+
+	// used and limit are computed from the manager when collected.
+	used    *prometheus.Desc
+	limit   *prometheus.Desc
+	manager *Manager
+}
+
+func newMetrics(m *Manager) *Metrics {
+	return &Metrics{
+		RejectedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "storage",
+				Name:      "rejected_total",
+				Help:      "Number of disk reservations rejected as they would exceed the quota",
+			},
+			[]string{"area"},
+		),
+		EvictedBytesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "storage",
+				Name:      "evicted_bytes_total",
+				Help:      "Number of bytes evicted to make space for disk reservations",
+			},
+			[]string{"area"},
+		),
+		used: prometheus.NewDesc(
+			"piko_storage_used_bytes",
+			"Reserved disk space in bytes",
+			[]string{"area"},
+			nil,
+		),
+		limit: prometheus.NewDesc(
+			"piko_storage_limit_bytes",
+			"Disk usage quota in bytes, or zero if there is no quota",
+			nil,
+			nil,
+		),
+		manager: m,
+	}
+}
+
+func (m *Metrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.RejectedTotal,
+		m.EvictedBytesTotal,
+		&collector{metrics: m},
+	)
+}
+
+// collector collects the disk usage metrics.
+type collector struct {
+	metrics *Metrics
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.metrics.used
+	ch <- c.metrics.limit
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	m := c.metrics.manager
+
+	m.mu.Lock()
+	used := make(map[string]int64, len(m.areas))
+	for name, a := range m.areas {
+		used[name] = a.used
+	}
+	m.mu.Unlock()
+
+	for name, n := range used {
+		ch <- prometheus.MustNewConstMetric(
+			c.metrics.used,
+			prometheus.GaugeValue,
+			float64(n),
+			name,
+		)
+	}
+	ch <- prometheus.MustNewConstMetric(
+		c.metrics.limit,
+		prometheus.GaugeValue,
+		float64(m.maxSize),
+	)
+}
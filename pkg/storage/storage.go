@@ -0,0 +1,318 @@
+// Package storage manages the data directory shared by features that write
+// to disk, such as resumable uploads, queued requests and spill buffers, with
+// a global disk usage quota.
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// Eviction policies.
+const (
+	// EvictionNone rejects writes that would exceed the quota.
+	EvictionNone = "none"
+
+	// EvictionLRU evicts the least recently used evictable data, such as
+	// idle incomplete uploads, to make space for writes that would exceed
+	// the quota. Writes are only rejected if not enough data can be evicted.
+	EvictionLRU = "lru"
+)
+
+// ErrQuotaExceeded is returned when a reservation would exceed the disk
+// usage quota.
+var ErrQuotaExceeded = errors.New("disk quota exceeded")
+
+// Evictor frees disk space in an area by discarding data, such as idle
+// incomplete uploads, least recently used first.
+//
+// It discards data until at least n bytes are freed or nothing else can be
+// discarded, releasing the freed bytes with [Area.Release].
+type Evictor func(n int64)
+
+// Manager manages the disk usage of a set of areas, where each area is a
+// directory used by one feature.
+//
+// Features reserve disk space before writing and release it after removing
+// data, so the manager enforces the quota across all areas.
+type Manager struct {
+	dir      string
+	maxSize  int64
+	eviction string
+
+	areas map[string]*Area
+	// used is the total reserved bytes across all areas.
+	used int64
+	mu   sync.Mutex
+
+	metrics *Metrics
+
+	logger log.Logger
+}
+
+// NewManager creates a manager for the areas in the data directory dir.
+//
+// maxSize is the quota of the total disk usage of all areas in bytes, or zero
+// for no quota. eviction is the eviction policy used when a reservation would
+// exceed the quota.
+func NewManager(dir string, maxSize int64, eviction string, logger log.Logger) *Manager {
+	if eviction == "" {
+		eviction = EvictionLRU
+	}
+	m := &Manager{
+		dir:      dir,
+		maxSize:  maxSize,
+		eviction: eviction,
+		areas:    make(map[string]*Area),
+		logger:   logger.WithSubsystem("storage"),
+	}
+	m.metrics = newMetrics(m)
+	return m
+}
+
+// Area returns the area with the given name, creating it if needed.
+//
+// The area is stored in path if not empty, otherwise in the subdirectory of
+// the data directory with the area name. If the manager has no data
+// directory and path is empty, the area path is empty and the feature should
+// use its own default.
+func (m *Manager) Area(name string, path string) *Area {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if a, ok := m.areas[name]; ok {
+		return a
+	}
+
+	if path == "" && m.dir != "" {
+		path = filepath.Join(m.dir, name)
+	}
+	a := &Area{
+		name:    name,
+		path:    path,
+		manager: m,
+	}
+	m.areas[name] = a
+	return a
+}
+
+// Used returns the total reserved bytes across all areas.
+func (m *Manager) Used() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.used
+}
+
+func (m *Manager) Metrics() *Metrics {
+	return m.metrics
+}
+
+func (m *Manager) reserve(a *Area, n int64) error {
+	if m.tryReserve(a, n) {
+		return nil
+	}
+
+	if m.eviction == EvictionLRU {
+		m.evict(m.Used() + n - m.maxSize)
+		if m.tryReserve(a, n) {
+			return nil
+		}
+	}
+
+	m.metrics.RejectedTotal.WithLabelValues(a.name).Inc()
+	m.logger.Warn(
+		"disk quota exceeded",
+		zap.String("area", a.name),
+		zap.Int64("size", n),
+	)
+	return ErrQuotaExceeded
+}
+
+func (m *Manager) tryReserve(a *Area, n int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.maxSize != 0 && m.used+n > m.maxSize {
+		return false
+	}
+	m.used += n
+	a.used += n
+	return true
+}
+
+func (m *Manager) release(a *Area, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n = min(n, a.used)
+	m.used -= n
+	a.used -= n
+}
+
+// evict evicts at least n bytes from the areas with an evictor, if possible.
+func (m *Manager) evict(n int64) {
+	m.mu.Lock()
+	var areas []*Area
+	for _, a := range m.areas {
+		if a.evictor != nil {
+			areas = append(areas, a)
+		}
+	}
+	m.mu.Unlock()
+
+	// Evict from the largest areas first.
+	sort.Slice(areas, func(i, j int) bool {
+		return areas[i].Used() > areas[j].Used()
+	})
+
+	for _, a := range areas {
+		if n <= 0 {
+			return
+		}
+		before := a.Used()
+		// Call the evictor without holding the lock, since it releases the
+		// evicted bytes.
+		a.evictor(n)
+		evicted := before - a.Used()
+		if evicted > 0 {
+			m.metrics.EvictedBytesTotal.WithLabelValues(a.name).Add(float64(evicted))
+			n -= evicted
+		}
+	}
+}
+
+// Area is a directory used by one feature, whose disk usage counts towards
+// the managers quota.
+type Area struct {
+	name    string
+	path    string
+	manager *Manager
+
+	// used is the reserved bytes in the area. Guarded by the managers mutex.
+	used int64
+
+	evictor Evictor
+}
+
+// Name returns the area name.
+func (a *Area) Name() string {
+	return a.name
+}
+
+// Path returns the area directory, or an empty string if the feature should
+// use its own default.
+func (a *Area) Path() string {
+	return a.path
+}
+
+// SetEvictor sets the evictor used to free space in the area when the quota
+// is exceeded. Areas without an evictor are never evicted.
+func (a *Area) SetEvictor(evictor Evictor) {
+	a.manager.mu.Lock()
+	defer a.manager.mu.Unlock()
+
+	a.evictor = evictor
+}
+
+// Reserve reserves n bytes of disk space before writing, returning
+// [ErrQuotaExceeded] if the write would exceed the quota.
+func (a *Area) Reserve(n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	return a.manager.reserve(a, n)
+}
+
+// Account records n bytes written without enforcing the quota, for writes
+// that must not fail, such as moving existing data within the area.
+func (a *Area) Account(n int64) {
+	if n <= 0 {
+		return
+	}
+
+	a.manager.mu.Lock()
+	defer a.manager.mu.Unlock()
+
+	a.manager.used += n
+	a.used += n
+}
+
+// Release releases n bytes of disk space after removing data.
+func (a *Area) Release(n int64) {
+	if n <= 0 {
+		return
+	}
+	a.manager.release(a, n)
+}
+
+// Used returns the reserved bytes in the area.
+func (a *Area) Used() int64 {
+	a.manager.mu.Lock()
+	defer a.manager.mu.Unlock()
+
+	return a.used
+}
+
+// Scan sets the areas usage to the total size of the files in the area
+// directory, such as to account for data persisted before a restart.
+//
+// Existing data is always accounted for, even if it exceeds the quota.
+func (a *Area) Scan() error {
+	if a.path == "" {
+		return nil
+	}
+
+	var size int64
+	err := filepath.WalkDir(a.path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	a.manager.mu.Lock()
+	defer a.manager.mu.Unlock()
+
+	a.manager.used += size - a.used
+	a.used = size
+	return nil
+}
+
+// RemoveFile removes the file at path and releases its size.
+func (a *Area) RemoveFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	a.Release(info.Size())
+	return nil
+}
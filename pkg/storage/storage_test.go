@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func TestManager_Reserve(t *testing.T) {
+	m := NewManager("", 100, EvictionNone, log.NewNopLogger())
+	a := m.Area("a", "")
+	b := m.Area("b", "")
+
+	require.NoError(t, a.Reserve(60))
+	// The quota is shared across areas.
+	assert.ErrorIs(t, b.Reserve(50), ErrQuotaExceeded)
+	require.NoError(t, b.Reserve(40))
+	assert.Equal(t, int64(100), m.Used())
+
+	a.Release(60)
+	assert.Equal(t, int64(0), a.Used())
+	assert.NoError(t, b.Reserve(50))
+
+	// Accounted bytes aren't limited by the quota.
+	a.Account(100)
+	assert.Equal(t, int64(190), m.Used())
+}
+
+func TestManager_Evict(t *testing.T) {
+	m := NewManager("", 100, EvictionLRU, log.NewNopLogger())
+
+	uploads := m.Area("uploads", "")
+	items := []int64{30, 30, 30}
+	uploads.SetEvictor(func(n int64) {
+		var freed int64
+		for len(items) > 0 && freed < n {
+			uploads.Release(items[0])
+			freed += items[0]
+			items = items[1:]
+		}
+	})
+	for _, size := range items {
+		require.NoError(t, uploads.Reserve(size))
+	}
+
+	// Evicts the first two items to make space.
+	queue := m.Area("queue", "")
+	require.NoError(t, queue.Reserve(50))
+	assert.Equal(t, []int64{30}, items)
+	assert.Equal(t, int64(80), m.Used())
+
+	// Rejected if not enough data can be evicted.
+	assert.ErrorIs(t, uploads.Reserve(80), ErrQuotaExceeded)
+}
+
+func TestArea_Path(t *testing.T) {
+	m := NewManager("/data", 0, EvictionLRU, log.NewNopLogger())
+	assert.Equal(t, filepath.Join("/data", "uploads"), m.Area("uploads", "").Path())
+	assert.Equal(t, "/uploads", m.Area("queue", "/uploads").Path())
+
+	m = NewManager("", 0, EvictionLRU, log.NewNopLogger())
+	assert.Equal(t, "", m.Area("uploads", "").Path())
+}
+
+func TestArea_Scan(t *testing.T) {
+	dir := t.TempDir()
+	m := NewManager(dir, 0, EvictionLRU, log.NewNopLogger())
+	a := m.Area("queue", "")
+
+	require.NoError(t, os.MkdirAll(filepath.Join(a.Path(), "dead"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(a.Path(), "1"), make([]byte, 10), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(a.Path(), "dead", "2"), make([]byte, 20), 0o600))
+
+	require.NoError(t, a.Scan())
+	assert.Equal(t, int64(30), a.Used())
+	assert.Equal(t, int64(30), m.Used())
+
+	require.NoError(t, a.RemoveFile(filepath.Join(a.Path(), "1")))
+	assert.Equal(t, int64(20), m.Used())
+}
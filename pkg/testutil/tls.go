@@ -26,7 +26,9 @@ func LocalTLSServerCert() (*x509.CertPool, tls.Certificate, error) {
 	// CA certificate.
 	rootTemplate.IsCA = true
 	rootTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
-	rootTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	rootTemplate.ExtKeyUsage = []x509.ExtKeyUsage{
+		x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+	}
 
 	_, rootCert, err := cert(
 		rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey,
@@ -44,7 +46,11 @@ func LocalTLSServerCert() (*x509.CertPool, tls.Certificate, error) {
 		return nil, tls.Certificate{}, fmt.Errorf("server cert template: %w", err)
 	}
 	serverTemplate.KeyUsage = x509.KeyUsageDigitalSignature
-	serverTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	// Permit client auth so the certificate can also be used as a client
+	// certificate.
+	serverTemplate.ExtKeyUsage = []x509.ExtKeyUsage{
+		x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+	}
 	serverTemplate.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
 
 	// Sign the cert using the root CA.
@@ -0,0 +1,121 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseCode is the WebSocket close code sent when closing a Piko
+// connection, so the peer can distinguish deliberate disconnects from
+// failures.
+type CloseCode int
+
+const (
+	// CloseNormal indicates the peer closed the connection, such as the
+	// agent closing its listener.
+	CloseNormal CloseCode = websocket.CloseNormalClosure
+	// CloseGoingAway indicates the server is shutting down.
+	CloseGoingAway CloseCode = websocket.CloseGoingAway
+	// CloseProtocolError indicates the peer sent an invalid frame.
+	CloseProtocolError CloseCode = websocket.CloseProtocolError
+	// CloseAbnormal indicates the connection closed without a close code,
+	// such as the connection dropping. This is never sent.
+	CloseAbnormal CloseCode = websocket.CloseAbnormalClosure
+
+	// Piko close codes use the private 4000-4999 range.
+
+	// CloseAuthExpired indicates the token used to authenticate the
+	// connection expired.
+	CloseAuthExpired CloseCode = 4001
+	// CloseDrained indicates the connection was drained, so the peer should
+	// already have reconnected.
+	CloseDrained CloseCode = 4002
+	// CloseEvicted indicates the connection was replaced by a newer
+	// connection resuming the same session.
+	CloseEvicted CloseCode = 4003
+)
+
+// String returns the close reason, such as 'auth_expired'.
+func (c CloseCode) String() string {
+	switch c {
+	case CloseNormal:
+		return "normal"
+	case CloseGoingAway:
+		return "going_away"
+	case CloseProtocolError:
+		return "protocol_error"
+	case CloseAbnormal:
+		return "abnormal"
+	case CloseAuthExpired:
+		return "auth_expired"
+	case CloseDrained:
+		return "drained"
+	case CloseEvicted:
+		return "evicted"
+	default:
+		return "code_" + strconv.Itoa(int(c))
+	}
+}
+
+// Deliberate returns whether the connection was closed deliberately, rather
+// than due to a failure.
+func (c CloseCode) Deliberate() bool {
+	switch c {
+	case CloseNormal, CloseGoingAway, CloseAuthExpired, CloseDrained, CloseEvicted:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseError is returned when the peer closed the connection, with the
+// close code sent by the peer.
+//
+// CloseError matches [net.ErrClosed] with [errors.Is].
+type CloseError struct {
+	Code CloseCode
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	if e.Text != "" && e.Text != e.Code.String() {
+		return fmt.Sprintf("closed by peer: %s (%d): %s", e.Code, int(e.Code), e.Text)
+	}
+	return fmt.Sprintf("closed by peer: %s (%d)", e.Code, int(e.Code))
+}
+
+func (e *CloseError) Is(target error) bool {
+	return target == net.ErrClosed
+}
+
+// CloseCodeOf returns the close code the peer closed the connection with,
+// or [CloseAbnormal] if the error doesn't contain a close code.
+func CloseCodeOf(err error) CloseCode {
+	var closeErr *CloseError
+	if errors.As(err, &closeErr) {
+		return closeErr.Code
+	}
+	return CloseAbnormal
+}
+
+// WriteClose sends a close frame with the given close code to the peer.
+// This doesn't close the connection.
+func (c *Conn) WriteClose(code CloseCode, deadline time.Time) error {
+	return c.wsConn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(int(code), code.String()),
+		deadline,
+	)
+}
+
+func newCloseError(err *websocket.CloseError) *CloseError {
+	return &CloseError{
+		Code: CloseCode(err.Code),
+		Text: err.Text,
+	}
+}
@@ -9,25 +9,36 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/andydunstall/piko/pkg/protocol"
 )
 
-// retryableStatusCodes contains a set of HTTP status codes that should be
-// retried.
-var retryableStatusCodes = map[int]struct{}{
-	http.StatusRequestTimeout:      {},
-	http.StatusTooManyRequests:     {},
-	http.StatusInternalServerError: {},
-	http.StatusBadGateway:          {},
-	http.StatusServiceUnavailable:  {},
-	http.StatusGatewayTimeout:      {},
-}
+// MaxMessageSize is the maximum size of a WebSocket message written by
+// [Conn].
+//
+// Larger writes are split into multiple messages, so peers that read whole
+// messages into memory (such as with [websocket.Conn.ReadMessage]) only
+// buffer up to MaxMessageSize at a time. [Conn] itself streams messages in
+// both directions, so its memory use doesn't depend on the message size.
+//
+// The message size can be reduced with [Conn.SetMessageSize].
+const MaxMessageSize = 64 << 10
+
+// MinMessageSize is the minimum message size that can be configured with
+// [Conn.SetMessageSize].
+const MinMessageSize = 1 << 10
+
+// drainPayload is the payload of the ping sent by [Conn.Drain].
+const drainPayload = "piko-drain"
 
 type errorMessage struct {
 	Error string `json:"error"`
+	Code  string `json:"code"`
 }
 
 // RetryableError indicates a error is retryable.
@@ -48,8 +59,12 @@ func (e *RetryableError) Error() string {
 }
 
 type dialOptions struct {
-	token     string
-	tlsConfig *tls.Config
+	token       string
+	tlsConfig   *tls.Config
+	header      http.Header
+	localAddr   net.Addr
+	rttHeader   string
+	messageSize int
 }
 
 type DialOption interface {
@@ -78,6 +93,66 @@ func WithTLSConfig(config *tls.Config) DialOption {
 	return tlsConfigOption{TLSConfig: config}
 }
 
+type headerOption struct {
+	Key   string
+	Value string
+}
+
+func (o headerOption) apply(opts *dialOptions) {
+	if opts.header == nil {
+		opts.header = make(http.Header)
+	}
+	opts.header.Set(o.Key, o.Value)
+}
+
+// WithHeader adds a header to the WebSocket handshake request.
+func WithHeader(key string, value string) DialOption {
+	return headerOption{Key: key, Value: value}
+}
+
+type localAddrOption struct {
+	LocalAddr net.Addr
+}
+
+func (o localAddrOption) apply(opts *dialOptions) {
+	opts.localAddr = o.LocalAddr
+}
+
+// WithLocalAddr configures the local address to dial from, such as to
+// connect using a particular network interface.
+//
+// If nil, the local address is chosen automatically.
+func WithLocalAddr(addr net.Addr) DialOption {
+	return localAddrOption{LocalAddr: addr}
+}
+
+type rttHeaderOption string
+
+func (o rttHeaderOption) apply(opts *dialOptions) {
+	opts.rttHeader = string(o)
+}
+
+// WithRTTHeader measures the duration of the TCP connect, as an estimate of
+// the round trip time to the server, and adds it to the WebSocket handshake
+// request in the given header, formatted in seconds.
+//
+// The measured duration is also available with [Conn.DialRTT].
+func WithRTTHeader(key string) DialOption {
+	return rttHeaderOption(key)
+}
+
+type messageSizeOption int
+
+func (o messageSizeOption) apply(opts *dialOptions) {
+	opts.messageSize = int(o)
+}
+
+// WithMessageSize configures the maximum size of each message written to
+// the connection (see [Conn.SetMessageSize]).
+func WithMessageSize(size int) DialOption {
+	return messageSizeOption(size)
+}
+
 // Conn implements a [net.Conn] using WebSockets as the underlying transport.
 //
 // This adds a small amount of overhead compared to using TCP directly, though
@@ -86,12 +161,18 @@ type Conn struct {
 	wsConn *websocket.Conn
 
 	reader io.Reader
+
+	// messageSize is the maximum size of each written message.
+	messageSize int
+
+	dialRTT time.Duration
 }
 
 func New(wsConn *websocket.Conn) *Conn {
 	return &Conn{
-		wsConn: wsConn,
-		reader: nil,
+		wsConn:      wsConn,
+		reader:      nil,
+		messageSize: MaxMessageSize,
 	}
 }
 
@@ -108,17 +189,57 @@ func Dial(ctx context.Context, url string, opts ...DialOption) (*Conn, error) {
 	if options.tlsConfig != nil {
 		dialer.TLSClientConfig = options.tlsConfig
 	}
+	netDialer := &net.Dialer{
+		LocalAddr: options.localAddr,
+	}
+	if options.localAddr != nil {
+		dialer.NetDialContext = netDialer.DialContext
+	}
 
-	header := make(http.Header)
+	header := options.header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
 	if options.token != "" {
 		header.Set("Authorization", "Bearer "+options.token)
 	}
 
+	var dialRTT time.Duration
+	if options.rttHeader != "" {
+		// Connect before the handshake to add the measured RTT to the
+		// handshake request.
+		netConn, rtt, err := dialTimed(ctx, netDialer, url)
+		if err != nil {
+			return nil, NewRetryableError(err)
+		}
+		defer func() {
+			if netConn != nil {
+				netConn.Close()
+			}
+		}()
+
+		dialRTT = rtt
+		header.Set(options.rttHeader, protocol.FormatSeconds(rtt))
+		dialer.NetDialContext = func(context.Context, string, string) (net.Conn, error) {
+			if netConn == nil {
+				return nil, errors.New("connection already used")
+			}
+			conn := netConn
+			netConn = nil
+			return conn, nil
+		}
+	}
+
 	wsConn, resp, err := dialer.DialContext(
 		ctx, url, header,
 	)
 	if err == nil {
-		return New(wsConn), nil
+		conn := New(wsConn)
+		conn.dialRTT = dialRTT
+		if options.messageSize != 0 {
+			conn.SetMessageSize(options.messageSize)
+		}
+		return conn, nil
 	}
 	if resp == nil {
 		return nil, NewRetryableError(err)
@@ -126,20 +247,47 @@ func Dial(ctx context.Context, url string, opts ...DialOption) (*Conn, error) {
 	defer resp.Body.Close()
 
 	// If the error has a JSON response parse the error message.
-	if strings.HasPrefix(resp.Header.Get("content-type"), "application/json") {
-		var m errorMessage
-		if decodeErr := json.NewDecoder(resp.Body).Decode(&m); decodeErr == nil {
-			err = errors.New(m.Error)
+	var m errorMessage
+	if strings.HasPrefix(resp.Header.Get("content-type"), "application/json") &&
+		json.NewDecoder(resp.Body).Decode(&m) == nil {
+		err = &protocol.Error{
+			StatusCode: resp.StatusCode,
+			Code:       m.Code,
+			Message:    m.Error,
 		}
+	} else {
+		err = fmt.Errorf("%d: %w", resp.StatusCode, err)
 	}
-
-	err = fmt.Errorf("%d: %w", resp.StatusCode, err)
-	if _, ok := retryableStatusCodes[resp.StatusCode]; ok {
+	if protocol.Retryable(resp.StatusCode) {
 		return nil, NewRetryableError(err)
 	}
 	return nil, err
 }
 
+// SetMessageSize sets the maximum size of each message written to the
+// connection, clamped between [MinMessageSize] and [MaxMessageSize].
+//
+// Smaller messages bound the size of each WebSocket frame (and TLS record),
+// which can improve reliability on networks that drop large packets, at the
+// cost of more per-message overhead.
+//
+// This must be called before the connection is used.
+func (c *Conn) SetMessageSize(size int) {
+	c.messageSize = min(max(size, MinMessageSize), MaxMessageSize)
+}
+
+// MessageSize returns the maximum size of each message written to the
+// connection.
+func (c *Conn) MessageSize() int {
+	return c.messageSize
+}
+
+// DialRTT returns the duration of the TCP connect, if measured with
+// [WithRTTHeader], otherwise zero.
+func (c *Conn) DialRTT() time.Duration {
+	return c.dialRTT
+}
+
 func (c *Conn) Read(b []byte) (int, error) {
 	for {
 		if c.reader == nil {
@@ -147,7 +295,7 @@ func (c *Conn) Read(b []byte) (int, error) {
 			if err != nil {
 				var closeErr *websocket.CloseError
 				if errors.As(err, &closeErr) {
-					return 0, net.ErrClosed
+					return 0, newCloseError(closeErr)
 				}
 				return 0, err
 			}
@@ -170,7 +318,7 @@ func (c *Conn) Read(b []byte) (int, error) {
 		if err != io.EOF {
 			var closeErr *websocket.CloseError
 			if errors.As(err, &closeErr) {
-				return 0, net.ErrClosed
+				return 0, newCloseError(closeErr)
 			}
 			return 0, err
 		}
@@ -180,15 +328,81 @@ func (c *Conn) Read(b []byte) (int, error) {
 	}
 }
 
+// Write writes b to the connection, split into messages of at most the
+// configured message size.
 func (c *Conn) Write(b []byte) (int, error) {
+	var written int
+	for {
+		chunk := b[written:min(written+c.messageSize, len(b))]
+		if err := c.writeMessage(chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		if written == len(b) {
+			return written, nil
+		}
+	}
+}
+
+// ReadFrom streams data from r to the connection until EOF or an error
+// occurs.
+//
+// This implements [io.ReaderFrom], so [io.Copy] to the connection writes
+// messages of up to the configured message size rather than being limited by
+// the size of the default copy buffer.
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, c.messageSize)
+	var written int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if werr := c.writeMessage(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+		}
+		if err != nil {
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
+		}
+	}
+}
+
+func (c *Conn) writeMessage(b []byte) error {
 	if err := c.wsConn.WriteMessage(websocket.BinaryMessage, b); err != nil {
 		var closeErr *websocket.CloseError
 		if errors.As(err, &closeErr) {
-			return 0, net.ErrClosed
+			return net.ErrClosed
 		}
-		return 0, err
+		return err
 	}
-	return len(b), nil
+	return nil
+}
+
+// Drain notifies the peer the connection is draining, so the peer should
+// open a new connection while requests on this connection complete.
+//
+// The notification is a ping control frame with a drain payload, so peers
+// that don't support draining reply to the ping as normal.
+func (c *Conn) Drain(deadline time.Time) error {
+	return c.wsConn.WriteControl(websocket.PingMessage, []byte(drainPayload), deadline)
+}
+
+// OnDrain registers f to be called when the peer notifies the connection is
+// draining (see [Conn.Drain]).
+//
+// Control frames are handled while reading from the connection, so f must
+// not block. Must be called before the connection is used.
+func (c *Conn) OnDrain(f func()) {
+	pingHandler := c.wsConn.PingHandler()
+	c.wsConn.SetPingHandler(func(message string) error {
+		if message == drainPayload {
+			f()
+		}
+		return pingHandler(message)
+	})
 }
 
 func (c *Conn) Close() error {
@@ -221,3 +435,31 @@ func (c *Conn) SetWriteDeadline(t time.Time) error {
 }
 
 var _ net.Conn = &Conn{}
+var _ io.ReaderFrom = &Conn{}
+
+// dialTimed connects to the host of the given WebSocket URL, returning the
+// connection and the duration of the connect.
+func dialTimed(
+	ctx context.Context, dialer *net.Dialer, rawURL string,
+) (net.Conn, time.Duration, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, 0, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "wss", "https":
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		default:
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	return conn, time.Since(start), nil
+}
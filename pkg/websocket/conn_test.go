@@ -0,0 +1,303 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/protocol"
+)
+
+// messageServer starts a WebSocket server that calls handler with each
+// accepted connection, and returns the server URL.
+func messageServer(t testing.TB, handler func(conn *websocket.Conn)) string {
+	upgrader := &websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			handler(conn)
+		},
+	))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestConn_Write(t *testing.T) {
+	t.Run("chunked", func(t *testing.T) {
+		sizes := make(chan int, 16)
+		received := make(chan []byte, 1)
+		url := messageServer(t, func(conn *websocket.Conn) {
+			var buf bytes.Buffer
+			for buf.Len() < MaxMessageSize*3+10 {
+				_, b, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				sizes <- len(b)
+				buf.Write(b)
+			}
+			close(sizes)
+			received <- buf.Bytes()
+		})
+
+		conn, err := Dial(context.Background(), url)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		b := randomBytes(MaxMessageSize*3 + 10)
+		n, err := conn.Write(b)
+		assert.NoError(t, err)
+		assert.Equal(t, len(b), n)
+
+		assert.Equal(t, b, <-received)
+		var messageSizes []int
+		for size := range sizes {
+			messageSizes = append(messageSizes, size)
+		}
+		assert.Equal(t, []int{
+			MaxMessageSize, MaxMessageSize, MaxMessageSize, 10,
+		}, messageSizes)
+	})
+
+	t.Run("message size", func(t *testing.T) {
+		sizes := make(chan int, 16)
+		url := messageServer(t, func(conn *websocket.Conn) {
+			var n int
+			for n < 5000 {
+				_, b, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				sizes <- len(b)
+				n += len(b)
+			}
+			close(sizes)
+		})
+
+		conn, err := Dial(context.Background(), url, WithMessageSize(2048))
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, 2048, conn.MessageSize())
+
+		_, err = conn.Write(randomBytes(5000))
+		assert.NoError(t, err)
+
+		var messageSizes []int
+		for size := range sizes {
+			messageSizes = append(messageSizes, size)
+		}
+		assert.Equal(t, []int{2048, 2048, 904}, messageSizes)
+	})
+}
+
+func TestConn_SetMessageSize(t *testing.T) {
+	conn := New(nil)
+	assert.Equal(t, MaxMessageSize, conn.MessageSize())
+
+	conn.SetMessageSize(4096)
+	assert.Equal(t, 4096, conn.MessageSize())
+
+	// Clamped to the supported range.
+	conn.SetMessageSize(10)
+	assert.Equal(t, MinMessageSize, conn.MessageSize())
+	conn.SetMessageSize(MaxMessageSize * 2)
+	assert.Equal(t, MaxMessageSize, conn.MessageSize())
+}
+
+func TestConn_ReadFrom(t *testing.T) {
+	maxSize := make(chan int, 1)
+	url := messageServer(t, func(conn *websocket.Conn) {
+		var max int
+		for {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				maxSize <- max
+				return
+			}
+			if len(b) > max {
+				max = len(b)
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+				return
+			}
+		}
+	})
+
+	conn, err := Dial(context.Background(), url)
+	require.NoError(t, err)
+
+	b := randomBytes(16 << 20)
+	go func() {
+		n, err := io.Copy(conn, bytes.NewReader(b))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(b)), n)
+	}()
+
+	received := make([]byte, len(b))
+	_, err = io.ReadFull(conn, received)
+	assert.NoError(t, err)
+	assert.Equal(t, b, received)
+
+	conn.Close()
+	assert.LessOrEqual(t, <-maxSize, MaxMessageSize)
+}
+
+// BenchmarkConn_Transfer benchmarks streaming large transfers over a
+// connection. Each transfer is streamed from a generated reader and
+// discarded on receipt, so memory use is bounded regardless of the
+// transfer size.
+func BenchmarkConn_Transfer(b *testing.B) {
+	for _, size := range []int64{1 << 20, 1 << 30, 10 << 30} {
+		b.Run(fmt.Sprintf("%dMB", size>>20), func(b *testing.B) {
+			url := messageServer(b, func(conn *websocket.Conn) {
+				c := New(conn)
+				for {
+					if _, err := io.CopyN(io.Discard, c, size); err != nil {
+						return
+					}
+					// Acknowledge the transfer is complete.
+					if _, err := c.Write([]byte{1}); err != nil {
+						return
+					}
+				}
+			})
+
+			conn, err := Dial(context.Background(), url)
+			require.NoError(b, err)
+			defer conn.Close()
+
+			src := bytes.Repeat([]byte{0xff}, MaxMessageSize)
+
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			ack := make([]byte, 1)
+			for i := 0; i != b.N; i++ {
+				r := io.LimitReader(&repeatReader{b: src}, size)
+				if _, err := io.Copy(conn, r); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(conn, ack); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// repeatReader is an infinite reader that repeats b.
+func TestConn_Drain(t *testing.T) {
+	pongs := make(chan string, 1)
+	url := messageServer(t, func(conn *websocket.Conn) {
+		conn.SetPongHandler(func(message string) error {
+			pongs <- message
+			return nil
+		})
+		if err := New(conn).Drain(time.Now().Add(time.Second)); err != nil {
+			return
+		}
+		// Read to handle the pong.
+		_, _, _ = conn.ReadMessage()
+	})
+
+	conn, err := Dial(context.Background(), url)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	drained := make(chan struct{}, 1)
+	conn.OnDrain(func() {
+		drained <- struct{}{}
+	})
+
+	// Read to handle the drain notification.
+	go func() {
+		_, _ = conn.Read(make([]byte, 1))
+	}()
+
+	<-drained
+	// Peers still reply to the ping.
+	assert.Equal(t, "piko-drain", <-pongs)
+}
+
+func TestConn_WriteClose(t *testing.T) {
+	url := messageServer(t, func(conn *websocket.Conn) {
+		if err := New(conn).WriteClose(CloseDrained, time.Now().Add(time.Second)); err != nil {
+			return
+		}
+		// Read to handle the close reply.
+		_, _, _ = conn.ReadMessage()
+	})
+
+	conn, err := Dial(context.Background(), url)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Read(make([]byte, 1))
+	// The close error matches net.ErrClosed so is handled like any other
+	// close.
+	assert.ErrorIs(t, err, net.ErrClosed)
+	assert.Equal(t, CloseDrained, CloseCodeOf(err))
+	assert.True(t, CloseCodeOf(err).Deliberate())
+	assert.EqualError(t, err, "closed by peer: drained (4002)")
+
+	assert.Equal(t, CloseAbnormal, CloseCodeOf(io.EOF))
+	assert.False(t, CloseAbnormal.Deliberate())
+}
+
+type repeatReader struct {
+	b []byte
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	return copy(p, r.b), nil
+}
+
+func randomBytes(n int) []byte {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+func TestDial_RTTHeader(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	upgrader := &websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			headers <- r.Header
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			conn.Close()
+		},
+	))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	conn, err := Dial(context.Background(), url, WithRTTHeader("x-rtt"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Greater(t, conn.DialRTT(), time.Duration(0))
+
+	assert.Equal(t, protocol.FormatSeconds(conn.DialRTT()), (<-headers).Get("x-rtt"))
+}
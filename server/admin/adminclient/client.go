@@ -0,0 +1,226 @@
+// Package adminclient is a client for the Piko server admin API.
+//
+// The API types and methods are generated from the OpenAPI document in
+// server/admin/openapi.yaml, which the admin server also serves at
+// '/openapi.json' and '/openapi.yaml'. Run 'go generate ./server/admin/...'
+// after updating the document.
+package adminclient
+
+//go:generate go run ./internal/gen -spec ../openapi.yaml -out client_gen.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	fspath "path"
+	"time"
+)
+
+// Error is returned when the admin API responds with a non-2xx status.
+type Error struct {
+	StatusCode int
+
+	// Message is the error message in the response, or empty if the
+	// response didn't include a message.
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("bad status: %d", e.StatusCode)
+	}
+	return fmt.Sprintf("bad status: %d: %s", e.StatusCode, e.Message)
+}
+
+type options struct {
+	httpClient *http.Client
+	token      string
+	forward    string
+}
+
+type httpClientOption struct {
+	HTTPClient *http.Client
+}
+
+func (o httpClientOption) apply(opts *options) {
+	opts.httpClient = o.HTTPClient
+}
+
+// WithHTTPClient configures the HTTP client used to send requests, such as
+// to configure TLS.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return httpClientOption{HTTPClient: httpClient}
+}
+
+type tokenOption string
+
+func (o tokenOption) apply(opts *options) {
+	opts.token = string(o)
+}
+
+// WithToken configures the token to authenticate with the admin API.
+func WithToken(token string) Option {
+	return tokenOption(token)
+}
+
+type forwardOption string
+
+func (o forwardOption) apply(opts *options) {
+	opts.forward = string(o)
+}
+
+// WithForward configures the node receiving the request to forward it to
+// the node with the given ID.
+func WithForward(nodeID string) Option {
+	return forwardOption(nodeID)
+}
+
+type Option interface {
+	apply(*options)
+}
+
+// Client is a client for the admin API of a Piko server node.
+type Client struct {
+	httpClient *http.Client
+
+	url *url.URL
+
+	token   string
+	forward string
+}
+
+func NewClient(url *url.URL, opts ...Option) *Client {
+	options := options{
+		httpClient: &http.Client{
+			Timeout: time.Second * 15,
+		},
+	}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
+	return &Client{
+		httpClient: options.httpClient,
+		url:        url,
+		token:      options.token,
+		forward:    options.forward,
+	}
+}
+
+// do sends a request with the given JSON body, or no body if nil, and
+// decodes the JSON response into result, or discards the response if nil.
+func (c *Client) do(
+	ctx context.Context,
+	method string,
+	path string,
+	query url.Values,
+	body any,
+	result any,
+) error {
+	resp, err := c.request(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+// doRaw is like do though returns the response body without decoding.
+func (c *Client) doRaw(
+	ctx context.Context,
+	method string,
+	path string,
+	query url.Values,
+	body any,
+) ([]byte, error) {
+	resp, err := c.request(ctx, method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+	return b, nil
+}
+
+func (c *Client) request(
+	ctx context.Context,
+	method string,
+	path string,
+	query url.Values,
+	body any,
+) (*http.Response, error) {
+	u := new(url.URL)
+	*u = *c.url
+	// The path parameters are already escaped, so join with the escaped
+	// base path.
+	u.RawPath = fspath.Join("/", u.EscapedPath(), path)
+	unescaped, err := url.PathUnescape(u.RawPath)
+	if err != nil {
+		return nil, fmt.Errorf("path: %w", err)
+	}
+	u.Path = unescaped
+
+	if c.forward != "" {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("forward", c.forward)
+	}
+	u.RawQuery = query.Encode()
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("encode request: %w", err)
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+
+		var errorResp struct {
+			Error string `json:"error"`
+		}
+		// Ignore errors since not all responses include a message.
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&errorResp)
+		return nil, &Error{
+			StatusCode: resp.StatusCode,
+			Message:    errorResp.Error,
+		}
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,751 @@
+// Code generated by internal/gen from server/admin/openapi.yaml. DO NOT EDIT.
+
+package adminclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// UpstreamSession is the multiplexer statistics of an upstream session.
+type UpstreamSession struct {
+	EndpointID  string    `json:"endpoint_id,omitempty"`
+	RemoteAddr  string    `json:"remote_addr,omitempty"`
+	ConnectedAt time.Time `json:"connected_at,omitempty"`
+
+	// Number of streams currently open.
+	OpenStreams int `json:"open_streams,omitempty"`
+
+	// Number of streams opened since the session connected.
+	StreamsOpened uint64 `json:"streams_opened,omitempty"`
+
+	// Number of streams closed since the session connected.
+	StreamsClosed uint64 `json:"streams_closed,omitempty"`
+
+	// Number of stream writes that blocked waiting for the upstream.
+	WriteStalls uint64 `json:"write_stalls,omitempty"`
+
+	// Round trip time of the last successful ping.
+	RTT         string `json:"rtt,omitempty"`
+	PingsSent   uint64 `json:"pings_sent,omitempty"`
+	PingsFailed uint64 `json:"pings_failed,omitempty"`
+
+	// Smoothed RTT of recent pings.
+	Latency string `json:"latency,omitempty"`
+
+	// Smoothed variation between consecutive ping RTTs.
+	Jitter string `json:"jitter,omitempty"`
+
+	// Ratio of recent pings that failed or timed out.
+	Loss float64 `json:"loss,omitempty"`
+}
+
+type ClusterNodeMetadata struct {
+	ID string `json:"id,omitempty"`
+
+	// Either 'active', 'unreachable' or 'left'.
+	Status    string `json:"status,omitempty"`
+	ProxyAddr string `json:"proxy_addr,omitempty"`
+	AdminAddr string `json:"admin_addr,omitempty"`
+
+	// Number of endpoints active on the node.
+	Endpoints int `json:"endpoints,omitempty"`
+
+	// Number of upstreams connected to the node.
+	Upstreams int `json:"upstreams,omitempty"`
+}
+
+type ClusterNode struct {
+	ID string `json:"id,omitempty"`
+
+	// Either 'active', 'unreachable' or 'left'.
+	Status    string `json:"status,omitempty"`
+	ProxyAddr string `json:"proxy_addr,omitempty"`
+	AdminAddr string `json:"admin_addr,omitempty"`
+
+	// Maps each endpoint ID active on the node to its number of upstreams.
+	Endpoints map[string]int `json:"endpoints,omitempty"`
+}
+
+type Features struct {
+	// Piko version of the node.
+	Version  string    `json:"version,omitempty"`
+	Features []Feature `json:"features,omitempty"`
+}
+
+type Feature struct {
+	Name    string `json:"name,omitempty"`
+	Enabled bool   `json:"enabled,omitempty"`
+
+	// SHA-256 hash of the JSON encoded feature configuration, excluding
+	// configuration unique to each node.
+	ConfigHash string `json:"config_hash,omitempty"`
+}
+
+type GossipNodeMetadata struct {
+	ID string `json:"id,omitempty"`
+
+	// Gossip address of the node.
+	Addr        string `json:"addr,omitempty"`
+	Version     uint64 `json:"version,omitempty"`
+	Left        bool   `json:"left,omitempty"`
+	Unreachable bool   `json:"unreachable,omitempty"`
+
+	// Time the node state expires, if left or unreachable.
+	Expiry time.Time `json:"expiry,omitempty"`
+}
+
+type GossipNodeState struct {
+	ID string `json:"id,omitempty"`
+
+	// Gossip address of the node.
+	Addr        string `json:"addr,omitempty"`
+	Version     uint64 `json:"version,omitempty"`
+	Left        bool   `json:"left,omitempty"`
+	Unreachable bool   `json:"unreachable,omitempty"`
+
+	// Time the node state expires, if left or unreachable.
+	Expiry  time.Time     `json:"expiry,omitempty"`
+	Entries []GossipEntry `json:"Entries,omitempty"`
+}
+
+type GossipEntry struct {
+	Key      string `json:"key,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Version  uint64 `json:"version,omitempty"`
+	Internal bool   `json:"internal,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty"`
+}
+
+// Fingerprint is a TLS client fingerprint and the requests from clients with
+// the fingerprint.
+type Fingerprint struct {
+	// MD5 hash of the JA3 fingerprint.
+	JA3 string `json:"ja3,omitempty"`
+
+	// JA4 TLS client fingerprint.
+	JA4           string    `json:"ja4,omitempty"`
+	Requests      uint64    `json:"requests,omitempty"`
+	FirstSeen     time.Time `json:"first_seen,omitempty"`
+	LastSeen      time.Time `json:"last_seen,omitempty"`
+	LastClientIP  string    `json:"last_client_ip,omitempty"`
+	LastUserAgent string    `json:"last_user_agent,omitempty"`
+}
+
+type QueueList struct {
+	Endpoints []Queue `json:"endpoints,omitempty"`
+}
+
+type Queue struct {
+	EndpointID  string `json:"endpoint_id,omitempty"`
+	Queued      int    `json:"queued,omitempty"`
+	DeadLetters int    `json:"dead_letters,omitempty"`
+
+	// Time the oldest queued request was received.
+	OldestQueuedAt *time.Time `json:"oldest_queued_at,omitempty"`
+}
+
+type QueuedRequestList struct {
+	Requests []QueuedRequest `json:"requests,omitempty"`
+}
+
+// QueuedRequest is a queued request, excluding the headers and body as they
+// may contain credentials.
+type QueuedRequest struct {
+	Seq        uint64 `json:"seq,omitempty"`
+	DeliveryID string `json:"delivery_id,omitempty"`
+
+	// Either 'queued' or 'dead'.
+	State          string    `json:"state,omitempty"`
+	Host           string    `json:"host,omitempty"`
+	RequestURI     string    `json:"request_uri,omitempty"`
+	ContentType    string    `json:"content_type,omitempty"`
+	Size           int       `json:"size,omitempty"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	QueuedAt       time.Time `json:"queued_at,omitempty"`
+	Attempts       int       `json:"attempts,omitempty"`
+	LastStatus     int       `json:"last_status,omitempty"`
+}
+
+type PurgeResult struct {
+	Purged int `json:"purged,omitempty"`
+}
+
+type RetryResult struct {
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+type DomainList struct {
+	Domains []Domain `json:"domains,omitempty"`
+}
+
+// Domain is a custom domain attached to an endpoint.
+type Domain struct {
+	Domain     string `json:"domain,omitempty"`
+	EndpointID string `json:"endpoint_id,omitempty"`
+
+	// Verification method, either 'dns' or 'http'.
+	Method string `json:"method,omitempty"`
+
+	// Verification token the tenant must publish.
+	Token      string     `json:"token,omitempty"`
+	Verified   bool       `json:"verified,omitempty"`
+	CreatedAt  time.Time  `json:"created_at,omitempty"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+
+	// Error from the last failed verification.
+	LastError string `json:"last_error,omitempty"`
+
+	// Name of the TXT record to publish the token in, when verifying with DNS.
+	ChallengeRecord string `json:"challenge_record,omitempty"`
+
+	// URL that must serve the token, when verifying with HTTP.
+	ChallengeURL string `json:"challenge_url,omitempty"`
+}
+
+type AddDomainRequest struct {
+	Domain     string `json:"domain"`
+	EndpointID string `json:"endpoint_id"`
+
+	// Verification method, either 'dns' (default) or 'http'.
+	Method string `json:"method,omitempty"`
+}
+
+type CaptureList struct {
+	Captures []Capture `json:"captures,omitempty"`
+}
+
+type Capture struct {
+	ID         string     `json:"id,omitempty"`
+	EndpointID string     `json:"endpoint_id,omitempty"`
+	State      string     `json:"state,omitempty"`
+	StartedAt  time.Time  `json:"started_at,omitempty"`
+	EndedAt    *time.Time `json:"ended_at,omitempty"`
+
+	// Why the capture ended, either 'duration', 'size' or 'stopped'.
+	Reason   string `json:"reason,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	MaxBytes int    `json:"max_bytes,omitempty"`
+	Records  int    `json:"records,omitempty"`
+	Bytes    int    `json:"bytes,omitempty"`
+}
+
+type StartCaptureRequest struct {
+	EndpointID string `json:"endpoint_id"`
+
+	// Maximum duration of the capture, such as '30s'. Defaults to 1 minute, up
+	// to 10 minutes.
+	Duration string `json:"duration,omitempty"`
+
+	// Maximum size of the capture. Defaults to 8MB, up to 64MB.
+	MaxBytes int `json:"max_bytes,omitempty"`
+}
+
+type CanarySplitList struct {
+	Splits []CanarySplit `json:"splits,omitempty"`
+}
+
+type CanarySplit struct {
+	EndpointID       string `json:"endpoint_id,omitempty"`
+	CanaryEndpointID string `json:"canary_endpoint_id,omitempty"`
+
+	// Current percentage of requests routed to the canary.
+	Weight           int         `json:"weight,omitempty"`
+	ConfiguredWeight int         `json:"configured_weight,omitempty"`
+	Stable           CanaryGroup `json:"stable,omitempty"`
+	Canary           CanaryGroup `json:"canary,omitempty"`
+
+	// Canary error rate minus the stable error rate.
+	ErrorRateDelta float64 `json:"error_rate_delta,omitempty"`
+
+	// Canary mean latency minus the stable mean latency.
+	LatencyDeltaMs float64 `json:"latency_delta_ms,omitempty"`
+
+	// Whether the canary exceeds the configured thresholds in the current
+	// window.
+	Degraded       bool       `json:"degraded,omitempty"`
+	RolledBack     bool       `json:"rolled_back,omitempty"`
+	RolledBackAt   *time.Time `json:"rolled_back_at,omitempty"`
+	RollbackReason string     `json:"rollback_reason,omitempty"`
+}
+
+type CanaryGroup struct {
+	Requests int `json:"requests,omitempty"`
+
+	// Number of responses with a 5xx status.
+	Errors        int     `json:"errors,omitempty"`
+	ErrorRate     float64 `json:"error_rate,omitempty"`
+	MeanLatencyMs float64 `json:"mean_latency_ms,omitempty"`
+}
+
+type SetCanaryWeightRequest struct {
+	EndpointID string `json:"endpoint_id"`
+
+	// Percentage of requests to route to the canary, from 0 to 100.
+	Weight int `json:"weight"`
+}
+
+// GetHealth returns 200 if the server is healthy.
+//
+// GET /health
+func (c *Client) GetHealth(ctx context.Context) error {
+	return c.do(ctx, http.MethodGet, "/health", nil, nil, nil)
+}
+
+// GetReady returns 200 if the server is ready to accept traffic.
+//
+// GET /ready
+func (c *Client) GetReady(ctx context.Context) error {
+	return c.do(ctx, http.MethodGet, "/ready", nil, nil, nil)
+}
+
+// GetMetrics returns the Prometheus metrics of the node.
+//
+// GET /metrics
+func (c *Client) GetMetrics(ctx context.Context) ([]byte, error) {
+	return c.doRaw(ctx, http.MethodGet, "/metrics", nil, nil)
+}
+
+// GetOpenAPIJSON returns this OpenAPI document as JSON.
+//
+// GET /openapi.json
+func (c *Client) GetOpenAPIJSON(ctx context.Context) (map[string]any, error) {
+	var result map[string]any
+	if err := c.do(ctx, http.MethodGet, "/openapi.json", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetOpenAPIYAML returns this OpenAPI document as YAML.
+//
+// GET /openapi.yaml
+func (c *Client) GetOpenAPIYAML(ctx context.Context) ([]byte, error) {
+	return c.doRaw(ctx, http.MethodGet, "/openapi.yaml", nil, nil)
+}
+
+// ListUpstreamEndpoints lists the endpoints with upstreams connected to this
+// node.
+//
+// GET /status/upstream/endpoints
+func (c *Client) ListUpstreamEndpoints(ctx context.Context) (map[string]int, error) {
+	var result map[string]int
+	if err := c.do(ctx, http.MethodGet, "/status/upstream/endpoints", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListUpstreamSessionsParams are the query parameters of ListUpstreamSessions.
+type ListUpstreamSessionsParams struct {
+	// Only list sessions for the endpoint.
+	Endpoint string
+}
+
+// ListUpstreamSessions lists the multiplexer statistics of each upstream
+// session.
+//
+// GET /status/upstream/sessions
+func (c *Client) ListUpstreamSessions(ctx context.Context, params *ListUpstreamSessionsParams) ([]UpstreamSession, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.Endpoint != "" {
+			query.Set("endpoint", params.Endpoint)
+		}
+	}
+	var result []UpstreamSession
+	if err := c.do(ctx, http.MethodGet, "/status/upstream/sessions", query, nil, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListClusterNodes lists the known nodes in the cluster.
+//
+// GET /status/cluster/nodes
+func (c *Client) ListClusterNodes(ctx context.Context) ([]ClusterNodeMetadata, error) {
+	var result []ClusterNodeMetadata
+	if err := c.do(ctx, http.MethodGet, "/status/cluster/nodes", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetLocalClusterNode returns the state of this node.
+//
+// GET /status/cluster/nodes/local
+func (c *Client) GetLocalClusterNode(ctx context.Context) (*ClusterNode, error) {
+	var result ClusterNode
+	if err := c.do(ctx, http.MethodGet, "/status/cluster/nodes/local", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetClusterNode returns the known state of a node in the cluster.
+//
+// GET /status/cluster/nodes/{id}
+func (c *Client) GetClusterNode(ctx context.Context, id string) (*ClusterNode, error) {
+	var result ClusterNode
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/status/cluster/nodes/%s", url.PathEscape(id)), nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetFeatures returns the optional features enabled on this node.
+//
+// GET /status/features
+func (c *Client) GetFeatures(ctx context.Context) (*Features, error) {
+	var result Features
+	if err := c.do(ctx, http.MethodGet, "/status/features", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ListGossipNodes lists the known nodes in the gossip state.
+//
+// GET /status/gossip/nodes
+func (c *Client) ListGossipNodes(ctx context.Context) ([]GossipNodeMetadata, error) {
+	var result []GossipNodeMetadata
+	if err := c.do(ctx, http.MethodGet, "/status/gossip/nodes", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetGossipNode returns the gossip state of a node.
+//
+// GET /status/gossip/nodes/{id}
+func (c *Client) GetGossipNode(ctx context.Context, id string) (*GossipNodeState, error) {
+	var result GossipNodeState
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/status/gossip/nodes/%s", url.PathEscape(id)), nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ListFingerprintsParams are the query parameters of ListFingerprints.
+type ListFingerprintsParams struct {
+	// Only list fingerprints with the JA3 hash.
+	JA3 string
+
+	// Only list fingerprints with the JA4 fingerprint.
+	JA4 string
+
+	// Maximum number of fingerprints. Defaults to 100.
+	Limit int
+}
+
+// ListFingerprints lists the most common TLS client fingerprints.
+//
+// GET /status/proxy/fingerprints
+func (c *Client) ListFingerprints(ctx context.Context, params *ListFingerprintsParams) ([]Fingerprint, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.JA3 != "" {
+			query.Set("ja3", params.JA3)
+		}
+		if params.JA4 != "" {
+			query.Set("ja4", params.JA4)
+		}
+		if params.Limit != 0 {
+			query.Set("limit", strconv.FormatInt(int64(params.Limit), 10))
+		}
+	}
+	var result []Fingerprint
+	if err := c.do(ctx, http.MethodGet, "/status/proxy/fingerprints", query, nil, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListQueueEndpoints lists the request queue of each endpoint.
+//
+// GET /queue/v1/endpoints
+func (c *Client) ListQueueEndpoints(ctx context.Context) (*QueueList, error) {
+	var result QueueList
+	if err := c.do(ctx, http.MethodGet, "/queue/v1/endpoints", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ListQueuedRequestsParams are the query parameters of ListQueuedRequests.
+type ListQueuedRequestsParams struct {
+	// The endpoint ID, which may contain namespaces separated by '/'.
+	EndpointID string
+
+	// Either 'queued' (default) or 'dead'.
+	State string
+}
+
+// ListQueuedRequests lists the queued or dead-lettered requests of an
+// endpoint.
+//
+// GET /queue/v1/requests
+func (c *Client) ListQueuedRequests(ctx context.Context, params *ListQueuedRequestsParams) (*QueuedRequestList, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.EndpointID != "" {
+			query.Set("endpoint_id", params.EndpointID)
+		}
+		if params.State != "" {
+			query.Set("state", params.State)
+		}
+	}
+	var result QueuedRequestList
+	if err := c.do(ctx, http.MethodGet, "/queue/v1/requests", query, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PurgeQueuedRequestsParams are the query parameters of PurgeQueuedRequests.
+type PurgeQueuedRequestsParams struct {
+	// The endpoint ID, which may contain namespaces separated by '/'.
+	EndpointID string
+
+	// Either 'queued' (default), 'dead' or 'all'.
+	State string
+}
+
+// PurgeQueuedRequests purges the queued or dead-lettered requests of an
+// endpoint.
+//
+// DELETE /queue/v1/requests
+func (c *Client) PurgeQueuedRequests(ctx context.Context, params *PurgeQueuedRequestsParams) (*PurgeResult, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.EndpointID != "" {
+			query.Set("endpoint_id", params.EndpointID)
+		}
+		if params.State != "" {
+			query.Set("state", params.State)
+		}
+	}
+	var result PurgeResult
+	if err := c.do(ctx, http.MethodDelete, "/queue/v1/requests", query, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetQueuedRequestParams are the query parameters of GetQueuedRequest.
+type GetQueuedRequestParams struct {
+	// The endpoint ID, which may contain namespaces separated by '/'.
+	EndpointID string
+}
+
+// GetQueuedRequest returns a queued or dead-lettered request.
+//
+// GET /queue/v1/requests/{seq}
+func (c *Client) GetQueuedRequest(ctx context.Context, seq uint64, params *GetQueuedRequestParams) (*QueuedRequest, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.EndpointID != "" {
+			query.Set("endpoint_id", params.EndpointID)
+		}
+	}
+	var result QueuedRequest
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/queue/v1/requests/%d", seq), query, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PurgeQueuedRequestParams are the query parameters of PurgeQueuedRequest.
+type PurgeQueuedRequestParams struct {
+	// The endpoint ID, which may contain namespaces separated by '/'.
+	EndpointID string
+}
+
+// PurgeQueuedRequest purges a queued or dead-lettered request.
+//
+// DELETE /queue/v1/requests/{seq}
+func (c *Client) PurgeQueuedRequest(ctx context.Context, seq uint64, params *PurgeQueuedRequestParams) error {
+	query := url.Values{}
+	if params != nil {
+		if params.EndpointID != "" {
+			query.Set("endpoint_id", params.EndpointID)
+		}
+	}
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/queue/v1/requests/%d", seq), query, nil, nil)
+}
+
+// RetryQueuedRequestParams are the query parameters of RetryQueuedRequest.
+type RetryQueuedRequestParams struct {
+	// The endpoint ID, which may contain namespaces separated by '/'.
+	EndpointID string
+}
+
+// RetryQueuedRequest moves a dead-lettered request to the end of the queue.
+//
+// POST /queue/v1/requests/{seq}/retry
+func (c *Client) RetryQueuedRequest(ctx context.Context, seq uint64, params *RetryQueuedRequestParams) (*RetryResult, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.EndpointID != "" {
+			query.Set("endpoint_id", params.EndpointID)
+		}
+	}
+	var result RetryResult
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/queue/v1/requests/%d/retry", seq), query, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ListDomainsParams are the query parameters of ListDomains.
+type ListDomainsParams struct {
+	// Only list domains attached to the endpoint.
+	EndpointID string
+}
+
+// ListDomains lists the custom domains permitted by the client.
+//
+// GET /domains/v1/domains
+func (c *Client) ListDomains(ctx context.Context, params *ListDomainsParams) (*DomainList, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.EndpointID != "" {
+			query.Set("endpoint_id", params.EndpointID)
+		}
+	}
+	var result DomainList
+	if err := c.do(ctx, http.MethodGet, "/domains/v1/domains", query, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// AddDomain attaches a custom domain to an endpoint.
+//
+// POST /domains/v1/domains
+func (c *Client) AddDomain(ctx context.Context, req AddDomainRequest) (*Domain, error) {
+	var result Domain
+	if err := c.do(ctx, http.MethodPost, "/domains/v1/domains", nil, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetDomain returns a custom domain.
+//
+// GET /domains/v1/domains/{domain}
+func (c *Client) GetDomain(ctx context.Context, domain string) (*Domain, error) {
+	var result Domain
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/domains/v1/domains/%s", url.PathEscape(domain)), nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// RemoveDomain removes a custom domain.
+//
+// DELETE /domains/v1/domains/{domain}
+func (c *Client) RemoveDomain(ctx context.Context, domain string) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/domains/v1/domains/%s", url.PathEscape(domain)), nil, nil, nil)
+}
+
+// VerifyDomain checks whether the verification token was published.
+//
+// POST /domains/v1/domains/{domain}/verify
+func (c *Client) VerifyDomain(ctx context.Context, domain string) (*Domain, error) {
+	var result Domain
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/domains/v1/domains/%s/verify", url.PathEscape(domain)), nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ListCaptures lists the debug captures permitted by the client.
+//
+// GET /capture/v1/captures
+func (c *Client) ListCaptures(ctx context.Context) (*CaptureList, error) {
+	var result CaptureList
+	if err := c.do(ctx, http.MethodGet, "/capture/v1/captures", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// StartCapture starts capturing the HTTP metadata of requests to an endpoint.
+//
+// POST /capture/v1/captures
+func (c *Client) StartCapture(ctx context.Context, req StartCaptureRequest) (*Capture, error) {
+	var result Capture
+	if err := c.do(ctx, http.MethodPost, "/capture/v1/captures", nil, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetCapture returns a debug capture.
+//
+// GET /capture/v1/captures/{id}
+func (c *Client) GetCapture(ctx context.Context, id string) (*Capture, error) {
+	var result Capture
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/capture/v1/captures/%s", url.PathEscape(id)), nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// RemoveCapture removes a debug capture and its records.
+//
+// DELETE /capture/v1/captures/{id}
+func (c *Client) RemoveCapture(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/capture/v1/captures/%s", url.PathEscape(id)), nil, nil, nil)
+}
+
+// StopCapture stops a running debug capture.
+//
+// POST /capture/v1/captures/{id}/stop
+func (c *Client) StopCapture(ctx context.Context, id string) (*Capture, error) {
+	var result Capture
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/capture/v1/captures/%s/stop", url.PathEscape(id)), nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DownloadCapture downloads the records captured so far.
+//
+// GET /capture/v1/captures/{id}/download
+func (c *Client) DownloadCapture(ctx context.Context, id string) ([]byte, error) {
+	return c.doRaw(ctx, http.MethodGet, fmt.Sprintf("/capture/v1/captures/%s/download", url.PathEscape(id)), nil, nil)
+}
+
+// ListCanarySplits lists the traffic splits permitted by the client.
+//
+// GET /canary/v1/splits
+func (c *Client) ListCanarySplits(ctx context.Context) (*CanarySplitList, error) {
+	var result CanarySplitList
+	if err := c.do(ctx, http.MethodGet, "/canary/v1/splits", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// SetCanaryWeight sets the percentage of requests routed to the canary.
+//
+// POST /canary/v1/splits/weight
+func (c *Client) SetCanaryWeight(ctx context.Context, req SetCanaryWeightRequest) (*CanarySplit, error) {
+	var result CanarySplit
+	if err := c.do(ctx, http.MethodPost, "/canary/v1/splits/weight", nil, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+var (
+	_ = fmt.Sprintf
+	_ = strconv.FormatInt
+	_ time.Time
+)
@@ -0,0 +1,91 @@
+package adminclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/admin"
+	"github.com/andydunstall/piko/server/cluster"
+)
+
+func TestClient(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	state := cluster.NewState(&cluster.Node{
+		ID:        "node-1",
+		AdminAddr: ln.Addr().String(),
+		Endpoints: map[string]int{"my-endpoint": 2},
+	}, log.NewNopLogger())
+
+	s := admin.NewServer(
+		state,
+		prometheus.NewRegistry(),
+		nil,
+		nil,
+		log.NewNopLogger(),
+	)
+	s.AddStatus("/cluster", cluster.NewStatus(state))
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	client := NewClient(&url.URL{
+		Scheme: "http",
+		Host:   ln.Addr().String(),
+	})
+
+	t.Run("health", func(t *testing.T) {
+		assert.NoError(t, client.GetHealth(context.TODO()))
+	})
+
+	t.Run("get node", func(t *testing.T) {
+		node, err := client.GetClusterNode(context.TODO(), "node-1")
+		require.NoError(t, err)
+		assert.Equal(t, "node-1", node.ID)
+		assert.Equal(t, map[string]int{"my-endpoint": 2}, node.Endpoints)
+	})
+
+	t.Run("list nodes", func(t *testing.T) {
+		nodes, err := client.ListClusterNodes(context.TODO())
+		require.NoError(t, err)
+		require.Len(t, nodes, 1)
+		assert.Equal(t, "node-1", nodes[0].ID)
+		assert.Equal(t, 1, nodes[0].Endpoints)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := client.GetClusterNode(context.TODO(), "unknown")
+		var apiErr *Error
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	})
+
+	t.Run("forward unknown node", func(t *testing.T) {
+		client := NewClient(&url.URL{
+			Scheme: "http",
+			Host:   ln.Addr().String(),
+		}, WithForward("unknown"))
+
+		err := client.GetHealth(context.TODO())
+		var apiErr *Error
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	})
+
+	t.Run("openapi", func(t *testing.T) {
+		doc, err := client.GetOpenAPIJSON(context.TODO())
+		require.NoError(t, err)
+		assert.Equal(t, "3.0.3", doc["openapi"])
+	})
+}
@@ -0,0 +1,494 @@
+// Command gen generates the admin API client from the admin OpenAPI
+// document.
+//
+// This only supports the subset of OpenAPI used by the admin API: object
+// schemas in 'components', and operations with path and query parameters,
+// an optional JSON request body and a single success response.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ordered is a YAML mapping that preserves the order of its keys, so the
+// generated code follows the order of the document.
+type ordered[T any] []orderedEntry[T]
+
+type orderedEntry[T any] struct {
+	Key   string
+	Value T
+}
+
+func (o *ordered[T]) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: expected mapping", node.Line)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		var v T
+		if err := node.Content[i+1].Decode(&v); err != nil {
+			return err
+		}
+		*o = append(*o, orderedEntry[T]{Key: node.Content[i].Value, Value: v})
+	}
+	return nil
+}
+
+type document struct {
+	Paths      ordered[ordered[operation]] `yaml:"paths"`
+	Components struct {
+		Schemas ordered[schema] `yaml:"schemas"`
+	} `yaml:"components"`
+}
+
+type schema struct {
+	Ref                  string          `yaml:"$ref"`
+	Type                 string          `yaml:"type"`
+	Format               string          `yaml:"format"`
+	Nullable             bool            `yaml:"nullable"`
+	Description          string          `yaml:"description"`
+	Required             []string        `yaml:"required"`
+	Properties           ordered[schema] `yaml:"properties"`
+	Items                *schema         `yaml:"items"`
+	AdditionalProperties *schema         `yaml:"additionalProperties"`
+}
+
+type parameter struct {
+	Name        string `yaml:"name"`
+	In          string `yaml:"in"`
+	Description string `yaml:"description"`
+	Schema      schema `yaml:"schema"`
+}
+
+type mediaType struct {
+	Schema schema `yaml:"schema"`
+}
+
+type response struct {
+	Content ordered[mediaType] `yaml:"content"`
+}
+
+type operation struct {
+	OperationID string      `yaml:"operationId"`
+	Summary     string      `yaml:"summary"`
+	Parameters  []parameter `yaml:"parameters"`
+	RequestBody *struct {
+		Content ordered[mediaType] `yaml:"content"`
+	} `yaml:"requestBody"`
+	Responses ordered[response] `yaml:"responses"`
+}
+
+// initialisms are the words written in upper case in Go names.
+var initialisms = map[string]string{
+	"id":      "ID",
+	"ip":      "IP",
+	"ja3":     "JA3",
+	"ja4":     "JA4",
+	"json":    "JSON",
+	"openapi": "OpenAPI",
+	"rtt":     "RTT",
+	"uri":     "URI",
+	"url":     "URL",
+	"yaml":    "YAML",
+}
+
+// goName converts a snake case or camel case name to an exported Go name.
+func goName(name string) string {
+	var words []string
+	for _, part := range strings.Split(name, "_") {
+		start := 0
+		for i := 1; i < len(part); i++ {
+			if part[i] >= 'A' && part[i] <= 'Z' && part[i-1] >= 'a' && part[i-1] <= 'z' {
+				words = append(words, part[start:i])
+				start = i
+			}
+		}
+		words = append(words, part[start:])
+	}
+
+	var b strings.Builder
+	for _, word := range words {
+		if word == "" {
+			continue
+		}
+		if s, ok := initialisms[strings.ToLower(word)]; ok {
+			b.WriteString(s)
+			continue
+		}
+		b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+	return b.String()
+}
+
+// argName converts a parameter name to an unexported Go name.
+func argName(name string) string {
+	n := goName(name)
+	for s := range initialisms {
+		if strings.EqualFold(n, s) {
+			return strings.ToLower(n)
+		}
+	}
+	return strings.ToLower(n[:1]) + n[1:]
+}
+
+func goType(s schema) (string, error) {
+	if s.Ref != "" {
+		name, ok := strings.CutPrefix(s.Ref, "#/components/schemas/")
+		if !ok {
+			return "", fmt.Errorf("unsupported ref: %s", s.Ref)
+		}
+		if s.Nullable {
+			return "*" + name, nil
+		}
+		return name, nil
+	}
+
+	var t string
+	switch s.Type {
+	case "string":
+		t = "string"
+		if s.Format == "date-time" {
+			t = "time.Time"
+		}
+	case "integer":
+		t = "int"
+		switch s.Format {
+		case "int32", "int64", "uint64":
+			t = s.Format
+		}
+	case "number":
+		t = "float64"
+	case "boolean":
+		t = "bool"
+	case "array":
+		if s.Items == nil {
+			return "", fmt.Errorf("array missing items")
+		}
+		items, err := goType(*s.Items)
+		if err != nil {
+			return "", err
+		}
+		return "[]" + items, nil
+	case "object":
+		if s.AdditionalProperties == nil {
+			return "map[string]any", nil
+		}
+		values, err := goType(*s.AdditionalProperties)
+		if err != nil {
+			return "", err
+		}
+		return "map[string]" + values, nil
+	default:
+		return "", fmt.Errorf("unsupported type: %q", s.Type)
+	}
+	if s.Nullable {
+		return "*" + t, nil
+	}
+	return t, nil
+}
+
+// writeComment writes the text as a Go comment, wrapped at 80 columns.
+func writeComment(b *bytes.Buffer, indent string, text string) {
+	line := indent + "//"
+	for _, word := range strings.Fields(text) {
+		if len(line)+1+len(word) > 78 && line != indent+"//" {
+			b.WriteString(line + "\n")
+			line = indent + "//"
+		}
+		line += " " + word
+	}
+	if line != indent+"//" {
+		b.WriteString(line + "\n")
+	}
+}
+
+func writeSchema(b *bytes.Buffer, name string, s schema) error {
+	if s.Type != "object" || len(s.Properties) == 0 {
+		return fmt.Errorf("schema %s: only objects with properties are supported", name)
+	}
+
+	if s.Description != "" {
+		writeComment(b, "", name+" is "+strings.ToLower(s.Description[:1])+s.Description[1:])
+	}
+	fmt.Fprintf(b, "type %s struct {\n", name)
+	for i, prop := range s.Properties {
+		t, err := goType(prop.Value)
+		if err != nil {
+			return fmt.Errorf("schema %s: %s: %w", name, prop.Key, err)
+		}
+		if prop.Value.Description != "" {
+			if i != 0 {
+				b.WriteString("\n")
+			}
+			writeComment(b, "\t", prop.Value.Description)
+		}
+		tag := prop.Key
+		if !contains(s.Required, prop.Key) {
+			tag += ",omitempty"
+		}
+		fmt.Fprintf(b, "\t%s %s `json:\"%s\"`\n", goName(prop.Key), t, tag)
+	}
+	b.WriteString("}\n\n")
+	return nil
+}
+
+func writeOperation(b *bytes.Buffer, path string, method string, op operation) error {
+	if op.OperationID == "" {
+		return fmt.Errorf("%s %s: missing operation id", method, path)
+	}
+	name := goName(op.OperationID)
+
+	var pathParams, queryParams []parameter
+	for _, p := range op.Parameters {
+		switch p.In {
+		case "path":
+			pathParams = append(pathParams, p)
+		case "query":
+			queryParams = append(queryParams, p)
+		default:
+			return fmt.Errorf("%s: unsupported parameter location: %s", name, p.In)
+		}
+	}
+
+	if len(queryParams) > 0 {
+		fmt.Fprintf(b, "// %sParams are the query parameters of %s.\n", name, name)
+		fmt.Fprintf(b, "type %sParams struct {\n", name)
+		for i, p := range queryParams {
+			t, err := goType(p.Schema)
+			if err != nil {
+				return fmt.Errorf("%s: %s: %w", name, p.Name, err)
+			}
+			if p.Description != "" {
+				if i != 0 {
+					b.WriteString("\n")
+				}
+				writeComment(b, "\t", p.Description)
+			}
+			fmt.Fprintf(b, "\t%s %s\n", goName(p.Name), t)
+		}
+		b.WriteString("}\n\n")
+	}
+
+	args := []string{"ctx context.Context"}
+	for _, p := range pathParams {
+		t, err := goType(p.Schema)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", name, p.Name, err)
+		}
+		args = append(args, argName(p.Name)+" "+t)
+	}
+	if len(queryParams) > 0 {
+		args = append(args, "params *"+name+"Params")
+	}
+
+	body := "nil"
+	if op.RequestBody != nil {
+		content, ok := mediaTypeSchema(op.RequestBody.Content, "application/json")
+		if !ok {
+			return fmt.Errorf("%s: request body must be json", name)
+		}
+		t, err := goType(content)
+		if err != nil {
+			return fmt.Errorf("%s: request body: %w", name, err)
+		}
+		args = append(args, "req "+t)
+		body = "req"
+	}
+
+	// The result is taken from the first success response with content.
+	var result string
+	var raw bool
+	for _, resp := range op.Responses {
+		if !strings.HasPrefix(resp.Key, "2") || len(resp.Value.Content) == 0 {
+			continue
+		}
+		if content, ok := mediaTypeSchema(resp.Value.Content, "application/json"); ok {
+			t, err := goType(content)
+			if err != nil {
+				return fmt.Errorf("%s: response: %w", name, err)
+			}
+			result = t
+			// Return objects by pointer.
+			if content.Ref != "" && !strings.HasPrefix(t, "*") {
+				result = "*" + t
+			}
+		} else {
+			result = "[]byte"
+			raw = true
+		}
+		break
+	}
+
+	pathExpr := fmt.Sprintf("%q", path)
+	if len(pathParams) > 0 {
+		format := path
+		var values []string
+		for _, p := range pathParams {
+			verb := "%s"
+			value := "url.PathEscape(" + argName(p.Name) + ")"
+			if p.Schema.Type == "integer" {
+				verb = "%d"
+				value = argName(p.Name)
+			}
+			format = strings.Replace(format, "{"+p.Name+"}", verb, 1)
+			values = append(values, value)
+		}
+		pathExpr = fmt.Sprintf("fmt.Sprintf(%q, %s)", format, strings.Join(values, ", "))
+	}
+
+	query := "nil"
+	if len(queryParams) > 0 {
+		query = "query"
+	}
+
+	if op.Summary != "" {
+		writeComment(b, "", name+" "+strings.ToLower(op.Summary[:1])+op.Summary[1:])
+		b.WriteString("//\n")
+	}
+	fmt.Fprintf(b, "// %s %s\n", strings.ToUpper(method), path)
+	if result == "" {
+		fmt.Fprintf(b, "func (c *Client) %s(%s) error {\n", name, strings.Join(args, ", "))
+	} else {
+		fmt.Fprintf(b, "func (c *Client) %s(%s) (%s, error) {\n", name, strings.Join(args, ", "), result)
+	}
+
+	if len(queryParams) > 0 {
+		b.WriteString("\tquery := url.Values{}\n")
+		b.WriteString("\tif params != nil {\n")
+		for _, p := range queryParams {
+			field := "params." + goName(p.Name)
+			if p.Schema.Type == "integer" {
+				fmt.Fprintf(b, "\t\tif %s != 0 {\n", field)
+				fmt.Fprintf(b, "\t\t\tquery.Set(%q, strconv.FormatInt(int64(%s), 10))\n", p.Name, field)
+			} else {
+				fmt.Fprintf(b, "\t\tif %s != \"\" {\n", field)
+				fmt.Fprintf(b, "\t\t\tquery.Set(%q, %s)\n", p.Name, field)
+			}
+			b.WriteString("\t\t}\n")
+		}
+		b.WriteString("\t}\n")
+	}
+
+	httpMethod := "http.Method" + strings.ToUpper(method[:1]) + strings.ToLower(method[1:])
+	switch {
+	case result == "":
+		fmt.Fprintf(b, "\treturn c.do(ctx, %s, %s, %s, %s, nil)\n", httpMethod, pathExpr, query, body)
+	case raw:
+		fmt.Fprintf(b, "\treturn c.doRaw(ctx, %s, %s, %s, %s)\n", httpMethod, pathExpr, query, body)
+	default:
+		fmt.Fprintf(b, "\tvar result %s\n", strings.TrimPrefix(result, "*"))
+		fmt.Fprintf(
+			b, "\tif err := c.do(ctx, %s, %s, %s, %s, &result); err != nil {\n",
+			httpMethod, pathExpr, query, body,
+		)
+		b.WriteString("\t\treturn nil, err\n")
+		b.WriteString("\t}\n")
+		if strings.HasPrefix(result, "*") {
+			b.WriteString("\treturn &result, nil\n")
+		} else {
+			b.WriteString("\treturn result, nil\n")
+		}
+	}
+	b.WriteString("}\n\n")
+	return nil
+}
+
+func mediaTypeSchema(content ordered[mediaType], contentType string) (schema, bool) {
+	for _, c := range content {
+		if c.Key == contentType {
+			return c.Value.Schema, true
+		}
+	}
+	return schema{}, false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+var methods = []string{"get", "post", "put", "patch", "delete"}
+
+func generate(spec []byte) ([]byte, error) {
+	var doc document
+	if err := yaml.Unmarshal(spec, &doc); err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("// Code generated by internal/gen from server/admin/openapi.yaml. DO NOT EDIT.\n\n")
+	b.WriteString("package adminclient\n\n")
+	b.WriteString("import (\n\t\"context\"\n\t\"fmt\"\n\t\"net/http\"\n\t\"net/url\"\n\t\"strconv\"\n\t\"time\"\n)\n\n")
+
+	for _, s := range doc.Components.Schemas {
+		if err := writeSchema(&b, s.Key, s.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range doc.Paths {
+		ops := path.Value
+		sort.SliceStable(ops, func(i, j int) bool {
+			return methodIndex(ops[i].Key) < methodIndex(ops[j].Key)
+		})
+		for _, op := range ops {
+			if methodIndex(op.Key) == len(methods) {
+				return nil, fmt.Errorf("%s: unsupported method: %s", path.Key, op.Key)
+			}
+			if err := writeOperation(&b, path.Key, op.Key, op.Value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Ensure the imports are used, regardless of which types and
+	// parameters the document contains.
+	b.WriteString("var (\n\t_ = fmt.Sprintf\n\t_ = strconv.FormatInt\n\t_ time.Time\n)\n")
+
+	out, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format: %w", err)
+	}
+	return out, nil
+}
+
+func methodIndex(method string) int {
+	for i, m := range methods {
+		if m == method {
+			return i
+		}
+	}
+	return len(methods)
+}
+
+func main() {
+	specPath := flag.String("spec", "", "path to the OpenAPI document")
+	outPath := flag.String("out", "", "path to write the generated client")
+	flag.Parse()
+
+	spec, err := os.ReadFile(*specPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "read spec: %s\n", err)
+		os.Exit(1)
+	}
+	out, err := generate(spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "generate: %s\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*outPath, out, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "write: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Tests the generated client is up to date with the OpenAPI document.
+func TestGenerate_UpToDate(t *testing.T) {
+	spec, err := os.ReadFile("../../../openapi.yaml")
+	require.NoError(t, err)
+	generated, err := os.ReadFile("../../client_gen.go")
+	require.NoError(t, err)
+
+	out, err := generate(spec)
+	require.NoError(t, err)
+	assert.Equal(
+		t, string(generated), string(out),
+		"client out of date, run 'go generate ./server/admin/...'",
+	)
+}
+
+func TestGoName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"endpoint_id", "EndpointID"},
+		{"last_client_ip", "LastClientIP"},
+		{"endpointID", "EndpointID"},
+		{"getOpenAPIJSON", "GetOpenAPIJSON"},
+		{"ja3", "JA3"},
+		{"Entries", "Entries"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, goName(tt.name))
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package admin
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// openAPIYAML is the OpenAPI document describing the admin API.
+//
+//go:embed openapi.yaml
+var openAPIYAML []byte
+
+var openAPIJSON = mustOpenAPIJSON()
+
+func (s *Server) openAPIJSONRoute(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json", openAPIJSON)
+}
+
+func (s *Server) openAPIYAMLRoute(c *gin.Context) {
+	c.Data(http.StatusOK, "application/yaml", openAPIYAML)
+}
+
+func mustOpenAPIJSON() []byte {
+	var doc any
+	if err := yaml.Unmarshal(openAPIYAML, &doc); err != nil {
+		panic("openapi: parse: " + err.Error())
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		panic("openapi: encode: " + err.Error())
+	}
+	return b
+}
@@ -0,0 +1,81 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/features"
+	"github.com/andydunstall/piko/server/gossip"
+	"github.com/andydunstall/piko/server/proxy"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+var pathParamRe = regexp.MustCompile(`:([A-Za-z]+)`)
+
+// Tests the OpenAPI document describes every admin route, and every route
+// in the document exists.
+func TestOpenAPI_Routes(t *testing.T) {
+	s := NewServer(nil, prometheus.NewRegistry(), nil, nil, log.NewNopLogger())
+	// Register the same handlers as the server.
+	s.AddStatus("/upstream", upstream.NewStatus(nil))
+	s.AddStatus("/cluster", cluster.NewStatus(nil))
+	s.AddStatus("/features", features.NewStatus(nil))
+	s.AddStatus("/gossip", gossip.NewStatus(nil))
+	s.AddStatus("/proxy", &proxy.FingerprintStatus{})
+	s.AddHandler("/queue/v1", &proxy.QueueHandler{})
+	s.AddHandler("/domains/v1", &proxy.DomainsHandler{})
+	s.AddHandler("/capture/v1", &proxy.CaptureHandler{})
+	s.AddHandler("/canary/v1", &proxy.CanaryHandler{})
+
+	var routes []string
+	for _, route := range s.router.Routes() {
+		// The pprof routes are for debugging so aren't documented.
+		if strings.HasPrefix(route.Path, "/debug/pprof/") {
+			continue
+		}
+		path := pathParamRe.ReplaceAllString(route.Path, "{$1}")
+		routes = append(routes, route.Method+" "+path)
+	}
+	sort.Strings(routes)
+
+	var doc struct {
+		Paths map[string]map[string]any `yaml:"paths"`
+	}
+	require.NoError(t, yaml.Unmarshal(openAPIYAML, &doc))
+
+	var documented []string
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(documented)
+
+	assert.Equal(t, routes, documented)
+}
+
+func TestOpenAPI_Serve(t *testing.T) {
+	s := NewServer(nil, prometheus.NewRegistry(), nil, nil, log.NewNopLogger())
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `"openapi":"3.0.3"`)
+
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.yaml", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, openAPIYAML, w.Body.Bytes())
+}
@@ -0,0 +1,54 @@
+package admin
+
+import (
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
+)
+
+type options struct {
+	authLockout    *middleware.AuthLockout
+	clientCertAuth bool
+	headers        protocol.Headers
+}
+
+type authLockoutOption struct {
+	AuthLockout *middleware.AuthLockout
+}
+
+func (o authLockoutOption) apply(opts *options) {
+	opts.authLockout = o.AuthLockout
+}
+
+// WithAuthLockout configures the server to lock out client IPs and token IDs
+// with repeated authentication failures.
+func WithAuthLockout(lockout *middleware.AuthLockout) Option {
+	return authLockoutOption{AuthLockout: lockout}
+}
+
+type clientCertAuthOption bool
+
+func (o clientCertAuthOption) apply(opts *options) {
+	opts.clientCertAuth = bool(o)
+}
+
+// WithClientCertAuth configures the server to accept requests with a verified
+// client certificate without requiring a token.
+func WithClientCertAuth(enabled bool) Option {
+	return clientCertAuthOption(enabled)
+}
+
+type headersOption protocol.Headers
+
+func (o headersOption) apply(opts *options) {
+	opts.headers = protocol.Headers(o)
+}
+
+// WithHeaders configures the names of the Piko headers, such as the header
+// containing the token.
+func WithHeaders(headers protocol.Headers) Option {
+	return headersOption(headers)
+}
+
+type Option interface {
+	apply(*options)
+}
@@ -0,0 +1,99 @@
+package admin
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/auth"
+	"github.com/andydunstall/piko/pkg/middleware"
+)
+
+// authorize rejects requests where the clients role doesn't permit the
+// request.
+//
+// The client role is taken from the authenticated token, or if the client
+// authenticated with a client certificate, from the certificate. If the
+// client isn't authenticated (such as authentication is disabled), all
+// requests are permitted.
+//
+// Clients without a role default to viewer, and clients with an unknown role
+// aren't permitted any requests.
+func (s *Server) authorize(c *gin.Context) {
+	role, ok := clientRole(c)
+	if !ok {
+		c.Next()
+		return
+	}
+
+	required := requiredRole(c.Request)
+	if !role.Permits(required) {
+		s.logger.Warn(
+			"role not permitted",
+			zap.String("path", c.Request.URL.Path),
+			zap.String("method", c.Request.Method),
+			zap.String("role", string(role)),
+			zap.String("required-role", string(required)),
+		)
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{"error": "role not permitted"},
+		)
+		return
+	}
+
+	c.Next()
+}
+
+// clientRole returns the role of the authenticated client, or false if the
+// client isn't authenticated.
+func clientRole(c *gin.Context) (auth.Role, bool) {
+	if token, ok := c.Get(middleware.TokenContextKey); ok {
+		role, err := auth.ParseRole(string(token.(*auth.Token).Role))
+		if err != nil {
+			// An unknown role permits nothing.
+			return token.(*auth.Token).Role, true
+		}
+		return role, true
+	}
+	if hasVerifiedClientCert(c.Request) {
+		return clientCertRole(c.Request), true
+	}
+	return "", false
+}
+
+// clientCertRole returns the role of the verified client certificate.
+//
+// The role is the first organizational unit (OU) in the certificate subject
+// that is a known role, such as 'OU=viewer'. If the certificate doesn't
+// include a role, defaults to viewer.
+func clientCertRole(r *http.Request) auth.Role {
+	cert := r.TLS.VerifiedChains[0][0]
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if ou == "" {
+			continue
+		}
+		if role, err := auth.ParseRole(ou); err == nil {
+			return role
+		}
+	}
+	return auth.RoleViewer
+}
+
+// requiredRole returns the minimum role required to access the request.
+//
+// Debug endpoints (such as profiling) require admin, reading state requires
+// viewer, and any other requests require operator.
+func requiredRole(r *http.Request) auth.Role {
+	if strings.HasPrefix(r.URL.Path, "/debug/") {
+		return auth.RoleAdmin
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return auth.RoleViewer
+	default:
+		return auth.RoleOperator
+	}
+}
@@ -2,6 +2,7 @@ package admin
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -26,16 +27,41 @@ type ReverseProxy struct {
 	logger log.Logger
 }
 
-func NewReverseProxy(logger log.Logger) *ReverseProxy {
+// NewReverseProxy creates a proxy to forward requests to other nodes admin
+// servers.
+//
+// If the admin server uses TLS ('tlsConfig' isn't nil), requests are
+// forwarded using TLS. The node presents its own certificate to the remote
+// node as a client certificate, and verifies the remote nodes certificate
+// using the configured client CAs (or the system CAs if none are
+// configured), since all nodes are expected to share the same configuration.
+func NewReverseProxy(tlsConfig *tls.Config, logger log.Logger) *ReverseProxy {
 	rp := &ReverseProxy{
 		logger: logger,
 	}
 
+	scheme := "http"
+	transport := http.DefaultTransport
+	if tlsConfig != nil {
+		scheme = "https"
+
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{
+			Certificates: tlsConfig.Certificates,
+			// If the certificate is reloaded or obtained using ACME, present
+			// the current certificate rather than the certificate at startup.
+			GetClientCertificate: tlsConfig.GetClientCertificate,
+			RootCAs:              tlsConfig.ClientCAs,
+		}
+		transport = t
+	}
+
 	rp.proxy = &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
-			req.URL.Scheme = "http"
+			req.URL.Scheme = scheme
 			req.URL.Host = req.Context().Value(hostContextKey).(string)
 		},
+		Transport:    transport,
 		ErrorLog:     logger.StdLogger(zapcore.WarnLevel),
 		ErrorHandler: rp.errorHandler,
 	}
@@ -46,7 +46,13 @@ func NewServer(
 	verifier auth.Verifier,
 	tlsConfig *tls.Config,
 	logger log.Logger,
+	opts ...Option,
 ) *Server {
+	options := options{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
 	logger = logger.WithSubsystem("admin")
 
 	router := gin.New()
@@ -54,7 +60,7 @@ func NewServer(
 		clusterState: clusterState,
 		ready:        atomic.NewBool(false),
 		registry:     registry,
-		proxy:        NewReverseProxy(logger),
+		proxy:        NewReverseProxy(tlsConfig, logger),
 		httpServer: &http.Server{
 			Handler:   router,
 			TLSConfig: tlsConfig,
@@ -68,10 +74,31 @@ func NewServer(
 	router.Use(gin.CustomRecoveryWithWriter(nil, server.panicRoute))
 
 	if verifier != nil {
-		authMiddleware := middleware.NewAuth(verifier, logger)
-		router.Use(authMiddleware.Verify)
+		authOpts := []middleware.AuthOption{
+			middleware.WithAuthHeaders(options.headers),
+		}
+		if options.authLockout != nil {
+			authOpts = append(authOpts, middleware.WithLockout(options.authLockout))
+		}
+		authMiddleware := middleware.NewAuth(verifier, logger, authOpts...)
+		if options.clientCertAuth {
+			router.Use(func(c *gin.Context) {
+				// Clients with a verified certificate don't require a token.
+				if hasVerifiedClientCert(c.Request) {
+					c.Next()
+					return
+				}
+				authMiddleware.Verify(c)
+			})
+		} else {
+			router.Use(authMiddleware.Verify)
+		}
 	}
 
+	// Authorize before forwarding, so clients can't bypass authorization by
+	// forwarding to another node.
+	router.Use(server.authorize)
+
 	if clusterState != nil {
 		router.Use(server.forwardInterceptor)
 	}
@@ -111,6 +138,11 @@ func (s *Server) AddStatus(route string, handler status.Handler) {
 	handler.Register(group)
 }
 
+// AddHandler registers the handlers routes under the given route.
+func (s *Server) AddHandler(route string, handler status.Handler) {
+	handler.Register(s.router.Group(route))
+}
+
 func (s *Server) SetReady(ready bool) {
 	s.ready.Store(ready)
 }
@@ -123,6 +155,9 @@ func (s *Server) registerRoutes(router *gin.Engine) {
 		router.GET("/metrics", s.metricsHandler())
 	}
 
+	router.GET("/openapi.json", s.openAPIJSONRoute)
+	router.GET("/openapi.yaml", s.openAPIYAMLRoute)
+
 	// From https://github.com/gin-contrib/pprof/blob/934af36b21728278339704005bcef2eec1375091/pprof.go#L32.
 	pprofGroup := s.router.Group("/debug/pprof")
 	pprofGroup.GET("/", gin.WrapF(pprof.Index))
@@ -195,6 +230,12 @@ func (s *Server) metricsHandler() gin.HandlerFunc {
 	}
 }
 
+// hasVerifiedClientCert returns whether the client presented a certificate
+// that was verified during the TLS handshake.
+func hasVerifiedClientCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
 func init() {
 	// Disable Gin debug logs.
 	gin.SetMode(gin.ReleaseMode)
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"net"
 	"net/http"
@@ -364,3 +366,276 @@ func TestServer_TLS(t *testing.T) {
 		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 	})
 }
+
+func TestServer_ClientCertAuth(t *testing.T) {
+	rootCAPool, cert, err := testutil.LocalTLSServerCert()
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    rootCAPool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+
+	verifier := &fakeVerifier{
+		handler: func(token string) (*auth.Token, error) {
+			if token == "123" {
+				return &auth.Token{}, nil
+			}
+			return nil, auth.ErrInvalidToken
+		},
+	}
+
+	s := NewServer(
+		nil,
+		prometheus.NewRegistry(),
+		verifier,
+		tlsConfig,
+		log.NewNopLogger(),
+		WithClientCertAuth(true),
+	)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	url := fmt.Sprintf("https://%s/health", ln.Addr().String())
+
+	t.Run("client cert", func(t *testing.T) {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs:      rootCAPool,
+					Certificates: []tls.Certificate{cert},
+				},
+			},
+		}
+
+		resp, err := client.Get(url)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("token", func(t *testing.T) {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs: rootCAPool,
+				},
+			},
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer 123")
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs: rootCAPool,
+				},
+			},
+		}
+
+		resp, err := client.Get(url)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+// Tests forwarding requests between nodes when the admin servers require
+// mTLS.
+func TestServer_ForwardTLS(t *testing.T) {
+	rootCAPool, cert, err := testutil.LocalTLSServerCert()
+	require.NoError(t, err)
+
+	t.Run("certificates", func(t *testing.T) {
+		testForwardTLS(t, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    rootCAPool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}, rootCAPool, cert)
+	})
+
+	// Tests forwarding when the certificate is loaded dynamically, such as
+	// when reloading or using autocert, so Certificates is empty.
+	t.Run("get certificate", func(t *testing.T) {
+		testForwardTLS(t, &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return &cert, nil
+			},
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &cert, nil
+			},
+			ClientCAs:  rootCAPool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}, rootCAPool, cert)
+	})
+}
+
+func testForwardTLS(
+	t *testing.T,
+	tlsConfig *tls.Config,
+	rootCAPool *x509.CertPool,
+	cert tls.Certificate,
+) {
+	ln1, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	state1 := cluster.NewState(&cluster.Node{
+		ID:        "node-1",
+		AdminAddr: ln1.Addr().String(),
+	}, log.NewNopLogger())
+
+	s1 := NewServer(
+		state1,
+		prometheus.NewRegistry(),
+		nil,
+		tlsConfig,
+		log.NewNopLogger(),
+	)
+	s1.AddStatus("/mystatus", &fakeStatus{})
+
+	go func() {
+		require.NoError(t, s1.Serve(ln1))
+	}()
+	defer s1.Shutdown(context.TODO())
+
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	state2 := cluster.NewState(&cluster.Node{
+		ID:        "node-2",
+		AdminAddr: ln2.Addr().String(),
+	}, log.NewNopLogger())
+	state2.AddNode(&cluster.Node{
+		ID:        "node-1",
+		AdminAddr: ln1.Addr().String(),
+	})
+
+	s2 := NewServer(
+		state2,
+		prometheus.NewRegistry(),
+		nil,
+		tlsConfig,
+		log.NewNopLogger(),
+	)
+
+	go func() {
+		require.NoError(t, s2.Serve(ln2))
+	}()
+	defer s2.Shutdown(context.TODO())
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      rootCAPool,
+				Certificates: []tls.Certificate{cert},
+			},
+		},
+	}
+
+	url := fmt.Sprintf("https://%s/status/mystatus/foo?forward=node-1", ln2.Addr().String())
+	resp, err := client.Get(url)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestServer_Authorization(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	verifier := &fakeVerifier{
+		handler: func(token string) (*auth.Token, error) {
+			// Use 'none' for tokens without a role.
+			if token == "none" {
+				return &auth.Token{}, nil
+			}
+			return &auth.Token{
+				Role: auth.Role(token),
+			}, nil
+		},
+	}
+
+	s := NewServer(
+		nil,
+		prometheus.NewRegistry(),
+		verifier,
+		nil,
+		log.NewNopLogger(),
+	)
+	s.AddStatus("/mystatus", &fakeStatus{})
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	tests := []struct {
+		role       auth.Role
+		method     string
+		path       string
+		statusCode int
+	}{
+		{auth.RoleViewer, http.MethodGet, "/status/mystatus/foo", http.StatusOK},
+		{auth.RoleViewer, http.MethodPost, "/status/mystatus/foo", http.StatusForbidden},
+		{auth.RoleViewer, http.MethodGet, "/debug/pprof/", http.StatusForbidden},
+		{auth.RoleOperator, http.MethodGet, "/status/mystatus/foo", http.StatusOK},
+		// Passes authorization but the route doesn't exist.
+		{auth.RoleOperator, http.MethodPost, "/status/mystatus/foo", http.StatusNotFound},
+		{auth.RoleOperator, http.MethodGet, "/debug/pprof/", http.StatusForbidden},
+		{auth.RoleAdmin, http.MethodGet, "/debug/pprof/", http.StatusOK},
+		// Tokens without a role default to viewer.
+		{"none", http.MethodGet, "/status/mystatus/foo", http.StatusOK},
+		{"none", http.MethodPost, "/status/mystatus/foo", http.StatusForbidden},
+		// Unknown roles aren't permitted any requests.
+		{"unknown", http.MethodGet, "/status/mystatus/foo", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.role)+" "+tt.method+" "+tt.path, func(t *testing.T) {
+			url := fmt.Sprintf("http://%s%s", ln.Addr().String(), tt.path)
+			req, _ := http.NewRequest(tt.method, url, nil)
+			req.Header.Set("Authorization", "Bearer "+string(tt.role))
+			resp, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestClientCertRole(t *testing.T) {
+	request := func(ous ...string) *http.Request {
+		cert := &x509.Certificate{
+			Subject: pkix.Name{
+				OrganizationalUnit: ous,
+			},
+		}
+		return &http.Request{
+			TLS: &tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{cert}},
+			},
+		}
+	}
+
+	assert.Equal(t, auth.RoleViewer, clientCertRole(request("viewer")))
+	assert.Equal(t, auth.RoleOperator, clientCertRole(request("eng", "operator")))
+	// Defaults to viewer.
+	assert.Equal(t, auth.RoleViewer, clientCertRole(request()))
+	assert.Equal(t, auth.RoleViewer, clientCertRole(request("eng")))
+}
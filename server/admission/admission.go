@@ -0,0 +1,283 @@
+package admission
+
+import (
+	"context"
+	"net/http"
+	"runtime/metrics"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/ratelimit"
+	"github.com/andydunstall/piko/server/config"
+)
+
+const (
+	heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+)
+
+// Controller sheds new connections and requests when heap usage exceeds the
+// configured watermark, to avoid the server being OOM killed during traffic
+// spikes.
+//
+// The controller also sheds new upstream connections when open file
+// descriptors near the process limit, so the server refuses upstream
+// connections with a clear error rather than failing randomly across the
+// data path once file descriptors are exhausted.
+//
+// Once shedding, the controller keeps shedding until usage falls below the
+// resume watermark, so the server doesn't flap around a single threshold.
+type Controller struct {
+	maxHeapBytes    uint64
+	resumeHeapBytes uint64
+	maxFileRatio    float64
+	resumeFileRatio float64
+	checkInterval   time.Duration
+	retryAfter      time.Duration
+
+	// heapBytes returns the current heap usage. Overridden in tests.
+	heapBytes func() uint64
+
+	// openFiles returns the number of open file descriptors and the file
+	// descriptor limit, or false if not supported. Overridden in tests.
+	openFiles func() (uint64, uint64, bool)
+
+	shedding *atomic.Bool
+	// fileShedding indicates whether the controller is rejecting upstream
+	// connections due to file descriptor usage.
+	fileShedding *atomic.Bool
+	// nextCheck is when heap usage will next be sampled, which is the
+	// earliest the controller can stop shedding.
+	nextCheck *atomic.Time
+
+	metrics *Metrics
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	logger log.Logger
+}
+
+func NewController(conf config.AdmissionConfig, logger log.Logger) *Controller {
+	resumeHeapBytes := conf.ResumeHeapBytes
+	if resumeHeapBytes == 0 {
+		resumeHeapBytes = conf.MaxHeapBytes / 10 * 9
+	}
+
+	resumeFileRatio := conf.ResumeFileRatio
+	if resumeFileRatio == 0 {
+		resumeFileRatio = conf.MaxFileRatio * 0.9
+	}
+
+	logger = logger.WithSubsystem("admission")
+	if conf.MaxFileRatio != 0 {
+		if _, _, ok := readOpenFiles(); !ok {
+			logger.Warn("file descriptor admission control not supported on this platform")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Controller{
+		maxHeapBytes:    conf.MaxHeapBytes,
+		resumeHeapBytes: resumeHeapBytes,
+		maxFileRatio:    conf.MaxFileRatio,
+		resumeFileRatio: resumeFileRatio,
+		checkInterval:   conf.CheckInterval,
+		retryAfter:      conf.RetryAfter,
+		heapBytes:       readHeapBytes,
+		openFiles:       readOpenFiles,
+		shedding:        atomic.NewBool(false),
+		fileShedding:    atomic.NewBool(false),
+		nextCheck:       atomic.NewTime(time.Time{}),
+		metrics:         NewMetrics(),
+		ctx:             ctx,
+		cancel:          cancel,
+		logger:          logger,
+	}
+}
+
+// Start samples heap usage until the controller is stopped.
+func (c *Controller) Start() {
+	ticker := time.NewTicker(c.checkInterval)
+	defer ticker.Stop()
+
+	c.check()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.check()
+		}
+	}
+}
+
+func (c *Controller) Stop() {
+	c.cancel()
+}
+
+// Shedding returns whether the controller is currently rejecting new
+// connections and requests.
+func (c *Controller) Shedding() bool {
+	return c.shedding.Load()
+}
+
+// FileShedding returns whether the controller is currently rejecting new
+// upstream connections due to file descriptor usage.
+func (c *Controller) FileShedding() bool {
+	return c.fileShedding.Load()
+}
+
+// Handler returns middleware that rejects requests with '503 Service
+// Unavailable' while the controller is shedding. 'server' identifies the
+// server in metrics.
+func (c *Controller) Handler(server string) gin.HandlerFunc {
+	shedTotal := c.metrics.ShedTotal.WithLabelValues(server)
+	return func(ctx *gin.Context) {
+		if !c.shedding.Load() {
+			ctx.Next()
+			return
+		}
+
+		shedTotal.Inc()
+		c.reject(ctx, "server overloaded")
+	}
+}
+
+// FileHandler returns middleware that rejects upstream connections with
+// '503 Service Unavailable' while file descriptor usage exceeds the
+// watermark.
+//
+// Only upstream connections are rejected, since each upstream connection
+// holds a file descriptor for its lifetime, whereas proxy requests to an
+// upstream connected to this node are multiplexed over the existing
+// connection.
+func (c *Controller) FileHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !c.fileShedding.Load() {
+			ctx.Next()
+			return
+		}
+
+		c.metrics.FileShedTotal.Inc()
+		c.reject(ctx, "server near file descriptor limit")
+	}
+}
+
+func (c *Controller) reject(ctx *gin.Context, message string) {
+	if retryAfter := c.RetryAfter(); retryAfter != 0 {
+		ctx.Header("Retry-After", strconv.Itoa(
+			ratelimit.RetryAfterSeconds(retryAfter),
+		))
+	}
+	ctx.AbortWithStatusJSON(
+		http.StatusServiceUnavailable,
+		gin.H{"error": message},
+	)
+}
+
+// RetryAfter returns the duration clients should wait before retrying a
+// rejected request, or zero if 'Retry-After' is disabled.
+//
+// This is the configured retry after, though no less than the time until
+// heap usage is next sampled, since the controller can't stop shedding
+// before then.
+func (c *Controller) RetryAfter() time.Duration {
+	if c.retryAfter == 0 {
+		return 0
+	}
+	return max(c.retryAfter, time.Until(c.nextCheck.Load()))
+}
+
+func (c *Controller) Metrics() *Metrics {
+	return c.metrics
+}
+
+func (c *Controller) check() {
+	c.nextCheck.Store(time.Now().Add(c.checkInterval))
+
+	if c.maxHeapBytes != 0 {
+		c.checkHeap()
+	}
+	if c.maxFileRatio != 0 {
+		c.checkFiles()
+	}
+}
+
+func (c *Controller) checkHeap() {
+	heapBytes := c.heapBytes()
+	c.metrics.HeapBytes.Set(float64(heapBytes))
+
+	if !c.shedding.Load() && heapBytes >= c.maxHeapBytes {
+		c.shedding.Store(true)
+		c.metrics.Shedding.Set(1)
+		c.logger.Warn(
+			"heap exceeds max watermark; shedding load",
+			zap.Uint64("heap-bytes", heapBytes),
+			zap.Uint64("max-heap-bytes", c.maxHeapBytes),
+		)
+		return
+	}
+
+	if c.shedding.Load() && heapBytes < c.resumeHeapBytes {
+		c.shedding.Store(false)
+		c.metrics.Shedding.Set(0)
+		c.logger.Info(
+			"heap below resume watermark; accepting load",
+			zap.Uint64("heap-bytes", heapBytes),
+			zap.Uint64("resume-heap-bytes", c.resumeHeapBytes),
+		)
+	}
+}
+
+func (c *Controller) checkFiles() {
+	open, limit, ok := c.openFiles()
+	if !ok || limit == 0 {
+		return
+	}
+	c.metrics.FileDescriptors.Set(float64(open))
+	c.metrics.FileDescriptorsLimit.Set(float64(limit))
+	c.metrics.FileDescriptorsHeadroom.Set(float64(limit) - float64(open))
+
+	ratio := float64(open) / float64(limit)
+	if !c.fileShedding.Load() && ratio >= c.maxFileRatio {
+		c.fileShedding.Store(true)
+		c.metrics.FileShedding.Set(1)
+		c.logger.Warn(
+			"file descriptors exceed max watermark; rejecting upstream connections",
+			zap.Uint64("open-files", open),
+			zap.Uint64("file-limit", limit),
+			zap.Float64("max-file-ratio", c.maxFileRatio),
+		)
+		return
+	}
+
+	if c.fileShedding.Load() && ratio < c.resumeFileRatio {
+		c.fileShedding.Store(false)
+		c.metrics.FileShedding.Set(0)
+		c.logger.Info(
+			"file descriptors below resume watermark; accepting upstream connections",
+			zap.Uint64("open-files", open),
+			zap.Uint64("file-limit", limit),
+			zap.Float64("resume-file-ratio", c.resumeFileRatio),
+		)
+	}
+}
+
+// readHeapBytes returns the bytes occupied by live and not yet swept heap
+// objects.
+//
+// This uses runtime/metrics rather than runtime.ReadMemStats, which stops the
+// world.
+func readHeapBytes() uint64 {
+	samples := []metrics.Sample{{Name: heapObjectsMetric}}
+	metrics.Read(samples)
+	if samples[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return samples[0].Value.Uint64()
+}
@@ -0,0 +1,235 @@
+package admission
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+)
+
+type errorMessage struct {
+	Error string `json:"error"`
+}
+
+func TestController_Watermarks(t *testing.T) {
+	c := NewController(config.AdmissionConfig{
+		MaxHeapBytes:    1000,
+		ResumeHeapBytes: 800,
+		CheckInterval:   time.Second,
+	}, log.NewNopLogger())
+
+	var heapBytes uint64
+	c.heapBytes = func() uint64 {
+		return heapBytes
+	}
+
+	heapBytes = 500
+	c.check()
+	assert.False(t, c.Shedding())
+
+	// Exceeds the max watermark.
+	heapBytes = 1000
+	c.check()
+	assert.True(t, c.Shedding())
+
+	// Below the max watermark but above the resume watermark so continue
+	// shedding.
+	heapBytes = 900
+	c.check()
+	assert.True(t, c.Shedding())
+
+	// Below the resume watermark.
+	heapBytes = 799
+	c.check()
+	assert.False(t, c.Shedding())
+}
+
+func TestController_DefaultResumeWatermark(t *testing.T) {
+	c := NewController(config.AdmissionConfig{
+		MaxHeapBytes:  1000,
+		CheckInterval: time.Second,
+	}, log.NewNopLogger())
+	assert.Equal(t, uint64(900), c.resumeHeapBytes)
+}
+
+func TestController_Handler(t *testing.T) {
+	c := NewController(config.AdmissionConfig{
+		MaxHeapBytes:  1000,
+		CheckInterval: time.Second,
+		RetryAfter:    time.Second * 5,
+	}, log.NewNopLogger())
+
+	var heapBytes uint64
+	c.heapBytes = func() uint64 {
+		return heapBytes
+	}
+
+	router := gin.New()
+	router.Use(c.Handler("proxy"))
+	router.GET("/", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	t.Run("accept", func(t *testing.T) {
+		heapBytes = 500
+		c.check()
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("shed", func(t *testing.T) {
+		heapBytes = 2000
+		c.check()
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "5", w.Header().Get("Retry-After"))
+
+		var m errorMessage
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&m))
+		assert.Equal(t, "server overloaded", m.Error)
+	})
+}
+
+func TestReadHeapBytes(t *testing.T) {
+	assert.NotZero(t, readHeapBytes())
+}
+
+func init() {
+	// Disable Gin debug logs.
+	gin.SetMode(gin.ReleaseMode)
+}
+
+func TestController_RetryAfterRoundsUp(t *testing.T) {
+	c := NewController(config.AdmissionConfig{
+		MaxHeapBytes:  1000,
+		CheckInterval: time.Second,
+		RetryAfter:    time.Millisecond * 500,
+	}, log.NewNopLogger())
+	c.heapBytes = func() uint64 {
+		return 2000
+	}
+	c.check()
+
+	router := gin.New()
+	router.Use(c.Handler("proxy"))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+}
+
+func TestController_RetryAfterNextCheck(t *testing.T) {
+	c := NewController(config.AdmissionConfig{
+		MaxHeapBytes:  1000,
+		CheckInterval: time.Minute,
+		RetryAfter:    time.Second * 5,
+	}, log.NewNopLogger())
+	c.heapBytes = func() uint64 {
+		return 2000
+	}
+	c.check()
+
+	// The controller can't resume until the next check in a minute.
+	retryAfter := c.RetryAfter()
+	assert.Greater(t, retryAfter, time.Second*59)
+	assert.LessOrEqual(t, retryAfter, time.Minute)
+
+	router := gin.New()
+	router.Use(c.Handler("proxy"))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+}
+
+func TestController_FileWatermarks(t *testing.T) {
+	c := NewController(config.AdmissionConfig{
+		MaxFileRatio:    0.9,
+		ResumeFileRatio: 0.8,
+		CheckInterval:   time.Second,
+	}, log.NewNopLogger())
+
+	var open uint64
+	c.openFiles = func() (uint64, uint64, bool) {
+		return open, 1000, true
+	}
+
+	open = 500
+	c.check()
+	assert.False(t, c.FileShedding())
+	assert.Equal(t, 500.0, testutil.ToFloat64(c.metrics.FileDescriptorsHeadroom))
+
+	// Exceeds the max watermark.
+	open = 900
+	c.check()
+	assert.True(t, c.FileShedding())
+	assert.Equal(t, 100.0, testutil.ToFloat64(c.metrics.FileDescriptorsHeadroom))
+	// Heap admission control is disabled.
+	assert.False(t, c.Shedding())
+
+	// Below the max watermark but above the resume watermark so continue
+	// shedding.
+	open = 850
+	c.check()
+	assert.True(t, c.FileShedding())
+
+	// Below the resume watermark.
+	open = 799
+	c.check()
+	assert.False(t, c.FileShedding())
+}
+
+func TestController_FileHandler(t *testing.T) {
+	c := NewController(config.AdmissionConfig{
+		MaxFileRatio:  0.9,
+		CheckInterval: time.Second,
+		RetryAfter:    time.Second * 5,
+	}, log.NewNopLogger())
+	assert.Equal(t, 0.81, c.resumeFileRatio)
+
+	c.openFiles = func() (uint64, uint64, bool) {
+		return 950, 1000, true
+	}
+	c.check()
+
+	router := gin.New()
+	router.Use(c.Handler("upstream"))
+	router.Use(c.FileHandler())
+	router.GET("/", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "5", w.Header().Get("Retry-After"))
+
+	var m errorMessage
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&m))
+	assert.Equal(t, "server near file descriptor limit", m.Error)
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.metrics.FileShedTotal))
+}
+
+func TestReadOpenFiles(t *testing.T) {
+	open, limit, ok := readOpenFiles()
+	if !ok {
+		t.Skip("not supported")
+	}
+	assert.NotZero(t, open)
+	assert.Greater(t, limit, open)
+}
@@ -0,0 +1,23 @@
+package admission
+
+import (
+	"os"
+	"syscall"
+)
+
+// readOpenFiles returns the number of open file descriptors and the file
+// descriptor limit of the process.
+func readOpenFiles() (uint64, uint64, bool) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, 0, false
+	}
+
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, 0, false
+	}
+	// Exclude the file descriptor used to read the directory.
+	open := uint64(max(len(entries)-1, 0))
+	return open, limit.Cur, true
+}
@@ -0,0 +1,116 @@
+package admission
+
+import "github.com/prometheus/client_golang/prometheus"
+
+type Metrics struct {
+	// HeapBytes is the last sampled heap usage.
+	HeapBytes prometheus.Gauge
+
+	// Shedding is 1 when the server is shedding load, 0 otherwise.
+	Shedding prometheus.Gauge
+
+	// ShedTotal is the number of requests and connections rejected due to
+	// memory pressure, labelled by server.
+	ShedTotal *prometheus.CounterVec
+
+	// FileDescriptors is the last sampled number of open file descriptors.
+	FileDescriptors prometheus.Gauge
+
+	// FileDescriptorsLimit is the process file descriptor limit.
+	FileDescriptorsLimit prometheus.Gauge
+
+	// FileDescriptorsHeadroom is the number of file descriptors that can be
+	// opened before reaching the limit.
+	FileDescriptorsHeadroom prometheus.Gauge
+
+	// FileShedding is 1 when the server is rejecting upstream connections
+	// due to file descriptor usage, 0 otherwise.
+	FileShedding prometheus.Gauge
+
+	// FileShedTotal is the number of upstream connections rejected due to
+	// file descriptor usage.
+	FileShedTotal prometheus.Counter
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		HeapBytes: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "admission",
+				Name:      "heap_bytes",
+				Help:      "Last sampled heap usage in bytes",
+			},
+		),
+		Shedding: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "admission",
+				Name:      "shedding",
+				Help:      "Whether the server is shedding load due to memory pressure",
+			},
+		),
+		ShedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "admission",
+				Name:      "shed_total",
+				Help:      "Number of requests and connections rejected due to memory pressure",
+			},
+			[]string{"server"},
+		),
+		FileDescriptors: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "admission",
+				Name:      "file_descriptors",
+				Help:      "Last sampled number of open file descriptors",
+			},
+		),
+		FileDescriptorsLimit: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "admission",
+				Name:      "file_descriptors_limit",
+				Help:      "Process file descriptor limit",
+			},
+		),
+		FileDescriptorsHeadroom: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "admission",
+				Name:      "file_descriptors_headroom",
+				Help:      "Number of file descriptors that can be opened before reaching the limit",
+			},
+		),
+		FileShedding: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "admission",
+				Name:      "file_shedding",
+				Help:      "Whether the server is rejecting upstream connections due to file descriptor usage",
+			},
+		),
+		FileShedTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "admission",
+				Name:      "file_shed_total",
+				Help:      "Number of upstream connections rejected due to file descriptor usage",
+			},
+		),
+	}
+}
+
+func (m *Metrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.HeapBytes,
+		m.Shedding,
+		m.ShedTotal,
+		m.FileDescriptors,
+		m.FileDescriptorsLimit,
+		m.FileDescriptorsHeadroom,
+		m.FileShedding,
+		m.FileShedTotal,
+	)
+}
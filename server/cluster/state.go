@@ -1,6 +1,7 @@
 package cluster
 
 import (
+	"math/rand"
 	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -124,6 +125,32 @@ func (s *State) LookupEndpoint(endpointID string) (*Node, bool) {
 	return nil, false
 }
 
+// LookupEndpointNodes returns the nodes that the endpoint with the given ID
+// is active on, in random order so requests are spread across the nodes.
+func (s *State) LookupEndpointNodes(endpointID string) []*Node {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var nodes []*Node
+	for _, node := range s.nodes {
+		if node.ID == s.localID {
+			// Ignore ourselves.
+			continue
+		}
+		if node.Status != NodeStatusActive {
+			// Ignore unreachable and left nodes.
+			continue
+		}
+		if listeners, ok := node.Endpoints[endpointID]; ok && listeners > 0 {
+			nodes = append(nodes, node.Copy())
+		}
+	}
+	rand.Shuffle(len(nodes), func(i, j int) {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	})
+	return nodes
+}
+
 // AddLocalEndpoint adds the active endpoint to the local node state.
 func (s *State) AddLocalEndpoint(endpointID string) {
 	s.mu.Lock()
@@ -365,3 +365,33 @@ func TestState_LookupEndpoint(t *testing.T) {
 		assert.False(t, ok)
 	})
 }
+
+func TestState_LookupEndpointNodes(t *testing.T) {
+	localNode := &Node{
+		ID:     "local",
+		Status: NodeStatusActive,
+	}
+	s := NewState(localNode.Copy(), log.NewNopLogger())
+	s.AddLocalEndpoint("my-endpoint")
+
+	for _, node := range []*Node{
+		{ID: "remote-1", Status: NodeStatusActive},
+		{ID: "remote-2", Status: NodeStatusActive},
+		{ID: "remote-3", Status: NodeStatusUnreachable},
+		{ID: "remote-4", Status: NodeStatusActive},
+	} {
+		s.AddNode(node)
+	}
+	assert.True(t, s.UpdateRemoteEndpoint("remote-1", "my-endpoint", 1))
+	assert.True(t, s.UpdateRemoteEndpoint("remote-2", "my-endpoint", 3))
+	assert.True(t, s.UpdateRemoteEndpoint("remote-3", "my-endpoint", 2))
+	assert.True(t, s.UpdateRemoteEndpoint("remote-4", "other-endpoint", 2))
+
+	var ids []string
+	for _, node := range s.LookupEndpointNodes("my-endpoint") {
+		ids = append(ids, node.ID)
+	}
+	assert.ElementsMatch(t, []string{"remote-1", "remote-2"}, ids)
+
+	assert.Empty(t, s.LookupEndpointNodes("unknown"))
+}
@@ -2,13 +2,22 @@ package config
 
 import (
 	"fmt"
+	"html/template"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/spf13/pflag"
 
 	"github.com/andydunstall/piko/pkg/auth"
+	"github.com/andydunstall/piko/pkg/goruntime"
 	"github.com/andydunstall/piko/pkg/gossip"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/pkg/ratelimit"
 )
 
 // HTTPConfig contains generic configuration for the HTTP servers.
@@ -98,6 +107,60 @@ type ProxyConfig struct {
 	// requests.
 	AccessLog bool `json:"access_log" yaml:"access_log"`
 
+	// SampleRate enables sampling the access log and request/response size
+	// metrics, where only 1 in every SampleRate requests is sampled. Requests
+	// that fail with a server error are always sampled.
+	//
+	// Zero or one samples all requests.
+	SampleRate int `json:"sample_rate" yaml:"sample_rate"`
+
+	// EndpointSampleRates overrides SampleRate for specific endpoints,
+	// mapping endpoint ID to sample rate.
+	EndpointSampleRates map[string]int `json:"endpoint_sample_rates" yaml:"endpoint_sample_rates"`
+
+	// BatchMetricsInterval enables batching request latency observations,
+	// where observations are buffered per CPU and flushed to the latency
+	// histogram at most the given interval apart.
+	//
+	// Zero disables batching.
+	BatchMetricsInterval time.Duration `json:"batch_metrics_interval" yaml:"batch_metrics_interval"`
+
+	// IdentityHeaders indicates whether to add the identity of the
+	// authenticated client to requests forwarded to upstreams, and strip any
+	// identity headers from the incoming request.
+	IdentityHeaders bool `json:"identity_headers" yaml:"identity_headers"`
+
+	// PublicEndpoints contains endpoint IDs that clients can access without
+	// a token when proxy authentication is enabled.
+	//
+	// Proxy authentication applies to all other endpoints, so endpoints
+	// aren't publicly reachable unless explicitly configured.
+	PublicEndpoints []string `json:"public_endpoints" yaml:"public_endpoints"`
+
+	Uploads UploadsConfig `json:"uploads" yaml:"uploads"`
+
+	Queue QueueConfig `json:"queue" yaml:"queue"`
+
+	WaitingRoom WaitingRoomConfig `json:"waiting_room" yaml:"waiting_room"`
+
+	StickySessions StickySessionsConfig `json:"sticky_sessions" yaml:"sticky_sessions"`
+
+	Filter FilterConfig `json:"filter" yaml:"filter"`
+
+	Fingerprint FingerprintConfig `json:"fingerprint" yaml:"fingerprint"`
+
+	CustomDomains CustomDomainsConfig `json:"custom_domains" yaml:"custom_domains"`
+
+	Redirect RedirectConfig `json:"redirect" yaml:"redirect"`
+
+	HSTS HSTSConfig `json:"hsts" yaml:"hsts"`
+
+	Transfers TransfersConfig `json:"transfers" yaml:"transfers"`
+
+	Canary CanaryConfig `json:"canary" yaml:"canary"`
+
+	RouteLabels RouteLabelsConfig `json:"route_labels" yaml:"route_labels"`
+
 	Auth auth.Config `json:"auth" yaml:"auth"`
 
 	HTTP HTTPConfig `json:"http" yaml:"http"`
@@ -109,6 +172,68 @@ func (c *ProxyConfig) Validate() error {
 	if c.BindAddr == "" {
 		return fmt.Errorf("missing bind addr")
 	}
+	if c.SampleRate < 0 {
+		return fmt.Errorf("sample rate cannot be negative")
+	}
+	for endpointID, rate := range c.EndpointSampleRates {
+		if rate < 0 {
+			return fmt.Errorf("endpoint sample rate cannot be negative: %s", endpointID)
+		}
+	}
+	if c.IdentityHeaders && !c.Auth.Enabled() {
+		return fmt.Errorf("identity headers require auth")
+	}
+	if len(c.PublicEndpoints) > 0 && !c.Auth.Enabled() {
+		return fmt.Errorf("public endpoints require auth")
+	}
+	if err := c.Uploads.Validate(); err != nil {
+		return fmt.Errorf("uploads: %w", err)
+	}
+	if err := c.Queue.Validate(); err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	if err := c.WaitingRoom.Validate(); err != nil {
+		return fmt.Errorf("waiting room: %w", err)
+	}
+	if err := c.StickySessions.Validate(); err != nil {
+		return fmt.Errorf("sticky sessions: %w", err)
+	}
+	if err := c.Filter.Validate(); err != nil {
+		return fmt.Errorf("filter: %w", err)
+	}
+	if err := c.Fingerprint.Validate(); err != nil {
+		return fmt.Errorf("fingerprint: %w", err)
+	}
+	if c.Fingerprint.Enabled && !c.TLS.Enabled() {
+		return fmt.Errorf("fingerprint: requires tls")
+	}
+	if err := c.CustomDomains.Validate(); err != nil {
+		return fmt.Errorf("custom domains: %w", err)
+	}
+	if c.CustomDomains.Enabled && !c.TLS.Enabled() {
+		return fmt.Errorf("custom domains: requires tls")
+	}
+	if err := c.Redirect.Validate(); err != nil {
+		return fmt.Errorf("redirect: %w", err)
+	}
+	if c.Redirect.Enabled() && !c.TLS.Enabled() {
+		return fmt.Errorf("redirect: requires tls")
+	}
+	if err := c.HSTS.Validate(); err != nil {
+		return fmt.Errorf("hsts: %w", err)
+	}
+	if c.HSTS.Enabled() && !c.TLS.Enabled() {
+		return fmt.Errorf("hsts: requires tls")
+	}
+	if err := c.Transfers.Validate(); err != nil {
+		return fmt.Errorf("transfers: %w", err)
+	}
+	if err := c.Canary.Validate(); err != nil {
+		return fmt.Errorf("canary: %w", err)
+	}
+	if err := c.RouteLabels.Validate(); err != nil {
+		return fmt.Errorf("route labels: %w", err)
+	}
 	if err := c.TLS.Validate(); err != nil {
 		return fmt.Errorf("tls: %w", err)
 	}
@@ -149,7 +274,10 @@ advertise address of '10.26.104.14:8000'.`,
 		"proxy.timeout",
 		c.Timeout,
 		`
-Timeout when forwarding incoming requests to the upstream.`,
+Timeout when forwarding incoming requests to the upstream.
+
+Upgraded connections, such as WebSockets or SPDY used by 'kubectl exec', aren't
+bound by the timeout once the upstream accepts the upgrade.`,
 	)
 
 	fs.BoolVar(
@@ -160,6 +288,109 @@ Timeout when forwarding incoming requests to the upstream.`,
 Whether to log all incoming connections and requests.`,
 	)
 
+	fs.IntVar(
+		&c.SampleRate,
+		"proxy.sample-rate",
+		c.SampleRate,
+		`
+Samples 1 in every N requests when logging requests (with
+'--proxy.access-log') and recording request and response size metrics.
+
+This avoids paying the full cost of logging and metrics for endpoints with
+a very high request rate. Requests that fail with a server error are always
+sampled, and request counts and latencies are always recorded.
+
+Zero or one samples all requests.`,
+	)
+
+	fs.StringToIntVar(
+		&c.EndpointSampleRates,
+		"proxy.endpoint-sample-rates",
+		c.EndpointSampleRates,
+		`
+Overrides '--proxy.sample-rate' for specific endpoints.
+
+Such as '--proxy.endpoint-sample-rates my-endpoint=100,other-endpoint=10'
+samples 1 in 100 requests to 'my-endpoint' and 1 in 10 requests to
+'other-endpoint'.`,
+	)
+
+	fs.DurationVar(
+		&c.BatchMetricsInterval,
+		"proxy.batch-metrics-interval",
+		c.BatchMetricsInterval,
+		`
+Enables batching request latency observations to avoid contention on the
+latency histograms under very high request rates.
+
+Observations are buffered per CPU and flushed to the histograms in batches,
+at most the given interval apart. All buffered observations are flushed when
+metrics are scraped.
+
+This only improves performance when handling a very high request rate across
+many CPUs, otherwise it adds a small overhead to each request.
+
+Zero disables batching.`,
+	)
+
+	fs.BoolVar(
+		&c.IdentityHeaders,
+		"proxy.identity-headers",
+		c.IdentityHeaders,
+		`
+Whether to pass the identity of authenticated clients to upstreams.
+
+When enabled, requests forwarded to upstreams include headers describing the
+verified token, so upstream services can authorize clients without
+validating the token themselves:
+- 'x-piko-subject': The token subject ('sub' claim)
+- 'x-piko-tenant': The token tenant ('piko.tenant' claim)
+- 'x-piko-scopes': Space separated token scopes ('piko.scopes' claim)
+
+Any identity headers in the incoming request are always removed, so clients
+can't spoof their identity.
+
+Requires proxy authentication to be enabled.`,
+	)
+
+	fs.StringSliceVar(
+		&c.PublicEndpoints,
+		"proxy.public-endpoints",
+		c.PublicEndpoints,
+		`
+Endpoint IDs that clients can access without a token when proxy
+authentication is enabled, such as '--proxy.public-endpoints my-endpoint'.
+
+Proxy authentication applies to all other endpoints, so endpoints aren't
+publicly reachable unless explicitly configured. Requests to public endpoints
+aren't verified, so the 'Authorization' header is forwarded to the upstream
+unchanged.
+
+Requires proxy authentication to be enabled.`,
+	)
+
+	c.Uploads.RegisterFlags(fs)
+
+	c.Queue.RegisterFlags(fs)
+
+	c.WaitingRoom.RegisterFlags(fs)
+
+	c.StickySessions.RegisterFlags(fs)
+
+	c.Filter.RegisterFlags(fs)
+
+	c.Fingerprint.RegisterFlags(fs)
+
+	c.CustomDomains.RegisterFlags(fs)
+
+	c.Redirect.RegisterFlags(fs)
+
+	c.HSTS.RegisterFlags(fs)
+
+	c.Transfers.RegisterFlags(fs)
+
+	c.Canary.RegisterFlags(fs)
+
 	c.HTTP.RegisterFlags(fs, "proxy")
 
 	c.Auth.RegisterFlags(fs, "proxy")
@@ -167,233 +398,2534 @@ Whether to log all incoming connections and requests.`,
 	c.TLS.RegisterFlags(fs, "proxy")
 }
 
-type UpstreamConfig struct {
-	// BindAddr is the address to bind to listen for incoming HTTP connections.
+type UploadsConfig struct {
+	// Enabled indicates whether to support resumable uploads using the tus
+	// protocol (https://tus.io).
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// Path is the directory to store incomplete uploads.
+	//
+	// Defaults to the 'uploads' subdirectory of the storage path, or if
+	// the storage path isn't configured, a 'piko-uploads' directory in the
+	// system temporary directory.
+	Path string `json:"path" yaml:"path"`
+
+	// MaxSize is the maximum size of an upload in bytes.
+	//
+	// Zero means there is no limit.
+	MaxSize int64 `json:"max_size" yaml:"max_size"`
+
+	// MaxTotalSize is the maximum total size of all incomplete uploads in
+	// bytes.
+	//
+	// Zero means there is no limit.
+	MaxTotalSize int64 `json:"max_total_size" yaml:"max_total_size"`
+
+	// Expiry is the duration after an upload was last written before an
+	// incomplete upload is discarded.
+	Expiry time.Duration `json:"expiry" yaml:"expiry"`
+}
+
+func (c *UploadsConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.MaxSize < 0 {
+		return fmt.Errorf("max size cannot be negative")
+	}
+	if c.MaxTotalSize < 0 {
+		return fmt.Errorf("max total size cannot be negative")
+	}
+	if c.Expiry <= 0 {
+		return fmt.Errorf("missing expiry")
+	}
+	return nil
+}
+
+func (c *UploadsConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(
+		&c.Enabled,
+		"proxy.uploads.enabled",
+		c.Enabled,
+		`
+Whether to support resumable uploads using the tus protocol
+(https://tus.io).
+
+When enabled, clients can create an upload by sending a tus creation request
+('POST' with a 'Tus-Resumable' and 'Upload-Length' header) to any upstream
+path. Piko stores the upload and returns its location, so clients on
+unreliable links can resume the upload after a failure rather than
+restarting it.
+
+Once the upload is complete, Piko forwards it to the upstream as a single
+'POST' request to the original path, and returns the upstream response.
+
+Note incomplete uploads are stored on the node that received the creation
+request, so clients must resume uploads with the same node (such as using
+sticky sessions). Incomplete uploads are lost if the node restarts, and are
+removed from the uploads path when the node starts.`,
+	)
+
+	fs.StringVar(
+		&c.Path,
+		"proxy.uploads.path",
+		c.Path,
+		`
+Directory to store incomplete uploads.
+
+The directory must not be shared with other Piko nodes, since uploads left
+in the directory are removed on startup.
+
+Defaults to the 'uploads' subdirectory of '--storage.path', or if not
+configured, a 'piko-uploads' directory in the system temporary directory.`,
+	)
+
+	fs.Int64Var(
+		&c.MaxSize,
+		"proxy.uploads.max-size",
+		c.MaxSize,
+		`
+Maximum size of an upload in bytes.
+
+Zero means there is no limit.`,
+	)
+
+	fs.Int64Var(
+		&c.MaxTotalSize,
+		"proxy.uploads.max-total-size",
+		c.MaxTotalSize,
+		`
+Maximum total size of all incomplete uploads in bytes.
+
+The full length of each upload is reserved when the upload is created, so
+Piko rejects new uploads with '507 Insufficient Storage' rather than exceeding
+the limit.
+
+Zero means there is no limit.`,
+	)
+
+	fs.DurationVar(
+		&c.Expiry,
+		"proxy.uploads.expiry",
+		c.Expiry,
+		`
+Duration after an upload was last written before an incomplete upload is
+discarded.`,
+	)
+}
+
+type StickySessionsConfig struct {
+	// Endpoints contains the IDs of the endpoints to route requests from the
+	// same client to the same upstream. Endpoint IDs may be wildcards, such
+	// as 'team-a/*'.
+	//
+	// If empty, sticky sessions are disabled.
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
+
+	// Header is a request header whose value is hashed to select the
+	// upstream, such as a session or tenant ID header. Requests without the
+	// header are load balanced as normal.
+	//
+	// If empty, affinity is tracked with a cookie instead.
+	Header string `json:"header" yaml:"header"`
+
+	// Cookie is the name of the cookie that records the upstream a client
+	// is routed to, when affinity isn't tracked with a header.
+	Cookie string `json:"cookie" yaml:"cookie"`
+
+	// CookieMaxAge is the maximum age of the affinity cookie.
+	//
+	// If zero, the cookie expires when the browser session ends.
+	CookieMaxAge time.Duration `json:"cookie_max_age" yaml:"cookie_max_age"`
+}
+
+// Enabled returns whether sticky sessions are enabled.
+func (c *StickySessionsConfig) Enabled() bool {
+	return len(c.Endpoints) > 0
+}
+
+// Permitted returns whether sticky sessions are enabled for the endpoint.
+func (c *StickySessionsConfig) Permitted(endpointID string) bool {
+	for _, pattern := range c.Endpoints {
+		if protocol.MatchEndpoint(pattern, endpointID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *StickySessionsConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	for _, endpointID := range c.Endpoints {
+		if err := protocol.ValidateEndpointID(endpointID); err != nil {
+			return fmt.Errorf("invalid endpoint: %w", err)
+		}
+	}
+	if c.Header == "" && c.Cookie == "" {
+		return fmt.Errorf("missing header or cookie")
+	}
+	if c.CookieMaxAge < 0 {
+		return fmt.Errorf("cookie max age cannot be negative")
+	}
+	return nil
+}
+
+func (c *StickySessionsConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(
+		&c.Endpoints,
+		"proxy.sticky-sessions.endpoints",
+		c.Endpoints,
+		`
+Endpoint IDs to route requests from the same client to the same upstream,
+when multiple agents register the endpoint, such as stateful applications that
+keep sessions in memory.
+
+By default affinity is tracked with a cookie containing the ID of the
+upstream. If the upstream disconnects, the request is load balanced as normal
+and the cookie is updated.
+
+Endpoint IDs may be wildcards, such as '--proxy.sticky-sessions.endpoints
+team-a/*'.
+
+If not given, sticky sessions are disabled.`,
+	)
+	fs.StringVar(
+		&c.Header,
+		"proxy.sticky-sessions.header",
+		c.Header,
+		`
+Request header whose value is hashed to select the upstream, such as a session
+or tenant ID header, rather than tracking affinity with a cookie.
+
+Requests with the same header value are routed to the same upstream while it
+is connected, and only requests to a disconnected upstream move to another
+upstream. Requests without the header are load balanced as normal.`,
+	)
+	fs.StringVar(
+		&c.Cookie,
+		"proxy.sticky-sessions.cookie",
+		c.Cookie,
+		`
+Name of the cookie that records the upstream a client is routed to.`,
+	)
+	fs.DurationVar(
+		&c.CookieMaxAge,
+		"proxy.sticky-sessions.cookie-max-age",
+		c.CookieMaxAge,
+		`
+Maximum age of the affinity cookie.
+
+If zero, the cookie expires when the browser session ends.`,
+	)
+}
+
+type FilterConfig struct {
+	// BlockUserAgents contains regular expressions matching the 'User-Agent'
+	// of requests to reject.
+	BlockUserAgents []string `json:"block_user_agents" yaml:"block_user_agents"`
+
+	// BlockPaths contains regular expressions matching the path of requests
+	// to reject.
+	BlockPaths []string `json:"block_paths" yaml:"block_paths"`
+
+	Challenge ChallengeConfig `json:"challenge" yaml:"challenge"`
+}
+
+// Enabled returns whether request filtering is enabled.
+func (c *FilterConfig) Enabled() bool {
+	return len(c.BlockUserAgents) > 0 ||
+		len(c.BlockPaths) > 0 ||
+		c.Challenge.Enabled()
+}
+
+func (c *FilterConfig) Validate() error {
+	for _, pattern := range c.BlockUserAgents {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid block user agent: %s: %w", pattern, err)
+		}
+	}
+	for _, pattern := range c.BlockPaths {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid block path: %s: %w", pattern, err)
+		}
+	}
+	if err := c.Challenge.Validate(); err != nil {
+		return fmt.Errorf("challenge: %w", err)
+	}
+	return nil
+}
+
+func (c *FilterConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(
+		&c.BlockUserAgents,
+		"proxy.filter.block-user-agents",
+		c.BlockUserAgents,
+		`
+Regular expressions matching the 'User-Agent' header of requests to reject
+with '403 Forbidden', such as to block internet scanners before they reach
+upstream services.
+
+Such as '--proxy.filter.block-user-agents "(?i)masscan,(?i)zgrab"'.`,
+	)
+
+	fs.StringSliceVar(
+		&c.BlockPaths,
+		"proxy.filter.block-paths",
+		c.BlockPaths,
+		`
+Regular expressions matching the path of requests to reject with
+'403 Forbidden', such as paths commonly probed by scanners.
+
+Such as '--proxy.filter.block-paths "^/wp-admin,\.php$,^/\.env"'.`,
+	)
+
+	c.Challenge.RegisterFlags(fs)
+}
+
+type FingerprintConfig struct {
+	// Enabled indicates whether to fingerprint the TLS client of downstream
+	// connections (using JA3 and JA4).
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// MaxFingerprints is the maximum number of distinct fingerprints to
+	// track for the admin API. Once reached, the least recently seen
+	// fingerprint is evicted.
+	MaxFingerprints int `json:"max_fingerprints" yaml:"max_fingerprints"`
+}
+
+func (c *FingerprintConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.MaxFingerprints <= 0 {
+		return fmt.Errorf("max fingerprints must be positive")
+	}
+	return nil
+}
+
+func (c *FingerprintConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(
+		&c.Enabled,
+		"proxy.fingerprint.enabled",
+		c.Enabled,
+		`
+Whether to fingerprint the TLS client of downstream connections.
+
+The JA3 and JA4 fingerprints identify the TLS client implementation from the
+TLS ClientHello, regardless of the client IP or user agent, which is useful
+to detect abusive clients. Fingerprints are added to access logs (as 'ja3'
+and 'ja4'), and the most common fingerprints can be queried using the admin
+API at '/status/proxy/fingerprints'.
+
+Requires proxy TLS.`,
+	)
+
+	fs.IntVar(
+		&c.MaxFingerprints,
+		"proxy.fingerprint.max-fingerprints",
+		c.MaxFingerprints,
+		`
+Maximum number of distinct fingerprints to track for the admin API. Once
+reached, the least recently seen fingerprint is evicted.`,
+	)
+}
+
+type CustomDomainsConfig struct {
+	// Enabled indicates whether tenants can attach their own domains to
+	// endpoints using the admin API.
+	//
+	// Once the tenant verifies they own the domain, requests with a
+	// matching Host are routed to the endpoint, and a certificate for the
+	// domain is obtained using ACME.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// Path is the file to persist custom domains.
+	//
+	// If not given, custom domains are lost when the server restarts.
+	Path string `json:"path" yaml:"path"`
+
+	// PendingExpiry is the duration an unverified domain is reserved for
+	// the endpoint. Once expired, the domain can be attached to another
+	// endpoint.
+	PendingExpiry time.Duration `json:"pending_expiry" yaml:"pending_expiry"`
+
+	// CertCacheDir is the directory to cache obtained certificates.
+	//
+	// If not given, certificates are obtained again when the server
+	// restarts, which may exceed the ACME providers rate limits.
+	CertCacheDir string `json:"cert_cache_dir" yaml:"cert_cache_dir"`
+
+	// ACMEDirectoryURL is the ACME directory URL of the certificate
+	// authority. Defaults to Let's Encrypt.
+	ACMEDirectoryURL string `json:"acme_directory_url" yaml:"acme_directory_url"`
+
+	// ACMEEmail is the contact email of the ACME account.
+	ACMEEmail string `json:"acme_email" yaml:"acme_email"`
+}
+
+func (c *CustomDomainsConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.PendingExpiry <= 0 {
+		return fmt.Errorf("pending expiry must be positive")
+	}
+	return nil
+}
+
+func (c *CustomDomainsConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(
+		&c.Enabled,
+		"proxy.custom-domains.enabled",
+		c.Enabled,
+		`
+Whether tenants can attach their own domains to endpoints.
+
+Domains are attached using the admin API at '/domains/v1/domains'. Once the
+tenant verifies they own the domain, using either a DNS TXT record or a
+HTTP challenge, requests with a matching 'Host' are routed to the endpoint
+and a certificate for the domain is obtained using ACME (TLS-ALPN-01), so
+the proxy must be reachable on port 443.
+
+Custom domains are stored by each node, so aren't shared across the
+cluster.
+
+Requires proxy TLS.`,
+	)
+	fs.StringVar(
+		&c.Path,
+		"proxy.custom-domains.path",
+		c.Path,
+		`
+File to persist custom domains.
+
+If not given, custom domains are lost when the server restarts.`,
+	)
+	fs.DurationVar(
+		&c.PendingExpiry,
+		"proxy.custom-domains.pending-expiry",
+		c.PendingExpiry,
+		`
+Duration an unverified domain is reserved for the endpoint. Once expired,
+the domain can be attached to another endpoint.`,
+	)
+	fs.StringVar(
+		&c.CertCacheDir,
+		"proxy.custom-domains.cert-cache-dir",
+		c.CertCacheDir,
+		`
+Directory to cache obtained certificates.
+
+If not given, certificates are obtained again when the server restarts,
+which may exceed the certificate authorities rate limits.`,
+	)
+	fs.StringVar(
+		&c.ACMEDirectoryURL,
+		"proxy.custom-domains.acme-directory-url",
+		c.ACMEDirectoryURL,
+		`
+ACME directory URL of the certificate authority.
+
+Defaults to Let's Encrypt.`,
+	)
+	fs.StringVar(
+		&c.ACMEEmail,
+		"proxy.custom-domains.acme-email",
+		c.ACMEEmail,
+		`
+Contact email of the ACME account, used by the certificate authority to
+notify about problems with issued certificates.`,
+	)
+}
+
+type RedirectConfig struct {
+	// BindAddr is the address to listen for plain HTTP requests, which are
+	// redirected to HTTPS.
+	//
+	// If not given, the redirect listener is disabled.
 	BindAddr string `json:"bind_addr" yaml:"bind_addr"`
 
-	// AdvertiseAddr is the address to advertise to other nodes.
-	AdvertiseAddr string `json:"advertise_addr" yaml:"advertise_addr"`
+	// HTTPSPort is the port of the HTTPS URL to redirect to.
+	HTTPSPort int `json:"https_port" yaml:"https_port"`
 
-	Auth auth.Config `json:"auth" yaml:"auth"`
+	// ExcludePaths are path prefixes that aren't redirected, and are instead
+	// proxied to the endpoint over HTTP, such as ACME HTTP-01 challenges.
+	ExcludePaths []string `json:"exclude_paths" yaml:"exclude_paths"`
+}
 
-	TLS TLSConfig `json:"tls" yaml:"tls"`
+// Enabled returns whether the redirect listener is enabled.
+func (c *RedirectConfig) Enabled() bool {
+	return c.BindAddr != ""
 }
 
-func (c *UpstreamConfig) Validate() error {
-	if c.BindAddr == "" {
-		return fmt.Errorf("missing bind addr")
+func (c *RedirectConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.HTTPSPort <= 0 || c.HTTPSPort > 65535 {
+		return fmt.Errorf("invalid https port: %d", c.HTTPSPort)
+	}
+	for _, path := range c.ExcludePaths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("exclude path must start with '/': %s", path)
+		}
+	}
+	return nil
+}
+
+func (c *RedirectConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&c.BindAddr,
+		"proxy.redirect.bind-addr",
+		c.BindAddr,
+		`
+The host/port to listen for plain HTTP requests, such as ':80', which are
+redirected to the HTTPS proxy listener, preserving the host, path and query.
+
+If not given, the redirect listener is disabled.
+
+Requires proxy TLS.`,
+	)
+	fs.IntVar(
+		&c.HTTPSPort,
+		"proxy.redirect.https-port",
+		c.HTTPSPort,
+		`
+Port of the HTTPS URL to redirect to. Port 443 is omitted from the URL.`,
+	)
+	fs.StringSliceVar(
+		&c.ExcludePaths,
+		"proxy.redirect.exclude-paths",
+		c.ExcludePaths,
+		`
+Path prefixes that aren't redirected, and are instead proxied to the
+endpoint over HTTP.
+
+Defaults to the ACME HTTP-01 challenge path, so upstreams can obtain
+certificates using HTTP-01. When custom domains are enabled, Piko also
+answers its own HTTP-01 challenges.`,
+	)
+}
+
+type HSTSConfig struct {
+	// MaxAge is the 'max-age' of the 'Strict-Transport-Security' header
+	// added to HTTPS responses.
+	//
+	// If zero, HSTS is disabled.
+	MaxAge time.Duration `json:"max_age" yaml:"max_age"`
+
+	// IncludeSubdomains adds the 'includeSubDomains' directive.
+	IncludeSubdomains bool `json:"include_subdomains" yaml:"include_subdomains"`
+
+	// Preload adds the 'preload' directive, to request the domain is
+	// included in browser HSTS preload lists.
+	Preload bool `json:"preload" yaml:"preload"`
+
+	// Endpoints restricts HSTS to the given endpoint IDs.
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
+
+	// Domains restricts HSTS to requests where the host matches one of the
+	// given domains. Domains starting with '*.' match any subdomain.
+	Domains []string `json:"domains" yaml:"domains"`
+}
+
+// Enabled returns whether HSTS is enabled.
+func (c *HSTSConfig) Enabled() bool {
+	return c.MaxAge != 0
+}
+
+func (c *HSTSConfig) Validate() error {
+	if c.MaxAge < 0 {
+		return fmt.Errorf("max age cannot be negative")
+	}
+	if !c.Enabled() {
+		return nil
+	}
+	if c.Preload {
+		// Requirements of https://hstspreload.org.
+		if !c.IncludeSubdomains {
+			return fmt.Errorf("preload requires include subdomains")
+		}
+		if c.MaxAge < time.Hour*24*365 {
+			return fmt.Errorf("preload requires a max age of at least 1 year")
+		}
+	}
+	return nil
+}
+
+func (c *HSTSConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.DurationVar(
+		&c.MaxAge,
+		"proxy.hsts.max-age",
+		c.MaxAge,
+		`
+Max age of the 'Strict-Transport-Security' header added to HTTPS responses,
+which tells browsers to only connect to the host using HTTPS.
+
+Browsers honour only the first header, so Piko's header takes precedence
+over a header sent by the upstream.
+
+If zero, HSTS is disabled.
+
+Requires proxy TLS.`,
+	)
+	fs.BoolVar(
+		&c.IncludeSubdomains,
+		"proxy.hsts.include-subdomains",
+		c.IncludeSubdomains,
+		`
+Whether to add the 'includeSubDomains' directive, so HSTS also applies to all
+subdomains of the host.`,
+	)
+	fs.BoolVar(
+		&c.Preload,
+		"proxy.hsts.preload",
+		c.Preload,
+		`
+Whether to add the 'preload' directive, to request the domain is included in
+browser HSTS preload lists.
+
+Requires '--proxy.hsts.include-subdomains' and a max age of at least 1 year.`,
+	)
+	fs.StringSliceVar(
+		&c.Endpoints,
+		"proxy.hsts.endpoints",
+		c.Endpoints,
+		`
+Restricts HSTS to the given endpoint IDs.
+
+If neither '--proxy.hsts.endpoints' or '--proxy.hsts.domains' are given, HSTS
+applies to all requests.`,
+	)
+	fs.StringSliceVar(
+		&c.Domains,
+		"proxy.hsts.domains",
+		c.Domains,
+		`
+Restricts HSTS to requests where the host matches one of the given domains.
+Domains starting with '*.' match any subdomain, such as '*.example.com'.`,
+	)
+}
+
+type TransfersConfig struct {
+	// ProgressInterval is the interval to report the progress of in-flight
+	// response transfers, including the bytes written, elapsed time and
+	// throughput.
+	//
+	// Only transfers that have been in progress for at least the interval
+	// are reported, so short responses aren't reported.
+	//
+	// If zero, transfers aren't tracked.
+	ProgressInterval time.Duration `json:"progress_interval" yaml:"progress_interval"`
+
+	// SlowThroughput is the minimum expected throughput of a transfer in
+	// bytes per second. Transfers with a lower throughput over a progress
+	// interval are flagged as slow.
+	//
+	// If zero, slow transfers aren't detected.
+	SlowThroughput int64 `json:"slow_throughput" yaml:"slow_throughput"`
+}
+
+// Enabled returns whether tracking transfers is enabled.
+func (c *TransfersConfig) Enabled() bool {
+	return c.ProgressInterval != 0
+}
+
+func (c *TransfersConfig) Validate() error {
+	if c.ProgressInterval < 0 {
+		return fmt.Errorf("progress interval cannot be negative")
+	}
+	if c.SlowThroughput < 0 {
+		return fmt.Errorf("slow throughput cannot be negative")
+	}
+	if c.SlowThroughput != 0 && !c.Enabled() {
+		return fmt.Errorf("slow throughput requires progress interval")
+	}
+	return nil
+}
+
+func (c *TransfersConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.DurationVar(
+		&c.ProgressInterval,
+		"proxy.transfers.progress-interval",
+		c.ProgressInterval,
+		`
+Interval to report the progress of in-flight response transfers, including
+the bytes written, elapsed time and throughput.
+
+Progress is logged at debug level, published as 'transfer_progress' events
+when exporting events, and the throughput is recorded in the
+'piko_proxy_transfer_throughput_bytes_per_second' metric.
+
+Only transfers that have been in progress for at least the interval are
+reported, so short responses aren't reported.
+
+If zero, transfers aren't tracked.`,
+	)
+	fs.Int64Var(
+		&c.SlowThroughput,
+		"proxy.transfers.slow-throughput",
+		c.SlowThroughput,
+		`
+Minimum expected throughput of a transfer in bytes per second.
+
+Transfers with a lower throughput over a progress interval are logged as
+slow and counted in the 'piko_proxy_slow_transfers_total' metric, which
+helps spot path MTU or throttling problems. Server-sent event streams are
+excluded since they're expected to write slowly.
+
+If zero, slow transfers aren't detected.`,
+	)
+}
+
+type CanarySplitConfig struct {
+	// EndpointID is the endpoint requested by clients. Upstreams listening
+	// on the endpoint are the stable group.
+	EndpointID string `json:"endpoint_id" yaml:"endpoint_id"`
+
+	// CanaryEndpointID is the endpoint the canary upstreams listen on.
+	CanaryEndpointID string `json:"canary_endpoint_id" yaml:"canary_endpoint_id"`
+
+	// Weight is the percentage of requests to the endpoint routed to the
+	// canary group, from 0 to 100.
+	Weight int `json:"weight" yaml:"weight"`
+}
+
+func (c *CanarySplitConfig) Validate() error {
+	if c.EndpointID == "" {
+		return fmt.Errorf("missing endpoint id")
+	}
+	if err := protocol.ValidateEndpointID(c.EndpointID); err != nil {
+		return fmt.Errorf("invalid endpoint id: %w", err)
+	}
+	if c.CanaryEndpointID == "" {
+		return fmt.Errorf("missing canary endpoint id")
+	}
+	if err := protocol.ValidateEndpointID(c.CanaryEndpointID); err != nil {
+		return fmt.Errorf("invalid canary endpoint id: %w", err)
+	}
+	if protocol.IsWildcard(c.EndpointID) || protocol.IsWildcard(c.CanaryEndpointID) {
+		return fmt.Errorf("wildcard endpoints not supported")
+	}
+	if c.CanaryEndpointID == c.EndpointID {
+		return fmt.Errorf("canary endpoint id must differ from endpoint id")
+	}
+	if c.Weight < 0 || c.Weight > 100 {
+		return fmt.Errorf("weight must be between 0 and 100")
+	}
+	return nil
+}
+
+type CanaryConfig struct {
+	// Splits contains the endpoints to split traffic between a stable and a
+	// canary group of upstreams. This can only be configured using the
+	// configuration file.
+	//
+	// If empty, traffic splitting is disabled.
+	Splits []CanarySplitConfig `json:"splits" yaml:"splits"`
+
+	// Window is the duration of the sliding window the success rate and
+	// latency of each group are compared over.
+	Window time.Duration `json:"window" yaml:"window"`
+
+	// MinRequests is the minimum number of requests to each group within
+	// the window before the groups are compared.
+	MinRequests int `json:"min_requests" yaml:"min_requests"`
+
+	// MaxErrorRateDelta is the maximum amount the canary error rate may
+	// exceed the stable error rate, such as 0.05 for 5 percentage points.
+	// Responses with a 5xx status are errors.
+	MaxErrorRateDelta float64 `json:"max_error_rate_delta" yaml:"max_error_rate_delta"`
+
+	// MaxLatencyDelta is the maximum amount the canary mean latency may
+	// exceed the stable mean latency.
+	//
+	// If zero, latency isn't compared.
+	MaxLatencyDelta time.Duration `json:"max_latency_delta" yaml:"max_latency_delta"`
+
+	// Rollback indicates whether to shift all traffic back to the stable
+	// group when the canary degrades. Otherwise degradation is only logged
+	// and reported.
+	Rollback bool `json:"rollback" yaml:"rollback"`
+}
+
+// Enabled returns whether traffic splitting is enabled.
+func (c *CanaryConfig) Enabled() bool {
+	return len(c.Splits) > 0
+}
+
+func (c *CanaryConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	endpoints := make(map[string]struct{})
+	for i, split := range c.Splits {
+		if err := split.Validate(); err != nil {
+			return fmt.Errorf("split %d: %w", i, err)
+		}
+		for _, endpointID := range []string{split.EndpointID, split.CanaryEndpointID} {
+			if _, ok := endpoints[endpointID]; ok {
+				return fmt.Errorf("split %d: duplicate endpoint: %s", i, endpointID)
+			}
+			endpoints[endpointID] = struct{}{}
+		}
+	}
+	if c.Window <= 0 {
+		return fmt.Errorf("missing window")
+	}
+	if c.MinRequests <= 0 {
+		return fmt.Errorf("missing min requests")
+	}
+	if c.MaxErrorRateDelta <= 0 || c.MaxErrorRateDelta > 1 {
+		return fmt.Errorf("max error rate delta must be greater than 0 and at most 1")
+	}
+	if c.MaxLatencyDelta < 0 {
+		return fmt.Errorf("max latency delta cannot be negative")
+	}
+	return nil
+}
+
+func (c *CanaryConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.DurationVar(
+		&c.Window,
+		"proxy.canary.window",
+		c.Window,
+		`
+Duration of the sliding window the success rate and latency of the stable and
+canary groups are compared over.
+
+Traffic splits can only be configured with 'proxy.canary.splits' in the
+configuration file, which route a percentage of requests to an endpoint to the
+upstreams of a canary endpoint.`,
+	)
+	fs.IntVar(
+		&c.MinRequests,
+		"proxy.canary.min-requests",
+		c.MinRequests,
+		`
+Minimum number of requests to each group within the window before the groups
+are compared.`,
+	)
+	fs.Float64Var(
+		&c.MaxErrorRateDelta,
+		"proxy.canary.max-error-rate-delta",
+		c.MaxErrorRateDelta,
+		`
+Maximum amount the canary error rate may exceed the stable error rate, such as
+0.05 for 5 percentage points, before the canary is considered degraded.
+
+Responses with a 5xx status are errors.`,
+	)
+	fs.DurationVar(
+		&c.MaxLatencyDelta,
+		"proxy.canary.max-latency-delta",
+		c.MaxLatencyDelta,
+		`
+Maximum amount the canary mean latency may exceed the stable mean latency
+before the canary is considered degraded.
+
+If zero, latency isn't compared.`,
+	)
+	fs.BoolVar(
+		&c.Rollback,
+		"proxy.canary.rollback",
+		c.Rollback,
+		`
+Whether to shift all traffic back to the stable group when the canary
+degrades. Otherwise degradation is only logged and reported in the admin API.
+
+Weights can be restored using the admin API once the canary is fixed.`,
+	)
+}
+
+type RouteRuleConfig struct {
+	// Route is the route label of requests matching the rule. Defaults to
+	// the template.
+	Route string `json:"route" yaml:"route"`
+
+	// Template matches request paths by segment, where a segment in braces,
+	// such as '/users/{id}', matches any segment, and a final '*' segment
+	// matches any remaining segments.
+	Template string `json:"template" yaml:"template"`
+
+	// Regex matches request paths using a regular expression. Requires a
+	// route.
+	Regex string `json:"regex" yaml:"regex"`
+}
+
+func (c *RouteRuleConfig) Validate() error {
+	if (c.Template == "") == (c.Regex == "") {
+		return fmt.Errorf("must have either a template or regex")
+	}
+	if c.Template != "" && !strings.HasPrefix(c.Template, "/") {
+		return fmt.Errorf("template must start with '/'")
+	}
+	if c.Regex != "" {
+		if c.Route == "" {
+			return fmt.Errorf("missing route")
+		}
+		if _, err := regexp.Compile(c.Regex); err != nil {
+			return fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+	return nil
+}
+
+type RouteLabelsConfig struct {
+	// Rules classifies requests into routes by path, to label the
+	// 'piko_proxy_route_*' metrics and the access log with a bounded
+	// 'route' label rather than the raw path. Requests are classified using
+	// the first matching rule. This can only be configured using the
+	// configuration file.
+	//
+	// If empty, requests aren't classified.
+	Rules []RouteRuleConfig `json:"rules" yaml:"rules"`
+}
+
+// Enabled returns whether request classification is enabled.
+func (c *RouteLabelsConfig) Enabled() bool {
+	return len(c.Rules) > 0
+}
+
+func (c *RouteLabelsConfig) Validate() error {
+	for i, rule := range c.Rules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+type ChallengeConfig struct {
+	// URL is the challenge provider URL to verify requests.
+	//
+	// If empty, challenges are disabled.
+	URL string `json:"url" yaml:"url"`
+
+	// Timeout is the timeout verifying a request with the challenge
+	// provider.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+}
+
+func (c *ChallengeConfig) Enabled() bool {
+	return c.URL != ""
+}
+
+func (c *ChallengeConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid url: unsupported scheme: %s", u.Scheme)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("missing timeout")
+	}
+	return nil
+}
+
+func (c *ChallengeConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&c.URL,
+		"proxy.filter.challenge.url",
+		c.URL,
+		`
+URL of a challenge provider to verify requests before they are proxied, such
+as a bot detection service that presents a browser challenge.
+
+For each request that isn't blocked, Piko sends a 'GET' request to the
+provider with the original requests headers, plus 'X-Forwarded-For',
+'X-Forwarded-Method', 'X-Forwarded-Host' and 'X-Forwarded-Uri'. If the
+provider responds with a 2xx status the request is proxied as normal,
+otherwise the providers response (such as a challenge page or redirect) is
+returned to the client.
+
+If empty, challenges are disabled.`,
+	)
+
+	fs.DurationVar(
+		&c.Timeout,
+		"proxy.filter.challenge.timeout",
+		c.Timeout,
+		`
+Timeout verifying a request with the challenge provider. Requests that can't
+be verified are rejected with '503 Service Unavailable'.`,
+	)
+}
+
+type QueueConfig struct {
+	// Endpoints contains the IDs of the endpoints to queue requests for
+	// while the endpoint has no connected upstreams.
+	//
+	// If empty, queueing is disabled.
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
+
+	// Path is the directory to persist queued requests.
+	//
+	// Defaults to the 'queue' subdirectory of the storage path.
+	Path string `json:"path" yaml:"path"`
+
+	// MaxRequestSize is the maximum size of a request body in bytes that
+	// will be queued. Larger requests are rejected as normal.
+	MaxRequestSize int64 `json:"max_request_size" yaml:"max_request_size"`
+
+	// MaxRequests is the maximum number of queued requests for each
+	// endpoint.
+	MaxRequests int `json:"max_requests" yaml:"max_requests"`
+
+	// ReplayInterval is the interval to attempt to replay queued requests.
+	ReplayInterval time.Duration `json:"replay_interval" yaml:"replay_interval"`
+
+	// DeliveredRetention is the duration to keep the records of delivered
+	// requests, used to check the delivery status and deduplicate requests.
+	DeliveredRetention time.Duration `json:"delivered_retention" yaml:"delivered_retention"`
+}
+
+// Enabled returns whether request queueing is enabled.
+func (c *QueueConfig) Enabled() bool {
+	return len(c.Endpoints) > 0
+}
+
+func (c *QueueConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.MaxRequestSize <= 0 {
+		return fmt.Errorf("missing max request size")
+	}
+	if c.MaxRequests <= 0 {
+		return fmt.Errorf("missing max requests")
+	}
+	if c.ReplayInterval <= 0 {
+		return fmt.Errorf("missing replay interval")
+	}
+	if c.DeliveredRetention <= 0 {
+		return fmt.Errorf("missing delivered retention")
+	}
+	return nil
+}
+
+func (c *QueueConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(
+		&c.Endpoints,
+		"proxy.queue.endpoints",
+		c.Endpoints,
+		`
+Endpoint IDs to queue 'POST' requests for while the endpoint has no
+connected upstreams, such as webhooks to edge devices with intermittent
+connectivity.
+
+Rather than rejecting the request with '502 Bad Gateway', Piko persists the
+request and responds with '202 Accepted'. When an upstream reconnects,
+queued requests are replayed in the order they were received.
+
+The '202 Accepted' response includes a delivery ID (in the 'delivery_id'
+field and 'x-piko-delivery-id' header). Clients can check whether the request
+was delivered to the upstream with 'GET /_piko/v1/deliveries/<delivery-id>'
+on the proxy port.
+
+If the request includes an 'Idempotency-Key' header, it is discarded if a
+request with the same key is already queued or was delivered within
+'--proxy.queue.delivered-retention', and the response contains the delivery
+ID of the original request.
+
+Note requests are queued on the node that received them, and the upstream
+response to replayed requests is discarded.
+
+Replayed requests that the upstream rejects (responding with any error status
+other than 502, 503 or 504) are moved to a dead-letter queue. Queued and
+dead-lettered requests can be inspected, retried and purged using the admin
+API at '/queue/v1'.
+
+Such as '--proxy.queue.endpoints my-endpoint,other-endpoint'.`,
+	)
+
+	fs.StringVar(
+		&c.Path,
+		"proxy.queue.path",
+		c.Path,
+		`
+Directory to persist queued requests, so queued requests survive restarts.
+
+Defaults to the 'queue' subdirectory of '--storage.path'. One of the two is
+required if '--proxy.queue.endpoints' is set.`,
+	)
+
+	fs.Int64Var(
+		&c.MaxRequestSize,
+		"proxy.queue.max-request-size",
+		c.MaxRequestSize,
+		`
+Maximum size of a request body in bytes that will be queued. Larger requests
+are rejected as if queueing were disabled.`,
+	)
+
+	fs.IntVar(
+		&c.MaxRequests,
+		"proxy.queue.max-requests",
+		c.MaxRequests,
+		`
+Maximum number of queued requests for each endpoint. Once the queue is full,
+requests are rejected with '503 Service Unavailable'.`,
+	)
+
+	fs.DurationVar(
+		&c.ReplayInterval,
+		"proxy.queue.replay-interval",
+		c.ReplayInterval,
+		`
+Interval to attempt to replay queued requests.`,
+	)
+
+	fs.DurationVar(
+		&c.DeliveredRetention,
+		"proxy.queue.delivered-retention",
+		c.DeliveredRetention,
+		`
+Duration to keep the records of delivered requests, which are used to check
+the delivery status of the request and discard duplicate requests.
+
+Delivery records are persisted with the queued requests, so survive
+restarts.`,
+	)
+}
+
+type WaitingRoomConfig struct {
+	// Endpoints contains the IDs of the endpoints to serve a waiting room
+	// for while the endpoint has no connected upstreams. Endpoint IDs may
+	// be wildcards, such as 'team-a/*'.
+	//
+	// If empty, the waiting room is disabled.
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
+
+	// RetryAfter is the interval the waiting room retries the request.
+	RetryAfter time.Duration `json:"retry_after" yaml:"retry_after"`
+
+	// Page is the path of a HTML template to serve as the waiting room
+	// page.
+	//
+	// Defaults to a built-in page.
+	Page string `json:"page" yaml:"page"`
+}
+
+// Enabled returns whether the waiting room is enabled.
+func (c *WaitingRoomConfig) Enabled() bool {
+	return len(c.Endpoints) > 0
+}
+
+// Permitted returns whether the waiting room is enabled for the endpoint.
+func (c *WaitingRoomConfig) Permitted(endpointID string) bool {
+	for _, pattern := range c.Endpoints {
+		if protocol.MatchEndpoint(pattern, endpointID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *WaitingRoomConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	for _, endpointID := range c.Endpoints {
+		if err := protocol.ValidateEndpointID(endpointID); err != nil {
+			return fmt.Errorf("invalid endpoint: %w", err)
+		}
+	}
+	if c.RetryAfter < time.Second {
+		return fmt.Errorf("retry after must be at least 1s")
+	}
+	return nil
+}
+
+// LoadPage loads the waiting room page template, or returns nil if the
+// waiting room uses the built-in page.
+func (c *WaitingRoomConfig) LoadPage() (*template.Template, error) {
+	if c.Page == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(c.Page)
+	if err != nil {
+		return nil, fmt.Errorf("read page: %w", err)
+	}
+	page, err := template.New("waiting-room").Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("parse page: %w", err)
+	}
+	return page, nil
+}
+
+func (c *WaitingRoomConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(
+		&c.Endpoints,
+		"proxy.waiting-room.endpoints",
+		c.Endpoints,
+		`
+Endpoint IDs to serve a waiting room for while the endpoint has no connected
+upstreams, such as on-demand endpoints that are starting up or agents that
+are reconnecting.
+
+Rather than rejecting the request with '502 Bad Gateway', Piko responds with
+'503 Service Unavailable' and a 'Retry-After' header. Browsers (requests that
+accept 'text/html') are served a waiting page that retries automatically,
+and other clients are served a JSON body with a 'retry_after' field, so API
+clients can retry.
+
+The waiting room is served after authenticating the request, so only clients
+permitted to access the endpoint see the waiting room.
+
+Endpoint IDs may be wildcards, such as '--proxy.waiting-room.endpoints
+team-a/*'.`,
+	)
+
+	fs.DurationVar(
+		&c.RetryAfter,
+		"proxy.waiting-room.retry-after",
+		c.RetryAfter,
+		`
+Interval the waiting room retries the request, which is also returned in the
+'Retry-After' header. Must be at least 1s.`,
+	)
+
+	fs.StringVar(
+		&c.Page,
+		"proxy.waiting-room.page",
+		c.Page,
+		`
+Path of a HTML template to serve as the waiting room page, such as to match
+your branding.
+
+The template is a Go 'html/template', with fields '.EndpointID',
+'.RetryAfter' (in seconds) and '.RequestID'. The page should retry the
+request itself, such as with '<meta http-equiv="refresh"
+content="{{.RetryAfter}}">'.
+
+Defaults to a built-in page.`,
+	)
+}
+
+// LoadBalancingStrategy is the strategy to load balance requests among the
+// upstreams connected to a node for an endpoint.
+type LoadBalancingStrategy string
+
+const (
+	// LoadBalancingRoundRobin selects each upstream in turn.
+	LoadBalancingRoundRobin LoadBalancingStrategy = "round-robin"
+	// LoadBalancingLeastConnections selects the upstream with the fewest
+	// open streams.
+	LoadBalancingLeastConnections LoadBalancingStrategy = "least-connections"
+	// LoadBalancingRandom selects a random upstream.
+	LoadBalancingRandom LoadBalancingStrategy = "random"
+)
+
+func (s LoadBalancingStrategy) Validate() error {
+	switch s {
+	case LoadBalancingRoundRobin, LoadBalancingLeastConnections, LoadBalancingRandom:
+		return nil
+	default:
+		return fmt.Errorf("unsupported strategy: %s", s)
+	}
+}
+
+type UpstreamConfig struct {
+	// BindAddr is the address to bind to listen for incoming HTTP connections.
+	BindAddr string `json:"bind_addr" yaml:"bind_addr"`
+
+	// AdvertiseAddr is the address to advertise to other nodes.
+	AdvertiseAddr string `json:"advertise_addr" yaml:"advertise_addr"`
+
+	// AllowCIDRs contains the source networks permitted to open upstream
+	// connections, as CIDRs or IP addresses.
+	//
+	// If empty, upstream connections are permitted from any address.
+	AllowCIDRs []string `json:"allow_cidrs" yaml:"allow_cidrs"`
+
+	RateLimit UpstreamRateLimitConfig `json:"rate_limit" yaml:"rate_limit"`
+
+	Auth auth.Config `json:"auth" yaml:"auth"`
+
+	AuthLockout ratelimit.LockoutConfig `json:"auth_lockout" yaml:"auth_lockout"`
+
+	// SessionGracePeriod is the duration to keep a disconnected upstream
+	// registered, so an upstream that reconnects with the same session ID
+	// resumes the registration rather than re-registering.
+	//
+	// Zero disables session resumption.
+	SessionGracePeriod time.Duration `json:"session_grace_period" yaml:"session_grace_period"`
+
+	// WriteCoalesceDelay is the duration to wait for more frames before
+	// writing small frames to an upstream connection, so frames are
+	// coalesced into a single WebSocket message.
+	//
+	// Zero only coalesces frames that are already queued.
+	WriteCoalesceDelay time.Duration `json:"write_coalesce_delay" yaml:"write_coalesce_delay"`
+
+	// MaxStreams is the maximum number of concurrent streams on each
+	// upstream connection. Agents may request a lower limit.
+	//
+	// Zero means unlimited.
+	MaxStreams int `json:"max_streams" yaml:"max_streams"`
+
+	// StreamQueueTimeout is the duration to wait for a stream to close when
+	// all of an endpoint's upstream connections have reached their stream
+	// limit.
+	//
+	// Zero rejects streams immediately.
+	StreamQueueTimeout time.Duration `json:"stream_queue_timeout" yaml:"stream_queue_timeout"`
+
+	// StreamWindow is the maximum receive window of each stream in bytes.
+	//
+	// Zero sizes the window from the measured round trip time to the agent.
+	StreamWindow uint32 `json:"stream_window" yaml:"stream_window"`
+
+	// MaxConns is the maximum number of upstream connections to the node.
+	//
+	// Zero means unlimited.
+	MaxConns int `json:"max_conns" yaml:"max_conns"`
+
+	// MaxEndpointConns is the maximum number of upstream connections to the
+	// node for each endpoint.
+	//
+	// Zero means unlimited.
+	MaxEndpointConns int `json:"max_endpoint_conns" yaml:"max_endpoint_conns"`
+
+	// MaxNamespaceConns is the maximum number of upstream connections to the
+	// node for the endpoints in each namespace, such as 'team-a' for
+	// endpoint 'team-a/service-b'.
+	//
+	// Zero means unlimited.
+	MaxNamespaceConns int `json:"max_namespace_conns" yaml:"max_namespace_conns"`
+
+	// LoadBalancing is the strategy to load balance requests among the
+	// upstreams connected to the node for an endpoint.
+	LoadBalancing LoadBalancingStrategy `json:"load_balancing" yaml:"load_balancing"`
+
+	TLS TLSConfig `json:"tls" yaml:"tls"`
+}
+
+// AllowPrefixes returns the parsed source networks permitted to open
+// upstream connections, where IP addresses are parsed as single address
+// prefixes.
+func (c *UpstreamConfig) AllowPrefixes() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range c.AllowCIDRs {
+		if addr, err := netip.ParseAddr(cidr); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr: %s", cidr)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (c *UpstreamConfig) Validate() error {
+	if c.BindAddr == "" {
+		return fmt.Errorf("missing bind addr")
+	}
+	if _, err := c.AllowPrefixes(); err != nil {
+		return fmt.Errorf("allow cidrs: %w", err)
+	}
+	if c.SessionGracePeriod < 0 {
+		return fmt.Errorf("session grace period cannot be negative")
+	}
+	if c.WriteCoalesceDelay < 0 {
+		return fmt.Errorf("write coalesce delay cannot be negative")
+	}
+	if c.MaxStreams < 0 {
+		return fmt.Errorf("max streams cannot be negative")
+	}
+	if c.StreamQueueTimeout < 0 {
+		return fmt.Errorf("stream queue timeout cannot be negative")
+	}
+	if c.StreamWindow != 0 && c.StreamWindow < protocol.InitialStreamWindow {
+		return fmt.Errorf("stream window must be at least %d", protocol.InitialStreamWindow)
+	}
+	if c.MaxConns < 0 {
+		return fmt.Errorf("max conns cannot be negative")
+	}
+	if c.MaxEndpointConns < 0 {
+		return fmt.Errorf("max endpoint conns cannot be negative")
+	}
+	if c.MaxNamespaceConns < 0 {
+		return fmt.Errorf("max namespace conns cannot be negative")
+	}
+	if err := c.LoadBalancing.Validate(); err != nil {
+		return fmt.Errorf("load balancing: %w", err)
+	}
+	if err := c.RateLimit.Validate(); err != nil {
+		return fmt.Errorf("rate limit: %w", err)
+	}
+	if err := c.AuthLockout.Validate(); err != nil {
+		return fmt.Errorf("auth lockout: %w", err)
+	}
+	if err := c.TLS.Validate(); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	return nil
+}
+
+func (c *UpstreamConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&c.BindAddr,
+		"upstream.bind-addr",
+		c.BindAddr,
+		`
+The host/port to listen for incoming upstream connections.
+
+If the host is unspecified it defaults to all listeners, such as
+'--upstream.bind-addr :8001' will listen on '0.0.0.0:8001'`,
+	)
+
+	fs.StringVar(
+		&c.AdvertiseAddr,
+		"upstream.advertise-addr",
+		c.AdvertiseAddr,
+		`
+Address to advertise to other nodes in the cluster.
+
+Such as if the listen address is ':8001', the advertised address may be
+'10.26.104.45:8001' or 'node1.cluster:8001'.
+
+By default, if the bind address includes an IP to bind to that will be used.
+If the bind address does not include an IP (such as ':8000') the nodes
+private IP will be used, such as a bind address of ':8000' may have an
+advertise address of '10.26.104.14:8000'.`,
+	)
+
+	fs.StringSliceVar(
+		&c.AllowCIDRs,
+		"upstream.allow-cidrs",
+		c.AllowCIDRs,
+		`
+Source networks permitted to open upstream connections, as CIDRs or IP
+addresses, such as when agents only connect from known corporate ranges.
+
+Connections from other addresses are rejected with '403 Forbidden' before
+authenticating. This only applies to upstream connections, not proxy
+traffic.
+
+The source is the address of the TCP connection, so if the server is behind a
+load balancer, the load balancer must preserve the client address.
+
+Such as '--upstream.allow-cidrs 10.0.0.0/8,192.168.1.10'.
+
+If not given, upstream connections are permitted from any address.`,
+	)
+
+	c.RateLimit.RegisterFlags(fs)
+
+	c.Auth.RegisterFlags(fs, "upstream")
+
+	c.AuthLockout.RegisterFlags(fs, "upstream")
+
+	fs.DurationVar(
+		&c.SessionGracePeriod,
+		"upstream.session-grace-period",
+		c.SessionGracePeriod,
+		`
+Duration to keep a disconnected upstream registered, so if the upstream
+reconnects with the same session ID within the grace period (such as after a
+brief network blip), it resumes its registration rather than
+re-registering.
+
+Requests to the endpoint while the upstream is disconnected wait for the
+upstream to reconnect, up to the grace period, rather than failing.
+Streams open when the connection dropped can't be resumed.
+
+Zero disables session resumption.`,
+	)
+
+	fs.DurationVar(
+		&c.WriteCoalesceDelay,
+		"upstream.write-coalesce-delay",
+		c.WriteCoalesceDelay,
+		`
+Duration to wait for more frames before writing small frames to an upstream
+connection, so frames from chatty protocols are coalesced into a single
+WebSocket message, reducing syscall and TLS record overhead at the cost of
+added latency.
+
+The delay only applies when few bytes are queued, so it doesn't slow bulk
+transfers, and control frames (such as pings) are never delayed.
+
+Zero only coalesces frames that are already queued, which adds no latency.`,
+	)
+
+	fs.IntVar(
+		&c.MaxStreams,
+		"upstream.max-streams",
+		c.MaxStreams,
+		`
+Maximum number of concurrent streams (connections or in-flight HTTP requests)
+on each upstream connection. Agents may request a lower limit when they
+connect.
+
+Once an upstream connection reaches its limit, new streams are sent to the
+endpoint's other upstream connections. If all of the endpoint's upstream
+connections have reached their limit, streams wait up to
+'--upstream.stream-queue-timeout' for a stream to close, and otherwise fail
+with a '503 Service Unavailable' response.
+
+The 'piko_upstreams_stream_utilization' metric records the ratio of open
+streams to the limit when streams are opened.
+
+Zero means unlimited.`,
+	)
+
+	fs.DurationVar(
+		&c.StreamQueueTimeout,
+		"upstream.stream-queue-timeout",
+		c.StreamQueueTimeout,
+		`
+Duration to wait for a stream to close when all of an endpoint's upstream
+connections have reached their stream limit.
+
+Zero rejects streams immediately.`,
+	)
+
+	fs.IntVar(
+		&c.MaxConns,
+		"upstream.max-conns",
+		c.MaxConns,
+		`
+Maximum number of upstream connections to the node, across all endpoints.
+
+Connections beyond the limit are rejected with a '429 Too Many Requests'
+response and error code 'conn_limit', and counted by the
+'piko_upstreams_conns_rejected_total' metric. Agents retry rejected
+connections with backoff.
+
+Zero means unlimited.`,
+	)
+
+	fs.IntVar(
+		&c.MaxEndpointConns,
+		"upstream.max-endpoint-conns",
+		c.MaxEndpointConns,
+		`
+Maximum number of upstream connections to the node for each endpoint, such
+as to contain a runaway fleet of agents registering the same endpoint.
+
+Connections beyond the limit are rejected with a '429 Too Many Requests'
+response and error code 'endpoint_conn_limit'.
+
+Zero means unlimited.`,
+	)
+
+	fs.IntVar(
+		&c.MaxNamespaceConns,
+		"upstream.max-namespace-conns",
+		c.MaxNamespaceConns,
+		`
+Maximum number of upstream connections to the node for the endpoints in each
+namespace, such as to give each team a quota.
+
+Endpoint IDs are namespaced with '/', such as endpoint 'team-a/service-b' in
+namespace 'team-a', and the limit applies to each namespace separately,
+including wildcard listeners such as 'team-a/*'. Endpoints without a
+namespace aren't limited.
+
+Connections beyond the limit are rejected with a '429 Too Many Requests'
+response and error code 'namespace_conn_limit'.
+
+Zero means unlimited.`,
+	)
+
+	fs.StringVar(
+		(*string)(&c.LoadBalancing),
+		"upstream.load-balancing",
+		string(c.LoadBalancing),
+		`
+Strategy to load balance requests among the upstreams connected to the node
+for an endpoint, when multiple agents register the same endpoint. Supports
+'round-robin', 'least-connections' and 'random'.
+
+'least-connections' selects the upstream connection with the fewest open
+streams, which suits long running requests with uneven durations.
+
+Upstream connections that have reached '--upstream.max-streams' are skipped
+with any strategy, unless all of the endpoint's upstream connections have
+reached their limit.`,
+	)
+
+	fs.Uint32Var(
+		&c.StreamWindow,
+		"upstream.stream-window",
+		c.StreamWindow,
+		`
+Maximum receive window of each stream on upstream connections in bytes,
+which bounds the throughput of each stream to the window divided by the
+round trip time.
+
+Zero sizes the window from the bandwidth-delay product of the link, using the
+round trip time agents measure when connecting, between 256KB and 16MB, which
+improves throughput on high latency links without manual tuning.
+
+Otherwise the window must be at least 256KB (262144).`,
+	)
+
+	c.TLS.RegisterFlags(fs, "upstream")
+}
+
+// UpstreamRateLimitConfig configures rate limiting upstream connection
+// attempts and WebSocket control frames, to protect the server from clients
+// spamming handshakes or pings.
+type UpstreamRateLimitConfig struct {
+	// ConnectRate is the maximum rate of connection attempts per second from
+	// each client IP.
+	//
+	// Zero disables connection rate limiting.
+	ConnectRate float64 `json:"connect_rate" yaml:"connect_rate"`
+
+	// ConnectBurst is the maximum burst of connection attempts from each
+	// client IP.
+	//
+	// Defaults to ConnectRate rounded up.
+	ConnectBurst int `json:"connect_burst" yaml:"connect_burst"`
+
+	// ControlFrameRate is the maximum rate of WebSocket control frames (pings
+	// and pongs) per second on each connection. Connections that exceed the
+	// limit are closed.
+	//
+	// Zero disables control frame rate limiting.
+	ControlFrameRate float64 `json:"control_frame_rate" yaml:"control_frame_rate"`
+
+	// ControlFrameBurst is the maximum burst of WebSocket control frames on
+	// each connection.
+	//
+	// Defaults to ControlFrameRate rounded up.
+	ControlFrameBurst int `json:"control_frame_burst" yaml:"control_frame_burst"`
+
+	// BanDuration is the duration to ban a client IP that exceeds either rate
+	// limit, during which all connection attempts from the IP are rejected.
+	//
+	// Zero disables bans.
+	BanDuration time.Duration `json:"ban_duration" yaml:"ban_duration"`
+}
+
+// Enabled returns whether upstream rate limiting is enabled.
+func (c *UpstreamRateLimitConfig) Enabled() bool {
+	return c.ConnectRate != 0 || c.ControlFrameRate != 0
+}
+
+func (c *UpstreamRateLimitConfig) Validate() error {
+	if c.ConnectRate < 0 {
+		return fmt.Errorf("connect rate cannot be negative")
+	}
+	if c.ConnectBurst < 0 {
+		return fmt.Errorf("connect burst cannot be negative")
+	}
+	if c.ControlFrameRate < 0 {
+		return fmt.Errorf("control frame rate cannot be negative")
+	}
+	if c.ControlFrameBurst < 0 {
+		return fmt.Errorf("control frame burst cannot be negative")
+	}
+	if c.BanDuration < 0 {
+		return fmt.Errorf("ban duration cannot be negative")
+	}
+	return nil
+}
+
+func (c *UpstreamRateLimitConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.Float64Var(
+		&c.ConnectRate,
+		"upstream.rate-limit.connect-rate",
+		c.ConnectRate,
+		`
+The maximum rate of upstream connection attempts per second from each client
+IP.
+
+Connection attempts that exceed the limit are rejected with
+'429 Too Many Requests', including 'RateLimit-Limit', 'RateLimit-Remaining',
+'RateLimit-Reset' and 'Retry-After' headers computed from the clients rate
+limit bucket and any ban, so clients know when they can reconnect.
+
+Zero disables connection rate limiting.`,
+	)
+
+	fs.IntVar(
+		&c.ConnectBurst,
+		"upstream.rate-limit.connect-burst",
+		c.ConnectBurst,
+		`
+The maximum burst of upstream connection attempts from each client IP.
+
+Defaults to '--upstream.rate-limit.connect-rate' rounded up.`,
+	)
+
+	fs.Float64Var(
+		&c.ControlFrameRate,
+		"upstream.rate-limit.control-frame-rate",
+		c.ControlFrameRate,
+		`
+The maximum rate of WebSocket control frames (pings and pongs) per second on
+each upstream connection.
+
+Connections that exceed the limit are closed.
+
+Zero disables control frame rate limiting.`,
+	)
+
+	fs.IntVar(
+		&c.ControlFrameBurst,
+		"upstream.rate-limit.control-frame-burst",
+		c.ControlFrameBurst,
+		`
+The maximum burst of WebSocket control frames on each upstream connection.
+
+Defaults to '--upstream.rate-limit.control-frame-rate' rounded up.`,
+	)
+
+	fs.DurationVar(
+		&c.BanDuration,
+		"upstream.rate-limit.ban-duration",
+		c.BanDuration,
+		`
+The duration to ban a client IP that exceeds either upstream rate limit.
+
+While banned, all upstream connection attempts from the IP are rejected with
+'429 Too Many Requests'.
+
+Zero disables bans.`,
+	)
+}
+
+type AdminConfig struct {
+	// BindAddr is the address to bind to listen for incoming HTTP connections.
+	BindAddr string `json:"bind_addr" yaml:"bind_addr"`
+
+	// AdvertiseAddr is the address to advertise to other nodes.
+	AdvertiseAddr string `json:"advertise_addr" yaml:"advertise_addr"`
+
+	Auth auth.Config `json:"auth" yaml:"auth"`
+
+	AuthLockout ratelimit.LockoutConfig `json:"auth_lockout" yaml:"auth_lockout"`
+
+	// ClientCertAuth permits clients to authenticate with either a client
+	// certificate (verified with TLS.ClientCAs) or a token, rather than
+	// requiring both.
+	//
+	// Requires TLS.ClientCAs.
+	ClientCertAuth bool `json:"client_cert_auth" yaml:"client_cert_auth"`
+
+	TLS TLSConfig `json:"tls" yaml:"tls"`
+}
+
+func (c *AdminConfig) Validate() error {
+	if c.BindAddr == "" {
+		return fmt.Errorf("missing bind addr")
+	}
+	if c.ClientCertAuth && c.TLS.ClientCAs == "" {
+		return fmt.Errorf("client cert auth requires tls client cas")
+	}
+	if err := c.AuthLockout.Validate(); err != nil {
+		return fmt.Errorf("auth lockout: %w", err)
+	}
+	if err := c.TLS.Validate(); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	return nil
+}
+
+func (c *AdminConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&c.BindAddr,
+		"admin.bind-addr",
+		c.BindAddr,
+		`
+The host/port to listen for incoming admin connections.
+
+If the host is unspecified it defaults to all listeners, such as
+'--admin.bind-addr :8002' will listen on '0.0.0.0:8002'`,
+	)
+
+	fs.StringVar(
+		&c.AdvertiseAddr,
+		"admin.advertise-addr",
+		c.AdvertiseAddr,
+		`
+Admin listen address to advertise to other nodes in the cluster. This is the
+address other nodes will used to forward admin requests.
+
+Such as if the listen address is ':8002', the advertised address may be
+'10.26.104.45:8002' or 'node1.cluster:8002'.
+
+By default, if the bind address includes an IP to bind to that will be used.
+If the bind address does not include an IP (such as ':8002') the nodes
+private IP will be used, such as a bind address of ':8002' may have an
+advertise address of '10.26.104.14:8002'.`,
+	)
+
+	c.Auth.RegisterFlags(fs, "admin")
+
+	c.AuthLockout.RegisterFlags(fs, "admin")
+
+	fs.BoolVar(
+		&c.ClientCertAuth,
+		"admin.client-cert-auth",
+		c.ClientCertAuth,
+		`
+Whether clients can authenticate with either a client certificate or a token.
+
+By default, when both '--admin.tls.client-cas' and token authentication are
+configured, clients must present both a valid client certificate and a valid
+token. With client certificate auth enabled, clients that present a valid
+client certificate don't require a token, and clients without a certificate
+must present a valid token.
+
+Requires '--admin.tls.client-cas'.`,
+	)
+
+	c.TLS.RegisterFlags(fs, "admin")
+}
+
+type ClusterConfig struct {
+	// NodeID is a unique identifier for this node in the cluster.
+	NodeID string `json:"node_id" yaml:"node_id"`
+
+	// NodeIDPrefix is a node ID prefix, where Piko will generate the rest of
+	// the node ID to ensure uniqueness.
+	NodeIDPrefix string `json:"node_id_prefix" yaml:"node_id_prefix"`
+
+	// Join contains a list of addresses of members in the cluster to join.
+	Join []string `json:"join" yaml:"join"`
+
+	// JoinTimeout is the time to keep trying to join the cluster before
+	// failing.
+	JoinTimeout time.Duration `json:"join_timeout" yaml:"join_timeout"`
+
+	AbortIfJoinFails bool `json:"abort_if_join_fails" yaml:"abort_if_join_fails"`
+
+	// ForwardSigningKey is a secret key used to sign requests forwarded
+	// between nodes, so clients can't spoof intra-cluster routing metadata.
+	//
+	// All nodes in the cluster must use the same key. If not given,
+	// forwarded requests aren't signed.
+	ForwardSigningKey string `json:"forward_signing_key" yaml:"forward_signing_key"`
+
+	Gossip gossip.Config `json:"gossip" yaml:"gossip"`
+}
+
+func (c *ClusterConfig) Validate() error {
+	if c.NodeID == "" {
+		return fmt.Errorf("missing node id")
+	}
+	if c.JoinTimeout == 0 {
+		return fmt.Errorf("missing join timeout")
+	}
+
+	if err := c.Gossip.Validate(); err != nil {
+		return fmt.Errorf("gossip: %w", err)
+	}
+
+	return nil
+}
+
+func (c *ClusterConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&c.NodeID,
+		"cluster.node-id",
+		c.NodeID,
+		`
+A unique identifier for the node in the cluster.
+
+By default a random ID will be generated for the node.`,
+	)
+
+	fs.StringVar(
+		&c.NodeIDPrefix,
+		"cluster.node-id-prefix",
+		c.NodeIDPrefix,
+		`
+A prefix for the node ID.
+
+Piko will generate a unique random identifier for the node and append it to
+the given prefix.
+
+Such as you could use the node or pod  name as a prefix, then add a unique
+identifier to ensure the node ID is unique across restarts.`,
+	)
+
+	fs.StringSliceVar(
+		&c.Join,
+		"cluster.join",
+		c.Join,
+		`
+A list of addresses of members in the cluster to join.
+
+This may be either addresses of specific nodes, such as
+'--cluster.join 10.26.104.14,10.26.104.75', or a domain that resolves to
+the addresses of the nodes in the cluster (e.g. a Kubernetes headless
+service), such as '--cluster.join piko.prod-piko-ns'.
+
+Each address must include the host, and may optionally include a port. If no
+port is given, the gossip port of this node is used.
+
+Note each node propagates membership information to the other known nodes,
+so the initial set of configured members only needs to be a subset of nodes.`,
+	)
+
+	fs.DurationVar(
+		&c.JoinTimeout,
+		"cluster.join-timeout",
+		c.JoinTimeout,
+		`
+The timeout to attempt to join an existing cluster when 'cluster.join' is
+set.`,
+	)
+
+	fs.BoolVar(
+		&c.AbortIfJoinFails,
+		"cluster.abort-if-join-fails",
+		c.AbortIfJoinFails,
+		`
+Whether the server node should abort if it is configured with more than one
+node to join (excluding itself) but fails to join any members.`,
+	)
+
+	fs.StringVar(
+		&c.ForwardSigningKey,
+		"cluster.forward-signing-key",
+		c.ForwardSigningKey,
+		`
+Secret key used to sign requests forwarded between nodes.
+
+When a node forwards a request to another node, it signs the routing metadata
+(such as the endpoint ID, original client IP and hop count) along with the
+request method, URI and a random nonce, which the receiving node verifies then
+strips. This prevents clients spoofing intra-cluster metadata or replaying
+signed requests. Upstreams see the original client IP in 'X-Forwarded-For'
+rather than the forwarding node.
+
+All nodes in the cluster must use the same key. If not given, forwarded
+requests aren't signed and nodes trust the 'x-piko-forward' header, so a client
+can set the header to stop its request being forwarded to another node.`,
+	)
+
+	c.Gossip.RegisterFlags(fs, "cluster")
+}
+
+type UsageConfig struct {
+	// Disable indicates whether to disable anonymous usage collection.
+	Disable bool `json:"disable" yaml:"disable"`
+}
+
+func (c *UsageConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(
+		&c.Disable,
+		"usage.disable",
+		c.Disable,
+		`
+Whether to disable anonymous usage tracking.
+
+The Piko server periodically sends an anonymous report to help understand how
+Piko is being used. This report includes the Piko version, host OS, host
+architecture, requests processed and upstreams registered.`,
+	)
+}
+
+type AdmissionConfig struct {
+	// MaxHeapBytes is the heap usage high watermark. Once the heap exceeds
+	// the watermark the server rejects new connections and requests until
+	// heap usage falls below ResumeHeapBytes.
+	//
+	// Zero disables memory admission control.
+	MaxHeapBytes uint64 `json:"max_heap_bytes" yaml:"max_heap_bytes"`
+
+	// ResumeHeapBytes is the heap usage low watermark, below which the server
+	// starts accepting new connections and requests again.
+	//
+	// Defaults to 90% of MaxHeapBytes.
+	ResumeHeapBytes uint64 `json:"resume_heap_bytes" yaml:"resume_heap_bytes"`
+
+	// MaxFileRatio is the file descriptor usage high watermark, as a ratio
+	// of the process file descriptor limit. Once open file descriptors
+	// exceed the watermark the server rejects new upstream connections until
+	// usage falls below ResumeFileRatio.
+	//
+	// Only supported on Linux. Zero disables file descriptor admission
+	// control.
+	MaxFileRatio float64 `json:"max_file_ratio" yaml:"max_file_ratio"`
+
+	// ResumeFileRatio is the file descriptor usage low watermark, below
+	// which the server starts accepting new upstream connections again.
+	//
+	// Defaults to 90% of MaxFileRatio.
+	ResumeFileRatio float64 `json:"resume_file_ratio" yaml:"resume_file_ratio"`
+
+	// CheckInterval is the interval to sample heap usage.
+	CheckInterval time.Duration `json:"check_interval" yaml:"check_interval"`
+
+	// RetryAfter is the duration clients are asked to wait before retrying
+	// a rejected request.
+	RetryAfter time.Duration `json:"retry_after" yaml:"retry_after"`
+}
+
+// Enabled returns whether memory or file descriptor admission control is
+// enabled.
+func (c *AdmissionConfig) Enabled() bool {
+	return c.MaxHeapBytes != 0 || c.MaxFileRatio != 0
+}
+
+func (c *AdmissionConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.ResumeHeapBytes > c.MaxHeapBytes {
+		return fmt.Errorf("resume heap bytes exceeds max heap bytes")
+	}
+	if c.MaxFileRatio < 0 || c.MaxFileRatio > 1 {
+		return fmt.Errorf("max file ratio must be between 0 and 1")
+	}
+	if c.ResumeFileRatio < 0 || c.ResumeFileRatio > c.MaxFileRatio {
+		return fmt.Errorf("resume file ratio must be between 0 and max file ratio")
+	}
+	if c.CheckInterval <= 0 {
+		return fmt.Errorf("check interval must be positive")
+	}
+	if c.RetryAfter < 0 {
+		return fmt.Errorf("retry after cannot be negative")
+	}
+	return nil
+}
+
+func (c *AdmissionConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.Uint64Var(
+		&c.MaxHeapBytes,
+		"admission.max-heap-bytes",
+		c.MaxHeapBytes,
+		`
+The heap usage high watermark in bytes.
+
+When the heap exceeds the watermark, the server rejects new proxy requests and
+upstream connections with '503 Service Unavailable' until heap usage falls
+below 'admission.resume-heap-bytes'. Existing connections are unaffected.
+
+This protects the server from being OOM killed during traffic spikes.
+
+Zero disables memory admission control.`,
+	)
+
+	fs.Uint64Var(
+		&c.ResumeHeapBytes,
+		"admission.resume-heap-bytes",
+		c.ResumeHeapBytes,
+		`
+The heap usage low watermark in bytes, below which the server starts accepting
+new requests and connections again.
+
+Defaults to 90% of 'admission.max-heap-bytes'.`,
+	)
+
+	fs.Float64Var(
+		&c.MaxFileRatio,
+		"admission.max-file-ratio",
+		c.MaxFileRatio,
+		`
+The file descriptor usage high watermark, as a ratio of the process file
+descriptor limit, such as 0.9.
+
+When open file descriptors exceed the watermark, the server rejects new
+upstream connections with '503 Service Unavailable' and an error explaining
+the server is near its file descriptor limit, until usage falls below
+'admission.resume-file-ratio'. Existing connections are unaffected.
+
+This avoids exhausting file descriptors, which would otherwise cause random
+failures across the server, such as failing to accept proxy requests or
+connect to other nodes.
+
+Only supported on Linux. Zero disables file descriptor admission control.`,
+	)
+
+	fs.Float64Var(
+		&c.ResumeFileRatio,
+		"admission.resume-file-ratio",
+		c.ResumeFileRatio,
+		`
+The file descriptor usage low watermark, as a ratio of the process file
+descriptor limit, below which the server starts accepting new upstream
+connections again.
+
+Defaults to 90% of 'admission.max-file-ratio'.`,
+	)
+
+	fs.DurationVar(
+		&c.CheckInterval,
+		"admission.check-interval",
+		c.CheckInterval,
+		`
+The interval to sample heap and file descriptor usage.`,
+	)
+
+	fs.DurationVar(
+		&c.RetryAfter,
+		"admission.retry-after",
+		c.RetryAfter,
+		`
+The duration to ask clients to wait before retrying a rejected request, sent
+in the 'Retry-After' header.
+
+If the next heap usage check is further away, clients are asked to wait until
+then instead, since load shedding can't stop before the next check. Zero
+disables the 'Retry-After' header.`,
+	)
+}
+
+type TenantsConfig struct {
+	// Enabled indicates whether to tag request metrics and logs with the
+	// tenant of the authenticated token.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// MaxTenants is the maximum number of distinct tenants to label in
+	// metrics. Requests from any additional tenants are labelled '_overflow'.
+	MaxTenants int `json:"max_tenants" yaml:"max_tenants"`
+}
+
+func (c *TenantsConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.MaxTenants <= 0 {
+		return fmt.Errorf("max tenants must be greater than zero")
+	}
+	return nil
+}
+
+func (c *TenantsConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(
+		&c.Enabled,
+		"tenants.enabled",
+		c.Enabled,
+		`
+Whether to enable multi-tenant metrics and logs.
+
+When enabled, the tenant of a request is taken from the 'piko.tenant' claim
+of the authenticated token. Proxy access logs and upstream connection logs
+are tagged with the tenant, and the proxy records per-tenant request totals
+and request and response byte totals, which can be used for per-tenant
+dashboards and billing.
+
+Requests without a tenant are labelled '_none'.`,
+	)
+
+	fs.IntVar(
+		&c.MaxTenants,
+		"tenants.max-tenants",
+		c.MaxTenants,
+		`
+The maximum number of distinct tenants to label in metrics.
+
+This bounds the cardinality of the per-tenant metrics. Once the limit is
+reached, requests from any additional tenants are labelled '_overflow'. The
+tenant is still included in logs.`,
+	)
+}
+
+type ProbeConfig struct {
+	// Name identifies the probe in metrics and logs.
+	//
+	// Defaults to the endpoint ID.
+	Name string `json:"name" yaml:"name"`
+
+	// EndpointID is the endpoint to probe.
+	EndpointID string `json:"endpoint_id" yaml:"endpoint_id"`
+
+	// Method is the HTTP method of probe requests.
+	//
+	// Defaults to GET.
+	Method string `json:"method" yaml:"method"`
+
+	// Path is the path of probe requests.
+	//
+	// Defaults to '/'.
+	Path string `json:"path" yaml:"path"`
+
+	// ExpectedStatus is the response status code of a successful probe.
+	//
+	// Defaults to any status below 500.
+	ExpectedStatus int `json:"expected_status" yaml:"expected_status"`
+
+	// Interval overrides the probe interval.
+	Interval time.Duration `json:"interval" yaml:"interval"`
+
+	// Timeout overrides the probe timeout.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+}
+
+func (c *ProbeConfig) Validate() error {
+	if c.EndpointID == "" {
+		return fmt.Errorf("missing endpoint id")
+	}
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("path must start with '/'")
+	}
+	if c.ExpectedStatus != 0 && (c.ExpectedStatus < 100 || c.ExpectedStatus > 599) {
+		return fmt.Errorf("invalid expected status: %d", c.ExpectedStatus)
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("interval cannot be negative")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout cannot be negative")
+	}
+	return nil
+}
+
+type ProbesConfig struct {
+	// Endpoints contains endpoint IDs to probe with 'GET /' requests.
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
+
+	// Probes contains probes with custom requests. This can only be
+	// configured using the configuration file.
+	Probes []ProbeConfig `json:"probes" yaml:"probes"`
+
+	// Interval is the default interval between probe requests.
+	Interval time.Duration `json:"interval" yaml:"interval"`
+
+	// Timeout is the default timeout of probe requests.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+}
+
+// Enabled returns whether any probes are configured.
+func (c *ProbesConfig) Enabled() bool {
+	return len(c.Endpoints) > 0 || len(c.Probes) > 0
+}
+
+func (c *ProbesConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
 	}
-	if err := c.TLS.Validate(); err != nil {
-		return fmt.Errorf("tls: %w", err)
+	if c.Interval <= 0 {
+		return fmt.Errorf("missing interval")
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("missing timeout")
+	}
+	for i, probe := range c.Probes {
+		if err := probe.Validate(); err != nil {
+			return fmt.Errorf("probe %d: %w", i, err)
+		}
 	}
 	return nil
 }
 
-func (c *UpstreamConfig) RegisterFlags(fs *pflag.FlagSet) {
-	fs.StringVar(
-		&c.BindAddr,
-		"upstream.bind-addr",
-		c.BindAddr,
+func (c *ProbesConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(
+		&c.Endpoints,
+		"probes.endpoints",
+		c.Endpoints,
 		`
-The host/port to listen for incoming upstream connections.
+Endpoint IDs to periodically send synthetic 'GET /' requests to.
 
-If the host is unspecified it defaults to all listeners, such as
-'--upstream.bind-addr :8001' will listen on '0.0.0.0:8001'`,
-	)
+Probe requests are forwarded to the endpoints upstreams as with any other
+proxy request (excluding authentication), and record availability and
+latency metrics, so broken tunnels are detected before users notice.
 
-	fs.StringVar(
-		&c.AdvertiseAddr,
-		"upstream.advertise-addr",
-		c.AdvertiseAddr,
-		`
-Address to advertise to other nodes in the cluster.
+A probe succeeds if the upstream responds with a status below 500.
 
-Such as if the listen address is ':8001', the advertised address may be
-'10.26.104.45:8001' or 'node1.cluster:8001'.
+Note every Piko node runs every probe, forwarding the probe to another node
+if the endpoint has no upstreams connected to the local node. So each node
+reports whether the endpoint is reachable from that node, and the cluster
+sends one probe request per node each interval.
 
-By default, if the bind address includes an IP to bind to that will be used.
-If the bind address does not include an IP (such as ':8000') the nodes
-private IP will be used, such as a bind address of ':8000' may have an
-advertise address of '10.26.104.14:8000'.`,
+Probes with custom requests (such as a different path or expected status)
+can be configured with 'probes.probes' in the configuration file.
+
+Such as '--probes.endpoints my-endpoint,other-endpoint'.`,
 	)
 
-	c.Auth.RegisterFlags(fs, "upstream")
+	fs.DurationVar(
+		&c.Interval,
+		"probes.interval",
+		c.Interval,
+		`
+Interval between probe requests.`,
+	)
 
-	c.TLS.RegisterFlags(fs, "upstream")
+	fs.DurationVar(
+		&c.Timeout,
+		"probes.timeout",
+		c.Timeout,
+		`
+Timeout of probe requests.`,
+	)
 }
 
-type AdminConfig struct {
-	// BindAddr is the address to bind to listen for incoming HTTP connections.
-	BindAddr string `json:"bind_addr" yaml:"bind_addr"`
+// EventsConfig configures exporting request summaries and endpoint lifecycle
+// events to an event bus.
+type EventsConfig struct {
+	// Exporter is the event bus to export events to, either 'nats' or
+	// 'kafka'.
+	//
+	// If empty, events aren't exported.
+	Exporter string `json:"exporter" yaml:"exporter"`
 
-	// AdvertiseAddr is the address to advertise to other nodes.
-	AdvertiseAddr string `json:"advertise_addr" yaml:"advertise_addr"`
+	// URL is the URL of the NATS server, or the Kafka REST proxy.
+	URL string `json:"url" yaml:"url"`
 
-	Auth auth.Config `json:"auth" yaml:"auth"`
+	// Topic is the NATS subject or Kafka topic to publish events to.
+	Topic string `json:"topic" yaml:"topic"`
 
-	TLS TLSConfig `json:"tls" yaml:"tls"`
+	// BatchSize is the maximum number of events to publish in a batch.
+	BatchSize int `json:"batch_size" yaml:"batch_size"`
+
+	// FlushInterval is the maximum duration to wait before publishing a
+	// batch that isn't full.
+	FlushInterval time.Duration `json:"flush_interval" yaml:"flush_interval"`
+
+	// QueueSize is the maximum number of events to queue before dropping
+	// events.
+	QueueSize int `json:"queue_size" yaml:"queue_size"`
+
+	// Timeout is the timeout publishing a batch.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
 }
 
-func (c *AdminConfig) Validate() error {
-	if c.BindAddr == "" {
-		return fmt.Errorf("missing bind addr")
+// Enabled returns whether exporting events is enabled.
+func (c *EventsConfig) Enabled() bool {
+	return c.Exporter != ""
+}
+
+func (c *EventsConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
 	}
-	if err := c.TLS.Validate(); err != nil {
-		return fmt.Errorf("tls: %w", err)
+	if c.Exporter != "nats" && c.Exporter != "kafka" {
+		return fmt.Errorf("unsupported exporter: %s", c.Exporter)
+	}
+	if c.URL == "" {
+		return fmt.Errorf("missing url")
+	}
+	if c.Topic == "" {
+		return fmt.Errorf("missing topic")
+	}
+	if c.BatchSize <= 0 {
+		return fmt.Errorf("batch size must be positive")
+	}
+	if c.FlushInterval <= 0 {
+		return fmt.Errorf("flush interval must be positive")
+	}
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("queue size must be positive")
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
 	}
 	return nil
 }
 
-func (c *AdminConfig) RegisterFlags(fs *pflag.FlagSet) {
+func (c *EventsConfig) RegisterFlags(fs *pflag.FlagSet) {
 	fs.StringVar(
-		&c.BindAddr,
-		"admin.bind-addr",
-		c.BindAddr,
+		&c.Exporter,
+		"events.exporter",
+		c.Exporter,
 		`
-The host/port to listen for incoming admin connections.
+Event bus to export events to, either 'nats' or 'kafka'.
 
-If the host is unspecified it defaults to all listeners, such as
-'--admin.bind-addr :8002' will listen on '0.0.0.0:8002'`,
+When enabled, each node publishes a JSON summary of every proxied request
+(including the endpoint ID, method, path, status, duration and response size),
+and an event when an endpoint is registered or unregistered on the node, for
+downstream analytics pipelines.
+
+Events are published in batches. If the event bus is unavailable, failed
+batches are dropped, and once the queue is full new events are dropped, so
+exporting events never blocks requests.
+
+If empty, events aren't exported.`,
 	)
 
 	fs.StringVar(
-		&c.AdvertiseAddr,
-		"admin.advertise-addr",
-		c.AdvertiseAddr,
+		&c.URL,
+		"events.url",
+		c.URL,
 		`
-Admin listen address to advertise to other nodes in the cluster. This is the
-address other nodes will used to forward admin requests.
+URL of the event bus.
 
-Such as if the listen address is ':8002', the advertised address may be
-'10.26.104.45:8002' or 'node1.cluster:8002'.
+For NATS, this is the server URL, such as 'nats://nats:4222' (or
+'tls://nats:4222' to require TLS). The URL may include a token
+('nats://<token>@nats:4222') or username and password.
 
-By default, if the bind address includes an IP to bind to that will be used.
-If the bind address does not include an IP (such as ':8002') the nodes
-private IP will be used, such as a bind address of ':8002' may have an
-advertise address of '10.26.104.14:8002'.`,
+For Kafka, this is the URL of a Kafka REST proxy supporting the v2 API
+(such as the Confluent REST Proxy or Redpanda HTTP Proxy), such as
+'http://kafka-rest:8082'.`,
 	)
 
-	c.Auth.RegisterFlags(fs, "admin")
-
-	c.TLS.RegisterFlags(fs, "admin")
-}
+	fs.StringVar(
+		&c.Topic,
+		"events.topic",
+		c.Topic,
+		`
+NATS subject or Kafka topic to publish events to.`,
+	)
 
-type ClusterConfig struct {
-	// NodeID is a unique identifier for this node in the cluster.
-	NodeID string `json:"node_id" yaml:"node_id"`
+	fs.IntVar(
+		&c.BatchSize,
+		"events.batch-size",
+		c.BatchSize,
+		`
+Maximum number of events to publish in a batch.`,
+	)
 
-	// NodeIDPrefix is a node ID prefix, where Piko will generate the rest of
-	// the node ID to ensure uniqueness.
-	NodeIDPrefix string `json:"node_id_prefix" yaml:"node_id_prefix"`
+	fs.DurationVar(
+		&c.FlushInterval,
+		"events.flush-interval",
+		c.FlushInterval,
+		`
+Maximum duration to wait before publishing a batch that isn't full.`,
+	)
 
-	// Join contains a list of addresses of members in the cluster to join.
-	Join []string `json:"join" yaml:"join"`
+	fs.IntVar(
+		&c.QueueSize,
+		"events.queue-size",
+		c.QueueSize,
+		`
+Maximum number of events to queue waiting to be published. Once the queue is
+full, new events are dropped.`,
+	)
 
-	// JoinTimeout is the time to keep trying to join the cluster before
-	// failing.
-	JoinTimeout time.Duration `json:"join_timeout" yaml:"join_timeout"`
+	fs.DurationVar(
+		&c.Timeout,
+		"events.timeout",
+		c.Timeout,
+		`
+Timeout publishing a batch of events.`,
+	)
+}
 
-	AbortIfJoinFails bool `json:"abort_if_join_fails" yaml:"abort_if_join_fails"`
+type GeoIPConfig struct {
+	// Database is the path to a MaxMind DB file (such as GeoLite2 Country)
+	// to look up the country of client IPs.
+	//
+	// If empty, GeoIP lookups are disabled.
+	Database string `json:"database" yaml:"database"`
 
-	Gossip gossip.Config `json:"gossip" yaml:"gossip"`
+	// ReloadInterval is the interval to check whether the database file has
+	// changed, and reload it if so. If zero the database is never reloaded.
+	ReloadInterval time.Duration `json:"reload_interval" yaml:"reload_interval"`
 }
 
-func (c *ClusterConfig) Validate() error {
-	if c.NodeID == "" {
-		return fmt.Errorf("missing node id")
-	}
-	if c.JoinTimeout == 0 {
-		return fmt.Errorf("missing join timeout")
-	}
+func (c *GeoIPConfig) Enabled() bool {
+	return c.Database != ""
+}
 
-	if err := c.Gossip.Validate(); err != nil {
-		return fmt.Errorf("gossip: %w", err)
+func (c *GeoIPConfig) Validate() error {
+	if c.ReloadInterval < 0 {
+		return fmt.Errorf("reload interval cannot be negative")
 	}
-
 	return nil
 }
 
-func (c *ClusterConfig) RegisterFlags(fs *pflag.FlagSet) {
+func (c *GeoIPConfig) RegisterFlags(fs *pflag.FlagSet) {
 	fs.StringVar(
-		&c.NodeID,
-		"cluster.node-id",
-		c.NodeID,
+		&c.Database,
+		"geoip.database",
+		c.Database,
 		`
-A unique identifier for the node in the cluster.
+Path to a MaxMind DB file, such as GeoLite2 Country or City, to look up the
+country of client IPs.
 
-By default a random ID will be generated for the node.`,
+When configured, proxy access logs are tagged with the ISO country code of
+the client IP, and the proxy records request totals by country. Requests
+whose client IP isn't in the database are labelled '_unknown'.
+
+If empty, GeoIP lookups are disabled.`,
 	)
 
-	fs.StringVar(
-		&c.NodeIDPrefix,
-		"cluster.node-id-prefix",
-		c.NodeIDPrefix,
+	fs.DurationVar(
+		&c.ReloadInterval,
+		"geoip.reload-interval",
+		c.ReloadInterval,
 		`
-A prefix for the node ID.
-
-Piko will generate a unique random identifier for the node and append it to
-the given prefix.
+The interval to check whether the database file has changed, such as when
+updated by 'geoipupdate', and reload it if so.
 
-Such as you could use the node or pod  name as a prefix, then add a unique
-identifier to ensure the node ID is unique across restarts.`,
+If zero the database is never reloaded.`,
 	)
+}
 
-	fs.StringSliceVar(
-		&c.Join,
-		"cluster.join",
-		c.Join,
-		`
-A list of addresses of members in the cluster to join.
+type StorageConfig struct {
+	// Path is the data directory shared by features that write to disk.
+	// Each feature stores its data in a subdirectory, unless the feature's
+	// own path is configured.
+	//
+	// If empty, each feature uses its own path.
+	Path string `json:"path" yaml:"path"`
+
+	// MaxSize is the maximum total disk usage of all features in bytes.
+	//
+	// Zero means there is no limit.
+	MaxSize int64 `json:"max_size" yaml:"max_size"`
+
+	// Eviction is the policy when a write would exceed MaxSize, either
+	// 'lru' to evict the least recently used evictable data (such as idle
+	// incomplete uploads), or 'none' to reject the write.
+	Eviction string `json:"eviction" yaml:"eviction"`
+}
 
-This may be either addresses of specific nodes, such as
-'--cluster.join 10.26.104.14,10.26.104.75', or a domain that resolves to
-the addresses of the nodes in the cluster (e.g. a Kubernetes headless
-service), such as '--cluster.join piko.prod-piko-ns'.
+func (c *StorageConfig) Validate() error {
+	if c.MaxSize < 0 {
+		return fmt.Errorf("max size cannot be negative")
+	}
+	switch c.Eviction {
+	case "lru", "none":
+	default:
+		return fmt.Errorf("unsupported eviction: %s", c.Eviction)
+	}
+	return nil
+}
 
-Each address must include the host, and may optionally include a port. If no
-port is given, the gossip port of this node is used.
+func (c *StorageConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&c.Path,
+		"storage.path",
+		c.Path,
+		`
+Data directory shared by features that write to disk, such as resumable
+uploads ('uploads') and request queueing ('queue'). Each feature stores its
+data in a subdirectory, unless the feature's own path is configured (such as
+'--proxy.uploads.path').
 
-Note each node propagates membership information to the other known nodes,
-so the initial set of configured members only needs to be a subset of nodes.`,
-	)
+The directory must not be shared with other Piko nodes.
 
-	fs.DurationVar(
-		&c.JoinTimeout,
-		"cluster.join-timeout",
-		c.JoinTimeout,
-		`
-The timeout to attempt to join an existing cluster when 'cluster.join' is
-set.`,
+If empty, each feature uses its own path.`,
 	)
 
-	fs.BoolVar(
-		&c.AbortIfJoinFails,
-		"cluster.abort-if-join-fails",
-		c.AbortIfJoinFails,
+	fs.Int64Var(
+		&c.MaxSize,
+		"storage.max-size",
+		c.MaxSize,
 		`
-Whether the server node should abort if it is configured with more than one
-node to join (excluding itself) but fails to join any members.`,
-	)
+Maximum total disk usage of all features in bytes, including features whose
+own path is configured.
 
-	c.Gossip.RegisterFlags(fs, "cluster")
-}
+Writes that would exceed the limit are handled by '--storage.eviction', and
+if rejected fail with a '507 Insufficient Storage' response.
 
-type UsageConfig struct {
-	// Disable indicates whether to disable anonymous usage collection.
-	Disable bool `json:"disable" yaml:"disable"`
-}
+Zero means there is no limit.`,
+	)
 
-func (c *UsageConfig) RegisterFlags(fs *pflag.FlagSet) {
-	fs.BoolVar(
-		&c.Disable,
-		"usage.disable",
-		c.Disable,
+	fs.StringVar(
+		&c.Eviction,
+		"storage.eviction",
+		c.Eviction,
 		`
-Whether to disable anonymous usage tracking.
+Policy when a write would exceed '--storage.max-size':
+- 'lru': Evict the least recently used evictable data, such as idle
+incomplete uploads, then reject the write if not enough space was freed.
+- 'none': Reject the write.
 
-The Piko server periodically sends an anonymous report to help understand how
-Piko is being used. This report includes the Piko version, host OS, host
-architecture, requests processed and upstreams registered.`,
+Queued requests are never evicted.`,
 	)
 }
 
@@ -408,8 +2940,29 @@ type Config struct {
 
 	Usage UsageConfig `json:"usage" yaml:"usage"`
 
+	Admission AdmissionConfig `json:"admission" yaml:"admission"`
+
+	Tenants TenantsConfig `json:"tenants" yaml:"tenants"`
+
+	Probes ProbesConfig `json:"probes" yaml:"probes"`
+
+	Events EventsConfig `json:"events" yaml:"events"`
+
+	GeoIP GeoIPConfig `json:"geoip" yaml:"geoip"`
+
+	Storage StorageConfig `json:"storage" yaml:"storage"`
+
+	Runtime goruntime.Config `json:"runtime" yaml:"runtime"`
+
 	Log log.Config `json:"log" yaml:"log"`
 
+	// HeaderPrefix is the prefix of the names of the headers Piko adds to
+	// proxied requests and responses, and the headers agents add when
+	// connecting, such as 'x-piko-endpoint'.
+	//
+	// Agents must be configured with the same prefix.
+	HeaderPrefix string `json:"header_prefix" yaml:"header_prefix"`
+
 	// GracePeriod is the duration to gracefully shutdown the server. During
 	// the grace period, listeners and idle connections are closed, then waits
 	// for active requests to complete and closes their connections.
@@ -429,12 +2982,60 @@ func Default() *Config {
 				IdleTimeout:       time.Minute * 5,
 				MaxHeaderBytes:    1 << 20,
 			},
+			Uploads: UploadsConfig{
+				MaxSize:      10 << 30,
+				MaxTotalSize: 100 << 30,
+				Expiry:       time.Hour * 24,
+			},
+			Queue: QueueConfig{
+				MaxRequestSize:     64 << 10,
+				MaxRequests:        1000,
+				ReplayInterval:     time.Second,
+				DeliveredRetention: time.Hour * 24,
+			},
+			WaitingRoom: WaitingRoomConfig{
+				RetryAfter: time.Second * 5,
+			},
+			StickySessions: StickySessionsConfig{
+				Cookie: "piko_affinity",
+			},
+			Filter: FilterConfig{
+				Challenge: ChallengeConfig{
+					Timeout: time.Second * 5,
+				},
+			},
+			Fingerprint: FingerprintConfig{
+				MaxFingerprints: 10000,
+			},
+			CustomDomains: CustomDomainsConfig{
+				PendingExpiry: time.Hour * 72,
+			},
+			Redirect: RedirectConfig{
+				HTTPSPort:    443,
+				ExcludePaths: []string{"/.well-known/acme-challenge/"},
+			},
+			Canary: CanaryConfig{
+				Window:            time.Minute * 5,
+				MinRequests:       100,
+				MaxErrorRateDelta: 0.05,
+			},
 		},
 		Upstream: UpstreamConfig{
-			BindAddr: ":8001",
+			BindAddr:      ":8001",
+			LoadBalancing: LoadBalancingRoundRobin,
+			AuthLockout: ratelimit.LockoutConfig{
+				FailureWindow: time.Minute,
+				Duration:      time.Second * 30,
+				MaxDuration:   time.Hour,
+			},
 		},
 		Admin: AdminConfig{
 			BindAddr: ":8002",
+			AuthLockout: ratelimit.LockoutConfig{
+				FailureWindow: time.Minute,
+				Duration:      time.Second * 30,
+				MaxDuration:   time.Hour,
+			},
 		},
 		Cluster: ClusterConfig{
 			JoinTimeout:      time.Minute,
@@ -445,10 +3046,35 @@ func Default() *Config {
 				MaxPacketSize: 1400,
 			},
 		},
+		Admission: AdmissionConfig{
+			CheckInterval: time.Second,
+			RetryAfter:    time.Second * 5,
+		},
+		Tenants: TenantsConfig{
+			MaxTenants: 1000,
+		},
+		Probes: ProbesConfig{
+			Interval: time.Second * 30,
+			Timeout:  time.Second * 10,
+		},
+		Events: EventsConfig{
+			Topic:         "piko.events",
+			BatchSize:     100,
+			FlushInterval: time.Second,
+			QueueSize:     10000,
+			Timeout:       time.Second * 10,
+		},
+		GeoIP: GeoIPConfig{
+			ReloadInterval: time.Hour,
+		},
+		Storage: StorageConfig{
+			Eviction: "lru",
+		},
 		Log: log.Config{
 			Level: "info",
 		},
-		GracePeriod: time.Minute,
+		HeaderPrefix: protocol.DefaultHeaderPrefix,
+		GracePeriod:  time.Minute,
 	}
 }
 
@@ -460,6 +3086,9 @@ func (c *Config) Validate() error {
 	if err := c.Proxy.Validate(); err != nil {
 		return fmt.Errorf("proxy: %w", err)
 	}
+	if c.Proxy.Queue.Enabled() && c.Proxy.Queue.Path == "" && c.Storage.Path == "" {
+		return fmt.Errorf("proxy: queue: missing path")
+	}
 
 	if err := c.Upstream.Validate(); err != nil {
 		return fmt.Errorf("upstream: %w", err)
@@ -469,10 +3098,42 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("admin: %w", err)
 	}
 
+	if err := c.Admission.Validate(); err != nil {
+		return fmt.Errorf("admission: %w", err)
+	}
+
+	if err := c.Tenants.Validate(); err != nil {
+		return fmt.Errorf("tenants: %w", err)
+	}
+
+	if err := c.Probes.Validate(); err != nil {
+		return fmt.Errorf("probes: %w", err)
+	}
+
+	if err := c.Events.Validate(); err != nil {
+		return fmt.Errorf("events: %w", err)
+	}
+
+	if err := c.GeoIP.Validate(); err != nil {
+		return fmt.Errorf("geoip: %w", err)
+	}
+
+	if err := c.Storage.Validate(); err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+
+	if err := c.Runtime.Validate(); err != nil {
+		return fmt.Errorf("runtime: %w", err)
+	}
+
 	if err := c.Log.Validate(); err != nil {
 		return fmt.Errorf("log: %w", err)
 	}
 
+	if err := protocol.ValidateHeaderPrefix(c.HeaderPrefix); err != nil {
+		return fmt.Errorf("header prefix: %w", err)
+	}
+
 	if c.GracePeriod == 0 {
 		return fmt.Errorf("missing grace period")
 	}
@@ -491,8 +3152,38 @@ func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
 
 	c.Usage.RegisterFlags(fs)
 
+	c.Admission.RegisterFlags(fs)
+
+	c.Tenants.RegisterFlags(fs)
+
+	c.Probes.RegisterFlags(fs)
+
+	c.Events.RegisterFlags(fs)
+
+	c.GeoIP.RegisterFlags(fs)
+
+	c.Storage.RegisterFlags(fs)
+
+	c.Runtime.RegisterFlags(fs)
+
 	c.Log.RegisterFlags(fs)
 
+	fs.StringVar(
+		&c.HeaderPrefix,
+		"header-prefix",
+		c.HeaderPrefix,
+		`
+Prefix of the names of the headers Piko adds to proxied requests and
+responses, and the headers agents add when connecting, such as the
+'x-piko-endpoint' header to route a request to an endpoint.
+
+Use this for environments that forbid 'x-piko-*' headers, such as
+'--header-prefix x-tunnel-' to use 'x-tunnel-endpoint'. The prefix may only
+contain letters, digits and '-', and must end with '-'.
+
+Agents must be configured with the same prefix.`,
+	)
+
 	fs.DurationVar(
 		&c.GracePeriod,
 		"grace-period",
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"net/netip"
 	"os"
 	"testing"
 	"time"
@@ -10,8 +11,10 @@ import (
 
 	"github.com/andydunstall/piko/pkg/auth"
 	"github.com/andydunstall/piko/pkg/config"
+	"github.com/andydunstall/piko/pkg/goruntime"
 	"github.com/andydunstall/piko/pkg/gossip"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/ratelimit"
 )
 
 // Tests the default configuration is valid (not including node ID).
@@ -19,6 +22,85 @@ func TestConfig_Default(t *testing.T) {
 	conf := Default()
 	conf.Cluster.NodeID = "my-node"
 	assert.NoError(t, conf.Validate())
+
+	assert.Equal(t, AdmissionConfig{
+		CheckInterval: time.Second,
+		RetryAfter:    time.Second * 5,
+	}, conf.Admission)
+}
+
+// Tests the admission configuration rejects invalid intervals.
+func TestAdmissionConfig_Validate(t *testing.T) {
+	conf := Default().Admission
+	conf.MaxHeapBytes = 1000
+	conf.CheckInterval = 0
+	assert.EqualError(t, conf.Validate(), "check interval must be positive")
+
+	conf = Default().Admission
+	conf.MaxHeapBytes = 1000
+	conf.RetryAfter = -time.Second
+	assert.EqualError(t, conf.Validate(), "retry after cannot be negative")
+
+	conf = Default().Admission
+	conf.MaxFileRatio = 1.5
+	assert.EqualError(t, conf.Validate(), "max file ratio must be between 0 and 1")
+
+	conf = Default().Admission
+	conf.MaxFileRatio = 0.8
+	conf.ResumeFileRatio = 0.9
+	assert.EqualError(t, conf.Validate(), "resume file ratio must be between 0 and max file ratio")
+}
+
+func TestCanaryConfig_Validate(t *testing.T) {
+	split := CanarySplitConfig{
+		EndpointID:       "my-endpoint",
+		CanaryEndpointID: "my-endpoint-canary",
+		Weight:           10,
+	}
+
+	conf := Default().Proxy.Canary
+	conf.Splits = []CanarySplitConfig{split}
+	assert.NoError(t, conf.Validate())
+
+	conf.Splits[0].Weight = 101
+	assert.EqualError(t, conf.Validate(), "split 0: weight must be between 0 and 100")
+
+	conf.Splits[0] = split
+	conf.Splits[0].CanaryEndpointID = "my-endpoint"
+	assert.EqualError(t, conf.Validate(), "split 0: canary endpoint id must differ from endpoint id")
+
+	conf.Splits[0] = split
+	conf.Splits[0].EndpointID = "team-a/*"
+	assert.EqualError(t, conf.Validate(), "split 0: wildcard endpoints not supported")
+
+	conf.Splits = []CanarySplitConfig{split, split}
+	assert.EqualError(t, conf.Validate(), "split 1: duplicate endpoint: my-endpoint")
+
+	conf.Splits = []CanarySplitConfig{split}
+	conf.MaxErrorRateDelta = 0
+	assert.EqualError(t, conf.Validate(), "max error rate delta must be greater than 0 and at most 1")
+}
+
+func TestRouteLabelsConfig_Validate(t *testing.T) {
+	conf := RouteLabelsConfig{
+		Rules: []RouteRuleConfig{
+			{Template: "/users/{id}"},
+			{Regex: "^/health$", Route: "health"},
+		},
+	}
+	assert.NoError(t, conf.Validate())
+
+	conf.Rules[1].Route = ""
+	assert.EqualError(t, conf.Validate(), "rule 1: missing route")
+
+	conf.Rules[1] = RouteRuleConfig{Regex: "(", Route: "health"}
+	assert.ErrorContains(t, conf.Validate(), "rule 1: invalid regex")
+
+	conf.Rules[1] = RouteRuleConfig{Template: "/a", Regex: "a"}
+	assert.EqualError(t, conf.Validate(), "rule 1: must have either a template or regex")
+
+	conf.Rules[1] = RouteRuleConfig{Template: "users"}
+	assert.EqualError(t, conf.Validate(), "rule 1: template must start with '/'")
 }
 
 // Tests loading the server configuration from YAML.
@@ -29,6 +111,97 @@ proxy:
   advertise_addr: 1.2.3.4:8000
   timeout: 20s
   access_log: true
+  sample_rate: 10
+  endpoint_sample_rates:
+    my-endpoint: 100
+  identity_headers: true
+  public_endpoints:
+    - my-public-endpoint
+
+  uploads:
+    enabled: true
+    path: /tmp/uploads
+    max_size: 1000
+    max_total_size: 10000
+    expiry: 1h
+
+  queue:
+    endpoints:
+      - my-endpoint
+    path: /tmp/queue
+    max_request_size: 100
+    max_requests: 10
+    replay_interval: 5s
+    delivered_retention: 1h
+
+  waiting_room:
+    endpoints:
+      - team-a/*
+    retry_after: 10s
+    page: /tmp/waiting-room.html
+
+  sticky_sessions:
+    endpoints:
+      - my-endpoint
+    header: x-session-id
+    cookie: my-affinity
+    cookie_max_age: 1h
+
+  filter:
+    block_user_agents:
+      - (?i)masscan
+    block_paths:
+      - ^/wp-admin
+    challenge:
+      url: http://challenge:8080/verify
+      timeout: 2s
+
+  fingerprint:
+    enabled: true
+    max_fingerprints: 500
+
+  custom_domains:
+    enabled: true
+    path: /var/lib/piko/domains.json
+    pending_expiry: 24h
+    cert_cache_dir: /var/lib/piko/certs
+    acme_directory_url: https://acme-staging-v02.api.letsencrypt.org/directory
+    acme_email: ops@example.com
+
+  redirect:
+    bind_addr: :80
+    https_port: 8443
+    exclude_paths:
+      - /.well-known/
+  hsts:
+    max_age: 8760h
+    include_subdomains: true
+    preload: true
+    endpoints:
+      - my-endpoint
+    domains:
+      - "*.example.com"
+
+  transfers:
+    progress_interval: 10s
+    slow_throughput: 4096
+
+  canary:
+    splits:
+      - endpoint_id: my-endpoint
+        canary_endpoint_id: my-endpoint-canary
+        weight: 10
+    window: 1m
+    min_requests: 50
+    max_error_rate_delta: 0.1
+    max_latency_delta: 200ms
+    rollback: true
+
+  route_labels:
+    rules:
+      - template: /users/{id}
+      - regex: ^/v[0-9]+/health$
+        route: health
 
   http:
     read_timeout: 5s
@@ -47,10 +220,30 @@ proxy:
   tls:
     cert: /piko/cert.pem
     key: /piko/key.pem
+    reload_interval: 1m
 
 upstream:
   bind_addr: 10.15.104.25:8001
   advertise_addr: 1.2.3.4:8001
+  allow_cidrs:
+    - 10.0.0.0/8
+    - 192.168.1.10
+  session_grace_period: 5s
+  write_coalesce_delay: 1ms
+  max_streams: 100
+  stream_queue_timeout: 2s
+  stream_window: 1048576
+  max_conns: 10000
+  max_endpoint_conns: 100
+  max_namespace_conns: 500
+  load_balancing: least-connections
+
+  rate_limit:
+    connect_rate: 5
+    connect_burst: 10
+    control_frame_rate: 2.5
+    control_frame_burst: 5
+    ban_duration: 1m
 
   auth:
     hmac_secret_key: hmac-secret-key
@@ -59,6 +252,12 @@ upstream:
     audience: my-audience
     issuer: my-issuer
 
+  auth_lockout:
+    max_failures: 5
+    failure_window: 2m
+    duration: 10s
+    max_duration: 30m
+
   tls:
     cert: /piko/cert.pem
     key: /piko/key.pem
@@ -66,6 +265,7 @@ upstream:
 admin:
   bind_addr: 10.15.104.25:8002
   advertise_addr: 1.2.3.4:8002
+  client_cert_auth: true
 
   auth:
     hmac_secret_key: hmac-secret-key
@@ -77,6 +277,7 @@ admin:
   tls:
     cert: /piko/cert.pem
     key: /piko/key.pem
+    client_cas: /piko/ca.pem
 
 cluster:
   node_id: "my-node"
@@ -86,6 +287,7 @@ cluster:
     - 10.26.104.28:8003
   join_timeout: 2m
   abort_if_join_fails: true
+  forward_signing_key: forward-signing-key
 
   gossip:
     bind_addr: 10.15.104.25:8003
@@ -96,12 +298,64 @@ cluster:
 usage:
   disable: true
 
+admission:
+  max_heap_bytes: 1000
+  resume_heap_bytes: 900
+  max_file_ratio: 0.9
+  resume_file_ratio: 0.8
+  check_interval: 2s
+  retry_after: 10s
+
+tenants:
+  enabled: true
+  max_tenants: 50
+
+probes:
+  endpoints:
+    - my-endpoint
+  probes:
+    - name: my-probe
+      endpoint_id: other-endpoint
+      method: HEAD
+      path: /healthz
+      expected_status: 204
+      interval: 5s
+      timeout: 1s
+  interval: 10s
+  timeout: 2s
+
+events:
+  exporter: nats
+  url: nats://nats:4222
+  topic: my-events
+  batch_size: 50
+  flush_interval: 2s
+  queue_size: 500
+  timeout: 5s
+
+geoip:
+  database: /etc/piko/GeoLite2-Country.mmdb
+  reload_interval: 30m
+
+storage:
+  path: /var/lib/piko
+  max_size: 1000000
+  eviction: none
+
+runtime:
+  gc_percent: 200
+  memory_limit: 1000000000
+  memory_limit_ratio: 0.9
+  max_procs: 4
+
 log:
   level: info
   subsystems:
     - foo
     - bar
 
+header_prefix: x-tunnel-
+
 grace_period: 2m
 `
 
@@ -121,6 +375,94 @@ grace_period: 2m
 			AdvertiseAddr: "1.2.3.4:8000",
 			Timeout:       time.Second * 20,
 			AccessLog:     true,
+			SampleRate:    10,
+			EndpointSampleRates: map[string]int{
+				"my-endpoint": 100,
+			},
+			IdentityHeaders: true,
+			PublicEndpoints: []string{"my-public-endpoint"},
+			Uploads: UploadsConfig{
+				Enabled:      true,
+				Path:         "/tmp/uploads",
+				MaxSize:      1000,
+				MaxTotalSize: 10000,
+				Expiry:       time.Hour,
+			},
+			Queue: QueueConfig{
+				Endpoints:          []string{"my-endpoint"},
+				Path:               "/tmp/queue",
+				MaxRequestSize:     100,
+				MaxRequests:        10,
+				ReplayInterval:     time.Second * 5,
+				DeliveredRetention: time.Hour,
+			},
+			WaitingRoom: WaitingRoomConfig{
+				Endpoints:  []string{"team-a/*"},
+				RetryAfter: time.Second * 10,
+				Page:       "/tmp/waiting-room.html",
+			},
+			StickySessions: StickySessionsConfig{
+				Endpoints:    []string{"my-endpoint"},
+				Header:       "x-session-id",
+				Cookie:       "my-affinity",
+				CookieMaxAge: time.Hour,
+			},
+			Filter: FilterConfig{
+				BlockUserAgents: []string{"(?i)masscan"},
+				BlockPaths:      []string{"^/wp-admin"},
+				Challenge: ChallengeConfig{
+					URL:     "http://challenge:8080/verify",
+					Timeout: time.Second * 2,
+				},
+			},
+			Fingerprint: FingerprintConfig{
+				Enabled:         true,
+				MaxFingerprints: 500,
+			},
+			CustomDomains: CustomDomainsConfig{
+				Enabled:          true,
+				Path:             "/var/lib/piko/domains.json",
+				PendingExpiry:    time.Hour * 24,
+				CertCacheDir:     "/var/lib/piko/certs",
+				ACMEDirectoryURL: "https://acme-staging-v02.api.letsencrypt.org/directory",
+				ACMEEmail:        "ops@example.com",
+			},
+			Redirect: RedirectConfig{
+				BindAddr:     ":80",
+				HTTPSPort:    8443,
+				ExcludePaths: []string{"/.well-known/"},
+			},
+			HSTS: HSTSConfig{
+				MaxAge:            time.Hour * 8760,
+				IncludeSubdomains: true,
+				Preload:           true,
+				Endpoints:         []string{"my-endpoint"},
+				Domains:           []string{"*.example.com"},
+			},
+			Transfers: TransfersConfig{
+				ProgressInterval: time.Second * 10,
+				SlowThroughput:   4096,
+			},
+			Canary: CanaryConfig{
+				Splits: []CanarySplitConfig{
+					{
+						EndpointID:       "my-endpoint",
+						CanaryEndpointID: "my-endpoint-canary",
+						Weight:           10,
+					},
+				},
+				Window:            time.Minute,
+				MinRequests:       50,
+				MaxErrorRateDelta: 0.1,
+				MaxLatencyDelta:   time.Millisecond * 200,
+				Rollback:          true,
+			},
+			RouteLabels: RouteLabelsConfig{
+				Rules: []RouteRuleConfig{
+					{Template: "/users/{id}"},
+					{Regex: "^/v[0-9]+/health$", Route: "health"},
+				},
+			},
 			HTTP: HTTPConfig{
 				ReadTimeout:       time.Second * 5,
 				ReadHeaderTimeout: time.Second * 5,
@@ -136,13 +478,31 @@ grace_period: 2m
 				Issuer:         "my-issuer",
 			},
 			TLS: TLSConfig{
-				Cert: "/piko/cert.pem",
-				Key:  "/piko/key.pem",
+				Cert:           "/piko/cert.pem",
+				Key:            "/piko/key.pem",
+				ReloadInterval: time.Minute,
 			},
 		},
 		Upstream: UpstreamConfig{
-			BindAddr:      "10.15.104.25:8001",
-			AdvertiseAddr: "1.2.3.4:8001",
+			BindAddr:           "10.15.104.25:8001",
+			AdvertiseAddr:      "1.2.3.4:8001",
+			AllowCIDRs:         []string{"10.0.0.0/8", "192.168.1.10"},
+			SessionGracePeriod: time.Second * 5,
+			WriteCoalesceDelay: time.Millisecond,
+			MaxStreams:         100,
+			StreamQueueTimeout: time.Second * 2,
+			StreamWindow:       1048576,
+			MaxConns:           10000,
+			MaxEndpointConns:   100,
+			MaxNamespaceConns:  500,
+			LoadBalancing:      LoadBalancingLeastConnections,
+			RateLimit: UpstreamRateLimitConfig{
+				ConnectRate:       5,
+				ConnectBurst:      10,
+				ControlFrameRate:  2.5,
+				ControlFrameBurst: 5,
+				BanDuration:       time.Minute,
+			},
 			Auth: auth.Config{
 				HMACSecretKey:  "hmac-secret-key",
 				RSAPublicKey:   "rsa-public-key",
@@ -150,14 +510,21 @@ grace_period: 2m
 				Audience:       "my-audience",
 				Issuer:         "my-issuer",
 			},
+			AuthLockout: ratelimit.LockoutConfig{
+				MaxFailures:   5,
+				FailureWindow: time.Minute * 2,
+				Duration:      time.Second * 10,
+				MaxDuration:   time.Minute * 30,
+			},
 			TLS: TLSConfig{
 				Cert: "/piko/cert.pem",
 				Key:  "/piko/key.pem",
 			},
 		},
 		Admin: AdminConfig{
-			BindAddr:      "10.15.104.25:8002",
-			AdvertiseAddr: "1.2.3.4:8002",
+			BindAddr:       "10.15.104.25:8002",
+			AdvertiseAddr:  "1.2.3.4:8002",
+			ClientCertAuth: true,
 			Auth: auth.Config{
 				HMACSecretKey:  "hmac-secret-key",
 				RSAPublicKey:   "rsa-public-key",
@@ -166,8 +533,9 @@ grace_period: 2m
 				Issuer:         "my-issuer",
 			},
 			TLS: TLSConfig{
-				Cert: "/piko/cert.pem",
-				Key:  "/piko/key.pem",
+				Cert:      "/piko/cert.pem",
+				Key:       "/piko/key.pem",
+				ClientCAs: "/piko/ca.pem",
 			},
 		},
 		Cluster: ClusterConfig{
@@ -177,8 +545,9 @@ grace_period: 2m
 				"10.26.104.73:8003",
 				"10.26.104.28:8003",
 			},
-			JoinTimeout:      2 * time.Minute,
-			AbortIfJoinFails: true,
+			JoinTimeout:       2 * time.Minute,
+			AbortIfJoinFails:  true,
+			ForwardSigningKey: "forward-signing-key",
 			Gossip: gossip.Config{
 				BindAddr:      "10.15.104.25:8003",
 				AdvertiseAddr: "1.2.3.4:8003",
@@ -189,6 +558,58 @@ grace_period: 2m
 		Usage: UsageConfig{
 			Disable: true,
 		},
+		Admission: AdmissionConfig{
+			MaxHeapBytes:    1000,
+			ResumeHeapBytes: 900,
+			MaxFileRatio:    0.9,
+			ResumeFileRatio: 0.8,
+			CheckInterval:   time.Second * 2,
+			RetryAfter:      time.Second * 10,
+		},
+		Tenants: TenantsConfig{
+			Enabled:    true,
+			MaxTenants: 50,
+		},
+		Probes: ProbesConfig{
+			Endpoints: []string{"my-endpoint"},
+			Probes: []ProbeConfig{
+				{
+					Name:           "my-probe",
+					EndpointID:     "other-endpoint",
+					Method:         "HEAD",
+					Path:           "/healthz",
+					ExpectedStatus: 204,
+					Interval:       time.Second * 5,
+					Timeout:        time.Second,
+				},
+			},
+			Interval: time.Second * 10,
+			Timeout:  time.Second * 2,
+		},
+		Events: EventsConfig{
+			Exporter:      "nats",
+			URL:           "nats://nats:4222",
+			Topic:         "my-events",
+			BatchSize:     50,
+			FlushInterval: time.Second * 2,
+			QueueSize:     500,
+			Timeout:       time.Second * 5,
+		},
+		GeoIP: GeoIPConfig{
+			Database:       "/etc/piko/GeoLite2-Country.mmdb",
+			ReloadInterval: time.Minute * 30,
+		},
+		Storage: StorageConfig{
+			Path:     "/var/lib/piko",
+			MaxSize:  1000000,
+			Eviction: "none",
+		},
+		Runtime: goruntime.Config{
+			GCPercent:        200,
+			MemoryLimit:      1000000000,
+			MemoryLimitRatio: 0.9,
+			MaxProcs:         4,
+		},
 		Log: log.Config{
 			Level: "info",
 			Subsystems: []string{
@@ -196,7 +617,8 @@ grace_period: 2m
 				"bar",
 			},
 		},
-		GracePeriod: 2 * time.Minute,
+		HeaderPrefix: "x-tunnel-",
+		GracePeriod:  2 * time.Minute,
 	}
 	assert.Equal(t, expectedConf, loadedConf)
 }
@@ -208,6 +630,55 @@ func TestConfig_LoadFlags(t *testing.T) {
 		"--proxy.advertise-addr", "1.2.3.4:8000",
 		"--proxy.timeout", "20s",
 		"--proxy.access-log",
+		"--proxy.sample-rate", "10",
+		"--proxy.endpoint-sample-rates", "my-endpoint=100",
+		"--proxy.identity-headers",
+		"--proxy.public-endpoints", "my-public-endpoint",
+		"--proxy.uploads.enabled",
+		"--proxy.uploads.path", "/tmp/uploads",
+		"--proxy.uploads.max-size", "1000",
+		"--proxy.uploads.max-total-size", "10000",
+		"--proxy.uploads.expiry", "1h",
+		"--proxy.queue.endpoints", "my-endpoint",
+		"--proxy.queue.path", "/tmp/queue",
+		"--proxy.queue.max-request-size", "100",
+		"--proxy.queue.max-requests", "10",
+		"--proxy.queue.replay-interval", "5s",
+		"--proxy.queue.delivered-retention", "1h",
+		"--proxy.waiting-room.endpoints", "team-a/*",
+		"--proxy.waiting-room.retry-after", "10s",
+		"--proxy.waiting-room.page", "/tmp/waiting-room.html",
+		"--proxy.sticky-sessions.endpoints", "my-endpoint",
+		"--proxy.sticky-sessions.header", "x-session-id",
+		"--proxy.sticky-sessions.cookie", "my-affinity",
+		"--proxy.sticky-sessions.cookie-max-age", "1h",
+		"--proxy.filter.block-user-agents", "(?i)masscan",
+		"--proxy.filter.block-paths", "^/wp-admin",
+		"--proxy.filter.challenge.url", "http://challenge:8080/verify",
+		"--proxy.filter.challenge.timeout", "2s",
+		"--proxy.fingerprint.enabled",
+		"--proxy.fingerprint.max-fingerprints", "500",
+		"--proxy.custom-domains.enabled",
+		"--proxy.custom-domains.path", "/var/lib/piko/domains.json",
+		"--proxy.custom-domains.pending-expiry", "24h",
+		"--proxy.custom-domains.cert-cache-dir", "/var/lib/piko/certs",
+		"--proxy.custom-domains.acme-directory-url", "https://acme-staging-v02.api.letsencrypt.org/directory",
+		"--proxy.custom-domains.acme-email", "ops@example.com",
+		"--proxy.redirect.bind-addr", ":80",
+		"--proxy.redirect.https-port", "8443",
+		"--proxy.redirect.exclude-paths", "/.well-known/",
+		"--proxy.hsts.max-age", "8760h",
+		"--proxy.hsts.include-subdomains",
+		"--proxy.hsts.preload",
+		"--proxy.hsts.endpoints", "my-endpoint",
+		"--proxy.hsts.domains", "*.example.com",
+		"--proxy.transfers.progress-interval", "10s",
+		"--proxy.transfers.slow-throughput", "4096",
+		"--proxy.canary.window", "1m",
+		"--proxy.canary.min-requests", "50",
+		"--proxy.canary.max-error-rate-delta", "0.1",
+		"--proxy.canary.max-latency-delta", "200ms",
+		"--proxy.canary.rollback",
 		"--proxy.http.read-timeout", "5s",
 		"--proxy.http.read-header-timeout", "5s",
 		"--proxy.http.write-timeout", "5s",
@@ -220,13 +691,33 @@ func TestConfig_LoadFlags(t *testing.T) {
 		"--proxy.auth.issuer", "my-issuer",
 		"--proxy.tls.cert", "/piko/cert.pem",
 		"--proxy.tls.key", "/piko/key.pem",
+		"--proxy.tls.reload-interval", "1m",
 		"--upstream.bind-addr", "10.15.104.25:8001",
 		"--upstream.advertise-addr", "1.2.3.4:8001",
+		"--upstream.allow-cidrs", "10.0.0.0/8,192.168.1.10",
+		"--upstream.session-grace-period", "5s",
+		"--upstream.write-coalesce-delay", "1ms",
+		"--upstream.max-streams", "100",
+		"--upstream.stream-queue-timeout", "2s",
+		"--upstream.stream-window", "1048576",
+		"--upstream.max-conns", "10000",
+		"--upstream.max-endpoint-conns", "100",
+		"--upstream.max-namespace-conns", "500",
+		"--upstream.load-balancing", "least-connections",
+		"--upstream.rate-limit.connect-rate", "5",
+		"--upstream.rate-limit.connect-burst", "10",
+		"--upstream.rate-limit.control-frame-rate", "2.5",
+		"--upstream.rate-limit.control-frame-burst", "5",
+		"--upstream.rate-limit.ban-duration", "1m",
 		"--upstream.auth.hmac-secret-key", "hmac-secret-key",
 		"--upstream.auth.rsa-public-key", "rsa-public-key",
 		"--upstream.auth.ecdsa-public-key", "ecdsa-public-key",
 		"--upstream.auth.audience", "my-audience",
 		"--upstream.auth.issuer", "my-issuer",
+		"--upstream.auth-lockout.max-failures", "5",
+		"--upstream.auth-lockout.failure-window", "2m",
+		"--upstream.auth-lockout.duration", "10s",
+		"--upstream.auth-lockout.max-duration", "30m",
 		"--upstream.tls.cert", "/piko/cert.pem",
 		"--upstream.tls.key", "/piko/key.pem",
 		"--admin.bind-addr", "10.15.104.25:8002",
@@ -238,17 +729,48 @@ func TestConfig_LoadFlags(t *testing.T) {
 		"--admin.auth.issuer", "my-issuer",
 		"--admin.tls.cert", "/piko/cert.pem",
 		"--admin.tls.key", "/piko/key.pem",
+		"--admin.tls.client-cas", "/piko/ca.pem",
+		"--admin.client-cert-auth",
 		"--cluster.node-id", "my-node",
 		"--cluster.join", "10.26.104.12:8003,10.26.104.73:8003,10.26.104.28:8003",
 		"--cluster.join-timeout", "2m",
 		"--cluster.abort-if-join-fails",
+		"--cluster.forward-signing-key", "forward-signing-key",
 		"--cluster.gossip.bind-addr", "10.15.104.25:8003",
 		"--cluster.gossip.advertise-addr", "1.2.3.4:8003",
 		"--cluster.gossip.interval", "100ms",
 		"--cluster.gossip.max-packet-size", "1400",
 		"--usage.disable",
+		"--admission.max-heap-bytes", "1000",
+		"--admission.resume-heap-bytes", "900",
+		"--admission.max-file-ratio", "0.9",
+		"--admission.resume-file-ratio", "0.8",
+		"--admission.check-interval", "2s",
+		"--admission.retry-after", "10s",
+		"--tenants.enabled",
+		"--tenants.max-tenants", "50",
+		"--probes.endpoints", "my-endpoint",
+		"--probes.interval", "10s",
+		"--probes.timeout", "2s",
+		"--events.exporter", "nats",
+		"--events.url", "nats://nats:4222",
+		"--events.topic", "my-events",
+		"--events.batch-size", "50",
+		"--events.flush-interval", "2s",
+		"--events.queue-size", "500",
+		"--events.timeout", "5s",
+		"--geoip.database", "/etc/piko/GeoLite2-Country.mmdb",
+		"--geoip.reload-interval", "30m",
+		"--storage.path", "/var/lib/piko",
+		"--storage.max-size", "1000000",
+		"--storage.eviction", "none",
+		"--runtime.gc-percent", "200",
+		"--runtime.memory-limit", "1000000000",
+		"--runtime.memory-limit-ratio", "0.9",
+		"--runtime.max-procs", "4",
 		"--log.level", "info",
 		"--log.subsystems", "foo,bar",
+		"--header-prefix", "x-tunnel-",
 		"--grace-period", "2m",
 	}
 
@@ -265,6 +787,81 @@ func TestConfig_LoadFlags(t *testing.T) {
 			AdvertiseAddr: "1.2.3.4:8000",
 			Timeout:       time.Second * 20,
 			AccessLog:     true,
+			SampleRate:    10,
+			EndpointSampleRates: map[string]int{
+				"my-endpoint": 100,
+			},
+			IdentityHeaders: true,
+			PublicEndpoints: []string{"my-public-endpoint"},
+			Uploads: UploadsConfig{
+				Enabled:      true,
+				Path:         "/tmp/uploads",
+				MaxSize:      1000,
+				MaxTotalSize: 10000,
+				Expiry:       time.Hour,
+			},
+			Queue: QueueConfig{
+				Endpoints:          []string{"my-endpoint"},
+				Path:               "/tmp/queue",
+				MaxRequestSize:     100,
+				MaxRequests:        10,
+				ReplayInterval:     time.Second * 5,
+				DeliveredRetention: time.Hour,
+			},
+			WaitingRoom: WaitingRoomConfig{
+				Endpoints:  []string{"team-a/*"},
+				RetryAfter: time.Second * 10,
+				Page:       "/tmp/waiting-room.html",
+			},
+			StickySessions: StickySessionsConfig{
+				Endpoints:    []string{"my-endpoint"},
+				Header:       "x-session-id",
+				Cookie:       "my-affinity",
+				CookieMaxAge: time.Hour,
+			},
+			Filter: FilterConfig{
+				BlockUserAgents: []string{"(?i)masscan"},
+				BlockPaths:      []string{"^/wp-admin"},
+				Challenge: ChallengeConfig{
+					URL:     "http://challenge:8080/verify",
+					Timeout: time.Second * 2,
+				},
+			},
+			Fingerprint: FingerprintConfig{
+				Enabled:         true,
+				MaxFingerprints: 500,
+			},
+			CustomDomains: CustomDomainsConfig{
+				Enabled:          true,
+				Path:             "/var/lib/piko/domains.json",
+				PendingExpiry:    time.Hour * 24,
+				CertCacheDir:     "/var/lib/piko/certs",
+				ACMEDirectoryURL: "https://acme-staging-v02.api.letsencrypt.org/directory",
+				ACMEEmail:        "ops@example.com",
+			},
+			Redirect: RedirectConfig{
+				BindAddr:     ":80",
+				HTTPSPort:    8443,
+				ExcludePaths: []string{"/.well-known/"},
+			},
+			HSTS: HSTSConfig{
+				MaxAge:            time.Hour * 8760,
+				IncludeSubdomains: true,
+				Preload:           true,
+				Endpoints:         []string{"my-endpoint"},
+				Domains:           []string{"*.example.com"},
+			},
+			Transfers: TransfersConfig{
+				ProgressInterval: time.Second * 10,
+				SlowThroughput:   4096,
+			},
+			Canary: CanaryConfig{
+				Window:            time.Minute,
+				MinRequests:       50,
+				MaxErrorRateDelta: 0.1,
+				MaxLatencyDelta:   time.Millisecond * 200,
+				Rollback:          true,
+			},
 			HTTP: HTTPConfig{
 				ReadTimeout:       time.Second * 5,
 				ReadHeaderTimeout: time.Second * 5,
@@ -280,13 +877,31 @@ func TestConfig_LoadFlags(t *testing.T) {
 				Issuer:         "my-issuer",
 			},
 			TLS: TLSConfig{
-				Cert: "/piko/cert.pem",
-				Key:  "/piko/key.pem",
+				Cert:           "/piko/cert.pem",
+				Key:            "/piko/key.pem",
+				ReloadInterval: time.Minute,
 			},
 		},
 		Upstream: UpstreamConfig{
-			BindAddr:      "10.15.104.25:8001",
-			AdvertiseAddr: "1.2.3.4:8001",
+			BindAddr:           "10.15.104.25:8001",
+			AdvertiseAddr:      "1.2.3.4:8001",
+			AllowCIDRs:         []string{"10.0.0.0/8", "192.168.1.10"},
+			SessionGracePeriod: time.Second * 5,
+			WriteCoalesceDelay: time.Millisecond,
+			MaxStreams:         100,
+			StreamQueueTimeout: time.Second * 2,
+			StreamWindow:       1048576,
+			MaxConns:           10000,
+			MaxEndpointConns:   100,
+			MaxNamespaceConns:  500,
+			LoadBalancing:      LoadBalancingLeastConnections,
+			RateLimit: UpstreamRateLimitConfig{
+				ConnectRate:       5,
+				ConnectBurst:      10,
+				ControlFrameRate:  2.5,
+				ControlFrameBurst: 5,
+				BanDuration:       time.Minute,
+			},
 			Auth: auth.Config{
 				HMACSecretKey:  "hmac-secret-key",
 				RSAPublicKey:   "rsa-public-key",
@@ -294,14 +909,21 @@ func TestConfig_LoadFlags(t *testing.T) {
 				Audience:       "my-audience",
 				Issuer:         "my-issuer",
 			},
+			AuthLockout: ratelimit.LockoutConfig{
+				MaxFailures:   5,
+				FailureWindow: time.Minute * 2,
+				Duration:      time.Second * 10,
+				MaxDuration:   time.Minute * 30,
+			},
 			TLS: TLSConfig{
 				Cert: "/piko/cert.pem",
 				Key:  "/piko/key.pem",
 			},
 		},
 		Admin: AdminConfig{
-			BindAddr:      "10.15.104.25:8002",
-			AdvertiseAddr: "1.2.3.4:8002",
+			BindAddr:       "10.15.104.25:8002",
+			AdvertiseAddr:  "1.2.3.4:8002",
+			ClientCertAuth: true,
 			Auth: auth.Config{
 				HMACSecretKey:  "hmac-secret-key",
 				RSAPublicKey:   "rsa-public-key",
@@ -310,8 +932,9 @@ func TestConfig_LoadFlags(t *testing.T) {
 				Issuer:         "my-issuer",
 			},
 			TLS: TLSConfig{
-				Cert: "/piko/cert.pem",
-				Key:  "/piko/key.pem",
+				Cert:      "/piko/cert.pem",
+				Key:       "/piko/key.pem",
+				ClientCAs: "/piko/ca.pem",
 			},
 		},
 		Cluster: ClusterConfig{
@@ -321,8 +944,9 @@ func TestConfig_LoadFlags(t *testing.T) {
 				"10.26.104.73:8003",
 				"10.26.104.28:8003",
 			},
-			JoinTimeout:      2 * time.Minute,
-			AbortIfJoinFails: true,
+			JoinTimeout:       2 * time.Minute,
+			AbortIfJoinFails:  true,
+			ForwardSigningKey: "forward-signing-key",
 			Gossip: gossip.Config{
 				BindAddr:      "10.15.104.25:8003",
 				AdvertiseAddr: "1.2.3.4:8003",
@@ -333,6 +957,47 @@ func TestConfig_LoadFlags(t *testing.T) {
 		Usage: UsageConfig{
 			Disable: true,
 		},
+		Admission: AdmissionConfig{
+			MaxHeapBytes:    1000,
+			ResumeHeapBytes: 900,
+			MaxFileRatio:    0.9,
+			ResumeFileRatio: 0.8,
+			CheckInterval:   time.Second * 2,
+			RetryAfter:      time.Second * 10,
+		},
+		Tenants: TenantsConfig{
+			Enabled:    true,
+			MaxTenants: 50,
+		},
+		Probes: ProbesConfig{
+			Endpoints: []string{"my-endpoint"},
+			Interval:  time.Second * 10,
+			Timeout:   time.Second * 2,
+		},
+		Events: EventsConfig{
+			Exporter:      "nats",
+			URL:           "nats://nats:4222",
+			Topic:         "my-events",
+			BatchSize:     50,
+			FlushInterval: time.Second * 2,
+			QueueSize:     500,
+			Timeout:       time.Second * 5,
+		},
+		GeoIP: GeoIPConfig{
+			Database:       "/etc/piko/GeoLite2-Country.mmdb",
+			ReloadInterval: time.Minute * 30,
+		},
+		Storage: StorageConfig{
+			Path:     "/var/lib/piko",
+			MaxSize:  1000000,
+			Eviction: "none",
+		},
+		Runtime: goruntime.Config{
+			GCPercent:        200,
+			MemoryLimit:      1000000000,
+			MemoryLimitRatio: 0.9,
+			MaxProcs:         4,
+		},
 		Log: log.Config{
 			Level: "info",
 			Subsystems: []string{
@@ -340,7 +1005,25 @@ func TestConfig_LoadFlags(t *testing.T) {
 				"bar",
 			},
 		},
-		GracePeriod: 2 * time.Minute,
+		HeaderPrefix: "x-tunnel-",
+		GracePeriod:  2 * time.Minute,
 	}
 	assert.Equal(t, expectedConf, loadedConf)
 }
+
+func TestUpstreamConfig_AllowPrefixes(t *testing.T) {
+	conf := UpstreamConfig{
+		AllowCIDRs: []string{"10.1.2.3/8", "192.168.1.10", "2001:db8::/32"},
+	}
+	prefixes, err := conf.AllowPrefixes()
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.10/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}, prefixes)
+
+	conf.AllowCIDRs = []string{"10.0.0.0/33"}
+	_, err = conf.AllowPrefixes()
+	assert.EqualError(t, err, "invalid cidr: 10.0.0.0/33")
+}
@@ -5,18 +5,47 @@ import (
 	"crypto/x509"
 	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/andydunstall/piko/pkg/log"
 )
 
 type TLSConfig struct {
 	Cert      string `json:"cert" yaml:"cert"`
 	Key       string `json:"key" yaml:"key"`
 	ClientCAs string `json:"client_cas" yaml:"client_cas"`
+
+	// ReloadInterval is the interval to check whether the certificate or
+	// key files have changed, and if so reload the certificate, so renewed
+	// certificates are used without restarting.
+	//
+	// Zero disables reloading.
+	ReloadInterval time.Duration `json:"reload_interval" yaml:"reload_interval"`
+
+	// Autocert obtains and renews certificates automatically using ACME,
+	// instead of loading the certificate from Cert and Key.
+	Autocert AutocertConfig `json:"autocert" yaml:"autocert"`
 }
 
 func (c *TLSConfig) Validate() error {
-	if !c.enabled() {
+	if !c.Enabled() {
+		return nil
+	}
+
+	if c.Autocert.Enabled() {
+		if c.Cert != "" || c.Key != "" {
+			return fmt.Errorf("cannot use both cert and autocert")
+		}
+		if err := c.Autocert.Validate(); err != nil {
+			return fmt.Errorf("autocert: %w", err)
+		}
 		return nil
 	}
 
@@ -26,6 +55,9 @@ func (c *TLSConfig) Validate() error {
 	if c.Key == "" {
 		return fmt.Errorf("missing key")
 	}
+	if c.ReloadInterval < 0 {
+		return fmt.Errorf("reload interval cannot be negative")
+	}
 	return nil
 }
 
@@ -58,19 +90,75 @@ verify the client certificates.
 
 When set the client must set a valid certificate during the TLS handshake.`,
 	)
+	fs.DurationVar(
+		&c.ReloadInterval,
+		prefix+"reload-interval",
+		c.ReloadInterval,
+		`
+Interval to check whether the certificate or key files have changed, and if
+so reload the certificate, so renewed certificates (such as from
+cert-manager) are used without restarting the server.
+
+Files are checked when a client connects, at most once per interval. If the
+changed files are invalid, such as a partially written certificate, the
+server keeps using the previous certificate and retries after the interval.
+
+Zero disables reloading.`,
+	)
+
+	c.Autocert.RegisterFlags(fs, prefix)
 }
 
-func (c *TLSConfig) Load() (*tls.Config, error) {
-	if !c.enabled() {
+// Load loads the TLS configuration, or returns nil if TLS is disabled.
+//
+// If reloading is enabled, the returned configuration reloads the certificate
+// when the certificate or key files change. If autocert is enabled, the
+// returned configuration has no Certificates and instead obtains
+// certificates using ACME.
+//
+// When reloading or autocert is enabled, GetClientCertificate returns the
+// same certificate as GetCertificate, so the node can present its current
+// certificate as a client certificate to other nodes.
+func (c *TLSConfig) Load(logger log.Logger) (*tls.Config, error) {
+	if !c.Enabled() {
 		return nil, nil
 	}
 
 	tlsConfig := &tls.Config{}
-	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
-	if err != nil {
-		return nil, fmt.Errorf("load key pair: %w", err)
+	if c.Autocert.Enabled() {
+		m := c.Autocert.Manager()
+		tlsConfig.GetCertificate = m.GetCertificate
+		domain := c.Autocert.Domains[0]
+		tlsConfig.GetClientCertificate = func(
+			info *tls.CertificateRequestInfo,
+		) (*tls.Certificate, error) {
+			return m.GetCertificate(&tls.ClientHelloInfo{
+				ServerName:       domain,
+				SignatureSchemes: info.SignatureSchemes,
+				// Prefer an ECDSA certificate if the server accepts ECDSA
+				// signatures.
+				CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			})
+		}
+		// Support the TLS-ALPN-01 challenge.
+		tlsConfig.NextProtos = []string{acme.ALPNProto}
+	} else {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load key pair: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.ReloadInterval > 0 && !c.Autocert.Enabled() {
+		reloader, err := newCertReloader(c.Cert, c.Key, c.ReloadInterval, logger)
+		if err != nil {
+			return nil, fmt.Errorf("load key pair: %w", err)
+		}
+		// GetCertificate takes precedence over Certificates.
+		tlsConfig.GetCertificate = reloader.GetCertificate
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
 	}
-	tlsConfig.Certificates = []tls.Certificate{cert}
 
 	if c.ClientCAs != "" {
 		caCert, err := os.ReadFile(c.ClientCAs)
@@ -89,6 +177,234 @@ func (c *TLSConfig) Load() (*tls.Config, error) {
 	return tlsConfig, nil
 }
 
-func (c *TLSConfig) enabled() bool {
-	return c.Cert != "" || c.Key != ""
+// Enabled returns whether TLS is enabled.
+func (c *TLSConfig) Enabled() bool {
+	return c.Cert != "" || c.Key != "" || c.Autocert.Enabled()
+}
+
+type AutocertConfig struct {
+	// Domains are the domains to obtain certificates for. Certificates are
+	// only obtained for these domains.
+	Domains []string `json:"domains" yaml:"domains"`
+
+	// CacheDir is the directory to cache obtained certificates and the
+	// ACME account key.
+	//
+	// If not given, certificates are obtained again when the server
+	// restarts, which may exceed the ACME providers rate limits.
+	CacheDir string `json:"cache_dir" yaml:"cache_dir"`
+
+	// DirectoryURL is the ACME directory URL of the certificate authority.
+	// Defaults to Let's Encrypt.
+	DirectoryURL string `json:"directory_url" yaml:"directory_url"`
+
+	// Email is the contact email of the ACME account.
+	Email string `json:"email" yaml:"email"`
+}
+
+// Enabled returns whether certificates are obtained using ACME.
+func (c *AutocertConfig) Enabled() bool {
+	return len(c.Domains) > 0
+}
+
+func (c *AutocertConfig) Validate() error {
+	for _, domain := range c.Domains {
+		if domain == "" {
+			return fmt.Errorf("empty domain")
+		}
+	}
+	return nil
+}
+
+func (c *AutocertConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix += "autocert."
+
+	fs.StringSliceVar(
+		&c.Domains,
+		prefix+"domains",
+		c.Domains,
+		`
+Domains to obtain TLS certificates for automatically using ACME, such as
+from Let's Encrypt. Certificates are renewed automatically before they
+expire.
+
+Certificates are obtained using the TLS-ALPN-01 challenge, so the listener
+must be reachable on port 443 for each domain.
+
+Cannot be used with a certificate and key file.`,
+	)
+	fs.StringVar(
+		&c.CacheDir,
+		prefix+"cache-dir",
+		c.CacheDir,
+		`
+Directory to cache obtained certificates.
+
+If not given, certificates are obtained again when the server restarts,
+which may exceed the certificate authorities rate limits.`,
+	)
+	fs.StringVar(
+		&c.DirectoryURL,
+		prefix+"directory-url",
+		c.DirectoryURL,
+		`
+ACME directory URL of the certificate authority.
+
+Defaults to Let's Encrypt.`,
+	)
+	fs.StringVar(
+		&c.Email,
+		prefix+"email",
+		c.Email,
+		`
+Contact email of the ACME account, used by the certificate authority to
+notify about problems with certificates.`,
+	)
+}
+
+// Manager returns a manager that obtains certificates for the configured
+// domains.
+//
+// Certificates are cached in the cache directory if configured.
+func (c *AutocertConfig) Manager() *autocert.Manager {
+	return c.ManagerWithCache(c.cache())
+}
+
+// ManagerWithCache returns a manager that obtains certificates for the
+// configured domains, and caches certificates in the given cache, such as
+// to share certificates among nodes. If the cache is nil, certificates
+// aren't cached.
+func (c *AutocertConfig) ManagerWithCache(cache autocert.Cache) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.Domains...),
+		Cache:      cache,
+		Email:      c.Email,
+	}
+	if c.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: c.DirectoryURL}
+	}
+	return m
+}
+
+func (c *AutocertConfig) cache() autocert.Cache {
+	if c.CacheDir == "" {
+		return nil
+	}
+	return autocert.DirCache(c.CacheDir)
+}
+
+// certReloader reloads a certificate when the certificate or key files
+// change.
+//
+// Rather than watching the files, the files are checked when a client
+// connects, at most once per interval, which also works when the files are
+// replaced by updating a symlink, such as a Kubernetes secret volume.
+type certReloader struct {
+	certPath string
+	keyPath  string
+	interval time.Duration
+
+	cert *atomic.Pointer[tls.Certificate]
+
+	// lastCheck is the time the files were last checked as a Unix timestamp
+	// in nanoseconds.
+	lastCheck *atomic.Int64
+
+	// mu is held while checking the files, so only one handshake checks the
+	// files and other handshakes continue with the current certificate.
+	// certModTime and keyModTime are protected by mu.
+	mu          sync.Mutex
+	certModTime time.Time
+	keyModTime  time.Time
+
+	logger log.Logger
+}
+
+func newCertReloader(
+	certPath string,
+	keyPath string,
+	interval time.Duration,
+	logger log.Logger,
+) (*certReloader, error) {
+	r := &certReloader{
+		certPath:  certPath,
+		keyPath:   keyPath,
+		interval:  interval,
+		cert:      &atomic.Pointer[tls.Certificate]{},
+		lastCheck: &atomic.Int64{},
+		logger:    logger.WithSubsystem("tls"),
+	}
+	r.lastCheck.Store(time.Now().UnixNano())
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	lastCheck := time.Unix(0, r.lastCheck.Load())
+	if time.Since(lastCheck) >= r.interval && r.mu.TryLock() {
+		r.lastCheck.Store(time.Now().UnixNano())
+		if err := r.reloadIfModified(); err != nil {
+			r.logger.Warn(
+				"failed to reload certificate; using previous certificate",
+				zap.String("cert", r.certPath),
+				zap.Error(err),
+			)
+		}
+		r.mu.Unlock()
+	}
+	return r.cert.Load(), nil
+}
+
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.GetCertificate(nil)
+}
+
+// reloadIfModified reloads the certificate if either file was modified since
+// the last reload. Must be called with mu held.
+func (r *certReloader) reloadIfModified() error {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return fmt.Errorf("stat cert: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return fmt.Errorf("stat key: %w", err)
+	}
+	if certInfo.ModTime().Equal(r.certModTime) && keyInfo.ModTime().Equal(r.keyModTime) {
+		return nil
+	}
+
+	if err := r.reload(); err != nil {
+		return err
+	}
+	r.logger.Info("reloaded certificate", zap.String("cert", r.certPath))
+	return nil
+}
+
+// reload loads the certificate. Must be called with mu held, or before the
+// reloader is used.
+func (r *certReloader) reload() error {
+	// Stat before loading, so if a file is modified while loading, it's
+	// reloaded again on the next check.
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return fmt.Errorf("stat cert: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return fmt.Errorf("stat key: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+
+	r.cert.Store(&cert)
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	return nil
 }
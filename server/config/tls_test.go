@@ -0,0 +1,120 @@
+package config
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/testutil"
+)
+
+func writeCert(t *testing.T, certPath string, keyPath string, modTime time.Time) tls.Certificate {
+	_, cert, err := testutil.LocalTLSServerCert()
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: cert.Certificate[0],
+	})
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(cert.PrivateKey.(*rsa.PrivateKey)),
+	})
+	require.NoError(t, os.WriteFile(certPath, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyPath, keyPEM, 0o600))
+	// Set the modification time explicitly, since the files may be written
+	// within the file system timestamp granularity.
+	require.NoError(t, os.Chtimes(certPath, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+	return cert
+}
+
+func TestTLSConfig_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	modTime := time.Now().Add(-time.Hour)
+	cert := writeCert(t, certPath, keyPath, modTime)
+
+	conf := TLSConfig{
+		Cert:           certPath,
+		Key:            keyPath,
+		ReloadInterval: time.Millisecond,
+	}
+	tlsConfig, err := conf.Load(log.NewNopLogger())
+	require.NoError(t, err)
+
+	loaded, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, cert.Certificate, loaded.Certificate)
+	loaded, err = tlsConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, cert.Certificate, loaded.Certificate)
+
+	// Renew the certificate.
+	modTime = modTime.Add(time.Minute)
+	renewed := writeCert(t, certPath, keyPath, modTime)
+	assert.Eventually(t, func() bool {
+		loaded, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+		require.NoError(t, err)
+		return assert.ObjectsAreEqual(renewed.Certificate, loaded.Certificate)
+	}, time.Second, time.Millisecond)
+	// The renewed certificate is also presented as a client certificate.
+	loaded, err = tlsConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, renewed.Certificate, loaded.Certificate)
+
+	// If the files are invalid, the previous certificate is still used.
+	require.NoError(t, os.WriteFile(certPath, []byte("invalid"), 0o600))
+	modTime = modTime.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certPath, modTime, modTime))
+	time.Sleep(time.Millisecond * 5)
+	loaded, err = tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, renewed.Certificate, loaded.Certificate)
+}
+
+func TestTLSConfig_Autocert(t *testing.T) {
+	t.Run("load", func(t *testing.T) {
+		conf := TLSConfig{
+			Autocert: AutocertConfig{
+				Domains:  []string{"example.com"},
+				CacheDir: t.TempDir(),
+			},
+		}
+		require.NoError(t, conf.Validate())
+		assert.True(t, conf.Enabled())
+
+		tlsConfig, err := conf.Load(log.NewNopLogger())
+		require.NoError(t, err)
+		assert.Empty(t, tlsConfig.Certificates)
+		assert.Contains(t, tlsConfig.NextProtos, acme.ALPNProto)
+
+		// Certificates are only obtained for the configured domains.
+		_, err = tlsConfig.GetCertificate(&tls.ClientHelloInfo{
+			ServerName: "other.com",
+		})
+		assert.ErrorContains(t, err, "not configured in HostWhitelist")
+	})
+
+	t.Run("cert and autocert", func(t *testing.T) {
+		conf := TLSConfig{
+			Cert: "/piko/cert.pem",
+			Key:  "/piko/key.pem",
+			Autocert: AutocertConfig{
+				Domains: []string{"example.com"},
+			},
+		}
+		assert.EqualError(t, conf.Validate(), "cannot use both cert and autocert")
+	})
+}
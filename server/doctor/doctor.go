@@ -0,0 +1,363 @@
+package doctor
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/andydunstall/piko/pkg/doctor"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+)
+
+const (
+	// minFileLimit is the file descriptor limit below which the server
+	// will likely fail under load.
+	minFileLimit = 1024
+
+	// recommendedFileLimit is the recommended minimum file descriptor
+	// limit, given each proxy client connection, upstream connection and
+	// connection to the upstream services uses a file descriptor.
+	recommendedFileLimit = 65536
+
+	// certExpiryWarning is how long before a certificate expires to warn.
+	certExpiryWarning = 7 * 24 * time.Hour
+)
+
+// Doctor runs preflight checks of the server configuration and environment
+// before the server starts, so misconfigurations fail fast with clear
+// messages rather than once the server is running.
+type Doctor struct {
+	conf *config.Config
+
+	// timeout is the timeout of each check.
+	timeout time.Duration
+}
+
+func NewDoctor(conf *config.Config, timeout time.Duration) *Doctor {
+	return &Doctor{
+		conf:    conf,
+		timeout: timeout,
+	}
+}
+
+// Run runs all checks and returns their results.
+//
+// If the configuration is invalid, the remaining checks are skipped.
+func (d *Doctor) Run(ctx context.Context) []doctor.Result {
+	if err := d.conf.Validate(); err != nil {
+		return []doctor.Result{{
+			Check:   "config",
+			Status:  doctor.StatusFail,
+			Message: err.Error(),
+			Hint:    "Fix the configuration, either in the '--config.path' file or the command line flags.",
+		}}
+	}
+
+	results := []doctor.Result{{
+		Check:   "config",
+		Status:  doctor.StatusOK,
+		Message: "configuration is valid",
+	}}
+	results = append(results, d.checkTLS("proxy", d.conf.Proxy.TLS))
+	results = append(results, d.checkTLS("upstream", d.conf.Upstream.TLS))
+	results = append(results, d.checkTLS("admin", d.conf.Admin.TLS))
+	results = append(results, checkFileLimit())
+	results = append(results, d.checkPorts()...)
+	results = append(results, d.checkPeers(ctx)...)
+	return results
+}
+
+// checkTLS checks the certificate and key of the named listener are a
+// valid pair and the certificate hasn't expired.
+func (d *Doctor) checkTLS(name string, conf config.TLSConfig) doctor.Result {
+	check := "tls " + name
+	tlsConfig, err := conf.Load(log.NewNopLogger())
+	if err != nil {
+		return doctor.Result{
+			Check:   check,
+			Status:  doctor.StatusFail,
+			Message: err.Error(),
+			Hint:    fmt.Sprintf("Check '--%s.tls.cert' and '--%s.tls.key' exist, are PEM encoded, and the key matches the certificate.", name, name),
+		}
+	}
+	if tlsConfig == nil {
+		return doctor.Result{
+			Check:   check,
+			Status:  doctor.StatusSkip,
+			Message: "tls disabled",
+		}
+	}
+
+	if len(tlsConfig.Certificates) == 0 {
+		return doctor.Result{
+			Check:   check,
+			Status:  doctor.StatusSkip,
+			Message: "certificates obtained with acme",
+		}
+	}
+
+	cert := tlsConfig.Certificates[0]
+	leaf := cert.Leaf
+	if leaf == nil {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return doctor.Result{
+				Check:   check,
+				Status:  doctor.StatusFail,
+				Message: fmt.Sprintf("parse certificate: %s", err.Error()),
+			}
+		}
+	}
+
+	message := fmt.Sprintf(
+		"certificate for %s expires %s",
+		strings.Join(certNames(leaf), ", "),
+		leaf.NotAfter.UTC().Format(time.RFC3339),
+	)
+	until := time.Until(leaf.NotAfter)
+	switch {
+	case until <= 0:
+		return doctor.Result{
+			Check:   check,
+			Status:  doctor.StatusFail,
+			Message: message,
+			Hint:    "The certificate has expired, so clients will reject connections. Renew the certificate.",
+		}
+	case until < certExpiryWarning:
+		return doctor.Result{
+			Check:   check,
+			Status:  doctor.StatusWarn,
+			Message: message,
+			Hint:    "The certificate expires soon, so check it will be renewed.",
+		}
+	default:
+		return doctor.Result{
+			Check:   check,
+			Status:  doctor.StatusOK,
+			Message: message,
+		}
+	}
+}
+
+func checkFileLimit() doctor.Result {
+	limit, ok := fileLimit()
+	if !ok {
+		return doctor.Result{
+			Check:   "file limit",
+			Status:  doctor.StatusSkip,
+			Message: "file descriptor limit not supported on this platform",
+		}
+	}
+
+	message := fmt.Sprintf("file descriptor limit is %d", limit)
+	hint := fmt.Sprintf(
+		"Each connection uses a file descriptor, so raise the hard limit to at least %d, such as with 'ulimit -Hn' or 'LimitNOFILE' in a systemd unit.",
+		recommendedFileLimit,
+	)
+	switch {
+	case limit < minFileLimit:
+		return doctor.Result{
+			Check:   "file limit",
+			Status:  doctor.StatusFail,
+			Message: message,
+			Hint:    hint,
+		}
+	case limit < recommendedFileLimit:
+		return doctor.Result{
+			Check:   "file limit",
+			Status:  doctor.StatusWarn,
+			Message: message,
+			Hint:    hint,
+		}
+	default:
+		return doctor.Result{
+			Check:   "file limit",
+			Status:  doctor.StatusOK,
+			Message: message,
+		}
+	}
+}
+
+// checkPorts checks each bind address is available, by binding then
+// closing the address.
+func (d *Doctor) checkPorts() []doctor.Result {
+	addrs := []struct {
+		name    string
+		flag    string
+		network string
+		addr    string
+	}{
+		{"proxy", "--proxy.bind-addr", "tcp", d.conf.Proxy.BindAddr},
+		{"upstream", "--upstream.bind-addr", "tcp", d.conf.Upstream.BindAddr},
+		{"admin", "--admin.bind-addr", "tcp", d.conf.Admin.BindAddr},
+		{"gossip", "--cluster.gossip.bind-addr", "tcp", d.conf.Cluster.Gossip.BindAddr},
+		{"gossip", "--cluster.gossip.bind-addr", "udp", d.conf.Cluster.Gossip.BindAddr},
+	}
+
+	var results []doctor.Result
+	for _, addr := range addrs {
+		check := fmt.Sprintf("port %s (%s)", addr.name, addr.network)
+
+		var err error
+		if addr.network == "udp" {
+			var ln net.PacketConn
+			ln, err = net.ListenPacket(addr.network, addr.addr)
+			if err == nil {
+				ln.Close()
+			}
+		} else {
+			var ln net.Listener
+			ln, err = net.Listen(addr.network, addr.addr)
+			if err == nil {
+				ln.Close()
+			}
+		}
+
+		if err != nil {
+			result := doctor.Result{
+				Check:   check,
+				Status:  doctor.StatusFail,
+				Message: fmt.Sprintf("bind %s: %s", addr.addr, err.Error()),
+				Hint:    fmt.Sprintf("Check '%s' is a valid address on this host.", addr.flag),
+			}
+			if errors.Is(err, syscall.EADDRINUSE) {
+				result.Hint = fmt.Sprintf(
+					"Another process, such as a running Piko server, is using the port. Stop the process or configure a different port with '%s'.",
+					addr.flag,
+				)
+			} else if errors.Is(err, syscall.EACCES) {
+				result.Hint = "Binding ports below 1024 requires elevated privileges, such as the 'CAP_NET_BIND_SERVICE' capability."
+			}
+			results = append(results, result)
+			continue
+		}
+
+		results = append(results, doctor.Result{
+			Check:   check,
+			Status:  doctor.StatusOK,
+			Message: fmt.Sprintf("%s available", addr.addr),
+		})
+	}
+	return results
+}
+
+// checkPeers checks the node can connect to the gossip port of each member
+// in '--cluster.join'.
+//
+// If no members are reachable, the check only fails if the node aborts when
+// it fails to join, since the first nodes of a new cluster may not be able
+// to reach each other until they've all started.
+func (d *Doctor) checkPeers(ctx context.Context) []doctor.Result {
+	if len(d.conf.Cluster.Join) == 0 {
+		return []doctor.Result{{
+			Check:   "cluster",
+			Status:  doctor.StatusSkip,
+			Message: "no cluster members to join",
+		}}
+	}
+
+	_, bindPort, err := net.SplitHostPort(d.conf.Cluster.Gossip.BindAddr)
+	if err != nil {
+		// Already validated.
+		panic("invalid gossip bind addr: " + d.conf.Cluster.Gossip.BindAddr)
+	}
+
+	var results []doctor.Result
+	reachable := 0
+	for _, join := range d.conf.Cluster.Join {
+		addr := join
+		// Use the gossip bind port if not given, which matches joining the
+		// cluster.
+		if !strings.Contains(addr, ":") {
+			addr = net.JoinHostPort(addr, bindPort)
+		}
+		check := "cluster " + addr
+
+		resolved, err := d.resolve(ctx, addr)
+		if err != nil {
+			results = append(results, doctor.Result{
+				Check:   check,
+				Status:  doctor.StatusWarn,
+				Message: fmt.Sprintf("resolve: %s", err.Error()),
+				Hint:    "Check the address in '--cluster.join' resolves to the cluster members.",
+			})
+			continue
+		}
+
+		for _, peer := range resolved {
+			if err := d.dial(ctx, peer); err != nil {
+				results = append(results, doctor.Result{
+					Check:   check,
+					Status:  doctor.StatusWarn,
+					Message: fmt.Sprintf("connect %s: %s", peer, err.Error()),
+					Hint:    "Check the member is running and no firewall blocks the gossip port (both TCP and UDP) between nodes.",
+				})
+				continue
+			}
+			reachable++
+			results = append(results, doctor.Result{
+				Check:   check,
+				Status:  doctor.StatusOK,
+				Message: fmt.Sprintf("connected to %s", peer),
+			})
+		}
+	}
+
+	if reachable == 0 && d.conf.Cluster.AbortIfJoinFails {
+		results = append(results, doctor.Result{
+			Check:   "cluster",
+			Status:  doctor.StatusFail,
+			Message: "no cluster members reachable",
+			Hint:    "The node will fail to start since it can't join the cluster. If this is the first node of a new cluster, start the other members or disable '--cluster.abort-if-join-fails'.",
+		})
+	}
+	return results
+}
+
+func (d *Doctor) resolve(ctx context.Context, addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	hosts, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, h := range hosts {
+		addrs = append(addrs, net.JoinHostPort(h, port))
+	}
+	return addrs, nil
+}
+
+func (d *Doctor) dial(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func certNames(cert *x509.Certificate) []string {
+	if len(cert.DNSNames) != 0 {
+		return cert.DNSNames
+	}
+	return []string{cert.Subject.CommonName}
+}
@@ -0,0 +1,134 @@
+package doctor
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/doctor"
+	"github.com/andydunstall/piko/pkg/testutil"
+	"github.com/andydunstall/piko/server/config"
+)
+
+func testConfig() *config.Config {
+	conf := config.Default()
+	conf.Cluster.NodeID = "my-node"
+	conf.Proxy.BindAddr = "127.0.0.1:0"
+	conf.Upstream.BindAddr = "127.0.0.1:0"
+	conf.Admin.BindAddr = "127.0.0.1:0"
+	conf.Cluster.Gossip.BindAddr = "127.0.0.1:0"
+	return conf
+}
+
+func results(conf *config.Config) map[string]doctor.Result {
+	d := NewDoctor(conf, time.Second)
+	m := make(map[string]doctor.Result)
+	for _, result := range d.Run(context.Background()) {
+		m[result.Check] = result
+	}
+	return m
+}
+
+func writeCert(t *testing.T) (string, string) {
+	_, cert, err := testutil.LocalTLSServerCert()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert.Certificate[0],
+	}), 0o600))
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: key,
+	}), 0o600))
+	return certPath, keyPath
+}
+
+func TestDoctor(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		conf := testConfig()
+		conf.Proxy.TLS.Cert, conf.Proxy.TLS.Key = writeCert(t)
+
+		r := results(conf)
+		assert.Equal(t, doctor.StatusOK, r["config"].Status)
+		assert.Equal(t, doctor.StatusOK, r["tls proxy"].Status)
+		assert.Equal(t, doctor.StatusSkip, r["tls upstream"].Status)
+		assert.Equal(t, doctor.StatusOK, r["port proxy (tcp)"].Status)
+		assert.Equal(t, doctor.StatusOK, r["port gossip (udp)"].Status)
+		assert.Equal(t, doctor.StatusSkip, r["cluster"].Status)
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		conf := testConfig()
+		conf.GracePeriod = 0
+
+		r := results(conf)
+		assert.Len(t, r, 1)
+		assert.Equal(t, doctor.StatusFail, r["config"].Status)
+		assert.Equal(t, "missing grace period", r["config"].Message)
+	})
+
+	t.Run("invalid key pair", func(t *testing.T) {
+		conf := testConfig()
+		certPath, _ := writeCert(t)
+		_, keyPath := writeCert(t)
+		conf.Upstream.TLS.Cert = certPath
+		conf.Upstream.TLS.Key = keyPath
+
+		r := results(conf)
+		assert.Equal(t, doctor.StatusFail, r["tls upstream"].Status)
+	})
+
+	t.Run("port in use", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		conf := testConfig()
+		conf.Admin.BindAddr = ln.Addr().String()
+
+		r := results(conf)
+		assert.Equal(t, doctor.StatusFail, r["port admin (tcp)"].Status)
+		assert.Contains(t, r["port admin (tcp)"].Hint, "Another process")
+		assert.Equal(t, doctor.StatusOK, r["port proxy (tcp)"].Status)
+	})
+
+	t.Run("peers", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		unreachableLn, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		unreachable := unreachableLn.Addr().String()
+		unreachableLn.Close()
+
+		conf := testConfig()
+		conf.Cluster.Join = []string{ln.Addr().String(), unreachable}
+
+		r := results(conf)
+		assert.Equal(t, doctor.StatusOK, r["cluster "+ln.Addr().String()].Status)
+		assert.Equal(t, doctor.StatusWarn, r["cluster "+unreachable].Status)
+		// At least one member is reachable.
+		_, ok := r["cluster"]
+		assert.False(t, ok)
+
+		conf.Cluster.Join = []string{unreachable}
+		r = results(conf)
+		assert.Equal(t, doctor.StatusFail, r["cluster"].Status)
+	})
+}
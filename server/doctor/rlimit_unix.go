@@ -0,0 +1,17 @@
+//go:build unix
+
+package doctor
+
+import "syscall"
+
+// fileLimit returns the file descriptor limit of the process.
+//
+// Go raises the soft limit to the hard limit on startup, so the soft limit
+// of this process is the limit the server will run with.
+func fileLimit() (uint64, bool) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, false
+	}
+	return uint64(limit.Cur), true
+}
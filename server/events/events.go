@@ -0,0 +1,311 @@
+// Package events exports request summaries and endpoint lifecycle events to
+// an event bus (NATS or Kafka), for downstream analytics pipelines.
+package events
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+)
+
+type EventType string
+
+const (
+	// EventTypeRequest is a summary of a proxied request.
+	EventTypeRequest EventType = "request"
+	// EventTypeEndpointRegistered is published when the first upstream for
+	// an endpoint connects to the node.
+	EventTypeEndpointRegistered EventType = "endpoint_registered"
+	// EventTypeEndpointUnregistered is published when the last upstream for
+	// an endpoint disconnects from the node.
+	EventTypeEndpointUnregistered EventType = "endpoint_unregistered"
+	// EventTypeTransferProgress is published periodically for long
+	// response transfers.
+	EventTypeTransferProgress EventType = "transfer_progress"
+	// EventTypeSessionClosed is a summary of an upstream connection,
+	// published when the connection closes.
+	EventTypeSessionClosed EventType = "session_closed"
+)
+
+// Event is a single event published to the event bus, encoded as JSON.
+type Event struct {
+	Type       EventType `json:"type"`
+	Time       time.Time `json:"time"`
+	NodeID     string    `json:"node_id"`
+	EndpointID string    `json:"endpoint_id"`
+
+	// Listeners is the number of upstreams connected to the node for the
+	// endpoint. Only set for endpoint events.
+	Listeners int `json:"listeners,omitempty"`
+
+	// Request is set for request events.
+	Request *Request `json:"request,omitempty"`
+
+	// Transfer is set for transfer progress events.
+	Transfer *Transfer `json:"transfer,omitempty"`
+
+	// Session is set for session closed events.
+	Session *Session `json:"session,omitempty"`
+}
+
+// Request is a summary of a proxied request.
+type Request struct {
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Status   int    `json:"status"`
+	Duration int64  `json:"duration_ms"`
+	// BytesWritten is the number of response body bytes written.
+	BytesWritten int    `json:"bytes_written"`
+	ClientIP     string `json:"client_ip"`
+	Tenant       string `json:"tenant,omitempty"`
+	Country      string `json:"country,omitempty"`
+	// Forwarded indicates the request was forwarded from another node, so
+	// the forwarding node also publishes a summary of the request.
+	Forwarded bool `json:"forwarded,omitempty"`
+}
+
+// Transfer is the progress of an in-flight response transfer.
+type Transfer struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// BytesWritten is the number of response body bytes written so far.
+	BytesWritten int64 `json:"bytes_written"`
+	// Elapsed is the time since the first response byte was written.
+	Elapsed int64 `json:"elapsed_ms"`
+	// Throughput is the throughput since the last progress event in bytes
+	// per second.
+	Throughput int64 `json:"throughput"`
+	// Slow indicates the throughput is below the configured threshold.
+	Slow bool `json:"slow,omitempty"`
+}
+
+// Session is a summary of an upstream connection.
+type Session struct {
+	RemoteAddr string `json:"remote_addr"`
+	Duration   int64  `json:"duration_ms"`
+	// StreamsServed is the number of streams opened to the upstream.
+	StreamsServed uint64 `json:"streams_served"`
+	// BytesSent is the number of bytes sent to the upstream.
+	BytesSent uint64 `json:"bytes_sent"`
+	// BytesReceived is the number of bytes received from the upstream.
+	BytesReceived uint64 `json:"bytes_received"`
+	// Reason is the reason the connection closed, such as 'drained'.
+	Reason string `json:"reason"`
+	// CloseCode is the WebSocket close code of the reason.
+	CloseCode int    `json:"close_code"`
+	Error     string `json:"error,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+}
+
+// Publisher publishes batches of events to an event bus.
+//
+// Publish must not retain the batch after returning.
+type Publisher interface {
+	Publish(ctx context.Context, events []*Event) error
+	Close() error
+}
+
+// NewPublisher creates a publisher for the configured event bus.
+func NewPublisher(conf config.EventsConfig) (Publisher, error) {
+	switch conf.Exporter {
+	case "nats":
+		return NewNATSPublisher(conf.URL, conf.Topic)
+	case "kafka":
+		return NewKafkaPublisher(conf.URL, conf.Topic)
+	default:
+		return nil, fmt.Errorf("unsupported exporter: %s", conf.Exporter)
+	}
+}
+
+// Exporter publishes events to the event bus in batches.
+//
+// Events are queued in memory and published once a batch fills or the flush
+// interval expires. If the queue is full, such as if the event bus is
+// unavailable, events are dropped rather than blocking requests. Failed
+// batches are dropped rather than retried, so the exporter provides
+// at-most-once delivery.
+type Exporter struct {
+	publisher Publisher
+
+	nodeID string
+
+	events chan *Event
+
+	batchSize     int
+	flushInterval time.Duration
+	timeout       time.Duration
+
+	// endpointListeners contains the last known number of listeners for each
+	// local endpoint.
+	endpointListeners map[string]int
+	mu                sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	metrics *Metrics
+
+	logger log.Logger
+}
+
+func NewExporter(
+	conf config.EventsConfig,
+	publisher Publisher,
+	nodeID string,
+	logger log.Logger,
+) *Exporter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Exporter{
+		publisher:         publisher,
+		nodeID:            nodeID,
+		events:            make(chan *Event, conf.QueueSize),
+		batchSize:         conf.BatchSize,
+		flushInterval:     conf.FlushInterval,
+		timeout:           conf.Timeout,
+		endpointListeners: make(map[string]int),
+		ctx:               ctx,
+		cancel:            cancel,
+		done:              make(chan struct{}),
+		metrics:           NewMetrics(),
+		logger:            logger.WithSubsystem("events"),
+	}
+}
+
+// Publish queues the event to be published. If the queue is full the event is
+// dropped.
+func (e *Exporter) Publish(event *Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.NodeID = e.nodeID
+
+	select {
+	case e.events <- event:
+	default:
+		e.metrics.EventsDropped.Inc()
+	}
+}
+
+// WatchLocalEndpoints publishes endpoint lifecycle events when upstreams for
+// an endpoint connect to or disconnect from the local node.
+func (e *Exporter) WatchLocalEndpoints(state *cluster.State) {
+	state.OnLocalEndpointUpdate(func(endpointID string) {
+		listeners := state.LocalEndpointListeners(endpointID)
+
+		e.mu.Lock()
+		prev := e.endpointListeners[endpointID]
+		if listeners == 0 {
+			delete(e.endpointListeners, endpointID)
+		} else {
+			e.endpointListeners[endpointID] = listeners
+		}
+		e.mu.Unlock()
+
+		var eventType EventType
+		switch {
+		case prev == 0 && listeners > 0:
+			eventType = EventTypeEndpointRegistered
+		case prev > 0 && listeners == 0:
+			eventType = EventTypeEndpointUnregistered
+		default:
+			return
+		}
+		e.Publish(&Event{
+			Type:       eventType,
+			EndpointID: endpointID,
+			Listeners:  listeners,
+		})
+	})
+}
+
+// Start publishes queued events until the exporter is stopped.
+func (e *Exporter) Start() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Event, 0, e.batchSize)
+	for {
+		select {
+		case event := <-e.events:
+			batch = append(batch, event)
+			if len(batch) < e.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-e.ctx.Done():
+			e.flush(batch)
+			return
+		}
+
+		e.publish(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush publishes the batch and any remaining queued events.
+func (e *Exporter) flush(batch []*Event) {
+	for {
+		select {
+		case event := <-e.events:
+			batch = append(batch, event)
+			if len(batch) == e.batchSize {
+				e.publish(batch)
+				batch = batch[:0]
+			}
+		default:
+			if len(batch) > 0 {
+				e.publish(batch)
+			}
+			return
+		}
+	}
+}
+
+// Stop flushes queued events and closes the publisher.
+func (e *Exporter) Stop() {
+	e.cancel()
+	<-e.done
+
+	if err := e.publisher.Close(); err != nil {
+		e.logger.Warn("failed to close publisher", zap.Error(err))
+	}
+}
+
+func (e *Exporter) Metrics() *Metrics {
+	return e.metrics
+}
+
+func (e *Exporter) publish(batch []*Event) {
+	// Use a background context so the final flush isn't cancelled on
+	// shutdown.
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := e.publisher.Publish(ctx, batch)
+	e.metrics.PublishLatency.Observe(time.Since(start).Seconds())
+	if err != nil {
+		e.logger.Warn(
+			"failed to publish events",
+			zap.Int("events", len(batch)),
+			zap.Error(err),
+		)
+		e.metrics.PublishFailures.Inc()
+		e.metrics.EventsFailed.Add(float64(len(batch)))
+		return
+	}
+	e.metrics.EventsPublished.Add(float64(len(batch)))
+}
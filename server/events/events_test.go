@@ -0,0 +1,169 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+)
+
+type fakePublisher struct {
+	batches chan []*Event
+	err     error
+
+	closed bool
+	mu     sync.Mutex
+}
+
+func newFakePublisher() *fakePublisher {
+	return &fakePublisher{
+		batches: make(chan []*Event, 100),
+	}
+}
+
+func (p *fakePublisher) Publish(_ context.Context, events []*Event) error {
+	batch := make([]*Event, len(events))
+	copy(batch, events)
+	p.batches <- batch
+	return p.err
+}
+
+func (p *fakePublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	return nil
+}
+
+func testEventsConfig() config.EventsConfig {
+	conf := config.Default().Events
+	conf.Exporter = "nats"
+	conf.URL = "nats://localhost:4222"
+	return conf
+}
+
+func TestExporter(t *testing.T) {
+	t.Run("batch size", func(t *testing.T) {
+		publisher := newFakePublisher()
+		conf := testEventsConfig()
+		conf.BatchSize = 3
+		conf.FlushInterval = time.Hour
+		exporter := NewExporter(conf, publisher, "my-node", log.NewNopLogger())
+		go exporter.Start()
+		defer exporter.Stop()
+
+		for i := 0; i != 3; i++ {
+			exporter.Publish(&Event{
+				Type:       EventTypeRequest,
+				EndpointID: fmt.Sprintf("endpoint-%d", i),
+			})
+		}
+
+		batch := <-publisher.batches
+		require.Len(t, batch, 3)
+		for i, event := range batch {
+			assert.Equal(t, fmt.Sprintf("endpoint-%d", i), event.EndpointID)
+			assert.Equal(t, "my-node", event.NodeID)
+			assert.False(t, event.Time.IsZero())
+		}
+	})
+
+	t.Run("flush interval", func(t *testing.T) {
+		publisher := newFakePublisher()
+		conf := testEventsConfig()
+		conf.FlushInterval = time.Millisecond * 10
+		exporter := NewExporter(conf, publisher, "my-node", log.NewNopLogger())
+		go exporter.Start()
+		defer exporter.Stop()
+
+		exporter.Publish(&Event{Type: EventTypeRequest})
+
+		batch := <-publisher.batches
+		assert.Len(t, batch, 1)
+	})
+
+	t.Run("flush on stop", func(t *testing.T) {
+		publisher := newFakePublisher()
+		conf := testEventsConfig()
+		conf.FlushInterval = time.Hour
+		exporter := NewExporter(conf, publisher, "my-node", log.NewNopLogger())
+		go exporter.Start()
+
+		exporter.Publish(&Event{Type: EventTypeRequest})
+		exporter.Publish(&Event{Type: EventTypeRequest})
+		exporter.Stop()
+
+		batch := <-publisher.batches
+		assert.Len(t, batch, 2)
+		assert.True(t, publisher.closed)
+	})
+
+	t.Run("queue full", func(t *testing.T) {
+		publisher := newFakePublisher()
+		conf := testEventsConfig()
+		conf.QueueSize = 2
+		// Don't start the exporter so the queue fills.
+		exporter := NewExporter(conf, publisher, "my-node", log.NewNopLogger())
+
+		for i := 0; i != 5; i++ {
+			exporter.Publish(&Event{Type: EventTypeRequest})
+		}
+		assert.Equal(t, 3.0, testutil.ToFloat64(exporter.Metrics().EventsDropped))
+	})
+
+	t.Run("publish failure", func(t *testing.T) {
+		publisher := newFakePublisher()
+		publisher.err = fmt.Errorf("unavailable")
+		conf := testEventsConfig()
+		conf.BatchSize = 2
+		exporter := NewExporter(conf, publisher, "my-node", log.NewNopLogger())
+		go exporter.Start()
+
+		exporter.Publish(&Event{Type: EventTypeRequest})
+		exporter.Publish(&Event{Type: EventTypeRequest})
+		<-publisher.batches
+		exporter.Stop()
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(exporter.Metrics().PublishFailures))
+		assert.Equal(t, 2.0, testutil.ToFloat64(exporter.Metrics().EventsFailed))
+		assert.Equal(t, 0.0, testutil.ToFloat64(exporter.Metrics().EventsPublished))
+	})
+
+	t.Run("endpoint lifecycle", func(t *testing.T) {
+		publisher := newFakePublisher()
+		conf := testEventsConfig()
+		conf.BatchSize = 1
+		exporter := NewExporter(conf, publisher, "my-node", log.NewNopLogger())
+		go exporter.Start()
+		defer exporter.Stop()
+
+		state := cluster.NewState(&cluster.Node{ID: "my-node"}, log.NewNopLogger())
+		exporter.WatchLocalEndpoints(state)
+
+		state.AddLocalEndpoint("my-endpoint")
+		batch := <-publisher.batches
+		assert.Equal(t, EventTypeEndpointRegistered, batch[0].Type)
+		assert.Equal(t, "my-endpoint", batch[0].EndpointID)
+		assert.Equal(t, 1, batch[0].Listeners)
+
+		// Adding and removing other listeners doesn't publish events.
+		state.AddLocalEndpoint("my-endpoint")
+		state.RemoveLocalEndpoint("my-endpoint")
+
+		state.RemoveLocalEndpoint("my-endpoint")
+		batch = <-publisher.batches
+		assert.Equal(t, EventTypeEndpointUnregistered, batch[0].Type)
+		assert.Equal(t, "my-endpoint", batch[0].EndpointID)
+		assert.Equal(t, 0, batch[0].Listeners)
+	})
+}
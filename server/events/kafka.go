@@ -0,0 +1,115 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// KafkaPublisher publishes events to a Kafka topic using the Kafka REST Proxy
+// v2 API (supported by the Confluent REST Proxy and Redpanda HTTP Proxy).
+//
+// Each batch is produced with a single request, where each event is a
+// separate JSON record.
+type KafkaPublisher struct {
+	url    string
+	client *http.Client
+}
+
+// NewKafkaPublisher creates a publisher to the Kafka REST proxy at the given
+// URL, such as 'http://localhost:8082'.
+func NewKafkaPublisher(rawURL string, topic string) (*KafkaPublisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported url scheme: %s", u.Scheme)
+	}
+	if topic == "" {
+		return nil, fmt.Errorf("missing topic")
+	}
+	return &KafkaPublisher{
+		url: strings.TrimSuffix(u.String(), "/") +
+			"/topics/" + url.PathEscape(topic),
+		client: &http.Client{},
+	}, nil
+}
+
+type kafkaRecord struct {
+	Value *Event `json:"value"`
+}
+
+type kafkaProduceRequest struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaProduceResponse struct {
+	Offsets []struct {
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+func (p *KafkaPublisher) Publish(ctx context.Context, events []*Event) error {
+	produce := kafkaProduceRequest{
+		Records: make([]kafkaRecord, 0, len(events)),
+	}
+	for _, event := range events {
+		produce.Records = append(produce.Records, kafkaRecord{Value: event})
+	}
+	body, err := json.Marshal(produce)
+	if err != nil {
+		return fmt.Errorf("encode records: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, p.url, bytes.NewReader(body),
+	)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("bad status: %d: %s", resp.StatusCode, b)
+	}
+
+	// The response may succeed even if individual records failed.
+	var produceResp kafkaProduceResponse
+	if err := json.NewDecoder(resp.Body).Decode(&produceResp); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	var failed int
+	var lastErr string
+	for _, offset := range produceResp.Offsets {
+		if offset.ErrorCode != nil {
+			failed++
+			lastErr = offset.Error
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d records failed: %s", failed, lastErr)
+	}
+	return nil
+}
+
+func (p *KafkaPublisher) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
+
+var _ Publisher = &KafkaPublisher{}
@@ -0,0 +1,81 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKafkaPublisher(t *testing.T) {
+	t.Run("publish", func(t *testing.T) {
+		var produce struct {
+			Records []struct {
+				Value Event `json:"value"`
+			} `json:"records"`
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, http.MethodPost, r.Method)
+			assert.Equal(t, "/topics/piko.events", r.URL.Path)
+			assert.Equal(t, "application/vnd.kafka.json.v2+json", r.Header.Get("Content-Type"))
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&produce))
+
+			w.Header().Set("Content-Type", "application/vnd.kafka.v2+json")
+			_, _ = w.Write([]byte(`{"offsets":[{"partition":0,"offset":1},{"partition":0,"offset":2}]}`))
+		}))
+		defer server.Close()
+
+		publisher, err := NewKafkaPublisher(server.URL, "piko.events")
+		require.NoError(t, err)
+		defer publisher.Close()
+
+		require.NoError(t, publisher.Publish(context.Background(), []*Event{
+			{Type: EventTypeRequest, EndpointID: "endpoint-1"},
+			{Type: EventTypeEndpointRegistered, EndpointID: "endpoint-2"},
+		}))
+
+		require.Len(t, produce.Records, 2)
+		assert.Equal(t, EventTypeRequest, produce.Records[0].Value.Type)
+		assert.Equal(t, "endpoint-1", produce.Records[0].Value.EndpointID)
+		assert.Equal(t, EventTypeEndpointRegistered, produce.Records[1].Value.Type)
+		assert.Equal(t, "endpoint-2", produce.Records[1].Value.EndpointID)
+	})
+
+	t.Run("record error", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte(`{"offsets":[{"partition":0,"offset":1},{"error_code":50003,"error":"leader not available"}]}`))
+		}))
+		defer server.Close()
+
+		publisher, err := NewKafkaPublisher(server.URL, "piko.events")
+		require.NoError(t, err)
+		defer publisher.Close()
+
+		err = publisher.Publish(context.Background(), []*Event{
+			{Type: EventTypeRequest},
+			{Type: EventTypeRequest},
+		})
+		assert.ErrorContains(t, err, "1 records failed: leader not available")
+	})
+
+	t.Run("bad status", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error_code":40401,"message":"Topic not found"}`))
+		}))
+		defer server.Close()
+
+		publisher, err := NewKafkaPublisher(server.URL, "piko.events")
+		require.NoError(t, err)
+		defer publisher.Close()
+
+		err = publisher.Publish(context.Background(), []*Event{
+			{Type: EventTypeRequest},
+		})
+		assert.ErrorContains(t, err, "bad status: 404")
+	})
+}
@@ -0,0 +1,77 @@
+package events
+
+import "github.com/prometheus/client_golang/prometheus"
+
+type Metrics struct {
+	// EventsPublished is the number of events published to the event bus.
+	EventsPublished prometheus.Counter
+
+	// EventsFailed is the number of events in batches that failed to
+	// publish.
+	EventsFailed prometheus.Counter
+
+	// EventsDropped is the number of events dropped as the queue was full.
+	EventsDropped prometheus.Counter
+
+	// PublishFailures is the number of batches that failed to publish.
+	PublishFailures prometheus.Counter
+
+	// PublishLatency is the duration to publish a batch of events.
+	PublishLatency prometheus.Histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		EventsPublished: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "events",
+				Name:      "published_total",
+				Help:      "Number of events published to the event bus",
+			},
+		),
+		EventsFailed: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "events",
+				Name:      "failed_total",
+				Help:      "Number of events in batches that failed to publish",
+			},
+		),
+		EventsDropped: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "events",
+				Name:      "dropped_total",
+				Help:      "Number of events dropped as the queue was full",
+			},
+		),
+		PublishFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "events",
+				Name:      "publish_failures_total",
+				Help:      "Number of event batches that failed to publish",
+			},
+		),
+		PublishLatency: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "piko",
+				Subsystem: "events",
+				Name:      "publish_latency_seconds",
+				Help:      "Duration to publish a batch of events",
+				Buckets:   prometheus.DefBuckets,
+			},
+		),
+	}
+}
+
+func (m *Metrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.EventsPublished,
+		m.EventsFailed,
+		m.EventsDropped,
+		m.PublishFailures,
+		m.PublishLatency,
+	)
+}
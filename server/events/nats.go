@@ -0,0 +1,219 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// NATSPublisher publishes events to a NATS subject using the NATS core
+// protocol.
+//
+// Each event is published as a separate message. After publishing a batch
+// the publisher sends a PING and waits for the PONG, so the batch only
+// succeeds once the server has processed all messages in the batch.
+//
+// The publisher connects on the first publish, and reconnects on the next
+// publish if the connection fails.
+type NATSPublisher struct {
+	url     *url.URL
+	subject string
+
+	conn   net.Conn
+	reader *bufio.Reader
+	mu     sync.Mutex
+}
+
+// NewNATSPublisher creates a publisher to the NATS server at the given URL,
+// such as 'nats://localhost:4222'. Use the 'tls' scheme to require TLS.
+//
+// The URL may include a token ('nats://<token>@localhost:4222') or username
+// and password ('nats://<user>:<pass>@localhost:4222').
+func NewNATSPublisher(rawURL string, subject string) (*NATSPublisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse url: %w", err)
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("unsupported url scheme: %s", u.Scheme)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return nil, fmt.Errorf("invalid subject: %q", subject)
+	}
+	return &NATSPublisher{
+		url:     u,
+		subject: subject,
+	}, nil
+}
+
+func (p *NATSPublisher) Publish(ctx context.Context, events []*Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		if err := p.connect(ctx); err != nil {
+			return fmt.Errorf("connect: %w", err)
+		}
+	}
+
+	if err := p.publish(ctx, events); err != nil {
+		p.closeConn()
+		return err
+	}
+	return nil
+}
+
+func (p *NATSPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closeConn()
+	return nil
+}
+
+func (p *NATSPublisher) publish(ctx context.Context, events []*Event) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := p.conn.SetDeadline(deadline); err != nil {
+			return fmt.Errorf("set deadline: %w", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("encode event: %w", err)
+		}
+		fmt.Fprintf(&buf, "PUB %s %d\r\n", p.subject, len(payload))
+		buf.Write(payload)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("PING\r\n")
+
+	if _, err := p.conn.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// Wait for the PONG, which the server sends once it has processed all
+	// messages.
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return fmt.Errorf("write: %w", err)
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server error: %s", strings.TrimSpace(line[4:]))
+		}
+		// Ignore other operations, such as '+OK' and 'INFO'.
+	}
+}
+
+func (p *NATSPublisher) connect(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.url.Host)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return fmt.Errorf("set deadline: %w", err)
+		}
+	}
+	p.conn = conn
+	p.reader = bufio.NewReader(conn)
+
+	if err := p.handshake(); err != nil {
+		p.closeConn()
+		return err
+	}
+	return nil
+}
+
+func (p *NATSPublisher) handshake() error {
+	// The server sends an INFO message on connect.
+	line, err := p.readLine()
+	if err != nil {
+		return fmt.Errorf("read info: %w", err)
+	}
+	infoJSON, ok := strings.CutPrefix(line, "INFO ")
+	if !ok {
+		return fmt.Errorf("unexpected message: %s", line)
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err := json.Unmarshal([]byte(infoJSON), &info); err != nil {
+		return fmt.Errorf("decode info: %w", err)
+	}
+
+	if info.TLSRequired || p.url.Scheme == "tls" {
+		tlsConn := tls.Client(p.conn, &tls.Config{
+			ServerName: p.url.Hostname(),
+		})
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("tls handshake: %w", err)
+		}
+		p.conn = tlsConn
+		p.reader = bufio.NewReader(tlsConn)
+	}
+
+	connect := map[string]any{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "piko",
+		"lang":     "go",
+		"protocol": 1,
+	}
+	if user := p.url.User; user != nil {
+		if pass, ok := user.Password(); ok {
+			connect["user"] = user.Username()
+			connect["pass"] = pass
+		} else {
+			connect["auth_token"] = user.Username()
+		}
+	}
+	connectJSON, err := json.Marshal(connect)
+	if err != nil {
+		return fmt.Errorf("encode connect: %w", err)
+	}
+	if _, err := fmt.Fprintf(p.conn, "CONNECT %s\r\n", connectJSON); err != nil {
+		return fmt.Errorf("write connect: %w", err)
+	}
+	return nil
+}
+
+func (p *NATSPublisher) readLine() (string, error) {
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (p *NATSPublisher) closeConn() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+		p.reader = nil
+	}
+}
+
+var _ Publisher = &NATSPublisher{}
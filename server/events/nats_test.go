@@ -0,0 +1,193 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type natsMessage struct {
+	Subject string
+	Payload []byte
+}
+
+// fakeNATSServer is a minimal NATS server that accepts published messages.
+type fakeNATSServer struct {
+	ln       net.Listener
+	connects chan map[string]any
+	messages chan natsMessage
+	// errMessage is sent instead of PONG if set.
+	errMessage string
+}
+
+func newFakeNATSServer(t *testing.T) *fakeNATSServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &fakeNATSServer{
+		ln:       ln,
+		connects: make(chan map[string]any, 10),
+		messages: make(chan natsMessage, 100),
+	}
+	go s.serve()
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	return s
+}
+
+func (s *fakeNATSServer) URL() string {
+	return "nats://" + s.ln.Addr().String()
+}
+
+func (s *fakeNATSServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *fakeNATSServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("INFO {\"server_id\":\"fake\"}\r\n")); err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case strings.HasPrefix(line, "CONNECT "):
+			var connect map[string]any
+			if err := json.Unmarshal([]byte(line[8:]), &connect); err != nil {
+				panic("decode connect: " + err.Error())
+			}
+			s.connects <- connect
+		case strings.HasPrefix(line, "PUB "):
+			parts := strings.Split(line, " ")
+			size, err := strconv.Atoi(parts[2])
+			if err != nil {
+				panic("invalid size: " + err.Error())
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return
+			}
+			s.messages <- natsMessage{
+				Subject: parts[1],
+				Payload: payload[:size],
+			}
+		case line == "PING":
+			reply := "PONG\r\n"
+			if s.errMessage != "" {
+				reply = fmt.Sprintf("-ERR '%s'\r\n", s.errMessage)
+			}
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	t.Run("publish", func(t *testing.T) {
+		server := newFakeNATSServer(t)
+
+		publisher, err := NewNATSPublisher(server.URL(), "piko.events")
+		require.NoError(t, err)
+		defer publisher.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		for i := 0; i != 2; i++ {
+			require.NoError(t, publisher.Publish(ctx, []*Event{
+				{Type: EventTypeRequest, EndpointID: "endpoint-1"},
+				{Type: EventTypeRequest, EndpointID: "endpoint-2"},
+			}))
+
+			for j := 0; j != 2; j++ {
+				m := <-server.messages
+				assert.Equal(t, "piko.events", m.Subject)
+
+				var event Event
+				require.NoError(t, json.Unmarshal(m.Payload, &event))
+				assert.Equal(t, fmt.Sprintf("endpoint-%d", j+1), event.EndpointID)
+			}
+		}
+
+		// The publisher should reuse the connection.
+		<-server.connects
+		assert.Len(t, server.connects, 0)
+	})
+
+	t.Run("token", func(t *testing.T) {
+		server := newFakeNATSServer(t)
+
+		url := strings.Replace(server.URL(), "nats://", "nats://my-token@", 1)
+		publisher, err := NewNATSPublisher(url, "piko.events")
+		require.NoError(t, err)
+		defer publisher.Close()
+
+		require.NoError(t, publisher.Publish(context.Background(), []*Event{
+			{Type: EventTypeRequest},
+		}))
+
+		connect := <-server.connects
+		assert.Equal(t, "my-token", connect["auth_token"])
+	})
+
+	t.Run("server error", func(t *testing.T) {
+		server := newFakeNATSServer(t)
+		server.errMessage = "Permissions Violation"
+
+		publisher, err := NewNATSPublisher(server.URL(), "piko.events")
+		require.NoError(t, err)
+		defer publisher.Close()
+
+		err = publisher.Publish(context.Background(), []*Event{
+			{Type: EventTypeRequest},
+		})
+		assert.ErrorContains(t, err, "Permissions Violation")
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		url := "nats://" + ln.Addr().String()
+		ln.Close()
+
+		publisher, err := NewNATSPublisher(url, "piko.events")
+		require.NoError(t, err)
+		defer publisher.Close()
+
+		err = publisher.Publish(context.Background(), []*Event{
+			{Type: EventTypeRequest},
+		})
+		assert.ErrorContains(t, err, "connect")
+	})
+
+	t.Run("invalid subject", func(t *testing.T) {
+		_, err := NewNATSPublisher("nats://localhost:4222", "piko events")
+		assert.Error(t, err)
+	})
+}
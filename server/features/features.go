@@ -0,0 +1,93 @@
+// Package features reports which optional server features are enabled and
+// a hash of each feature's configuration, so fleet tooling can verify nodes
+// run the expected configuration without exposing the configuration itself.
+package features
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/andydunstall/piko/pkg/build"
+	"github.com/andydunstall/piko/server/config"
+)
+
+// Feature describes an optional server feature.
+type Feature struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// ConfigHash is the hex encoded SHA-256 hash of the JSON encoded
+	// feature configuration, so nodes with the same configuration have the
+	// same hash.
+	ConfigHash string `json:"config_hash"`
+}
+
+// Report describes the features of a node.
+type Report struct {
+	Version  string    `json:"version"`
+	Features []Feature `json:"features"`
+}
+
+// NewReport returns the features enabled by the given configuration.
+func NewReport(conf *config.Config) *Report {
+	features := []Feature{
+		newFeature("cluster", len(conf.Cluster.Join) > 0, clusterConfig(conf.Cluster)),
+		newFeature("proxy_auth", conf.Proxy.Auth.Enabled(), conf.Proxy.Auth),
+		newFeature("proxy_tls", conf.Proxy.TLS.Enabled(), conf.Proxy.TLS),
+		newFeature("upstream_auth", conf.Upstream.Auth.Enabled(), conf.Upstream.Auth),
+		newFeature("upstream_tls", conf.Upstream.TLS.Enabled(), conf.Upstream.TLS),
+		newFeature(
+			"upstream_rate_limit", conf.Upstream.RateLimit.Enabled(), conf.Upstream.RateLimit,
+		),
+		newFeature("admin_auth", conf.Admin.Auth.Enabled(), conf.Admin.Auth),
+		newFeature("admin_tls", conf.Admin.TLS.Enabled(), conf.Admin.TLS),
+		// Custom domains obtain certificates using ACME.
+		newFeature("custom_domains", conf.Proxy.CustomDomains.Enabled, conf.Proxy.CustomDomains),
+		newFeature("uploads", conf.Proxy.Uploads.Enabled, conf.Proxy.Uploads),
+		newFeature("queue", conf.Proxy.Queue.Enabled(), conf.Proxy.Queue),
+		newFeature("waiting_room", conf.Proxy.WaitingRoom.Enabled(), conf.Proxy.WaitingRoom),
+		newFeature("sticky_sessions", conf.Proxy.StickySessions.Enabled(), conf.Proxy.StickySessions),
+		newFeature("filter", conf.Proxy.Filter.Enabled(), conf.Proxy.Filter),
+		newFeature("fingerprint", conf.Proxy.Fingerprint.Enabled, conf.Proxy.Fingerprint),
+		newFeature("redirect", conf.Proxy.Redirect.Enabled(), conf.Proxy.Redirect),
+		newFeature("hsts", conf.Proxy.HSTS.Enabled(), conf.Proxy.HSTS),
+		newFeature("transfers", conf.Proxy.Transfers.Enabled(), conf.Proxy.Transfers),
+		newFeature("canary", conf.Proxy.Canary.Enabled(), conf.Proxy.Canary),
+		newFeature("route_labels", conf.Proxy.RouteLabels.Enabled(), conf.Proxy.RouteLabels),
+		newFeature("admission", conf.Admission.Enabled(), conf.Admission),
+		newFeature("tenants", conf.Tenants.Enabled, conf.Tenants),
+		newFeature("probes", conf.Probes.Enabled(), conf.Probes),
+		newFeature("events", conf.Events.Enabled(), conf.Events),
+		newFeature("geoip", conf.GeoIP.Enabled(), conf.GeoIP),
+		newFeature("storage", conf.Storage.Path != "", conf.Storage),
+		newFeature("usage", !conf.Usage.Disable, conf.Usage),
+	}
+
+	return &Report{
+		Version:  build.Version,
+		Features: features,
+	}
+}
+
+func newFeature(name string, enabled bool, conf any) Feature {
+	return Feature{
+		Name:       name,
+		Enabled:    enabled,
+		ConfigHash: hash(conf),
+	}
+}
+
+// clusterConfig returns the cluster configuration without the node ID and
+// advertise address, which are unique to each node.
+func clusterConfig(conf config.ClusterConfig) config.ClusterConfig {
+	conf.NodeID = ""
+	conf.Gossip.AdvertiseAddr = ""
+	return conf
+}
+
+func hash(conf any) string {
+	// Configuration only contains JSON encodable types so won't fail.
+	b, _ := json.Marshal(conf)
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,61 @@
+package features
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+func feature(t *testing.T, report *Report, name string) Feature {
+	for _, f := range report.Features {
+		if f.Name == name {
+			return f
+		}
+	}
+	t.Fatalf("feature not found: %s", name)
+	return Feature{}
+}
+
+func TestNewReport(t *testing.T) {
+	t.Run("enabled", func(t *testing.T) {
+		conf := config.Default()
+		conf.Proxy.Uploads.Enabled = true
+
+		report := NewReport(conf)
+		assert.True(t, feature(t, report, "uploads").Enabled)
+		assert.False(t, feature(t, report, "cluster").Enabled)
+		assert.False(t, feature(t, report, "custom_domains").Enabled)
+
+		conf.Cluster.Join = []string{"10.26.104.56"}
+		conf.Proxy.CustomDomains.Enabled = true
+		report = NewReport(conf)
+		assert.True(t, feature(t, report, "cluster").Enabled)
+		assert.True(t, feature(t, report, "custom_domains").Enabled)
+	})
+
+	t.Run("config hash", func(t *testing.T) {
+		a := config.Default()
+		a.Cluster.NodeID = "node-a"
+		a.Cluster.Gossip.AdvertiseAddr = "10.26.104.56:8003"
+		b := config.Default()
+		b.Cluster.NodeID = "node-b"
+		b.Cluster.Gossip.AdvertiseAddr = "10.26.104.57:8003"
+
+		// Node specific configuration doesn't change the hash.
+		assert.Equal(t, NewReport(a), NewReport(b))
+
+		b.Proxy.Queue.MaxRequests = 10
+		assert.NotEqual(
+			t,
+			feature(t, NewReport(a), "queue").ConfigHash,
+			feature(t, NewReport(b), "queue").ConfigHash,
+		)
+		assert.Equal(
+			t,
+			feature(t, NewReport(a), "uploads").ConfigHash,
+			feature(t, NewReport(b), "uploads").ConfigHash,
+		)
+	})
+}
@@ -0,0 +1,30 @@
+package features
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/status"
+)
+
+type Status struct {
+	conf *config.Config
+}
+
+func NewStatus(conf *config.Config) *Status {
+	return &Status{
+		conf: conf,
+	}
+}
+
+func (s *Status) Register(group *gin.RouterGroup) {
+	group.GET("", s.getFeaturesRoute)
+}
+
+func (s *Status) getFeaturesRoute(c *gin.Context) {
+	c.JSON(http.StatusOK, NewReport(s.conf))
+}
+
+var _ status.Handler = &Status{}
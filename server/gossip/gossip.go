@@ -34,6 +34,7 @@ func NewGossip(
 	clusterState *cluster.State,
 	streamLn net.Listener,
 	packetLn net.PacketConn,
+	dialer gossip.Dialer,
 	conf *gossip.Config,
 	logger log.Logger,
 ) *Gossip {
@@ -45,6 +46,7 @@ func NewGossip(
 		conf,
 		streamLn,
 		packetLn,
+		dialer,
 		syncer,
 		logger,
 	)
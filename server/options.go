@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net"
+)
+
+// Network is the network the server listens on and dials other nodes with.
+//
+// Tests use a simulated network to inject faults between nodes running in
+// the same process, such as partitions and delays.
+type Network interface {
+	Listen(network, address string) (net.Listener, error)
+	ListenPacket(network, address string) (net.PacketConn, error)
+	Dial(network, address string) (net.Conn, error)
+}
+
+type options struct {
+	network Network
+}
+
+type networkOption struct {
+	Network Network
+}
+
+func (o networkOption) apply(opts *options) {
+	opts.network = o.Network
+}
+
+// WithNetwork configures the network to listen on and dial other nodes
+// with.
+//
+// Defaults to the host network.
+func WithNetwork(network Network) Option {
+	return networkOption{Network: network}
+}
+
+type Option interface {
+	apply(*options)
+}
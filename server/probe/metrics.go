@@ -0,0 +1,58 @@
+package probe
+
+import "github.com/prometheus/client_golang/prometheus"
+
+type Metrics struct {
+	// ProbesTotal is the number of probe requests, labelled by probe,
+	// endpoint and result ('success' or 'failure').
+	ProbesTotal *prometheus.CounterVec
+
+	// ProbeDuration is the probe request latency, labelled by probe and
+	// endpoint.
+	ProbeDuration *prometheus.HistogramVec
+
+	// Up is 1 when the last probe succeeded, 0 otherwise. Labelled by probe
+	// and endpoint.
+	Up *prometheus.GaugeVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		ProbesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "probe",
+				Name:      "probes_total",
+				Help:      "Number of synthetic probe requests",
+			},
+			[]string{"probe", "endpoint", "result"},
+		),
+		ProbeDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "piko",
+				Subsystem: "probe",
+				Name:      "duration_seconds",
+				Help:      "Synthetic probe request latency",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"probe", "endpoint"},
+		),
+		Up: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "probe",
+				Name:      "up",
+				Help:      "Whether the last synthetic probe succeeded",
+			},
+			[]string{"probe", "endpoint"},
+		),
+	}
+}
+
+func (m *Metrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.ProbesTotal,
+		m.ProbeDuration,
+		m.Up,
+	)
+}
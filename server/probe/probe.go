@@ -0,0 +1,190 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/proxy"
+)
+
+// Proxy forwards requests to an endpoint.
+type Proxy interface {
+	ServeHTTP(w http.ResponseWriter, r *http.Request, endpointID string)
+}
+
+// Prober periodically sends synthetic requests to endpoints and records
+// availability and latency metrics, so broken tunnels are detected before
+// users notice.
+//
+// Probe requests are forwarded to the endpoints upstreams the same as proxy
+// requests, though bypass the proxy server itself (including
+// authentication).
+//
+// Every node in the cluster runs every probe. If the endpoint has no
+// upstreams connected to the node, the probe is forwarded to a node that
+// does, so each node's metrics cover its own path to the upstream, including
+// any broken links between nodes.
+type Prober struct {
+	probes []config.ProbeConfig
+
+	proxy Proxy
+
+	metrics *Metrics
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	logger log.Logger
+}
+
+func NewProber(conf config.ProbesConfig, proxy Proxy, logger log.Logger) *Prober {
+	var probes []config.ProbeConfig
+	for _, endpointID := range conf.Endpoints {
+		probes = append(probes, config.ProbeConfig{
+			EndpointID: endpointID,
+		})
+	}
+	probes = append(probes, conf.Probes...)
+
+	// Set defaults.
+	for i := range probes {
+		if probes[i].Name == "" {
+			probes[i].Name = probes[i].EndpointID
+		}
+		if probes[i].Method == "" {
+			probes[i].Method = http.MethodGet
+		}
+		if probes[i].Path == "" {
+			probes[i].Path = "/"
+		}
+		if probes[i].Interval == 0 {
+			probes[i].Interval = conf.Interval
+		}
+		if probes[i].Timeout == 0 {
+			probes[i].Timeout = conf.Timeout
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Prober{
+		probes:  probes,
+		proxy:   proxy,
+		metrics: NewMetrics(),
+		ctx:     ctx,
+		cancel:  cancel,
+		logger:  logger.WithSubsystem("probe"),
+	}
+}
+
+// Start runs the probes until the prober is stopped.
+func (p *Prober) Start() {
+	var wg sync.WaitGroup
+	for _, probe := range p.probes {
+		wg.Add(1)
+		go func(probe config.ProbeConfig) {
+			defer wg.Done()
+			p.run(probe)
+		}(probe)
+	}
+	wg.Wait()
+}
+
+func (p *Prober) Stop() {
+	p.cancel()
+}
+
+func (p *Prober) Metrics() *Metrics {
+	return p.metrics
+}
+
+func (p *Prober) run(probe config.ProbeConfig) {
+	ticker := time.NewTicker(probe.Interval)
+	defer ticker.Stop()
+
+	// Assume the endpoint is available until the first probe, so we only
+	// log if the first probe fails.
+	up := true
+	for {
+		err := p.probe(probe)
+		if err != nil && up {
+			p.logger.Warn(
+				"probe failed",
+				zap.String("probe", probe.Name),
+				zap.String("endpoint-id", probe.EndpointID),
+				zap.Error(err),
+			)
+		}
+		if err == nil && !up {
+			p.logger.Info(
+				"probe recovered",
+				zap.String("probe", probe.Name),
+				zap.String("endpoint-id", probe.EndpointID),
+			)
+		}
+		up = err == nil
+
+		select {
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// probe sends a probe request and records the result.
+func (p *Prober) probe(probe config.ProbeConfig) error {
+	start := time.Now()
+	err := p.send(probe)
+	duration := time.Since(start)
+
+	p.metrics.ProbeDuration.WithLabelValues(
+		probe.Name, probe.EndpointID,
+	).Observe(duration.Seconds())
+
+	result := "success"
+	up := 1.0
+	if err != nil {
+		result = "failure"
+		up = 0.0
+	}
+	p.metrics.ProbesTotal.WithLabelValues(
+		probe.Name, probe.EndpointID, result,
+	).Inc()
+	p.metrics.Up.WithLabelValues(probe.Name, probe.EndpointID).Set(up)
+
+	return err
+}
+
+func (p *Prober) send(probe config.ProbeConfig) error {
+	ctx, cancel := context.WithTimeout(p.ctx, probe.Timeout)
+	defer cancel()
+
+	r, err := http.NewRequestWithContext(ctx, probe.Method, probe.Path, nil)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	r.Host = probe.EndpointID
+	r.Header.Set("User-Agent", "piko-probe")
+
+	w := proxy.NewStatusRecorder()
+	p.proxy.ServeHTTP(w, r, probe.EndpointID)
+
+	status := w.Status()
+	if probe.ExpectedStatus != 0 {
+		if status != probe.ExpectedStatus {
+			return fmt.Errorf("unexpected status: %d", status)
+		}
+		return nil
+	}
+	if status >= http.StatusInternalServerError {
+		return fmt.Errorf("unexpected status: %d", status)
+	}
+	return nil
+}
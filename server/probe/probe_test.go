@@ -0,0 +1,91 @@
+package probe
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/atomic"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+)
+
+type fakeProxy struct {
+	status *atomic.Int64
+}
+
+func (p *fakeProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, endpointID string) {
+	if endpointID != "my-endpoint" || r.Header.Get("User-Agent") != "piko-probe" {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(int(p.status.Load()))
+}
+
+func TestProber(t *testing.T) {
+	t.Run("default probe", func(t *testing.T) {
+		status := atomic.NewInt64(http.StatusNotFound)
+		prober := NewProber(config.ProbesConfig{
+			Endpoints: []string{"my-endpoint"},
+			Interval:  time.Millisecond * 10,
+			Timeout:   time.Second,
+		}, &fakeProxy{status: status}, log.NewNopLogger())
+		go prober.Start()
+		defer prober.Stop()
+
+		up := prober.Metrics().Up.WithLabelValues("my-endpoint", "my-endpoint")
+
+		// Any status below 500 is considered available.
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(up) == 1
+		}, time.Second, time.Millisecond*10)
+
+		status.Store(http.StatusBadGateway)
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(up) == 0
+		}, time.Second, time.Millisecond*10)
+
+		assert.Greater(t, testutil.ToFloat64(
+			prober.Metrics().ProbesTotal.WithLabelValues(
+				"my-endpoint", "my-endpoint", "failure",
+			),
+		), 0.0)
+	})
+
+	t.Run("expected status", func(t *testing.T) {
+		status := atomic.NewInt64(http.StatusOK)
+		prober := NewProber(config.ProbesConfig{
+			Probes: []config.ProbeConfig{
+				{
+					Name:           "health",
+					EndpointID:     "my-endpoint",
+					Path:           "/health",
+					ExpectedStatus: http.StatusNoContent,
+				},
+			},
+			Interval: time.Millisecond * 10,
+			Timeout:  time.Second,
+		}, &fakeProxy{status: status}, log.NewNopLogger())
+		go prober.Start()
+		defer prober.Stop()
+
+		up := prober.Metrics().Up.WithLabelValues("health", "my-endpoint")
+
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(
+				prober.Metrics().ProbesTotal.WithLabelValues(
+					"health", "my-endpoint", "failure",
+				),
+			) > 0
+		}, time.Second, time.Millisecond*10)
+		assert.Equal(t, 0.0, testutil.ToFloat64(up))
+
+		status.Store(http.StatusNoContent)
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(up) == 1
+		}, time.Second, time.Millisecond*10)
+	})
+}
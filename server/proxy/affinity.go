@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+// affinityManager is an upstream manager that supports selecting a specific
+// local upstream for sticky sessions.
+type affinityManager interface {
+	SelectByID(endpointID string, upstreamID string) (upstream.Upstream, bool)
+	SelectByKey(endpointID string, key string) (upstream.Upstream, bool)
+}
+
+// affinity routes requests from the same client to the same upstream, for
+// endpoints with multiple upstreams.
+//
+// If a header is configured, the header value is hashed to select the
+// upstream. Otherwise the upstream ID is recorded in a cookie.
+type affinity struct {
+	conf config.StickySessionsConfig
+
+	upstreams affinityManager
+}
+
+// newAffinity returns the affinity for the configured endpoints, or nil if
+// the manager doesn't support affinity.
+func newAffinity(
+	conf config.StickySessionsConfig,
+	upstreams upstream.Manager,
+) *affinity {
+	m, ok := upstreams.(affinityManager)
+	if !ok {
+		return nil
+	}
+	return &affinity{
+		conf:      conf,
+		upstreams: m,
+	}
+}
+
+// lookup returns the upstream the request has affinity with, or false if
+// the request has no affinity or the upstream isn't connected to the local
+// node.
+func (a *affinity) lookup(r *http.Request, endpointID string) (upstream.Upstream, bool) {
+	if a.conf.Header != "" {
+		key := r.Header.Get(a.conf.Header)
+		if key == "" {
+			return nil, false
+		}
+		return a.upstreams.SelectByKey(endpointID, key)
+	}
+
+	cookie, err := r.Cookie(a.conf.Cookie)
+	if err != nil || cookie.Value == "" {
+		return nil, false
+	}
+	return a.upstreams.SelectByID(endpointID, cookie.Value)
+}
+
+// stick records affinity with the selected upstream in a cookie, so
+// subsequent requests from the client are routed to the same upstream.
+//
+// Affinity is only recorded by the node the upstream is connected to, so
+// requests forwarded to another node are recorded by that node.
+func (a *affinity) stick(w http.ResponseWriter, r *http.Request, u upstream.Upstream) {
+	if a.conf.Header != "" || u.Forward() {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     a.conf.Cookie,
+		Value:    u.ID(),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if a.conf.CookieMaxAge != 0 {
+		cookie.MaxAge = int(a.conf.CookieMaxAge.Seconds())
+	}
+	http.SetCookie(w, cookie)
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+// affinityUpstream is an upstream with the given ID.
+type affinityUpstream struct {
+	tcpUpstream
+
+	id string
+}
+
+func (u *affinityUpstream) ID() string {
+	return u.id
+}
+
+// fakeAffinityManager routes requests round-robin between upstreams, unless
+// the request has affinity with an upstream.
+type fakeAffinityManager struct {
+	fakeManager
+
+	upstreams []*affinityUpstream
+	next      int
+
+	keys []string
+}
+
+func (m *fakeAffinityManager) Select(_ string, _ bool) (upstream.Upstream, bool) {
+	u := m.upstreams[m.next%len(m.upstreams)]
+	m.next++
+	return u, true
+}
+
+func (m *fakeAffinityManager) SelectByID(_ string, upstreamID string) (upstream.Upstream, bool) {
+	for _, u := range m.upstreams {
+		if u.id == upstreamID {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+func (m *fakeAffinityManager) SelectByKey(_ string, key string) (upstream.Upstream, bool) {
+	m.keys = append(m.keys, key)
+	return m.upstreams[0], true
+}
+
+func newAffinityTestServer(
+	t *testing.T,
+	conf config.StickySessionsConfig,
+) (*fakeAffinityManager, string) {
+	manager := &fakeAffinityManager{}
+	for _, id := range []string{"upstream-1", "upstream-2"} {
+		id := id
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("x-upstream", id)
+			},
+		))
+		t.Cleanup(server.Close)
+
+		manager.upstreams = append(manager.upstreams, &affinityUpstream{
+			tcpUpstream: tcpUpstream{addr: server.Listener.Addr().String()},
+			id:          id,
+		})
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	proxyConf := config.Default().Proxy
+	proxyConf.StickySessions = conf
+
+	s := NewServer(manager, proxyConf, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	t.Cleanup(func() {
+		_ = s.Shutdown(context.TODO())
+	})
+
+	return manager, "http://" + ln.Addr().String()
+}
+
+func TestServer_StickySessions(t *testing.T) {
+	t.Run("cookie", func(t *testing.T) {
+		_, addr := newAffinityTestServer(t, config.StickySessionsConfig{
+			Endpoints: []string{"my-endpoint"},
+			Cookie:    "piko_affinity",
+		})
+
+		get := func(cookie *http.Cookie) *http.Response {
+			req, err := http.NewRequest(http.MethodGet, addr, nil)
+			require.NoError(t, err)
+			req.Header.Set("x-piko-endpoint", "my-endpoint")
+			if cookie != nil {
+				req.AddCookie(cookie)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			return resp
+		}
+
+		resp := get(nil)
+		assert.Equal(t, "upstream-1", resp.Header.Get("x-upstream"))
+		cookies := resp.Cookies()
+		require.Len(t, cookies, 1)
+		assert.Equal(t, "piko_affinity", cookies[0].Name)
+		assert.Equal(t, "upstream-1", cookies[0].Value)
+		assert.True(t, cookies[0].HttpOnly)
+
+		// Requests with the cookie are routed to the same upstream.
+		for i := 0; i != 3; i++ {
+			resp = get(cookies[0])
+			assert.Equal(t, "upstream-1", resp.Header.Get("x-upstream"))
+			assert.Empty(t, resp.Cookies())
+		}
+
+		// If the upstream isn't connected, the request is routed to another
+		// upstream and affinity is recorded with the new upstream.
+		resp = get(&http.Cookie{Name: "piko_affinity", Value: "unknown"})
+		cookies = resp.Cookies()
+		require.Len(t, cookies, 1)
+		assert.Equal(t, resp.Header.Get("x-upstream"), cookies[0].Value)
+	})
+
+	t.Run("header", func(t *testing.T) {
+		manager, addr := newAffinityTestServer(t, config.StickySessionsConfig{
+			Endpoints: []string{"my-endpoint"},
+			Header:    "x-session-id",
+		})
+
+		req, err := http.NewRequest(http.MethodGet, addr, nil)
+		require.NoError(t, err)
+		req.Header.Set("x-piko-endpoint", "my-endpoint")
+		req.Header.Set("x-session-id", "my-session")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, "upstream-1", resp.Header.Get("x-upstream"))
+		assert.Equal(t, []string{"my-session"}, manager.keys)
+		// No cookie is set when using a header.
+		assert.Empty(t, resp.Cookies())
+	})
+
+	t.Run("endpoint not permitted", func(t *testing.T) {
+		_, addr := newAffinityTestServer(t, config.StickySessionsConfig{
+			Endpoints: []string{"other-endpoint"},
+			Cookie:    "piko_affinity",
+		})
+
+		req, err := http.NewRequest(http.MethodGet, addr, nil)
+		require.NoError(t, err)
+		req.Header.Set("x-piko-endpoint", "my-endpoint")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Empty(t, resp.Cookies())
+	})
+}
@@ -0,0 +1,418 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+// canaryBuckets is the number of buckets in each sliding window.
+const canaryBuckets = 10
+
+const (
+	canaryGroupStable = "stable"
+	canaryGroupCanary = "canary"
+)
+
+var (
+	errCanaryNotFound      = errors.New("traffic split not found")
+	errCanaryInvalidWeight = errors.New("weight must be between 0 and 100")
+)
+
+// canaryGroupStats contains the requests to a group within the window.
+type canaryGroupStats struct {
+	Requests      int     `json:"requests"`
+	Errors        int     `json:"errors"`
+	ErrorRate     float64 `json:"error_rate"`
+	MeanLatencyMS float64 `json:"mean_latency_ms"`
+}
+
+type canaryBucket struct {
+	start    time.Time
+	requests int
+	errors   int
+	latency  time.Duration
+}
+
+// canaryWindow records requests to a group over a sliding window, split
+// into buckets so old requests expire a bucket at a time.
+type canaryWindow struct {
+	window     time.Duration
+	bucketSize time.Duration
+	buckets    [canaryBuckets]canaryBucket
+}
+
+func newCanaryWindow(window time.Duration) canaryWindow {
+	bucketSize := window / canaryBuckets
+	if bucketSize <= 0 {
+		bucketSize = 1
+	}
+	return canaryWindow{
+		window:     window,
+		bucketSize: bucketSize,
+	}
+}
+
+func (w *canaryWindow) observe(now time.Time, failed bool, latency time.Duration) {
+	start := now.Truncate(w.bucketSize)
+	b := &w.buckets[(start.UnixNano()/int64(w.bucketSize))%canaryBuckets]
+	if !b.start.Equal(start) {
+		*b = canaryBucket{start: start}
+	}
+	b.requests++
+	if failed {
+		b.errors++
+	}
+	b.latency += latency
+}
+
+func (w *canaryWindow) stats(now time.Time) canaryGroupStats {
+	var stats canaryGroupStats
+	var latency time.Duration
+	for _, b := range w.buckets {
+		if b.requests == 0 || now.Sub(b.start) >= w.window {
+			continue
+		}
+		stats.Requests += b.requests
+		stats.Errors += b.errors
+		latency += b.latency
+	}
+	if stats.Requests > 0 {
+		stats.ErrorRate = float64(stats.Errors) / float64(stats.Requests)
+		stats.MeanLatencyMS = float64(latency) / float64(stats.Requests) / float64(time.Millisecond)
+	}
+	return stats
+}
+
+// canaryStatus describes a traffic split returned by the admin API.
+type canaryStatus struct {
+	EndpointID       string `json:"endpoint_id"`
+	CanaryEndpointID string `json:"canary_endpoint_id"`
+	// Weight is the current percentage of requests routed to the canary.
+	Weight int `json:"weight"`
+	// ConfiguredWeight is the weight in the configuration.
+	ConfiguredWeight int `json:"configured_weight"`
+
+	Stable canaryGroupStats `json:"stable"`
+	Canary canaryGroupStats `json:"canary"`
+
+	// ErrorRateDelta is the canary error rate minus the stable error rate.
+	ErrorRateDelta float64 `json:"error_rate_delta"`
+	// LatencyDeltaMS is the canary mean latency minus the stable mean
+	// latency.
+	LatencyDeltaMS float64 `json:"latency_delta_ms"`
+
+	// Degraded indicates the canary exceeded the configured thresholds in
+	// the current window.
+	Degraded bool `json:"degraded"`
+
+	// RolledBack indicates traffic was shifted back to the stable group
+	// because the canary degraded.
+	RolledBack     bool       `json:"rolled_back"`
+	RolledBackAt   *time.Time `json:"rolled_back_at,omitempty"`
+	RollbackReason string     `json:"rollback_reason,omitempty"`
+}
+
+type canarySplit struct {
+	conf config.CanarySplitConfig
+
+	weight int
+
+	stable canaryWindow
+	canary canaryWindow
+
+	rolledBackAt   time.Time
+	rollbackReason string
+
+	mu sync.Mutex
+}
+
+// canaryRouter splits requests to an endpoint between a stable and a canary
+// group of upstreams, where the canary upstreams listen on their own
+// endpoint.
+//
+// The router compares the error rate and latency of each group over a
+// sliding window, and if the canary degrades, optionally shifts all traffic
+// back to the stable group.
+type canaryRouter struct {
+	conf config.CanaryConfig
+
+	// splits contains the traffic splits, keyed by endpoint ID.
+	splits map[string]*canarySplit
+
+	upstreams upstream.Manager
+
+	metrics *canaryMetrics
+
+	// now and random are overridden in tests.
+	now    func() time.Time
+	random func(n int) int
+
+	logger log.Logger
+}
+
+func newCanaryRouter(
+	conf config.CanaryConfig,
+	upstreams upstream.Manager,
+	logger log.Logger,
+) *canaryRouter {
+	r := &canaryRouter{
+		conf:      conf,
+		splits:    make(map[string]*canarySplit),
+		upstreams: upstreams,
+		metrics:   newCanaryMetrics(),
+		now:       time.Now,
+		random:    rand.Intn,
+		logger:    logger,
+	}
+	for _, splitConf := range conf.Splits {
+		r.splits[splitConf.EndpointID] = &canarySplit{
+			conf:   splitConf,
+			weight: splitConf.Weight,
+			stable: newCanaryWindow(conf.Window),
+			canary: newCanaryWindow(conf.Window),
+		}
+		r.metrics.Weight.With(prometheus.Labels{
+			"endpoint": splitConf.EndpointID,
+		}).Set(float64(splitConf.Weight))
+	}
+	return r
+}
+
+// route returns the endpoint to forward the request to, and a function to
+// record the response status code once the request completes.
+//
+// Requests are only routed to the canary group when it has a connected
+// upstream, so the canary doesn't fail requests before it's deployed.
+func (r *canaryRouter) route(endpointID string) (string, func(statusCode int)) {
+	split, ok := r.splits[endpointID]
+	if !ok {
+		return endpointID, func(int) {}
+	}
+
+	split.mu.Lock()
+	weight := split.weight
+	split.mu.Unlock()
+
+	target := endpointID
+	group := canaryGroupStable
+	if weight > 0 && r.random(100) < weight {
+		if _, ok := r.upstreams.Select(split.conf.CanaryEndpointID, true); ok {
+			target = split.conf.CanaryEndpointID
+			group = canaryGroupCanary
+		}
+	}
+
+	start := r.now()
+	return target, func(statusCode int) {
+		r.observe(split, group, statusCode, r.now().Sub(start))
+	}
+}
+
+func (r *canaryRouter) observe(
+	split *canarySplit, group string, statusCode int, latency time.Duration,
+) {
+	failed := statusCode >= http.StatusInternalServerError
+	result := "success"
+	if failed {
+		result = "error"
+	}
+	r.metrics.RequestsTotal.With(prometheus.Labels{
+		"endpoint": split.conf.EndpointID,
+		"group":    group,
+		"result":   result,
+	}).Inc()
+
+	now := r.now()
+
+	split.mu.Lock()
+	defer split.mu.Unlock()
+
+	if group == canaryGroupCanary {
+		split.canary.observe(now, failed, latency)
+	} else {
+		split.stable.observe(now, failed, latency)
+	}
+
+	if !r.conf.Rollback || split.weight == 0 {
+		return
+	}
+	status := r.statusLocked(split, now)
+	if !status.Degraded {
+		return
+	}
+
+	split.weight = 0
+	split.rolledBackAt = now
+	split.rollbackReason = r.degradedReason(status)
+
+	r.metrics.Weight.With(prometheus.Labels{
+		"endpoint": split.conf.EndpointID,
+	}).Set(0)
+	r.metrics.RollbacksTotal.With(prometheus.Labels{
+		"endpoint": split.conf.EndpointID,
+	}).Inc()
+
+	r.logger.Warn(
+		"canary degraded; rolled back",
+		zap.String("endpoint-id", split.conf.EndpointID),
+		zap.String("canary-endpoint-id", split.conf.CanaryEndpointID),
+		zap.String("reason", split.rollbackReason),
+	)
+}
+
+// list returns the status of each traffic split.
+func (r *canaryRouter) list() []canaryStatus {
+	now := r.now()
+	statuses := make([]canaryStatus, 0, len(r.conf.Splits))
+	// Use the configuration order so results are stable.
+	for _, splitConf := range r.conf.Splits {
+		split := r.splits[splitConf.EndpointID]
+		split.mu.Lock()
+		statuses = append(statuses, r.statusLocked(split, now))
+		split.mu.Unlock()
+	}
+	return statuses
+}
+
+// setWeight sets the percentage of requests routed to the canary, such as
+// to progress a rollout or restore the weight after a rollback.
+func (r *canaryRouter) setWeight(endpointID string, weight int) (canaryStatus, error) {
+	split, ok := r.splits[endpointID]
+	if !ok {
+		return canaryStatus{}, errCanaryNotFound
+	}
+	if weight < 0 || weight > 100 {
+		return canaryStatus{}, errCanaryInvalidWeight
+	}
+
+	split.mu.Lock()
+	defer split.mu.Unlock()
+
+	split.weight = weight
+	// Clear the rollback and the canary window, so requests from before
+	// the canary was fixed don't immediately roll back again.
+	split.rolledBackAt = time.Time{}
+	split.rollbackReason = ""
+	split.canary = newCanaryWindow(r.conf.Window)
+
+	r.metrics.Weight.With(prometheus.Labels{
+		"endpoint": endpointID,
+	}).Set(float64(weight))
+
+	r.logger.Info(
+		"canary weight updated",
+		zap.String("endpoint-id", endpointID),
+		zap.Int("weight", weight),
+	)
+
+	return r.statusLocked(split, r.now()), nil
+}
+
+func (r *canaryRouter) statusLocked(split *canarySplit, now time.Time) canaryStatus {
+	status := canaryStatus{
+		EndpointID:       split.conf.EndpointID,
+		CanaryEndpointID: split.conf.CanaryEndpointID,
+		Weight:           split.weight,
+		ConfiguredWeight: split.conf.Weight,
+		Stable:           split.stable.stats(now),
+		Canary:           split.canary.stats(now),
+	}
+	status.ErrorRateDelta = status.Canary.ErrorRate - status.Stable.ErrorRate
+	status.LatencyDeltaMS = status.Canary.MeanLatencyMS - status.Stable.MeanLatencyMS
+
+	if status.Stable.Requests >= r.conf.MinRequests &&
+		status.Canary.Requests >= r.conf.MinRequests {
+		status.Degraded = r.degradedReason(status) != ""
+	}
+
+	if !split.rolledBackAt.IsZero() {
+		rolledBackAt := split.rolledBackAt
+		status.RolledBack = true
+		status.RolledBackAt = &rolledBackAt
+		status.RollbackReason = split.rollbackReason
+	}
+	return status
+}
+
+// degradedReason returns why the canary is degraded compared to the stable
+// group, or an empty string if the canary isn't degraded.
+func (r *canaryRouter) degradedReason(status canaryStatus) string {
+	if status.ErrorRateDelta > r.conf.MaxErrorRateDelta {
+		return fmt.Sprintf(
+			"error rate delta %.3f exceeds %.3f",
+			status.ErrorRateDelta, r.conf.MaxErrorRateDelta,
+		)
+	}
+	maxLatencyDeltaMS := float64(r.conf.MaxLatencyDelta) / float64(time.Millisecond)
+	if r.conf.MaxLatencyDelta != 0 && status.LatencyDeltaMS > maxLatencyDeltaMS {
+		return fmt.Sprintf(
+			"latency delta %.1fms exceeds %.1fms",
+			status.LatencyDeltaMS, maxLatencyDeltaMS,
+		)
+	}
+	return ""
+}
+
+type canaryMetrics struct {
+	// RequestsTotal is the number of requests to each group of a traffic
+	// split.
+	RequestsTotal *prometheus.CounterVec
+
+	// Weight is the current percentage of requests routed to the canary.
+	Weight *prometheus.GaugeVec
+
+	// RollbacksTotal is the number of times traffic was shifted back to the
+	// stable group because the canary degraded.
+	RollbacksTotal *prometheus.CounterVec
+}
+
+func newCanaryMetrics() *canaryMetrics {
+	return &canaryMetrics{
+		RequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "canary_requests_total",
+				Help:      "Number of requests to each group of a traffic split",
+			},
+			[]string{"endpoint", "group", "result"},
+		),
+		Weight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "canary_weight",
+				Help:      "Percentage of requests routed to the canary group",
+			},
+			[]string{"endpoint"},
+		),
+		RollbacksTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "canary_rollbacks_total",
+				Help:      "Number of rollbacks after the canary degraded",
+			},
+			[]string{"endpoint"},
+		),
+	}
+}
+
+func (m *canaryMetrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.RequestsTotal,
+		m.Weight,
+		m.RollbacksTotal,
+	)
+}
@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+func newTestCanaryRouter(canaryConnected *atomic.Bool) *canaryRouter {
+	conf := config.Default().Proxy.Canary
+	conf.Splits = []config.CanarySplitConfig{
+		{
+			EndpointID:       "my-endpoint",
+			CanaryEndpointID: "my-endpoint-canary",
+			Weight:           50,
+		},
+	}
+	conf.Window = time.Minute
+	conf.MinRequests = 5
+	conf.MaxErrorRateDelta = 0.1
+	conf.MaxLatencyDelta = time.Millisecond * 100
+	conf.Rollback = true
+
+	return newCanaryRouter(
+		conf,
+		&fakeManager{
+			handler: func(endpointID string, _ bool) (upstream.Upstream, bool) {
+				if endpointID == "my-endpoint-canary" && !canaryConnected.Load() {
+					return nil, false
+				}
+				return &tcpUpstream{}, true
+			},
+		},
+		log.NewNopLogger(),
+	)
+}
+
+func TestCanaryRouter(t *testing.T) {
+	t.Run("split", func(t *testing.T) {
+		r := newTestCanaryRouter(atomic.NewBool(true))
+
+		// Requests below the weight are routed to the canary.
+		r.random = func(int) int { return 49 }
+		target, done := r.route("my-endpoint")
+		assert.Equal(t, "my-endpoint-canary", target)
+		done(http.StatusOK)
+
+		r.random = func(int) int { return 50 }
+		target, done = r.route("my-endpoint")
+		assert.Equal(t, "my-endpoint", target)
+		done(http.StatusOK)
+
+		// Endpoints without a split aren't affected.
+		target, _ = r.route("other-endpoint")
+		assert.Equal(t, "other-endpoint", target)
+
+		splits := r.list()
+		require.Len(t, splits, 1)
+		assert.Equal(t, 1, splits[0].Stable.Requests)
+		assert.Equal(t, 1, splits[0].Canary.Requests)
+	})
+
+	t.Run("canary not connected", func(t *testing.T) {
+		r := newTestCanaryRouter(atomic.NewBool(false))
+		r.random = func(int) int { return 0 }
+
+		target, _ := r.route("my-endpoint")
+		assert.Equal(t, "my-endpoint", target)
+	})
+
+	t.Run("rollback on errors", func(t *testing.T) {
+		r := newTestCanaryRouter(atomic.NewBool(true))
+
+		for i := 0; i != 5; i++ {
+			r.random = func(int) int { return 99 }
+			_, done := r.route("my-endpoint")
+			done(http.StatusOK)
+		}
+		for i := 0; i != 4; i++ {
+			r.random = func(int) int { return 0 }
+			_, done := r.route("my-endpoint")
+			done(http.StatusBadGateway)
+		}
+		// Not compared until the canary has the minimum requests.
+		assert.Equal(t, 50, r.list()[0].Weight)
+
+		_, done := r.route("my-endpoint")
+		done(http.StatusBadGateway)
+
+		split := r.list()[0]
+		assert.Equal(t, 0, split.Weight)
+		assert.Equal(t, 50, split.ConfiguredWeight)
+		assert.True(t, split.Degraded)
+		assert.True(t, split.RolledBack)
+		assert.Equal(t, 1.0, split.ErrorRateDelta)
+		assert.Equal(t, "error rate delta 1.000 exceeds 0.100", split.RollbackReason)
+
+		// All traffic is routed to the stable group.
+		target, _ := r.route("my-endpoint")
+		assert.Equal(t, "my-endpoint", target)
+
+		// Restoring the weight clears the rollback.
+		split, err := r.setWeight("my-endpoint", 10)
+		require.NoError(t, err)
+		assert.Equal(t, 10, split.Weight)
+		assert.False(t, split.RolledBack)
+		assert.Equal(t, 0, split.Canary.Requests)
+
+		_, err = r.setWeight("my-endpoint", 101)
+		assert.ErrorIs(t, err, errCanaryInvalidWeight)
+		_, err = r.setWeight("unknown", 10)
+		assert.ErrorIs(t, err, errCanaryNotFound)
+	})
+
+	t.Run("rollback on latency", func(t *testing.T) {
+		r := newTestCanaryRouter(atomic.NewBool(true))
+
+		now := time.Now()
+		r.now = func() time.Time { return now }
+
+		for i := 0; i != 5; i++ {
+			r.random = func(int) int { return 99 }
+			_, done := r.route("my-endpoint")
+			now = now.Add(time.Millisecond * 10)
+			done(http.StatusOK)
+
+			r.random = func(int) int { return 0 }
+			_, done = r.route("my-endpoint")
+			now = now.Add(time.Millisecond * 200)
+			done(http.StatusOK)
+		}
+
+		split := r.list()[0]
+		assert.True(t, split.RolledBack)
+		assert.Equal(t, "latency delta 190.0ms exceeds 100.0ms", split.RollbackReason)
+	})
+
+	t.Run("window", func(t *testing.T) {
+		r := newTestCanaryRouter(atomic.NewBool(true))
+		r.random = func(int) int { return 99 }
+
+		now := time.Now()
+		r.now = func() time.Time { return now }
+
+		_, done := r.route("my-endpoint")
+		done(http.StatusOK)
+		assert.Equal(t, 1, r.list()[0].Stable.Requests)
+
+		// Requests expire once outside the window.
+		now = now.Add(time.Minute * 2)
+		assert.Equal(t, 0, r.list()[0].Stable.Requests)
+	})
+}
+
+func TestServer_Canary(t *testing.T) {
+	stableServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("x-group", "stable")
+		},
+	))
+	defer stableServer.Close()
+	canaryServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("x-group", "canary")
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+	))
+	defer canaryServer.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	conf := config.Default().Proxy
+	conf.Canary.Splits = []config.CanarySplitConfig{
+		{
+			EndpointID:       "my-endpoint",
+			CanaryEndpointID: "my-endpoint-canary",
+			Weight:           100,
+		},
+	}
+	conf.Canary.MinRequests = 1
+	conf.Canary.Rollback = true
+
+	s := NewServer(
+		&fakeManager{
+			handler: func(endpointID string, _ bool) (upstream.Upstream, bool) {
+				if endpointID == "my-endpoint-canary" {
+					return &tcpUpstream{addr: canaryServer.Listener.Addr().String()}, true
+				}
+				return &tcpUpstream{addr: stableServer.Listener.Addr().String()}, true
+			},
+		},
+		conf,
+		nil,
+		nil,
+		nil,
+		log.NewNopLogger(),
+	)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer func() {
+		_ = s.Shutdown(context.TODO())
+	}()
+
+	get := func() *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String(), nil)
+		require.NoError(t, err)
+		req.Header.Set("x-piko-endpoint", "my-endpoint")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// The canary receives all traffic until it has errors compared to the
+	// stable group. Since the stable group has no requests, the canary
+	// isn't compared.
+	resp := get()
+	assert.Equal(t, "canary", resp.Header.Get("x-group"))
+
+	// Route a request to stable so the groups can be compared.
+	_, err = s.canary.setWeight("my-endpoint", 0)
+	require.NoError(t, err)
+	resp = get()
+	assert.Equal(t, "stable", resp.Header.Get("x-group"))
+
+	_, err = s.canary.setWeight("my-endpoint", 100)
+	require.NoError(t, err)
+	resp = get()
+	assert.Equal(t, "canary", resp.Header.Get("x-group"))
+
+	// Rolled back after the canary error.
+	resp = get()
+	assert.Equal(t, "stable", resp.Header.Get("x-group"))
+
+	// Restore the weight using the admin handler.
+	router := gin.New()
+	s.CanaryHandler().Register(router.Group("/canary/v1"))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(
+		http.MethodPost, "/canary/v1/splits/weight",
+		bytes.NewReader([]byte(`{"endpoint_id": "my-endpoint", "weight": 100}`)),
+	))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/canary/v1/splits", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var splits struct {
+		Splits []canaryStatus `json:"splits"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &splits))
+	require.Len(t, splits.Splits, 1)
+	assert.Equal(t, 100, splits.Splits[0].Weight)
+	assert.False(t, splits.Splits[0].RolledBack)
+
+	resp = get()
+	assert.Equal(t, "canary", resp.Header.Get("x-group"))
+}
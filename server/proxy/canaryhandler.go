@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/server/status"
+)
+
+type setCanaryWeightRequest struct {
+	EndpointID string `json:"endpoint_id"`
+	// Weight is the percentage of requests to route to the canary, from 0
+	// to 100.
+	Weight *int `json:"weight"`
+}
+
+// CanaryHandler exposes the traffic splits in the admin API, including the
+// success rate and latency of the stable and canary groups over the sliding
+// window, so operators can analyse a canary release and shift weights.
+//
+// If the client authenticated with a token that is restricted to a set of
+// endpoints, the client can only access splits for those endpoints.
+type CanaryHandler struct {
+	router *canaryRouter
+}
+
+func (h *CanaryHandler) Register(group *gin.RouterGroup) {
+	group.GET("/splits", h.listSplitsRoute)
+	group.POST("/splits/weight", h.setWeightRoute)
+}
+
+func (h *CanaryHandler) listSplitsRoute(c *gin.Context) {
+	splits := []canaryStatus{}
+	for _, split := range h.router.list() {
+		if !endpointPermitted(c, split.EndpointID) {
+			continue
+		}
+		splits = append(splits, split)
+	}
+	c.JSON(http.StatusOK, gin.H{"splits": splits})
+}
+
+// setWeightRoute sets the canary weight of a split, such as to progress a
+// rollout or restore the weight after a rollback.
+func (h *CanaryHandler) setWeightRoute(c *gin.Context) {
+	var req setCanaryWeightRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if req.EndpointID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing endpoint id"})
+		return
+	}
+	if req.Weight == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing weight"})
+		return
+	}
+	if !endpointPermitted(c, req.EndpointID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": errCanaryNotFound.Error()})
+		return
+	}
+
+	split, err := h.router.setWeight(req.EndpointID, *req.Weight)
+	switch {
+	case errors.Is(err, errCanaryNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errCanaryInvalidWeight):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, split)
+}
+
+var _ status.Handler = &CanaryHandler{}
@@ -0,0 +1,409 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
+)
+
+const (
+	// maxCaptureDuration is the maximum duration of a capture.
+	maxCaptureDuration = time.Minute * 10
+
+	// defaultCaptureDuration is the duration of a capture if not specified.
+	defaultCaptureDuration = time.Minute
+
+	// maxCaptureBytes is the maximum size of a capture.
+	maxCaptureBytes = 64 << 20
+
+	// defaultCaptureBytes is the size of a capture if not specified.
+	defaultCaptureBytes = 8 << 20
+
+	// maxCaptures is the maximum number of captures retained. Once
+	// reached, the oldest completed capture is removed.
+	maxCaptures = 16
+)
+
+const (
+	captureStateRunning   = "running"
+	captureStateCompleted = "completed"
+)
+
+var (
+	errCaptureNotFound        = errors.New("capture not found")
+	errCaptureLimit           = errors.New("too many running captures")
+	errCaptureInvalidSize     = errors.New("invalid max bytes")
+	errCaptureInvalidDuration = errors.New("invalid duration")
+)
+
+// captureRedactedHeaders are headers whose values are replaced in captured
+// records, as they contain credentials. The Piko authorization and forward
+// signature headers are also redacted.
+var captureRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// captureRecord is the metadata of a captured request. Bodies aren't
+// captured.
+type captureRecord struct {
+	Time            time.Time   `json:"time"`
+	Method          string      `json:"method"`
+	Host            string      `json:"host"`
+	RequestURI      string      `json:"request_uri"`
+	Proto           string      `json:"proto"`
+	ClientIP        string      `json:"client_ip"`
+	RequestHeaders  http.Header `json:"request_headers"`
+	RequestBytes    int64       `json:"request_bytes"`
+	Status          int         `json:"status"`
+	ResponseHeaders http.Header `json:"response_headers"`
+	ResponseBytes   int         `json:"response_bytes"`
+	// Duration is the duration to handle the request in milliseconds.
+	Duration int64 `json:"duration_ms"`
+}
+
+// captureStatus is the status of a capture returned by the admin API.
+type captureStatus struct {
+	ID         string     `json:"id"`
+	EndpointID string     `json:"endpoint_id"`
+	State      string     `json:"state"`
+	StartedAt  time.Time  `json:"started_at"`
+	EndedAt    *time.Time `json:"ended_at,omitempty"`
+	// Reason is why the capture ended, either 'duration', 'size' or
+	// 'stopped'.
+	Reason   string `json:"reason,omitempty"`
+	Duration string `json:"duration"`
+	MaxBytes int    `json:"max_bytes"`
+	Records  int    `json:"records"`
+	Bytes    int    `json:"bytes"`
+}
+
+// captureSession records the HTTP metadata of requests to an endpoint for a
+// bounded duration and size.
+type captureSession struct {
+	id         string
+	endpointID string
+	startedAt  time.Time
+	duration   time.Duration
+	maxBytes   int
+
+	// buf contains the captured records as newline delimited JSON.
+	buf     bytes.Buffer
+	records int
+	endedAt time.Time
+	reason  string
+
+	timer *time.Timer
+}
+
+func (c *captureSession) running() bool {
+	return c.endedAt.IsZero()
+}
+
+func (c *captureSession) status() captureStatus {
+	status := captureStatus{
+		ID:         c.id,
+		EndpointID: c.endpointID,
+		State:      captureStateRunning,
+		StartedAt:  c.startedAt,
+		Reason:     c.reason,
+		Duration:   c.duration.String(),
+		MaxBytes:   c.maxBytes,
+		Records:    c.records,
+		Bytes:      c.buf.Len(),
+	}
+	if !c.running() {
+		endedAt := c.endedAt
+		status.State = captureStateCompleted
+		status.EndedAt = &endedAt
+	}
+	return status
+}
+
+// captures manages debug captures of the HTTP metadata of requests to
+// endpoints, so operators can debug production traffic without
+// redeploying.
+//
+// Captures are held in memory and bounded in duration and size.
+type captures struct {
+	// captures contains both running and completed captures, ordered by
+	// start time.
+	captures []*captureSession
+
+	// running is the number of running captures, so requests can skip
+	// checking for captures without locking when none are running.
+	running atomic.Int32
+
+	mu sync.Mutex
+
+	headers protocol.Headers
+
+	logger log.Logger
+}
+
+func newCaptures(headers protocol.Headers, logger log.Logger) *captures {
+	return &captures{
+		headers: headers,
+		logger:  logger,
+	}
+}
+
+// start starts a capture of requests to the endpoint.
+//
+// If duration or maxBytes are zero, the defaults are used.
+func (c *captures) start(
+	endpointID string,
+	duration time.Duration,
+	maxBytes int,
+) (captureStatus, error) {
+	if duration == 0 {
+		duration = defaultCaptureDuration
+	}
+	if duration < 0 || duration > maxCaptureDuration {
+		return captureStatus{}, errCaptureInvalidDuration
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultCaptureBytes
+	}
+	if maxBytes < 0 || maxBytes > maxCaptureBytes {
+		return captureStatus{}, errCaptureInvalidSize
+	}
+
+	id, err := captureID()
+	if err != nil {
+		return captureStatus{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if int(c.running.Load()) >= maxCaptures {
+		return captureStatus{}, errCaptureLimit
+	}
+	// Remove the oldest completed captures to make room.
+	for len(c.captures) >= maxCaptures {
+		i := slices.IndexFunc(c.captures, func(capture *captureSession) bool {
+			return !capture.running()
+		})
+		c.captures = slices.Delete(c.captures, i, i+1)
+	}
+
+	capture := &captureSession{
+		id:         id,
+		endpointID: endpointID,
+		startedAt:  time.Now(),
+		duration:   duration,
+		maxBytes:   maxBytes,
+	}
+	capture.timer = time.AfterFunc(duration, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.endLocked(capture, "duration")
+	})
+	c.captures = append(c.captures, capture)
+	c.running.Add(1)
+
+	c.logger.Info(
+		"capture started",
+		zap.String("id", id),
+		zap.String("endpoint-id", endpointID),
+		zap.Duration("duration", duration),
+		zap.Int("max-bytes", maxBytes),
+	)
+
+	return capture.status(), nil
+}
+
+// stop ends the capture if running. The captured records are kept until
+// the capture is removed.
+func (c *captures) stop(id string) (captureStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	capture, ok := c.getLocked(id)
+	if !ok {
+		return captureStatus{}, errCaptureNotFound
+	}
+	c.endLocked(capture, "stopped")
+	return capture.status(), nil
+}
+
+// remove ends the capture if running and discards its records.
+func (c *captures) remove(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	capture, ok := c.getLocked(id)
+	if !ok {
+		return errCaptureNotFound
+	}
+	c.endLocked(capture, "stopped")
+	c.captures = slices.DeleteFunc(c.captures, func(other *captureSession) bool {
+		return other == capture
+	})
+	return nil
+}
+
+func (c *captures) get(id string) (captureStatus, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	capture, ok := c.getLocked(id)
+	if !ok {
+		return captureStatus{}, false
+	}
+	return capture.status(), true
+}
+
+func (c *captures) list() []captureStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	statuses := make([]captureStatus, 0, len(c.captures))
+	for _, capture := range c.captures {
+		statuses = append(statuses, capture.status())
+	}
+	return statuses
+}
+
+// records returns a copy of the captured records as newline delimited
+// JSON.
+func (c *captures) records(id string) (captureStatus, []byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	capture, ok := c.getLocked(id)
+	if !ok {
+		return captureStatus{}, nil, false
+	}
+	return capture.status(), bytes.Clone(capture.buf.Bytes()), true
+}
+
+// Handler records the requests to endpoints with running captures.
+func (c *captures) Handler(
+	endpointID func(r *http.Request) string,
+) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if c.running.Load() == 0 ||
+			strings.HasPrefix(ctx.Request.URL.Path, "/_piko") {
+			ctx.Next()
+			return
+		}
+
+		start := time.Now()
+		// Copy the request headers before they're modified when proxying.
+		requestHeaders := c.redactHeaders(ctx.Request.Header)
+
+		ctx.Next()
+
+		record := captureRecord{
+			Time:            start,
+			Method:          ctx.Request.Method,
+			Host:            ctx.Request.Host,
+			RequestURI:      ctx.Request.RequestURI,
+			Proto:           ctx.Request.Proto,
+			ClientIP:        ctx.ClientIP(),
+			RequestHeaders:  requestHeaders,
+			RequestBytes:    max(ctx.Request.ContentLength, 0),
+			Status:          ctx.Writer.Status(),
+			ResponseHeaders: c.redactHeaders(ctx.Writer.Header()),
+			ResponseBytes:   max(ctx.Writer.Size(), 0),
+			Duration:        time.Since(start).Milliseconds(),
+		}
+		c.record(endpointID(ctx.Request), record)
+	}
+}
+
+// record adds the record to the running captures of the endpoint.
+func (c *captures) record(endpointID string, record captureRecord) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var b []byte
+	for _, capture := range c.captures {
+		if !capture.running() || capture.endpointID != endpointID {
+			continue
+		}
+		if b == nil {
+			var err error
+			b, err = json.Marshal(record)
+			if err != nil {
+				c.logger.Warn("failed to encode capture record", zap.Error(err))
+				return
+			}
+			b = append(b, '\n')
+		}
+		if capture.buf.Len()+len(b) > capture.maxBytes {
+			c.endLocked(capture, "size")
+			continue
+		}
+		capture.buf.Write(b)
+		capture.records++
+	}
+}
+
+func (c *captures) endLocked(capture *captureSession, reason string) {
+	if !capture.running() {
+		return
+	}
+	capture.timer.Stop()
+	capture.endedAt = time.Now()
+	capture.reason = reason
+	c.running.Add(-1)
+
+	c.logger.Info(
+		"capture completed",
+		zap.String("id", capture.id),
+		zap.String("endpoint-id", capture.endpointID),
+		zap.String("reason", reason),
+		zap.Int("records", capture.records),
+	)
+}
+
+func (c *captures) getLocked(id string) (*captureSession, bool) {
+	for _, capture := range c.captures {
+		if capture.id == id {
+			return capture, true
+		}
+	}
+	return nil, false
+}
+
+// redactHeaders returns a copy of the headers with credentials redacted.
+func (c *captures) redactHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	names := slices.Concat(captureRedactedHeaders, []string{
+		c.headers.Authorization(),
+		c.headers.ForwardSignature(),
+	})
+	for _, name := range names {
+		if _, ok := h[http.CanonicalHeaderKey(name)]; ok {
+			h.Set(name, "REDACTED")
+		}
+	}
+	return h
+}
+
+func captureID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
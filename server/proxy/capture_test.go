@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/auth"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
+)
+
+func TestCaptures(t *testing.T) {
+	// proxy returns a router that records requests to c.
+	proxy := func(c *captures) *gin.Engine {
+		router := gin.New()
+		router.Use(c.Handler(defaultEndpointID))
+		router.NoRoute(func(c *gin.Context) {
+			c.Header("Set-Cookie", "session=secret")
+			c.String(http.StatusOK, "hello")
+		})
+		return router
+	}
+	request := func(router *gin.Engine, endpointID string) {
+		req := httptest.NewRequest(http.MethodGet, "/foo?bar=baz", nil)
+		req.Header.Set("x-piko-endpoint", endpointID)
+		req.Header.Set("Authorization", "Bearer secret")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	records := func(t *testing.T, c *captures, id string) []captureRecord {
+		_, b, ok := c.records(id)
+		require.True(t, ok)
+
+		var records []captureRecord
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		for scanner.Scan() {
+			var record captureRecord
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+			records = append(records, record)
+		}
+		return records
+	}
+
+	t.Run("records endpoint requests", func(t *testing.T) {
+		c := newCaptures(protocol.Headers{}, log.NewNopLogger())
+		router := proxy(c)
+
+		// Not captured before the capture starts.
+		request(router, "my-endpoint")
+
+		status, err := c.start("my-endpoint", time.Minute, 0)
+		require.NoError(t, err)
+		assert.Equal(t, captureStateRunning, status.State)
+		assert.Equal(t, defaultCaptureBytes, status.MaxBytes)
+
+		request(router, "my-endpoint")
+		request(router, "other-endpoint")
+
+		status, err = c.stop(status.ID)
+		require.NoError(t, err)
+		assert.Equal(t, captureStateCompleted, status.State)
+		assert.Equal(t, "stopped", status.Reason)
+		assert.Equal(t, 1, status.Records)
+
+		// Not captured after the capture stops.
+		request(router, "my-endpoint")
+
+		captured := records(t, c, status.ID)
+		require.Len(t, captured, 1)
+		assert.Equal(t, http.MethodGet, captured[0].Method)
+		assert.Equal(t, "/foo?bar=baz", captured[0].RequestURI)
+		assert.Equal(t, http.StatusOK, captured[0].Status)
+		assert.Equal(t, 5, captured[0].ResponseBytes)
+		// Credentials are redacted.
+		assert.Equal(t, "REDACTED", captured[0].RequestHeaders.Get("Authorization"))
+		assert.Equal(t, "REDACTED", captured[0].ResponseHeaders.Get("Set-Cookie"))
+	})
+
+	t.Run("duration", func(t *testing.T) {
+		c := newCaptures(protocol.Headers{}, log.NewNopLogger())
+
+		status, err := c.start("my-endpoint", time.Millisecond*10, 0)
+		require.NoError(t, err)
+
+		assert.Eventually(t, func() bool {
+			status, _ := c.get(status.ID)
+			return status.State == captureStateCompleted && status.Reason == "duration"
+		}, time.Second, time.Millisecond*10)
+	})
+
+	t.Run("max bytes", func(t *testing.T) {
+		c := newCaptures(protocol.Headers{}, log.NewNopLogger())
+		router := proxy(c)
+
+		status, err := c.start("my-endpoint", time.Minute, 1024)
+		require.NoError(t, err)
+
+		for i := 0; i != 10; i++ {
+			request(router, "my-endpoint")
+		}
+
+		status, _ = c.get(status.ID)
+		assert.Equal(t, captureStateCompleted, status.State)
+		assert.Equal(t, "size", status.Reason)
+		assert.LessOrEqual(t, status.Bytes, 1024)
+		assert.Len(t, records(t, c, status.ID), status.Records)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		c := newCaptures(protocol.Headers{}, log.NewNopLogger())
+
+		_, err := c.start("my-endpoint", time.Hour, 0)
+		assert.ErrorIs(t, err, errCaptureInvalidDuration)
+		_, err = c.start("my-endpoint", time.Minute, maxCaptureBytes+1)
+		assert.ErrorIs(t, err, errCaptureInvalidSize)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		c := newCaptures(protocol.Headers{}, log.NewNopLogger())
+
+		var ids []string
+		for i := 0; i != maxCaptures; i++ {
+			status, err := c.start("my-endpoint", time.Minute, 0)
+			require.NoError(t, err)
+			ids = append(ids, status.ID)
+		}
+		_, err := c.start("my-endpoint", time.Minute, 0)
+		assert.ErrorIs(t, err, errCaptureLimit)
+
+		// Completed captures are removed to make room.
+		_, err = c.stop(ids[0])
+		require.NoError(t, err)
+		_, err = c.start("my-endpoint", time.Minute, 0)
+		require.NoError(t, err)
+		_, ok := c.get(ids[0])
+		assert.False(t, ok)
+	})
+}
+
+func TestCaptureHandler(t *testing.T) {
+	c := newCaptures(protocol.Headers{}, log.NewNopLogger())
+	other, err := c.start("other-endpoint", time.Minute, 0)
+	require.NoError(t, err)
+
+	router := gin.New()
+	// Authenticate as a tenant restricted to 'my-endpoint'.
+	router.Use(func(c *gin.Context) {
+		c.Set(middleware.TokenContextKey, &auth.Token{
+			Endpoints: []string{"my-endpoint"},
+		})
+	})
+	(&CaptureHandler{captures: c}).Register(router.Group("/capture/v1"))
+
+	do := func(method string, path string, body any) *httptest.ResponseRecorder {
+		var b []byte
+		if body != nil {
+			b, _ = json.Marshal(body)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, path, bytes.NewReader(b)))
+		return rec
+	}
+
+	var status captureStatus
+	t.Run("start", func(t *testing.T) {
+		rec := do(http.MethodPost, "/capture/v1/captures", startCaptureRequest{
+			EndpointID: "my-endpoint",
+			Duration:   "30s",
+		})
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		assert.Equal(t, "my-endpoint", status.EndpointID)
+		assert.Equal(t, "30s", status.Duration)
+	})
+
+	t.Run("start endpoint not permitted", func(t *testing.T) {
+		rec := do(http.MethodPost, "/capture/v1/captures", startCaptureRequest{
+			EndpointID: "other-endpoint",
+		})
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("start invalid duration", func(t *testing.T) {
+		rec := do(http.MethodPost, "/capture/v1/captures", startCaptureRequest{
+			EndpointID: "my-endpoint",
+			Duration:   "1h",
+		})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		rec := do(http.MethodGet, "/capture/v1/captures", nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var resp struct {
+			Captures []captureStatus `json:"captures"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		// Excludes captures of other endpoints.
+		require.Len(t, resp.Captures, 1)
+		assert.Equal(t, status.ID, resp.Captures[0].ID)
+	})
+
+	t.Run("get not permitted", func(t *testing.T) {
+		rec := do(http.MethodGet, "/capture/v1/captures/"+other.ID, nil)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("download", func(t *testing.T) {
+		c.record("my-endpoint", captureRecord{Method: http.MethodGet})
+
+		rec := do(http.MethodGet, "/capture/v1/captures/"+status.ID+"/download", nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+		assert.Contains(t, rec.Header().Get("Content-Disposition"), status.ID)
+
+		var record captureRecord
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &record))
+		assert.Equal(t, http.MethodGet, record.Method)
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		rec := do(http.MethodPost, "/capture/v1/captures/"+status.ID+"/stop", nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var stopped captureStatus
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stopped))
+		assert.Equal(t, captureStateCompleted, stopped.State)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		rec := do(http.MethodDelete, "/capture/v1/captures/"+status.ID, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		rec = do(http.MethodGet, "/capture/v1/captures/"+status.ID, nil)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
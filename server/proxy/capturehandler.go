@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/server/status"
+)
+
+type startCaptureRequest struct {
+	EndpointID string `json:"endpoint_id"`
+	// Duration is the maximum duration of the capture, such as '30s'.
+	// Defaults to 1 minute, up to 10 minutes.
+	Duration string `json:"duration"`
+	// MaxBytes is the maximum size of the capture. Defaults to 8MB, up to
+	// 64MB.
+	MaxBytes int `json:"max_bytes"`
+}
+
+// CaptureHandler exposes debug captures in the admin API, which record the
+// HTTP metadata (though not the bodies) of requests to an endpoint for a
+// bounded duration and size. Completed captures can be downloaded as newline
+// delimited JSON.
+//
+// Credentials in the 'Authorization', 'Cookie' and 'Set-Cookie' headers are
+// redacted.
+type CaptureHandler struct {
+	captures *captures
+}
+
+func (h *CaptureHandler) Register(group *gin.RouterGroup) {
+	group.GET("/captures", h.listCapturesRoute)
+	group.POST("/captures", h.startCaptureRoute)
+	group.GET("/captures/:id", h.getCaptureRoute)
+	group.POST("/captures/:id/stop", h.stopCaptureRoute)
+	group.GET("/captures/:id/download", h.downloadCaptureRoute)
+	group.DELETE("/captures/:id", h.removeCaptureRoute)
+}
+
+func (h *CaptureHandler) listCapturesRoute(c *gin.Context) {
+	captures := []captureStatus{}
+	for _, capture := range h.captures.list() {
+		if !endpointPermitted(c, capture.EndpointID) {
+			continue
+		}
+		captures = append(captures, capture)
+	}
+	c.JSON(http.StatusOK, gin.H{"captures": captures})
+}
+
+func (h *CaptureHandler) startCaptureRoute(c *gin.Context) {
+	var req startCaptureRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if req.EndpointID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing endpoint id"})
+		return
+	}
+	if !endpointPermitted(c, req.EndpointID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "endpoint not permitted"})
+		return
+	}
+	var duration time.Duration
+	if req.Duration != "" {
+		var err error
+		duration, err = time.ParseDuration(req.Duration)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": errCaptureInvalidDuration.Error()})
+			return
+		}
+	}
+
+	status, err := h.captures.start(req.EndpointID, duration, req.MaxBytes)
+	switch {
+	case errors.Is(err, errCaptureInvalidDuration), errors.Is(err, errCaptureInvalidSize):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errCaptureLimit):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+func (h *CaptureHandler) getCaptureRoute(c *gin.Context) {
+	status, ok := h.permittedCapture(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+func (h *CaptureHandler) stopCaptureRoute(c *gin.Context) {
+	if _, ok := h.permittedCapture(c); !ok {
+		return
+	}
+	status, err := h.captures.stop(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// downloadCaptureRoute returns the records captured so far, so a running
+// capture can be downloaded before it completes.
+func (h *CaptureHandler) downloadCaptureRoute(c *gin.Context) {
+	if _, ok := h.permittedCapture(c); !ok {
+		return
+	}
+	status, records, ok := h.captures.records(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": errCaptureNotFound.Error()})
+		return
+	}
+	c.Header(
+		"Content-Disposition",
+		`attachment; filename="piko-capture-`+status.ID+`.ndjson"`,
+	)
+	c.Data(http.StatusOK, "application/x-ndjson", records)
+}
+
+func (h *CaptureHandler) removeCaptureRoute(c *gin.Context) {
+	if _, ok := h.permittedCapture(c); !ok {
+		return
+	}
+	if err := h.captures.remove(c.Param("id")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// permittedCapture returns the capture in the path if it exists and the
+// client is permitted to access its endpoint. Otherwise it responds with
+// not found.
+func (h *CaptureHandler) permittedCapture(c *gin.Context) (captureStatus, bool) {
+	status, ok := h.captures.get(c.Param("id"))
+	if !ok || !endpointPermitted(c, status.EndpointID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": errCaptureNotFound.Error()})
+		return captureStatus{}, false
+	}
+	return status, true
+}
+
+var _ status.Handler = &CaptureHandler{}
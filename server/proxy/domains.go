@@ -0,0 +1,511 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+)
+
+// Domain verification methods.
+const (
+	// domainVerificationDNS verifies the domain contains a TXT record at
+	// '_piko-challenge.<domain>' with the verification token.
+	domainVerificationDNS = "dns"
+
+	// domainVerificationHTTP verifies the site at the domain serves the
+	// verification token at
+	// 'http://<domain>/.well-known/piko-challenge/<token>'.
+	domainVerificationHTTP = "http"
+)
+
+const (
+	domainChallengeRecordPrefix = "_piko-challenge."
+	domainChallengePath         = "/.well-known/piko-challenge/"
+
+	domainVerifyTimeout = 10 * time.Second
+)
+
+var (
+	errDomainNotFound = errors.New("domain not found")
+	errDomainConflict = errors.New("domain attached to another endpoint")
+	errDomainInvalid  = errors.New("invalid domain")
+	errMethodInvalid  = errors.New("invalid verification method")
+)
+
+// customDomain is a domain attached to an endpoint by a tenant.
+type customDomain struct {
+	Domain     string `json:"domain"`
+	EndpointID string `json:"endpoint_id"`
+	// Method is the method used to verify the tenant owns the domain.
+	Method string `json:"method"`
+	// Token is the verification token the tenant must publish.
+	Token string `json:"token"`
+
+	Verified   bool       `json:"verified"`
+	CreatedAt  time.Time  `json:"created_at"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+
+	// LastError is the error from the last failed verification.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// customDomains manages the domains tenants attach to endpoints.
+//
+// Requests with a Host matching a verified domain are routed to its
+// endpoint, and certificates for verified domains are obtained on demand
+// with ACME.
+type customDomains struct {
+	domains map[string]*customDomain
+
+	// path is the file to persist domains, or empty if domains aren't
+	// persisted.
+	path          string
+	pendingExpiry time.Duration
+
+	certs *autocert.Manager
+
+	lookupTXT  func(ctx context.Context, name string) ([]string, error)
+	httpClient *http.Client
+
+	mu sync.Mutex
+
+	logger log.Logger
+}
+
+func newCustomDomains(
+	conf config.CustomDomainsConfig,
+	logger log.Logger,
+) *customDomains {
+	d := &customDomains{
+		domains:       make(map[string]*customDomain),
+		path:          conf.Path,
+		pendingExpiry: conf.PendingExpiry,
+		lookupTXT:     net.DefaultResolver.LookupTXT,
+		httpClient: &http.Client{
+			Timeout: domainVerifyTimeout,
+		},
+		logger: logger.WithSubsystem("proxy.domains"),
+	}
+
+	d.certs = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: d.hostPolicy,
+		Email:      conf.ACMEEmail,
+	}
+	if conf.CertCacheDir != "" {
+		d.certs.Cache = autocert.DirCache(conf.CertCacheDir)
+	}
+	if conf.ACMEDirectoryURL != "" {
+		d.certs.Client = &acme.Client{DirectoryURL: conf.ACMEDirectoryURL}
+	}
+
+	if err := d.load(); err != nil {
+		// Disable persisting domains so the existing file isn't
+		// overwritten, which would lose the domains that failed to load.
+		d.logger.Error(
+			"failed to load custom domains; custom domains won't be persisted",
+			zap.String("path", d.path),
+			zap.Error(err),
+		)
+		d.path = ""
+	} else if len(d.domains) > 0 {
+		d.logger.Info(
+			"loaded custom domains",
+			zap.Int("domains", len(d.domains)),
+		)
+	}
+	return d
+}
+
+// add attaches the domain to the endpoint, returning the domain with the
+// token the tenant must publish to verify they own the domain.
+//
+// If the domain is already attached to the endpoint, the existing domain
+// is returned. Fails if the domain is attached to another endpoint, unless
+// that domain is unverified and expired.
+func (d *customDomains) add(
+	domain string,
+	endpointID string,
+	method string,
+) (customDomain, error) {
+	domain, ok := normalizeDomain(domain)
+	if !ok {
+		return customDomain{}, errDomainInvalid
+	}
+	if method == "" {
+		method = domainVerificationDNS
+	}
+	if method != domainVerificationDNS && method != domainVerificationHTTP {
+		return customDomain{}, errMethodInvalid
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	existing, ok := d.domains[domain]
+	if ok {
+		if existing.EndpointID == endpointID {
+			return *existing, nil
+		}
+		if existing.Verified || time.Since(existing.CreatedAt) < d.pendingExpiry {
+			return customDomain{}, errDomainConflict
+		}
+	}
+
+	token, err := domainToken()
+	if err != nil {
+		return customDomain{}, fmt.Errorf("token: %w", err)
+	}
+	entry := &customDomain{
+		Domain:     domain,
+		EndpointID: endpointID,
+		Method:     method,
+		Token:      token,
+		CreatedAt:  time.Now(),
+	}
+	d.domains[domain] = entry
+	if err := d.saveLocked(); err != nil {
+		if existing != nil {
+			d.domains[domain] = existing
+		} else {
+			delete(d.domains, domain)
+		}
+		return customDomain{}, err
+	}
+
+	d.logger.Info(
+		"custom domain added",
+		zap.String("domain", domain),
+		zap.String("endpoint-id", endpointID),
+		zap.String("method", method),
+	)
+
+	return *entry, nil
+}
+
+// verify checks the tenant published the verification token for the
+// domain. Once verified, the domain is routed to its endpoint.
+func (d *customDomains) verify(ctx context.Context, domain string) (customDomain, error) {
+	domain, _ = normalizeDomain(domain)
+
+	d.mu.Lock()
+	entry, ok := d.domains[domain]
+	if !ok {
+		d.mu.Unlock()
+		return customDomain{}, errDomainNotFound
+	}
+	if entry.Verified {
+		d.mu.Unlock()
+		return *entry, nil
+	}
+	method, token := entry.Method, entry.Token
+	d.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, domainVerifyTimeout)
+	defer cancel()
+
+	var verifyErr error
+	if method == domainVerificationHTTP {
+		verifyErr = d.verifyHTTP(ctx, domain, token)
+	} else {
+		verifyErr = d.verifyDNS(ctx, domain, token)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// The domain may have been removed or replaced while verifying.
+	if current, ok := d.domains[domain]; !ok || current != entry {
+		return customDomain{}, errDomainNotFound
+	}
+
+	if verifyErr != nil {
+		entry.LastError = verifyErr.Error()
+		return *entry, nil
+	}
+
+	now := time.Now()
+	entry.Verified = true
+	entry.VerifiedAt = &now
+	entry.LastError = ""
+	if err := d.saveLocked(); err != nil {
+		return customDomain{}, err
+	}
+
+	d.logger.Info(
+		"custom domain verified",
+		zap.String("domain", domain),
+		zap.String("endpoint-id", entry.EndpointID),
+	)
+
+	return *entry, nil
+}
+
+func (d *customDomains) remove(domain string) error {
+	domain, _ = normalizeDomain(domain)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.domains[domain]
+	if !ok {
+		return errDomainNotFound
+	}
+	delete(d.domains, domain)
+	if err := d.saveLocked(); err != nil {
+		d.domains[domain] = entry
+		return err
+	}
+
+	d.logger.Info(
+		"custom domain removed",
+		zap.String("domain", domain),
+		zap.String("endpoint-id", entry.EndpointID),
+	)
+	return nil
+}
+
+func (d *customDomains) get(domain string) (customDomain, bool) {
+	domain, _ = normalizeDomain(domain)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.domains[domain]
+	if !ok {
+		return customDomain{}, false
+	}
+	return *entry, true
+}
+
+// list returns the domains ordered by domain name.
+func (d *customDomains) list() []customDomain {
+	d.mu.Lock()
+	domains := make([]customDomain, 0, len(d.domains))
+	for _, entry := range d.domains {
+		domains = append(domains, *entry)
+	}
+	d.mu.Unlock()
+
+	sort.Slice(domains, func(i, j int) bool {
+		return domains[i].Domain < domains[j].Domain
+	})
+	return domains
+}
+
+// endpoint returns the endpoint ID of the verified domain matching the host,
+// or false if there is no matching verified domain.
+func (d *customDomains) endpoint(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.domains[host]
+	if !ok || !entry.Verified {
+		return "", false
+	}
+	return entry.EndpointID, true
+}
+
+// hostPolicy only permits obtaining certificates for verified domains.
+func (d *customDomains) hostPolicy(_ context.Context, host string) error {
+	if _, ok := d.endpoint(host); !ok {
+		return fmt.Errorf("domain not verified: %s", host)
+	}
+	return nil
+}
+
+// tlsConfig returns a copy of the proxy TLS config that uses certificates
+// obtained with ACME for verified domains, and otherwise falls back to the
+// configured certificates.
+func (d *customDomains) tlsConfig(base *tls.Config) *tls.Config {
+	tlsConfig := base.Clone()
+	getCertificate := tlsConfig.GetCertificate
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if _, ok := d.endpoint(hello.ServerName); ok {
+			return d.certs.GetCertificate(hello)
+		}
+		if getCertificate != nil {
+			return getCertificate(hello)
+		}
+		// Use the configured certificates.
+		return nil, nil
+	}
+	// Support the TLS-ALPN-01 challenge.
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+	return tlsConfig
+}
+
+// httpHandler returns a handler that answers ACME HTTP-01 challenges for
+// verified domains, and passes other requests to next.
+func (d *customDomains) httpHandler(next http.Handler) http.Handler {
+	challenges := d.certs.HTTPHandler(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := d.endpoint(r.Host); ok {
+			challenges.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (d *customDomains) verifyDNS(ctx context.Context, domain string, token string) error {
+	name := domainChallengeRecordPrefix + domain
+	records, err := d.lookupTXT(ctx, name)
+	if err != nil {
+		return fmt.Errorf("lookup txt: %s: %w", name, err)
+	}
+	for _, record := range records {
+		if record == token {
+			return nil
+		}
+	}
+	return fmt.Errorf("txt record not found: %s", name)
+}
+
+func (d *customDomains) verifyHTTP(ctx context.Context, domain string, token string) error {
+	url := "http://" + domain + domainChallengePath + token
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("get: %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get: %s: %s", url, resp.Status)
+	}
+	// Limit the body as only the token is expected.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return fmt.Errorf("get: %s: %w", url, err)
+	}
+	if strings.TrimSpace(string(body)) != token {
+		return fmt.Errorf("get: %s: token mismatch", url)
+	}
+	return nil
+}
+
+func (d *customDomains) load() error {
+	if d.path == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(d.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var domains []*customDomain
+	if err := json.Unmarshal(b, &domains); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	for _, entry := range domains {
+		d.domains[entry.Domain] = entry
+	}
+	return nil
+}
+
+// saveLocked writes the domains to the file, replacing the existing file
+// atomically.
+func (d *customDomains) saveLocked() error {
+	if d.path == "" {
+		return nil
+	}
+
+	domains := make([]*customDomain, 0, len(d.domains))
+	for _, entry := range d.domains {
+		domains = append(domains, entry)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		return domains[i].Domain < domains[j].Domain
+	})
+	b, err := json.MarshalIndent(domains, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode domains: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("save domains: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("save domains: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("save domains: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), d.path); err != nil {
+		return fmt.Errorf("save domains: %w", err)
+	}
+	return nil
+}
+
+// normalizeDomain returns the lower case domain without a trailing dot, or
+// false if the domain isn't a valid fully qualified host name.
+func normalizeDomain(domain string) (string, bool) {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if len(domain) == 0 || len(domain) > 253 || net.ParseIP(domain) != nil {
+		return domain, false
+	}
+
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return domain, false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return domain, false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return domain, false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return domain, false
+			}
+		}
+	}
+	return domain, true
+}
+
+func domainToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
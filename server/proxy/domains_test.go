@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/auth"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/server/config"
+)
+
+func newTestCustomDomains(t *testing.T, path string) *customDomains {
+	return newCustomDomains(config.CustomDomainsConfig{
+		Enabled:       true,
+		Path:          path,
+		PendingExpiry: time.Hour,
+	}, log.NewNopLogger())
+}
+
+func TestCustomDomains(t *testing.T) {
+	t.Run("verify dns", func(t *testing.T) {
+		domains := newTestCustomDomains(t, "")
+
+		d, err := domains.add("App.Customer.com.", "my-endpoint", "dns")
+		require.NoError(t, err)
+		assert.Equal(t, "app.customer.com", d.Domain)
+		assert.False(t, d.Verified)
+
+		// Not routed until verified.
+		_, ok := domains.endpoint("app.customer.com")
+		assert.False(t, ok)
+
+		domains.lookupTXT = func(_ context.Context, name string) ([]string, error) {
+			assert.Equal(t, "_piko-challenge.app.customer.com", name)
+			return []string{"other"}, nil
+		}
+		d, err = domains.verify(context.Background(), "app.customer.com")
+		require.NoError(t, err)
+		assert.False(t, d.Verified)
+		assert.Equal(t, "txt record not found: _piko-challenge.app.customer.com", d.LastError)
+
+		token := d.Token
+		domains.lookupTXT = func(_ context.Context, _ string) ([]string, error) {
+			return []string{"other", token}, nil
+		}
+		d, err = domains.verify(context.Background(), "app.customer.com")
+		require.NoError(t, err)
+		assert.True(t, d.Verified)
+		assert.Empty(t, d.LastError)
+
+		endpointID, ok := domains.endpoint("APP.customer.com:443")
+		assert.True(t, ok)
+		assert.Equal(t, "my-endpoint", endpointID)
+		assert.NoError(t, domains.hostPolicy(context.Background(), "app.customer.com"))
+		assert.Error(t, domains.hostPolicy(context.Background(), "other.customer.com"))
+	})
+
+	t.Run("verify http", func(t *testing.T) {
+		domains := newTestCustomDomains(t, "")
+
+		d, err := domains.add("app.customer.com", "my-endpoint", "http")
+		require.NoError(t, err)
+
+		site := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "app.customer.com", r.Host)
+				if r.URL.Path != "/.well-known/piko-challenge/"+d.Token {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				_, _ = w.Write([]byte(d.Token + "\n"))
+			},
+		))
+		defer site.Close()
+
+		// Resolve the domain to the test site.
+		domains.httpClient = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, network, site.Listener.Addr().String())
+				},
+			},
+		}
+
+		d, err = domains.verify(context.Background(), "app.customer.com")
+		require.NoError(t, err)
+		assert.True(t, d.Verified)
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		domains := newTestCustomDomains(t, "")
+
+		_, err := domains.add("app.customer.com", "endpoint-1", "dns")
+		require.NoError(t, err)
+
+		// Adding to the same endpoint returns the existing domain.
+		_, err = domains.add("app.customer.com", "endpoint-1", "dns")
+		assert.NoError(t, err)
+
+		_, err = domains.add("app.customer.com", "endpoint-2", "dns")
+		assert.ErrorIs(t, err, errDomainConflict)
+
+		// Once the pending domain expires it can be attached to another
+		// endpoint.
+		domains.pendingExpiry = 0
+		d, err := domains.add("app.customer.com", "endpoint-2", "dns")
+		require.NoError(t, err)
+		assert.Equal(t, "endpoint-2", d.EndpointID)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		domains := newTestCustomDomains(t, "")
+
+		_, err := domains.add("*.customer.com", "my-endpoint", "dns")
+		assert.ErrorIs(t, err, errDomainInvalid)
+
+		_, err = domains.add("app.customer.com", "my-endpoint", "email")
+		assert.ErrorIs(t, err, errMethodInvalid)
+	})
+
+	t.Run("persist", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "domains.json")
+		domains := newTestCustomDomains(t, path)
+
+		d, err := domains.add("app.customer.com", "my-endpoint", "dns")
+		require.NoError(t, err)
+		_, err = domains.add("other.customer.com", "my-endpoint", "dns")
+		require.NoError(t, err)
+		domains.lookupTXT = func(_ context.Context, _ string) ([]string, error) {
+			return []string{d.Token}, nil
+		}
+		_, err = domains.verify(context.Background(), "app.customer.com")
+		require.NoError(t, err)
+		require.NoError(t, domains.remove("other.customer.com"))
+
+		loaded := newTestCustomDomains(t, path)
+		list := loaded.list()
+		require.Len(t, list, 1)
+		assert.Equal(t, "app.customer.com", list[0].Domain)
+		assert.True(t, list[0].Verified)
+		endpointID, ok := loaded.endpoint("app.customer.com")
+		assert.True(t, ok)
+		assert.Equal(t, "my-endpoint", endpointID)
+	})
+}
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := []struct {
+		domain     string
+		normalized string
+		ok         bool
+	}{
+		{"example.com", "example.com", true},
+		{"App.Example.COM.", "app.example.com", true},
+		{"a-b.example.com", "a-b.example.com", true},
+		{"example", "example", false},
+		{"*.example.com", "*.example.com", false},
+		{"-a.example.com", "-a.example.com", false},
+		{"a..example.com", "a..example.com", false},
+		{"10.0.0.1", "10.0.0.1", false},
+		{"example.com:443", "example.com:443", false},
+	}
+	for _, tt := range tests {
+		normalized, ok := normalizeDomain(tt.domain)
+		assert.Equal(t, tt.ok, ok, tt.domain)
+		if ok {
+			assert.Equal(t, tt.normalized, normalized)
+		}
+	}
+}
+
+func TestDomainsHandler(t *testing.T) {
+	domains := newTestCustomDomains(t, "")
+	_, err := domains.add("other.customer.com", "other-endpoint", "dns")
+	require.NoError(t, err)
+
+	router := gin.New()
+	// Authenticate as a tenant restricted to 'my-endpoint'.
+	router.Use(func(c *gin.Context) {
+		c.Set(middleware.TokenContextKey, &auth.Token{
+			Endpoints: []string{"my-endpoint"},
+		})
+	})
+	(&DomainsHandler{domains: domains}).Register(router.Group("/domains/v1"))
+
+	do := func(method string, path string, body any) *httptest.ResponseRecorder {
+		var b []byte
+		if body != nil {
+			b, _ = json.Marshal(body)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, path, bytes.NewReader(b)))
+		return rec
+	}
+
+	t.Run("add", func(t *testing.T) {
+		rec := do(http.MethodPost, "/domains/v1/domains", addDomainRequest{
+			Domain:     "app.customer.com",
+			EndpointID: "my-endpoint",
+		})
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var status domainStatus
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		assert.Equal(t, "app.customer.com", status.Domain)
+		assert.Equal(t, "dns", status.Method)
+		assert.Equal(t, "_piko-challenge.app.customer.com", status.ChallengeRecord)
+		assert.NotEmpty(t, status.Token)
+	})
+
+	t.Run("add endpoint not permitted", func(t *testing.T) {
+		rec := do(http.MethodPost, "/domains/v1/domains", addDomainRequest{
+			Domain:     "app2.customer.com",
+			EndpointID: "other-endpoint",
+		})
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("add conflict", func(t *testing.T) {
+		rec := do(http.MethodPost, "/domains/v1/domains", addDomainRequest{
+			Domain:     "other.customer.com",
+			EndpointID: "my-endpoint",
+		})
+		assert.Equal(t, http.StatusConflict, rec.Code)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		rec := do(http.MethodGet, "/domains/v1/domains", nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var resp struct {
+			Domains []domainStatus `json:"domains"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		// Excludes domains of other endpoints.
+		require.Len(t, resp.Domains, 1)
+		assert.Equal(t, "app.customer.com", resp.Domains[0].Domain)
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		domains.lookupTXT = func(_ context.Context, _ string) ([]string, error) {
+			return nil, errors.New("no such host")
+		}
+		rec := do(http.MethodPost, "/domains/v1/domains/app.customer.com/verify", nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var status domainStatus
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		assert.False(t, status.Verified)
+		assert.Equal(t, "lookup txt: _piko-challenge.app.customer.com: no such host", status.LastError)
+	})
+
+	t.Run("other tenant not found", func(t *testing.T) {
+		rec := do(http.MethodGet, "/domains/v1/domains/other.customer.com", nil)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		rec = do(http.MethodDelete, "/domains/v1/domains/other.customer.com", nil)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		rec := do(http.MethodDelete, "/domains/v1/domains/app.customer.com", nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		rec = do(http.MethodGet, "/domains/v1/domains/app.customer.com", nil)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
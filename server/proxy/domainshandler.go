@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/pkg/auth"
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/server/status"
+)
+
+// domainStatus is a custom domain returned by the admin API, including how
+// to publish the verification token.
+type domainStatus struct {
+	customDomain
+
+	// ChallengeRecord is the name of the TXT record containing the token
+	// when verifying with DNS.
+	ChallengeRecord string `json:"challenge_record,omitempty"`
+
+	// ChallengeURL is the URL that must serve the token when verifying
+	// with HTTP.
+	ChallengeURL string `json:"challenge_url,omitempty"`
+}
+
+func newDomainStatus(d customDomain) domainStatus {
+	status := domainStatus{customDomain: d}
+	if d.Method == domainVerificationHTTP {
+		status.ChallengeURL = "http://" + d.Domain + domainChallengePath + d.Token
+	} else {
+		status.ChallengeRecord = domainChallengeRecordPrefix + d.Domain
+	}
+	return status
+}
+
+type addDomainRequest struct {
+	Domain     string `json:"domain"`
+	EndpointID string `json:"endpoint_id"`
+	// Method is the verification method, either 'dns' (default) or 'http'.
+	Method string `json:"method"`
+}
+
+// DomainsHandler exposes the custom domains in the admin API, so tenants
+// can attach their own domains to endpoints.
+//
+// If the client authenticated with a token that is restricted to a set of
+// endpoints, the client can only manage domains attached to those
+// endpoints.
+type DomainsHandler struct {
+	domains *customDomains
+}
+
+func (h *DomainsHandler) Register(group *gin.RouterGroup) {
+	group.GET("/domains", h.listDomainsRoute)
+	group.POST("/domains", h.addDomainRoute)
+	group.GET("/domains/:domain", h.getDomainRoute)
+	group.DELETE("/domains/:domain", h.removeDomainRoute)
+	group.POST("/domains/:domain/verify", h.verifyDomainRoute)
+}
+
+// listDomainsRoute lists the domains permitted by the client, optionally
+// filtered by 'endpoint_id'.
+func (h *DomainsHandler) listDomainsRoute(c *gin.Context) {
+	endpointID := c.Query("endpoint_id")
+
+	domains := []domainStatus{}
+	for _, d := range h.domains.list() {
+		if endpointID != "" && d.EndpointID != endpointID {
+			continue
+		}
+		if !endpointPermitted(c, d.EndpointID) {
+			continue
+		}
+		domains = append(domains, newDomainStatus(d))
+	}
+	c.JSON(http.StatusOK, gin.H{"domains": domains})
+}
+
+func (h *DomainsHandler) addDomainRoute(c *gin.Context) {
+	var req addDomainRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if req.EndpointID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing endpoint id"})
+		return
+	}
+	if !endpointPermitted(c, req.EndpointID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "endpoint not permitted"})
+		return
+	}
+
+	d, err := h.domains.add(req.Domain, req.EndpointID, req.Method)
+	switch {
+	case errors.Is(err, errDomainInvalid), errors.Is(err, errMethodInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errDomainConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, newDomainStatus(d))
+}
+
+func (h *DomainsHandler) getDomainRoute(c *gin.Context) {
+	d, ok := h.permittedDomain(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, newDomainStatus(d))
+}
+
+func (h *DomainsHandler) removeDomainRoute(c *gin.Context) {
+	d, ok := h.permittedDomain(c)
+	if !ok {
+		return
+	}
+	if err := h.domains.remove(d.Domain); err != nil {
+		if errors.Is(err, errDomainNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// verifyDomainRoute checks whether the tenant published the verification
+// token. If verification fails, the domain is returned with the error in
+// 'last_error' so the tenant can retry.
+func (h *DomainsHandler) verifyDomainRoute(c *gin.Context) {
+	d, ok := h.permittedDomain(c)
+	if !ok {
+		return
+	}
+	d, err := h.domains.verify(c.Request.Context(), d.Domain)
+	if err != nil {
+		if errors.Is(err, errDomainNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, newDomainStatus(d))
+}
+
+// permittedDomain returns the domain in the path if it exists and the
+// client is permitted to access its endpoint. Otherwise it responds with
+// not found.
+func (h *DomainsHandler) permittedDomain(c *gin.Context) (customDomain, bool) {
+	d, ok := h.domains.get(c.Param("domain"))
+	// Respond with not found rather than forbidden, so clients can't
+	// discover the domains of other tenants.
+	if !ok || !endpointPermitted(c, d.EndpointID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": errDomainNotFound.Error()})
+		return customDomain{}, false
+	}
+	return d, true
+}
+
+// endpointPermitted returns whether the authenticated client is permitted to
+// access the endpoint. If the client isn't authenticated with a token, all
+// endpoints are permitted.
+func endpointPermitted(c *gin.Context, endpointID string) bool {
+	token, ok := c.Get(middleware.TokenContextKey)
+	if !ok {
+		return true
+	}
+	return token.(*auth.Token).EndpointPermitted(endpointID)
+}
+
+var _ status.Handler = &DomainsHandler{}
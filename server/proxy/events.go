@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/server/events"
+)
+
+// eventsMiddleware publishes a summary of each request to the event bus.
+func eventsMiddleware(exporter *events.Exporter, headers protocol.Headers) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		// Check before the request is handled, since the forward headers
+		// are stripped once verified.
+		forwarded := c.Request.Header.Get(headers.Forward()) == "true"
+
+		c.Next()
+
+		// TCP routes include the endpoint ID as a path parameter.
+		endpointID := tcpEndpointID(c)
+		if endpointID == "" {
+			// Ignore internal endpoints, other than TCP routes.
+			if strings.HasPrefix(c.Request.URL.Path, "/_piko") {
+				return
+			}
+			endpointID = EndpointIDFromRequest(c.Request, headers)
+		}
+
+		exporter.Publish(&events.Event{
+			Type:       events.EventTypeRequest,
+			Time:       start,
+			EndpointID: endpointID,
+			Request: &events.Request{
+				Method:       c.Request.Method,
+				Path:         c.Request.URL.Path,
+				Status:       c.Writer.Status(),
+				Duration:     time.Since(start).Milliseconds(),
+				BytesWritten: max(c.Writer.Size(), 0),
+				ClientIP:     c.ClientIP(),
+				Tenant:       middleware.Tenant(c),
+				Country:      middleware.Country(c),
+				Forwarded:    forwarded,
+			},
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/andydunstall/piko/pkg/protocol"
+)
+
+// failoverUpstream is an upstream that can fail over to another node.
+type failoverUpstream interface {
+	Failover() bool
+}
+
+// failoverTransport retries requests forwarded to another node on the next
+// node the endpoint is active on, if the node responds that it has no
+// upstream for the endpoint, such as if the cluster state is stale.
+//
+// Only requests without a body, or whose body can be replayed, are retried.
+type failoverTransport struct {
+	transport http.RoundTripper
+	headers   protocol.Headers
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for {
+		resp, err := t.transport.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Header.Get(t.headers.NoUpstream()) == "" {
+			return resp, nil
+		}
+		resp.Header.Del(t.headers.NoUpstream())
+
+		u, ok := req.Context().Value(upstreamContextKey).(failoverUpstream)
+		if !ok || !replayable(req) || !u.Failover() {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		if req.Body != nil && req.Body != http.NoBody {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// replayable returns whether the request can be sent again.
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
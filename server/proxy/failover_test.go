@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+type fakeFailoverUpstream struct {
+	tcpUpstream
+
+	failovers int
+}
+
+func (u *fakeFailoverUpstream) Failover() bool {
+	u.failovers++
+	return u.failovers <= 1
+}
+
+type fakeRoundTripper struct {
+	responses []*http.Response
+	requests  int
+}
+
+func (t *fakeRoundTripper) RoundTrip(_ *http.Request) (*http.Response, error) {
+	resp := t.responses[t.requests]
+	t.requests++
+	return resp, nil
+}
+
+func noUpstreamResponse() *http.Response {
+	header := make(http.Header)
+	header.Set(protocol.Headers{}.NoUpstream(), "true")
+	return &http.Response{
+		StatusCode: http.StatusBadGateway,
+		Header:     header,
+		Body:       http.NoBody,
+	}
+}
+
+func TestFailoverTransport(t *testing.T) {
+	newRequest := func(body io.Reader) *http.Request {
+		u := &fakeFailoverUpstream{tcpUpstream: tcpUpstream{forward: true}}
+		req := httptest.NewRequest(http.MethodPost, "/", body)
+		return req.WithContext(context.WithValue(req.Context(), upstreamContextKey, u))
+	}
+
+	t.Run("retry", func(t *testing.T) {
+		rt := &fakeRoundTripper{
+			responses: []*http.Response{
+				noUpstreamResponse(),
+				{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody},
+			},
+		}
+		transport := &failoverTransport{transport: rt}
+
+		resp, err := transport.RoundTrip(newRequest(nil))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 2, rt.requests)
+	})
+
+	t.Run("no fallbacks", func(t *testing.T) {
+		rt := &fakeRoundTripper{
+			responses: []*http.Response{
+				noUpstreamResponse(), noUpstreamResponse(), noUpstreamResponse(),
+			},
+		}
+		transport := &failoverTransport{transport: rt}
+
+		resp, err := transport.RoundTrip(newRequest(nil))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		// The header is stripped from the response to the client.
+		assert.Equal(t, "", resp.Header.Get(protocol.Headers{}.NoUpstream()))
+		assert.Equal(t, 2, rt.requests)
+	})
+
+	t.Run("body not replayable", func(t *testing.T) {
+		rt := &fakeRoundTripper{
+			responses: []*http.Response{noUpstreamResponse()},
+		}
+		transport := &failoverTransport{transport: rt}
+
+		req := newRequest(bytes.NewReader([]byte("foo")))
+		req.GetBody = nil
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Equal(t, 1, rt.requests)
+	})
+}
+
+// Tests requests forwarded to a node without an upstream for the endpoint,
+// such as when the cluster state is stale, are retried on another node.
+func TestServer_ForwardFailover(t *testing.T) {
+	// The node has no upstreams for the endpoint.
+	emptyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	emptyNode := NewServer(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return nil, false
+			},
+		},
+		config.Default().Proxy,
+		nil,
+		nil,
+		nil,
+		log.NewNopLogger(),
+	)
+	go func() {
+		require.NoError(t, emptyNode.Serve(emptyLn))
+	}()
+	defer emptyNode.Shutdown(context.TODO())
+
+	okNode := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			// nolint
+			w.Write([]byte("ok"))
+		},
+	))
+	defer okNode.Close()
+
+	state := cluster.NewState(&cluster.Node{
+		ID:     "local",
+		Status: cluster.NodeStatusActive,
+	}, log.NewNopLogger())
+	state.AddNode(&cluster.Node{
+		ID:        "empty",
+		Status:    cluster.NodeStatusActive,
+		ProxyAddr: emptyLn.Addr().String(),
+	})
+	state.AddNode(&cluster.Node{
+		ID:        "ok",
+		Status:    cluster.NodeStatusActive,
+		ProxyAddr: okNode.Listener.Addr().String(),
+	})
+	state.UpdateRemoteEndpoint("empty", "my-endpoint", 1)
+	state.UpdateRemoteEndpoint("ok", "my-endpoint", 1)
+	manager := upstream.NewLoadBalancedManager(state, nil)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := NewServer(
+		manager,
+		config.Default().Proxy,
+		nil,
+		nil,
+		nil,
+		log.NewNopLogger(),
+	)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	// Nodes are selected in a random order, so send enough requests that
+	// some are sent to the empty node first.
+	for i := 0; i != 20; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String(), nil)
+		req.Header.Set("x-piko-endpoint", "my-endpoint")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "ok", string(b))
+	}
+
+	metrics := manager.Metrics()
+	assert.Equal(t, 20.0, promtestutil.ToFloat64(
+		metrics.RemoteRequestsTotal.WithLabelValues("ok"),
+	))
+	emptyRequests := promtestutil.ToFloat64(
+		metrics.RemoteRequestsTotal.WithLabelValues("empty"),
+	)
+	assert.Greater(t, emptyRequests, 0.0)
+	assert.Equal(t, emptyRequests, promtestutil.ToFloat64(
+		metrics.ForwardFailuresTotal.WithLabelValues("empty"),
+	))
+}
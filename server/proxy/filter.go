@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/server/config"
+)
+
+// maxChallengeResponseSize is the maximum size of a challenge provider
+// response body returned to the client.
+const maxChallengeResponseSize = 1 << 20
+
+type filterMetrics struct {
+	// FilteredTotal is the number of rejected requests, labelled by reason
+	// ('user_agent', 'path' or 'challenge').
+	FilteredTotal *prometheus.CounterVec
+
+	// ChallengeErrorsTotal is the number of requests that failed to be
+	// verified with the challenge provider.
+	ChallengeErrorsTotal prometheus.Counter
+}
+
+func newFilterMetrics() *filterMetrics {
+	return &filterMetrics{
+		FilteredTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "filtered_requests_total",
+				Help:      "Number of requests rejected by the request filter",
+			},
+			[]string{"reason"},
+		),
+		ChallengeErrorsTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "challenge_errors_total",
+				Help:      "Number of requests that failed to be verified with the challenge provider",
+			},
+		),
+	}
+}
+
+func (m *filterMetrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.FilteredTotal,
+		m.ChallengeErrorsTotal,
+	)
+}
+
+// requestFilter rejects requests from internet scanners and bots before
+// they reach the upstream.
+//
+// Requests whose user agent or path match the configured block lists are
+// rejected with '403 Forbidden'. If a challenge provider is configured, the
+// remaining requests are verified with the provider, similar to 'forward
+// auth', so the provider can present a challenge to suspected bots.
+type requestFilter struct {
+	blockUserAgents []*regexp.Regexp
+	blockPaths      []*regexp.Regexp
+
+	challengeURL string
+	client       *http.Client
+
+	metrics *filterMetrics
+
+	headers protocol.Headers
+
+	logger log.Logger
+}
+
+func newRequestFilter(
+	conf config.FilterConfig,
+	headers protocol.Headers,
+	logger log.Logger,
+) *requestFilter {
+	f := &requestFilter{
+		challengeURL: conf.Challenge.URL,
+		client: &http.Client{
+			Timeout: conf.Challenge.Timeout,
+			// Return redirects to the client, such as redirecting to a
+			// challenge page.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		metrics: newFilterMetrics(),
+		headers: headers,
+		logger:  logger.WithSubsystem("proxy.filter"),
+	}
+	// The patterns are checked when the configuration is validated.
+	for _, pattern := range conf.BlockUserAgents {
+		f.blockUserAgents = append(f.blockUserAgents, regexp.MustCompile(pattern))
+	}
+	for _, pattern := range conf.BlockPaths {
+		f.blockPaths = append(f.blockPaths, regexp.MustCompile(pattern))
+	}
+	return f
+}
+
+func (f *requestFilter) Metrics() *filterMetrics {
+	return f.metrics
+}
+
+func (f *requestFilter) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Ignore internal endpoints, and requests forwarded from other
+		// nodes, which were filtered by the node that received them.
+		if strings.HasPrefix(c.Request.URL.Path, "/_piko") ||
+			c.Request.Header.Get(f.headers.Forward()) == "true" {
+			c.Next()
+			return
+		}
+
+		if matchAny(f.blockUserAgents, c.Request.UserAgent()) {
+			f.reject(c, "user_agent")
+			return
+		}
+		if matchAny(f.blockPaths, c.Request.URL.Path) {
+			f.reject(c, "path")
+			return
+		}
+
+		if f.challengeURL != "" && !f.verify(c) {
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func (f *requestFilter) reject(c *gin.Context, reason string) {
+	f.metrics.FilteredTotal.WithLabelValues(reason).Inc()
+	_ = errorResponse(c.Writer, http.StatusForbidden, "forbidden")
+	c.Abort()
+}
+
+// verify verifies the request with the challenge provider, returning true
+// if the request is allowed. Otherwise the response has been written.
+func (f *requestFilter) verify(c *gin.Context) bool {
+	resp, err := f.challenge(c.Request.Context(), c)
+	if err != nil {
+		f.metrics.ChallengeErrorsTotal.Inc()
+		f.logger.Warn("failed to verify request", zap.Error(err))
+		_ = errorResponse(
+			c.Writer, http.StatusServiceUnavailable, "challenge unavailable",
+		)
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return true
+	}
+
+	f.metrics.FilteredTotal.WithLabelValues("challenge").Inc()
+
+	// Return the challenge providers response to the client.
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			c.Writer.Header().Add(k, v)
+		}
+	}
+	c.Writer.WriteHeader(resp.StatusCode)
+	// nolint
+	io.Copy(c.Writer, io.LimitReader(resp.Body, maxChallengeResponseSize))
+	return false
+}
+
+func (f *requestFilter) challenge(ctx context.Context, c *gin.Context) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.challengeURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = c.Request.Header.Clone()
+	req.Header.Set("X-Forwarded-For", c.ClientIP())
+	req.Header.Set("X-Forwarded-Method", c.Request.Method)
+	req.Header.Set("X-Forwarded-Host", c.Request.Host)
+	req.Header.Set("X-Forwarded-Uri", c.Request.URL.RequestURI())
+	// Hop-by-hop and body headers don't apply to the challenge request.
+	req.Header.Del("Connection")
+	req.Header.Del("Upgrade")
+	req.Header.Del("Content-Length")
+	req.Header.Del("Transfer-Encoding")
+	return f.client.Do(req)
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/server/config"
+)
+
+func newFilterRouter(conf config.FilterConfig) *gin.Engine {
+	router := gin.New()
+	router.Use(newRequestFilter(conf, protocol.Headers{}, log.NewNopLogger()).Handler())
+	router.NoRoute(func(c *gin.Context) {
+		c.String(http.StatusOK, "upstream")
+	})
+	return router
+}
+
+func TestRequestFilter(t *testing.T) {
+	t.Run("block lists", func(t *testing.T) {
+		router := newFilterRouter(config.FilterConfig{
+			BlockUserAgents: []string{"(?i)masscan"},
+			BlockPaths:      []string{"^/wp-admin", `\.php$`},
+		})
+
+		request := func(path string, userAgent string) int {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("User-Agent", userAgent)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			return rec.Code
+		}
+
+		assert.Equal(t, http.StatusOK, request("/foo", "curl/8.0"))
+		assert.Equal(t, http.StatusForbidden, request("/foo", "Masscan/1.3"))
+		assert.Equal(t, http.StatusForbidden, request("/wp-admin/setup", "curl/8.0"))
+		assert.Equal(t, http.StatusForbidden, request("/index.php", "curl/8.0"))
+	})
+
+	t.Run("challenge", func(t *testing.T) {
+		provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/foo?bar=car", r.Header.Get("X-Forwarded-Uri"))
+			if r.Header.Get("Cookie") == "verified=true" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			w.Header().Set("Location", "https://challenge.example.com")
+			w.WriteHeader(http.StatusFound)
+		}))
+		defer provider.Close()
+
+		router := newFilterRouter(config.FilterConfig{
+			Challenge: config.ChallengeConfig{
+				URL:     provider.URL,
+				Timeout: time.Second,
+			},
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/foo?bar=car", nil)
+		req.Header.Set("Cookie", "verified=true")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "upstream", rec.Body.String())
+
+		// The challenge providers response is returned to the client.
+		req = httptest.NewRequest(http.MethodGet, "/foo?bar=car", nil)
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusFound, rec.Code)
+		assert.Equal(t, "https://challenge.example.com", rec.Header().Get("Location"))
+	})
+
+	t.Run("challenge unavailable", func(t *testing.T) {
+		provider := httptest.NewServer(http.NotFoundHandler())
+		provider.Close()
+
+		router := newFilterRouter(config.FilterConfig{
+			Challenge: config.ChallengeConfig{
+				URL:     provider.URL,
+				Timeout: time.Second,
+			},
+		})
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/foo", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	})
+}
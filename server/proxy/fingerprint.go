@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/pkg/fingerprint"
+	"github.com/andydunstall/piko/server/status"
+)
+
+// defaultFingerprintsLimit is the default maximum number of fingerprints
+// returned by the admin API.
+const defaultFingerprintsLimit = 100
+
+// FingerprintStatus is the admin handler to query the TLS client fingerprints
+// of downstream clients.
+type FingerprintStatus struct {
+	table *fingerprint.Table
+}
+
+func (s *FingerprintStatus) Register(group *gin.RouterGroup) {
+	group.GET("/fingerprints", s.listFingerprintsRoute)
+}
+
+// listFingerprintsRoute lists the most common fingerprints, optionally
+// filtered by 'ja3' and 'ja4', and limited to 'limit' entries.
+func (s *FingerprintStatus) listFingerprintsRoute(c *gin.Context) {
+	limit := defaultFingerprintsLimit
+	if v := c.Query("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+	}
+
+	entries := s.table.List(fingerprint.Fingerprint{
+		JA3: c.Query("ja3"),
+		JA4: c.Query("ja4"),
+	}, limit)
+	c.JSON(http.StatusOK, entries)
+}
+
+var _ status.Handler = &FingerprintStatus{}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andydunstall/piko/pkg/protocol"
+)
+
+const (
+	// maxForwardHops is the maximum number of times a request can be
+	// forwarded between nodes.
+	maxForwardHops = 1
+
+	// maxForwardSkew is the maximum age of a signed request. Nonces are
+	// only remembered for this window, so older signatures are rejected.
+	maxForwardSkew = time.Minute
+
+	forwardNonceSize = 16
+)
+
+var (
+	errMissingForwardSignature  = errors.New("missing signature")
+	errInvalidForwardSignature  = errors.New("invalid signature")
+	errExpiredForwardSignature  = errors.New("expired signature")
+	errReplayedForwardSignature = errors.New("replayed signature")
+)
+
+// forwardMetadata contains the routing metadata of a request forwarded
+// between nodes.
+type forwardMetadata struct {
+	// EndpointID is the endpoint the request is routed to.
+	EndpointID string
+	// ClientIP is the IP of the original client.
+	ClientIP string
+	// Hops is the number of nodes the request has been forwarded by.
+	Hops int
+}
+
+// ForwardSigner signs the routing metadata of requests forwarded between
+// nodes, so downstream clients can't spoof intra-cluster metadata such as
+// bypassing the hop limit or the original client IP.
+//
+// The signature covers the request method and URI, and a random nonce, so a
+// signature can't be reused for a different request. Each node remembers the
+// nonces it has verified within the allowed clock skew, so a signed request
+// can't be replayed to the same node.
+//
+// All nodes in the cluster must be configured with the same key.
+type ForwardSigner struct {
+	key []byte
+
+	headers protocol.Headers
+
+	// nonces contains the verified nonces and when they were verified.
+	nonces    map[string]time.Time
+	lastPrune time.Time
+	mu        sync.Mutex
+
+	// now returns the current time. Overridden in tests.
+	now func() time.Time
+}
+
+func NewForwardSigner(key []byte, headers protocol.Headers) *ForwardSigner {
+	return &ForwardSigner{
+		key:     key,
+		headers: headers,
+		nonces:  make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+// Sign adds the signed metadata to the request headers.
+func (s *ForwardSigner) Sign(r *http.Request, md forwardMetadata) {
+	timestamp := strconv.FormatInt(s.now().Unix(), 10)
+	nonce := newForwardNonce()
+
+	r.Header.Set(s.headers.Forward(), "true")
+	r.Header.Set(s.headers.ForwardClientIP(), md.ClientIP)
+	r.Header.Set(s.headers.ForwardHops(), strconv.Itoa(md.Hops))
+	r.Header.Set(s.headers.ForwardTimestamp(), timestamp)
+	r.Header.Set(s.headers.ForwardNonce(), nonce)
+	r.Header.Set(s.headers.ForwardSignature(), s.signature(r, md, timestamp, nonce))
+}
+
+// Verify verifies the signed metadata in the request headers for the given
+// endpoint.
+func (s *ForwardSigner) Verify(r *http.Request, endpointID string) (forwardMetadata, error) {
+	signature := r.Header.Get(s.headers.ForwardSignature())
+	if signature == "" {
+		return forwardMetadata{}, errMissingForwardSignature
+	}
+
+	hops, err := strconv.Atoi(r.Header.Get(s.headers.ForwardHops()))
+	if err != nil {
+		return forwardMetadata{}, fmt.Errorf("invalid hops: %w", err)
+	}
+	md := forwardMetadata{
+		EndpointID: endpointID,
+		ClientIP:   r.Header.Get(s.headers.ForwardClientIP()),
+		Hops:       hops,
+	}
+
+	timestamp := r.Header.Get(s.headers.ForwardTimestamp())
+	nonce := r.Header.Get(s.headers.ForwardNonce())
+	expected := s.signature(r, md, timestamp, nonce)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return forwardMetadata{}, errInvalidForwardSignature
+	}
+
+	// Only check the timestamp and nonce once the signature is verified.
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return forwardMetadata{}, fmt.Errorf("invalid timestamp: %w", err)
+	}
+	age := s.now().Sub(time.Unix(unix, 0))
+	if age > maxForwardSkew || age < -maxForwardSkew {
+		return forwardMetadata{}, errExpiredForwardSignature
+	}
+	if !s.useNonce(nonce) {
+		return forwardMetadata{}, errReplayedForwardSignature
+	}
+
+	return md, nil
+}
+
+// useNonce records the nonce as used, returning false if it was already used.
+func (s *ForwardSigner) useNonce(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	// Nonces older than twice the skew can't be replayed as the timestamp
+	// would have expired.
+	if now.Sub(s.lastPrune) > maxForwardSkew {
+		for n, verifiedAt := range s.nonces {
+			if now.Sub(verifiedAt) > maxForwardSkew*2 {
+				delete(s.nonces, n)
+			}
+		}
+		s.lastPrune = now
+	}
+
+	if _, ok := s.nonces[nonce]; ok {
+		return false
+	}
+	s.nonces[nonce] = now
+	return true
+}
+
+func (s *ForwardSigner) signature(
+	r *http.Request,
+	md forwardMetadata,
+	timestamp string,
+	nonce string,
+) string {
+	mac := hmac.New(sha256.New, s.key)
+	// Use newlines as a separator, which can't be included in header values
+	// or the request line.
+	mac.Write([]byte(strings.Join([]string{
+		r.Method,
+		r.URL.RequestURI(),
+		md.EndpointID,
+		md.ClientIP,
+		strconv.Itoa(md.Hops),
+		timestamp,
+		nonce,
+	}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newForwardNonce() string {
+	b := make([]byte, forwardNonceSize)
+	if _, err := rand.Read(b); err != nil {
+		panic("read rand: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// stripForwardHeaders removes all forward metadata from the request headers.
+func stripForwardHeaders(h http.Header, headers protocol.Headers) {
+	h.Del(headers.Forward())
+	h.Del(headers.ForwardClientIP())
+	h.Del(headers.ForwardHops())
+	h.Del(headers.ForwardTimestamp())
+	h.Del(headers.ForwardNonce())
+	h.Del(headers.ForwardSignature())
+}
+
+// restoreClientIP replaces the forwarding node with the verified original
+// client, so the upstream sees the same client address as if the request
+// hadn't been forwarded.
+//
+// The forwarding node appended the client IP to X-Forwarded-For, so that
+// entry is removed as the proxy appends the (now restored) remote IP again.
+func restoreClientIP(r *http.Request, clientIP string) {
+	if clientIP == "" {
+		return
+	}
+
+	_, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		port = "0"
+	}
+	r.RemoteAddr = net.JoinHostPort(clientIP, port)
+
+	forwardedFor := r.Header.Values("X-Forwarded-For")
+	if len(forwardedFor) == 0 {
+		return
+	}
+	last := forwardedFor[len(forwardedFor)-1]
+	prior, lastIP := "", last
+	if i := strings.LastIndex(last, ","); i != -1 {
+		prior, lastIP = last[:i], last[i+1:]
+	}
+	if strings.TrimSpace(lastIP) != clientIP {
+		return
+	}
+
+	forwardedFor = forwardedFor[:len(forwardedFor)-1]
+	if prior != "" {
+		forwardedFor = append(forwardedFor, prior)
+	}
+	if len(forwardedFor) == 0 {
+		r.Header.Del("X-Forwarded-For")
+		return
+	}
+	r.Header["X-Forwarded-For"] = forwardedFor
+}
+
+// remoteIP returns the IP of the remote address of the request.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/protocol"
+)
+
+func TestForwardSigner(t *testing.T) {
+	md := forwardMetadata{
+		EndpointID: "my-endpoint",
+		ClientIP:   "1.2.3.4",
+		Hops:       1,
+	}
+
+	newRequest := func() *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/foo?bar=car", nil)
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		signer := NewForwardSigner([]byte("secret"), protocol.Headers{})
+
+		r := newRequest()
+		signer.Sign(r, md)
+
+		verified, err := signer.Verify(r, "my-endpoint")
+		require.NoError(t, err)
+		assert.Equal(t, md, verified)
+
+		stripForwardHeaders(r.Header, protocol.Headers{})
+		assert.Empty(t, r.Header)
+	})
+
+	t.Run("missing signature", func(t *testing.T) {
+		signer := NewForwardSigner([]byte("secret"), protocol.Headers{})
+
+		r := newRequest()
+		r.Header.Set(protocol.Headers{}.Forward(), "true")
+		r.Header.Set(protocol.Headers{}.ForwardHops(), "0")
+
+		_, err := signer.Verify(r, "my-endpoint")
+		assert.ErrorIs(t, err, errMissingForwardSignature)
+	})
+
+	t.Run("modified metadata", func(t *testing.T) {
+		signer := NewForwardSigner([]byte("secret"), protocol.Headers{})
+
+		r := newRequest()
+		signer.Sign(r, md)
+		r.Header.Set(protocol.Headers{}.ForwardHops(), "0")
+
+		_, err := signer.Verify(r, "my-endpoint")
+		assert.ErrorIs(t, err, errInvalidForwardSignature)
+	})
+
+	t.Run("different endpoint", func(t *testing.T) {
+		signer := NewForwardSigner([]byte("secret"), protocol.Headers{})
+
+		r := newRequest()
+		signer.Sign(r, md)
+
+		_, err := signer.Verify(r, "other-endpoint")
+		assert.ErrorIs(t, err, errInvalidForwardSignature)
+	})
+
+	t.Run("different request", func(t *testing.T) {
+		signer := NewForwardSigner([]byte("secret"), protocol.Headers{})
+
+		r := newRequest()
+		signer.Sign(r, md)
+
+		// Moving the signed headers to a request with a different method or
+		// URI must fail verification.
+		other := httptest.NewRequest(http.MethodPost, "/foo?bar=car", nil)
+		other.Header = r.Header.Clone()
+		_, err := signer.Verify(other, "my-endpoint")
+		assert.ErrorIs(t, err, errInvalidForwardSignature)
+
+		other = httptest.NewRequest(http.MethodGet, "/admin", nil)
+		other.Header = r.Header.Clone()
+		_, err = signer.Verify(other, "my-endpoint")
+		assert.ErrorIs(t, err, errInvalidForwardSignature)
+	})
+
+	t.Run("different key", func(t *testing.T) {
+		r := newRequest()
+		NewForwardSigner([]byte("secret"), protocol.Headers{}).Sign(r, md)
+
+		_, err := NewForwardSigner([]byte("other"), protocol.Headers{}).Verify(r, "my-endpoint")
+		assert.ErrorIs(t, err, errInvalidForwardSignature)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		signer := NewForwardSigner([]byte("secret"), protocol.Headers{})
+
+		r := newRequest()
+		signer.Sign(r, md)
+
+		signer.now = func() time.Time {
+			return time.Now().Add(maxForwardSkew * 2)
+		}
+		_, err := signer.Verify(r, "my-endpoint")
+		assert.ErrorIs(t, err, errExpiredForwardSignature)
+	})
+
+	t.Run("replayed", func(t *testing.T) {
+		signer := NewForwardSigner([]byte("secret"), protocol.Headers{})
+
+		r := newRequest()
+		signer.Sign(r, md)
+
+		_, err := signer.Verify(r, "my-endpoint")
+		require.NoError(t, err)
+
+		_, err = signer.Verify(r, "my-endpoint")
+		assert.ErrorIs(t, err, errReplayedForwardSignature)
+	})
+
+	t.Run("prune nonces", func(t *testing.T) {
+		signer := NewForwardSigner([]byte("secret"), protocol.Headers{})
+
+		r := newRequest()
+		signer.Sign(r, md)
+		_, err := signer.Verify(r, "my-endpoint")
+		require.NoError(t, err)
+		assert.Len(t, signer.nonces, 1)
+
+		signer.now = func() time.Time {
+			return time.Now().Add(maxForwardSkew * 3)
+		}
+		assert.True(t, signer.useNonce("other"))
+		assert.Len(t, signer.nonces, 1)
+	})
+}
+
+func TestRestoreClientIP(t *testing.T) {
+	tests := []struct {
+		name         string
+		forwardedFor []string
+		expected     []string
+	}{
+		{
+			name:         "single",
+			forwardedFor: []string{"1.2.3.4"},
+			expected:     nil,
+		},
+		{
+			name:         "list",
+			forwardedFor: []string{"10.0.0.1, 1.2.3.4"},
+			expected:     []string{"10.0.0.1"},
+		},
+		{
+			name:         "multiple headers",
+			forwardedFor: []string{"10.0.0.1", "1.2.3.4"},
+			expected:     []string{"10.0.0.1"},
+		},
+		{
+			// The last entry doesn't match so isn't removed.
+			name:         "mismatch",
+			forwardedFor: []string{"10.0.0.1"},
+			expected:     []string{"10.0.0.1"},
+		},
+		{
+			name:     "none",
+			expected: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "10.26.104.56:8000"
+			for _, v := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+
+			restoreClientIP(r, "1.2.3.4")
+
+			assert.Equal(t, "1.2.3.4:8000", r.RemoteAddr)
+			assert.Equal(t, tt.expected, r.Header.Values("X-Forwarded-For"))
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+// hstsMiddleware adds the 'Strict-Transport-Security' header to HTTPS
+// responses for the configured endpoints and domains.
+//
+// The header is added before the request is proxied, so if the upstream
+// also sends the header Piko's header is first, which is the only header
+// browsers process (RFC 6797 section 8.1).
+func hstsMiddleware(
+	conf config.HSTSConfig,
+	endpointID func(r *http.Request) string,
+) gin.HandlerFunc {
+	value := "max-age=" + strconv.FormatInt(int64(conf.MaxAge.Seconds()), 10)
+	if conf.IncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if conf.Preload {
+		value += "; preload"
+	}
+
+	endpoints := make(map[string]struct{})
+	for _, endpoint := range conf.Endpoints {
+		endpoints[endpoint] = struct{}{}
+	}
+	restricted := len(conf.Endpoints) > 0 || len(conf.Domains) > 0
+
+	return func(c *gin.Context) {
+		// HSTS must only be sent over HTTPS.
+		if c.Request.TLS == nil {
+			return
+		}
+
+		if restricted {
+			_, ok := endpoints[endpointID(c.Request)]
+			if !ok && !matchDomains(conf.Domains, c.Request.Host) {
+				return
+			}
+		}
+
+		c.Header("Strict-Transport-Security", value)
+	}
+}
+
+// matchDomains returns whether the host matches one of the domains, where
+// domains starting with '*.' match any subdomain.
+func matchDomains(domains []string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	for _, domain := range domains {
+		domain = strings.ToLower(domain)
+		if suffix, ok := strings.CutPrefix(domain, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+			continue
+		}
+		if host == domain {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+func TestHSTSMiddleware(t *testing.T) {
+	serve := func(conf config.HSTSConfig, host string, https bool) string {
+		router := gin.New()
+		router.Use(hstsMiddleware(conf, defaultEndpointID))
+		router.NoRoute(func(c *gin.Context) {
+			// Upstream header is ignored by browsers as Piko's is first.
+			c.Writer.Header().Add("Strict-Transport-Security", "max-age=0")
+			c.Status(http.StatusOK)
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		if https {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Header().Get("Strict-Transport-Security")
+	}
+
+	t.Run("all requests", func(t *testing.T) {
+		conf := config.HSTSConfig{
+			MaxAge: time.Hour * 24 * 365,
+		}
+		assert.Equal(t, "max-age=31536000", serve(conf, "my-endpoint.piko.example.com", true))
+	})
+
+	t.Run("directives", func(t *testing.T) {
+		conf := config.HSTSConfig{
+			MaxAge:            time.Hour * 24 * 365,
+			IncludeSubdomains: true,
+			Preload:           true,
+		}
+		assert.Equal(
+			t,
+			"max-age=31536000; includeSubDomains; preload",
+			serve(conf, "my-endpoint.piko.example.com", true),
+		)
+	})
+
+	t.Run("plain http", func(t *testing.T) {
+		conf := config.HSTSConfig{
+			MaxAge: time.Hour,
+		}
+		// Overridden by the upstream header.
+		assert.Equal(t, "max-age=0", serve(conf, "my-endpoint.piko.example.com", false))
+	})
+
+	t.Run("endpoints", func(t *testing.T) {
+		conf := config.HSTSConfig{
+			MaxAge:    time.Hour,
+			Endpoints: []string{"my-endpoint"},
+		}
+		assert.Equal(t, "max-age=3600", serve(conf, "my-endpoint.piko.example.com", true))
+		assert.Equal(t, "max-age=0", serve(conf, "other-endpoint.piko.example.com", true))
+	})
+
+	t.Run("domains", func(t *testing.T) {
+		conf := config.HSTSConfig{
+			MaxAge:  time.Hour,
+			Domains: []string{"app.example.com", "*.example.org"},
+		}
+		assert.Equal(t, "max-age=3600", serve(conf, "APP.example.com:443", true))
+		assert.Equal(t, "max-age=3600", serve(conf, "foo.example.org", true))
+		assert.Equal(t, "max-age=0", serve(conf, "example.org", true))
+		assert.Equal(t, "max-age=0", serve(conf, "other.example.com", true))
+	})
+}
@@ -2,17 +2,27 @@ package proxy
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
 	"github.com/andydunstall/piko/server/upstream"
 )
 
@@ -21,8 +31,82 @@ type contextKey int
 const (
 	endpointContextKey contextKey = iota
 	upstreamContextKey
+	startContextKey
+	requestIDContextKey
 )
 
+type httpProxyMetrics struct {
+	// TunnelLatency is the latency of proxied requests excluding the time
+	// spent in the upstream service, which includes the time between the
+	// server and agent in both directions.
+	TunnelLatency prometheus.Histogram
+
+	// UpstreamLatency is the time between the agent forwarding a request to
+	// its upstream service and receiving the response headers, as reported
+	// by the agent.
+	UpstreamLatency prometheus.Histogram
+
+	// InformationalResponsesTotal is the number of 1xx informational
+	// responses received from upstreams, such as '100 Continue' and
+	// '103 Early Hints', labelled by status.
+	InformationalResponsesTotal *prometheus.CounterVec
+
+	// InvalidResponsesTotal is the number of invalid responses from
+	// upstreams, labelled by endpoint ID and reason ('content_length_mismatch',
+	// 'malformed_chunked' or 'malformed_headers').
+	InvalidResponsesTotal *prometheus.CounterVec
+}
+
+func newHTTPProxyMetrics() *httpProxyMetrics {
+	return &httpProxyMetrics{
+		TunnelLatency: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "tunnel_latency_seconds",
+				Help:      "Latency of proxied requests excluding the time spent in the upstream service",
+				Buckets:   prometheus.DefBuckets,
+			},
+		),
+		UpstreamLatency: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "upstream_latency_seconds",
+				Help:      "Latency of the upstream service as reported by the agent",
+				Buckets:   prometheus.DefBuckets,
+			},
+		),
+		InformationalResponsesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "informational_responses_total",
+				Help:      "Number of 1xx informational responses received from upstreams",
+			},
+			[]string{"status"},
+		),
+		InvalidResponsesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "invalid_upstream_responses_total",
+				Help:      "Number of invalid responses from upstreams",
+			},
+			[]string{"endpoint", "reason"},
+		),
+	}
+}
+
+func (m *httpProxyMetrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.TunnelLatency,
+		m.UpstreamLatency,
+		m.InformationalResponsesTotal,
+		m.InvalidResponsesTotal,
+	)
+}
+
 // HTTPProxy proxies HTTP traffic to upsteam listeners.
 type HTTPProxy struct {
 	upstreams upstream.Manager
@@ -31,17 +115,33 @@ type HTTPProxy struct {
 
 	timeout time.Duration
 
+	// signer signs and verifies requests forwarded between nodes. If nil,
+	// forwarded requests aren't signed.
+	signer *ForwardSigner
+
+	headers protocol.Headers
+
+	// affinity is nil if sticky sessions are disabled.
+	affinity *affinity
+
+	metrics *httpProxyMetrics
+
 	logger log.Logger
 }
 
 func NewHTTPProxy(
 	upstreams upstream.Manager,
 	timeout time.Duration,
+	signer *ForwardSigner,
+	headers protocol.Headers,
 	logger log.Logger,
 ) *HTTPProxy {
 	rp := &HTTPProxy{
 		upstreams: upstreams,
 		timeout:   timeout,
+		signer:    signer,
+		headers:   headers,
+		metrics:   newHTTPProxyMetrics(),
 		logger:    logger.WithSubsystem("proxy.http"),
 	}
 
@@ -50,84 +150,319 @@ func NewHTTPProxy(
 			req.URL.Scheme = "http"
 			req.URL.Host = req.Context().Value(endpointContextKey).(string)
 		},
-		Transport: &http.Transport{
-			DialContext: rp.dialUpstream,
-			// 'connections' to the upstream are multiplexed over a single TCP
-			// connection so theres no overhead to creating new connections,
-			// therefore it doesn't make sense to keep them alive.
-			DisableKeepAlives: true,
+		Transport: &failoverTransport{
+			transport: &http.Transport{
+				DialContext: rp.dialUpstream,
+				// 'connections' to the upstream are multiplexed over a single
+				// TCP connection so theres no overhead to creating new
+				// connections, therefore it doesn't make sense to keep them
+				// alive.
+				DisableKeepAlives: true,
+				// Wait for the upstream to respond with '100 Continue'
+				// before sending the request body, so the client only sends
+				// the body if the upstream accepts the request.
+				ExpectContinueTimeout: time.Second,
+			},
+			headers: headers,
 		},
-		ErrorLog:     logger.StdLogger(zapcore.WarnLevel),
-		ErrorHandler: rp.errorHandler,
+		ErrorLog:       logger.StdLogger(zapcore.WarnLevel),
+		ErrorHandler:   rp.errorHandler,
+		ModifyResponse: rp.modifyResponse,
 	}
 
 	return rp
 }
 
+func (p *HTTPProxy) Metrics() *httpProxyMetrics {
+	return p.metrics
+}
+
 func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, endpointID string) {
+	hops := p.forwardHops(r, endpointID)
 	// Whether the request was forwarded from another Piko node.
-	forwarded := r.Header.Get("x-piko-forward") == "true"
+	forwarded := hops >= maxForwardHops
+	if hops == 0 {
+		// Only trust the request ID if assigned by another node.
+		r.Header.Del(p.headers.RequestID())
+	}
 
 	// If there is a connected upstream, attempt to forward the request to one
 	// of those upstreams. Note this includes remote nodes that are reporting
 	// they have an available upstream. We don't allow multiple hops, so if
 	// forwarded is true we only select from local nodes.
-	upstream, ok := p.upstreams.Select(endpointID, !forwarded)
+	upstream, ok := p.selectUpstream(w, r, endpointID, forwarded)
 	if !ok {
+		requestID := ensureRequestID(r, p.headers)
 		p.logger.Warn(
 			"no available upstreams",
 			zap.String("endpoint-id", endpointID),
+			zap.String("request-id", requestID),
 		)
 
-		_ = errorResponse(w, http.StatusBadGateway, "no available upstreams")
+		if forwarded {
+			// Let the forwarding node retry another node.
+			w.Header().Set(p.headers.NoUpstream(), "true")
+		}
+		_ = proxyErrorResponse(
+			w, http.StatusBadGateway, noUpstreamsMessage(p.upstreams, endpointID), p.headers, requestID, "",
+		)
 		return
 	}
 
 	p.ServeHTTPWithUpstream(w, r, endpointID, upstream)
 }
 
+// selectUpstream selects an upstream for the request, preferring the
+// upstream the request has affinity with if sticky sessions are enabled for
+// the endpoint.
+func (p *HTTPProxy) selectUpstream(
+	w http.ResponseWriter,
+	r *http.Request,
+	endpointID string,
+	forwarded bool,
+) (upstream.Upstream, bool) {
+	if p.affinity == nil || !p.affinity.conf.Permitted(endpointID) {
+		return p.upstreams.Select(endpointID, !forwarded)
+	}
+
+	if u, ok := p.affinity.lookup(r, endpointID); ok {
+		return u, true
+	}
+	u, ok := p.upstreams.Select(endpointID, !forwarded)
+	if ok {
+		p.affinity.stick(w, r, u)
+	}
+	return u, ok
+}
+
 func (p *HTTPProxy) ServeHTTPWithUpstream(
 	w http.ResponseWriter,
 	r *http.Request,
 	endpointID string,
 	upstream upstream.Upstream,
 ) {
-	if p.timeout != 0 && r.Header.Get("upgrade") != "websocket" {
+	if p.timeout != 0 && !middleware.IsUpgrade(r) {
 		ctx, cancel := context.WithTimeout(r.Context(), p.timeout)
 		defer cancel()
 
 		r = r.WithContext(ctx)
 	}
 
-	r.Header.Set("x-piko-forward", "true")
+	p.addForwardHeaders(r, endpointID, upstream.Forward())
+
+	requestID := ensureRequestID(r, p.headers)
+	// The connection ID is only added by the node the upstream is connected
+	// to.
+	r.Header.Del(p.headers.ConnectionID())
+	if !upstream.Forward() {
+		r.Header.Set(p.headers.ConnectionID(), upstream.ID())
+	}
 
 	r = r.WithContext(context.WithValue(r.Context(), endpointContextKey, endpointID))
 
+	r = r.WithContext(context.WithValue(r.Context(), requestIDContextKey, requestID))
+
 	// Add the upstream to the context to pass to 'DialContext'.
 	r = r.WithContext(context.WithValue(r.Context(), upstreamContextKey, upstream))
 
+	r = r.WithContext(context.WithValue(r.Context(), startContextKey, time.Now()))
+
+	w = middleware.NewInformationalWriter(w, func(status int) {
+		p.metrics.InformationalResponsesTotal.WithLabelValues(
+			strconv.Itoa(status),
+		).Inc()
+	})
+
 	p.proxy.ServeHTTP(w, r)
 }
 
+// forwardHops returns the number of nodes the request has been forwarded by,
+// then strips the forward metadata from the request.
+//
+// If signing is enabled, requests with missing or invalid signatures are
+// treated as not forwarded, and requests with a valid signature have their
+// remote address restored to the original client IP.
+//
+// If signing is disabled, the unsigned 'x-piko-forward' header is trusted
+// as in earlier versions, so a client could set the header itself to stop its
+// request being forwarded to another node.
+func (p *HTTPProxy) forwardHops(r *http.Request, endpointID string) int {
+	defer stripForwardHeaders(r.Header, p.headers)
+
+	if r.Header.Get(p.headers.Forward()) != "true" {
+		return 0
+	}
+	if p.signer == nil {
+		return 1
+	}
+
+	md, err := p.signer.Verify(r, endpointID)
+	if err != nil {
+		p.logger.Warn(
+			"forwarded request failed verification",
+			zap.String("endpoint-id", endpointID),
+			zap.String("remote-addr", r.RemoteAddr),
+			zap.Error(err),
+		)
+		return 0
+	}
+	restoreClientIP(r, md.ClientIP)
+	return md.Hops
+}
+
+// addForwardHeaders adds the forward metadata to a request sent to an
+// upstream.
+//
+// All requests include the 'x-piko-forward' header, though only requests
+// forwarded to another node are signed.
+func (p *HTTPProxy) addForwardHeaders(r *http.Request, endpointID string, remote bool) {
+	if p.signer == nil || !remote {
+		r.Header.Set(p.headers.Forward(), "true")
+		return
+	}
+
+	// Requests are only forwarded to another node if they haven't already
+	// been forwarded, so the hop count is always one.
+	p.signer.Sign(r, forwardMetadata{
+		EndpointID: endpointID,
+		ClientIP:   remoteIP(r),
+		Hops:       1,
+	})
+}
+
 func (p *HTTPProxy) dialUpstream(ctx context.Context, _, _ string) (net.Conn, error) {
 	// As a bit of a hack to work with http.Transport, we add the upstream
 	// to the dial context.
-	upstream := ctx.Value(upstreamContextKey).(upstream.Upstream)
-	return upstream.Dial()
+	u := ctx.Value(upstreamContextKey).(upstream.Upstream)
+	if u, ok := u.(contextUpstream); ok {
+		return u.DialContext(ctx)
+	}
+	return u.Dial()
+}
+
+// contextUpstream is an upstream that can be dialled with the request
+// context, so dialling is cancelled with the request.
+type contextUpstream interface {
+	DialContext(ctx context.Context) (net.Conn, error)
 }
 
-func (p *HTTPProxy) errorHandler(w http.ResponseWriter, _ *http.Request, err error) {
-	p.logger.Warn("proxy request", zap.Error(err))
+// modifyResponse adds the request ID to the response, validates the
+// response body, and records the tunnel and upstream latency of the request,
+// using the upstream duration reported by the agent, then removes the
+// duration from the response.
+//
+// Responses without a valid upstream duration, such as from older agents or
+// requests forwarded to another node (which records the latency itself), are
+// ignored.
+func (p *HTTPProxy) modifyResponse(resp *http.Response) error {
+	if requestID, ok := resp.Request.Context().Value(requestIDContextKey).(string); ok {
+		resp.Header.Set(p.headers.RequestID(), requestID)
+	}
+
+	// Upgraded connections require the body to be an io.ReadWriteCloser, and
+	// have no framing to validate.
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = &validatingBody{
+			ReadCloser: resp.Body,
+			resp:       resp,
+			proxy:      p,
+		}
+	}
+
+	value := resp.Header.Get(p.headers.UpstreamDuration())
+	resp.Header.Del(p.headers.UpstreamDuration())
+	if value == "" {
+		return nil
+	}
+
+	start, ok := resp.Request.Context().Value(startContextKey).(time.Time)
+	if !ok {
+		return nil
+	}
+	upstreamDuration, ok := protocol.ParseSeconds(value)
+	if !ok {
+		return nil
+	}
+	total := time.Since(start)
+	// Clamp in case the agent reports a duration longer than the request,
+	// which should never happen.
+	upstreamDuration = min(upstreamDuration, total)
+
+	p.metrics.UpstreamLatency.Observe(upstreamDuration.Seconds())
+	p.metrics.TunnelLatency.Observe((total - upstreamDuration).Seconds())
+	return nil
+}
+
+// errorHandler responds with the request ID and ID of the upstream the
+// request was sent to, so failures reported by users can be matched to the
+// server and agent logs.
+func (p *HTTPProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	endpointID, requestID, upstreamID := requestIDs(r)
+
+	if isMalformedResponse(err) {
+		p.invalidResponse(
+			endpointID, requestID, upstreamID, invalidReasonMalformedHeaders, err,
+		)
+		_ = proxyErrorResponse(
+			w, http.StatusBadGateway, "invalid upstream response", p.headers, requestID, upstreamID,
+		)
+		return
+	}
+
+	p.logger.Warn(
+		"proxy request",
+		zap.String("endpoint-id", endpointID),
+		zap.String("request-id", requestID),
+		zap.String("upstream-id", upstreamID),
+		zap.Error(err),
+	)
 
 	if errors.Is(err, context.DeadlineExceeded) {
-		_ = errorResponse(w, http.StatusGatewayTimeout, "upstream timeout")
+		_ = proxyErrorResponse(
+			w, http.StatusGatewayTimeout, "upstream timeout", p.headers, requestID, upstreamID,
+		)
 		return
 	}
-	_ = errorResponse(w, http.StatusBadGateway, "upstream unreachable")
+	if errors.Is(err, upstream.ErrStreamLimit) {
+		_ = proxyErrorResponse(
+			w, http.StatusServiceUnavailable, "upstream stream limit reached", p.headers, requestID, upstreamID,
+		)
+		return
+	}
+	_ = proxyErrorResponse(
+		w, http.StatusBadGateway, "upstream unreachable", p.headers, requestID, upstreamID,
+	)
+}
+
+// lastSeenManager is an upstream manager that remembers endpoints whose
+// upstreams recently disconnected.
+type lastSeenManager interface {
+	LastSeen(endpointID string) (time.Time, bool)
+}
+
+// noUpstreamsMessage returns the error message when there are no available
+// upstreams for the endpoint, including when the endpoint was last seen if
+// it recently went offline.
+func noUpstreamsMessage(upstreams upstream.Manager, endpointID string) string {
+	m, ok := upstreams.(lastSeenManager)
+	if !ok {
+		return "no available upstreams"
+	}
+	lastSeen, ok := m.LastSeen(endpointID)
+	if !ok {
+		return "no available upstreams"
+	}
+	return fmt.Sprintf(
+		"endpoint recently went offline (last seen %s ago)",
+		time.Since(lastSeen).Round(time.Second),
+	)
 }
 
 type errorMessage struct {
 	Error string `json:"error"`
+	// RequestID and UpstreamID are only set for errors proxying requests.
+	RequestID  string `json:"request_id,omitempty"`
+	UpstreamID string `json:"upstream_id,omitempty"`
 }
 
 func errorResponse(w http.ResponseWriter, statusCode int, message string) error {
@@ -140,3 +475,144 @@ func errorResponse(w http.ResponseWriter, statusCode int, message string) error
 	}
 	return json.NewEncoder(w).Encode(m)
 }
+
+// proxyErrorResponse responds with an error proxying a request, including the
+// request ID and the ID of the upstream the request was sent to, if any.
+func proxyErrorResponse(
+	w http.ResponseWriter,
+	statusCode int,
+	message string,
+	headers protocol.Headers,
+	requestID string,
+	upstreamID string,
+) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if requestID != "" {
+		w.Header().Set(headers.RequestID(), requestID)
+	}
+	w.WriteHeader(statusCode)
+
+	m := &errorMessage{
+		Error:      message,
+		RequestID:  requestID,
+		UpstreamID: upstreamID,
+	}
+	return json.NewEncoder(w).Encode(m)
+}
+
+// ensureRequestID returns the ID of the request, assigning a new ID if the
+// request doesn't have one.
+func ensureRequestID(r *http.Request, headers protocol.Headers) string {
+	if requestID := r.Header.Get(headers.RequestID()); requestID != "" {
+		return requestID
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("read rand: " + err.Error())
+	}
+	requestID := hex.EncodeToString(b)
+	r.Header.Set(headers.RequestID(), requestID)
+	return requestID
+}
+
+const (
+	invalidReasonContentLength    = "content_length_mismatch"
+	invalidReasonMalformedChunked = "malformed_chunked"
+	invalidReasonMalformedHeaders = "malformed_headers"
+)
+
+// invalidResponse records an invalid response from an upstream, so flaky
+// upstream services can be identified.
+func (p *HTTPProxy) invalidResponse(
+	endpointID string,
+	requestID string,
+	upstreamID string,
+	reason string,
+	err error,
+) {
+	p.metrics.InvalidResponsesTotal.With(prometheus.Labels{
+		"endpoint": endpointID,
+		"reason":   reason,
+	}).Inc()
+	p.logger.Warn(
+		"invalid upstream response",
+		zap.String("endpoint-id", endpointID),
+		zap.String("request-id", requestID),
+		zap.String("upstream-id", upstreamID),
+		zap.String("reason", reason),
+		zap.Error(err),
+	)
+}
+
+// validatingBody detects upstream response bodies that are shorter than
+// their 'Content-Length' or have malformed chunked encoding.
+//
+// By the time the body is read the response headers have been written, so
+// the error can't be returned to the client. Instead the read error aborts
+// the response, so the client sees a truncated response rather than a
+// response that appears complete.
+//
+// Bodies longer than their 'Content-Length' are truncated to the declared
+// length by the transport, so never reach the client.
+type validatingBody struct {
+	io.ReadCloser
+
+	resp     *http.Response
+	proxy    *HTTPProxy
+	reported bool
+}
+
+func (b *validatingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && !b.reported {
+		if reason, ok := b.invalidReason(err); ok {
+			b.reported = true
+			endpointID, requestID, upstreamID := requestIDs(b.resp.Request)
+			b.proxy.invalidResponse(endpointID, requestID, upstreamID, reason, err)
+		}
+	}
+	return n, err
+}
+
+// invalidReason returns the reason the upstream response is invalid, or false
+// if the error isn't caused by the upstream response, such as the request
+// being cancelled.
+func (b *validatingBody) invalidReason(err error) (string, bool) {
+	if b.resp.Request.Context().Err() != nil {
+		return "", false
+	}
+	if slices.Contains(b.resp.TransferEncoding, "chunked") {
+		if errors.Is(err, io.ErrUnexpectedEOF) || strings.Contains(err.Error(), "chunk") {
+			return invalidReasonMalformedChunked, true
+		}
+		return "", false
+	}
+	if b.resp.ContentLength >= 0 && errors.Is(err, io.ErrUnexpectedEOF) {
+		return invalidReasonContentLength, true
+	}
+	return "", false
+}
+
+// isMalformedResponse returns whether the transport failed to parse the
+// upstream response headers.
+//
+// net/http doesn't export these errors so they're matched by message.
+func isMalformedResponse(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "malformed HTTP") ||
+		strings.Contains(msg, "bad Content-Length") ||
+		strings.Contains(msg, "Transfer-Encoding") ||
+		strings.Contains(msg, "transfer encodings")
+}
+
+// requestIDs returns the endpoint, request and upstream IDs of a proxied
+// request.
+func requestIDs(r *http.Request) (endpointID string, requestID string, upstreamID string) {
+	endpointID, _ = r.Context().Value(endpointContextKey).(string)
+	requestID, _ = r.Context().Value(requestIDContextKey).(string)
+	if upstream, ok := r.Context().Value(upstreamContextKey).(upstream.Upstream); ok {
+		upstreamID = upstream.ID()
+	}
+	return endpointID, requestID, upstreamID
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/pkg/auth"
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
+)
+
+// identityHeadersMiddleware adds the identity of the authenticated token to
+// the request forwarded to the upstream.
+//
+// Any identity headers in the incoming request are removed first, so upstreams
+// can trust the headers were added by Piko. Must be added after the auth
+// middleware.
+func identityHeadersMiddleware(headers protocol.Headers) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Header.Del(headers.Subject())
+		c.Request.Header.Del(headers.Tenant())
+		c.Request.Header.Del(headers.Scopes())
+
+		if v, ok := c.Get(middleware.TokenContextKey); ok {
+			token := v.(*auth.Token)
+			if token.Subject != "" {
+				c.Request.Header.Set(headers.Subject(), token.Subject)
+			}
+			if token.Tenant != "" {
+				c.Request.Header.Set(headers.Tenant(), token.Tenant)
+			}
+			if len(token.Scopes) != 0 {
+				c.Request.Header.Set(headers.Scopes(), strings.Join(token.Scopes, " "))
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// publicEndpointsMiddleware verifies requests with the auth middleware,
+// except requests to public endpoints which skip authentication.
+func publicEndpointsMiddleware(
+	publicEndpoints []string,
+	endpointID func(r *http.Request) string,
+	verify gin.HandlerFunc,
+) gin.HandlerFunc {
+	if len(publicEndpoints) == 0 {
+		return verify
+	}
+
+	endpoints := make(map[string]struct{})
+	for _, endpoint := range publicEndpoints {
+		endpoints[endpoint] = struct{}{}
+	}
+
+	return func(c *gin.Context) {
+		// TCP routes include the endpoint ID as a path parameter.
+		id := tcpEndpointID(c)
+		if id == "" {
+			id = endpointID(c.Request)
+		}
+		if _, ok := endpoints[id]; ok {
+			c.Next()
+			return
+		}
+		verify(c)
+	}
+}
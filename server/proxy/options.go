@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"html/template"
+
+	"github.com/andydunstall/piko/pkg/geoip"
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/pkg/recovery"
+	"github.com/andydunstall/piko/pkg/storage"
+	"github.com/andydunstall/piko/server/admission"
+	"github.com/andydunstall/piko/server/events"
+)
+
+type options struct {
+	admission     *admission.Controller
+	forwardSigner *ForwardSigner
+	events        *events.Exporter
+	geoIP         *geoip.DB
+	storage       *storage.Manager
+	panics        *recovery.Metrics
+	// routes is nil if requests aren't classified.
+	routes middleware.RouteClassifier
+	// maxTenants is zero if tenants are disabled.
+	maxTenants int
+	headers    protocol.Headers
+	// waitingRoomPage is nil to use the built-in waiting room page.
+	waitingRoomPage *template.Template
+}
+
+type admissionOption struct {
+	Admission *admission.Controller
+}
+
+func (o admissionOption) apply(opts *options) {
+	opts.admission = o.Admission
+}
+
+// WithAdmission configures the server to reject new requests while the
+// admission controller is shedding load.
+func WithAdmission(admission *admission.Controller) Option {
+	return admissionOption{Admission: admission}
+}
+
+type forwardSignerOption struct {
+	ForwardSigner *ForwardSigner
+}
+
+func (o forwardSignerOption) apply(opts *options) {
+	opts.forwardSigner = o.ForwardSigner
+}
+
+// WithForwardSigner configures the server to sign requests forwarded to other
+// nodes, and verify requests forwarded from other nodes.
+func WithForwardSigner(signer *ForwardSigner) Option {
+	return forwardSignerOption{ForwardSigner: signer}
+}
+
+type eventsOption struct {
+	Exporter *events.Exporter
+}
+
+func (o eventsOption) apply(opts *options) {
+	opts.events = o.Exporter
+}
+
+// WithEvents configures the server to export a summary of each request to
+// the event bus.
+func WithEvents(exporter *events.Exporter) Option {
+	return eventsOption{Exporter: exporter}
+}
+
+type geoIPOption struct {
+	DB *geoip.DB
+}
+
+func (o geoIPOption) apply(opts *options) {
+	opts.geoIP = o.DB
+}
+
+// WithGeoIP configures the server to tag access logs and events with the
+// country of the client IP and record per-country request metrics.
+func WithGeoIP(db *geoip.DB) Option {
+	return geoIPOption{DB: db}
+}
+
+type routesOption struct {
+	Classifier middleware.RouteClassifier
+}
+
+func (o routesOption) apply(opts *options) {
+	opts.routes = o.Classifier
+}
+
+// WithRouteClassifier configures the server to tag access logs with the
+// route of each request and record per-route metrics.
+func WithRouteClassifier(classifier middleware.RouteClassifier) Option {
+	return routesOption{Classifier: classifier}
+}
+
+type storageOption struct {
+	Manager *storage.Manager
+}
+
+func (o storageOption) apply(opts *options) {
+	opts.storage = o.Manager
+}
+
+// WithStorage configures the storage manager used to locate and enforce the
+// disk quota of resumable uploads and queued requests.
+func WithStorage(manager *storage.Manager) Option {
+	return storageOption{Manager: manager}
+}
+
+type panicsOption struct {
+	Metrics *recovery.Metrics
+}
+
+func (o panicsOption) apply(opts *options) {
+	opts.panics = o.Metrics
+}
+
+// WithPanicMetrics configures the server to count panics recovered while
+// handling requests and streams.
+func WithPanicMetrics(metrics *recovery.Metrics) Option {
+	return panicsOption{Metrics: metrics}
+}
+
+type tenantsOption int
+
+func (o tenantsOption) apply(opts *options) {
+	opts.maxTenants = int(o)
+}
+
+// WithTenants configures the server to tag access logs with the tenant of
+// the authenticated token and record per-tenant metrics, labelling at most
+// 'maxTenants' distinct tenants.
+func WithTenants(maxTenants int) Option {
+	return tenantsOption(maxTenants)
+}
+
+type headersOption protocol.Headers
+
+func (o headersOption) apply(opts *options) {
+	opts.headers = protocol.Headers(o)
+}
+
+// WithHeaders configures the names of the Piko headers, such as the header
+// containing the endpoint ID.
+func WithHeaders(headers protocol.Headers) Option {
+	return headersOption(headers)
+}
+
+type waitingRoomPageOption struct {
+	Page *template.Template
+}
+
+func (o waitingRoomPageOption) apply(opts *options) {
+	opts.waitingRoomPage = o.Page
+}
+
+// WithWaitingRoomPage configures the template of the waiting room page,
+// rather than the built-in page.
+func WithWaitingRoomPage(page *template.Template) Option {
+	return waitingRoomPageOption{Page: page}
+}
+
+type Option interface {
+	apply(*options)
+}
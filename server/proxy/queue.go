@@ -0,0 +1,825 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/auth"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/pkg/storage"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+// idempotencyKeyHeader is the header containing the key used to deduplicate
+// queued requests.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+var (
+	errQueuedRequestNotFound = errors.New("request not found")
+)
+
+// queuedRequest is a request persisted while the endpoint had no connected
+// upstreams.
+type queuedRequest struct {
+	Seq uint64 `json:"seq"`
+	// DeliveryID is a unique ID returned to the client to check the
+	// delivery status of the request.
+	DeliveryID     string      `json:"delivery_id"`
+	Host           string      `json:"host"`
+	RequestURI     string      `json:"request_uri"`
+	Header         http.Header `json:"header"`
+	Body           []byte      `json:"body"`
+	RemoteAddr     string      `json:"remote_addr"`
+	IdempotencyKey string      `json:"idempotency_key,omitempty"`
+	QueuedAt       time.Time   `json:"queued_at"`
+
+	// Attempts is the number of attempts to replay the request.
+	Attempts int `json:"attempts"`
+	// LastStatus is the response status of the last replay attempt.
+	LastStatus int `json:"last_status,omitempty"`
+	// DeliveredAt is the time the request was delivered to the upstream.
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+// endpointQueue contains the queued requests for an endpoint, in the order
+// they were received.
+type endpointQueue struct {
+	dir string
+
+	requests []*queuedRequest
+
+	// dead contains dead-lettered requests, which the upstream rejected when
+	// replayed. Dead-lettered requests aren't replayed unless retried.
+	dead []*queuedRequest
+
+	nextSeq uint64
+
+	// delivered contains requests delivered within the delivered retention,
+	// in the order they were delivered. Delivered requests don't include the
+	// request header or body.
+	delivered []*queuedRequest
+}
+
+func (q *endpointQueue) requestPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.json", seq))
+}
+
+func (q *endpointQueue) deadPath(seq uint64) string {
+	return filepath.Join(q.dir, "dead", fmt.Sprintf("%020d.json", seq))
+}
+
+func (q *endpointQueue) deliveredPath(seq uint64) string {
+	return filepath.Join(q.dir, "delivered", fmt.Sprintf("%020d.json", seq))
+}
+
+// duplicate returns the queued, dead-lettered or recently delivered request
+// with the given idempotency key, or nil if there is no such request.
+func (q *endpointQueue) duplicate(key string) *queuedRequest {
+	if key == "" {
+		return nil
+	}
+	for _, requests := range [][]*queuedRequest{q.requests, q.dead, q.delivered} {
+		for _, r := range requests {
+			if r.IdempotencyKey == key {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// delivery returns the request with the given delivery ID and its state.
+func (q *endpointQueue) delivery(deliveryID string) (*queuedRequest, string, bool) {
+	for _, r := range q.requests {
+		if r.DeliveryID == deliveryID {
+			return r, queueStateQueued, true
+		}
+	}
+	for _, r := range q.dead {
+		if r.DeliveryID == deliveryID {
+			return r, queueStateDead, true
+		}
+	}
+	for _, r := range q.delivered {
+		if r.DeliveryID == deliveryID {
+			return r, queueStateDelivered, true
+		}
+	}
+	return nil, "", false
+}
+
+// requestQueue queues POST requests to configured endpoints while the
+// endpoint has no connected upstreams, then replays the requests in order
+// once an upstream reconnects.
+//
+// Queued requests, and records of delivered requests, are persisted to disk
+// so survive restarts.
+type requestQueue struct {
+	maxRequestSize     int64
+	maxRequests        int
+	replayInterval     time.Duration
+	deliveredRetention time.Duration
+
+	endpoints map[string]*endpointQueue
+	mu        sync.Mutex
+
+	// area accounts for the disk usage of the persisted requests.
+	area *storage.Area
+
+	upstreams upstream.Manager
+	httpProxy *HTTPProxy
+
+	metrics *queueMetrics
+
+	ctx    context.Context
+	cancel func()
+
+	logger log.Logger
+}
+
+func newRequestQueue(
+	conf config.QueueConfig,
+	area *storage.Area,
+	upstreams upstream.Manager,
+	httpProxy *HTTPProxy,
+	logger log.Logger,
+) *requestQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &requestQueue{
+		maxRequestSize:     conf.MaxRequestSize,
+		maxRequests:        conf.MaxRequests,
+		replayInterval:     conf.ReplayInterval,
+		deliveredRetention: conf.DeliveredRetention,
+		endpoints:          make(map[string]*endpointQueue),
+		area:               area,
+		upstreams:          upstreams,
+		httpProxy:          httpProxy,
+		ctx:                ctx,
+		cancel:             cancel,
+		logger:             logger.WithSubsystem("proxy.queue"),
+	}
+	q.metrics = newQueueMetrics(q.status)
+
+	for _, endpointID := range conf.Endpoints {
+		// Encode the endpoint ID so it is always a valid directory name.
+		dir := filepath.Join(area.Path(), hex.EncodeToString([]byte(endpointID)))
+		eq, err := q.load(dir)
+		if err != nil {
+			// Still queue new requests, though requests that failed to load
+			// won't be replayed.
+			q.logger.Error(
+				"failed to load queue",
+				zap.String("endpoint-id", endpointID),
+				zap.Error(err),
+			)
+		}
+		if len(eq.requests) > 0 {
+			q.logger.Info(
+				"loaded queued requests",
+				zap.String("endpoint-id", endpointID),
+				zap.Int("requests", len(eq.requests)),
+			)
+		}
+		q.endpoints[endpointID] = eq
+	}
+	q.removeExpiredDeliveries()
+
+	// Account for the requests persisted before restarting.
+	if err := area.Scan(); err != nil {
+		q.logger.Warn("failed to scan queue dir", zap.Error(err))
+	}
+
+	return q
+}
+
+// handle queues the request if the endpoint is configured for queueing and
+// either has no connected upstreams or already has queued requests (to
+// preserve ordering).
+//
+// Returns true if the request was handled, otherwise the request should be
+// proxied as normal.
+func (q *requestQueue) handle(c *gin.Context, endpointID string) bool {
+	if c.Request.Method != http.MethodPost {
+		return false
+	}
+
+	q.mu.Lock()
+	eq, ok := q.endpoints[endpointID]
+	pending := ok && len(eq.requests) > 0
+	q.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if !pending {
+		if _, ok := q.upstreams.Select(endpointID, true); ok {
+			return false
+		}
+	}
+
+	if c.Request.ContentLength > q.maxRequestSize {
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, q.maxRequestSize+1))
+	if err != nil {
+		q.logger.Warn("failed to read request", zap.Error(err))
+		_ = errorResponse(c.Writer, http.StatusBadRequest, "failed to read request")
+		return true
+	}
+	if int64(len(body)) > q.maxRequestSize {
+		// Restore the body to proxy the request as normal.
+		c.Request.Body = io.NopCloser(
+			io.MultiReader(bytes.NewReader(body), c.Request.Body),
+		)
+		return false
+	}
+
+	header := c.Request.Header.Clone()
+	// Strip any forward headers so the replayed request isn't treated as
+	// forwarded from another node.
+	stripForwardHeaders(header, q.httpProxy.headers)
+
+	deliveryID, err := newDeliveryID()
+	if err != nil {
+		q.logger.Error("failed to generate delivery id", zap.Error(err))
+		_ = errorResponse(c.Writer, http.StatusInternalServerError, "internal error")
+		return true
+	}
+
+	r := &queuedRequest{
+		DeliveryID:     deliveryID,
+		Host:           c.Request.Host,
+		RequestURI:     c.Request.URL.RequestURI(),
+		Header:         header,
+		Body:           body,
+		RemoteAddr:     c.Request.RemoteAddr,
+		IdempotencyKey: c.Request.Header.Get(idempotencyKeyHeader),
+		QueuedAt:       time.Now(),
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if duplicate := eq.duplicate(r.IdempotencyKey); duplicate != nil {
+		q.logger.Debug(
+			"discarding duplicate request",
+			zap.String("endpoint-id", endpointID),
+			zap.String("idempotency-key", r.IdempotencyKey),
+		)
+		acceptedResponse(c, q.httpProxy.headers, duplicate.DeliveryID)
+		return true
+	}
+	if len(eq.requests) >= q.maxRequests {
+		q.logger.Warn(
+			"queue full",
+			zap.String("endpoint-id", endpointID),
+		)
+		_ = errorResponse(c.Writer, http.StatusServiceUnavailable, "queue full")
+		return true
+	}
+
+	r.Seq = eq.nextSeq
+	if err := q.writeRequest(eq.requestPath(r.Seq), r, true); err != nil {
+		if errors.Is(err, storage.ErrQuotaExceeded) {
+			_ = errorResponse(
+				c.Writer, http.StatusInsufficientStorage, "insufficient storage",
+			)
+			return true
+		}
+		q.logger.Error(
+			"failed to persist request",
+			zap.String("endpoint-id", endpointID),
+			zap.Error(err),
+		)
+		_ = errorResponse(c.Writer, http.StatusInternalServerError, "internal error")
+		return true
+	}
+	eq.nextSeq++
+	eq.requests = append(eq.requests, r)
+
+	q.logger.Debug(
+		"request queued",
+		zap.String("endpoint-id", endpointID),
+		zap.Uint64("seq", r.Seq),
+	)
+
+	acceptedResponse(c, q.httpProxy.headers, r.DeliveryID)
+	return true
+}
+
+// deliveryRoute returns the delivery status of a queued request.
+func (q *requestQueue) deliveryRoute(c *gin.Context) {
+	deliveryID := c.Param("deliveryID")
+
+	var (
+		r          *queuedRequest
+		state      string
+		endpointID string
+		found      bool
+	)
+	q.mu.Lock()
+	for id, eq := range q.endpoints {
+		if r, state, found = eq.delivery(deliveryID); found {
+			endpointID = id
+			break
+		}
+	}
+	var status deliveryStatus
+	if found {
+		status = newDeliveryStatus(r, state)
+	}
+	q.mu.Unlock()
+
+	if !found {
+		_ = errorResponse(c.Writer, http.StatusNotFound, "delivery not found")
+		return
+	}
+
+	// Verify the token is permitted to access the requests endpoint.
+	token, ok := c.Get(middleware.TokenContextKey)
+	if ok {
+		endpointToken := token.(*auth.Token)
+		if !endpointToken.EndpointPermitted(endpointID) {
+			q.logger.Warn(
+				"endpoint not permitted",
+				zap.Strings("token-endpoints", endpointToken.Endpoints),
+				zap.String("endpoint-id", endpointID),
+			)
+			_ = errorResponse(
+				c.Writer, http.StatusUnauthorized, "endpoint not permitted",
+			)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// run replays queued requests until the queue is closed.
+func (q *requestQueue) run() {
+	ticker := time.NewTicker(q.replayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.replayAll()
+			q.removeExpiredDeliveries()
+		case <-q.ctx.Done():
+			return
+		}
+	}
+}
+
+func (q *requestQueue) close() {
+	q.cancel()
+}
+
+func (q *requestQueue) replayAll() {
+	for endpointID, eq := range q.endpoints {
+		q.replayEndpoint(endpointID, eq)
+	}
+}
+
+// replayEndpoint replays the endpoints queued requests in order, stopping at
+// the first request that fails because the upstream is unavailable, which
+// will be retried later.
+//
+// Requests the upstream rejects (with a status other than 502, 503 or 504)
+// are moved to the dead-letter queue.
+func (q *requestQueue) replayEndpoint(endpointID string, eq *endpointQueue) {
+	for q.ctx.Err() == nil {
+		q.mu.Lock()
+		if len(eq.requests) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		r := eq.requests[0]
+		q.mu.Unlock()
+
+		status := q.replay(endpointID, r)
+
+		q.mu.Lock()
+		r.Attempts++
+		r.LastStatus = status
+		q.mu.Unlock()
+
+		if status == http.StatusBadGateway ||
+			status == http.StatusServiceUnavailable ||
+			status == http.StatusGatewayTimeout {
+			// The upstream is still unavailable, so retry later.
+			return
+		}
+
+		var delivered queuedRequest
+		q.mu.Lock()
+		// Note the request may have been purged while being replayed.
+		requests, ok := removeRequest(eq.requests, r.Seq)
+		if ok {
+			eq.requests = requests
+			if status < http.StatusBadRequest {
+				deliveredAt := time.Now()
+				r.DeliveredAt = &deliveredAt
+				delivered = *r
+				delivered.Header = nil
+				delivered.Body = nil
+				eq.delivered = append(eq.delivered, &delivered)
+			} else {
+				eq.dead = append(eq.dead, r)
+			}
+		}
+		q.mu.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		if status < http.StatusBadRequest {
+			q.metrics.ReplayedTotal.WithLabelValues(endpointID, "delivered").Inc()
+			q.logger.Debug(
+				"request replayed",
+				zap.String("endpoint-id", endpointID),
+				zap.Uint64("seq", r.Seq),
+				zap.Int("status", status),
+			)
+			if err := q.writeRequest(eq.deliveredPath(r.Seq), &delivered, false); err != nil {
+				q.logger.Error("failed to persist delivery", zap.Error(err))
+			}
+		} else {
+			q.metrics.ReplayedTotal.WithLabelValues(endpointID, "dead_lettered").Inc()
+			q.logger.Warn(
+				"request rejected; moved to dead-letter queue",
+				zap.String("endpoint-id", endpointID),
+				zap.Uint64("seq", r.Seq),
+				zap.Int("status", status),
+			)
+			if err := q.writeRequest(eq.deadPath(r.Seq), r, false); err != nil {
+				q.logger.Error("failed to persist request", zap.Error(err))
+			}
+		}
+
+		if err := q.area.RemoveFile(eq.requestPath(r.Seq)); err != nil {
+			q.logger.Warn("failed to remove request", zap.Error(err))
+		}
+	}
+}
+
+// replay forwards the request to the endpoint and returns the response
+// status. The response body is discarded.
+func (q *requestQueue) replay(endpointID string, r *queuedRequest) int {
+	req, err := http.NewRequestWithContext(
+		q.ctx, http.MethodPost, r.RequestURI, bytes.NewReader(r.Body),
+	)
+	if err != nil {
+		// Will not happen as the request URI was parsed from the original
+		// request.
+		q.logger.Error("failed to create request", zap.Error(err))
+		return http.StatusBadRequest
+	}
+	req.Host = r.Host
+	req.Header = r.Header.Clone()
+	req.RemoteAddr = r.RemoteAddr
+
+	w := NewStatusRecorder()
+	q.httpProxy.ServeHTTP(w, req, endpointID)
+	return w.Status()
+}
+
+// removeExpiredDeliveries removes the records of requests delivered longer
+// ago than the delivered retention.
+func (q *requestQueue) removeExpiredDeliveries() {
+	for _, eq := range q.endpoints {
+		var expired []uint64
+		q.mu.Lock()
+		delivered := eq.delivered[:0]
+		for _, r := range eq.delivered {
+			if r.DeliveredAt == nil || time.Since(*r.DeliveredAt) > q.deliveredRetention {
+				expired = append(expired, r.Seq)
+				continue
+			}
+			delivered = append(delivered, r)
+		}
+		clear(eq.delivered[len(delivered):])
+		eq.delivered = delivered
+		q.mu.Unlock()
+
+		for _, seq := range expired {
+			if err := q.area.RemoveFile(eq.deliveredPath(seq)); err != nil && !os.IsNotExist(err) {
+				q.logger.Warn("failed to remove delivery", zap.Error(err))
+			}
+		}
+	}
+}
+
+// status returns the status of each endpoints queue, ordered by endpoint
+// ID.
+func (q *requestQueue) status() []queueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var statuses []queueStatus
+	for endpointID, eq := range q.endpoints {
+		status := queueStatus{
+			EndpointID:  endpointID,
+			Queued:      len(eq.requests),
+			DeadLetters: len(eq.dead),
+		}
+		if len(eq.requests) > 0 {
+			queuedAt := eq.requests[0].QueuedAt
+			status.OldestQueuedAt = &queuedAt
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].EndpointID < statuses[j].EndpointID
+	})
+	return statuses
+}
+
+// list returns the metadata of the endpoints queued requests, or
+// dead-lettered requests if dead is true.
+func (q *requestQueue) list(endpointID string, dead bool) ([]queuedRequestMetadata, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	eq, ok := q.endpoints[endpointID]
+	if !ok {
+		return nil, false
+	}
+
+	requests, state := eq.requests, queueStateQueued
+	if dead {
+		requests, state = eq.dead, queueStateDead
+	}
+	metadata := make([]queuedRequestMetadata, 0, len(requests))
+	for _, r := range requests {
+		metadata = append(metadata, newQueuedRequestMetadata(r, state))
+	}
+	return metadata, true
+}
+
+// get returns the metadata of the queued or dead-lettered request with the
+// given sequence number.
+func (q *requestQueue) get(endpointID string, seq uint64) (queuedRequestMetadata, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	eq, ok := q.endpoints[endpointID]
+	if !ok {
+		return queuedRequestMetadata{}, false
+	}
+	for _, r := range eq.requests {
+		if r.Seq == seq {
+			return newQueuedRequestMetadata(r, queueStateQueued), true
+		}
+	}
+	for _, r := range eq.dead {
+		if r.Seq == seq {
+			return newQueuedRequestMetadata(r, queueStateDead), true
+		}
+	}
+	return queuedRequestMetadata{}, false
+}
+
+// retry moves the dead-lettered request with the given sequence number to
+// the end of the queue, and returns its new sequence number.
+func (q *requestQueue) retry(endpointID string, seq uint64) (uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	eq, ok := q.endpoints[endpointID]
+	if !ok {
+		return 0, errQueuedRequestNotFound
+	}
+	var r *queuedRequest
+	for _, dead := range eq.dead {
+		if dead.Seq == seq {
+			r = dead
+		}
+	}
+	if r == nil {
+		return 0, errQueuedRequestNotFound
+	}
+
+	retried := *r
+	retried.Seq = eq.nextSeq
+	retried.Attempts = 0
+	retried.LastStatus = 0
+	if err := q.writeRequest(eq.requestPath(retried.Seq), &retried, true); err != nil {
+		return 0, fmt.Errorf("persist: %w", err)
+	}
+	eq.nextSeq++
+	eq.requests = append(eq.requests, &retried)
+
+	eq.dead, _ = removeRequest(eq.dead, seq)
+	if err := q.area.RemoveFile(eq.deadPath(seq)); err != nil {
+		q.logger.Warn("failed to remove request", zap.Error(err))
+	}
+
+	return retried.Seq, nil
+}
+
+// purge removes the request with the given sequence number.
+func (q *requestQueue) purge(endpointID string, seq uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	eq, ok := q.endpoints[endpointID]
+	if !ok {
+		return errQueuedRequestNotFound
+	}
+	if requests, ok := removeRequest(eq.requests, seq); ok {
+		eq.requests = requests
+		return q.area.RemoveFile(eq.requestPath(seq))
+	}
+	if dead, ok := removeRequest(eq.dead, seq); ok {
+		eq.dead = dead
+		return q.area.RemoveFile(eq.deadPath(seq))
+	}
+	return errQueuedRequestNotFound
+}
+
+// purgeAll removes all queued requests and/or dead-lettered requests, and
+// returns the number of removed requests.
+func (q *requestQueue) purgeAll(
+	endpointID string, queued bool, dead bool,
+) (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	eq, ok := q.endpoints[endpointID]
+	if !ok {
+		return 0, false
+	}
+
+	var n int
+	if queued {
+		for _, r := range eq.requests {
+			if err := q.area.RemoveFile(eq.requestPath(r.Seq)); err != nil {
+				q.logger.Warn("failed to remove request", zap.Error(err))
+			}
+		}
+		n += len(eq.requests)
+		eq.requests = nil
+	}
+	if dead {
+		for _, r := range eq.dead {
+			if err := q.area.RemoveFile(eq.deadPath(r.Seq)); err != nil {
+				q.logger.Warn("failed to remove request", zap.Error(err))
+			}
+		}
+		n += len(eq.dead)
+		eq.dead = nil
+	}
+	return n, true
+}
+
+func acceptedResponse(c *gin.Context, headers protocol.Headers, deliveryID string) {
+	c.Header(headers.DeliveryID(), deliveryID)
+	c.JSON(http.StatusAccepted, gin.H{
+		"status":      queueStateQueued,
+		"delivery_id": deliveryID,
+	})
+}
+
+func newDeliveryID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// writeRequest writes the request to the given path.
+//
+// If enforceQuota is true, returns [storage.ErrQuotaExceeded] if the request
+// would exceed the disk quota. Otherwise the write is accounted for without
+// enforcing the quota, such as when moving a request to the dead-letter
+// queue.
+func (q *requestQueue) writeRequest(path string, r *queuedRequest, enforceQuota bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("mkdir: %w", err)
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+
+	size := int64(len(b))
+	if enforceQuota {
+		if err := q.area.Reserve(size); err != nil {
+			return err
+		}
+	} else {
+		q.area.Account(size)
+	}
+
+	// Write to a temporary file then rename to avoid loading a partially
+	// written request.
+	if err := os.WriteFile(path+".tmp", b, 0o600); err != nil {
+		q.area.Release(size)
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		q.area.Release(size)
+		return fmt.Errorf("rename: %w", err)
+	}
+	return nil
+}
+
+// load loads the persisted queued, dead-lettered and delivered requests in
+// the given directory. Returns the queue even if loading fails.
+func (q *requestQueue) load(dir string) (*endpointQueue, error) {
+	eq := &endpointQueue{
+		dir: dir,
+	}
+
+	var err error
+	eq.requests, err = readRequests(dir)
+	if err != nil {
+		return eq, err
+	}
+	eq.dead, err = readRequests(filepath.Join(dir, "dead"))
+	if err != nil {
+		return eq, fmt.Errorf("dead: %w", err)
+	}
+	eq.delivered, err = readRequests(filepath.Join(dir, "delivered"))
+	if err != nil {
+		return eq, fmt.Errorf("delivered: %w", err)
+	}
+
+	// Include delivered requests so their sequence numbers aren't reused.
+	for _, requests := range [][]*queuedRequest{eq.requests, eq.dead, eq.delivered} {
+		for _, r := range requests {
+			if r.Seq >= eq.nextSeq {
+				eq.nextSeq = r.Seq + 1
+			}
+		}
+	}
+
+	return eq, nil
+}
+
+// readRequests reads the requests in the given directory ordered by
+// sequence number.
+func readRequests(dir string) ([]*queuedRequest, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	var requests []*queuedRequest
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return requests, fmt.Errorf("read: %s: %w", entry.Name(), err)
+		}
+		var r queuedRequest
+		if err := json.Unmarshal(b, &r); err != nil {
+			return requests, fmt.Errorf("decode: %s: %w", entry.Name(), err)
+		}
+		requests = append(requests, &r)
+	}
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Seq < requests[j].Seq
+	})
+	return requests, nil
+}
+
+// removeRequest removes the request with the given sequence number. Returns
+// false if the request isn't found.
+func removeRequest(requests []*queuedRequest, seq uint64) ([]*queuedRequest, bool) {
+	for i, r := range requests {
+		if r.Seq == seq {
+			return append(requests[:i:i], requests[i+1:]...), true
+		}
+	}
+	return requests, false
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/storage"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+func newQueueServer(
+	t *testing.T,
+	upstreamAddr string,
+	connected *atomic.Bool,
+	path string,
+	registry *prometheus.Registry,
+	opts ...Option,
+) (*Server, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	conf := config.Default().Proxy
+	conf.Queue.Endpoints = []string{"my-endpoint"}
+	conf.Queue.Path = path
+	conf.Queue.MaxRequests = 3
+	conf.Queue.ReplayInterval = time.Millisecond * 10
+
+	s := NewServer(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				if !connected.Load() {
+					return nil, false
+				}
+				return &tcpUpstream{
+					addr: upstreamAddr,
+				}, true
+			},
+		},
+		conf,
+		registry,
+		nil,
+		nil,
+		log.NewNopLogger(),
+		opts...,
+	)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	t.Cleanup(func() {
+		_ = s.Shutdown(context.TODO())
+	})
+
+	return s, "http://" + ln.Addr().String()
+}
+
+// queueArea returns a storage area, without a quota, for a queue in the
+// given path.
+func queueArea(path string) *storage.Area {
+	m := storage.NewManager("", 0, storage.EvictionNone, log.NewNopLogger())
+	return m.Area("queue", path)
+}
+
+func postRequest(t *testing.T, url string, key string, body string) int {
+	status, _ := postDelivery(t, url, key, body)
+	return status
+}
+
+// postDelivery sends a POST request and returns the response status and
+// delivery ID.
+func postDelivery(t *testing.T, url string, key string, body string) (int, string) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader([]byte(body)))
+	require.NoError(t, err)
+	req.Header.Set("x-piko-endpoint", "my-endpoint")
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode, resp.Header.Get("x-piko-delivery-id")
+}
+
+func getDelivery(t *testing.T, url string) (int, deliveryStatus) {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var status deliveryStatus
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	}
+	return resp.StatusCode, status
+}
+
+func TestServer_Queue(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	upstreamServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/webhook", r.URL.Path)
+
+			b, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+
+			mu.Lock()
+			received = append(received, string(b))
+			mu.Unlock()
+		},
+	))
+	defer upstreamServer.Close()
+
+	connected := atomic.NewBool(false)
+	path := t.TempDir()
+	_, addr := newQueueServer(
+		t, upstreamServer.Listener.Addr().String(), connected, path, nil,
+	)
+
+	url := addr + "/webhook"
+	status, deliveryID := postDelivery(t, url, "1", "foo")
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.NotEmpty(t, deliveryID)
+	assert.Equal(t, http.StatusAccepted, postRequest(t, url, "2", "bar"))
+	// Duplicate, which returns the delivery ID of the original request.
+	status, duplicateID := postDelivery(t, url, "1", "foo")
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, deliveryID, duplicateID)
+	assert.Equal(t, http.StatusAccepted, postRequest(t, url, "", "baz"))
+	// Queue full.
+	assert.Equal(t, http.StatusServiceUnavailable, postRequest(t, url, "", "car"))
+
+	// Verify requests are persisted.
+	loaded := newRequestQueue(config.QueueConfig{
+		Endpoints:      []string{"my-endpoint"},
+		Path:           path,
+		MaxRequestSize: 1024,
+		MaxRequests:    3,
+		ReplayInterval: time.Second,
+	}, queueArea(path), nil, nil, log.NewNopLogger())
+	require.Len(t, loaded.endpoints["my-endpoint"].requests, 3)
+	assert.Equal(t, []byte("bar"), loaded.endpoints["my-endpoint"].requests[1].Body)
+	assert.Equal(t, uint64(3), loaded.endpoints["my-endpoint"].nextSeq)
+
+	deliveryURL := addr + "/_piko/v1/deliveries/" + deliveryID
+	status, delivery := getDelivery(t, deliveryURL)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "queued", delivery.Status)
+	assert.Nil(t, delivery.DeliveredAt)
+
+	status, _ = getDelivery(t, addr+"/_piko/v1/deliveries/unknown")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// Once the upstream connects, queued requests are replayed in order.
+	connected.Store(true)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 3
+	}, time.Second, time.Millisecond*10)
+	mu.Lock()
+	assert.Equal(t, []string{"foo", "bar", "baz"}, received)
+	mu.Unlock()
+
+	// Wait for the replayed requests to be removed.
+	endpointPath := filepath.Join(path, hex.EncodeToString([]byte("my-endpoint")))
+	assert.Eventually(t, func() bool {
+		entries, err := os.ReadDir(endpointPath)
+		if err != nil {
+			return false
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				return false
+			}
+		}
+		return true
+	}, time.Second, time.Millisecond*10)
+
+	status, delivery = getDelivery(t, deliveryURL)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "delivered", delivery.Status)
+	assert.NotNil(t, delivery.DeliveredAt)
+	assert.Equal(t, 1, delivery.Attempts)
+
+	// Verify delivery records are persisted, without the request body.
+	queueConf := config.QueueConfig{
+		Endpoints:          []string{"my-endpoint"},
+		Path:               path,
+		MaxRequestSize:     1024,
+		MaxRequests:        3,
+		ReplayInterval:     time.Second,
+		DeliveredRetention: time.Hour,
+	}
+	assert.Eventually(t, func() bool {
+		loaded := newRequestQueue(queueConf, queueArea(path), nil, nil, log.NewNopLogger())
+		return len(loaded.endpoints["my-endpoint"].delivered) == 3
+	}, time.Second, time.Millisecond*10)
+	loaded = newRequestQueue(queueConf, queueArea(path), nil, nil, log.NewNopLogger())
+	r, state, ok := loaded.endpoints["my-endpoint"].delivery(deliveryID)
+	require.True(t, ok)
+	assert.Equal(t, "delivered", state)
+	assert.Nil(t, r.Body)
+	assert.Equal(t, uint64(3), loaded.endpoints["my-endpoint"].nextSeq)
+
+	// Expired delivery records are removed.
+	queueConf.DeliveredRetention = time.Nanosecond
+	loaded = newRequestQueue(queueConf, queueArea(path), nil, nil, log.NewNopLogger())
+	assert.Empty(t, loaded.endpoints["my-endpoint"].delivered)
+	entries, err := os.ReadDir(filepath.Join(endpointPath, "delivered"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Once the queue is empty, requests are proxied as normal.
+	assert.Equal(t, http.StatusOK, postRequest(t, url, "3", "foo"))
+	mu.Lock()
+	assert.Equal(t, []string{"foo", "bar", "baz", "foo"}, received)
+	mu.Unlock()
+}
+
+func TestServer_QueueQuota(t *testing.T) {
+	path := t.TempDir()
+	// Only enough space for one request.
+	manager := storage.NewManager("", 600, storage.EvictionLRU, log.NewNopLogger())
+	_, addr := newQueueServer(
+		t, "", atomic.NewBool(false), path, nil, WithStorage(manager),
+	)
+
+	url := addr + "/webhook"
+	assert.Equal(t, http.StatusAccepted, postRequest(t, url, "", "foo"))
+	assert.Equal(t, http.StatusInsufficientStorage, postRequest(t, url, "", "bar"))
+
+	assert.Greater(t, manager.Used(), int64(0))
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	queueStateQueued    = "queued"
+	queueStateDead      = "dead"
+	queueStateDelivered = "delivered"
+)
+
+type queueStatus struct {
+	EndpointID  string `json:"endpoint_id"`
+	Queued      int    `json:"queued"`
+	DeadLetters int    `json:"dead_letters"`
+	// OldestQueuedAt is the time the oldest queued request was received, or
+	// nil if there are no queued requests.
+	OldestQueuedAt *time.Time `json:"oldest_queued_at,omitempty"`
+}
+
+// queuedRequestMetadata describes a queued request. This excludes the
+// request headers and body as they may contain credentials or sensitive
+// data.
+type queuedRequestMetadata struct {
+	Seq            uint64    `json:"seq"`
+	DeliveryID     string    `json:"delivery_id"`
+	State          string    `json:"state"`
+	Host           string    `json:"host"`
+	RequestURI     string    `json:"request_uri"`
+	ContentType    string    `json:"content_type,omitempty"`
+	Size           int       `json:"size"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	QueuedAt       time.Time `json:"queued_at"`
+	Attempts       int       `json:"attempts"`
+	LastStatus     int       `json:"last_status,omitempty"`
+}
+
+func newQueuedRequestMetadata(r *queuedRequest, state string) queuedRequestMetadata {
+	return queuedRequestMetadata{
+		Seq:            r.Seq,
+		DeliveryID:     r.DeliveryID,
+		State:          state,
+		Host:           r.Host,
+		RequestURI:     r.RequestURI,
+		ContentType:    r.Header.Get("Content-Type"),
+		Size:           len(r.Body),
+		IdempotencyKey: r.IdempotencyKey,
+		QueuedAt:       r.QueuedAt,
+		Attempts:       r.Attempts,
+		LastStatus:     r.LastStatus,
+	}
+}
+
+// deliveryStatus is the delivery status of a queued request returned to
+// the client.
+type deliveryStatus struct {
+	DeliveryID string `json:"delivery_id"`
+	// Status is either 'queued', 'delivered', or 'dead' if the upstream
+	// rejected the request.
+	Status      string     `json:"status"`
+	QueuedAt    time.Time  `json:"queued_at"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	Attempts    int        `json:"attempts"`
+	LastStatus  int        `json:"last_status,omitempty"`
+}
+
+func newDeliveryStatus(r *queuedRequest, state string) deliveryStatus {
+	return deliveryStatus{
+		DeliveryID:  r.DeliveryID,
+		Status:      state,
+		QueuedAt:    r.QueuedAt,
+		DeliveredAt: r.DeliveredAt,
+		Attempts:    r.Attempts,
+		LastStatus:  r.LastStatus,
+	}
+}
+
+// QueueHandler exposes the queued requests in the admin API, to inspect,
+// retry and purge queued and dead-lettered requests.
+type QueueHandler struct {
+	queue *requestQueue
+}
+
+// Register registers the queue routes.
+//
+// The endpoint ID is a query parameter rather than a path parameter, since
+// namespaced endpoint IDs contain '/'.
+func (h *QueueHandler) Register(group *gin.RouterGroup) {
+	group.GET("/endpoints", h.listEndpointsRoute)
+	group.GET("/requests", h.listRequestsRoute)
+	group.DELETE("/requests", h.purgeRequestsRoute)
+	group.GET("/requests/:seq", h.getRequestRoute)
+	group.DELETE("/requests/:seq", h.purgeRequestRoute)
+	group.POST("/requests/:seq/retry", h.retryRequestRoute)
+}
+
+func (h *QueueHandler) listEndpointsRoute(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"endpoints": h.queue.status()})
+}
+
+// listRequestsRoute lists the endpoints queued requests, or dead-lettered
+// requests with 'state=dead'.
+func (h *QueueHandler) listRequestsRoute(c *gin.Context) {
+	endpointID, ok := endpointIDQuery(c)
+	if !ok {
+		return
+	}
+	state := c.DefaultQuery("state", queueStateQueued)
+	if state != queueStateQueued && state != queueStateDead {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid state"})
+		return
+	}
+
+	requests, ok := h.queue.list(endpointID, state == queueStateDead)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "endpoint not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"requests": requests})
+}
+
+func (h *QueueHandler) getRequestRoute(c *gin.Context) {
+	endpointID, ok := endpointIDQuery(c)
+	if !ok {
+		return
+	}
+	seq, ok := seqParam(c)
+	if !ok {
+		return
+	}
+
+	r, ok := h.queue.get(endpointID, seq)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": errQueuedRequestNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+// retryRequestRoute moves a dead-lettered request to the end of the queue.
+func (h *QueueHandler) retryRequestRoute(c *gin.Context) {
+	endpointID, ok := endpointIDQuery(c)
+	if !ok {
+		return
+	}
+	seq, ok := seqParam(c)
+	if !ok {
+		return
+	}
+
+	newSeq, err := h.queue.retry(endpointID, seq)
+	if errors.Is(err, errQueuedRequestNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"seq": newSeq})
+}
+
+func (h *QueueHandler) purgeRequestRoute(c *gin.Context) {
+	endpointID, ok := endpointIDQuery(c)
+	if !ok {
+		return
+	}
+	seq, ok := seqParam(c)
+	if !ok {
+		return
+	}
+
+	err := h.queue.purge(endpointID, seq)
+	if errors.Is(err, errQueuedRequestNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// purgeRequestsRoute purges the endpoints queued requests, dead-lettered
+// requests with 'state=dead', or both with 'state=all'.
+func (h *QueueHandler) purgeRequestsRoute(c *gin.Context) {
+	endpointID, ok := endpointIDQuery(c)
+	if !ok {
+		return
+	}
+	state := c.DefaultQuery("state", queueStateQueued)
+	if state != queueStateQueued && state != queueStateDead && state != "all" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid state"})
+		return
+	}
+
+	n, ok := h.queue.purgeAll(
+		endpointID,
+		state == queueStateQueued || state == "all",
+		state == queueStateDead || state == "all",
+	)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "endpoint not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": n})
+}
+
+func seqParam(c *gin.Context) (uint64, bool) {
+	seq, err := strconv.ParseUint(c.Param("seq"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid seq"})
+		return 0, false
+	}
+	return seq, true
+}
+
+func endpointIDQuery(c *gin.Context) (string, bool) {
+	endpointID := c.Query("endpoint_id")
+	if endpointID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing endpoint_id"})
+		return "", false
+	}
+	return endpointID, true
+}
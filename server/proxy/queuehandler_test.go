@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+func gaugeValue(
+	t *testing.T,
+	registry *prometheus.Registry,
+	name string,
+	labels map[string]string,
+) float64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			matches := true
+			for _, label := range m.GetLabel() {
+				if v, ok := labels[label.GetName()]; ok && v != label.GetValue() {
+					matches = false
+				}
+			}
+			if matches {
+				return m.GetGauge().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func adminRequest(
+	t *testing.T, router *gin.Engine, method string, path string, v any,
+) int {
+	req := httptest.NewRequest(method, path, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if v != nil {
+		b, err := io.ReadAll(w.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(b, v))
+	}
+	return w.Code
+}
+
+func TestQueueHandler(t *testing.T) {
+	// The upstream rejects requests with body 'bad'.
+	upstreamServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			if string(b) == "bad" {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		},
+	))
+	defer upstreamServer.Close()
+
+	registry := prometheus.NewRegistry()
+	connected := atomic.NewBool(false)
+	s, addr := newQueueServer(
+		t, upstreamServer.Listener.Addr().String(), connected, t.TempDir(), registry,
+	)
+
+	router := gin.New()
+	s.QueueHandler().Register(router.Group("/queue/v1"))
+
+	url := addr + "/webhook"
+	assert.Equal(t, http.StatusAccepted, postRequest(t, url, "1", "bad"))
+	assert.Equal(t, http.StatusAccepted, postRequest(t, url, "2", "good"))
+
+	var endpoints struct {
+		Endpoints []queueStatus `json:"endpoints"`
+	}
+	assert.Equal(t, http.StatusOK, adminRequest(
+		t, router, http.MethodGet, "/queue/v1/endpoints", &endpoints,
+	))
+	require.Len(t, endpoints.Endpoints, 1)
+	assert.Equal(t, "my-endpoint", endpoints.Endpoints[0].EndpointID)
+	assert.Equal(t, 2, endpoints.Endpoints[0].Queued)
+	assert.NotNil(t, endpoints.Endpoints[0].OldestQueuedAt)
+
+	assert.Equal(t, 2.0, gaugeValue(t, registry, "piko_proxy_queue_requests", map[string]string{
+		"endpoint": "my-endpoint",
+		"state":    "queued",
+	}))
+
+	var metadata queuedRequestMetadata
+	assert.Equal(t, http.StatusOK, adminRequest(
+		t, router, http.MethodGet, "/queue/v1/requests/1?endpoint_id=my-endpoint", &metadata,
+	))
+	assert.Equal(t, queuedRequestMetadata{
+		Seq:            1,
+		DeliveryID:     metadata.DeliveryID,
+		State:          "queued",
+		Host:           metadata.Host,
+		RequestURI:     "/webhook",
+		Size:           4,
+		IdempotencyKey: "2",
+		QueuedAt:       metadata.QueuedAt,
+	}, metadata)
+
+	// Once connected, the rejected request is dead-lettered.
+	connected.Store(true)
+	var requests struct {
+		Requests []queuedRequestMetadata `json:"requests"`
+	}
+	assert.Eventually(t, func() bool {
+		adminRequest(
+			t, router, http.MethodGet, "/queue/v1/requests?endpoint_id=my-endpoint&state=dead", &requests,
+		)
+		return len(requests.Requests) == 1
+	}, time.Second, time.Millisecond*10)
+	assert.Equal(t, uint64(0), requests.Requests[0].Seq)
+	assert.Equal(t, "dead", requests.Requests[0].State)
+	assert.Equal(t, http.StatusBadRequest, requests.Requests[0].LastStatus)
+	assert.Equal(t, 1, requests.Requests[0].Attempts)
+
+	assert.Eventually(t, func() bool {
+		adminRequest(
+			t, router, http.MethodGet, "/queue/v1/requests?endpoint_id=my-endpoint", &requests,
+		)
+		return len(requests.Requests) == 0
+	}, time.Second, time.Millisecond*10)
+
+	// Retrying the dead-lettered request requeues it, though it is rejected
+	// again.
+	connected.Store(false)
+	var retried struct {
+		Seq uint64 `json:"seq"`
+	}
+	assert.Equal(t, http.StatusOK, adminRequest(
+		t, router, http.MethodPost, "/queue/v1/requests/0/retry?endpoint_id=my-endpoint", &retried,
+	))
+	assert.Equal(t, uint64(2), retried.Seq)
+	assert.Equal(t, http.StatusOK, adminRequest(
+		t, router, http.MethodGet, "/queue/v1/requests/2?endpoint_id=my-endpoint", &metadata,
+	))
+	assert.Equal(t, "queued", metadata.State)
+
+	assert.Equal(t, http.StatusNotFound, adminRequest(
+		t, router, http.MethodPost, "/queue/v1/requests/0/retry?endpoint_id=my-endpoint", nil,
+	))
+
+	// Purge.
+	var purged struct {
+		Purged int `json:"purged"`
+	}
+	assert.Equal(t, http.StatusOK, adminRequest(
+		t, router, http.MethodDelete, "/queue/v1/requests?endpoint_id=my-endpoint&state=all", &purged,
+	))
+	assert.Equal(t, 1, purged.Purged)
+
+	assert.Equal(t, http.StatusNotFound, adminRequest(
+		t, router, http.MethodGet, "/queue/v1/requests?endpoint_id=unknown", nil,
+	))
+}
+
+// Tests the queued requests of namespaced endpoints, whose endpoint IDs
+// contain '/'.
+func TestQueueHandler_NamespacedEndpoint(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	conf := config.Default().Proxy
+	conf.Queue.Endpoints = []string{"team/my-endpoint"}
+	conf.Queue.Path = t.TempDir()
+	conf.Queue.MaxRequests = 3
+	conf.Queue.ReplayInterval = time.Millisecond * 10
+
+	s := NewServer(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return nil, false
+			},
+		},
+		conf,
+		nil,
+		nil,
+		nil,
+		log.NewNopLogger(),
+	)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer func() {
+		_ = s.Shutdown(context.TODO())
+	}()
+
+	req, err := http.NewRequest(
+		http.MethodPost, "http://"+ln.Addr().String()+"/webhook", bytes.NewReader([]byte("foo")),
+	)
+	require.NoError(t, err)
+	req.Header.Set("x-piko-endpoint", "team/my-endpoint")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	router := gin.New()
+	s.QueueHandler().Register(router.Group("/queue/v1"))
+
+	var requests struct {
+		Requests []queuedRequestMetadata `json:"requests"`
+	}
+	assert.Equal(t, http.StatusOK, adminRequest(
+		t, router, http.MethodGet, "/queue/v1/requests?endpoint_id=team%2Fmy-endpoint", &requests,
+	))
+	require.Len(t, requests.Requests, 1)
+	assert.Equal(t, uint64(0), requests.Requests[0].Seq)
+
+	var metadata queuedRequestMetadata
+	assert.Equal(t, http.StatusOK, adminRequest(
+		t, router, http.MethodGet, "/queue/v1/requests/0?endpoint_id=team/my-endpoint", &metadata,
+	))
+	assert.Equal(t, "queued", metadata.State)
+
+	assert.Equal(t, http.StatusNoContent, adminRequest(
+		t, router, http.MethodDelete, "/queue/v1/requests/0?endpoint_id=team/my-endpoint", nil,
+	))
+
+	// The endpoint ID is required.
+	assert.Equal(t, http.StatusBadRequest, adminRequest(
+		t, router, http.MethodGet, "/queue/v1/requests", nil,
+	))
+}
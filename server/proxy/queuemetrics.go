@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type queueMetrics struct {
+	// ReplayedTotal is the number of replayed queued requests. Labelled by
+	// endpoint ID and result ('delivered' or 'dead_lettered').
+	ReplayedTotal *prometheus.CounterVec
+
+	// requests and oldestAge are computed from the queue status when
+	// collected.
+	requests  *prometheus.Desc
+	oldestAge *prometheus.Desc
+	status    func() []queueStatus
+}
+
+func newQueueMetrics(status func() []queueStatus) *queueMetrics {
+	return &queueMetrics{
+		ReplayedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy_queue",
+				Name:      "replayed_total",
+				Help:      "Number of replayed queued requests",
+			},
+			[]string{"endpoint", "result"},
+		),
+		requests: prometheus.NewDesc(
+			"piko_proxy_queue_requests",
+			"Number of queued requests",
+			[]string{"endpoint", "state"},
+			nil,
+		),
+		oldestAge: prometheus.NewDesc(
+			"piko_proxy_queue_oldest_request_age_seconds",
+			"Age of the oldest queued request, or zero if there are no queued requests",
+			[]string{"endpoint"},
+			nil,
+		),
+		status: status,
+	}
+}
+
+func (m *queueMetrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.ReplayedTotal,
+		&queueCollector{metrics: m},
+	)
+}
+
+// queueCollector collects the queue depth and age metrics.
+type queueCollector struct {
+	metrics *queueMetrics
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.metrics.requests
+	ch <- c.metrics.oldestAge
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, status := range c.metrics.status() {
+		ch <- prometheus.MustNewConstMetric(
+			c.metrics.requests,
+			prometheus.GaugeValue,
+			float64(status.Queued),
+			status.EndpointID, queueStateQueued,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.metrics.requests,
+			prometheus.GaugeValue,
+			float64(status.DeadLetters),
+			status.EndpointID, queueStateDead,
+		)
+
+		var age time.Duration
+		if status.OldestQueuedAt != nil {
+			age = time.Since(*status.OldestQueuedAt)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			c.metrics.oldestAge,
+			prometheus.GaugeValue,
+			age.Seconds(),
+			status.EndpointID,
+		)
+	}
+}
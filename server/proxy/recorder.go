@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net/http"
+)
+
+// StatusRecorder is a [http.ResponseWriter] that records the response
+// status and discards the body.
+//
+// This is used for requests forwarded by Piko itself, such as replayed
+// queued requests and probes, where only the response status is needed.
+type StatusRecorder struct {
+	header http.Header
+	status int
+}
+
+func NewStatusRecorder() *StatusRecorder {
+	return &StatusRecorder{
+		header: make(http.Header),
+	}
+}
+
+func (r *StatusRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *StatusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (r *StatusRecorder) WriteHeader(status int) {
+	// Ignore informational responses, which precede the final response.
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		return
+	}
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+// Status returns the recorded response status, which defaults to 200 if the
+// status wasn't written.
+func (r *StatusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+var _ http.ResponseWriter = &StatusRecorder{}
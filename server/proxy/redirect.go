@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+// redirectHandler redirects plain HTTP requests to HTTPS, preserving the
+// host, path and query.
+//
+// Requests for excluded paths, such as ACME HTTP-01 challenges, are passed to
+// next instead.
+type redirectHandler struct {
+	httpsPort    int
+	excludePaths []string
+
+	next http.Handler
+}
+
+func newRedirectHandler(conf config.RedirectConfig, next http.Handler) *redirectHandler {
+	return &redirectHandler{
+		httpsPort:    conf.HTTPSPort,
+		excludePaths: conf.ExcludePaths,
+		next:         next,
+	}
+}
+
+func (h *redirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, path := range h.excludePaths {
+		if strings.HasPrefix(r.URL.Path, path) {
+			h.next.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		http.Error(w, "missing host", http.StatusBadRequest)
+		return
+	}
+	if strings.Contains(host, ":") {
+		// IPv6.
+		host = "[" + host + "]"
+	}
+	if h.httpsPort != 443 {
+		host += ":" + strconv.Itoa(h.httpsPort)
+	}
+
+	// Use 308 rather than 301 so the method and body are preserved.
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
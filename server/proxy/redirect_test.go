@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+func TestRedirectHandler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	serve := func(conf config.RedirectConfig, method string, host string, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		newRedirectHandler(conf, next).ServeHTTP(rec, req)
+		return rec
+	}
+
+	conf := config.Default().Proxy.Redirect
+
+	t.Run("redirect", func(t *testing.T) {
+		rec := serve(conf, http.MethodPost, "my-endpoint.example.com:80", "/foo/bar?a=b")
+		assert.Equal(t, http.StatusPermanentRedirect, rec.Code)
+		assert.Equal(t, "https://my-endpoint.example.com/foo/bar?a=b", rec.Header().Get("Location"))
+	})
+
+	t.Run("https port", func(t *testing.T) {
+		conf := conf
+		conf.HTTPSPort = 8443
+		rec := serve(conf, http.MethodGet, "example.com", "/")
+		assert.Equal(t, "https://example.com:8443/", rec.Header().Get("Location"))
+
+		rec = serve(conf, http.MethodGet, "[::1]:80", "/")
+		assert.Equal(t, "https://[::1]:8443/", rec.Header().Get("Location"))
+	})
+
+	t.Run("acme challenge", func(t *testing.T) {
+		rec := serve(conf, http.MethodGet, "example.com", "/.well-known/acme-challenge/abc")
+		assert.Equal(t, http.StatusTeapot, rec.Code)
+	})
+
+	t.Run("missing host", func(t *testing.T) {
+		rec := serve(conf, http.MethodGet, "", "/")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
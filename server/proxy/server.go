@@ -14,8 +14,12 @@ import (
 	"go.uber.org/zap/zapcore"
 
 	"github.com/andydunstall/piko/pkg/auth"
+	"github.com/andydunstall/piko/pkg/fingerprint"
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/pkg/recovery"
+	"github.com/andydunstall/piko/pkg/storage"
 	"github.com/andydunstall/piko/server/config"
 	"github.com/andydunstall/piko/server/upstream"
 )
@@ -24,8 +28,39 @@ type Server struct {
 	httpProxy *HTTPProxy
 	tcpProxy  *TCPProxy
 
+	// uploads is nil if resumable uploads are disabled.
+	uploads *uploads
+
+	// queue is nil if request queueing is disabled.
+	queue *requestQueue
+
+	// waitingRoom is nil if the waiting room is disabled.
+	waitingRoom *waitingRoom
+
+	// canary is nil if traffic splitting is disabled.
+	canary *canaryRouter
+
+	// fingerprints is nil if TLS fingerprinting is disabled.
+	fingerprints *fingerprint.Table
+
+	// domains is nil if custom domains are disabled.
+	domains *customDomains
+
+	// transfers is nil if tracking transfers is disabled.
+	transfers *transferTracker
+
+	captures *captures
+
+	headers protocol.Headers
+
+	panics *recovery.Pool
+
 	httpServer *http.Server
 
+	// redirectServer is nil if the HTTP to HTTPS redirect listener is
+	// disabled.
+	redirectServer *http.Server
+
 	logger log.Logger
 }
 
@@ -36,15 +71,26 @@ func NewServer(
 	verifier auth.Verifier,
 	tlsConfig *tls.Config,
 	logger log.Logger,
+	opts ...Option,
 ) *Server {
+	options := options{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
 	logger = logger.WithSubsystem("proxy")
 
-	httpProxy := NewHTTPProxy(upstreams, proxyConfig.Timeout, logger)
+	httpProxy := NewHTTPProxy(
+		upstreams, proxyConfig.Timeout, options.forwardSigner, options.headers, logger,
+	)
+	if proxyConfig.StickySessions.Enabled() {
+		httpProxy.affinity = newAffinity(proxyConfig.StickySessions, upstreams)
+	}
 
 	router := gin.New()
 	s := &Server{
 		httpProxy: httpProxy,
-		tcpProxy:  NewTCPProxy(upstreams, httpProxy, logger),
+		tcpProxy:  NewTCPProxy(upstreams, httpProxy, options.panics, logger),
 		httpServer: &http.Server{
 			Handler:           router,
 			TLSConfig:         tlsConfig,
@@ -55,36 +101,257 @@ func NewServer(
 			MaxHeaderBytes:    proxyConfig.HTTP.MaxHeaderBytes,
 			ErrorLog:          logger.StdLogger(zapcore.WarnLevel),
 		},
-		logger: logger,
+		captures: newCaptures(options.headers, logger),
+		headers:  options.headers,
+		panics:   recovery.NewPool("proxy.http", options.panics, logger),
+		logger:   logger,
+	}
+	storageManager := options.storage
+	if storageManager == nil {
+		storageManager = storage.NewManager("", 0, storage.EvictionNone, logger)
+	}
+	if proxyConfig.Uploads.Enabled {
+		s.uploads = newUploads(
+			proxyConfig.Uploads,
+			storageManager.Area("uploads", proxyConfig.Uploads.Path),
+			httpProxy,
+			logger,
+		)
+	}
+	if proxyConfig.Queue.Enabled() {
+		s.queue = newRequestQueue(
+			proxyConfig.Queue,
+			storageManager.Area("queue", proxyConfig.Queue.Path),
+			upstreams,
+			httpProxy,
+			logger,
+		)
+	}
+
+	if proxyConfig.WaitingRoom.Enabled() {
+		s.waitingRoom = newWaitingRoom(
+			proxyConfig.WaitingRoom,
+			options.waitingRoomPage,
+			upstreams,
+			options.headers,
+			logger,
+		)
+	}
+
+	if proxyConfig.Canary.Enabled() {
+		s.canary = newCanaryRouter(proxyConfig.Canary, upstreams, logger)
+	}
+
+	if proxyConfig.CustomDomains.Enabled && tlsConfig != nil {
+		s.domains = newCustomDomains(proxyConfig.CustomDomains, logger)
+		s.httpServer.TLSConfig = s.domains.tlsConfig(tlsConfig)
 	}
 
 	// Recover from panics.
 	router.Use(gin.CustomRecoveryWithWriter(nil, s.panicRoute))
 
+	if options.admission != nil {
+		router.Use(options.admission.Handler("proxy"))
+	}
+
+	// Fingerprint before filtering, so the fingerprints of blocked clients
+	// are recorded.
+	if proxyConfig.Fingerprint.Enabled {
+		s.fingerprints = fingerprint.NewTable(proxyConfig.Fingerprint.MaxFingerprints)
+		s.httpServer.ConnContext = fingerprint.ConnContext
+		router.Use(middleware.NewFingerprint(s.fingerprints))
+	}
+
+	// Filter requests before authenticating, so requests from scanners
+	// don't cause auth lockouts.
+	if proxyConfig.Filter.Enabled() {
+		filter := newRequestFilter(proxyConfig.Filter, options.headers, logger)
+		if registry != nil {
+			filter.Metrics().Register(registry)
+		}
+		router.Use(filter.Handler())
+	}
+
 	if verifier != nil {
-		authMiddleware := middleware.NewAuth(verifier, logger)
-		router.Use(authMiddleware.Verify)
+		authMiddleware := middleware.NewAuth(
+			verifier, logger, middleware.WithAuthHeaders(options.headers),
+		)
+		router.Use(publicEndpointsMiddleware(
+			proxyConfig.PublicEndpoints, s.endpointID, authMiddleware.Verify,
+		))
+	}
+
+	if proxyConfig.IdentityHeaders {
+		router.Use(identityHeadersMiddleware(options.headers))
 	}
 
+	if proxyConfig.HSTS.Enabled() {
+		router.Use(hstsMiddleware(proxyConfig.HSTS, s.endpointID))
+	}
+
+	if options.maxTenants != 0 {
+		router.Use(middleware.NewTenant())
+	}
+
+	if options.geoIP != nil {
+		router.Use(middleware.NewGeoIP(options.geoIP))
+	}
+
+	if options.routes != nil {
+		router.Use(middleware.NewRoute(options.routes))
+	}
+
+	router.Use(middleware.NewSampling(
+		newEndpointSampler(proxyConfig, options.headers),
+	))
+
 	router.Use(middleware.NewLogger(proxyConfig.AccessLog, logger))
 
+	if options.events != nil {
+		router.Use(eventsMiddleware(options.events, options.headers))
+	}
+
+	if proxyConfig.Transfers.Enabled() {
+		s.transfers = newTransferTracker(
+			proxyConfig.Transfers, options.events, logger,
+		)
+		if registry != nil {
+			s.transfers.metrics.Register(registry)
+		}
+		router.Use(s.transfers.Handler(s.endpointID))
+	}
+
+	router.Use(s.captures.Handler(s.endpointID))
+
 	if registry != nil {
-		metrics := middleware.NewMetrics("proxy")
+		var metricsOpts []middleware.MetricsOption
+		if proxyConfig.BatchMetricsInterval != 0 {
+			metricsOpts = append(
+				metricsOpts,
+				middleware.WithBatchedLatency(proxyConfig.BatchMetricsInterval),
+			)
+		}
+		metrics := middleware.NewMetrics("proxy", metricsOpts...)
 		metrics.Register(registry)
 		router.Use(metrics.Handler())
+
+		httpProxy.Metrics().Register(registry)
+
+		if s.queue != nil {
+			s.queue.metrics.Register(registry)
+		}
+
+		if s.canary != nil {
+			s.canary.metrics.Register(registry)
+		}
+
+		if options.maxTenants != 0 {
+			tenantMetrics := middleware.NewTenantMetrics("proxy", options.maxTenants)
+			tenantMetrics.Register(registry)
+			router.Use(tenantMetrics.Handler())
+		}
+
+		if options.routes != nil {
+			routeMetrics := middleware.NewRouteMetrics("proxy")
+			routeMetrics.Register(registry)
+			router.Use(routeMetrics.Handler())
+		}
+
+		if options.geoIP != nil {
+			geoIPMetrics := middleware.NewGeoIPMetrics("proxy")
+			geoIPMetrics.Register(registry)
+			router.Use(geoIPMetrics.Handler())
+		}
 	}
 
 	s.registerRoutes(router)
 
+	if proxyConfig.Redirect.Enabled() {
+		// Requests excluded from redirecting are handled by the proxy.
+		var next http.Handler = router
+		if s.domains != nil {
+			next = s.domains.httpHandler(next)
+		}
+		s.redirectServer = &http.Server{
+			Handler:           newRedirectHandler(proxyConfig.Redirect, next),
+			ReadTimeout:       proxyConfig.HTTP.ReadTimeout,
+			ReadHeaderTimeout: proxyConfig.HTTP.ReadHeaderTimeout,
+			WriteTimeout:      proxyConfig.HTTP.WriteTimeout,
+			IdleTimeout:       proxyConfig.HTTP.IdleTimeout,
+			MaxHeaderBytes:    proxyConfig.HTTP.MaxHeaderBytes,
+			ErrorLog:          logger.StdLogger(zapcore.WarnLevel),
+		}
+	}
+
 	return s
 }
 
+// QueueHandler returns the admin handler to manage queued requests, or nil
+// if request queueing is disabled.
+func (s *Server) QueueHandler() *QueueHandler {
+	if s.queue == nil {
+		return nil
+	}
+	return &QueueHandler{queue: s.queue}
+}
+
+// CanaryHandler returns the admin handler to analyse traffic splits, or nil
+// if traffic splitting is disabled.
+func (s *Server) CanaryHandler() *CanaryHandler {
+	if s.canary == nil {
+		return nil
+	}
+	return &CanaryHandler{router: s.canary}
+}
+
+// FingerprintStatus returns the admin handler to query TLS client
+// fingerprints, or nil if fingerprinting is disabled.
+func (s *Server) FingerprintStatus() *FingerprintStatus {
+	if s.fingerprints == nil {
+		return nil
+	}
+	return &FingerprintStatus{table: s.fingerprints}
+}
+
+// DomainsHandler returns the admin handler to manage custom domains, or nil
+// if custom domains are disabled.
+func (s *Server) DomainsHandler() *DomainsHandler {
+	if s.domains == nil {
+		return nil
+	}
+	return &DomainsHandler{domains: s.domains}
+}
+
+// CaptureHandler returns the admin handler to manage debug captures.
+func (s *Server) CaptureHandler() *CaptureHandler {
+	return &CaptureHandler{captures: s.captures}
+}
+
+// HTTPProxy returns the proxy used to forward HTTP requests to upstreams.
+func (s *Server) HTTPProxy() *HTTPProxy {
+	return s.httpProxy
+}
+
 func (s *Server) Serve(ln net.Listener) error {
 	s.logger.Info(
 		"starting proxy server",
 		zap.String("addr", ln.Addr().String()),
 	)
 
+	if s.uploads != nil {
+		go s.uploads.run()
+	}
+	if s.queue != nil {
+		go s.queue.run()
+	}
+	if s.transfers != nil {
+		go s.transfers.run()
+	}
+
+	if s.fingerprints != nil {
+		ln = fingerprint.NewListener(ln)
+	}
+
 	var err error
 	if s.httpServer.TLSConfig != nil {
 		err = s.httpServer.ServeTLS(ln, "", "")
@@ -98,7 +365,36 @@ func (s *Server) Serve(ln net.Listener) error {
 	return nil
 }
 
+// ServeRedirect serves plain HTTP requests on the listener, which are
+// redirected to HTTPS.
+func (s *Server) ServeRedirect(ln net.Listener) error {
+	s.logger.Info(
+		"starting proxy redirect server",
+		zap.String("addr", ln.Addr().String()),
+	)
+
+	if err := s.redirectServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("http serve: %w", err)
+	}
+	return nil
+}
+
+// ShutdownRedirect gracefully shuts down the redirect server.
+func (s *Server) ShutdownRedirect(ctx context.Context) error {
+	return s.redirectServer.Shutdown(ctx)
+}
+
 func (s *Server) Shutdown(ctx context.Context) error {
+	if s.uploads != nil {
+		s.uploads.close()
+	}
+	if s.queue != nil {
+		s.queue.close()
+	}
+	if s.transfers != nil {
+		s.transfers.close()
+	}
+
 	if err := s.httpServer.Shutdown(ctx); err != nil {
 		return err
 	}
@@ -109,13 +405,23 @@ func (s *Server) registerRoutes(router *gin.Engine) {
 	// All /_piko routes are reserved.
 	piko := router.Group("/_piko")
 	v1 := piko.Group("/v1")
-	v1.GET("/tcp/:endpointID", s.proxyTCPRoute)
+	v1.GET("/tcp/*endpointID", s.proxyTCPRoute)
+
+	if s.uploads != nil {
+		v1.HEAD("/uploads/:uploadID", s.uploads.headRoute)
+		v1.PATCH("/uploads/:uploadID", s.uploads.patchRoute)
+		v1.DELETE("/uploads/:uploadID", s.uploads.deleteRoute)
+	}
+
+	if s.queue != nil {
+		v1.GET("/deliveries/:deliveryID", s.queue.deliveryRoute)
+	}
 
 	router.NoRoute(s.proxyHTTPRoute)
 }
 
 func (s *Server) proxyHTTPRoute(c *gin.Context) {
-	endpointID := EndpointIDFromRequest(c.Request)
+	endpointID := s.endpointID(c.Request)
 	if endpointID == "" {
 		s.logger.Warn("request missing endpoint id")
 		c.JSON(
@@ -147,11 +453,34 @@ func (s *Server) proxyHTTPRoute(c *gin.Context) {
 		}
 	}
 
+	if s.queue != nil && s.queue.handle(c, endpointID) {
+		return
+	}
+
+	if s.waitingRoom != nil && s.waitingRoom.handle(c, endpointID) {
+		return
+	}
+
+	if s.canary != nil {
+		// Route a percentage of requests to the canary endpoint, and record
+		// the response to compare the groups.
+		var done func(statusCode int)
+		endpointID, done = s.canary.route(endpointID)
+		defer func() {
+			done(c.Writer.Status())
+		}()
+	}
+
+	if s.uploads != nil && isUploadCreation(c.Request) {
+		s.uploads.create(c, endpointID)
+		return
+	}
+
 	s.httpProxy.ServeHTTP(c.Writer, c.Request, endpointID)
 }
 
 func (s *Server) proxyTCPRoute(c *gin.Context) {
-	endpointID := c.Param("endpointID")
+	endpointID := tcpEndpointID(c)
 
 	// Verify the token is permitted to access the target endpoint.
 	token, ok := c.Get(middleware.TokenContextKey)
@@ -178,22 +507,81 @@ func (s *Server) proxyTCPRoute(c *gin.Context) {
 	s.tcpProxy.ServeHTTP(c.Writer, c.Request, endpointID)
 }
 
+// endpointID returns the endpoint ID from the HTTP request, or an empty
+// string if no endpoint ID is specified.
+//
+// The endpoint header (such as 'x-piko-endpoint') takes precedence, then a
+// verified custom domain matching the 'Host' header, then the endpoint ID in
+// the 'Host' header (see [EndpointIDFromRequest]).
+func (s *Server) endpointID(r *http.Request) string {
+	if endpointID := r.Header.Get(s.headers.Endpoint()); endpointID != "" {
+		return endpointID
+	}
+	if s.domains != nil {
+		if endpointID, ok := s.domains.endpoint(r.Host); ok {
+			return endpointID
+		}
+	}
+	return EndpointIDFromRequest(r, s.headers)
+}
+
+// newEndpointSampler returns a function that selects the sampler for the
+// endpoint of the request.
+func newEndpointSampler(
+	proxyConfig config.ProxyConfig,
+	headers protocol.Headers,
+) func(c *gin.Context) *middleware.Sampler {
+	defaultSampler := middleware.NewSampler(proxyConfig.SampleRate)
+	endpointSamplers := make(map[string]*middleware.Sampler)
+	for endpointID, rate := range proxyConfig.EndpointSampleRates {
+		endpointSamplers[endpointID] = middleware.NewSampler(rate)
+	}
+
+	return func(c *gin.Context) *middleware.Sampler {
+		if len(endpointSamplers) == 0 {
+			return defaultSampler
+		}
+
+		// TCP routes include the endpoint ID as a path parameter.
+		endpointID := tcpEndpointID(c)
+		if endpointID == "" {
+			endpointID = EndpointIDFromRequest(c.Request, headers)
+		}
+		if sampler, ok := endpointSamplers[endpointID]; ok {
+			return sampler
+		}
+		return defaultSampler
+	}
+}
+
+// tcpEndpointID returns the endpoint ID of a TCP route, or an empty string if
+// the route isn't a TCP route.
+//
+// The endpoint ID may contain namespaces separated by '/', so is matched as
+// a catch-all parameter which includes the leading '/'.
+func tcpEndpointID(c *gin.Context) string {
+	return strings.TrimPrefix(c.Param("endpointID"), "/")
+}
+
 func (s *Server) panicRoute(c *gin.Context, err any) {
-	s.logger.Error(
-		"handler panic",
-		zap.String("path", c.FullPath()),
-		zap.Any("err", err),
-	)
+	// The proxy aborts responses when the upstream response fails
+	// mid-body. The abort must reach the HTTP server to close the
+	// connection, otherwise the truncated response would appear complete
+	// to the client.
+	if err == http.ErrAbortHandler {
+		panic(err)
+	}
+	s.panics.Observe(err)
 	c.AbortWithStatus(http.StatusInternalServerError)
 }
 
 // EndpointIDFromRequest returns the endpoint ID from the HTTP request, or an
 // empty string if no endpoint ID is specified.
 //
-// This will check both the 'x-piko-endpoint' header and 'Host' header, where
-// x-piko-endpoint takes precedence.
-func EndpointIDFromRequest(r *http.Request) string {
-	endpointID := r.Header.Get("x-piko-endpoint")
+// This will check both the endpoint header (such as 'x-piko-endpoint') and
+// 'Host' header, where the endpoint header takes precedence.
+func EndpointIDFromRequest(r *http.Request, headers protocol.Headers) string {
+	endpointID := r.Header.Get(headers.Endpoint())
 	if endpointID != "" {
 		return endpointID
 	}
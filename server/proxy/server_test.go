@@ -1,8 +1,10 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,17 +12,26 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/andydunstall/piko/pkg/auth"
+	"github.com/andydunstall/piko/pkg/fingerprint"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/pkg/testutil"
 	"github.com/andydunstall/piko/pkg/websocket"
 	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/events"
 	"github.com/andydunstall/piko/server/upstream"
 )
 
@@ -41,6 +52,18 @@ func (m *fakeManager) AddConn(_ upstream.Upstream) {
 func (m *fakeManager) RemoveConn(_ upstream.Upstream) {
 }
 
+// offlineManager is a manager with no upstreams where the endpoint was last
+// seen at lastSeen.
+type offlineManager struct {
+	fakeManager
+
+	lastSeen time.Time
+}
+
+func (m *offlineManager) LastSeen(_ string) (time.Time, bool) {
+	return m.lastSeen, true
+}
+
 type tcpUpstream struct {
 	addr    string
 	forward bool
@@ -50,6 +73,10 @@ func (u *tcpUpstream) Dial() (net.Conn, error) {
 	return net.Dial("tcp", u.addr)
 }
 
+func (u *tcpUpstream) ID() string {
+	return "my-upstream"
+}
+
 func (u *tcpUpstream) EndpointID() string {
 	return "my-endpoint"
 }
@@ -58,6 +85,26 @@ func (u *tcpUpstream) Forward() bool {
 	return u.forward
 }
 
+// limitedUpstream is an upstream that has reached its stream limit.
+type limitedUpstream struct {
+}
+
+func (u *limitedUpstream) Dial() (net.Conn, error) {
+	return nil, upstream.ErrStreamLimit
+}
+
+func (u *limitedUpstream) ID() string {
+	return "my-upstream"
+}
+
+func (u *limitedUpstream) EndpointID() string {
+	return "my-endpoint"
+}
+
+func (u *limitedUpstream) Forward() bool {
+	return false
+}
+
 func echoListener(ln net.Listener) {
 	conn, err := ln.Accept()
 	if err != nil {
@@ -89,6 +136,163 @@ func (v *fakeVerifier) Verify(token string) (*auth.Token, error) {
 
 var _ auth.Verifier = &fakeVerifier{}
 
+// TestServer_Forward tests signing and verifying requests forwarded between
+// nodes.
+func TestServer_Forward(t *testing.T) {
+	signer := NewForwardSigner([]byte("secret"), protocol.Headers{})
+
+	// Tests requests forwarded to another node are signed.
+	t.Run("sign", func(t *testing.T) {
+		nodeServer := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				md, err := signer.Verify(r, "my-endpoint")
+				assert.NoError(t, err)
+				assert.Equal(t, 1, md.Hops)
+				assert.Equal(t, "127.0.0.1", md.ClientIP)
+			},
+		))
+		defer nodeServer.Close()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		s := NewServer(
+			&fakeManager{
+				handler: func(_ string, allowForward bool) (upstream.Upstream, bool) {
+					assert.True(t, allowForward)
+					return &tcpUpstream{
+						addr:    nodeServer.Listener.Addr().String(),
+						forward: true,
+					}, true
+				},
+			},
+			config.Default().Proxy,
+			nil,
+			nil,
+			nil,
+			log.NewNopLogger(),
+			WithForwardSigner(signer),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf("http://%s/foo", ln.Addr().String())
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	// Tests requests forwarded from another node are verified and stripped.
+	t.Run("verify", func(t *testing.T) {
+		upstreamServer := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				// Signed forward metadata must be stripped before sending
+				// to the upstream.
+				assert.Equal(t, "true", r.Header.Get(protocol.Headers{}.Forward()))
+				assert.Equal(t, "", r.Header.Get(protocol.Headers{}.ForwardSignature()))
+				assert.Equal(t, "", r.Header.Get(protocol.Headers{}.ForwardNonce()))
+				// The upstream sees the original client IP rather than the
+				// forwarding node.
+				assert.Equal(t, "1.2.3.4", r.Header.Get("X-Forwarded-For"))
+			},
+		))
+		defer upstreamServer.Close()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		s := NewServer(
+			&fakeManager{
+				handler: func(_ string, allowForward bool) (upstream.Upstream, bool) {
+					assert.False(t, allowForward)
+					return &tcpUpstream{
+						addr: upstreamServer.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.Default().Proxy,
+			nil,
+			nil,
+			nil,
+			log.NewNopLogger(),
+			WithForwardSigner(signer),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf("http://%s/foo", ln.Addr().String())
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		signer.Sign(req, forwardMetadata{
+			EndpointID: "my-endpoint",
+			ClientIP:   "1.2.3.4",
+			Hops:       1,
+		})
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	// Tests a client spoofing the forward header without a valid signature
+	// is treated as not forwarded.
+	t.Run("spoofed", func(t *testing.T) {
+		upstreamServer := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "", r.Header.Get(protocol.Headers{}.ForwardHops()))
+				assert.Equal(t, "", r.Header.Get(protocol.Headers{}.ForwardSignature()))
+				assert.Equal(t, "127.0.0.1", r.Header.Get("X-Forwarded-For"))
+			},
+		))
+		defer upstreamServer.Close()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		s := NewServer(
+			&fakeManager{
+				handler: func(_ string, allowForward bool) (upstream.Upstream, bool) {
+					assert.True(t, allowForward)
+					return &tcpUpstream{
+						addr: upstreamServer.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.Default().Proxy,
+			nil,
+			nil,
+			nil,
+			log.NewNopLogger(),
+			WithForwardSigner(signer),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf("http://%s/foo", ln.Addr().String())
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		req.Header.Add(protocol.Headers{}.Forward(), "true")
+		req.Header.Add(protocol.Headers{}.ForwardHops(), "1")
+		req.Header.Add(protocol.Headers{}.ForwardSignature(), "invalid")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
+
 // TestServer_HTTP tests proxying HTTP traffic to upstreams.
 func TestServer_HTTP(t *testing.T) {
 	// Tests proxying a request to the upstream.
@@ -98,6 +302,10 @@ func TestServer_HTTP(t *testing.T) {
 			func(w http.ResponseWriter, r *http.Request) {
 				assert.Equal(t, "/foo/bar", r.URL.Path)
 				assert.Equal(t, "a=b", r.URL.RawQuery)
+				// The request IDs are added for the agent.
+				assert.NotEmpty(t, r.Header.Get(protocol.Headers{}.RequestID()))
+				assert.NotEqual(t, "spoofed", r.Header.Get(protocol.Headers{}.RequestID()))
+				assert.Equal(t, "my-upstream", r.Header.Get(protocol.Headers{}.ConnectionID()))
 
 				buf := new(strings.Builder)
 				// nolint
@@ -138,6 +346,8 @@ func TestServer_HTTP(t *testing.T) {
 		url := fmt.Sprintf("http://%s/foo/bar?a=b", ln.Addr().String())
 		req, _ := http.NewRequest(http.MethodGet, url, b)
 		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		// Client request IDs aren't trusted.
+		req.Header.Add(protocol.Headers{}.RequestID(), "spoofed")
 
 		client := &http.Client{}
 		resp, err := client.Do(req)
@@ -145,6 +355,7 @@ func TestServer_HTTP(t *testing.T) {
 		defer resp.Body.Close()
 
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get(protocol.Headers{}.RequestID()))
 
 		buf := new(strings.Builder)
 		// nolint
@@ -152,7 +363,361 @@ func TestServer_HTTP(t *testing.T) {
 		assert.Equal(t, "bar", buf.String())
 	})
 
+	// Tests recording tunnel and upstream latency using the upstream
+	// duration reported by the agent.
+	t.Run("latency", func(t *testing.T) {
+		upstreamServer := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set(protocol.Headers{}.UpstreamDuration(), "0.000001")
+				// nolint
+				w.Write([]byte("bar"))
+			},
+		))
+		defer upstreamServer.Close()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		registry := prometheus.NewRegistry()
+		s := NewServer(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: upstreamServer.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.Default().Proxy,
+			registry,
+			nil,
+			nil,
+			log.NewNopLogger(),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf("http://%s/foo", ln.Addr().String())
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		// The upstream duration isn't returned to the client.
+		assert.Equal(t, "", resp.Header.Get(protocol.Headers{}.UpstreamDuration()))
+
+		families, err := registry.Gather()
+		require.NoError(t, err)
+		counts := make(map[string]uint64)
+		for _, family := range families {
+			for _, m := range family.GetMetric() {
+				if h := m.GetHistogram(); h != nil {
+					counts[family.GetName()] = h.GetSampleCount()
+				}
+			}
+		}
+		assert.Equal(t, uint64(1), counts["piko_proxy_tunnel_latency_seconds"])
+		assert.Equal(t, uint64(1), counts["piko_proxy_upstream_latency_seconds"])
+	})
+
+	// Tests forwarding '103 Early Hints' responses to the client.
+	t.Run("early hints", func(t *testing.T) {
+		upstreamServer := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Link", "</style.css>; rel=preload")
+				w.WriteHeader(http.StatusEarlyHints)
+				w.Header().Del("Link")
+
+				// nolint
+				w.Write([]byte("bar"))
+			},
+		))
+		defer upstreamServer.Close()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		s := NewServer(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: upstreamServer.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.Default().Proxy,
+			nil,
+			nil,
+			nil,
+			log.NewNopLogger(),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		var hints []string
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(status int, header textproto.MIMEHeader) error {
+				assert.Equal(t, http.StatusEarlyHints, status)
+				hints = append(hints, header.Get("Link"))
+				return nil
+			},
+		}
+		ctx := httptrace.WithClientTrace(context.Background(), trace)
+		url := fmt.Sprintf("http://%s/foo", ln.Addr().String())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, []string{"</style.css>; rel=preload"}, hints)
+		// The hints aren't included in the final response.
+		assert.Equal(t, "", resp.Header.Get("Link"))
+
+		assert.Equal(t, 1.0, promtestutil.ToFloat64(
+			s.httpProxy.Metrics().InformationalResponsesTotal.WithLabelValues("103"),
+		))
+	})
+
+	// Tests the client only sends a request body with 'Expect: 100-continue'
+	// once the upstream accepts the request.
+	t.Run("expect continue", func(t *testing.T) {
+		upstreamServer := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/reject" {
+					// Reject without reading the body so no '100 Continue'
+					// is sent.
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					return
+				}
+
+				// nolint
+				io.Copy(w, r.Body)
+			},
+		))
+		defer upstreamServer.Close()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		s := NewServer(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: upstreamServer.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.Default().Proxy,
+			nil,
+			nil,
+			nil,
+			log.NewNopLogger(),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		client := &http.Client{
+			Transport: &http.Transport{
+				ExpectContinueTimeout: time.Second * 10,
+			},
+		}
+		defer client.CloseIdleConnections()
+		post := func(path string) (*http.Response, int) {
+			var continues int
+			trace := &httptrace.ClientTrace{
+				Got100Continue: func() {
+					continues++
+				},
+			}
+			ctx := httptrace.WithClientTrace(context.Background(), trace)
+			url := fmt.Sprintf("http://%s%s", ln.Addr().String(), path)
+			req, _ := http.NewRequestWithContext(
+				ctx, http.MethodPost, url, strings.NewReader("foo"),
+			)
+			req.Header.Add("x-piko-endpoint", "my-endpoint")
+			req.Header.Set("Expect", "100-continue")
+
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			return resp, continues
+		}
+
+		resp, continues := post("/accept")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 1, continues)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "foo", string(body))
+
+		resp, continues = post("/reject")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		assert.Equal(t, 0, continues)
+	})
+
+	// Tests forwarding trailers on chunked responses.
+	t.Run("trailers", func(t *testing.T) {
+		upstreamServer := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				// Clients that support trailers send 'TE: trailers', such as
+				// gRPC clients.
+				assert.Equal(t, "trailers", r.Header.Get("TE"))
+
+				// Declared trailer.
+				w.Header().Set("Trailer", "Grpc-Status")
+				w.WriteHeader(http.StatusOK)
+				// nolint
+				w.Write([]byte("foo"))
+				w.(http.Flusher).Flush()
+				// nolint
+				w.Write([]byte("bar"))
+
+				w.Header().Set("Grpc-Status", "0")
+				// Undeclared trailer.
+				w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+			},
+		))
+		defer upstreamServer.Close()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		s := NewServer(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: upstreamServer.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.Default().Proxy,
+			nil,
+			nil,
+			nil,
+			log.NewNopLogger(),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf("http://%s/foo", ln.Addr().String())
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		req.Header.Set("TE", "trailers")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+		// Declared trailers are announced before the body.
+		_, ok := resp.Trailer["Grpc-Status"]
+		assert.True(t, ok)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "foobar", string(body))
+
+		// Trailers are available once the body is read.
+		assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+		assert.Equal(t, "ok", resp.Trailer.Get("Grpc-Message"))
+	})
+
 	// Tests a request times out when upstream doesn't respond.
+	// Tests non-WebSocket upgrades, such as SPDY used by 'kubectl exec',
+	// are copied in both directions after the upgrade and aren't bound by
+	// the request timeout.
+	t.Run("upgrade", func(t *testing.T) {
+		upstreamServer := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "SPDY/3.1", r.Header.Get("Upgrade"))
+
+				w.Header().Set("Connection", "Upgrade")
+				w.Header().Set("Upgrade", "SPDY/3.1")
+				w.WriteHeader(http.StatusSwitchingProtocols)
+
+				conn, rw, err := http.NewResponseController(w).Hijack()
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer conn.Close()
+
+				// nolint
+				io.Copy(conn, rw)
+			},
+		))
+		defer upstreamServer.Close()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		conf := config.Default().Proxy
+		conf.Timeout = time.Millisecond * 10
+		s := NewServer(
+			&fakeManager{
+				handler: func(endpointID string, allowForward bool) (upstream.Upstream, bool) {
+					assert.Equal(t, "my-endpoint", endpointID)
+					assert.True(t, allowForward)
+					return &tcpUpstream{
+						addr: upstreamServer.Listener.Addr().String(),
+					}, true
+				},
+			},
+			conf,
+			nil,
+			nil,
+			nil,
+			log.NewNopLogger(),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		req, _ := http.NewRequest(http.MethodPost, "http://"+ln.Addr().String()+"/exec", nil)
+		req.Header.Set("x-piko-endpoint", "my-endpoint")
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "SPDY/3.1")
+		require.NoError(t, req.Write(conn))
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		assert.Equal(t, "SPDY/3.1", resp.Header.Get("Upgrade"))
+
+		// Wait for longer than the request timeout.
+		time.Sleep(conf.Timeout * 5)
+
+		for i := 0; i != 3; i++ {
+			_, err = conn.Write([]byte("foo"))
+			require.NoError(t, err)
+
+			buf := make([]byte, 3)
+			_, err = io.ReadFull(br, buf)
+			require.NoError(t, err)
+			assert.Equal(t, "foo", string(buf))
+		}
+	})
+
 	t.Run("timeout", func(t *testing.T) {
 		blockCh := make(chan struct{})
 		upstreamServer := httptest.NewServer(http.HandlerFunc(
@@ -198,28 +763,155 @@ func TestServer_HTTP(t *testing.T) {
 		assert.NoError(t, err)
 		defer resp.Body.Close()
 
-		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+
+		m := errorMessage{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "upstream timeout", m.Error)
+	})
+
+	// Tests a request returns an error when the upstream is unreachable.
+	t.Run("upstream unreachable", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		s := NewServer(
+			&fakeManager{
+				handler: func(endpointID string, allowForward bool) (upstream.Upstream, bool) {
+					assert.Equal(t, "my-endpoint", endpointID)
+					assert.True(t, allowForward)
+					return &tcpUpstream{
+						// Unreachable address.
+						addr: "localhost:55555",
+					}, true
+				},
+			},
+			config.Default().Proxy,
+			nil,
+			nil,
+			nil,
+			log.NewNopLogger(),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf("http://%s/", ln.Addr().String())
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		client := &http.Client{}
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+		m := errorMessage{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "upstream unreachable", m.Error)
+		// The error includes the IDs to match the failure with the logs.
+		assert.NotEmpty(t, m.RequestID)
+		assert.Equal(t, m.RequestID, resp.Header.Get(protocol.Headers{}.RequestID()))
+		assert.Equal(t, "my-upstream", m.UpstreamID)
+	})
+
+	// Tests a request returns an error when the upstream has reached its
+	// stream limit.
+	t.Run("upstream stream limit", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		s := NewServer(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &limitedUpstream{}, true
+				},
+			},
+			config.Default().Proxy,
+			nil,
+			nil,
+			nil,
+			log.NewNopLogger(),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf("http://%s/", ln.Addr().String())
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		client := &http.Client{}
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+		m := errorMessage{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "upstream stream limit reached", m.Error)
+	})
+
+	// Tests the server returns an error if there are no upstreams for the
+	// requested endpoint.
+	t.Run("no available upstreams", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		s := NewServer(
+			&fakeManager{
+				handler: func(endpointID string, allowForward bool) (upstream.Upstream, bool) {
+					assert.Equal(t, "my-endpoint", endpointID)
+					assert.True(t, allowForward)
+					return nil, false
+				},
+			},
+			config.Default().Proxy,
+			nil,
+			nil,
+			nil,
+			log.NewNopLogger(),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf("http://%s/", ln.Addr().String())
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		client := &http.Client{}
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
 
 		m := errorMessage{}
 		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
-		assert.Equal(t, "upstream timeout", m.Error)
+		assert.Equal(t, "no available upstreams", m.Error)
+		assert.NotEmpty(t, m.RequestID)
 	})
 
-	// Tests a request returns an error when the upstream is unreachable.
-	t.Run("upstream unreachable", func(t *testing.T) {
+	// Tests the server reports when the endpoint was last seen if it recently
+	// went offline.
+	t.Run("endpoint offline", func(t *testing.T) {
 		ln, err := net.Listen("tcp", "127.0.0.1:0")
 		require.NoError(t, err)
 
 		s := NewServer(
-			&fakeManager{
-				handler: func(endpointID string, allowForward bool) (upstream.Upstream, bool) {
-					assert.Equal(t, "my-endpoint", endpointID)
-					assert.True(t, allowForward)
-					return &tcpUpstream{
-						// Unreachable address.
-						addr: "localhost:55555",
-					}, true
+			&offlineManager{
+				fakeManager: fakeManager{
+					handler: func(string, bool) (upstream.Upstream, bool) {
+						return nil, false
+					},
 				},
+				lastSeen: time.Now().Add(-time.Minute),
 			},
 			config.Default().Proxy,
 			nil,
@@ -245,23 +937,17 @@ func TestServer_HTTP(t *testing.T) {
 
 		m := errorMessage{}
 		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
-		assert.Equal(t, "upstream unreachable", m.Error)
+		assert.Equal(t, "endpoint recently went offline (last seen 1m0s ago)", m.Error)
 	})
 
-	// Tests the server returns an error if there are no upstreams for the
-	// requested endpoint.
-	t.Run("no available upstreams", func(t *testing.T) {
+	// Tests the server returns an error if the request is missing an endpoint
+	// ID.
+	t.Run("missing endpoint id", func(t *testing.T) {
 		ln, err := net.Listen("tcp", "127.0.0.1:0")
 		require.NoError(t, err)
 
 		s := NewServer(
-			&fakeManager{
-				handler: func(endpointID string, allowForward bool) (upstream.Upstream, bool) {
-					assert.Equal(t, "my-endpoint", endpointID)
-					assert.True(t, allowForward)
-					return nil, false
-				},
-			},
+			nil,
 			config.Default().Proxy,
 			nil,
 			nil,
@@ -275,33 +961,50 @@ func TestServer_HTTP(t *testing.T) {
 
 		url := fmt.Sprintf("http://%s/", ln.Addr().String())
 		req, _ := http.NewRequest(http.MethodGet, url, nil)
-		req.Header.Add("x-piko-endpoint", "my-endpoint")
 
 		client := &http.Client{}
 		resp, err := client.Do(req)
 		assert.NoError(t, err)
 		defer resp.Body.Close()
 
-		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 
 		m := errorMessage{}
 		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
-		assert.Equal(t, "no available upstreams", m.Error)
+		assert.Equal(t, "missing endpoint id", m.Error)
 	})
 
-	// Tests the server returns an error if the request is missing an endpoint
-	// ID.
-	t.Run("missing endpoint id", func(t *testing.T) {
+	// Tests routing and tracing headers use the configured prefix.
+	t.Run("header prefix", func(t *testing.T) {
+		headers := protocol.NewHeaders("x-tunnel-")
+
+		upstreamServer := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				assert.NotEmpty(t, r.Header.Get("x-tunnel-request-id"))
+				assert.Equal(t, "my-upstream", r.Header.Get("x-tunnel-connection-id"))
+				assert.Empty(t, r.Header.Get("x-piko-connection-id"))
+			},
+		))
+		defer upstreamServer.Close()
+
 		ln, err := net.Listen("tcp", "127.0.0.1:0")
 		require.NoError(t, err)
 
 		s := NewServer(
-			nil,
+			&fakeManager{
+				handler: func(endpointID string, _ bool) (upstream.Upstream, bool) {
+					assert.Equal(t, "my-endpoint", endpointID)
+					return &tcpUpstream{
+						addr: upstreamServer.Listener.Addr().String(),
+					}, true
+				},
+			},
 			config.Default().Proxy,
 			nil,
 			nil,
 			nil,
 			log.NewNopLogger(),
+			WithHeaders(headers),
 		)
 		go func() {
 			require.NoError(t, s.Serve(ln))
@@ -310,21 +1013,151 @@ func TestServer_HTTP(t *testing.T) {
 
 		url := fmt.Sprintf("http://%s/", ln.Addr().String())
 		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Add("x-tunnel-endpoint", "my-endpoint")
 
 		client := &http.Client{}
 		resp, err := client.Do(req)
 		assert.NoError(t, err)
 		defer resp.Body.Close()
 
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("x-tunnel-request-id"))
+		assert.Empty(t, resp.Header.Get("x-piko-request-id"))
+
+		// The default endpoint header is ignored.
+		req, _ = http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		resp, err = client.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
 		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+// TestServer_TCP tests proxying TCP traffic to upstreams.
+func TestServer_InvalidResponse(t *testing.T) {
+	// serve proxies a request to an upstream that responds with the raw
+	// response.
+	serve := func(
+		t *testing.T, rawResponse string,
+	) (*http.Response, *prometheus.Registry, error) {
+		upstreamLn, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { upstreamLn.Close() })
+		go func() {
+			conn, err := upstreamLn.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			// nolint
+			http.ReadRequest(bufio.NewReader(conn))
+			// nolint
+			conn.Write([]byte(rawResponse))
+		}()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		registry := prometheus.NewRegistry()
+		s := NewServer(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: upstreamLn.Addr().String(),
+					}, true
+				},
+			},
+			config.Default().Proxy,
+			registry,
+			nil,
+			nil,
+			log.NewNopLogger(),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		t.Cleanup(func() { s.Shutdown(context.TODO()) })
+
+		url := fmt.Sprintf("http://%s/", ln.Addr().String())
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			t.Cleanup(func() { resp.Body.Close() })
+		}
+		return resp, registry, err
+	}
+
+	// assertTruncated asserts the client sees the response is truncated,
+	// rather than the response appearing complete. Depending on whether the
+	// headers were flushed before the response was aborted, the error is
+	// either reading the headers or reading the body.
+	assertTruncated := func(t *testing.T, resp *http.Response, err error) {
+		if err != nil {
+			return
+		}
+		_, err = io.ReadAll(resp.Body)
+		assert.Error(t, err)
+	}
+
+	invalidResponses := func(registry *prometheus.Registry, reason string) float64 {
+		families, err := registry.Gather()
+		if err != nil {
+			return 0
+		}
+		for _, family := range families {
+			if family.GetName() != "piko_proxy_invalid_upstream_responses_total" {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				for _, label := range m.GetLabel() {
+					if label.GetName() == "reason" && label.GetValue() == reason {
+						return m.GetCounter().GetValue()
+					}
+				}
+			}
+		}
+		return 0
+	}
+
+	t.Run("content length mismatch", func(t *testing.T) {
+		resp, registry, err := serve(
+			t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nfoo",
+		)
+		assertTruncated(t, resp, err)
+
+		assert.Equal(t, 1.0, invalidResponses(registry, invalidReasonContentLength))
+	})
+
+	t.Run("malformed chunked", func(t *testing.T) {
+		resp, registry, err := serve(
+			t,
+			"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"+
+				"3\r\nfoo\r\nzz\r\n",
+		)
+		assertTruncated(t, resp, err)
+
+		assert.Equal(t, 1.0, invalidResponses(registry, invalidReasonMalformedChunked))
+	})
+
+	t.Run("malformed headers", func(t *testing.T) {
+		resp, registry, err := serve(
+			t, "HTTP/1.1 200 OK\r\nContent-Length: foo\r\n\r\n",
+		)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
 
 		m := errorMessage{}
 		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
-		assert.Equal(t, "missing endpoint id", m.Error)
+		assert.Equal(t, "invalid upstream response", m.Error)
+		assert.NotEmpty(t, m.RequestID)
+
+		assert.Equal(t, 1.0, invalidResponses(registry, invalidReasonMalformedHeaders))
 	})
 }
 
-// TestServer_TCP tests proxying TCP traffic to upstreams.
 func TestServer_TCP(t *testing.T) {
 	t.Run("ok", func(t *testing.T) {
 		echoLn, err := net.Listen("tcp", "127.0.0.1:0")
@@ -483,6 +1316,66 @@ func TestServer_Authentication(t *testing.T) {
 		assert.Equal(t, "bar", buf.String())
 	})
 
+	t.Run("identity headers", func(t *testing.T) {
+		upstreamServer := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "my-user", r.Header.Get("x-piko-subject"))
+				assert.Equal(t, "my-tenant", r.Header.Get("x-piko-tenant"))
+				assert.Equal(t, "read write", r.Header.Get("x-piko-scopes"))
+				// Verify spoofed headers are removed.
+				assert.Len(t, r.Header.Values("x-piko-subject"), 1)
+			},
+		))
+		defer upstreamServer.Close()
+
+		verifier := &fakeVerifier{
+			handler: func(_ string) (*auth.Token, error) {
+				return &auth.Token{
+					Subject: "my-user",
+					Tenant:  "my-tenant",
+					Scopes:  []string{"read", "write"},
+				}, nil
+			},
+		}
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		proxyConfig := config.Default().Proxy
+		proxyConfig.IdentityHeaders = true
+		s := NewServer(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: upstreamServer.Listener.Addr().String(),
+					}, true
+				},
+			},
+			proxyConfig,
+			nil,
+			verifier,
+			nil,
+			log.NewNopLogger(),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf("http://%s/foo", ln.Addr().String())
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		req.Header.Add("Authorization", "Bearer 123")
+		req.Header.Add("x-piko-subject", "spoofed")
+		req.Header.Add("x-piko-subject", "spoofed-2")
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
 	t.Run("endpoint not permitted", func(t *testing.T) {
 		verifier := &fakeVerifier{
 			handler: func(token string) (*auth.Token, error) {
@@ -631,13 +1524,219 @@ func TestServer_Authentication(t *testing.T) {
 
 		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
 	})
+
+	t.Run("public endpoint", func(t *testing.T) {
+		upstreamServer := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				// The authorization header is forwarded unchanged.
+				assert.Equal(t, "Bearer upstream-token", r.Header.Get("Authorization"))
+				// nolint
+				w.Write([]byte("bar"))
+			},
+		))
+		defer upstreamServer.Close()
+
+		verifier := &fakeVerifier{
+			handler: func(_ string) (*auth.Token, error) {
+				return nil, auth.ErrInvalidToken
+			},
+		}
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		proxyConfig := config.Default().Proxy
+		proxyConfig.PublicEndpoints = []string{"my-public-endpoint"}
+		s := NewServer(
+			&fakeManager{
+				handler: func(endpointID string, _ bool) (upstream.Upstream, bool) {
+					assert.Equal(t, "my-public-endpoint", endpointID)
+					return &tcpUpstream{
+						addr: upstreamServer.Listener.Addr().String(),
+					}, true
+				},
+			},
+			proxyConfig,
+			nil,
+			verifier,
+			nil,
+			log.NewNopLogger(),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		send := func(endpointID string) int {
+			url := fmt.Sprintf("http://%s/foo", ln.Addr().String())
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+			req.Header.Add("x-piko-endpoint", endpointID)
+			req.Header.Add("Authorization", "Bearer upstream-token")
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		assert.Equal(t, http.StatusOK, send("my-public-endpoint"))
+		// Other endpoints still require authentication.
+		assert.Equal(t, http.StatusUnauthorized, send("my-endpoint"))
+	})
+}
+
+// Tests fingerprinting TLS clients and querying the fingerprints.
+func TestServer_Fingerprint(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer upstreamServer.Close()
+
+	rootCAPool, cert, err := testutil.LocalTLSServerCert()
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	conf := config.Default().Proxy
+	conf.Fingerprint.Enabled = true
+	s := NewServer(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return &tcpUpstream{
+					addr: upstreamServer.Listener.Addr().String(),
+				}, true
+			},
+		},
+		conf,
+		nil,
+		nil,
+		&tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+		log.NewNopLogger(),
+	)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: rootCAPool,
+			},
+		},
+	}
+	for i := 0; i != 3; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "https://"+ln.Addr().String(), nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		req.Header.Add("User-Agent", "my-client")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	router := gin.New()
+	s.FingerprintStatus().Register(router.Group("/status/proxy"))
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status/proxy/fingerprints", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var entries []fingerprint.Entry
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &entries))
+	require.Len(t, entries, 1)
+	assert.Equal(t, uint64(3), entries[0].Requests)
+	assert.Equal(t, "127.0.0.1", entries[0].LastClientIP)
+	assert.Equal(t, "my-client", entries[0].LastUserAgent)
+	assert.NotEmpty(t, entries[0].JA3)
+	assert.NotEmpty(t, entries[0].JA4)
+
+	// Filter by an unknown fingerprint.
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status/proxy/fingerprints?ja4=unknown", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "[]", rec.Body.String())
+}
+
+func TestServer_CustomDomain(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer upstreamServer.Close()
+
+	_, cert, err := testutil.LocalTLSServerCert()
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	conf := config.Default().Proxy
+	conf.CustomDomains.Enabled = true
+	s := NewServer(
+		&fakeManager{
+			handler: func(endpointID string, _ bool) (upstream.Upstream, bool) {
+				assert.Equal(t, "my-endpoint", endpointID)
+				return &tcpUpstream{
+					addr: upstreamServer.Listener.Addr().String(),
+				}, true
+			},
+		},
+		conf,
+		nil,
+		nil,
+		&tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+		log.NewNopLogger(),
+	)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	d, err := s.domains.add("app.customer.com", "my-endpoint", "dns")
+	require.NoError(t, err)
+	s.domains.lookupTXT = func(_ context.Context, _ string) ([]string, error) {
+		return []string{d.Token}, nil
+	}
+	_, err = s.domains.verify(context.Background(), "app.customer.com")
+	require.NoError(t, err)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				// Skip verification as the domain doesn't match the test
+				// certificate.
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://"+ln.Addr().String(), nil)
+	req.Host = "app.customer.com"
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// defaultEndpointID returns the endpoint ID of the request using the default
+// header names.
+func defaultEndpointID(r *http.Request) string {
+	return EndpointIDFromRequest(r, protocol.Headers{})
 }
 
 func TestEndpointIDFromRequest(t *testing.T) {
 	t.Run("host header", func(t *testing.T) {
 		endpointID := EndpointIDFromRequest(&http.Request{
 			Host: "my-endpoint.piko.com:9000",
-		})
+		}, protocol.Headers{})
 		assert.Equal(t, "my-endpoint", endpointID)
 	})
 
@@ -649,28 +1748,130 @@ func TestEndpointIDFromRequest(t *testing.T) {
 			// takes precedence.
 			Host:   "another-endpoint.piko.com:9000",
 			Header: header,
-		})
+		}, protocol.Headers{})
 		assert.Equal(t, "my-endpoint", endpointID)
 	})
 
 	t.Run("ip address", func(t *testing.T) {
 		endpointID := EndpointIDFromRequest(&http.Request{
 			Host: "127.0.0.1:9000",
-		})
+		}, protocol.Headers{})
 		assert.Equal(t, "", endpointID)
 	})
 
 	t.Run("no separator", func(t *testing.T) {
 		endpointID := EndpointIDFromRequest(&http.Request{
 			Host: "localhost:9000",
-		})
+		}, protocol.Headers{})
 		assert.Equal(t, "", endpointID)
 	})
 
 	t.Run("empty host", func(t *testing.T) {
 		endpointID := EndpointIDFromRequest(&http.Request{
 			Host: "",
-		})
+		}, protocol.Headers{})
 		assert.Equal(t, "", endpointID)
 	})
+
+	t.Run("header prefix", func(t *testing.T) {
+		header := make(http.Header)
+		header.Add("x-piko-endpoint", "other-endpoint")
+		header.Add("x-tunnel-endpoint", "my-endpoint")
+		endpointID := EndpointIDFromRequest(&http.Request{
+			Header: header,
+		}, protocol.NewHeaders("x-tunnel-"))
+		assert.Equal(t, "my-endpoint", endpointID)
+	})
+}
+
+type fakePublisher struct {
+	events chan *events.Event
+}
+
+func (p *fakePublisher) Publish(_ context.Context, batch []*events.Event) error {
+	for _, event := range batch {
+		p.events <- event
+	}
+	return nil
+}
+
+func (p *fakePublisher) Close() error {
+	return nil
+}
+
+// Tests middleware that looks up the endpoint ID of the request gets the
+// endpoint ID of TCP routes.
+func TestServer_TCPRouteEndpointID(t *testing.T) {
+	const tcpPath = "/_piko/v1/tcp/team/my-endpoint"
+
+	newRouter := func(middleware gin.HandlerFunc) *gin.Engine {
+		router := gin.New()
+		router.Use(middleware)
+		router.GET("/_piko/v1/tcp/*endpointID", func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		return router
+	}
+
+	t.Run("sampler", func(t *testing.T) {
+		proxyConfig := config.Default().Proxy
+		proxyConfig.EndpointSampleRates = map[string]int{
+			"team/my-endpoint": 1_000_000_000,
+		}
+		samplerFor := newEndpointSampler(proxyConfig, protocol.Headers{})
+
+		var sampled bool
+		router := newRouter(func(c *gin.Context) {
+			sampled = samplerFor(c).Sample()
+		})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tcpPath, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		// The endpoint sampler is used rather than the default sampler,
+		// which samples all requests.
+		assert.False(t, sampled)
+	})
+
+	t.Run("events", func(t *testing.T) {
+		publisher := &fakePublisher{events: make(chan *events.Event, 1)}
+		conf := config.Default().Events
+		conf.BatchSize = 1
+		exporter := events.NewExporter(conf, publisher, "my-node", log.NewNopLogger())
+		go exporter.Start()
+		defer exporter.Stop()
+
+		router := newRouter(eventsMiddleware(exporter, protocol.Headers{}))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tcpPath, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		select {
+		case event := <-publisher.events:
+			assert.Equal(t, "team/my-endpoint", event.EndpointID)
+		case <-time.After(time.Second):
+			t.Fatal("event not published")
+		}
+	})
+
+	t.Run("public endpoint", func(t *testing.T) {
+		router := newRouter(publicEndpointsMiddleware(
+			[]string{"team/my-endpoint"},
+			func(_ *http.Request) string { return "" },
+			func(c *gin.Context) {
+				c.AbortWithStatus(http.StatusUnauthorized)
+			},
+		))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tcpPath, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		// Other endpoints still require authentication.
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(
+			http.MethodGet, "/_piko/v1/tcp/team/other-endpoint", nil,
+		))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
 }
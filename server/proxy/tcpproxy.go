@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/recovery"
 	pikowebsocket "github.com/andydunstall/piko/pkg/websocket"
 	"github.com/andydunstall/piko/server/upstream"
 )
@@ -25,24 +27,29 @@ type TCPProxy struct {
 
 	websocketUpgrader *websocket.Upgrader
 
+	panics *recovery.Pool
+
 	logger log.Logger
 }
 
 func NewTCPProxy(
 	upstreams upstream.Manager,
 	httpProxy *HTTPProxy,
+	panicMetrics *recovery.Metrics,
 	logger log.Logger,
 ) *TCPProxy {
+	logger = logger.WithSubsystem("proxy.tcp")
 	return &TCPProxy{
 		upstreams:         upstreams,
 		httpProxy:         httpProxy,
 		websocketUpgrader: &websocket.Upgrader{},
-		logger:            logger.WithSubsystem("proxy.tcp"),
+		panics:            recovery.NewPool("proxy.tcp", panicMetrics, logger),
+		logger:            logger,
 	}
 }
 
 func (p *TCPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, endpointID string) {
-	forwarded := r.Header.Get("x-piko-forward") == "true"
+	forwarded := p.httpProxy.forwardHops(r, endpointID) >= maxForwardHops
 
 	// If there is a connected upstream, attempt to forward the request to one
 	// of those upstreams. Note this includes remote nodes that are reporting
@@ -55,7 +62,7 @@ func (p *TCPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, endpointID
 			zap.String("endpoint-id", endpointID),
 		)
 
-		_ = errorResponse(w, http.StatusBadGateway, "no available upstreams")
+		_ = errorResponse(w, http.StatusBadGateway, noUpstreamsMessage(p.upstreams, endpointID))
 		return
 	}
 
@@ -69,6 +76,10 @@ func (p *TCPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, endpointID
 	}
 
 	upstreamConn, err := u.Dial()
+	if errors.Is(err, upstream.ErrStreamLimit) {
+		_ = errorResponse(w, http.StatusServiceUnavailable, "upstream stream limit reached")
+		return
+	}
 	if err != nil {
 		_ = errorResponse(w, http.StatusBadGateway, "upstream unreachable")
 		return
@@ -87,12 +98,15 @@ func (p *TCPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, endpointID
 	p.forward(upstreamConn, downstreamConn)
 }
 
+// forward copies between the connections until both directions are closed.
+// A panic copying closes the connections without affecting other streams.
 func (p *TCPProxy) forward(upstream net.Conn, downstream net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
 		defer upstream.Close()
+		defer p.panics.Recover()
 		_, err := io.Copy(upstream, downstream)
 		if err != nil {
 			p.logger.Debug("copy to upstream closed", zap.Error(err))
@@ -101,6 +115,7 @@ func (p *TCPProxy) forward(upstream net.Conn, downstream net.Conn) {
 	go func() {
 		defer wg.Done()
 		defer downstream.Close()
+		defer p.panics.Recover()
 		_, err := io.Copy(downstream, upstream)
 		if err != nil {
 			p.logger.Debug("copy to downstream closed", zap.Error(err))
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/recovery"
+)
+
+// panicConn is a connection that panics when read.
+type panicConn struct {
+	net.Conn
+}
+
+func (c *panicConn) Read(_ []byte) (int, error) {
+	panic("injected panic")
+}
+
+// Tests a panic forwarding a stream closes the stream's connections rather
+// than crashing the server.
+func TestTCPProxy_ForwardPanic(t *testing.T) {
+	panicMetrics := recovery.NewMetrics()
+	proxy := NewTCPProxy(nil, nil, panicMetrics, log.NewNopLogger())
+
+	upstream, upstreamRemote := net.Pipe()
+	downstream, downstreamRemote := net.Pipe()
+	defer upstreamRemote.Close()
+	defer downstreamRemote.Close()
+
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		proxy.forward(&panicConn{Conn: upstream}, downstream)
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second * 5):
+		t.Fatal("forward didn't return")
+	}
+
+	// Both connections are closed.
+	_, err := io.ReadAll(downstreamRemote)
+	require.NoError(t, err)
+	_, err = io.ReadAll(upstreamRemote)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(
+		panicMetrics.PanicsTotal.WithLabelValues("proxy.tcp"),
+	))
+}
@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/events"
+)
+
+// transfer is an in-flight response transfer.
+type transfer struct {
+	endpointID string
+	method     string
+	path       string
+	// stream indicates the response is a server-sent event stream, which
+	// is expected to write slowly so isn't flagged as slow.
+	stream bool
+	start  time.Time
+
+	written atomic.Int64
+
+	// lastWritten and lastReport are the bytes written and time of the
+	// last progress report. Only accessed by the tracker.
+	lastWritten int64
+	lastReport  time.Time
+	// slow indicates the transfer has already been flagged as slow, so
+	// each transfer is only flagged once.
+	slow bool
+}
+
+// transferTracker periodically reports the progress of long response
+// transfers and flags transfers whose throughput is below the configured
+// threshold, which helps spot path MTU or throttling problems.
+type transferTracker struct {
+	conf config.TransfersConfig
+
+	transfers map[*transfer]struct{}
+	mu        sync.Mutex
+
+	// exporter is nil if events aren't exported.
+	exporter *events.Exporter
+
+	metrics *transferMetrics
+
+	ctx    context.Context
+	cancel func()
+
+	logger log.Logger
+}
+
+func newTransferTracker(
+	conf config.TransfersConfig,
+	exporter *events.Exporter,
+	logger log.Logger,
+) *transferTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &transferTracker{
+		conf:      conf,
+		transfers: make(map[*transfer]struct{}),
+		exporter:  exporter,
+		metrics:   newTransferMetrics(),
+		ctx:       ctx,
+		cancel:    cancel,
+		logger:    logger,
+	}
+}
+
+// Handler tracks the response of each proxied request.
+func (t *transferTracker) Handler(
+	endpointID func(r *http.Request) string,
+) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Ignore internal endpoints.
+		if strings.HasPrefix(c.Request.URL.Path, "/_piko") {
+			c.Next()
+			return
+		}
+
+		w := &transferWriter{
+			ResponseWriter: c.Writer,
+			tracker:        t,
+			transfer: &transfer{
+				endpointID: endpointID(c.Request),
+				method:     c.Request.Method,
+				path:       c.Request.URL.Path,
+			},
+		}
+		c.Writer = w
+
+		defer func() {
+			if w.started {
+				t.remove(w.transfer)
+			}
+		}()
+
+		c.Next()
+	}
+}
+
+func (t *transferTracker) run() {
+	ticker := time.NewTicker(t.conf.ProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			t.report(now)
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *transferTracker) close() {
+	t.cancel()
+}
+
+func (t *transferTracker) add(tr *transfer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.transfers[tr] = struct{}{}
+}
+
+func (t *transferTracker) remove(tr *transfer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.transfers, tr)
+}
+
+// report reports the progress of transfers that have been in progress for
+// at least the progress interval.
+func (t *transferTracker) report(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for tr := range t.transfers {
+		elapsed := now.Sub(tr.start)
+		if elapsed < t.conf.ProgressInterval {
+			continue
+		}
+
+		// Throughput is measured since the last report rather than since
+		// the transfer started, so transfers that stall are detected.
+		written := tr.written.Load()
+		window := now.Sub(tr.lastReport)
+		if window <= 0 {
+			continue
+		}
+		throughput := int64(float64(written-tr.lastWritten) / window.Seconds())
+		tr.lastWritten = written
+		tr.lastReport = now
+
+		t.metrics.Throughput.Observe(float64(throughput))
+
+		slow := t.conf.SlowThroughput != 0 &&
+			!tr.stream &&
+			!tr.slow &&
+			throughput < t.conf.SlowThroughput
+
+		fields := []zap.Field{
+			zap.String("endpoint-id", tr.endpointID),
+			zap.String("method", tr.method),
+			zap.String("path", tr.path),
+			zap.Int64("bytes", written),
+			zap.Duration("elapsed", elapsed),
+			zap.Int64("throughput", throughput),
+		}
+		if slow {
+			tr.slow = true
+			t.metrics.SlowTotal.With(prometheus.Labels{
+				"endpoint": tr.endpointID,
+			}).Inc()
+			t.logger.Warn("slow transfer", fields...)
+		} else {
+			t.logger.Debug("transfer progress", fields...)
+		}
+
+		if t.exporter != nil {
+			t.exporter.Publish(&events.Event{
+				Type:       events.EventTypeTransferProgress,
+				Time:       now,
+				EndpointID: tr.endpointID,
+				Transfer: &events.Transfer{
+					Method:       tr.method,
+					Path:         tr.path,
+					BytesWritten: written,
+					Elapsed:      elapsed.Milliseconds(),
+					Throughput:   throughput,
+					Slow:         slow,
+				},
+			})
+		}
+	}
+}
+
+// transferWriter counts the response body bytes written. The transfer
+// starts when the first byte is written, so the time waiting for the
+// upstream to respond isn't included.
+type transferWriter struct {
+	gin.ResponseWriter
+
+	tracker  *transferTracker
+	transfer *transfer
+	started  bool
+}
+
+func (w *transferWriter) Write(b []byte) (int, error) {
+	w.start()
+	n, err := w.ResponseWriter.Write(b)
+	w.transfer.written.Add(int64(n))
+	return n, err
+}
+
+func (w *transferWriter) WriteString(s string) (int, error) {
+	w.start()
+	n, err := w.ResponseWriter.WriteString(s)
+	w.transfer.written.Add(int64(n))
+	return n, err
+}
+
+func (w *transferWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+
+	contentType := w.ResponseWriter.Header().Get("Content-Type")
+	w.transfer.stream = strings.HasPrefix(contentType, "text/event-stream")
+	w.transfer.start = time.Now()
+	w.transfer.lastReport = w.transfer.start
+	w.tracker.add(w.transfer)
+}
+
+type transferMetrics struct {
+	// Throughput is the throughput of in-flight transfers in bytes per
+	// second, observed on each progress report.
+	Throughput prometheus.Histogram
+
+	// SlowTotal is the number of transfers flagged as slow. Labelled by
+	// endpoint ID.
+	SlowTotal *prometheus.CounterVec
+}
+
+func newTransferMetrics() *transferMetrics {
+	return &transferMetrics{
+		Throughput: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "transfer_throughput_bytes_per_second",
+				Help:      "Throughput of in-flight response transfers in bytes per second",
+				// 1 KB/s to 1 GB/s.
+				Buckets: prometheus.ExponentialBuckets(1<<10, 4, 11),
+			},
+		),
+		SlowTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "slow_transfers_total",
+				Help:      "Number of response transfers slower than the configured threshold",
+			},
+			[]string{"endpoint"},
+		),
+	}
+}
+
+func (m *transferMetrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.Throughput,
+		m.SlowTotal,
+	)
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+)
+
+func TestTransferTracker(t *testing.T) {
+	// serve starts a request that writes the body then blocks until
+	// done is closed.
+	serve := func(
+		tracker *transferTracker, contentType string, body string,
+	) (*transfer, chan struct{}) {
+		router := gin.New()
+		router.Use(tracker.Handler(defaultEndpointID))
+
+		written := make(chan struct{})
+		done := make(chan struct{})
+		router.NoRoute(func(c *gin.Context) {
+			c.Writer.Header().Set("Content-Type", contentType)
+			_, _ = c.Writer.WriteString(body)
+			close(written)
+			<-done
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		req.Header.Set("x-piko-endpoint", "my-endpoint")
+		go router.ServeHTTP(httptest.NewRecorder(), req)
+		<-written
+
+		tracker.mu.Lock()
+		defer tracker.mu.Unlock()
+		require.Len(t, tracker.transfers, 1)
+		for tr := range tracker.transfers {
+			return tr, done
+		}
+		return nil, done
+	}
+
+	t.Run("progress", func(t *testing.T) {
+		tracker := newTransferTracker(config.TransfersConfig{
+			ProgressInterval: time.Second,
+		}, nil, log.NewNopLogger())
+
+		tr, done := serve(tracker, "application/octet-stream", "foo")
+		assert.Equal(t, "my-endpoint", tr.endpointID)
+		assert.Equal(t, int64(3), tr.written.Load())
+
+		// Not reported before the interval.
+		tracker.report(tr.start.Add(time.Millisecond * 500))
+		assert.Equal(t, int64(0), tr.lastWritten)
+
+		tracker.report(tr.start.Add(time.Second))
+		assert.Equal(t, int64(3), tr.lastWritten)
+		assert.Equal(t, 0, testutil.CollectAndCount(tracker.metrics.SlowTotal))
+
+		close(done)
+		assert.Eventually(t, func() bool {
+			tracker.mu.Lock()
+			defer tracker.mu.Unlock()
+			return len(tracker.transfers) == 0
+		}, time.Second, time.Millisecond*10)
+	})
+
+	t.Run("slow", func(t *testing.T) {
+		tracker := newTransferTracker(config.TransfersConfig{
+			ProgressInterval: time.Second,
+			SlowThroughput:   1024,
+		}, nil, log.NewNopLogger())
+
+		tr, done := serve(tracker, "application/octet-stream", "foo")
+		defer close(done)
+
+		tracker.report(tr.start.Add(time.Second))
+		// Only flagged once.
+		tracker.report(tr.start.Add(time.Second * 2))
+		assert.True(t, tr.slow)
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			tracker.metrics.SlowTotal.WithLabelValues("my-endpoint"),
+		))
+	})
+
+	t.Run("event stream not slow", func(t *testing.T) {
+		tracker := newTransferTracker(config.TransfersConfig{
+			ProgressInterval: time.Second,
+			SlowThroughput:   1024,
+		}, nil, log.NewNopLogger())
+
+		tr, done := serve(tracker, "text/event-stream", "data: foo\n\n")
+		defer close(done)
+
+		tracker.report(tr.start.Add(time.Second))
+		assert.False(t, tr.slow)
+		assert.Equal(t, 0, testutil.CollectAndCount(tracker.metrics.SlowTotal))
+	})
+}
@@ -0,0 +1,614 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/auth"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/storage"
+	"github.com/andydunstall/piko/server/config"
+)
+
+const (
+	// tusVersion is the supported tus protocol version.
+	tusVersion = "1.0.0"
+
+	// uploadContentType is the content type of tus PATCH requests.
+	uploadContentType = "application/offset+octet-stream"
+
+	// uploadReapInterval is the maximum interval between removing expired
+	// uploads.
+	uploadReapInterval = time.Minute
+)
+
+var (
+	errUploadNotFound = errors.New("upload not found")
+	errUploadBusy     = errors.New("upload in progress")
+)
+
+// tusHeaders contains the tus request headers, which are removed before the
+// completed upload is forwarded to the upstream.
+var tusHeaders = []string{
+	"Tus-Resumable",
+	"Upload-Length",
+	"Upload-Defer-Length",
+	"Upload-Offset",
+	"Upload-Concat",
+	"Content-Length",
+}
+
+// upload is an incomplete upload.
+type upload struct {
+	id         string
+	endpointID string
+
+	// host, requestURI and header are the host, request URI and headers of
+	// the creation request, used when forwarding the completed upload.
+	host       string
+	requestURI string
+	header     http.Header
+
+	length int64
+
+	// offset is the number of bytes received.
+	offset int64
+
+	lastWrite time.Time
+
+	// busy indicates a request is writing to the upload.
+	busy bool
+}
+
+// uploads manages resumable uploads using the tus protocol
+// (https://tus.io).
+//
+// Incomplete uploads are written to disk, then once complete forwarded to
+// the upstream as a single request. This means clients on unreliable links
+// can resume uploads after a failure rather than restarting them.
+type uploads struct {
+	dir          string
+	maxSize      int64
+	maxTotalSize int64
+	expiry       time.Duration
+
+	uploads map[string]*upload
+	// totalSize is the sum of the lengths of all incomplete uploads.
+	totalSize int64
+	mu        sync.Mutex
+
+	// area accounts for the disk usage of incomplete uploads, which reserve
+	// their full length when created.
+	area *storage.Area
+
+	httpProxy *HTTPProxy
+
+	ctx    context.Context
+	cancel func()
+
+	logger log.Logger
+}
+
+func newUploads(
+	conf config.UploadsConfig,
+	area *storage.Area,
+	httpProxy *HTTPProxy,
+	logger log.Logger,
+) *uploads {
+	dir := area.Path()
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "piko-uploads")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	u := &uploads{
+		dir:          dir,
+		maxSize:      conf.MaxSize,
+		maxTotalSize: conf.MaxTotalSize,
+		expiry:       conf.Expiry,
+		uploads:      make(map[string]*upload),
+		area:         area,
+		httpProxy:    httpProxy,
+		ctx:          ctx,
+		cancel:       cancel,
+		logger:       logger.WithSubsystem("proxy.uploads"),
+	}
+	u.removeOrphaned()
+	area.SetEvictor(u.evict)
+	return u
+}
+
+// run removes expired uploads until closed.
+func (u *uploads) run() {
+	ticker := time.NewTicker(min(u.expiry, uploadReapInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			u.removeExpired()
+		case <-u.ctx.Done():
+			return
+		}
+	}
+}
+
+func (u *uploads) close() {
+	u.cancel()
+}
+
+// isUploadCreation returns whether the request is a tus upload creation
+// request.
+func isUploadCreation(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.Header.Get("Tus-Resumable") != ""
+}
+
+// create handles a tus creation request to the given endpoint.
+func (u *uploads) create(c *gin.Context, endpointID string) {
+	if !u.checkVersion(c) {
+		return
+	}
+
+	if c.Request.Header.Get("Upload-Defer-Length") != "" {
+		_ = errorResponse(
+			c.Writer, http.StatusBadRequest, "deferred upload length not supported",
+		)
+		return
+	}
+	length, err := strconv.ParseInt(c.Request.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		_ = errorResponse(c.Writer, http.StatusBadRequest, "invalid upload length")
+		return
+	}
+	if u.maxSize != 0 && length > u.maxSize {
+		_ = errorResponse(
+			c.Writer, http.StatusRequestEntityTooLarge, "upload too large",
+		)
+		return
+	}
+
+	u.removeExpired()
+
+	if err := os.MkdirAll(u.dir, 0o700); err != nil {
+		u.logger.Error("failed to create uploads dir", zap.Error(err))
+		_ = errorResponse(c.Writer, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	id, err := uploadID()
+	if err != nil {
+		u.logger.Error("failed to generate upload id", zap.Error(err))
+		_ = errorResponse(c.Writer, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	header := c.Request.Header.Clone()
+	for _, h := range tusHeaders {
+		header.Del(h)
+	}
+	// Strip any forward headers so the completed upload isn't treated as
+	// forwarded from another node.
+	stripForwardHeaders(header, u.httpProxy.headers)
+
+	// Reserve the full upload length so the total size of incomplete uploads
+	// can't exceed the limits.
+	if err := u.area.Reserve(length); err != nil {
+		u.logger.Warn(
+			"disk quota exceeded",
+			zap.String("endpoint-id", endpointID),
+			zap.Int64("length", length),
+		)
+		_ = errorResponse(
+			c.Writer, http.StatusInsufficientStorage, "insufficient upload storage",
+		)
+		return
+	}
+	u.mu.Lock()
+	if u.maxTotalSize != 0 && u.totalSize+length > u.maxTotalSize {
+		u.mu.Unlock()
+		u.area.Release(length)
+
+		u.logger.Warn(
+			"upload storage full",
+			zap.String("endpoint-id", endpointID),
+			zap.Int64("length", length),
+		)
+		_ = errorResponse(
+			c.Writer, http.StatusInsufficientStorage, "insufficient upload storage",
+		)
+		return
+	}
+	u.uploads[id] = &upload{
+		id:         id,
+		endpointID: endpointID,
+		host:       c.Request.Host,
+		requestURI: c.Request.URL.RequestURI(),
+		header:     header,
+		length:     length,
+		lastWrite:  time.Now(),
+	}
+	u.totalSize += length
+	u.mu.Unlock()
+
+	f, err := os.OpenFile(u.uploadPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		u.logger.Error("failed to create upload", zap.Error(err))
+		u.remove(id)
+		_ = errorResponse(c.Writer, http.StatusInternalServerError, "internal error")
+		return
+	}
+	f.Close()
+
+	u.logger.Debug(
+		"upload created",
+		zap.String("upload-id", id),
+		zap.String("endpoint-id", endpointID),
+		zap.Int64("length", length),
+	)
+
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Location", "/_piko/v1/uploads/"+id)
+	c.Header("Upload-Offset", "0")
+	c.Status(http.StatusCreated)
+}
+
+func (u *uploads) headRoute(c *gin.Context) {
+	if !u.checkVersion(c) {
+		return
+	}
+
+	upload, ok := u.lookup(c)
+	if !ok {
+		return
+	}
+
+	u.mu.Lock()
+	offset := upload.offset
+	u.mu.Unlock()
+
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.length, 10))
+	c.Status(http.StatusOK)
+}
+
+func (u *uploads) patchRoute(c *gin.Context) {
+	if !u.checkVersion(c) {
+		return
+	}
+	if c.Request.Header.Get("Content-Type") != uploadContentType {
+		_ = errorResponse(
+			c.Writer, http.StatusUnsupportedMediaType, "invalid content type",
+		)
+		return
+	}
+	offset, err := strconv.ParseInt(c.Request.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		_ = errorResponse(c.Writer, http.StatusBadRequest, "invalid upload offset")
+		return
+	}
+
+	upload, ok := u.lookup(c)
+	if !ok {
+		return
+	}
+
+	if err := u.acquire(upload, offset); err != nil {
+		_ = errorResponse(c.Writer, http.StatusConflict, err.Error())
+		return
+	}
+	defer u.release(upload)
+
+	n, err := u.write(upload, c.Request.Body)
+
+	u.mu.Lock()
+	upload.offset += n
+	upload.lastWrite = time.Now()
+	offset = upload.offset
+	u.mu.Unlock()
+
+	if err != nil {
+		// The client can resume from the new offset.
+		u.logger.Debug(
+			"upload interrupted",
+			zap.String("upload-id", upload.id),
+			zap.Int64("offset", offset),
+			zap.Error(err),
+		)
+		_ = errorResponse(c.Writer, http.StatusBadRequest, "upload interrupted")
+		return
+	}
+
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	if offset < upload.length {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	u.forward(c, upload)
+}
+
+func (u *uploads) deleteRoute(c *gin.Context) {
+	if !u.checkVersion(c) {
+		return
+	}
+
+	upload, ok := u.lookup(c)
+	if !ok {
+		return
+	}
+
+	if err := u.acquire(upload, -1); err != nil {
+		_ = errorResponse(c.Writer, http.StatusConflict, err.Error())
+		return
+	}
+	u.remove(upload.id)
+
+	c.Header("Tus-Resumable", tusVersion)
+	c.Status(http.StatusNoContent)
+}
+
+// forward forwards the completed upload to the upstream and writes the
+// upstream response.
+//
+// If the upstream responds with a server error the upload is kept, so the
+// client can retry by sending an empty PATCH request.
+func (u *uploads) forward(c *gin.Context, upload *upload) {
+	f, err := os.Open(u.uploadPath(upload.id))
+	if err != nil {
+		u.logger.Error("failed to open upload", zap.Error(err))
+		_ = errorResponse(c.Writer, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer f.Close()
+
+	var body io.ReadCloser = f
+	if upload.length == 0 {
+		body = http.NoBody
+	}
+	r, err := http.NewRequestWithContext(
+		c.Request.Context(), http.MethodPost, upload.requestURI, body,
+	)
+	if err != nil {
+		u.logger.Error("failed to create upload request", zap.Error(err))
+		_ = errorResponse(c.Writer, http.StatusInternalServerError, "internal error")
+		return
+	}
+	r.Host = upload.host
+	r.Header = upload.header.Clone()
+	r.ContentLength = upload.length
+	r.RemoteAddr = c.Request.RemoteAddr
+
+	u.httpProxy.ServeHTTP(c.Writer, r, upload.endpointID)
+
+	if c.Writer.Status() >= http.StatusInternalServerError {
+		u.logger.Warn(
+			"failed to forward upload",
+			zap.String("upload-id", upload.id),
+			zap.Int("status", c.Writer.Status()),
+		)
+		return
+	}
+
+	u.logger.Debug(
+		"upload forwarded",
+		zap.String("upload-id", upload.id),
+		zap.Int("status", c.Writer.Status()),
+	)
+	u.remove(upload.id)
+}
+
+// lookup returns the upload requested by the client. If the upload isn't
+// found or the client isn't permitted to access the upload, an error
+// response is written.
+func (u *uploads) lookup(c *gin.Context) (*upload, bool) {
+	id := c.Param("uploadID")
+
+	u.mu.Lock()
+	upload, ok := u.uploads[id]
+	u.mu.Unlock()
+
+	if ok && time.Since(upload.lastWrite) > u.expiry {
+		u.remove(id)
+		ok = false
+	}
+	if !ok {
+		_ = errorResponse(c.Writer, http.StatusNotFound, errUploadNotFound.Error())
+		return nil, false
+	}
+
+	// Verify the token is permitted to access the uploads endpoint.
+	token, ok := c.Get(middleware.TokenContextKey)
+	if ok {
+		endpointToken := token.(*auth.Token)
+		if !endpointToken.EndpointPermitted(upload.endpointID) {
+			u.logger.Warn(
+				"endpoint not permitted",
+				zap.Strings("token-endpoints", endpointToken.Endpoints),
+				zap.String("endpoint-id", upload.endpointID),
+			)
+			_ = errorResponse(
+				c.Writer, http.StatusUnauthorized, "endpoint not permitted",
+			)
+			return nil, false
+		}
+	}
+
+	return upload, true
+}
+
+// acquire marks the upload as busy. If offset is not negative, verifies the
+// upload is at the given offset.
+func (u *uploads) acquire(upload *upload, offset int64) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if upload.busy {
+		return errUploadBusy
+	}
+	if offset >= 0 && offset != upload.offset {
+		return fmt.Errorf("offset mismatch: %d", upload.offset)
+	}
+	upload.busy = true
+	return nil
+}
+
+func (u *uploads) release(upload *upload) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	upload.busy = false
+}
+
+// write appends the body to the upload, up to the upload length, and returns
+// the number of bytes written.
+func (u *uploads) write(upload *upload, body io.Reader) (int64, error) {
+	f, err := os.OpenFile(u.uploadPath(upload.id), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return 0, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	u.mu.Lock()
+	remaining := upload.length - upload.offset
+	u.mu.Unlock()
+
+	return io.Copy(f, io.LimitReader(body, remaining))
+}
+
+func (u *uploads) remove(id string) {
+	u.mu.Lock()
+	if upload, ok := u.uploads[id]; ok {
+		u.totalSize -= upload.length
+		delete(u.uploads, id)
+		u.area.Release(upload.length)
+	}
+	u.mu.Unlock()
+
+	if err := os.Remove(u.uploadPath(id)); err != nil && !os.IsNotExist(err) {
+		u.logger.Warn("failed to remove upload", zap.Error(err))
+	}
+}
+
+// removeExpired removes all incomplete uploads that haven't been written to
+// within the expiry.
+func (u *uploads) removeExpired() {
+	var expired []string
+	u.mu.Lock()
+	for id, upload := range u.uploads {
+		if !upload.busy && time.Since(upload.lastWrite) > u.expiry {
+			expired = append(expired, id)
+		}
+	}
+	u.mu.Unlock()
+
+	for _, id := range expired {
+		u.logger.Debug("upload expired", zap.String("upload-id", id))
+		u.remove(id)
+	}
+}
+
+// evict removes the least recently written idle uploads until at least n
+// bytes are freed, to make space when the disk quota is exceeded.
+func (u *uploads) evict(n int64) {
+	var idle []*upload
+	u.mu.Lock()
+	for _, upload := range u.uploads {
+		if !upload.busy {
+			idle = append(idle, upload)
+		}
+	}
+	u.mu.Unlock()
+
+	sort.Slice(idle, func(i, j int) bool {
+		return idle[i].lastWrite.Before(idle[j].lastWrite)
+	})
+
+	var freed int64
+	for _, upload := range idle {
+		if freed >= n {
+			return
+		}
+		u.logger.Info(
+			"evicting upload",
+			zap.String("upload-id", upload.id),
+			zap.Int64("length", upload.length),
+		)
+		u.remove(upload.id)
+		freed += upload.length
+	}
+}
+
+// removeOrphaned removes uploads left in the uploads directory, such as
+// after the node restarts. Since incomplete uploads are only tracked in
+// memory they can't be resumed.
+func (u *uploads) removeOrphaned() {
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			u.logger.Warn("failed to read uploads dir", zap.Error(err))
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		// Only remove files named like an upload, in case the directory is
+		// used for anything else.
+		if entry.IsDir() || !isUploadID(entry.Name()) {
+			continue
+		}
+		if err := os.Remove(u.uploadPath(entry.Name())); err != nil {
+			u.logger.Warn("failed to remove orphaned upload", zap.Error(err))
+			continue
+		}
+		u.logger.Debug(
+			"removed orphaned upload",
+			zap.String("upload-id", entry.Name()),
+		)
+	}
+}
+
+func (u *uploads) checkVersion(c *gin.Context) bool {
+	if c.Request.Header.Get("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		_ = errorResponse(
+			c.Writer, http.StatusPreconditionFailed, "unsupported tus version",
+		)
+		return false
+	}
+	return true
+}
+
+func (u *uploads) uploadPath(id string) string {
+	return filepath.Join(u.dir, id)
+}
+
+func uploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func isUploadID(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == 16
+}
@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+func newUploadServer(
+	t *testing.T, upstreamAddr string, uploadsConf config.UploadsConfig,
+) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	conf := config.Default().Proxy
+	conf.Uploads = uploadsConf
+	conf.Uploads.Enabled = true
+	if conf.Uploads.Path == "" {
+		conf.Uploads.Path = t.TempDir()
+	}
+	if conf.Uploads.Expiry == 0 {
+		conf.Uploads.Expiry = time.Hour
+	}
+
+	s := NewServer(
+		&fakeManager{
+			handler: func(endpointID string, _ bool) (upstream.Upstream, bool) {
+				assert.Equal(t, "my-endpoint", endpointID)
+				return &tcpUpstream{
+					addr: upstreamAddr,
+				}, true
+			},
+		},
+		conf,
+		nil,
+		nil,
+		nil,
+		log.NewNopLogger(),
+	)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	t.Cleanup(func() {
+		_ = s.Shutdown(context.TODO())
+	})
+
+	return "http://" + ln.Addr().String()
+}
+
+func tusRequest(
+	t *testing.T, method string, url string, headers map[string]string, body []byte,
+) *http.Response {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestServer_Uploads(t *testing.T) {
+	t.Run("resume", func(t *testing.T) {
+		received := make(chan []byte, 1)
+		upstreamServer := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Equal(t, "/foo/bar", r.URL.Path)
+				assert.Equal(t, "a=b", r.URL.RawQuery)
+				assert.Equal(t, "my-value", r.Header.Get("x-my-header"))
+				assert.Equal(t, "", r.Header.Get("Tus-Resumable"))
+				assert.Equal(t, "", r.Header.Get("Upload-Length"))
+
+				b, err := io.ReadAll(r.Body)
+				assert.NoError(t, err)
+				received <- b
+
+				w.WriteHeader(http.StatusCreated)
+				// nolint
+				w.Write([]byte("uploaded"))
+			},
+		))
+		defer upstreamServer.Close()
+
+		addr := newUploadServer(
+			t, upstreamServer.Listener.Addr().String(), config.UploadsConfig{},
+		)
+
+		body := []byte("foobarbaz")
+
+		resp := tusRequest(t, http.MethodPost, addr+"/foo/bar?a=b", map[string]string{
+			"x-piko-endpoint": "my-endpoint",
+			"Upload-Length":   strconv.Itoa(len(body)),
+			"x-my-header":     "my-value",
+		}, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		location := resp.Header.Get("Location")
+		assert.Contains(t, location, "/_piko/v1/uploads/")
+
+		// Upload the first part.
+		resp = tusRequest(t, http.MethodPatch, addr+location, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": "0",
+		}, body[:4])
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		assert.Equal(t, "4", resp.Header.Get("Upload-Offset"))
+
+		// Query the offset to resume.
+		resp = tusRequest(t, http.MethodHead, addr+location, nil, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "4", resp.Header.Get("Upload-Offset"))
+		assert.Equal(t, "9", resp.Header.Get("Upload-Length"))
+
+		// Upload the remaining part, which forwards the upload to the
+		// upstream.
+		resp = tusRequest(t, http.MethodPatch, addr+location, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": "4",
+		}, body[4:])
+		respBody, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, "uploaded", string(respBody))
+
+		assert.Equal(t, body, <-received)
+
+		// The upload is removed once forwarded.
+		resp = tusRequest(t, http.MethodHead, addr+location, nil, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("offset mismatch", func(t *testing.T) {
+		addr := newUploadServer(t, "", config.UploadsConfig{})
+
+		resp := tusRequest(t, http.MethodPost, addr+"/", map[string]string{
+			"x-piko-endpoint": "my-endpoint",
+			"Upload-Length":   "10",
+		}, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		resp = tusRequest(t, http.MethodPatch, addr+resp.Header.Get("Location"), map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": "5",
+		}, []byte("foo"))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		addr := newUploadServer(t, "", config.UploadsConfig{MaxSize: 100})
+
+		resp := tusRequest(t, http.MethodPost, addr+"/", map[string]string{
+			"x-piko-endpoint": "my-endpoint",
+			"Upload-Length":   "101",
+		}, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+
+	t.Run("storage full", func(t *testing.T) {
+		addr := newUploadServer(t, "", config.UploadsConfig{MaxTotalSize: 100})
+
+		resp := tusRequest(t, http.MethodPost, addr+"/", map[string]string{
+			"x-piko-endpoint": "my-endpoint",
+			"Upload-Length":   "60",
+		}, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		location := resp.Header.Get("Location")
+
+		// The first upload reserves 60 bytes so there is no space for
+		// another 60 bytes.
+		resp = tusRequest(t, http.MethodPost, addr+"/", map[string]string{
+			"x-piko-endpoint": "my-endpoint",
+			"Upload-Length":   "60",
+		}, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+
+		// Deleting the first upload frees the space.
+		resp = tusRequest(t, http.MethodDelete, addr+location, nil, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp = tusRequest(t, http.MethodPost, addr+"/", map[string]string{
+			"x-piko-endpoint": "my-endpoint",
+			"Upload-Length":   "60",
+		}, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		dir := t.TempDir()
+		addr := newUploadServer(t, "", config.UploadsConfig{
+			Path:   dir,
+			Expiry: time.Millisecond * 50,
+		})
+
+		resp := tusRequest(t, http.MethodPost, addr+"/", map[string]string{
+			"x-piko-endpoint": "my-endpoint",
+			"Upload-Length":   "10",
+		}, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		// The upload should be removed from disk without any further
+		// requests.
+		assert.Eventually(t, func() bool {
+			entries, err := os.ReadDir(dir)
+			return err == nil && len(entries) == 0
+		}, time.Second, time.Millisecond*10)
+	})
+
+	t.Run("orphaned", func(t *testing.T) {
+		dir := t.TempDir()
+		orphan := filepath.Join(dir, "0123456789abcdef0123456789abcdef")
+		require.NoError(t, os.WriteFile(orphan, []byte("foo"), 0o600))
+		other := filepath.Join(dir, "other")
+		require.NoError(t, os.WriteFile(other, []byte("foo"), 0o600))
+
+		newUploadServer(t, "", config.UploadsConfig{Path: dir})
+
+		// Only files named like uploads are removed.
+		assert.NoFileExists(t, orphan)
+		assert.FileExists(t, other)
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		addr := newUploadServer(t, "", config.UploadsConfig{})
+
+		resp := tusRequest(t, http.MethodPost, addr+"/", map[string]string{
+			"x-piko-endpoint": "my-endpoint",
+			"Tus-Resumable":   "0.2.0",
+			"Upload-Length":   "10",
+		}, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+		assert.Equal(t, "1.0.0", resp.Header.Get("Tus-Version"))
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		addr := newUploadServer(t, "", config.UploadsConfig{})
+
+		resp := tusRequest(t, http.MethodHead, addr+"/_piko/v1/uploads/unknown", nil, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
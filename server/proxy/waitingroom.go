@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+// defaultWaitingRoomPage is the built-in waiting room page.
+var defaultWaitingRoomPage = template.Must(template.New("waiting-room").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="{{.RetryAfter}}">
+<title>Starting up</title>
+<style>
+body { font-family: sans-serif; text-align: center; margin-top: 20vh; color: #333; }
+p { color: #666; }
+</style>
+</head>
+<body>
+<h1>Starting up</h1>
+<p>{{.EndpointID}} isn't available yet. This page will retry automatically in {{.RetryAfter}} seconds.</p>
+<p><small>Request ID: {{.RequestID}}</small></p>
+</body>
+</html>
+`))
+
+// waitingRoomPageData contains the fields available to the waiting room page
+// template.
+type waitingRoomPageData struct {
+	EndpointID string
+	// RetryAfter is the retry interval in seconds.
+	RetryAfter int
+	RequestID  string
+}
+
+type waitingRoomMessage struct {
+	Error      string `json:"error"`
+	RetryAfter int    `json:"retry_after"`
+	RequestID  string `json:"request_id"`
+}
+
+// waitingRoom serves a waiting room for endpoints without connected
+// upstreams, such as while an on-demand endpoint is starting up or an agent
+// is reconnecting, rather than rejecting the request.
+//
+// Browsers are served a HTML page that retries automatically, and other
+// clients are served a JSON body with the retry interval.
+type waitingRoom struct {
+	conf config.WaitingRoomConfig
+	page *template.Template
+
+	upstreams upstream.Manager
+
+	headers protocol.Headers
+
+	logger log.Logger
+}
+
+func newWaitingRoom(
+	conf config.WaitingRoomConfig,
+	page *template.Template,
+	upstreams upstream.Manager,
+	headers protocol.Headers,
+	logger log.Logger,
+) *waitingRoom {
+	if page == nil {
+		page = defaultWaitingRoomPage
+	}
+	return &waitingRoom{
+		conf:      conf,
+		page:      page,
+		upstreams: upstreams,
+		headers:   headers,
+		logger:    logger,
+	}
+}
+
+// handle serves the waiting room if enabled for the endpoint and the
+// endpoint has no upstreams. Returns false if the request should be proxied
+// as normal.
+func (w *waitingRoom) handle(c *gin.Context, endpointID string) bool {
+	if !w.conf.Permitted(endpointID) {
+		return false
+	}
+	if _, ok := w.upstreams.Select(endpointID, true); ok {
+		return false
+	}
+
+	requestID := ensureRequestID(c.Request, w.headers)
+	retryAfter := int(w.conf.RetryAfter / time.Second)
+
+	w.logger.Debug(
+		"serving waiting room",
+		zap.String("endpoint-id", endpointID),
+		zap.String("request-id", requestID),
+	)
+
+	header := c.Writer.Header()
+	header.Set("Retry-After", strconv.Itoa(retryAfter))
+	header.Set("Cache-Control", "no-store")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set(w.headers.RequestID(), requestID)
+
+	if acceptsHTML(c.Request) {
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		c.Writer.WriteHeader(http.StatusServiceUnavailable)
+		if err := w.page.Execute(c.Writer, &waitingRoomPageData{
+			EndpointID: endpointID,
+			RetryAfter: retryAfter,
+			RequestID:  requestID,
+		}); err != nil {
+			w.logger.Warn("failed to render waiting room", zap.Error(err))
+		}
+		return true
+	}
+
+	header.Set("Content-Type", "application/json")
+	c.Writer.WriteHeader(http.StatusServiceUnavailable)
+	_ = json.NewEncoder(c.Writer).Encode(&waitingRoomMessage{
+		Error:      "endpoint starting",
+		RetryAfter: retryAfter,
+		RequestID:  requestID,
+	})
+	return true
+}
+
+// acceptsHTML returns whether the request is from a browser navigating to a
+// page, rather than an API client.
+func acceptsHTML(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+func newWaitingRoomServer(
+	t *testing.T, upstreamAddr string, connected *atomic.Bool, opts ...Option,
+) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	conf := config.Default().Proxy
+	conf.WaitingRoom.Endpoints = []string{"team-a/*"}
+
+	s := NewServer(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				if !connected.Load() {
+					return nil, false
+				}
+				return &tcpUpstream{
+					addr: upstreamAddr,
+				}, true
+			},
+		},
+		conf,
+		nil,
+		nil,
+		nil,
+		log.NewNopLogger(),
+		opts...,
+	)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	t.Cleanup(func() {
+		_ = s.Shutdown(context.TODO())
+	})
+
+	return "http://" + ln.Addr().String()
+}
+
+func TestServer_WaitingRoom(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(
+		func(_ http.ResponseWriter, _ *http.Request) {},
+	))
+	defer upstreamServer.Close()
+
+	get := func(t *testing.T, addr string, endpointID string, accept string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, addr, nil)
+		require.NoError(t, err)
+		req.Header.Set("x-piko-endpoint", endpointID)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			resp.Body.Close()
+		})
+		return resp
+	}
+
+	connected := atomic.NewBool(false)
+	addr := newWaitingRoomServer(
+		t, upstreamServer.Listener.Addr().String(), connected,
+	)
+
+	t.Run("html", func(t *testing.T) {
+		resp := get(t, addr, "team-a/service-b", "text/html,*/*")
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "5", resp.Header.Get("Retry-After"))
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(b), `<meta http-equiv="refresh" content="5">`)
+		assert.Contains(t, string(b), "team-a/service-b")
+	})
+
+	t.Run("json", func(t *testing.T) {
+		resp := get(t, addr, "team-a/service-b", "application/json")
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "5", resp.Header.Get("Retry-After"))
+
+		var m waitingRoomMessage
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "endpoint starting", m.Error)
+		assert.Equal(t, 5, m.RetryAfter)
+		assert.NotEmpty(t, m.RequestID)
+	})
+
+	t.Run("not enabled", func(t *testing.T) {
+		resp := get(t, addr, "team-b/service-b", "text/html")
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	})
+
+	t.Run("connected", func(t *testing.T) {
+		connected.Store(true)
+		defer connected.Store(false)
+
+		resp := get(t, addr, "team-a/service-b", "text/html")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("custom page", func(t *testing.T) {
+		page := template.Must(template.New("page").Parse(
+			"waiting for {{.EndpointID}}",
+		))
+		addr := newWaitingRoomServer(
+			t, upstreamServer.Listener.Addr().String(), connected,
+			WithWaitingRoomPage(page),
+		)
+
+		resp := get(t, addr, "team-a/service-b", "text/html")
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "waiting for team-a/service-b", string(b))
+	})
+}
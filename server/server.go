@@ -2,24 +2,34 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"strings"
-	"sync"
 
 	"github.com/hashicorp/go-sockaddr"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/collectors"
-	"go.uber.org/atomic"
 	"go.uber.org/zap"
 
 	"github.com/andydunstall/piko/pkg/auth"
 	"github.com/andydunstall/piko/pkg/build"
+	"github.com/andydunstall/piko/pkg/geoip"
+	"github.com/andydunstall/piko/pkg/goruntime"
+	pikogossip "github.com/andydunstall/piko/pkg/gossip"
+	"github.com/andydunstall/piko/pkg/lifecycle"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/pkg/recovery"
+	"github.com/andydunstall/piko/pkg/storage"
 	"github.com/andydunstall/piko/server/admin"
+	"github.com/andydunstall/piko/server/admission"
 	"github.com/andydunstall/piko/server/cluster"
 	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/events"
+	"github.com/andydunstall/piko/server/features"
 	"github.com/andydunstall/piko/server/gossip"
+	"github.com/andydunstall/piko/server/probe"
 	"github.com/andydunstall/piko/server/proxy"
 	"github.com/andydunstall/piko/server/upstream"
 	"github.com/andydunstall/piko/server/usage"
@@ -29,7 +39,9 @@ import (
 type Server struct {
 	clusterState *cluster.State
 
-	proxyLn     net.Listener
+	proxyLn net.Listener
+	// redirectLn is nil if the HTTP to HTTPS redirect listener is disabled.
+	redirectLn  net.Listener
 	proxyServer *proxy.Server
 
 	upstreamLn     net.Listener
@@ -42,18 +54,26 @@ type Server struct {
 
 	reporter *usage.Reporter
 
-	conf *config.Config
+	// admission is nil if memory admission control is disabled.
+	admission *admission.Controller
+
+	// prober is nil if synthetic probes are disabled.
+	prober *probe.Prober
+
+	// events is nil if exporting events is disabled.
+	events *events.Exporter
 
-	// fatalCh triggers a shutdown when a fatal error occurs.
-	fatalCh chan struct{}
-	// fatalOnce ensures only a single goroutine closes fatalCh.
-	fatalOnce sync.Once
+	// geoIP is nil if GeoIP lookups are disabled.
+	geoIP *geoip.DB
 
-	// shutdown indicates whether a server shutdown has been requested.
-	shutdown *atomic.Bool
+	conf *config.Config
+
+	// network is nil if using the host network.
+	network Network
 
-	// wg waits for background goroutines to exit.
-	wg sync.WaitGroup
+	// lifecycle starts the server components in order, and stops them in
+	// the reverse order.
+	lifecycle *lifecycle.Manager
 
 	registry *prometheus.Registry
 
@@ -64,18 +84,23 @@ type Server struct {
 //
 // This loads the server configuration and open the server TCP listens, though
 // won't start accepting traffic.
-func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
+func NewServer(conf *config.Config, logger log.Logger, opts ...Option) (*Server, error) {
+	options := options{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
 	logger = logger.WithSubsystem("server")
 
 	registry := prometheus.NewRegistry()
-	registry.MustRegister(collectors.NewGoCollector())
+	goruntime.Register(registry)
 
 	s := &Server{
-		fatalCh:  make(chan struct{}),
-		shutdown: atomic.NewBool(false),
-		conf:     conf,
-		registry: registry,
-		logger:   logger,
+		lifecycle: lifecycle.NewManager(logger),
+		conf:      conf,
+		network:   options.network,
+		registry:  registry,
+		logger:    logger,
 	}
 
 	// Proxy listener.
@@ -86,6 +111,14 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 	}
 	s.proxyLn = proxyLn
 
+	if conf.Proxy.Redirect.Enabled() {
+		redirectLn, err := s.listen(conf.Proxy.Redirect.BindAddr)
+		if err != nil {
+			return nil, fmt.Errorf("proxy redirect listen: %s: %w", conf.Proxy.Redirect.BindAddr, err)
+		}
+		s.redirectLn = redirectLn
+	}
+
 	// Upstream listener.
 
 	upstreamLn, err := s.upstreamListen()
@@ -111,9 +144,163 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 	}, logger)
 	s.clusterState.Metrics().Register(registry)
 
-	upstreams := upstream.NewLoadBalancedManager(s.clusterState)
+	var dialer upstream.Dialer
+	if s.network != nil {
+		dialer = s.network
+	}
+	upstreams := upstream.NewLoadBalancedManager(
+		s.clusterState, dialer, upstream.WithLoadBalancing(conf.Upstream.LoadBalancing),
+	)
 	upstreams.Metrics().Register(registry)
 
+	headers := protocol.NewHeaders(conf.HeaderPrefix)
+	proxyOpts := []proxy.Option{proxy.WithHeaders(headers)}
+	upstreamOpts := []upstream.Option{upstream.WithHeaders(headers)}
+
+	// Panic metrics.
+
+	panicMetrics := recovery.NewMetrics()
+	panicMetrics.Register(registry)
+	proxyOpts = append(proxyOpts, proxy.WithPanicMetrics(panicMetrics))
+	upstreamOpts = append(upstreamOpts, upstream.WithPanicMetrics(panicMetrics))
+
+	// Upstream multiplexer metrics.
+
+	muxMetrics := upstream.NewMuxMetrics()
+	muxMetrics.Register(registry)
+	upstreamOpts = append(upstreamOpts, upstream.WithMuxMetrics(muxMetrics))
+
+	// Admission control.
+
+	if conf.Admission.Enabled() {
+		s.admission = admission.NewController(conf.Admission, logger)
+		s.admission.Metrics().Register(registry)
+
+		proxyOpts = append(proxyOpts, proxy.WithAdmission(s.admission))
+		upstreamOpts = append(upstreamOpts, upstream.WithAdmission(s.admission))
+	}
+
+	// Event export.
+
+	if conf.Events.Enabled() {
+		publisher, err := events.NewPublisher(conf.Events)
+		if err != nil {
+			return nil, fmt.Errorf("events: %w", err)
+		}
+		s.events = events.NewExporter(
+			conf.Events, publisher, conf.Cluster.NodeID, logger,
+		)
+		s.events.Metrics().Register(registry)
+		s.events.WatchLocalEndpoints(s.clusterState)
+
+		proxyOpts = append(proxyOpts, proxy.WithEvents(s.events))
+		upstreamOpts = append(upstreamOpts, upstream.WithEvents(s.events))
+	}
+
+	// GeoIP.
+
+	if conf.GeoIP.Enabled() {
+		geoIP, err := geoip.OpenDB(
+			conf.GeoIP.Database, conf.GeoIP.ReloadInterval, logger,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("geoip: %w", err)
+		}
+		s.geoIP = geoIP
+
+		proxyOpts = append(proxyOpts, proxy.WithGeoIP(s.geoIP))
+	}
+
+	// Storage.
+
+	storageManager := storage.NewManager(
+		conf.Storage.Path, conf.Storage.MaxSize, conf.Storage.Eviction, logger,
+	)
+	storageManager.Metrics().Register(registry)
+	proxyOpts = append(proxyOpts, proxy.WithStorage(storageManager))
+
+	// Forward signing.
+
+	if conf.Cluster.ForwardSigningKey != "" {
+		proxyOpts = append(proxyOpts, proxy.WithForwardSigner(
+			proxy.NewForwardSigner([]byte(conf.Cluster.ForwardSigningKey), headers),
+		))
+	}
+
+	// Tenants.
+
+	if conf.Tenants.Enabled {
+		proxyOpts = append(proxyOpts, proxy.WithTenants(conf.Tenants.MaxTenants))
+		upstreamOpts = append(upstreamOpts, upstream.WithTenants(true))
+	}
+
+	// Upstream session resumption.
+
+	if conf.Upstream.SessionGracePeriod != 0 {
+		upstreamOpts = append(upstreamOpts, upstream.WithSessionGracePeriod(
+			conf.Upstream.SessionGracePeriod,
+		))
+	}
+
+	// Upstream write coalescing.
+
+	if conf.Upstream.WriteCoalesceDelay != 0 {
+		upstreamOpts = append(upstreamOpts, upstream.WithWriteCoalesceDelay(
+			conf.Upstream.WriteCoalesceDelay,
+		))
+	}
+
+	// Upstream stream limits.
+
+	if conf.Upstream.MaxStreams != 0 {
+		upstreamOpts = append(upstreamOpts, upstream.WithStreamLimit(
+			conf.Upstream.MaxStreams,
+			conf.Upstream.StreamQueueTimeout,
+		))
+	}
+
+	// Upstream connection limits.
+
+	if conf.Upstream.MaxConns != 0 ||
+		conf.Upstream.MaxEndpointConns != 0 ||
+		conf.Upstream.MaxNamespaceConns != 0 {
+		connLimiter := upstream.NewConnLimiter(
+			conf.Upstream.MaxConns,
+			conf.Upstream.MaxEndpointConns,
+			conf.Upstream.MaxNamespaceConns,
+		)
+		connLimiter.Metrics().Register(registry)
+
+		upstreamOpts = append(upstreamOpts, upstream.WithConnLimiter(connLimiter))
+	}
+
+	// Upstream stream window.
+
+	if conf.Upstream.StreamWindow != 0 {
+		upstreamOpts = append(upstreamOpts, upstream.WithStreamWindow(
+			conf.Upstream.StreamWindow,
+		))
+	}
+
+	// Upstream source allow list.
+
+	if len(conf.Upstream.AllowCIDRs) != 0 {
+		prefixes, err := conf.Upstream.AllowPrefixes()
+		if err != nil {
+			return nil, fmt.Errorf("upstream: allow cidrs: %w", err)
+		}
+		upstreamOpts = append(upstreamOpts, upstream.WithAllowPrefixes(prefixes))
+	}
+
+	// Upstream rate limiting.
+
+	if conf.Upstream.RateLimit.Enabled() {
+		rateLimiter := upstream.NewRateLimiter(conf.Upstream.RateLimit, logger)
+		rateLimiter.Metrics().Register(registry)
+
+		upstreamOpts = append(upstreamOpts, upstream.WithRateLimiter(rateLimiter))
+	}
+
 	// Proxy server.
 
 	var proxyVerifier auth.Verifier
@@ -124,10 +311,32 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 		}
 		proxyVerifier = auth.NewJWTVerifier(verifierConf)
 	}
-	proxyTLSConfig, err := conf.Proxy.TLS.Load()
+	proxyTLSConfig, err := conf.Proxy.TLS.Load(logger)
 	if err != nil {
 		return nil, fmt.Errorf("proxy tls: %w", err)
 	}
+	waitingRoomPage, err := conf.Proxy.WaitingRoom.LoadPage()
+	if err != nil {
+		return nil, fmt.Errorf("proxy: waiting room: %w", err)
+	}
+	if waitingRoomPage != nil {
+		proxyOpts = append(proxyOpts, proxy.WithWaitingRoomPage(waitingRoomPage))
+	}
+	if conf.Proxy.RouteLabels.Enabled() {
+		var rules []middleware.RouteRule
+		for _, rule := range conf.Proxy.RouteLabels.Rules {
+			rules = append(rules, middleware.RouteRule{
+				Route:    rule.Route,
+				Template: rule.Template,
+				Regex:    rule.Regex,
+			})
+		}
+		classifier, err := middleware.NewPathClassifier(rules)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: route labels: %w", err)
+		}
+		proxyOpts = append(proxyOpts, proxy.WithRouteClassifier(classifier))
+	}
 	s.proxyServer = proxy.NewServer(
 		upstreams,
 		conf.Proxy,
@@ -135,8 +344,18 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 		proxyVerifier,
 		proxyTLSConfig,
 		logger,
+		proxyOpts...,
 	)
 
+	// Synthetic probes.
+
+	if conf.Probes.Enabled() {
+		s.prober = probe.NewProber(
+			conf.Probes, s.proxyServer.HTTPProxy(), logger,
+		)
+		s.prober.Metrics().Register(registry)
+	}
+
 	// Upstream server.
 
 	var upstreamVerifier auth.Verifier
@@ -146,8 +365,16 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 			return nil, fmt.Errorf("upstream: load auth: %w", err)
 		}
 		upstreamVerifier = auth.NewJWTVerifier(verifierConf)
+
+		if conf.Upstream.AuthLockout.Enabled() {
+			lockout := middleware.NewAuthLockout(
+				conf.Upstream.AuthLockout, "upstream", logger,
+			)
+			lockout.Register(registry)
+			upstreamOpts = append(upstreamOpts, upstream.WithAuthLockout(lockout))
+		}
 	}
-	upstreamTLSConfig, err := conf.Upstream.TLS.Load()
+	upstreamTLSConfig, err := conf.Upstream.TLS.Load(logger)
 	if err != nil {
 		return nil, fmt.Errorf("upstream: load tls: %w", err)
 	}
@@ -156,31 +383,65 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 		upstreamVerifier,
 		upstreamTLSConfig,
 		logger,
+		upstreamOpts...,
 	)
+	s.upstreamServer.Metrics().Register(registry)
 
 	// Admin server.
 
 	var adminVerifier auth.Verifier
+	adminOpts := []admin.Option{admin.WithHeaders(headers)}
 	if conf.Admin.Auth.Enabled() {
 		verifierConf, err := conf.Admin.Auth.Load()
 		if err != nil {
 			return nil, fmt.Errorf("admin: load auth: %w", err)
 		}
 		adminVerifier = auth.NewJWTVerifier(verifierConf)
+
+		if conf.Admin.AuthLockout.Enabled() {
+			lockout := middleware.NewAuthLockout(
+				conf.Admin.AuthLockout, "admin", logger,
+			)
+			lockout.Register(registry)
+			adminOpts = append(adminOpts, admin.WithAuthLockout(lockout))
+		}
 	}
-	adminTLSConfig, err := conf.Admin.TLS.Load()
+	adminTLSConfig, err := conf.Admin.TLS.Load(logger)
 	if err != nil {
 		return nil, fmt.Errorf("admin tls: %w", err)
 	}
+	if conf.Admin.ClientCertAuth && adminTLSConfig != nil && adminVerifier != nil {
+		// Accept clients without a certificate, who must instead
+		// authenticate with a token. Note if token authentication is
+		// disabled, clients must still present a certificate.
+		adminTLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		adminOpts = append(adminOpts, admin.WithClientCertAuth(true))
+	}
 	s.adminServer = admin.NewServer(
 		s.clusterState,
 		registry,
 		adminVerifier,
 		adminTLSConfig,
 		logger,
+		adminOpts...,
 	)
 	s.adminServer.AddStatus("/upstream", upstream.NewStatus(upstreams))
 	s.adminServer.AddStatus("/cluster", cluster.NewStatus(s.clusterState))
+	s.adminServer.AddStatus("/features", features.NewStatus(s.conf))
+
+	if queueHandler := s.proxyServer.QueueHandler(); queueHandler != nil {
+		s.adminServer.AddHandler("/queue/v1", queueHandler)
+	}
+	if canaryHandler := s.proxyServer.CanaryHandler(); canaryHandler != nil {
+		s.adminServer.AddHandler("/canary/v1", canaryHandler)
+	}
+	if fingerprintStatus := s.proxyServer.FingerprintStatus(); fingerprintStatus != nil {
+		s.adminServer.AddStatus("/proxy", fingerprintStatus)
+	}
+	if domainsHandler := s.proxyServer.DomainsHandler(); domainsHandler != nil {
+		s.adminServer.AddHandler("/domains/v1", domainsHandler)
+	}
+	s.adminServer.AddHandler("/capture/v1", s.proxyServer.CaptureHandler())
 
 	// Usage reporting.
 
@@ -198,81 +459,12 @@ func (s *Server) Start() error {
 	)
 	s.logger.Debug("piko config", zap.Any("config", s.conf))
 
-	// Start the admin server. This includes a '/ready' route that will be
-	// false until the server has started.
-	s.startAdminServer()
-
-	// Usage reporting.
-
-	if !s.conf.Usage.Disable {
-		s.startUsageReporting()
-	}
-
-	// Start listening for gossip traffic for other node. This won't actively
-	// attempt to join the cluster yet, though accepts other nodes attempting
-	// to join us.
-	//
-	// As we haven't started the upstream server, the node won't have any
-	// upstream connections so won't receive any proxy requests from other
-	// nodes in the cluster.
-	if err := s.startGossip(); err != nil {
-		return fmt.Errorf("gossip: %w", err)
-	}
-
-	// Attempt to join the cluster.
-	//
-	// When running on Kubernetes using a headless DNS record for service
-	// discovery, if this is the first pod in the service DNS resolution will
-	// fail as the pod isn't ready.
-	//
-	// Therefore this will attempt to join once, but continue booting if we
-	// fail to join the cluster, then try again once this pod is ready.
-	nodeIDs, err := s.gossiper.JoinOnBoot(s.conf.Cluster.Join)
-	if err != nil {
-		s.logger.Warn("failed to join cluster", zap.Error(err))
-	}
-	if len(nodeIDs) > 0 {
-		s.logger.Info("joined cluster", zap.Strings("node-ids", nodeIDs))
-	}
-
-	// Now we've attempted to join the cluster, we can start the upstream
-	// server and proxy server.
-	s.startUpstreamServer()
-	s.startProxyServer()
-
-	// Now we've joined the cluster and started all servers, mark the server
-	// as ready to begin accepting requests.
-	s.adminServer.SetReady(true)
-
-	// If we couldn't join the cluster on the first attempt, now the node is
-	// ready we can retry.
-	if len(nodeIDs) == 0 {
-		joinCtx, cancel := context.WithTimeout(
-			context.Background(), s.conf.Cluster.JoinTimeout,
-		)
-		defer cancel()
-
-		nodeIDs, err := s.gossiper.JoinOnStartup(joinCtx, s.conf.Cluster.Join)
-		if err != nil {
-			if s.conf.Cluster.AbortIfJoinFails {
-				return fmt.Errorf("cluster join: %w", err)
-			}
-			s.logger.Warn("failed to join cluster", zap.Error(err))
-		}
-		if len(nodeIDs) > 0 {
-			s.logger.Info("joined cluster", zap.Strings("node-ids", nodeIDs))
-		}
-	}
-
-	return nil
+	s.addComponents()
+	return s.lifecycle.Start(context.Background(), s.conf.GracePeriod)
 }
 
 // Shutdown gracefully stops the server node.
 func (s *Server) Shutdown() {
-	if !s.shutdown.CompareAndSwap(false, true) {
-		s.logger.Warn("server already being shutdown")
-	}
-
 	s.logger.Info("starting shutdown")
 
 	ctx, cancel := context.WithTimeout(
@@ -280,40 +472,254 @@ func (s *Server) Shutdown() {
 	)
 	defer cancel()
 
-	// Set the ready to false to stop incoming traffic.
-	s.adminServer.SetReady(false)
+	s.lifecycle.Stop(ctx)
 
-	// Shutdown the upstream server and close active upstream connections.
-	//
-	// We close upstream connections first since as long as we have upstream
-	// connections, we'll receive requests from other nodes in the cluster
-	// routing requests to our upstreams.
-	//
-	// We could still get requests from the proxy server but they'll be routed
-	// to other nodes.
-	s.shutdownUpstreamServer(ctx)
+	s.logger.Info("shutdown complete")
+}
 
-	// Now we no longer have any connected upstreams, we'll no longer get
-	// requests from other cluster nodes so can shut down the proxy server.
-	s.shutdownProxyServer(ctx)
+// addComponents adds the server components to the lifecycle manager.
+//
+// Components are started in the order they're added and stopped in the
+// reverse order, so when shutting down the node stops accepting traffic,
+// then disconnects its upstreams, then drains proxied requests, then leaves
+// the cluster, and finally flushes events and logs.
+func (s *Server) addComponents() {
+	// Flush buffered logs last.
+	s.lifecycle.Add(lifecycle.Component{
+		Name: "logs",
+		Stop: func(context.Context) error {
+			// Ignore errors as syncing stdout and stderr fails on some
+			// platforms.
+			_ = s.logger.Sync()
+			return nil
+		},
+	})
 
-	// Leave the cluster.
-	if err := s.gossiper.Leave(ctx); err != nil {
-		s.logger.Warn("failed to leave cluster", zap.Error(err))
-	} else {
-		s.logger.Info("left cluster")
+	// Stop exporting events after the other components, to flush events
+	// published during shutdown.
+	if s.events != nil {
+		s.lifecycle.Add(lifecycle.Component{
+			Name: "events",
+			Run: func() error {
+				s.events.Start()
+				return nil
+			},
+			Stop: func(context.Context) error {
+				s.events.Stop()
+				return nil
+			},
+		})
 	}
 
-	// Now we've left the cluster we can safely close the gossip listeners.
-	s.gossiper.Close()
+	// Start the admin server. This includes a '/ready' route that will be
+	// false until the server has started.
+	s.lifecycle.Add(lifecycle.Component{
+		Name: "admin",
+		Run: func() error {
+			return s.adminServer.Serve(s.adminLn)
+		},
+		Stop: s.adminServer.Shutdown,
+	})
 
-	s.shutdownAdminServer(ctx)
+	// Memory admission control.
+
+	if s.admission != nil {
+		s.lifecycle.Add(lifecycle.Component{
+			Name: "admission",
+			Run: func() error {
+				s.admission.Start()
+				return nil
+			},
+			Stop: func(context.Context) error {
+				s.admission.Stop()
+				return nil
+			},
+		})
+	}
+
+	// GeoIP database reloading.
+
+	if s.geoIP != nil {
+		s.lifecycle.Add(lifecycle.Component{
+			Name: "geoip",
+			Run: func() error {
+				s.geoIP.Start()
+				return nil
+			},
+			Stop: func(context.Context) error {
+				s.geoIP.Stop()
+				return nil
+			},
+		})
+	}
 
-	s.shutdownUsageReporting()
+	// Usage reporting.
 
-	s.wg.Wait()
+	if !s.conf.Usage.Disable {
+		s.lifecycle.Add(lifecycle.Component{
+			Name: "usage",
+			Run: func() error {
+				s.reporter.Start()
+				return nil
+			},
+			Stop: func(context.Context) error {
+				s.reporter.Stop()
+				return nil
+			},
+		})
+	}
+
+	// The IDs of the nodes joined on boot.
+	var joinedNodeIDs []string
+
+	s.lifecycle.Add(lifecycle.Component{
+		Name: "gossip",
+		Start: func(context.Context) error {
+			// Start listening for gossip traffic for other node. This won't
+			// actively attempt to join the cluster yet, though accepts other
+			// nodes attempting to join us.
+			//
+			// As we haven't started the upstream server, the node won't have
+			// any upstream connections so won't receive any proxy requests
+			// from other nodes in the cluster.
+			if err := s.startGossip(); err != nil {
+				return err
+			}
 
-	s.logger.Info("shutdown complete")
+			// Attempt to join the cluster.
+			//
+			// When running on Kubernetes using a headless DNS record for
+			// service discovery, if this is the first pod in the service DNS
+			// resolution will fail as the pod isn't ready.
+			//
+			// Therefore this will attempt to join once, but continue booting
+			// if we fail to join the cluster, then try again once this pod is
+			// ready.
+			nodeIDs, err := s.gossiper.JoinOnBoot(s.conf.Cluster.Join)
+			if err != nil {
+				s.logger.Warn("failed to join cluster", zap.Error(err))
+			}
+			if len(nodeIDs) > 0 {
+				s.logger.Info("joined cluster", zap.Strings("node-ids", nodeIDs))
+			}
+			joinedNodeIDs = nodeIDs
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			// Leave the cluster once the upstreams have disconnected and
+			// proxied requests have drained.
+			if err := s.gossiper.Leave(ctx); err != nil {
+				s.logger.Warn("failed to leave cluster", zap.Error(err))
+			} else {
+				s.logger.Info("left cluster")
+			}
+
+			// Now we've left the cluster we can safely close the gossip
+			// listeners.
+			s.gossiper.Close()
+			return nil
+		},
+	})
+
+	// Now we've attempted to join the cluster, we can start the proxy server
+	// and upstream server.
+	//
+	// When shutting down, the upstream server is stopped first to close
+	// active upstream connections, since as long as we have upstream
+	// connections we'll receive requests from other nodes in the cluster
+	// routing requests to our upstreams. Once there are no connected
+	// upstreams, we'll no longer get requests from other nodes so can
+	// shutdown the proxy server.
+	s.lifecycle.Add(lifecycle.Component{
+		Name: "proxy",
+		Run: func() error {
+			return s.proxyServer.Serve(s.proxyLn)
+		},
+		Stop: func(ctx context.Context) error {
+			if err := s.proxyServer.Shutdown(ctx); err != nil {
+				return err
+			}
+			s.logger.Info("shutdown proxy server")
+			return nil
+		},
+	})
+	if s.redirectLn != nil {
+		s.lifecycle.Add(lifecycle.Component{
+			Name: "proxy.redirect",
+			Run: func() error {
+				return s.proxyServer.ServeRedirect(s.redirectLn)
+			},
+			Stop: func(ctx context.Context) error {
+				return s.proxyServer.ShutdownRedirect(ctx)
+			},
+		})
+	}
+	s.lifecycle.Add(lifecycle.Component{
+		Name: "upstream",
+		Run: func() error {
+			return s.upstreamServer.Serve(s.upstreamLn)
+		},
+		Stop: func(ctx context.Context) error {
+			if err := s.upstreamServer.Shutdown(ctx); err != nil {
+				return err
+			}
+			s.logger.Info("shutdown upstream server")
+			return nil
+		},
+	})
+
+	// Stop probing endpoints before the upstreams disconnect, to avoid
+	// reporting endpoints as unavailable during shutdown.
+	if s.prober != nil {
+		s.lifecycle.Add(lifecycle.Component{
+			Name: "prober",
+			Run: func() error {
+				s.prober.Start()
+				return nil
+			},
+			Stop: func(context.Context) error {
+				s.prober.Stop()
+				return nil
+			},
+		})
+	}
+
+	s.lifecycle.Add(lifecycle.Component{
+		Name: "ready",
+		Start: func(context.Context) error {
+			// Now we've joined the cluster and started all servers, mark the
+			// server as ready to begin accepting requests.
+			s.adminServer.SetReady(true)
+
+			// If we couldn't join the cluster on the first attempt, now the
+			// node is ready we can retry.
+			if len(joinedNodeIDs) > 0 {
+				return nil
+			}
+
+			joinCtx, cancel := context.WithTimeout(
+				context.Background(), s.conf.Cluster.JoinTimeout,
+			)
+			defer cancel()
+
+			nodeIDs, err := s.gossiper.JoinOnStartup(joinCtx, s.conf.Cluster.Join)
+			if err != nil {
+				if s.conf.Cluster.AbortIfJoinFails {
+					return fmt.Errorf("cluster join: %w", err)
+				}
+				s.logger.Warn("failed to join cluster", zap.Error(err))
+			}
+			if len(nodeIDs) > 0 {
+				s.logger.Info("joined cluster", zap.Strings("node-ids", nodeIDs))
+			}
+			return nil
+		},
+		Stop: func(context.Context) error {
+			// Set the ready to false to stop incoming traffic.
+			s.adminServer.SetReady(false)
+			return nil
+		},
+	})
 }
 
 func (s *Server) Config() *config.Config {
@@ -331,7 +737,7 @@ func (s *Server) Wait(ctx context.Context) bool {
 	ok := true
 	select {
 	case <-ctx.Done():
-	case <-s.fatalCh:
+	case <-s.lifecycle.Done():
 		ok = false
 	}
 
@@ -340,15 +746,12 @@ func (s *Server) Wait(ctx context.Context) bool {
 }
 
 func (s *Server) startGossip() error {
-	gossipStreamLn, err := net.Listen("tcp", s.conf.Cluster.Gossip.BindAddr)
+	gossipStreamLn, err := s.listen(s.conf.Cluster.Gossip.BindAddr)
 	if err != nil {
 		return fmt.Errorf("listen: %s: %w", s.conf.Cluster.Gossip.BindAddr, err)
 	}
 
-	gossipPacketLn, err := net.ListenUDP("udp", &net.UDPAddr{
-		IP:   gossipStreamLn.Addr().(*net.TCPAddr).IP,
-		Port: gossipStreamLn.Addr().(*net.TCPAddr).Port,
-	})
+	gossipPacketLn, err := s.listenPacket(gossipStreamLn.Addr().String())
 	if err != nil {
 		return fmt.Errorf("listen: %s: %w", s.conf.Cluster.Gossip.BindAddr, err)
 	}
@@ -364,10 +767,15 @@ func (s *Server) startGossip() error {
 		s.conf.Cluster.Gossip.AdvertiseAddr = advertiseAddr
 	}
 
+	var dialer pikogossip.Dialer
+	if s.network != nil {
+		dialer = s.network
+	}
 	s.gossiper = gossip.NewGossip(
 		s.clusterState,
 		gossipStreamLn,
 		gossipPacketLn,
+		dialer,
 		&s.conf.Cluster.Gossip,
 		s.logger,
 	)
@@ -377,63 +785,8 @@ func (s *Server) startGossip() error {
 	return nil
 }
 
-func (s *Server) startProxyServer() {
-	s.runGoroutine(func() {
-		if err := s.proxyServer.Serve(s.proxyLn); err != nil {
-			s.logger.Error("failed to run proxy server", zap.Error(err))
-		}
-	})
-}
-
-func (s *Server) startUpstreamServer() {
-	s.runGoroutine(func() {
-		if err := s.upstreamServer.Serve(s.upstreamLn); err != nil {
-			s.logger.Error("failed to run upstream server", zap.Error(err))
-		}
-	})
-}
-
-func (s *Server) startAdminServer() {
-	s.runGoroutine(func() {
-		if err := s.adminServer.Serve(s.adminLn); err != nil {
-			s.logger.Error("failed to run admin server", zap.Error(err))
-		}
-	})
-}
-
-func (s *Server) startUsageReporting() {
-	s.runGoroutine(func() {
-		s.reporter.Start()
-	})
-}
-
-func (s *Server) shutdownProxyServer(ctx context.Context) {
-	if err := s.proxyServer.Shutdown(ctx); err != nil {
-		s.logger.Error("failed to shutdown proxy server", zap.Error(err))
-	}
-	s.logger.Info("shutdown proxy server")
-}
-
-func (s *Server) shutdownUsageReporting() {
-	s.reporter.Stop()
-}
-
-func (s *Server) shutdownUpstreamServer(ctx context.Context) {
-	if err := s.upstreamServer.Shutdown(ctx); err != nil {
-		s.logger.Error("failed to shutdown upstream server", zap.Error(err))
-	}
-	s.logger.Info("shutdown upstream server")
-}
-
-func (s *Server) shutdownAdminServer(ctx context.Context) {
-	if err := s.adminServer.Shutdown(ctx); err != nil {
-		s.logger.Error("failed to shutdown admin server", zap.Error(err))
-	}
-	s.logger.Info("shutdown admin server")
-}
-
 func (s *Server) proxyListen() (net.Listener, error) {
-	ln, err := net.Listen("tcp", s.conf.Proxy.BindAddr)
+	ln, err := s.listen(s.conf.Proxy.BindAddr)
 	if err != nil {
 		return nil, fmt.Errorf("listen: %s: %w", s.conf.Proxy.BindAddr, err)
 	}
@@ -453,7 +806,7 @@ func (s *Server) proxyListen() (net.Listener, error) {
 }
 
 func (s *Server) upstreamListen() (net.Listener, error) {
-	ln, err := net.Listen("tcp", s.conf.Upstream.BindAddr)
+	ln, err := s.listen(s.conf.Upstream.BindAddr)
 	if err != nil {
 		return nil, fmt.Errorf("listen: %s: %w", s.conf.Upstream.BindAddr, err)
 	}
@@ -473,7 +826,7 @@ func (s *Server) upstreamListen() (net.Listener, error) {
 }
 
 func (s *Server) adminListen() (net.Listener, error) {
-	ln, err := net.Listen("tcp", s.conf.Admin.BindAddr)
+	ln, err := s.listen(s.conf.Admin.BindAddr)
 	if err != nil {
 		return nil, fmt.Errorf("listen: %s: %w", s.conf.Admin.BindAddr, err)
 	}
@@ -492,24 +845,18 @@ func (s *Server) adminListen() (net.Listener, error) {
 	return ln, nil
 }
 
-// runGoroutine runs the given function as a background goroutine. If the
-// function returns before the server is shutdown, it is considered a fatal
-// error and the server is forcefully shutdown.
-func (s *Server) runGoroutine(f func()) {
-	s.wg.Add(1)
-	go func() {
-		defer s.wg.Done()
-
-		f()
-
-		// If the server hasn't been shutdown, we consider it a fatal error
-		// and trigger a shutdown.
-		if !s.shutdown.Load() {
-			s.fatalOnce.Do(func() {
-				close(s.fatalCh)
-			})
-		}
-	}()
+func (s *Server) listen(addr string) (net.Listener, error) {
+	if s.network != nil {
+		return s.network.Listen("tcp", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func (s *Server) listenPacket(addr string) (net.PacketConn, error) {
+	if s.network != nil {
+		return s.network.ListenPacket("udp", addr)
+	}
+	return net.ListenPacket("udp", addr)
 }
 
 func advertiseAddrFromListenAddr(bindAddr string) (string, error) {
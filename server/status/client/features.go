@@ -0,0 +1,32 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/andydunstall/piko/server/features"
+)
+
+type Features struct {
+	client *Client
+}
+
+func NewFeatures(client *Client) *Features {
+	return &Features{
+		client: client,
+	}
+}
+
+func (c *Features) Report() (*features.Report, error) {
+	r, err := c.client.Request("/status/features")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var report features.Report
+	if err := json.NewDecoder(r).Decode(&report); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return &report, nil
+}
@@ -0,0 +1,69 @@
+package upstream
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// sourceAllowList rejects upstream connections from source addresses
+// outside the permitted networks.
+//
+// This checks the address of the TCP connection rather than
+// 'X-Forwarded-For', since the header is set by the client so can't be
+// trusted.
+type sourceAllowList struct {
+	prefixes []netip.Prefix
+
+	logger log.Logger
+}
+
+func newSourceAllowList(prefixes []netip.Prefix, logger log.Logger) *sourceAllowList {
+	return &sourceAllowList{
+		prefixes: prefixes,
+		logger:   logger,
+	}
+}
+
+func (l *sourceAllowList) Handler(c *gin.Context) {
+	addr, ok := remoteAddr(c.Request)
+	if !ok || !l.permitted(addr) {
+		l.logger.Warn(
+			"source address not permitted",
+			zap.String("remote-addr", c.Request.RemoteAddr),
+		)
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{"error": "source address not permitted"},
+		)
+		return
+	}
+	c.Next()
+}
+
+func (l *sourceAllowList) permitted(addr netip.Addr) bool {
+	for _, prefix := range l.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	// Unmap IPv4-mapped IPv6 addresses so they match IPv4 prefixes.
+	return addr.Unmap(), true
+}
@@ -0,0 +1,148 @@
+package upstream
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/andydunstall/yamux"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	pikowebsocket "github.com/andydunstall/piko/pkg/websocket"
+)
+
+const (
+	// drainNotifyTimeout is the maximum duration to wait to send the drain
+	// notification to an upstream.
+	drainNotifyTimeout = time.Second
+
+	// drainPollInterval is the interval to check whether draining upstream
+	// connections have finished their in-flight streams.
+	drainPollInterval = time.Millisecond * 100
+
+	// closeFrameTimeout is the maximum duration to wait to send the close
+	// frame to an upstream.
+	closeFrameTimeout = time.Second
+)
+
+// activeConn is a connected upstream connection.
+type activeConn struct {
+	conn *pikowebsocket.Conn
+	sess *yamux.Session
+
+	// upstreams contains the upstream registered for each endpoint of the
+	// connection.
+	upstreams []*ConnUpstream
+
+	// closeCode is the close code of a connection the server decided to
+	// close before its session closed, such as when draining, or zero.
+	closeCode atomic.Int32
+
+	disconnectOnce sync.Once
+}
+
+// close sends the close frame with the given code to the upstream then
+// closes the session.
+func (c *activeConn) close(code pikowebsocket.CloseCode) error {
+	_ = c.conn.WriteClose(code, time.Now().Add(closeFrameTimeout))
+	return c.sess.Close()
+}
+
+func (s *Server) addConn(c *activeConn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	s.conns[c] = struct{}{}
+}
+
+func (s *Server) removeConn(c *activeConn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	delete(s.conns, c)
+}
+
+func (s *Server) activeConns() []*activeConn {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	conns := make([]*activeConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// evict closes the connection with the given session, since a new
+// connection has resumed the session.
+func (s *Server) evict(sess *yamux.Session) {
+	for _, c := range s.activeConns() {
+		if c.sess == sess {
+			c.closeCode.Store(int32(pikowebsocket.CloseEvicted))
+			_ = c.close(pikowebsocket.CloseEvicted)
+			return
+		}
+	}
+	sess.Close()
+}
+
+// disconnect removes the upstreams of the connection. The upstreams are only
+// removed once, either when the connection is drained or closed.
+func (s *Server) disconnect(c *activeConn, shutdown bool) {
+	c.disconnectOnce.Do(func() {
+		for _, upstream := range c.upstreams {
+			s.sessions.Disconnect(upstream, c.sess, shutdown)
+		}
+	})
+}
+
+// drain notifies connected upstreams that the server is shutting down, then
+// waits for their in-flight streams to complete, or the context to be
+// cancelled.
+//
+// Draining upstreams are removed so they aren't sent new requests, and the
+// notification lets the upstream reconnect before the connection is closed.
+func (s *Server) drain(ctx context.Context) {
+	conns := s.activeConns()
+	if len(conns) == 0 {
+		return
+	}
+
+	s.logger.Info("draining upstream connections", zap.Int("conns", len(conns)))
+
+	deadline := time.Now().Add(drainNotifyTimeout)
+	for _, c := range conns {
+		s.disconnect(c, true)
+		c.closeCode.Store(int32(pikowebsocket.CloseDrained))
+		if err := c.conn.Drain(deadline); err != nil {
+			s.logger.Debug("failed to notify upstream drain", zap.Error(err))
+		}
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		streams := 0
+		for _, c := range conns {
+			if !c.sess.IsClosed() {
+				streams += c.sess.NumStreams()
+			}
+		}
+		if streams == 0 {
+			s.logger.Info("drained upstream connections")
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.logger.Warn(
+				"upstream drain timed out",
+				zap.Int("streams", streams),
+			)
+			return
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package upstream
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/andydunstall/piko/pkg/protocol"
+)
+
+// ErrStreamLimit is returned when dialing an upstream connection that has
+// reached its stream limit.
+var ErrStreamLimit = errors.New("upstream stream limit reached")
+
+// streamLimiter limits the number of concurrent streams on an upstream
+// connection.
+//
+// If the connection is at its limit, opening a stream waits up to the queue
+// timeout for another stream to close, or fails with [ErrStreamLimit] if the
+// queue timeout is zero.
+type streamLimiter struct {
+	streams      chan struct{}
+	queueTimeout time.Duration
+
+	// metrics is nil if metrics are disabled.
+	metrics *MuxMetrics
+}
+
+func newStreamLimiter(
+	maxStreams int, queueTimeout time.Duration, metrics *MuxMetrics,
+) *streamLimiter {
+	return &streamLimiter{
+		streams:      make(chan struct{}, maxStreams),
+		queueTimeout: queueTimeout,
+		metrics:      metrics,
+	}
+}
+
+// Acquire reserves a stream, waiting up to the queue timeout if the
+// connection is at its limit.
+func (l *streamLimiter) Acquire() error {
+	if l.metrics != nil {
+		l.metrics.StreamUtilization.Observe(
+			float64(len(l.streams)) / float64(cap(l.streams)),
+		)
+	}
+
+	select {
+	case l.streams <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if l.queueTimeout == 0 {
+		l.observeLimited("rejected")
+		return ErrStreamLimit
+	}
+	l.observeLimited("queued")
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.streams <- struct{}{}:
+		return nil
+	case <-timer.C:
+		l.observeLimited("rejected")
+		return ErrStreamLimit
+	}
+}
+
+// Release releases a stream reserved with Acquire.
+func (l *streamLimiter) Release() {
+	<-l.streams
+}
+
+// Saturated returns whether the connection is at its limit.
+func (l *streamLimiter) Saturated() bool {
+	return len(l.streams) == cap(l.streams)
+}
+
+func (l *streamLimiter) observeLimited(outcome string) {
+	if l.metrics != nil {
+		l.metrics.StreamLimitedTotal.WithLabelValues(outcome).Inc()
+	}
+}
+
+// ConnLimiter limits the number of upstream connections to the node, in
+// total, for each endpoint and for each namespace.
+type ConnLimiter struct {
+	// maxConns, maxEndpointConns and maxNamespaceConns are zero if
+	// unlimited.
+	maxConns          int
+	maxEndpointConns  int
+	maxNamespaceConns int
+
+	conns          int
+	endpointConns  map[string]int
+	namespaceConns map[string]int
+
+	// mu protects the above fields.
+	mu sync.Mutex
+
+	metrics *ConnLimitMetrics
+}
+
+func NewConnLimiter(
+	maxConns int, maxEndpointConns int, maxNamespaceConns int,
+) *ConnLimiter {
+	return &ConnLimiter{
+		maxConns:          maxConns,
+		maxEndpointConns:  maxEndpointConns,
+		maxNamespaceConns: maxNamespaceConns,
+		endpointConns:     make(map[string]int),
+		namespaceConns:    make(map[string]int),
+		metrics:           NewConnLimitMetrics(),
+	}
+}
+
+// Acquire reserves a connection for the given endpoints. A multiplexed
+// connection reserves a single connection of the node limit, but a
+// connection for each of its endpoints and their namespaces. If any limit
+// is reached, returns false with the protocol error code of the limit.
+//
+// Endpoints without a namespace aren't subject to the namespace limit.
+func (l *ConnLimiter) Acquire(endpointIDs []string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxConns != 0 && l.conns >= l.maxConns {
+		l.metrics.RejectedTotal.WithLabelValues("node").Inc()
+		return protocol.ErrorCodeConnLimit, false
+	}
+	// Endpoints of a multiplexed connection are unique, though may share a
+	// namespace.
+	namespaces := make(map[string]int)
+	for _, endpointID := range endpointIDs {
+		if l.maxEndpointConns != 0 && l.endpointConns[endpointID] >= l.maxEndpointConns {
+			l.metrics.RejectedTotal.WithLabelValues("endpoint").Inc()
+			return protocol.ErrorCodeEndpointConnLimit, false
+		}
+		if namespace := protocol.Namespace(endpointID); namespace != "" {
+			namespaces[namespace]++
+		}
+	}
+	for namespace, n := range namespaces {
+		if l.maxNamespaceConns != 0 &&
+			l.namespaceConns[namespace]+n > l.maxNamespaceConns {
+			l.metrics.RejectedTotal.WithLabelValues("namespace").Inc()
+			return protocol.ErrorCodeNamespaceConnLimit, false
+		}
+	}
+
+	l.conns++
+	for _, endpointID := range endpointIDs {
+		l.endpointConns[endpointID]++
+	}
+	for namespace, n := range namespaces {
+		l.namespaceConns[namespace] += n
+	}
+	return "", true
+}
+
+// Release releases a connection reserved with Acquire.
+func (l *ConnLimiter) Release(endpointIDs []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.conns--
+	for _, endpointID := range endpointIDs {
+		l.endpointConns[endpointID]--
+		if l.endpointConns[endpointID] == 0 {
+			delete(l.endpointConns, endpointID)
+		}
+		if namespace := protocol.Namespace(endpointID); namespace != "" {
+			l.namespaceConns[namespace]--
+			if l.namespaceConns[namespace] == 0 {
+				delete(l.namespaceConns, namespace)
+			}
+		}
+	}
+}
+
+func (l *ConnLimiter) Metrics() *ConnLimitMetrics {
+	return l.metrics
+}
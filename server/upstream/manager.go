@@ -1,14 +1,23 @@
 package upstream
 
 import (
+	"hash/fnv"
+	"math/rand"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/atomic"
 
+	"github.com/andydunstall/piko/pkg/protocol"
 	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
 )
 
+// maxForwardAttempts is the maximum number of nodes to try when forwarding
+// a request to another node.
+const maxForwardAttempts = 3
+
 // Manager manages the upstream routes for each endpoint.
 //
 // This includes upstreams connected to the local node, or other server nodes
@@ -22,6 +31,12 @@ type Manager interface {
 	// If there are no upstreams connected for the endpoint, and 'allowForward'
 	// is true, it will look for another node in the cluster that has an
 	// upstream connection for the endpoint and use that node as the upstream.
+	// If the node can't be reached, the upstream fails over to another node
+	// with an upstream connection for the endpoint.
+	//
+	// If no upstream is connected for the endpoint on any node, it falls
+	// back to wildcard upstreams for the endpoint's namespaces, such as an
+	// upstream listening on 'team-a/*' for endpoint 'team-a/service-b'.
 	Select(endpointID string, allowForward bool) (Upstream, bool)
 
 	// AddConn adds a local upstream connection.
@@ -31,11 +46,36 @@ type Manager interface {
 	RemoveConn(u Upstream)
 }
 
-// loadBalancer load balances requests among upstreams in a round-robin
-// fashion.
+// saturatedUpstream is an upstream that may reach its stream limit.
+type saturatedUpstream interface {
+	Saturated() bool
+}
+
+// loadedUpstream is an upstream that reports its open streams.
+type loadedUpstream interface {
+	OpenStreams() int
+}
+
+// loadBalancer load balances requests among upstreams using the configured
+// strategy, defaulting to round-robin.
+//
+// Upstreams that have reached their stream limit are skipped, unless all
+// upstreams have reached their limit.
 type loadBalancer struct {
+	strategy config.LoadBalancingStrategy
+
 	upstreams []Upstream
 	nextIndex int
+
+	// random returns a random index in [0, n), overridden in tests.
+	random func(n int) int
+}
+
+func newLoadBalancer(strategy config.LoadBalancingStrategy) *loadBalancer {
+	return &loadBalancer{
+		strategy: strategy,
+		random:   rand.Intn,
+	}
 }
 
 func (lb *loadBalancer) Add(u Upstream) {
@@ -62,10 +102,84 @@ func (lb *loadBalancer) Next() Upstream {
 		return nil
 	}
 
-	u := lb.upstreams[lb.nextIndex]
-	lb.nextIndex++
-	lb.nextIndex %= len(lb.upstreams)
-	return u
+	switch lb.strategy {
+	case config.LoadBalancingLeastConnections:
+		return lb.nextLeastConnections()
+	case config.LoadBalancingRandom:
+		return lb.nextRandom()
+	default:
+		return lb.nextRoundRobin()
+	}
+}
+
+func (lb *loadBalancer) nextRoundRobin() Upstream {
+	start := lb.nextIndex
+	for i := 0; i != len(lb.upstreams); i++ {
+		u := lb.upstreams[(start+i)%len(lb.upstreams)]
+		if saturated(u) {
+			continue
+		}
+		lb.nextIndex = (start + i + 1) % len(lb.upstreams)
+		return u
+	}
+
+	// All upstreams are saturated, so fall back to round-robin.
+	lb.nextIndex = (start + 1) % len(lb.upstreams)
+	return lb.upstreams[start]
+}
+
+// nextLeastConnections selects the upstream with the fewest open streams.
+// Ties are broken in round-robin order, so idle upstreams share requests.
+func (lb *loadBalancer) nextLeastConnections() Upstream {
+	start := lb.nextIndex
+	best := -1
+	bestStreams := 0
+	bestSaturated := true
+	for i := 0; i != len(lb.upstreams); i++ {
+		index := (start + i) % len(lb.upstreams)
+		u := lb.upstreams[index]
+		isSaturated := saturated(u)
+		// Prefer unsaturated upstreams, unless all are saturated.
+		if isSaturated && !bestSaturated {
+			continue
+		}
+		streams := openStreams(u)
+		if best == -1 || (bestSaturated && !isSaturated) || streams < bestStreams {
+			best = index
+			bestStreams = streams
+			bestSaturated = isSaturated
+		}
+	}
+	lb.nextIndex = (best + 1) % len(lb.upstreams)
+	return lb.upstreams[best]
+}
+
+func (lb *loadBalancer) nextRandom() Upstream {
+	var unsaturated []Upstream
+	for _, u := range lb.upstreams {
+		if !saturated(u) {
+			unsaturated = append(unsaturated, u)
+		}
+	}
+	if len(unsaturated) == 0 {
+		// All upstreams are saturated, so select among all upstreams.
+		return lb.upstreams[lb.random(len(lb.upstreams))]
+	}
+	return unsaturated[lb.random(len(unsaturated))]
+}
+
+func saturated(u Upstream) bool {
+	s, ok := u.(saturatedUpstream)
+	return ok && s.Saturated()
+}
+
+// openStreams returns the open streams of the upstream, or zero if the
+// upstream doesn't report its streams.
+func openStreams(u Upstream) int {
+	if l, ok := u.(loadedUpstream); ok {
+		return l.OpenStreams()
+	}
+	return 0
 }
 
 type Usage struct {
@@ -76,32 +190,102 @@ type Usage struct {
 type LoadBalancedManager struct {
 	localUpstreams map[string]*loadBalancer
 
+	strategy config.LoadBalancingStrategy
+
+	// tombstones contains endpoints whose last local upstream recently
+	// disconnected.
+	tombstones *tombstones
+
+	connSubscribers []func(u Upstream, connected bool)
+
+	// mu protects the above fields.
 	mu sync.Mutex
 
 	usage *Usage
 
 	cluster *cluster.State
 
+	// dialer is nil if remote nodes are dialled with the host network.
+	dialer Dialer
+
 	metrics *Metrics
 }
 
-func NewLoadBalancedManager(cluster *cluster.State) *LoadBalancedManager {
-	return &LoadBalancedManager{
+type managerOptions struct {
+	strategy config.LoadBalancingStrategy
+}
+
+type ManagerOption interface {
+	apply(*managerOptions)
+}
+
+type loadBalancingOption config.LoadBalancingStrategy
+
+func (o loadBalancingOption) apply(opts *managerOptions) {
+	opts.strategy = config.LoadBalancingStrategy(o)
+}
+
+// WithLoadBalancing configures the strategy to load balance requests among
+// the local upstreams for an endpoint. Defaults to round-robin.
+func WithLoadBalancing(strategy config.LoadBalancingStrategy) ManagerOption {
+	return loadBalancingOption(strategy)
+}
+
+// NewLoadBalancedManager creates a manager that forwards requests for
+// endpoints without a local upstream to other nodes, dialled with dialer. If
+// dialer is nil, nodes are dialled with the host network.
+func NewLoadBalancedManager(
+	cluster *cluster.State,
+	dialer Dialer,
+	opts ...ManagerOption,
+) *LoadBalancedManager {
+	options := managerOptions{
+		strategy: config.LoadBalancingRoundRobin,
+	}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
+	m := &LoadBalancedManager{
 		localUpstreams: make(map[string]*loadBalancer),
+		strategy:       options.strategy,
+		tombstones:     newTombstones(tombstoneTTL, maxTombstones),
 		cluster:        cluster,
+		dialer:         dialer,
 		usage: &Usage{
 			Requests:  atomic.NewUint64(0),
 			Upstreams: atomic.NewUint64(0),
 		},
 		metrics: NewMetrics(),
 	}
+	m.metrics.links = m.worstLinks
+	return m
 }
 
 func (m *LoadBalancedManager) Select(endpointID string, allowRemote bool) (Upstream, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	lb, ok := m.localUpstreams[endpointID]
+	// Prefer an upstream registered for the endpoint itself, then fall back
+	// to wildcard upstreams for the endpoint's namespaces, such as
+	// 'team-a/*' for 'team-a/service-b', most specific first.
+	if u, ok := m.selectLocked(endpointID, endpointID, allowRemote); ok {
+		return u, true
+	}
+	for _, wildcard := range protocol.Wildcards(endpointID) {
+		if u, ok := m.selectLocked(endpointID, wildcard, allowRemote); ok {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+// selectLocked selects an upstream registered with the given ID, either the
+// endpoint ID or a wildcard matching the endpoint.
+func (m *LoadBalancedManager) selectLocked(
+	endpointID string, registeredID string, allowRemote bool,
+) (Upstream, bool) {
+	lb, ok := m.localUpstreams[registeredID]
 	if ok {
 		m.metrics.UpstreamRequestsTotal.Inc()
 		return lb.Next(), true
@@ -110,47 +294,132 @@ func (m *LoadBalancedManager) Select(endpointID string, allowRemote bool) (Upstr
 		return nil, false
 	}
 
-	node, ok := m.cluster.LookupEndpoint(endpointID)
-	if !ok {
+	nodes := m.cluster.LookupEndpointNodes(registeredID)
+	if len(nodes) == 0 {
 		return nil, false
 	}
+	if len(nodes) > maxForwardAttempts {
+		nodes = nodes[:maxForwardAttempts]
+	}
 	m.metrics.RemoteRequestsTotal.With(prometheus.Labels{
-		"node_id": node.ID,
+		"node_id": nodes[0].ID,
 	}).Inc()
 	m.usage.Requests.Inc()
-	return NewNodeUpstream(endpointID, node), true
+	// Forward the endpoint ID rather than the wildcard, so the remote node
+	// selects its wildcard upstream the same way.
+	u := NewNodeUpstream(endpointID, nodes[0], m.dialer)
+	u.fallbacks = nodes[1:]
+	u.metrics = m.metrics
+	return u, true
 }
 
-func (m *LoadBalancedManager) AddConn(u Upstream) {
+// SelectByID returns the upstream with the given ID if it's connected to the
+// local node for the endpoint, so a client with affinity to the upstream is
+// routed to the same upstream.
+func (m *LoadBalancedManager) SelectByID(endpointID string, upstreamID string) (Upstream, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	lb, ok := m.localLoadBalancerLocked(endpointID)
+	if !ok {
+		return nil, false
+	}
+	for _, u := range lb.upstreams {
+		if u.ID() == upstreamID {
+			m.metrics.UpstreamRequestsTotal.Inc()
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+// SelectByKey selects an upstream connected to the local node for the
+// endpoint by hashing the key, so requests with the same key are routed to
+// the same upstream.
+//
+// This uses rendezvous hashing, so when an upstream disconnects, only the
+// keys mapped to that upstream move to another upstream.
+func (m *LoadBalancedManager) SelectByKey(endpointID string, key string) (Upstream, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lb, ok := m.localLoadBalancerLocked(endpointID)
+	if !ok {
+		return nil, false
+	}
+	var selected Upstream
+	var selectedHash uint64
+	for _, u := range lb.upstreams {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(u.ID()))
+		if sum := h.Sum64(); selected == nil || sum > selectedHash {
+			selected = u
+			selectedHash = sum
+		}
+	}
+	if selected == nil {
+		return nil, false
+	}
+	m.metrics.UpstreamRequestsTotal.Inc()
+	return selected, true
+}
+
+// localLoadBalancerLocked returns the load balancer for the local upstreams
+// the endpoint is routed to, in the same order as Select. Returns false if
+// Select would route the endpoint to another node.
+func (m *LoadBalancedManager) localLoadBalancerLocked(endpointID string) (*loadBalancer, bool) {
+	registeredIDs := append([]string{endpointID}, protocol.Wildcards(endpointID)...)
+	for _, registeredID := range registeredIDs {
+		if lb, ok := m.localUpstreams[registeredID]; ok {
+			return lb, true
+		}
+		if _, ok := m.cluster.LookupEndpoint(registeredID); ok {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+func (m *LoadBalancedManager) AddConn(u Upstream) {
+	m.mu.Lock()
+
 	lb, ok := m.localUpstreams[u.EndpointID()]
 	if !ok {
-		lb = &loadBalancer{}
+		lb = newLoadBalancer(m.strategy)
 
 		m.metrics.RegisteredEndpoints.Inc()
 	}
 
 	lb.Add(u)
 	m.localUpstreams[u.EndpointID()] = lb
+	m.tombstones.Remove(u.EndpointID())
 
 	m.cluster.AddLocalEndpoint(u.EndpointID())
 
 	m.metrics.ConnectedUpstreams.Inc()
 	m.usage.Upstreams.Inc()
+
+	subscribers := m.subscribers()
+	m.mu.Unlock()
+
+	for _, f := range subscribers {
+		f(u, true)
+	}
 }
 
 func (m *LoadBalancedManager) RemoveConn(u Upstream) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
 
 	lb, ok := m.localUpstreams[u.EndpointID()]
 	if !ok {
+		m.mu.Unlock()
 		return
 	}
 	if lb.Remove(u) {
 		delete(m.localUpstreams, u.EndpointID())
+		m.tombstones.Add(u.EndpointID(), time.Now())
 
 		m.metrics.RegisteredEndpoints.Dec()
 	}
@@ -158,6 +427,40 @@ func (m *LoadBalancedManager) RemoveConn(u Upstream) {
 	m.cluster.RemoveLocalEndpoint(u.EndpointID())
 
 	m.metrics.ConnectedUpstreams.Dec()
+
+	subscribers := m.subscribers()
+	m.mu.Unlock()
+
+	for _, f := range subscribers {
+		f(u, false)
+	}
+}
+
+// LastSeen returns when the last upstream connected to the local node for the
+// endpoint disconnected, or false if the endpoint has an upstream connected
+// or hasn't been seen recently.
+func (m *LoadBalancedManager) LastSeen(endpointID string) (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.tombstones.LastSeen(endpointID, time.Now())
+}
+
+// OnConnUpdate subscribes to local upstream connections being added
+// (connected is true) or removed (connected is false).
+//
+// The callback is called without the manager mutex locked, so may call back
+// to the manager, such as to select an upstream for the endpoint.
+func (m *LoadBalancedManager) OnConnUpdate(f func(u Upstream, connected bool)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.connSubscribers = append(m.connSubscribers, f)
+}
+
+func (m *LoadBalancedManager) subscribers() []func(u Upstream, connected bool) {
+	subscribers := make([]func(u Upstream, connected bool), 0, len(m.connSubscribers))
+	return append(subscribers, m.connSubscribers...)
 }
 
 func (m *LoadBalancedManager) Endpoints() map[string]int {
@@ -171,6 +474,56 @@ func (m *LoadBalancedManager) Endpoints() map[string]int {
 	return endpoints
 }
 
+// Sessions returns the multiplexer statistics of the upstreams connected to
+// the local node. If endpointID is not empty, only returns upstreams for
+// the given endpoint.
+func (m *LoadBalancedManager) Sessions(endpointID string) []*SessionStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sessions := []*SessionStats{}
+	for id, lb := range m.localUpstreams {
+		if endpointID != "" && id != endpointID {
+			continue
+		}
+		for _, u := range lb.upstreams {
+			if conn, ok := u.(*ConnUpstream); ok {
+				sessions = append(sessions, conn.Stats())
+			}
+		}
+	}
+	return sessions
+}
+
+// worstLinks returns the link stats of the upstreams connected to the local
+// node for each endpoint, where each stat is the worst of the endpoint's
+// connections, so a single bad link stands out.
+func (m *LoadBalancedManager) worstLinks() map[string]LinkStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	links := make(map[string]LinkStats)
+	for endpointID, lb := range m.localUpstreams {
+		var worst LinkStats
+		var found bool
+		for _, u := range lb.upstreams {
+			conn, ok := u.(*ConnUpstream)
+			if !ok {
+				continue
+			}
+			link := conn.LinkStats()
+			worst.Latency = max(worst.Latency, link.Latency)
+			worst.Jitter = max(worst.Jitter, link.Jitter)
+			worst.Loss = max(worst.Loss, link.Loss)
+			found = true
+		}
+		if found {
+			links[endpointID] = worst
+		}
+	}
+	return links
+}
+
 func (m *LoadBalancedManager) Usage() *Usage {
 	return m.usage
 }
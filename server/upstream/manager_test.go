@@ -1,14 +1,34 @@
 package upstream
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"strconv"
 	"testing"
+	"time"
 
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
 )
 
 type fakeUpstream struct {
+	id         string
 	endpointID string
+	saturated  bool
+	streams    int
+}
+
+func (u *fakeUpstream) ID() string {
+	if u.id != "" {
+		return u.id
+	}
+	return "my-upstream"
 }
 
 func (u *fakeUpstream) EndpointID() string {
@@ -23,6 +43,14 @@ func (u *fakeUpstream) Forward() bool {
 	return false
 }
 
+func (u *fakeUpstream) Saturated() bool {
+	return u.saturated
+}
+
+func (u *fakeUpstream) OpenStreams() int {
+	return u.streams
+}
+
 func TestLocalLoadBalancer(t *testing.T) {
 	lb := &loadBalancer{}
 
@@ -58,3 +86,402 @@ func TestLocalLoadBalancer(t *testing.T) {
 
 	assert.Nil(t, lb.Next())
 }
+
+func TestLocalLoadBalancer_Saturated(t *testing.T) {
+	lb := &loadBalancer{}
+
+	u1 := &fakeUpstream{endpointID: "1"}
+	u2 := &fakeUpstream{endpointID: "2", saturated: true}
+	u3 := &fakeUpstream{endpointID: "3"}
+	lb.Add(u1)
+	lb.Add(u2)
+	lb.Add(u3)
+
+	// Saturated upstreams are skipped.
+	assert.Equal(t, "1", lb.Next().EndpointID())
+	assert.Equal(t, "3", lb.Next().EndpointID())
+	assert.Equal(t, "1", lb.Next().EndpointID())
+	assert.Equal(t, "3", lb.Next().EndpointID())
+
+	// If all upstreams are saturated, falls back to round-robin.
+	u1.saturated = true
+	u3.saturated = true
+	assert.Equal(t, "1", lb.Next().EndpointID())
+	assert.Equal(t, "2", lb.Next().EndpointID())
+	assert.Equal(t, "3", lb.Next().EndpointID())
+}
+
+func TestLocalLoadBalancer_LeastConnections(t *testing.T) {
+	lb := newLoadBalancer(config.LoadBalancingLeastConnections)
+
+	u1 := &fakeUpstream{endpointID: "1", streams: 3}
+	u2 := &fakeUpstream{endpointID: "2", streams: 1}
+	u3 := &fakeUpstream{endpointID: "3", streams: 2}
+	lb.Add(u1)
+	lb.Add(u2)
+	lb.Add(u3)
+
+	assert.Equal(t, "2", lb.Next().EndpointID())
+	u2.streams = 4
+	assert.Equal(t, "3", lb.Next().EndpointID())
+
+	// Ties are broken in round-robin order.
+	u1.streams = 0
+	u2.streams = 0
+	u3.streams = 0
+	assert.Equal(t, "1", lb.Next().EndpointID())
+	assert.Equal(t, "2", lb.Next().EndpointID())
+	assert.Equal(t, "3", lb.Next().EndpointID())
+
+	// Saturated upstreams are skipped.
+	u1.saturated = true
+	u2.streams = 5
+	assert.Equal(t, "3", lb.Next().EndpointID())
+
+	// If all upstreams are saturated, selects the least loaded.
+	u2.saturated = true
+	u3.saturated = true
+	u3.streams = 6
+	assert.Equal(t, "1", lb.Next().EndpointID())
+}
+
+func TestLocalLoadBalancer_Random(t *testing.T) {
+	lb := newLoadBalancer(config.LoadBalancingRandom)
+
+	var n int
+	lb.random = func(max int) int {
+		n = max
+		return max - 1
+	}
+
+	u1 := &fakeUpstream{endpointID: "1"}
+	u2 := &fakeUpstream{endpointID: "2"}
+	u3 := &fakeUpstream{endpointID: "3", saturated: true}
+	lb.Add(u1)
+	lb.Add(u2)
+	lb.Add(u3)
+
+	// Saturated upstreams are skipped.
+	assert.Equal(t, "2", lb.Next().EndpointID())
+	assert.Equal(t, 2, n)
+
+	// If all upstreams are saturated, selects among all upstreams.
+	u1.saturated = true
+	u2.saturated = true
+	assert.Equal(t, "3", lb.Next().EndpointID())
+	assert.Equal(t, 3, n)
+}
+
+func TestLoadBalancedManager_OnConnUpdate(t *testing.T) {
+	state := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	m := NewLoadBalancedManager(state, nil)
+
+	type update struct {
+		endpointID string
+		connected  bool
+	}
+	var updates []update
+	m.OnConnUpdate(func(u Upstream, connected bool) {
+		// Calling back to the manager must not deadlock.
+		_, ok := m.Select(u.EndpointID(), false)
+		assert.Equal(t, connected, ok)
+
+		updates = append(updates, update{u.EndpointID(), connected})
+	})
+
+	u := &fakeUpstream{endpointID: "my-endpoint"}
+	m.AddConn(u)
+	m.RemoveConn(u)
+	// Removing an unknown upstream isn't notified.
+	m.RemoveConn(u)
+
+	assert.Equal(t, []update{
+		{"my-endpoint", true},
+		{"my-endpoint", false},
+	}, updates)
+}
+
+func TestLoadBalancedManager_LastSeen(t *testing.T) {
+	state := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	m := NewLoadBalancedManager(state, nil)
+
+	u1 := &fakeUpstream{endpointID: "my-endpoint"}
+	u2 := &fakeUpstream{endpointID: "my-endpoint"}
+	m.AddConn(u1)
+	m.AddConn(u2)
+
+	_, ok := m.LastSeen("my-endpoint")
+	assert.False(t, ok)
+
+	// The endpoint is only offline once its last upstream disconnects.
+	m.RemoveConn(u1)
+	_, ok = m.LastSeen("my-endpoint")
+	assert.False(t, ok)
+
+	m.RemoveConn(u2)
+	lastSeen, ok := m.LastSeen("my-endpoint")
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now(), lastSeen, time.Minute)
+
+	// Reconnecting removes the tombstone.
+	m.AddConn(u1)
+	_, ok = m.LastSeen("my-endpoint")
+	assert.False(t, ok)
+}
+
+func TestLoadBalancedManager_Wildcard(t *testing.T) {
+	state := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	m := NewLoadBalancedManager(state, nil)
+
+	wildcard := &fakeUpstream{endpointID: "org/*"}
+	m.AddConn(wildcard)
+
+	// Endpoints in the namespace are routed to the wildcard upstream.
+	u, ok := m.Select("org/team-a/service-b", false)
+	assert.True(t, ok)
+	assert.Equal(t, wildcard, u)
+	_, ok = m.Select("other/service-b", false)
+	assert.False(t, ok)
+
+	// More specific wildcards are preferred.
+	nested := &fakeUpstream{endpointID: "org/team-a/*"}
+	m.AddConn(nested)
+	u, ok = m.Select("org/team-a/service-b", false)
+	assert.True(t, ok)
+	assert.Equal(t, nested, u)
+
+	// Upstreams for the endpoint itself are preferred to wildcards.
+	exact := &fakeUpstream{endpointID: "org/team-a/service-b"}
+	m.AddConn(exact)
+	u, ok = m.Select("org/team-a/service-b", false)
+	assert.True(t, ok)
+	assert.Equal(t, exact, u)
+}
+
+// fakeDialer fails to dial the addresses in unreachable.
+type fakeDialer struct {
+	unreachable map[string]bool
+	dialled     []string
+}
+
+func (d *fakeDialer) Dial(_, address string) (net.Conn, error) {
+	d.dialled = append(d.dialled, address)
+	if d.unreachable[address] {
+		return nil, fmt.Errorf("connection refused")
+	}
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+// fakeContextDialer blocks until the dial context is cancelled.
+type fakeContextDialer struct {
+	dials int
+}
+
+func (d *fakeContextDialer) Dial(_, _ string) (net.Conn, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (d *fakeContextDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	d.dials++
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestLoadBalancedManager_Forward(t *testing.T) {
+	newState := func() *cluster.State {
+		state := cluster.NewState(&cluster.Node{
+			ID:     "local",
+			Status: cluster.NodeStatusActive,
+		}, log.NewNopLogger())
+		for _, id := range []string{"remote-1", "remote-2"} {
+			state.AddNode(&cluster.Node{
+				ID:        id,
+				Status:    cluster.NodeStatusActive,
+				ProxyAddr: id + ":8000",
+			})
+			state.UpdateRemoteEndpoint(id, "my-endpoint", 1)
+		}
+		return state
+	}
+
+	t.Run("failover", func(t *testing.T) {
+		dialer := &fakeDialer{unreachable: map[string]bool{}}
+		m := NewLoadBalancedManager(newState(), dialer)
+
+		u, ok := m.Select("my-endpoint", true)
+		require.True(t, ok)
+		assert.True(t, u.Forward())
+
+		// Fail the node selected first so the upstream fails over to the
+		// other node.
+		first := u.ID()
+		dialer.unreachable[first+":8000"] = true
+
+		conn, err := u.Dial()
+		require.NoError(t, err)
+		conn.Close()
+
+		assert.NotEqual(t, first, u.ID())
+		assert.Equal(t, []string{first + ":8000", u.ID() + ":8000"}, dialer.dialled)
+		assert.Equal(t, 1.0, promtestutil.ToFloat64(
+			m.Metrics().ForwardFailuresTotal.WithLabelValues(first),
+		))
+		assert.Equal(t, 1.0, promtestutil.ToFloat64(
+			m.Metrics().RemoteRequestsTotal.WithLabelValues(u.ID()),
+		))
+	})
+
+	t.Run("all unreachable", func(t *testing.T) {
+		dialer := &fakeDialer{unreachable: map[string]bool{
+			"remote-1:8000": true,
+			"remote-2:8000": true,
+		}}
+		m := NewLoadBalancedManager(newState(), dialer)
+
+		u, ok := m.Select("my-endpoint", true)
+		require.True(t, ok)
+
+		_, err := u.Dial()
+		assert.Error(t, err)
+		assert.Len(t, dialer.dialled, 2)
+		assert.Equal(t, 1.0, promtestutil.ToFloat64(
+			m.Metrics().ForwardFailuresTotal.WithLabelValues("remote-1"),
+		))
+		assert.Equal(t, 1.0, promtestutil.ToFloat64(
+			m.Metrics().ForwardFailuresTotal.WithLabelValues("remote-2"),
+		))
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		dialer := &fakeContextDialer{}
+		m := NewLoadBalancedManager(newState(), dialer)
+
+		u, ok := m.Select("my-endpoint", true)
+		require.True(t, ok)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := u.(*NodeUpstream).DialContext(ctx)
+		assert.ErrorIs(t, err, context.Canceled)
+		// Cancelled requests don't fail over to another node.
+		assert.Equal(t, 1, dialer.dials)
+	})
+
+	t.Run("forward disabled", func(t *testing.T) {
+		m := NewLoadBalancedManager(newState(), &fakeDialer{})
+
+		_, ok := m.Select("my-endpoint", false)
+		assert.False(t, ok)
+	})
+}
+
+func TestLoadBalancedManager_SelectByID(t *testing.T) {
+	state := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	m := NewLoadBalancedManager(state, nil)
+
+	u1 := &fakeUpstream{id: "1", endpointID: "my-endpoint"}
+	u2 := &fakeUpstream{id: "2", endpointID: "my-endpoint"}
+	m.AddConn(u1)
+	m.AddConn(u2)
+
+	for i := 0; i != 3; i++ {
+		u, ok := m.SelectByID("my-endpoint", "2")
+		assert.True(t, ok)
+		assert.Equal(t, u2, u)
+	}
+
+	// Upstreams that have disconnected aren't selected.
+	m.RemoveConn(u2)
+	_, ok := m.SelectByID("my-endpoint", "2")
+	assert.False(t, ok)
+
+	_, ok = m.SelectByID("unknown", "1")
+	assert.False(t, ok)
+}
+
+func TestLoadBalancedManager_SelectByKey(t *testing.T) {
+	state := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	m := NewLoadBalancedManager(state, nil)
+
+	upstreams := []*fakeUpstream{
+		{id: "1", endpointID: "my-endpoint"},
+		{id: "2", endpointID: "my-endpoint"},
+		{id: "3", endpointID: "my-endpoint"},
+	}
+	for _, u := range upstreams {
+		m.AddConn(u)
+	}
+
+	selected := make(map[string]string)
+	for i := 0; i != 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		u, ok := m.SelectByKey("my-endpoint", key)
+		assert.True(t, ok)
+		selected[key] = u.ID()
+
+		// The same key selects the same upstream.
+		u, ok = m.SelectByKey("my-endpoint", key)
+		assert.True(t, ok)
+		assert.Equal(t, selected[key], u.ID())
+	}
+
+	// Only keys mapped to the removed upstream move.
+	m.RemoveConn(upstreams[0])
+	for key, id := range selected {
+		u, ok := m.SelectByKey("my-endpoint", key)
+		assert.True(t, ok)
+		if id != "1" {
+			assert.Equal(t, id, u.ID())
+		} else {
+			assert.NotEqual(t, "1", u.ID())
+		}
+	}
+
+	_, ok := m.SelectByKey("unknown", "key")
+	assert.False(t, ok)
+}
+
+func TestTombstones(t *testing.T) {
+	t.Run("expired", func(t *testing.T) {
+		tombstones := newTombstones(time.Minute, 10)
+
+		now := time.Now()
+		tombstones.Add("my-endpoint", now)
+
+		lastSeen, ok := tombstones.LastSeen("my-endpoint", now.Add(time.Second))
+		assert.True(t, ok)
+		assert.Equal(t, now, lastSeen)
+
+		_, ok = tombstones.LastSeen("my-endpoint", now.Add(time.Minute+time.Second))
+		assert.False(t, ok)
+		assert.Empty(t, tombstones.entries)
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		tombstones := newTombstones(time.Minute, 10)
+
+		now := time.Now()
+		for i := 0; i != 15; i++ {
+			tombstones.Add(strconv.Itoa(i), now)
+		}
+		assert.Len(t, tombstones.entries, 10)
+
+		// The least recently disconnected endpoints are evicted.
+		_, ok := tombstones.LastSeen("4", now)
+		assert.False(t, ok)
+		_, ok = tombstones.LastSeen("5", now)
+		assert.True(t, ok)
+	})
+}
@@ -16,6 +16,19 @@ type Metrics struct {
 	// RemoteRequestsTotal is the number of requests sent to another node.
 	// Labelled by target node ID.
 	RemoteRequestsTotal *prometheus.CounterVec
+
+	// ForwardFailuresTotal is the number of requests that failed to be
+	// forwarded to another node, either failing over to another node or
+	// failing the request. Labelled by target node ID.
+	ForwardFailuresTotal *prometheus.CounterVec
+
+	// linkLatency, linkJitter and linkLoss are computed from the worst link
+	// stats of each endpoint's local upstreams when collected.
+	linkLatency *prometheus.Desc
+	linkJitter  *prometheus.Desc
+	linkLoss    *prometheus.Desc
+	// links is nil if link metrics are disabled.
+	links func() map[string]LinkStats
 }
 
 func NewMetrics() *Metrics {
@@ -53,6 +66,33 @@ func NewMetrics() *Metrics {
 			},
 			[]string{"node_id"},
 		),
+		ForwardFailuresTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "forward_failures_total",
+				Help:      "Number of requests that failed to be forwarded to a remote node",
+			},
+			[]string{"node_id"},
+		),
+		linkLatency: prometheus.NewDesc(
+			"piko_upstreams_link_latency_seconds",
+			"Highest smoothed ping RTT of the endpoint's upstream connections",
+			[]string{"endpoint"},
+			nil,
+		),
+		linkJitter: prometheus.NewDesc(
+			"piko_upstreams_link_jitter_seconds",
+			"Highest smoothed ping RTT variation of the endpoint's upstream connections",
+			[]string{"endpoint"},
+			nil,
+		),
+		linkLoss: prometheus.NewDesc(
+			"piko_upstreams_link_loss_ratio",
+			"Highest ratio of recent failed pings of the endpoint's upstream connections",
+			[]string{"endpoint"},
+			nil,
+		),
 	}
 }
 
@@ -62,5 +102,183 @@ func (m *Metrics) Register(registry *prometheus.Registry) {
 		m.RegisteredEndpoints,
 		m.UpstreamRequestsTotal,
 		m.RemoteRequestsTotal,
+		m.ForwardFailuresTotal,
+	)
+	if m.links != nil {
+		registry.MustRegister(&linkCollector{metrics: m})
+	}
+}
+
+// linkCollector collects the upstream link metrics.
+type linkCollector struct {
+	metrics *Metrics
+}
+
+func (c *linkCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.metrics.linkLatency
+	ch <- c.metrics.linkJitter
+	ch <- c.metrics.linkLoss
+}
+
+func (c *linkCollector) Collect(ch chan<- prometheus.Metric) {
+	for endpointID, link := range c.metrics.links() {
+		ch <- prometheus.MustNewConstMetric(
+			c.metrics.linkLatency,
+			prometheus.GaugeValue,
+			link.Latency.Seconds(),
+			endpointID,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.metrics.linkJitter,
+			prometheus.GaugeValue,
+			link.Jitter.Seconds(),
+			endpointID,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.metrics.linkLoss,
+			prometheus.GaugeValue,
+			link.Loss,
+			endpointID,
+		)
+	}
+}
+
+type MuxMetrics struct {
+	// ControlFrameLatency is the duration control frames (pings and window
+	// updates) are queued before being written to upstream connections.
+	ControlFrameLatency prometheus.Histogram
+
+	// StreamUtilization is the ratio of open streams to the stream limit
+	// when opening a stream to an upstream connection with a limit.
+	StreamUtilization prometheus.Histogram
+
+	// StreamLimitedTotal is the number of streams that reached an upstream
+	// connection stream limit. Labelled by the outcome ('queued' or
+	// 'rejected').
+	StreamLimitedTotal *prometheus.CounterVec
+}
+
+func NewMuxMetrics() *MuxMetrics {
+	return &MuxMetrics{
+		ControlFrameLatency: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "control_frame_latency_seconds",
+				Help:      "Duration control frames are queued before being written to upstream connections",
+				Buckets: []float64{
+					0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1,
+				},
+			},
+		),
+		StreamUtilization: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "stream_utilization",
+				Help:      "Ratio of open streams to the stream limit when opening a stream to an upstream connection",
+				Buckets: []float64{
+					0.1, 0.25, 0.5, 0.75, 0.9, 1,
+				},
+			},
+		),
+		StreamLimitedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "stream_limited_total",
+				Help:      "Number of streams that reached an upstream connection stream limit",
+			},
+			[]string{"outcome"},
+		),
+	}
+}
+
+func (m *MuxMetrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.ControlFrameLatency,
+		m.StreamUtilization,
+		m.StreamLimitedTotal,
+	)
+}
+
+type RateLimitMetrics struct {
+	// RateLimitedTotal is the number of rate limited connection attempts and
+	// control frames. Labelled by the limit ('connect', 'control_frame' or
+	// 'banned').
+	RateLimitedTotal *prometheus.CounterVec
+
+	// BansTotal is the number of client IPs banned.
+	BansTotal prometheus.Counter
+
+	// BannedClients is the number of currently banned client IPs.
+	BannedClients prometheus.GaugeFunc
+}
+
+func NewRateLimitMetrics(bannedClients func() int) *RateLimitMetrics {
+	return &RateLimitMetrics{
+		RateLimitedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "rate_limited_total",
+				Help:      "Number of rate limited connection attempts and control frames",
+			},
+			[]string{"limit"},
+		),
+		BansTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "bans_total",
+				Help:      "Number of client IPs banned for exceeding rate limits",
+			},
+		),
+		BannedClients: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "banned_clients",
+				Help:      "Number of currently banned client IPs",
+			},
+			func() float64 {
+				return float64(bannedClients())
+			},
+		),
+	}
+}
+
+func (m *RateLimitMetrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.RateLimitedTotal,
+		m.BansTotal,
+		m.BannedClients,
+	)
+}
+
+type ConnLimitMetrics struct {
+	// RejectedTotal is the number of upstream connections rejected for
+	// exceeding a connection limit. Labelled by the limit ('node',
+	// 'endpoint' or 'namespace').
+	RejectedTotal *prometheus.CounterVec
+}
+
+func NewConnLimitMetrics() *ConnLimitMetrics {
+	return &ConnLimitMetrics{
+		RejectedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "conns_rejected_total",
+				Help:      "Number of upstream connections rejected for exceeding a connection limit",
+			},
+			[]string{"limit"},
+		),
+	}
+}
+
+func (m *ConnLimitMetrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.RejectedTotal,
 	)
 }
@@ -0,0 +1,234 @@
+package upstream
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/pkg/recovery"
+	"github.com/andydunstall/piko/server/admission"
+	"github.com/andydunstall/piko/server/events"
+)
+
+type options struct {
+	admission   *admission.Controller
+	rateLimiter *RateLimiter
+	connLimiter *ConnLimiter
+	muxMetrics  *MuxMetrics
+	authLockout *middleware.AuthLockout
+	panics      *recovery.Metrics
+	tenants     bool
+	// events is nil if exporting events is disabled.
+	events *events.Exporter
+
+	allowPrefixes []netip.Prefix
+
+	sessionGracePeriod time.Duration
+	writeCoalesceDelay time.Duration
+
+	maxStreams         int
+	streamQueueTimeout time.Duration
+
+	streamWindow uint32
+
+	headers protocol.Headers
+}
+
+type admissionOption struct {
+	Admission *admission.Controller
+}
+
+func (o admissionOption) apply(opts *options) {
+	opts.admission = o.Admission
+}
+
+// WithAdmission configures the server to reject new upstream connections
+// while the admission controller is shedding load.
+func WithAdmission(admission *admission.Controller) Option {
+	return admissionOption{Admission: admission}
+}
+
+type eventsOption struct {
+	Exporter *events.Exporter
+}
+
+func (o eventsOption) apply(opts *options) {
+	opts.events = o.Exporter
+}
+
+// WithEvents configures the server to export a summary of each upstream
+// connection to the event bus when the connection closes.
+func WithEvents(exporter *events.Exporter) Option {
+	return eventsOption{Exporter: exporter}
+}
+
+type rateLimiterOption struct {
+	RateLimiter *RateLimiter
+}
+
+func (o rateLimiterOption) apply(opts *options) {
+	opts.rateLimiter = o.RateLimiter
+}
+
+// WithRateLimiter configures the server to rate limit connection attempts
+// and WebSocket control frames from upstreams.
+func WithRateLimiter(rateLimiter *RateLimiter) Option {
+	return rateLimiterOption{RateLimiter: rateLimiter}
+}
+
+type connLimiterOption struct {
+	ConnLimiter *ConnLimiter
+}
+
+func (o connLimiterOption) apply(opts *options) {
+	opts.connLimiter = o.ConnLimiter
+}
+
+// WithConnLimiter configures the server to limit the number of upstream
+// connections, both in total and for each endpoint.
+func WithConnLimiter(connLimiter *ConnLimiter) Option {
+	return connLimiterOption{ConnLimiter: connLimiter}
+}
+
+type muxMetricsOption struct {
+	Metrics *MuxMetrics
+}
+
+func (o muxMetricsOption) apply(opts *options) {
+	opts.muxMetrics = o.Metrics
+}
+
+// WithMuxMetrics configures the server to record metrics for the upstream
+// connection multiplexers.
+func WithMuxMetrics(metrics *MuxMetrics) Option {
+	return muxMetricsOption{Metrics: metrics}
+}
+
+type authLockoutOption struct {
+	AuthLockout *middleware.AuthLockout
+}
+
+func (o authLockoutOption) apply(opts *options) {
+	opts.authLockout = o.AuthLockout
+}
+
+// WithAuthLockout configures the server to lock out client IPs and token IDs
+// with repeated authentication failures.
+func WithAuthLockout(lockout *middleware.AuthLockout) Option {
+	return authLockoutOption{AuthLockout: lockout}
+}
+
+type panicsOption struct {
+	Metrics *recovery.Metrics
+}
+
+func (o panicsOption) apply(opts *options) {
+	opts.panics = o.Metrics
+}
+
+// WithPanicMetrics configures the server to count panics recovered while
+// handling upstream connections.
+func WithPanicMetrics(metrics *recovery.Metrics) Option {
+	return panicsOption{Metrics: metrics}
+}
+
+type tenantsOption bool
+
+func (o tenantsOption) apply(opts *options) {
+	opts.tenants = bool(o)
+}
+
+// WithTenants configures the server to tag upstream connection logs with the
+// tenant of the authenticated token.
+func WithTenants(enabled bool) Option {
+	return tenantsOption(enabled)
+}
+
+type sessionGracePeriodOption time.Duration
+
+func (o sessionGracePeriodOption) apply(opts *options) {
+	opts.sessionGracePeriod = time.Duration(o)
+}
+
+// WithSessionGracePeriod configures the server to keep disconnected upstreams
+// registered for the grace period, so upstreams that reconnect with the same
+// session ID resume their registration.
+func WithSessionGracePeriod(gracePeriod time.Duration) Option {
+	return sessionGracePeriodOption(gracePeriod)
+}
+
+type writeCoalesceDelayOption time.Duration
+
+func (o writeCoalesceDelayOption) apply(opts *options) {
+	opts.writeCoalesceDelay = time.Duration(o)
+}
+
+// WithWriteCoalesceDelay configures the server to wait for the delay for more
+// frames before writing small frames to upstream connections.
+func WithWriteCoalesceDelay(delay time.Duration) Option {
+	return writeCoalesceDelayOption(delay)
+}
+
+type streamLimitOption struct {
+	MaxStreams   int
+	QueueTimeout time.Duration
+}
+
+func (o streamLimitOption) apply(opts *options) {
+	opts.maxStreams = o.MaxStreams
+	opts.streamQueueTimeout = o.QueueTimeout
+}
+
+// WithStreamLimit configures the server to limit the number of concurrent
+// streams on each upstream connection.
+//
+// Once a connection reaches the limit, streams are opened on the endpoints
+// other connections, or if all connections are at their limit, wait up to
+// the queue timeout for a stream to close.
+func WithStreamLimit(maxStreams int, queueTimeout time.Duration) Option {
+	return streamLimitOption{
+		MaxStreams:   maxStreams,
+		QueueTimeout: queueTimeout,
+	}
+}
+
+type streamWindowOption uint32
+
+func (o streamWindowOption) apply(opts *options) {
+	opts.streamWindow = uint32(o)
+}
+
+// WithStreamWindow configures a fixed maximum stream receive window in bytes
+// for upstream connections, rather than sizing the window by the RTT the
+// agent reports.
+func WithStreamWindow(window uint32) Option {
+	return streamWindowOption(window)
+}
+
+type allowPrefixesOption []netip.Prefix
+
+func (o allowPrefixesOption) apply(opts *options) {
+	opts.allowPrefixes = o
+}
+
+// WithAllowPrefixes configures the server to reject upstream connections
+// from source addresses outside the given networks.
+func WithAllowPrefixes(prefixes []netip.Prefix) Option {
+	return allowPrefixesOption(prefixes)
+}
+
+type headersOption protocol.Headers
+
+func (o headersOption) apply(opts *options) {
+	opts.headers = protocol.Headers(o)
+}
+
+// WithHeaders configures the names of the Piko handshake headers.
+func WithHeaders(headers protocol.Headers) Option {
+	return headersOption(headers)
+}
+
+type Option interface {
+	apply(*options)
+}
@@ -0,0 +1,192 @@
+package upstream
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/ratelimit"
+	"github.com/andydunstall/piko/server/config"
+)
+
+var (
+	errControlFrameRateLimited = errors.New("control frame rate limit exceeded")
+)
+
+// RateLimiter protects the upstream server from clients spamming connection
+// attempts or WebSocket control frames.
+//
+// Connection attempts are rate limited per client IP, and control frames are
+// rate limited per connection. Clients that exceed either limit are
+// temporarily banned.
+//
+// The client IP is the connection's remote address rather than any
+// forwarded headers, since those are set by the client so would let a
+// client bypass the limits by rotating addresses.
+type RateLimiter struct {
+	// connects is nil if connection rate limiting is disabled.
+	connects     *ratelimit.KeyedLimiter
+	connectBurst int
+
+	controlFrameRate  float64
+	controlFrameBurst int
+
+	banDuration time.Duration
+	bans        *ratelimit.BanList
+
+	metrics *RateLimitMetrics
+
+	logger log.Logger
+}
+
+func NewRateLimiter(conf config.UpstreamRateLimitConfig, logger log.Logger) *RateLimiter {
+	l := &RateLimiter{
+		controlFrameRate:  conf.ControlFrameRate,
+		controlFrameBurst: burst(conf.ControlFrameRate, conf.ControlFrameBurst),
+		banDuration:       conf.BanDuration,
+		bans:              ratelimit.NewBanList(),
+		logger:            logger.WithSubsystem("upstream.ratelimit"),
+	}
+	if conf.ConnectRate != 0 {
+		l.connectBurst = burst(conf.ConnectRate, conf.ConnectBurst)
+		l.connects = ratelimit.NewKeyedLimiter(conf.ConnectRate, l.connectBurst)
+	}
+	l.metrics = NewRateLimitMetrics(l.bans.Len)
+	return l
+}
+
+// Handler returns middleware that rejects connection attempts from banned
+// clients, or clients exceeding the connection rate limit, with '429 Too Many
+// Requests'.
+func (l *RateLimiter) Handler() gin.HandlerFunc {
+	connectLimited := l.metrics.RateLimitedTotal.WithLabelValues("connect")
+	banned := l.metrics.RateLimitedTotal.WithLabelValues("banned")
+	return func(c *gin.Context) {
+		clientIP := c.RemoteIP()
+		now := time.Now()
+
+		if until, ok := l.bans.BannedAt(clientIP, now); ok {
+			banned.Inc()
+			l.reject(c, l.bannedStatus(until.Sub(now)))
+			return
+		}
+
+		if l.connects != nil {
+			allowed, status := l.connects.TakeAt(clientIP, now)
+			if !allowed {
+				connectLimited.Inc()
+				l.logger.Warn(
+					"connect rate limit exceeded",
+					zap.String("client-ip", clientIP),
+				)
+				l.ban(clientIP)
+				// The client can't connect until both the ban expires and
+				// the bucket has a token.
+				status.RetryAfter = max(status.RetryAfter, l.banDuration)
+				status.Reset = max(status.Reset, l.banDuration)
+				l.reject(c, status)
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// LimitControlFrames rate limits the control frames received on the given
+// WebSocket connection. If the limit is exceeded, reading from the
+// connection fails so the connection is closed, and the client IP is banned.
+func (l *RateLimiter) LimitControlFrames(wsConn *websocket.Conn, clientIP string) {
+	if l.controlFrameRate == 0 {
+		return
+	}
+
+	limiter := ratelimit.NewLimiter(l.controlFrameRate, l.controlFrameBurst)
+	limited := l.metrics.RateLimitedTotal.WithLabelValues("control_frame")
+	allow := func() error {
+		if limiter.Allow() {
+			return nil
+		}
+
+		limited.Inc()
+		l.logger.Warn(
+			"control frame rate limit exceeded",
+			zap.String("client-ip", clientIP),
+		)
+		l.ban(clientIP)
+		return errControlFrameRateLimited
+	}
+
+	pingHandler := wsConn.PingHandler()
+	wsConn.SetPingHandler(func(message string) error {
+		if err := allow(); err != nil {
+			return err
+		}
+		return pingHandler(message)
+	})
+	pongHandler := wsConn.PongHandler()
+	wsConn.SetPongHandler(func(message string) error {
+		if err := allow(); err != nil {
+			return err
+		}
+		return pongHandler(message)
+	})
+}
+
+func (l *RateLimiter) Metrics() *RateLimitMetrics {
+	return l.metrics
+}
+
+func (l *RateLimiter) ban(clientIP string) {
+	if l.banDuration == 0 {
+		return
+	}
+
+	l.bans.Ban(clientIP, time.Now().Add(l.banDuration))
+	l.metrics.BansTotal.Inc()
+
+	l.logger.Warn(
+		"banned client",
+		zap.String("client-ip", clientIP),
+		zap.Duration("duration", l.banDuration),
+	)
+}
+
+// bannedStatus returns the limiter status of a client banned for the given
+// duration.
+func (l *RateLimiter) bannedStatus(remaining time.Duration) ratelimit.Status {
+	status := ratelimit.Status{
+		RetryAfter: remaining,
+		Reset:      remaining,
+	}
+	if l.connects != nil {
+		status.Limit = l.connectBurst
+	}
+	return status
+}
+
+// reject rejects the connection attempt with headers describing when the
+// client can retry (see ratelimit.SetHeaders).
+func (l *RateLimiter) reject(c *gin.Context, status ratelimit.Status) {
+	// Ensure Retry-After is always sent.
+	status.RetryAfter = max(status.RetryAfter, time.Second)
+	ratelimit.SetHeaders(c.Writer.Header(), status)
+	c.AbortWithStatusJSON(
+		http.StatusTooManyRequests,
+		gin.H{"error": "too many requests"},
+	)
+}
+
+// burst returns the configured burst, defaulting to the rate rounded up.
+func burst(rate float64, burst int) int {
+	if burst != 0 {
+		return burst
+	}
+	return int(math.Ceil(rate))
+}
@@ -0,0 +1,74 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+)
+
+func TestRateLimiter_Headers(t *testing.T) {
+	connect := func(router *gin.Engine) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	newRouter := func(rateLimiter *RateLimiter) *gin.Engine {
+		router := gin.New()
+		router.Use(rateLimiter.Handler())
+		router.GET("/", func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		return router
+	}
+
+	t.Run("retry after refill", func(t *testing.T) {
+		router := newRouter(NewRateLimiter(config.UpstreamRateLimitConfig{
+			ConnectRate:  0.5,
+			ConnectBurst: 2,
+		}, log.NewNopLogger()))
+
+		assert.Equal(t, http.StatusOK, connect(router).Code)
+		assert.Equal(t, http.StatusOK, connect(router).Code)
+
+		rec := connect(router)
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "2", rec.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+		// Refills a token every 2 seconds, so the bucket is full after 4
+		// seconds.
+		assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+		assert.Equal(t, "4", rec.Header().Get("RateLimit-Reset"))
+	})
+
+	t.Run("retry after ban", func(t *testing.T) {
+		router := newRouter(NewRateLimiter(config.UpstreamRateLimitConfig{
+			ConnectRate:  1,
+			ConnectBurst: 1,
+			BanDuration:  time.Minute,
+		}, log.NewNopLogger()))
+
+		assert.Equal(t, http.StatusOK, connect(router).Code)
+
+		rec := connect(router)
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+		assert.Equal(t, "60", rec.Header().Get("RateLimit-Reset"))
+
+		// Banned clients retry once the ban expires.
+		rec = connect(router)
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+		assert.Equal(t, "1", rec.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+	})
+}
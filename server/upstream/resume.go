@@ -0,0 +1,181 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/andydunstall/yamux"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// sessions tracks upstream sessions with session IDs, so an upstream that
+// disconnects and reconnects within the grace period, such as after a brief
+// network blip, resumes its registration rather than being removed and
+// re-added.
+//
+// This avoids propagating the endpoint being removed and re-added to the
+// cluster, and requests during the disconnect wait for the upstream to
+// reconnect rather than failing.
+type sessions struct {
+	gracePeriod time.Duration
+
+	upstreams Manager
+
+	// sessions contains the upstreams with a session ID, keyed by endpoint
+	// and session ID.
+	sessions map[string]*ConnUpstream
+
+	// expiryTimers contains the timers to expire disconnected sessions,
+	// keyed by endpoint and session ID.
+	expiryTimers map[string]*expiryTimer
+
+	// evict closes a session replaced by a connection resuming the same
+	// session.
+	evict func(sess *yamux.Session)
+
+	mu sync.Mutex
+
+	logger log.Logger
+}
+
+func newSessions(gracePeriod time.Duration, upstreams Manager, logger log.Logger) *sessions {
+	return &sessions{
+		gracePeriod:  gracePeriod,
+		upstreams:    upstreams,
+		sessions:     make(map[string]*ConnUpstream),
+		expiryTimers: make(map[string]*expiryTimer),
+		evict: func(sess *yamux.Session) {
+			sess.Close()
+		},
+		logger: logger,
+	}
+}
+
+// Connect registers the connected upstream session. If the session resumes
+// an existing session, the existing upstream is returned with the new
+// session, and resumed is true.
+//
+// limiter limits the streams of a new upstream, and is nil if unlimited.
+// Resumed upstreams keep their existing limiter. multiplexed indicates
+// whether the session is shared by multiple endpoints.
+func (s *sessions) Connect(
+	endpointID string,
+	sessionID string,
+	sess *yamux.Session,
+	limiter *streamLimiter,
+	multiplexed bool,
+) (upstream *ConnUpstream, resumed bool) {
+	if s.gracePeriod == 0 || sessionID == "" {
+		upstream := NewConnUpstream(endpointID, sess)
+		upstream.limiter = limiter
+		upstream.multiplexed = multiplexed
+		s.upstreams.AddConn(upstream)
+		return upstream, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := sessionKey(endpointID, sessionID)
+	if upstream, ok := s.sessions[key]; ok {
+		if timer, ok := s.expiryTimers[key]; ok {
+			timer.timer.Stop()
+			delete(s.expiryTimers, key)
+		}
+
+		prev := upstream.currentSession()
+		upstream.resume(sess)
+		// If we haven't yet detected the previous session disconnected,
+		// close it.
+		s.evict(prev)
+
+		return upstream, true
+	}
+
+	upstream = NewConnUpstream(endpointID, sess)
+	upstream.limiter = limiter
+	upstream.multiplexed = multiplexed
+	upstream.sessionID = sessionID
+	upstream.gracePeriod = s.gracePeriod
+	s.sessions[key] = upstream
+	s.upstreams.AddConn(upstream)
+	return upstream, false
+}
+
+// Disconnect handles the upstream session disconnecting.
+//
+// If the upstream has a session ID, it remains registered until the grace
+// period expires, unless the server is shutting down.
+func (s *sessions) Disconnect(upstream *ConnUpstream, sess *yamux.Session, shutdown bool) {
+	if upstream.sessionID == "" {
+		s.upstreams.RemoveConn(upstream)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if upstream.currentSession() != sess {
+		// The upstream has already resumed with a new session.
+		return
+	}
+
+	key := sessionKey(upstream.endpointID, upstream.sessionID)
+	if shutdown {
+		s.removeLocked(key, upstream)
+		return
+	}
+
+	upstream.disconnectSession(sess)
+
+	timer := &expiryTimer{}
+	timer.timer = time.AfterFunc(s.gracePeriod, func() {
+		s.expire(key, upstream, timer)
+	})
+	s.expiryTimers[key] = timer
+}
+
+// Close removes all disconnected sessions.
+func (s *sessions) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, timer := range s.expiryTimers {
+		timer.timer.Stop()
+		s.removeLocked(key, s.sessions[key])
+	}
+}
+
+func (s *sessions) expire(key string, upstream *ConnUpstream, timer *expiryTimer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expiryTimers[key] != timer {
+		// The session was resumed before the timer fired.
+		return
+	}
+
+	s.logger.Info(
+		"upstream session expired",
+		zap.String("endpoint-id", upstream.endpointID),
+	)
+	s.removeLocked(key, upstream)
+}
+
+func (s *sessions) removeLocked(key string, upstream *ConnUpstream) {
+	delete(s.sessions, key)
+	delete(s.expiryTimers, key)
+	upstream.expire()
+	s.upstreams.RemoveConn(upstream)
+}
+
+// expiryTimer wraps a timer so expired timers can be compared by identity.
+type expiryTimer struct {
+	timer *time.Timer
+}
+
+func sessionKey(endpointID string, sessionID string) string {
+	return endpointID + "/" + sessionID
+}
@@ -7,6 +7,10 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/andydunstall/yamux"
 	"github.com/gin-gonic/gin"
@@ -17,17 +21,57 @@ import (
 	"github.com/andydunstall/piko/pkg/auth"
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
+	"github.com/andydunstall/piko/pkg/recovery"
 	pikowebsocket "github.com/andydunstall/piko/pkg/websocket"
+	"github.com/andydunstall/piko/server/events"
 )
 
 // Server accepts connections from upstream services.
 type Server struct {
 	upstreams Manager
 
+	sessions *sessions
+
 	httpServer *http.Server
 
 	websocketUpgrader *websocket.Upgrader
 
+	// rateLimiter is nil if rate limiting is disabled.
+	rateLimiter *RateLimiter
+
+	// connLimiter is nil if connections are unlimited.
+	connLimiter *ConnLimiter
+
+	// muxMetrics is nil if metrics are disabled.
+	muxMetrics *MuxMetrics
+
+	// metrics records the upstream connections for each endpoint.
+	metrics *middleware.LabeledMetrics
+
+	// events is nil if exporting events is disabled.
+	events *events.Exporter
+
+	panics *recovery.Pool
+
+	writeCoalesceDelay time.Duration
+
+	// maxStreams is the maximum number of concurrent streams on each
+	// upstream connection, or zero if unlimited.
+	maxStreams         int
+	streamQueueTimeout time.Duration
+
+	// streamWindow is the fixed maximum stream receive window, or zero to
+	// size windows by the RTT reported by the agent.
+	streamWindow uint32
+
+	headers protocol.Headers
+
+	// conns contains the connected upstream connections, which are drained
+	// on shutdown.
+	conns   map[*activeConn]struct{}
+	connsMu sync.Mutex
+
 	ctx    context.Context
 	cancel func()
 
@@ -39,37 +83,90 @@ func NewServer(
 	verifier auth.Verifier,
 	tlsConfig *tls.Config,
 	logger log.Logger,
+	opts ...Option,
 ) *Server {
+	options := options{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
 	logger = logger.WithSubsystem("upstream")
 
 	router := gin.New()
 	ctx, cancel := context.WithCancel(context.Background())
 	server := &Server{
 		upstreams: upstreams,
+		sessions:  newSessions(options.sessionGracePeriod, upstreams, logger),
 		httpServer: &http.Server{
 			Handler:   router,
 			TLSConfig: tlsConfig,
 			ErrorLog:  logger.StdLogger(zapcore.WarnLevel),
 		},
-		websocketUpgrader: &websocket.Upgrader{},
-		ctx:               ctx,
-		cancel:            cancel,
-		logger:            logger,
+		websocketUpgrader:  &websocket.Upgrader{},
+		rateLimiter:        options.rateLimiter,
+		connLimiter:        options.connLimiter,
+		muxMetrics:         options.muxMetrics,
+		metrics:            middleware.NewLabeledMetrics("upstream"),
+		events:             options.events,
+		panics:             recovery.NewPool("upstream", options.panics, logger),
+		writeCoalesceDelay: options.writeCoalesceDelay,
+		maxStreams:         options.maxStreams,
+		streamQueueTimeout: options.streamQueueTimeout,
+		streamWindow:       options.streamWindow,
+		headers:            options.headers,
+		conns:              make(map[*activeConn]struct{}),
+		ctx:                ctx,
+		cancel:             cancel,
+		logger:             logger,
 	}
 
+	// Replaced sessions are closed with a close code so the upstream knows
+	// why it was disconnected.
+	server.sessions.evict = server.evict
+
 	// Recover from panics.
 	router.Use(gin.CustomRecoveryWithWriter(nil, server.panicRoute))
 
+	// Reject connections from unknown networks before any other processing,
+	// including authentication.
+	if len(options.allowPrefixes) > 0 {
+		router.Use(newSourceAllowList(options.allowPrefixes, logger).Handler)
+	}
+
+	if options.admission != nil {
+		router.Use(options.admission.Handler("upstream"))
+		router.Use(options.admission.FileHandler())
+	}
+
+	if options.rateLimiter != nil {
+		router.Use(options.rateLimiter.Handler())
+	}
+
 	if verifier != nil {
-		authMiddleware := middleware.NewAuth(verifier, logger)
+		authOpts := []middleware.AuthOption{
+			middleware.WithAuthHeaders(options.headers),
+		}
+		if options.authLockout != nil {
+			authOpts = append(authOpts, middleware.WithLockout(options.authLockout))
+		}
+		authMiddleware := middleware.NewAuth(verifier, logger, authOpts...)
 		router.Use(authMiddleware.Verify)
 	}
 
+	if options.tenants {
+		router.Use(middleware.NewTenant())
+	}
+
 	server.registerRoutes(router)
 
 	return server
 }
 
+// Metrics returns the per-endpoint upstream connection metrics.
+func (s *Server) Metrics() *middleware.LabeledMetrics {
+	return s.metrics
+}
+
 func (s *Server) Serve(ln net.Listener) error {
 	s.logger.Info(
 		"starting upstream server",
@@ -91,25 +188,68 @@ func (s *Server) Serve(ln net.Listener) error {
 
 // Shutdown attempts to gracefully shutdown the server by waiting for pending
 // requests to complete.
+//
+// Once the server stops accepting connections, connected upstreams are
+// notified the server is draining, and the server waits for in-flight
+// proxied requests to complete until the context is cancelled, before
+// closing the upstream connections.
 func (s *Server) Shutdown(ctx context.Context) error {
 	err := s.httpServer.Shutdown(ctx)
+	s.drain(ctx)
 	// Close the context to close upstream connections.
 	s.cancel()
+	// Remove any disconnected upstreams waiting to resume.
+	s.sessions.Close()
 	return err
 }
 
 // upstreamRoute handles WebSocket connections from upstream services.
 func (s *Server) upstreamRoute(c *gin.Context) {
-	endpointID := c.Param("endpointID")
+	// The endpoint ID may contain namespaces separated by '/', so is matched
+	// as a wildcard path parameter including the leading '/'.
+	endpointID := strings.TrimPrefix(c.Param("endpointID"), "/")
+	s.serveUpstream(c, []string{endpointID}, false)
+}
+
+// multiplexedUpstreamRoute handles WebSocket connections from upstream
+// services listening on multiple endpoints.
+func (s *Server) multiplexedUpstreamRoute(c *gin.Context) {
+	endpointIDs, err := protocol.ParseEndpoints(c.GetHeader(s.headers.Endpoints()))
+	if err != nil {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"error": "invalid endpoints: " + err.Error()},
+		)
+		return
+	}
+	s.serveUpstream(c, endpointIDs, true)
+}
+
+// serveUpstream registers the upstream connection for each of the given
+// endpoints. If multiplexed is true, streams start with a stream header
+// identifying their endpoint.
+func (s *Server) serveUpstream(c *gin.Context, endpointIDs []string, multiplexed bool) {
+	for _, endpointID := range endpointIDs {
+		if err := protocol.ValidateEndpointID(endpointID); err != nil {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{"error": "invalid endpoint id: " + err.Error()},
+			)
+			return
+		}
+	}
 
 	token, ok := c.Get(middleware.TokenContextKey)
 	if ok {
 		// If the token contains a set of permitted endpoints, verify the
-		// target endpoint matches one of those endpoints. Otherwise if the
+		// target endpoints match one of those endpoints. Otherwise if the
 		// token doesn't contain any endpoints the client can access any
 		// endpoint.
 		endpointToken := token.(*auth.Token)
-		if !endpointToken.EndpointPermitted(endpointID) {
+		for _, endpointID := range endpointIDs {
+			if endpointToken.EndpointPermitted(endpointID) {
+				continue
+			}
 			s.logger.Warn(
 				"endpoint not permitted",
 				zap.Strings("token-endpoints", endpointToken.Endpoints),
@@ -123,25 +263,111 @@ func (s *Server) upstreamRoute(c *gin.Context) {
 		}
 	}
 
+	sessionID := c.GetHeader(s.headers.SessionID())
+	if len(sessionID) > protocol.MaxSessionIDLength {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"error": "session id too long"},
+		)
+		return
+	}
+
+	maxStreams := s.maxStreams
+	if h := c.GetHeader(s.headers.MaxStreams()); h != "" {
+		agentMaxStreams, err := strconv.Atoi(h)
+		if err != nil || agentMaxStreams < 0 {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{"error": "invalid max streams"},
+			)
+			return
+		}
+		// Use the lower of the server and agent limits, where zero is
+		// unlimited.
+		if agentMaxStreams != 0 && (maxStreams == 0 || agentMaxStreams < maxStreams) {
+			maxStreams = agentMaxStreams
+		}
+	}
+
+	streamWindow := s.streamWindow
+	if streamWindow == 0 {
+		streamWindow = protocol.InitialStreamWindow
+		if h := c.GetHeader(s.headers.RTT()); h != "" {
+			rtt, ok := protocol.ParseSeconds(h)
+			if !ok {
+				c.JSON(
+					http.StatusBadRequest,
+					gin.H{"error": "invalid rtt"},
+				)
+				return
+			}
+			streamWindow = protocol.StreamWindow(rtt)
+		}
+	}
+
+	messageSize := pikowebsocket.MaxMessageSize
+	if h := c.GetHeader(s.headers.MaxMessageSize()); h != "" {
+		agentMessageSize, err := strconv.Atoi(h)
+		if err != nil ||
+			agentMessageSize < pikowebsocket.MinMessageSize ||
+			agentMessageSize > pikowebsocket.MaxMessageSize {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{"error": "invalid max message size"},
+			)
+			return
+		}
+		messageSize = agentMessageSize
+	}
+
+	if s.connLimiter != nil {
+		code, ok := s.connLimiter.Acquire(endpointIDs)
+		if !ok {
+			s.logger.Warn(
+				"upstream connection limit reached",
+				zap.Strings("endpoint-ids", endpointIDs),
+				zap.String("code", code),
+			)
+			c.JSON(
+				http.StatusTooManyRequests,
+				gin.H{"error": "upstream connection limit reached", "code": code},
+			)
+			return
+		}
+		defer s.connLimiter.Release(endpointIDs)
+	}
+
 	wsConn, err := s.websocketUpgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		// Upgrade replies to the client so nothing else to do.
 		s.logger.Warn("failed to upgrade websocket", zap.Error(err))
 		return
 	}
+	if s.rateLimiter != nil {
+		s.rateLimiter.LimitControlFrames(wsConn, c.RemoteIP())
+	}
 	conn := pikowebsocket.New(wsConn)
+	conn.SetMessageSize(messageSize)
 	defer conn.Close()
 
-	s.logger.Info(
-		"upstream connected",
-		zap.String("endpoint-id", endpointID),
+	logFields := []zap.Field{
 		zap.String("client-ip", c.ClientIP()),
-	)
-	defer s.logger.Info(
-		"upstream disconnected",
-		zap.String("endpoint-id", endpointID),
-		zap.String("client-ip", c.ClientIP()),
-	)
+	}
+	if multiplexed {
+		logFields = append(logFields, zap.Strings("endpoint-ids", endpointIDs))
+	} else {
+		logFields = append(logFields, zap.String("endpoint-id", endpointIDs[0]))
+	}
+	if tenant := middleware.Tenant(c); tenant != "" {
+		logFields = append(logFields, zap.String("tenant", tenant))
+	}
+	s.logger.Info("upstream connected", logFields...)
+	defer s.logger.Info("upstream disconnected", logFields...)
+
+	for _, endpointID := range endpointIDs {
+		disconnected := s.metrics.UpstreamConnected(endpointID)
+		defer disconnected()
+	}
 
 	ctx := s.ctx
 	if ok {
@@ -155,53 +381,204 @@ func (s *Server) upstreamRoute(c *gin.Context) {
 		}
 	}
 
-	muxConfig := yamux.DefaultConfig()
+	muxConfig := protocol.MuxConfig()
 	muxConfig.Logger = s.logger.StdLogger(zap.WarnLevel)
 	muxConfig.LogOutput = nil
-	sess, err := yamux.Server(conn, muxConfig)
+	muxConfig.MaxStreamWindowSize = streamWindow
+	muxConnOpts := []protocol.ConnOption{
+		protocol.WithCoalesceDelay(s.writeCoalesceDelay),
+	}
+	if s.muxMetrics != nil {
+		muxConnOpts = append(muxConnOpts, protocol.WithControlFrameLatency(
+			s.muxMetrics.ControlFrameLatency,
+		))
+	}
+	sess, err := yamux.Server(protocol.NewMuxConn(conn, muxConnOpts...), muxConfig)
 	if err != nil {
 		// Will not happen.
 		panic("yamux server: " + err.Error())
 	}
 	defer sess.Close()
 
-	upstream := NewConnUpstream(endpointID, sess)
+	// The stream limit applies to the connection, so is shared by each
+	// endpoint of a multiplexed connection.
+	var limiter *streamLimiter
+	if maxStreams != 0 {
+		limiter = newStreamLimiter(maxStreams, s.streamQueueTimeout, s.muxMetrics)
+	}
+	active := &activeConn{
+		conn: conn,
+		sess: sess,
+	}
+	// closeCode and closeErr describe why the connection closed, for the
+	// session summaries.
+	var closeCode pikowebsocket.CloseCode
+	var closeErr error
+	for _, endpointID := range endpointIDs {
+		upstream, resumed := s.sessions.Connect(
+			endpointID, sessionID, sess, limiter, multiplexed,
+		)
+		if resumed {
+			s.logger.Info(
+				"upstream session resumed",
+				append(logFields, zap.String("endpoint-id", endpointID))...,
+			)
+		}
+		active.upstreams = append(active.upstreams, upstream)
 
-	s.upstreams.AddConn(upstream)
-	defer s.upstreams.RemoveConn(upstream)
+		start := upstream.Stats()
+		connectedAt := time.Now()
+		defer func() {
+			summary := newSessionSummary(
+				start, upstream.Stats(), time.Since(connectedAt), closeCode, closeErr,
+			)
+			s.sessionClosed(c, summary)
+		}()
+	}
+	// Ping once per connection rather than once per endpoint.
+	go s.monitorSession(ctx, active.upstreams, sess)
+
+	defer func() {
+		// If the server is shutting down or the token expired, the upstream
+		// can't resume.
+		s.disconnect(active, ctx.Err() != nil)
+	}()
 
+	s.addConn(active)
+	defer s.removeConn(active)
+
+	closeCode, closeErr = s.waitClosed(ctx, active)
+}
+
+// waitClosed waits for the session of the upstream connection to close, and
+// returns the close code describing why. If the server closes the
+// connection, the upstream is sent the close code.
+//
+// Returns the error that closed the session if it wasn't closed
+// deliberately.
+func (s *Server) waitClosed(
+	ctx context.Context, active *activeConn,
+) (pikowebsocket.CloseCode, error) {
+	// The client will never open streams but block on accept to wait for
+	// close or an error.
 	for {
-		// The client will never open streams but block on accept to wait for
-		// close or an error.
-		if _, err := sess.AcceptStreamWithContext(ctx); err != nil {
-			if errors.Is(err, net.ErrClosed) {
-				return
-			}
-			if errors.Is(err, context.Canceled) {
-				// Server shutdown.
-				return
-			}
-			if errors.Is(err, context.DeadlineExceeded) {
-				s.logger.Info("upstream token expired")
-				return
+		_, err := active.sess.AcceptStreamWithContext(ctx)
+		if err == nil {
+			continue
+		}
+
+		if code := pikowebsocket.CloseCode(active.closeCode.Load()); code != 0 {
+			// The server already decided to close the connection, such as
+			// when evicted or draining.
+			_ = active.close(code)
+			return code, nil
+		}
+		if errors.Is(err, context.Canceled) {
+			// Server shutdown.
+			_ = active.close(pikowebsocket.CloseGoingAway)
+			return pikowebsocket.CloseGoingAway, nil
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			s.logger.Info("upstream token expired")
+			_ = active.close(pikowebsocket.CloseAuthExpired)
+			return pikowebsocket.CloseAuthExpired, nil
+		}
+		if errors.Is(err, net.ErrClosed) {
+			// Closed by the upstream, or the connection dropped.
+			code := pikowebsocket.CloseCodeOf(err)
+			if code.Deliberate() {
+				return code, nil
 			}
-			s.logger.Warn("session closed unexpectedly", zap.Error(err))
+			return code, err
+		}
+		s.logger.Warn("session closed unexpectedly", zap.Error(err))
+		if errors.Is(err, yamux.ErrInvalidVersion) ||
+			errors.Is(err, yamux.ErrInvalidMsgType) ||
+			errors.Is(err, yamux.ErrRecvWindowExceeded) {
+			_ = active.close(pikowebsocket.CloseProtocolError)
+			return pikowebsocket.CloseProtocolError, err
+		}
+		return pikowebsocket.CloseAbnormal, err
+	}
+}
+
+// sessionClosed logs the summary of a closed upstream connection and
+// exports it to the event bus.
+func (s *Server) sessionClosed(c *gin.Context, summary *SessionSummary) {
+	fields := summary.Fields()
+	tenant := middleware.Tenant(c)
+	if tenant != "" {
+		fields = append(fields, zap.String("tenant", tenant))
+	}
+	s.logger.Info("upstream session closed", fields...)
+
+	if s.events == nil {
+		return
+	}
+	s.events.Publish(&events.Event{
+		Type:       events.EventTypeSessionClosed,
+		EndpointID: summary.EndpointID,
+		Session: &events.Session{
+			RemoteAddr:    summary.RemoteAddr,
+			Duration:      summary.Duration.Milliseconds(),
+			StreamsServed: summary.StreamsServed,
+			BytesSent:     summary.BytesSent,
+			BytesReceived: summary.BytesReceived,
+			Reason:        summary.CloseCode.String(),
+			CloseCode:     int(summary.CloseCode),
+			Error:         summary.Error,
+			Tenant:        tenant,
+		},
+	})
+}
+
+// monitorSession periodically pings the upstream session to measure the RTT
+// and logs the session multiplexer stats of each endpoint, to diagnose slow
+// endpoints.
+func (s *Server) monitorSession(
+	ctx context.Context, upstreams []*ConnUpstream, sess *yamux.Session,
+) {
+	defer s.panics.Recover()
+
+	endpointIDs := make([]string, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		endpointIDs = append(endpointIDs, upstream.EndpointID())
+	}
+
+	ticker := time.NewTicker(statsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-sess.CloseChan():
+			return
+		case <-ctx.Done():
 			return
 		}
+
+		rtt, err := sess.Ping()
+		if err != nil {
+			s.logger.Debug(
+				"upstream ping failed",
+				zap.Strings("endpoint-ids", endpointIDs),
+				zap.Error(err),
+			)
+		}
+		for _, upstream := range upstreams {
+			upstream.observePing(rtt, err)
+			s.logger.Debug("upstream session stats", upstream.Stats().Fields()...)
+		}
 	}
 }
 
 func (s *Server) registerRoutes(router *gin.Engine) {
-	piko := router.Group("/piko/v1")
-	piko.GET("/upstream/:endpointID", s.upstreamRoute)
+	router.GET(protocol.UpstreamPath("*endpointID"), s.upstreamRoute)
+	router.GET(protocol.MultiplexedUpstreamPath, s.multiplexedUpstreamRoute)
 }
 
 func (s *Server) panicRoute(c *gin.Context, err any) {
-	s.logger.Error(
-		"handler panic",
-		zap.String("path", c.FullPath()),
-		zap.Any("err", err),
-	)
+	s.panics.Observe(err)
 	c.AbortWithStatus(http.StatusInternalServerError)
 }
 
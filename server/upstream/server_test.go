@@ -4,17 +4,26 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/netip"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/andydunstall/yamux"
+	gorillawebsocket "github.com/gorilla/websocket"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/andydunstall/piko/pkg/auth"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
 	"github.com/andydunstall/piko/pkg/testutil"
 	"github.com/andydunstall/piko/pkg/websocket"
+	"github.com/andydunstall/piko/server/config"
 )
 
 type fakeManager struct {
@@ -23,9 +32,11 @@ type fakeManager struct {
 }
 
 func newFakeManager() *fakeManager {
+	// Buffer removals since the server removes upstreams while shutting
+	// down, before the test reads them.
 	return &fakeManager{
 		addConnCh:    make(chan Upstream),
-		removeConnCh: make(chan Upstream),
+		removeConnCh: make(chan Upstream, 16),
 	}
 }
 
@@ -51,6 +62,16 @@ func (v *fakeVerifier) Verify(token string) (*auth.Token, error) {
 
 var _ auth.Verifier = &fakeVerifier{}
 
+// readUntilError reads from the connection until it fails.
+func readUntilError(conn net.Conn) error {
+	buf := make([]byte, 1024)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			return err
+		}
+	}
+}
+
 func TestServer_Register(t *testing.T) {
 	t.Run("ok", func(t *testing.T) {
 		ln, err := net.Listen("tcp", "127.0.0.1:0")
@@ -74,10 +95,27 @@ func TestServer_Register(t *testing.T) {
 		addedUpstream := <-manager.addConnCh
 		assert.Equal(t, "my-endpoint", addedUpstream.EndpointID())
 
+		metrics := s.Metrics()
+		assert.Equal(t, 1.0, promtestutil.ToFloat64(
+			metrics.UpstreamsConnected.WithLabelValues("my-endpoint"),
+		))
+		assert.Equal(t, 1.0, promtestutil.ToFloat64(
+			metrics.UpstreamsActive.WithLabelValues("my-endpoint"),
+		))
+
 		conn.Close()
 
 		removedUpstream := <-manager.removeConnCh
 		assert.Equal(t, "my-endpoint", removedUpstream.EndpointID())
+
+		assert.Eventually(t, func() bool {
+			return promtestutil.ToFloat64(
+				metrics.UpstreamsActive.WithLabelValues("my-endpoint"),
+			) == 0
+		}, time.Second, time.Millisecond*10)
+		assert.Equal(t, 1.0, promtestutil.ToFloat64(
+			metrics.UpstreamsDisconnected.WithLabelValues("my-endpoint"),
+		))
 	})
 
 	// Tests the server closes upstream connections when it is shutdown.
@@ -111,6 +149,185 @@ func TestServer_Register(t *testing.T) {
 	})
 }
 
+func TestServer_RateLimit(t *testing.T) {
+	t.Run("connect rate limited", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+
+		rateLimiter := NewRateLimiter(config.UpstreamRateLimitConfig{
+			ConnectRate:  1,
+			ConnectBurst: 1,
+			BanDuration:  time.Minute,
+		}, log.NewNopLogger())
+		s := NewServer(
+			manager, nil, nil, log.NewNopLogger(), WithRateLimiter(rateLimiter),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+		conn, err := websocket.Dial(context.TODO(), url)
+		require.NoError(t, err)
+		<-manager.addConnCh
+		conn.Close()
+		<-manager.removeConnCh
+
+		// Exceeds the rate limit.
+		_, err = websocket.Dial(context.TODO(), url)
+		assert.ErrorContains(t, err, "429: too many requests")
+
+		// Banned.
+		_, ok := rateLimiter.bans.Banned("127.0.0.1")
+		assert.True(t, ok)
+	})
+
+	t.Run("ignores forwarded for", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+
+		rateLimiter := NewRateLimiter(config.UpstreamRateLimitConfig{
+			ConnectRate:  1,
+			ConnectBurst: 1,
+			BanDuration:  time.Minute,
+		}, log.NewNopLogger())
+		s := NewServer(
+			manager, nil, nil, log.NewNopLogger(), WithRateLimiter(rateLimiter),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+		conn, err := websocket.Dial(
+			context.TODO(), url, websocket.WithHeader("X-Forwarded-For", "10.0.0.1"),
+		)
+		require.NoError(t, err)
+		<-manager.addConnCh
+		conn.Close()
+		<-manager.removeConnCh
+
+		// Changing the forwarded address must not bypass the rate limit.
+		_, err = websocket.Dial(
+			context.TODO(), url, websocket.WithHeader("X-Forwarded-For", "10.0.0.2"),
+		)
+		assert.ErrorContains(t, err, "429: too many requests")
+
+		_, ok := rateLimiter.bans.Banned("127.0.0.1")
+		assert.True(t, ok)
+	})
+
+	t.Run("control frames rate limited", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+
+		rateLimiter := NewRateLimiter(config.UpstreamRateLimitConfig{
+			ControlFrameRate:  1,
+			ControlFrameBurst: 2,
+			BanDuration:       time.Minute,
+		}, log.NewNopLogger())
+		s := NewServer(
+			manager, nil, nil, log.NewNopLogger(), WithRateLimiter(rateLimiter),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+		wsConn, _, err := gorillawebsocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		defer wsConn.Close()
+
+		<-manager.addConnCh
+
+		// Spam pings which should cause the server to close the connection.
+		for i := 0; i != 5; i++ {
+			require.NoError(t, wsConn.WriteControl(
+				gorillawebsocket.PingMessage, nil, time.Now().Add(time.Second),
+			))
+		}
+
+		<-manager.removeConnCh
+
+		// Banned.
+		_, err = websocket.Dial(context.TODO(), url)
+		assert.ErrorContains(t, err, "429: too many requests")
+	})
+}
+
+func TestServer_AllowPrefixes(t *testing.T) {
+	newServer := func(t *testing.T, prefixes ...string) (*fakeManager, string) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		var allowPrefixes []netip.Prefix
+		for _, prefix := range prefixes {
+			allowPrefixes = append(allowPrefixes, netip.MustParsePrefix(prefix))
+		}
+
+		manager := newFakeManager()
+		s := NewServer(
+			manager, nil, nil, log.NewNopLogger(), WithAllowPrefixes(allowPrefixes),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		t.Cleanup(func() {
+			s.Shutdown(context.TODO())
+		})
+
+		return manager, fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+	}
+
+	t.Run("permitted", func(t *testing.T) {
+		manager, url := newServer(t, "10.0.0.0/8", "127.0.0.0/8")
+
+		conn, err := websocket.Dial(context.TODO(), url)
+		require.NoError(t, err)
+		<-manager.addConnCh
+		conn.Close()
+	})
+
+	t.Run("not permitted", func(t *testing.T) {
+		_, url := newServer(t, "10.0.0.0/8")
+
+		_, err := websocket.Dial(context.TODO(), url)
+		assert.ErrorContains(t, err, "403: source address not permitted")
+	})
+
+	t.Run("ignores forwarded for", func(t *testing.T) {
+		_, url := newServer(t, "10.0.0.0/8")
+
+		// Setting a permitted forwarded address must not bypass the allow
+		// list.
+		_, err := websocket.Dial(
+			context.TODO(), url, websocket.WithHeader("X-Forwarded-For", "10.0.0.1"),
+		)
+		assert.ErrorContains(t, err, "403: source address not permitted")
+	})
+}
+
 func TestServer_Authentication(t *testing.T) {
 	t.Run("ok", func(t *testing.T) {
 		ln, err := net.Listen("tcp", "127.0.0.1:0")
@@ -188,6 +405,11 @@ func TestServer_Authentication(t *testing.T) {
 
 		removedUpstream := <-manager.removeConnCh
 		assert.Equal(t, "my-endpoint", removedUpstream.EndpointID())
+
+		// The server closes the connection with the auth expired close code.
+		err = readUntilError(conn)
+		assert.ErrorIs(t, err, net.ErrClosed)
+		assert.Equal(t, websocket.CloseAuthExpired, websocket.CloseCodeOf(err))
 	})
 
 	t.Run("endpoint not permitted", func(t *testing.T) {
@@ -345,3 +567,673 @@ func TestServer_TLS(t *testing.T) {
 		require.ErrorContains(t, err, "bad handshake")
 	})
 }
+
+func TestServer_SessionResume(t *testing.T) {
+	newServer := func(t *testing.T, gracePeriod time.Duration) (*fakeManager, string) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+		s := NewServer(
+			manager, nil, nil, log.NewNopLogger(),
+			WithSessionGracePeriod(gracePeriod),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		t.Cleanup(func() {
+			go func() {
+				// Drain any removed upstreams on shutdown.
+				for range manager.removeConnCh {
+				}
+			}()
+			s.Shutdown(context.TODO())
+		})
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+		return manager, url
+	}
+
+	dial := func(t *testing.T, url string, sessionID string) *yamux.Session {
+		conn, err := websocket.Dial(
+			context.TODO(),
+			url,
+			websocket.WithHeader(protocol.Headers{}.SessionID(), sessionID),
+		)
+		require.NoError(t, err)
+
+		muxConfig := protocol.MuxConfig()
+		muxConfig.LogOutput = io.Discard
+		sess, err := yamux.Client(conn, muxConfig)
+		require.NoError(t, err)
+		return sess
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		manager, url := newServer(t, time.Minute)
+
+		sess := dial(t, url, "my-session")
+		upstream := <-manager.addConnCh
+
+		sess.Close()
+
+		// Wait for the server to detect the disconnect.
+		assert.Eventually(t, func() bool {
+			connUpstream := upstream.(*ConnUpstream)
+			connUpstream.mu.Lock()
+			defer connUpstream.mu.Unlock()
+			return connUpstream.resumeCh != nil
+		}, time.Second, time.Millisecond*10)
+
+		// Dialing while disconnected waits for the upstream to resume.
+		dialed := make(chan error, 1)
+		go func() {
+			conn, err := upstream.Dial()
+			if err == nil {
+				conn.Close()
+			}
+			dialed <- err
+		}()
+
+		sess = dial(t, url, "my-session")
+		defer sess.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		_, err := sess.AcceptStreamWithContext(ctx)
+		require.NoError(t, err)
+		assert.NoError(t, <-dialed)
+
+		// The upstream resumed so isn't removed or re-added.
+		select {
+		case <-manager.addConnCh:
+			t.Fatal("upstream re-added")
+		case <-manager.removeConnCh:
+			t.Fatal("upstream removed")
+		case <-time.After(time.Millisecond * 100):
+		}
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		manager, url := newServer(t, time.Minute)
+
+		conn, err := websocket.Dial(
+			context.TODO(),
+			url,
+			websocket.WithHeader(protocol.Headers{}.SessionID(), "my-session"),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		<-manager.addConnCh
+
+		// Resuming the session before the server detects the existing
+		// connection closed evicts the existing connection.
+		sess := dial(t, url, "my-session")
+		defer sess.Close()
+
+		err = readUntilError(conn)
+		assert.Equal(t, websocket.CloseEvicted, websocket.CloseCodeOf(err))
+	})
+
+	t.Run("expire", func(t *testing.T) {
+		manager, url := newServer(t, time.Millisecond*100)
+
+		sess := dial(t, url, "my-session")
+		upstream := <-manager.addConnCh
+
+		sess.Close()
+
+		removedUpstream := <-manager.removeConnCh
+		assert.Equal(t, upstream, removedUpstream)
+
+		_, err := upstream.Dial()
+		assert.ErrorIs(t, err, errSessionExpired)
+	})
+
+	t.Run("session id too long", func(t *testing.T) {
+		_, url := newServer(t, time.Minute)
+
+		_, err := websocket.Dial(
+			context.TODO(),
+			url,
+			websocket.WithHeader(
+				protocol.Headers{}.SessionID(),
+				strings.Repeat("a", protocol.MaxSessionIDLength+1),
+			),
+		)
+		assert.ErrorContains(t, err, "session id too long")
+	})
+
+	t.Run("different session", func(t *testing.T) {
+		manager, url := newServer(t, time.Minute)
+
+		sess := dial(t, url, "my-session")
+		defer sess.Close()
+		<-manager.addConnCh
+
+		sess2 := dial(t, url, "other-session")
+		defer sess2.Close()
+		<-manager.addConnCh
+	})
+}
+
+func TestServer_StreamLimit(t *testing.T) {
+	newServer := func(t *testing.T, opts ...Option) (*fakeManager, string) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+		s := NewServer(manager, nil, nil, log.NewNopLogger(), opts...)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		t.Cleanup(func() {
+			go func() {
+				// Drain any removed upstreams on shutdown.
+				for range manager.removeConnCh {
+				}
+			}()
+			s.Shutdown(context.TODO())
+		})
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+		return manager, url
+	}
+
+	dial := func(t *testing.T, url string, opts ...websocket.DialOption) *yamux.Session {
+		conn, err := websocket.Dial(context.TODO(), url, opts...)
+		require.NoError(t, err)
+
+		muxConfig := protocol.MuxConfig()
+		muxConfig.LogOutput = io.Discard
+		sess, err := yamux.Client(conn, muxConfig)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			sess.Close()
+		})
+		return sess
+	}
+
+	t.Run("rejected", func(t *testing.T) {
+		manager, url := newServer(t, WithStreamLimit(2, 0))
+
+		dial(t, url)
+		upstream := <-manager.addConnCh
+
+		conn1, err := upstream.Dial()
+		require.NoError(t, err)
+		conn2, err := upstream.Dial()
+		require.NoError(t, err)
+		assert.True(t, upstream.(*ConnUpstream).Saturated())
+
+		_, err = upstream.Dial()
+		assert.ErrorIs(t, err, ErrStreamLimit)
+
+		// Closing a stream frees capacity.
+		conn1.Close()
+		assert.False(t, upstream.(*ConnUpstream).Saturated())
+		conn3, err := upstream.Dial()
+		require.NoError(t, err)
+
+		conn2.Close()
+		conn3.Close()
+	})
+
+	t.Run("queued", func(t *testing.T) {
+		manager, url := newServer(t, WithStreamLimit(1, time.Second*5))
+
+		dial(t, url)
+		upstream := <-manager.addConnCh
+
+		conn1, err := upstream.Dial()
+		require.NoError(t, err)
+
+		dialed := make(chan error, 1)
+		go func() {
+			conn, err := upstream.Dial()
+			if err == nil {
+				conn.Close()
+			}
+			dialed <- err
+		}()
+
+		select {
+		case <-dialed:
+			t.Fatal("dial not queued")
+		case <-time.After(time.Millisecond * 100):
+		}
+
+		conn1.Close()
+		assert.NoError(t, <-dialed)
+	})
+
+	t.Run("queue timeout", func(t *testing.T) {
+		manager, url := newServer(t, WithStreamLimit(1, time.Millisecond*10))
+
+		dial(t, url)
+		upstream := <-manager.addConnCh
+
+		conn, err := upstream.Dial()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = upstream.Dial()
+		assert.ErrorIs(t, err, ErrStreamLimit)
+	})
+
+	t.Run("agent limit", func(t *testing.T) {
+		manager, url := newServer(t, WithStreamLimit(10, 0))
+
+		// The agent limit is lower than the server limit so is used.
+		dial(t, url, websocket.WithHeader(protocol.Headers{}.MaxStreams(), "1"))
+		upstream := <-manager.addConnCh
+
+		conn, err := upstream.Dial()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = upstream.Dial()
+		assert.ErrorIs(t, err, ErrStreamLimit)
+	})
+
+	t.Run("agent limit without server limit", func(t *testing.T) {
+		manager, url := newServer(t)
+
+		dial(t, url, websocket.WithHeader(protocol.Headers{}.MaxStreams(), "1"))
+		upstream := <-manager.addConnCh
+
+		conn, err := upstream.Dial()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = upstream.Dial()
+		assert.ErrorIs(t, err, ErrStreamLimit)
+	})
+
+	t.Run("invalid agent limit", func(t *testing.T) {
+		_, url := newServer(t)
+
+		_, err := websocket.Dial(
+			context.TODO(),
+			url,
+			websocket.WithHeader(protocol.Headers{}.MaxStreams(), "-1"),
+		)
+		assert.ErrorContains(t, err, "invalid max streams")
+	})
+}
+
+func TestServer_MessageSize(t *testing.T) {
+	newServer := func(t *testing.T) (*fakeManager, string) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+		s := NewServer(manager, nil, nil, log.NewNopLogger())
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		t.Cleanup(func() {
+			go func() {
+				// Drain any removed upstreams on shutdown.
+				for range manager.removeConnCh {
+				}
+			}()
+			s.Shutdown(context.TODO())
+		})
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+		return manager, url
+	}
+
+	t.Run("agent message size", func(t *testing.T) {
+		manager, url := newServer(t)
+
+		// Read the raw WebSocket messages to check their size.
+		header := make(http.Header)
+		header.Set(protocol.Headers{}.MaxMessageSize(), "1024")
+		wsConn, _, err := gorillawebsocket.DefaultDialer.Dial(url, header)
+		require.NoError(t, err)
+		defer wsConn.Close()
+		upstream := <-manager.addConnCh
+
+		conn, err := upstream.Dial()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write(make([]byte, 4096))
+		require.NoError(t, err)
+
+		var received int
+		for received < 4096+protocol.HeaderSize {
+			_, b, err := wsConn.ReadMessage()
+			require.NoError(t, err)
+			assert.LessOrEqual(t, len(b), 1024)
+			received += len(b)
+		}
+	})
+
+	t.Run("invalid agent message size", func(t *testing.T) {
+		_, url := newServer(t)
+
+		_, err := websocket.Dial(
+			context.TODO(),
+			url,
+			websocket.WithHeader(protocol.Headers{}.MaxMessageSize(), "100"),
+		)
+		assert.ErrorContains(t, err, "invalid max message size")
+	})
+}
+
+func TestServer_ConnLimit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	manager := newFakeManager()
+
+	connLimiter := NewConnLimiter(2, 1, 0)
+	s := NewServer(
+		manager, nil, nil, log.NewNopLogger(), WithConnLimiter(connLimiter),
+	)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	dial := func(endpointID string) (*websocket.Conn, error) {
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/%s",
+			ln.Addr().String(), endpointID,
+		)
+		return websocket.Dial(context.TODO(), url)
+	}
+
+	conn1, err := dial("endpoint-1")
+	require.NoError(t, err)
+	defer conn1.Close()
+	<-manager.addConnCh
+
+	// The endpoint has reached its limit.
+	_, err = dial("endpoint-1")
+	var protocolErr *protocol.Error
+	require.ErrorAs(t, err, &protocolErr)
+	assert.Equal(t, http.StatusTooManyRequests, protocolErr.StatusCode)
+	assert.Equal(t, protocol.ErrorCodeEndpointConnLimit, protocolErr.Code)
+
+	conn2, err := dial("endpoint-2")
+	require.NoError(t, err)
+	<-manager.addConnCh
+
+	// The node has reached its limit.
+	_, err = dial("endpoint-3")
+	require.ErrorAs(t, err, &protocolErr)
+	assert.Equal(t, protocol.ErrorCodeConnLimit, protocolErr.Code)
+
+	assert.Equal(t, 1.0, promtestutil.ToFloat64(
+		connLimiter.Metrics().RejectedTotal.WithLabelValues("endpoint"),
+	))
+	assert.Equal(t, 1.0, promtestutil.ToFloat64(
+		connLimiter.Metrics().RejectedTotal.WithLabelValues("node"),
+	))
+
+	// Once a connection closes, another upstream can connect.
+	conn2.Close()
+	<-manager.removeConnCh
+	assert.Eventually(t, func() bool {
+		conn3, err := dial("endpoint-3")
+		if err != nil {
+			return false
+		}
+		<-manager.addConnCh
+		conn3.Close()
+		<-manager.removeConnCh
+		return true
+	}, time.Second, time.Millisecond*10)
+}
+
+// Tests a multiplexed connection reserves a single connection of the node
+// limit, but a connection for each endpoint.
+func TestServer_ConnLimitMultiplexed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	manager := newFakeManager()
+
+	connLimiter := NewConnLimiter(2, 1, 0)
+	s := NewServer(
+		manager, nil, nil, log.NewNopLogger(), WithConnLimiter(connLimiter),
+	)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	dial := func(endpointID string) (*websocket.Conn, error) {
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/%s",
+			ln.Addr().String(), endpointID,
+		)
+		return websocket.Dial(context.TODO(), url)
+	}
+
+	muxConn, err := websocket.Dial(
+		context.TODO(),
+		fmt.Sprintf("ws://%s/piko/v1/upstream", ln.Addr().String()),
+		websocket.WithHeader("x-piko-endpoints", "endpoint-1,endpoint-2,endpoint-3"),
+	)
+	require.NoError(t, err)
+	defer muxConn.Close()
+	for i := 0; i != 3; i++ {
+		<-manager.addConnCh
+	}
+
+	// Each endpoint of the multiplexed connection has reached its limit.
+	_, err = dial("endpoint-2")
+	var protocolErr *protocol.Error
+	require.ErrorAs(t, err, &protocolErr)
+	assert.Equal(t, protocol.ErrorCodeEndpointConnLimit, protocolErr.Code)
+
+	// The multiplexed connection only counts as one connection of the node
+	// limit.
+	conn, err := dial("endpoint-4")
+	require.NoError(t, err)
+	defer conn.Close()
+	<-manager.addConnCh
+
+	_, err = dial("endpoint-5")
+	require.ErrorAs(t, err, &protocolErr)
+	assert.Equal(t, protocol.ErrorCodeConnLimit, protocolErr.Code)
+}
+
+func TestServer_Multiplexed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	manager := newFakeManager()
+
+	s := NewServer(manager, nil, nil, log.NewNopLogger())
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	url := fmt.Sprintf("ws://%s/piko/v1/upstream", ln.Addr().String())
+
+	t.Run("ok", func(t *testing.T) {
+		conn, err := websocket.Dial(
+			context.TODO(), url,
+			websocket.WithHeader("x-piko-endpoints", "endpoint-1,endpoint-2"),
+		)
+		require.NoError(t, err)
+
+		muxConfig := protocol.MuxConfig()
+		muxConfig.LogOutput = io.Discard
+		sess, err := yamux.Client(conn, muxConfig)
+		require.NoError(t, err)
+		defer sess.Close()
+
+		// The connection is registered for each endpoint.
+		upstreams := make(map[string]Upstream)
+		for i := 0; i != 2; i++ {
+			upstream := <-manager.addConnCh
+			upstreams[upstream.EndpointID()] = upstream
+		}
+		require.Contains(t, upstreams, "endpoint-1")
+		require.Contains(t, upstreams, "endpoint-2")
+
+		// Each stream starts with the endpoint ID.
+		for _, endpointID := range []string{"endpoint-1", "endpoint-2"} {
+			upstreamConn, err := upstreams[endpointID].Dial()
+			require.NoError(t, err)
+
+			stream, err := sess.AcceptStream()
+			require.NoError(t, err)
+			streamEndpointID, err := protocol.ReadStreamEndpoint(stream)
+			require.NoError(t, err)
+			assert.Equal(t, endpointID, streamEndpointID)
+
+			upstreamConn.Close()
+			stream.Close()
+		}
+
+		sess.Close()
+		for i := 0; i != 2; i++ {
+			<-manager.removeConnCh
+		}
+	})
+
+	t.Run("invalid endpoints", func(t *testing.T) {
+		_, err := websocket.Dial(
+			context.TODO(), url,
+			websocket.WithHeader("x-piko-endpoints", "endpoint-1,endpoint-1"),
+		)
+		assert.ErrorContains(
+			t, err, "400: invalid endpoints: duplicate endpoint: endpoint-1",
+		)
+	})
+}
+
+func TestServer_Drain(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	manager := newFakeManager()
+
+	s := NewServer(manager, nil, nil, log.NewNopLogger())
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+
+	url := fmt.Sprintf("ws://%s/piko/v1/upstream/my-endpoint", ln.Addr().String())
+	conn, err := websocket.Dial(context.TODO(), url)
+	require.NoError(t, err)
+
+	drainCh := make(chan struct{}, 1)
+	conn.OnDrain(func() {
+		drainCh <- struct{}{}
+	})
+
+	muxConfig := protocol.MuxConfig()
+	muxConfig.LogOutput = io.Discard
+	sess, err := yamux.Client(conn, muxConfig)
+	require.NoError(t, err)
+	defer sess.Close()
+
+	upstream := <-manager.addConnCh
+
+	// Open an in-flight stream.
+	upstreamConn, err := upstream.Dial()
+	require.NoError(t, err)
+	stream, err := sess.AcceptStream()
+	require.NoError(t, err)
+
+	shutdownCh := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		shutdownCh <- s.Shutdown(ctx)
+	}()
+
+	// The upstream is removed so it isn't sent new requests, then notified
+	// of the drain.
+	assert.Equal(t, upstream, <-manager.removeConnCh)
+	<-drainCh
+
+	// Shutdown waits for the in-flight stream.
+	select {
+	case <-shutdownCh:
+		t.Fatal("shutdown before in-flight stream closed")
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	upstreamConn.Close()
+	stream.Close()
+
+	assert.NoError(t, <-shutdownCh)
+
+	// The connection is closed once drained.
+	select {
+	case <-sess.CloseChan():
+	case <-time.After(time.Second * 5):
+		t.Fatal("session not closed")
+	}
+}
+
+func TestServer_Namespace(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	manager := newFakeManager()
+
+	s := NewServer(
+		manager, nil, nil, log.NewNopLogger(),
+		WithConnLimiter(NewConnLimiter(0, 0, 1)),
+	)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	dial := func(endpointID string) (*websocket.Conn, error) {
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/%s",
+			ln.Addr().String(), endpointID,
+		)
+		return websocket.Dial(context.TODO(), url)
+	}
+
+	t.Run("wildcard", func(t *testing.T) {
+		conn, err := dial("team-a/*")
+		require.NoError(t, err)
+		defer conn.Close()
+
+		upstream := <-manager.addConnCh
+		assert.Equal(t, "team-a/*", upstream.EndpointID())
+
+		// The namespace has reached its limit.
+		_, err = dial("team-a/service-b")
+		var protocolErr *protocol.Error
+		require.ErrorAs(t, err, &protocolErr)
+		assert.Equal(t, protocol.ErrorCodeNamespaceConnLimit, protocolErr.Code)
+
+		// Other namespaces aren't affected.
+		conn2, err := dial("team-b/service-b")
+		require.NoError(t, err)
+		assert.Equal(t, "team-b/service-b", (<-manager.addConnCh).EndpointID())
+		conn2.Close()
+		<-manager.removeConnCh
+	})
+
+	t.Run("invalid endpoint id", func(t *testing.T) {
+		_, err := dial("team-a/*/service-b")
+		assert.ErrorContains(t, err, "400: invalid endpoint id")
+	})
+}
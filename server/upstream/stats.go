@@ -0,0 +1,299 @@
+package upstream
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	pikowebsocket "github.com/andydunstall/piko/pkg/websocket"
+)
+
+const (
+	// stallThreshold is the duration a write to an upstream stream must
+	// block for to be counted as a stall. Writes typically only block for
+	// this long when the stream send window is exhausted, meaning the
+	// upstream isn't consuming data quickly enough.
+	stallThreshold = time.Millisecond * 100
+
+	// statsPingInterval is the interval between pings to measure the
+	// upstream link latency, jitter and loss.
+	statsPingInterval = time.Second * 10
+
+	// linkLossWindow is the number of recent pings the link loss is
+	// computed over.
+	linkLossWindow = 30
+)
+
+// SessionStats contains multiplexer statistics for an upstream session.
+type SessionStats struct {
+	EndpointID  string    `json:"endpoint_id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+
+	// OpenStreams is the number of streams currently open.
+	OpenStreams int `json:"open_streams"`
+	// StreamsOpened is the number of streams opened since the session
+	// connected.
+	StreamsOpened uint64 `json:"streams_opened"`
+	// StreamsClosed is the number of streams closed since the session
+	// connected.
+	StreamsClosed uint64 `json:"streams_closed"`
+	// WriteStalls is the number of stream writes that blocked waiting for
+	// the upstream to consume data.
+	WriteStalls uint64 `json:"write_stalls"`
+	// BytesSent is the number of bytes written to streams to the upstream.
+	BytesSent uint64 `json:"bytes_sent"`
+	// BytesReceived is the number of bytes read from streams from the
+	// upstream.
+	BytesReceived uint64 `json:"bytes_received"`
+
+	// RTT is the round trip time of the last successful ping.
+	RTT string `json:"rtt,omitempty"`
+	// PingsSent is the number of pings sent to measure the RTT.
+	PingsSent uint64 `json:"pings_sent"`
+	// PingsFailed is the number of pings that failed or timed out.
+	PingsFailed uint64 `json:"pings_failed"`
+
+	// Latency is the smoothed RTT of recent pings.
+	Latency string `json:"latency,omitempty"`
+	// Jitter is the smoothed variation between consecutive ping RTTs.
+	Jitter string `json:"jitter,omitempty"`
+	// Loss is the ratio of recent pings that failed or timed out.
+	Loss float64 `json:"loss"`
+}
+
+// Fields returns the stats as log fields.
+func (s *SessionStats) Fields() []zap.Field {
+	return []zap.Field{
+		zap.String("endpoint-id", s.EndpointID),
+		zap.String("remote-addr", s.RemoteAddr),
+		zap.Int("open-streams", s.OpenStreams),
+		zap.Uint64("streams-opened", s.StreamsOpened),
+		zap.Uint64("streams-closed", s.StreamsClosed),
+		zap.Uint64("write-stalls", s.WriteStalls),
+		zap.Uint64("bytes-sent", s.BytesSent),
+		zap.Uint64("bytes-received", s.BytesReceived),
+		zap.String("rtt", s.RTT),
+		zap.Uint64("pings-sent", s.PingsSent),
+		zap.Uint64("pings-failed", s.PingsFailed),
+		zap.String("latency", s.Latency),
+		zap.String("jitter", s.Jitter),
+		zap.Float64("loss", s.Loss),
+	}
+}
+
+type sessionStats struct {
+	connectedAt *atomic.Time
+
+	streamsOpened *atomic.Uint64
+	streamsClosed *atomic.Uint64
+	writeStalls   *atomic.Uint64
+	bytesSent     *atomic.Uint64
+	bytesReceived *atomic.Uint64
+
+	rtt         *atomic.Duration
+	pingsSent   *atomic.Uint64
+	pingsFailed *atomic.Uint64
+
+	link *linkStats
+}
+
+func newSessionStats() *sessionStats {
+	return &sessionStats{
+		connectedAt:   atomic.NewTime(time.Now()),
+		streamsOpened: atomic.NewUint64(0),
+		streamsClosed: atomic.NewUint64(0),
+		writeStalls:   atomic.NewUint64(0),
+		bytesSent:     atomic.NewUint64(0),
+		bytesReceived: atomic.NewUint64(0),
+		rtt:           atomic.NewDuration(0),
+		pingsSent:     atomic.NewUint64(0),
+		pingsFailed:   atomic.NewUint64(0),
+		link:          &linkStats{},
+	}
+}
+
+// SessionSummary summarises an upstream connection once it closes.
+//
+// If the upstream resumes a session, the summary only includes the
+// connection, not the session before it resumed.
+type SessionSummary struct {
+	EndpointID string
+	RemoteAddr string
+
+	Duration time.Duration
+
+	// StreamsServed is the number of streams opened to the upstream.
+	StreamsServed uint64
+	BytesSent     uint64
+	BytesReceived uint64
+
+	// CloseCode is the close code describing why the connection closed.
+	CloseCode pikowebsocket.CloseCode
+	// Error is the error that closed the connection, if it wasn't closed
+	// deliberately.
+	Error string
+}
+
+// newSessionSummary returns the summary of a connection with the stats
+// when the connection opened and closed.
+func newSessionSummary(
+	start *SessionStats,
+	end *SessionStats,
+	duration time.Duration,
+	code pikowebsocket.CloseCode,
+	err error,
+) *SessionSummary {
+	summary := &SessionSummary{
+		EndpointID:    end.EndpointID,
+		RemoteAddr:    start.RemoteAddr,
+		Duration:      duration,
+		StreamsServed: end.StreamsOpened - start.StreamsOpened,
+		BytesSent:     end.BytesSent - start.BytesSent,
+		BytesReceived: end.BytesReceived - start.BytesReceived,
+		CloseCode:     code,
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	return summary
+}
+
+// Fields returns the summary as log fields.
+func (s *SessionSummary) Fields() []zap.Field {
+	fields := []zap.Field{
+		zap.String("endpoint-id", s.EndpointID),
+		zap.String("remote-addr", s.RemoteAddr),
+		zap.Duration("duration", s.Duration),
+		zap.Uint64("streams-served", s.StreamsServed),
+		zap.Uint64("bytes-sent", s.BytesSent),
+		zap.Uint64("bytes-received", s.BytesReceived),
+		zap.String("reason", s.CloseCode.String()),
+		zap.Int("close-code", int(s.CloseCode)),
+	}
+	if s.Error != "" {
+		fields = append(fields, zap.String("error", s.Error))
+	}
+	return fields
+}
+
+// LinkStats contains estimates of the quality of the link to an upstream.
+type LinkStats struct {
+	Latency time.Duration
+	Jitter  time.Duration
+	Loss    float64
+}
+
+// linkStats estimates the upstream link latency, jitter and loss from ping
+// results.
+//
+// Latency is the smoothed RTT as computed by TCP (RFC 6298), and jitter is
+// the smoothed difference between consecutive RTTs as computed by RTP
+// (RFC 3550). Loss is the ratio of failed pings over the last
+// 'linkLossWindow' pings.
+type linkStats struct {
+	latency time.Duration
+	jitter  time.Duration
+	lastRTT time.Duration
+
+	// results contains whether each of the recent pings failed.
+	results [linkLossWindow]bool
+	// n is the total number of pings.
+	n        int
+	failures int
+
+	mu sync.Mutex
+}
+
+func (s *linkStats) Observe(rtt time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.n % linkLossWindow
+	if s.n >= linkLossWindow && s.results[i] {
+		s.failures--
+	}
+	s.results[i] = failed
+	if failed {
+		s.failures++
+	}
+	s.n++
+
+	if failed {
+		return
+	}
+
+	if s.lastRTT == 0 {
+		s.latency = rtt
+	} else {
+		s.latency += (rtt - s.latency) / 8
+
+		d := rtt - s.lastRTT
+		if d < 0 {
+			d = -d
+		}
+		s.jitter += (d - s.jitter) / 16
+	}
+	s.lastRTT = rtt
+}
+
+func (s *linkStats) Stats() LinkStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := LinkStats{
+		Latency: s.latency,
+		Jitter:  s.jitter,
+	}
+	if s.n > 0 {
+		stats.Loss = float64(s.failures) / float64(min(s.n, linkLossWindow))
+	}
+	return stats
+}
+
+// statsConn is a stream that records stream statistics.
+type statsConn struct {
+	net.Conn
+
+	stats *sessionStats
+	// onClose is called once when the stream is closed, if set.
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func newStatsConn(conn net.Conn, stats *sessionStats) *statsConn {
+	stats.streamsOpened.Inc()
+	return &statsConn{
+		Conn:  conn,
+		stats: stats,
+	}
+}
+
+func (c *statsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.bytesReceived.Add(uint64(n))
+	return n, err
+}
+
+func (c *statsConn) Write(b []byte) (int, error) {
+	start := time.Now()
+	n, err := c.Conn.Write(b)
+	if time.Since(start) > stallThreshold {
+		c.stats.writeStalls.Inc()
+	}
+	c.stats.bytesSent.Add(uint64(n))
+	return n, err
+}
+
+func (c *statsConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stats.streamsClosed.Inc()
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,136 @@
+package upstream
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/yamux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/protocol"
+	pikowebsocket "github.com/andydunstall/piko/pkg/websocket"
+)
+
+func TestConnUpstream_Stats(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+
+	muxConfig := protocol.MuxConfig()
+	muxConfig.LogOutput = io.Discard
+
+	serverSess, err := yamux.Server(serverConn, muxConfig)
+	require.NoError(t, err)
+	defer serverSess.Close()
+	clientSess, err := yamux.Client(clientConn, muxConfig)
+	require.NoError(t, err)
+	defer clientSess.Close()
+
+	upstream := NewConnUpstream("my-endpoint", serverSess)
+
+	conn, err := upstream.Dial()
+	require.NoError(t, err)
+
+	stream, err := clientSess.AcceptStream()
+	require.NoError(t, err)
+
+	// Write more than the stream window without the client reading, so the
+	// write stalls.
+	go func() {
+		time.Sleep(stallThreshold * 2)
+		// nolint
+		io.Copy(io.Discard, stream)
+	}()
+	_, err = conn.Write(make([]byte, protocol.InitialStreamWindow*2))
+	require.NoError(t, err)
+
+	stats := upstream.Stats()
+	assert.Equal(t, "my-endpoint", stats.EndpointID)
+	assert.Equal(t, 1, stats.OpenStreams)
+	assert.Equal(t, uint64(1), stats.StreamsOpened)
+	assert.Equal(t, uint64(0), stats.StreamsClosed)
+	assert.Equal(t, uint64(1), stats.WriteStalls)
+	assert.Equal(t, uint64(protocol.InitialStreamWindow*2), stats.BytesSent)
+
+	go func() {
+		// nolint
+		stream.Write([]byte("foo"))
+	}()
+	_, err = io.ReadFull(conn, make([]byte, 3))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), upstream.Stats().BytesReceived)
+
+	// Closing multiple times only counts a single close.
+	conn.Close()
+	conn.Close()
+
+	_, err = upstream.Ping()
+	require.NoError(t, err)
+
+	stats = upstream.Stats()
+	assert.Equal(t, uint64(1), stats.StreamsClosed)
+	assert.Equal(t, uint64(1), stats.PingsSent)
+	assert.Equal(t, uint64(0), stats.PingsFailed)
+	assert.NotEmpty(t, stats.RTT)
+	assert.NotEmpty(t, stats.Latency)
+	assert.Equal(t, 0.0, stats.Loss)
+}
+
+func TestSessionSummary(t *testing.T) {
+	start := &SessionStats{
+		EndpointID:    "my-endpoint",
+		RemoteAddr:    "10.26.104.56:1234",
+		StreamsOpened: 5,
+		BytesSent:     100,
+		BytesReceived: 200,
+	}
+	end := &SessionStats{
+		EndpointID:    "my-endpoint",
+		StreamsOpened: 8,
+		BytesSent:     150,
+		BytesReceived: 500,
+	}
+
+	// The summary only includes the stats since the connection opened.
+	summary := newSessionSummary(
+		start, end, time.Minute, pikowebsocket.CloseAbnormal, io.ErrUnexpectedEOF,
+	)
+	assert.Equal(t, &SessionSummary{
+		EndpointID:    "my-endpoint",
+		RemoteAddr:    "10.26.104.56:1234",
+		Duration:      time.Minute,
+		StreamsServed: 3,
+		BytesSent:     50,
+		BytesReceived: 300,
+		CloseCode:     pikowebsocket.CloseAbnormal,
+		Error:         "unexpected EOF",
+	}, summary)
+}
+
+func TestLinkStats(t *testing.T) {
+	var link linkStats
+
+	link.Observe(time.Millisecond*100, false)
+	assert.Equal(t, LinkStats{Latency: time.Millisecond * 100}, link.Stats())
+
+	// Latency moves 1/8 towards the new RTT and jitter 1/16 towards the RTT
+	// difference.
+	link.Observe(time.Millisecond*180, false)
+	stats := link.Stats()
+	assert.Equal(t, time.Millisecond*110, stats.Latency)
+	assert.Equal(t, time.Millisecond*5, stats.Jitter)
+	assert.Equal(t, 0.0, stats.Loss)
+
+	// Failures don't affect latency.
+	link.Observe(0, true)
+	stats = link.Stats()
+	assert.Equal(t, time.Millisecond*110, stats.Latency)
+	assert.InDelta(t, 1.0/3.0, stats.Loss, 0.0001)
+
+	// Loss is computed over the recent window.
+	for i := 0; i != linkLossWindow; i++ {
+		link.Observe(time.Millisecond*110, false)
+	}
+	assert.Equal(t, 0.0, link.Stats().Loss)
+}
@@ -20,6 +20,7 @@ func NewStatus(manager *LoadBalancedManager) *Status {
 
 func (s *Status) Register(group *gin.RouterGroup) {
 	group.GET("/endpoints", s.listEndpointsRoute)
+	group.GET("/sessions", s.listSessionsRoute)
 }
 
 func (s *Status) listEndpointsRoute(c *gin.Context) {
@@ -27,4 +28,11 @@ func (s *Status) listEndpointsRoute(c *gin.Context) {
 	c.JSON(http.StatusOK, endpoints)
 }
 
+// listSessionsRoute lists the multiplexer statistics of each connected
+// upstream session, optionally filtered by 'endpoint'.
+func (s *Status) listSessionsRoute(c *gin.Context) {
+	sessions := s.manager.Sessions(c.Query("endpoint"))
+	c.JSON(http.StatusOK, sessions)
+}
+
 var _ status.Handler = &Status{}
@@ -0,0 +1,87 @@
+package upstream
+
+import (
+	"container/list"
+	"time"
+)
+
+const (
+	// tombstoneTTL is how long the node remembers an endpoint after its last
+	// upstream disconnects.
+	tombstoneTTL = 5 * time.Minute
+
+	// maxTombstones is the maximum number of disconnected endpoints
+	// remembered, after which the least recently disconnected endpoints are
+	// forgotten.
+	maxTombstones = 10000
+)
+
+type tombstone struct {
+	endpointID string
+	lastSeen   time.Time
+}
+
+// tombstones is an LRU of endpoints whose last local upstream recently
+// disconnected, so requests for the endpoint can report when it was last
+// seen rather than a generic error.
+//
+// tombstones isn't thread safe.
+type tombstones struct {
+	entries map[string]*list.Element
+	// order contains the most recently disconnected endpoints first.
+	order *list.List
+
+	ttl     time.Duration
+	maxSize int
+}
+
+func newTombstones(ttl time.Duration, maxSize int) *tombstones {
+	return &tombstones{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		ttl:     ttl,
+		maxSize: maxSize,
+	}
+}
+
+// Add records the endpoint was last seen at the given time.
+func (t *tombstones) Add(endpointID string, lastSeen time.Time) {
+	t.Remove(endpointID)
+
+	t.entries[endpointID] = t.order.PushFront(&tombstone{
+		endpointID: endpointID,
+		lastSeen:   lastSeen,
+	})
+
+	for t.order.Len() > t.maxSize {
+		t.remove(t.order.Back())
+	}
+}
+
+// Remove removes the tombstone for the endpoint, such as when an upstream
+// reconnects.
+func (t *tombstones) Remove(endpointID string) {
+	if e, ok := t.entries[endpointID]; ok {
+		t.remove(e)
+	}
+}
+
+// LastSeen returns when the endpoint was last seen, or false if the endpoint
+// has no tombstone or the tombstone has expired.
+func (t *tombstones) LastSeen(endpointID string, now time.Time) (time.Time, bool) {
+	e, ok := t.entries[endpointID]
+	if !ok {
+		return time.Time{}, false
+	}
+	lastSeen := e.Value.(*tombstone).lastSeen
+	if now.Sub(lastSeen) > t.ttl {
+		t.remove(e)
+		return time.Time{}, false
+	}
+	return lastSeen, true
+}
+
+func (t *tombstones) remove(e *list.Element) {
+	t.order.Remove(e)
+	delete(t.entries, e.Value.(*tombstone).endpointID)
+}
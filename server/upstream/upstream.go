@@ -1,10 +1,18 @@
 package upstream
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/andydunstall/yamux"
+	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/andydunstall/piko/pkg/protocol"
 	"github.com/andydunstall/piko/server/cluster"
 )
 
@@ -13,6 +21,8 @@ import (
 // An upstream may be an upstream service connected to the local node, or
 // another Piko server node.
 type Upstream interface {
+	// ID identifies the upstream in logs and error responses.
+	ID() string
 	EndpointID() string
 	Dial() (net.Conn, error)
 	// Forward indicates whether the upstream is forwarding traffic to a remote
@@ -20,53 +30,396 @@ type Upstream interface {
 	Forward() bool
 }
 
+var (
+	errSessionExpired      = errors.New("upstream session expired")
+	errSessionDisconnected = errors.New("upstream session disconnected")
+)
+
 // ConnUpstream represents a connection to an upstream service thats connected
 // to the local node.
+//
+// If the upstream has a session ID, it may be temporarily disconnected while
+// waiting for the upstream to reconnect and resume the session. While
+// disconnected, Dial waits for the upstream to resume or the session to
+// expire.
 type ConnUpstream struct {
+	// id is a random ID assigned to the upstream, which unlike the session
+	// ID isn't secret so can be included in responses.
+	id         string
 	endpointID string
-	sess       *yamux.Session
+	sessionID  string
+
+	// gracePeriod is the maximum duration to wait for a disconnected
+	// upstream to resume.
+	gracePeriod time.Duration
+
+	sess *yamux.Session
+	// resumeCh is non-nil while the upstream is disconnected, and is closed
+	// when the upstream resumes or the session expires.
+	resumeCh chan struct{}
+	expired  bool
+	mu       sync.Mutex
+
+	stats *sessionStats
+
+	// limiter is nil if the upstream has no stream limit.
+	limiter *streamLimiter
+
+	// multiplexed indicates the session is shared by multiple endpoints, so
+	// each stream starts with a stream header containing the endpoint ID.
+	multiplexed bool
 }
 
 func NewConnUpstream(endpointID string, sess *yamux.Session) *ConnUpstream {
 	return &ConnUpstream{
+		id:         newConnectionID(),
 		endpointID: endpointID,
 		sess:       sess,
+		stats:      newSessionStats(),
 	}
 }
 
+// ID returns the connection ID of the upstream, which is kept when the
+// upstream resumes its session.
+func (u *ConnUpstream) ID() string {
+	return u.id
+}
+
 func (u *ConnUpstream) EndpointID() string {
 	return u.endpointID
 }
 
 func (u *ConnUpstream) Dial() (net.Conn, error) {
-	return u.sess.OpenStream()
+	if u.limiter != nil {
+		if err := u.limiter.Acquire(); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		sess, err := u.session()
+		if err != nil {
+			u.release()
+			return nil, err
+		}
+		stream, err := sess.OpenStream()
+		if err == nil {
+			if u.multiplexed {
+				if err := protocol.WriteStreamEndpoint(stream, u.endpointID); err != nil {
+					stream.Close()
+					u.release()
+					return nil, err
+				}
+			}
+			conn := newStatsConn(stream, u.stats)
+			conn.onClose = u.release
+			return conn, nil
+		}
+		if u.sessionID == "" ||
+			(!sess.IsClosed() && !errors.Is(err, yamux.ErrRemoteGoAway)) {
+			u.release()
+			return nil, err
+		}
+
+		// The session closed or is closing but the server may not yet have
+		// detected the disconnect, so mark the upstream as disconnected and
+		// wait for it to resume.
+		u.disconnectSession(sess)
+	}
+}
+
+// Saturated returns whether the upstream has reached its stream limit.
+func (u *ConnUpstream) Saturated() bool {
+	return u.limiter != nil && u.limiter.Saturated()
+}
+
+// OpenStreams returns the number of streams open on the upstream
+// connection.
+func (u *ConnUpstream) OpenStreams() int {
+	return u.currentSession().NumStreams()
+}
+
+// Ping sends a ping to the upstream to measure the RTT.
+func (u *ConnUpstream) Ping() (time.Duration, error) {
+	rtt, err := u.currentSession().Ping()
+	u.observePing(rtt, err)
+	if err != nil {
+		return 0, err
+	}
+	return rtt, nil
+}
+
+// observePing records the result of a ping to the upstream session. Since
+// the endpoints of a multiplexed connection share a session, a single ping
+// is recorded by each endpoint's upstream.
+func (u *ConnUpstream) observePing(rtt time.Duration, err error) {
+	u.stats.pingsSent.Inc()
+	if err != nil {
+		u.stats.pingsFailed.Inc()
+		u.stats.link.Observe(0, true)
+		return
+	}
+	u.stats.rtt.Store(rtt)
+	u.stats.link.Observe(rtt, false)
+}
+
+// Stats returns the upstream session multiplexer statistics.
+func (u *ConnUpstream) Stats() *SessionStats {
+	sess := u.currentSession()
+	stats := &SessionStats{
+		EndpointID:    u.endpointID,
+		ConnectedAt:   u.stats.connectedAt.Load(),
+		OpenStreams:   sess.NumStreams(),
+		StreamsOpened: u.stats.streamsOpened.Load(),
+		StreamsClosed: u.stats.streamsClosed.Load(),
+		WriteStalls:   u.stats.writeStalls.Load(),
+		BytesSent:     u.stats.bytesSent.Load(),
+		BytesReceived: u.stats.bytesReceived.Load(),
+		PingsSent:     u.stats.pingsSent.Load(),
+		PingsFailed:   u.stats.pingsFailed.Load(),
+	}
+	if addr := sess.RemoteAddr(); addr != nil {
+		stats.RemoteAddr = addr.String()
+	}
+	if rtt := u.stats.rtt.Load(); rtt != 0 {
+		stats.RTT = rtt.String()
+	}
+	link := u.LinkStats()
+	if link.Latency != 0 {
+		stats.Latency = link.Latency.String()
+		stats.Jitter = link.Jitter.String()
+	}
+	stats.Loss = link.Loss
+	return stats
+}
+
+// LinkStats returns estimates of the link latency, jitter and loss from
+// recent pings.
+func (u *ConnUpstream) LinkStats() LinkStats {
+	return u.stats.link.Stats()
+}
+
+// session returns the upstream session, waiting up to the grace period for
+// the upstream to resume if it is disconnected.
+func (u *ConnUpstream) session() (*yamux.Session, error) {
+	var timeout <-chan time.Time
+	for {
+		u.mu.Lock()
+		sess, resumeCh, expired := u.sess, u.resumeCh, u.expired
+		u.mu.Unlock()
+
+		if expired {
+			return nil, errSessionExpired
+		}
+		if resumeCh == nil {
+			return sess, nil
+		}
+
+		if timeout == nil {
+			timer := time.NewTimer(u.gracePeriod)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-resumeCh:
+		case <-timeout:
+			return nil, errSessionDisconnected
+		}
+	}
+}
+
+// release releases a stream reserved from the stream limiter.
+func (u *ConnUpstream) release() {
+	if u.limiter != nil {
+		u.limiter.Release()
+	}
+}
+
+// currentSession returns the most recent upstream session, without waiting
+// for the upstream to resume.
+func (u *ConnUpstream) currentSession() *yamux.Session {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.sess
+}
+
+// disconnectSession marks the upstream as disconnected if the given session
+// is still the current session.
+func (u *ConnUpstream) disconnectSession(sess *yamux.Session) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.sess == sess && u.resumeCh == nil && !u.expired {
+		u.resumeCh = make(chan struct{})
+	}
+}
+
+// resume replaces the upstream session with the reconnected session.
+func (u *ConnUpstream) resume(sess *yamux.Session) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.sess = sess
+	u.stats.connectedAt.Store(time.Now())
+	if u.resumeCh != nil {
+		close(u.resumeCh)
+		u.resumeCh = nil
+	}
+}
+
+// expire marks the upstream session as expired, so can no longer be
+// resumed.
+func (u *ConnUpstream) expire() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.expired = true
+	if u.resumeCh != nil {
+		close(u.resumeCh)
+		u.resumeCh = nil
+	}
 }
 
 func (u *ConnUpstream) Forward() bool {
 	return false
 }
 
+// forwardDialTimeout is the maximum duration to wait to connect to another
+// node, so an unreachable node fails over quickly rather than waiting for the
+// OS connect timeout.
+const forwardDialTimeout = time.Second * 3
+
+// Dialer opens connections to other nodes in the cluster.
+//
+// If the dialer implements DialContext, connections are dialled using the
+// request context.
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
 // NodeUpstream represents a remote Piko server node.
+//
+// If the node can't be reached, the upstream fails over to the next of the
+// fallback nodes the endpoint is active on. Dial fails over when dialling the
+// node fails, and the proxy fails over with Failover when the node responds
+// that it has no upstream for the endpoint, such as if the cluster state is
+// stale.
 type NodeUpstream struct {
 	endpointID string
-	node       *cluster.Node
+	// node is the node the upstream is forwarding to, which is updated when
+	// failing over to a fallback node.
+	node *cluster.Node
+	// fallbacks contains the nodes to try, in order, if the node fails.
+	fallbacks []*cluster.Node
+	mu        sync.Mutex
+
+	// dialer is nil if connections are dialled with the host network.
+	dialer Dialer
+
+	// metrics is nil if hops aren't recorded.
+	metrics *Metrics
 }
 
-func NewNodeUpstream(endpointID string, node *cluster.Node) *NodeUpstream {
+func NewNodeUpstream(endpointID string, node *cluster.Node, dialer Dialer) *NodeUpstream {
 	return &NodeUpstream{
 		endpointID: endpointID,
 		node:       node,
+		dialer:     dialer,
 	}
 }
 
+// ID returns the ID of the remote node.
+func (u *NodeUpstream) ID() string {
+	return u.currentNode().ID
+}
+
 func (u *NodeUpstream) EndpointID() string {
 	return u.endpointID
 }
 
 func (u *NodeUpstream) Dial() (net.Conn, error) {
-	return net.Dial("tcp", u.node.ProxyAddr)
+	return u.DialContext(context.Background())
+}
+
+// DialContext dials the node, failing over to the fallback nodes if the
+// node can't be reached.
+func (u *NodeUpstream) DialContext(ctx context.Context) (net.Conn, error) {
+	for {
+		conn, err := u.dial(ctx, u.currentNode())
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			// The request was cancelled so don't try another node.
+			return nil, err
+		}
+		if !u.Failover() {
+			return nil, err
+		}
+	}
+}
+
+// Failover records that forwarding to the current node failed and switches
+// to the next fallback node.
+//
+// Returns false if there are no remaining fallback nodes.
+func (u *NodeUpstream) Failover() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.metrics != nil {
+		u.metrics.ForwardFailuresTotal.With(prometheus.Labels{
+			"node_id": u.node.ID,
+		}).Inc()
+	}
+	if len(u.fallbacks) == 0 {
+		return false
+	}
+
+	u.node = u.fallbacks[0]
+	u.fallbacks = u.fallbacks[1:]
+	if u.metrics != nil {
+		u.metrics.RemoteRequestsTotal.With(prometheus.Labels{
+			"node_id": u.node.ID,
+		}).Inc()
+	}
+	return true
+}
+
+func (u *NodeUpstream) currentNode() *cluster.Node {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.node
+}
+
+func (u *NodeUpstream) dial(ctx context.Context, node *cluster.Node) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, forwardDialTimeout)
+	defer cancel()
+
+	if dialer, ok := u.dialer.(contextDialer); ok {
+		return dialer.DialContext(ctx, "tcp", node.ProxyAddr)
+	}
+	if u.dialer != nil {
+		return u.dialer.Dial("tcp", node.ProxyAddr)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", node.ProxyAddr)
 }
 
 func (u *NodeUpstream) Forward() bool {
 	return true
 }
+
+func newConnectionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic("read rand: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
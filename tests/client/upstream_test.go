@@ -6,14 +6,18 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/andydunstall/piko/client"
 	"github.com/andydunstall/piko/pikotest/cluster"
@@ -81,6 +85,145 @@ func TestUpstream_ListenAndForward(t *testing.T) {
 	assert.NoError(t, forwarder.Wait())
 }
 
+// TestUpstream_ListenMultipath tests listening over multiple network paths.
+func TestUpstream_ListenMultipath(t *testing.T) {
+	node := cluster.NewNode()
+	node.Start()
+	defer node.Stop()
+
+	upstream := client.Upstream{
+		URL: &url.URL{
+			Scheme: "http",
+			Host:   node.UpstreamAddr(),
+		},
+	}
+
+	// Use two loopback addresses as separate paths.
+	ln, err := upstream.ListenMultipath(
+		context.Background(),
+		"my-endpoint",
+		[]net.Addr{
+			&net.TCPAddr{IP: net.ParseIP("127.0.0.1")},
+			&net.TCPAddr{IP: net.ParseIP("127.0.0.2")},
+		},
+	)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(_ http.ResponseWriter, _ *http.Request) {},
+	))
+	server.Listener = ln
+	go server.Start()
+	defer server.Close()
+
+	// Wait for both paths to connect.
+	var sessions []struct {
+		RemoteAddr string `json:"remote_addr"`
+	}
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(
+			"http://" + node.AdminAddr() + "/status/upstream/sessions?endpoint=my-endpoint",
+		)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+			return false
+		}
+		return len(sessions) == 2
+	}, time.Second*5, time.Millisecond*10)
+
+	var ips []string
+	for _, sess := range sessions {
+		host, _, err := net.SplitHostPort(sess.RemoteAddr)
+		require.NoError(t, err)
+		ips = append(ips, host)
+	}
+	assert.ElementsMatch(t, []string{"127.0.0.1", "127.0.0.2"}, ips)
+
+	for i := 0; i != 10; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+node.ProxyAddr(), nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+// TestUpstream_ListenMultiplexed tests listening on multiple endpoints with a
+// single connection.
+func TestUpstream_ListenMultiplexed(t *testing.T) {
+	node := cluster.NewNode()
+	node.Start()
+	defer node.Stop()
+
+	upstream := client.Upstream{
+		URL: &url.URL{
+			Scheme: "http",
+			Host:   node.UpstreamAddr(),
+		},
+	}
+
+	endpointIDs := []string{"endpoint-1", "endpoint-2", "endpoint-3"}
+	listeners, err := upstream.ListenMultiplexed(context.Background(), endpointIDs)
+	require.NoError(t, err)
+	require.Len(t, listeners, len(endpointIDs))
+
+	for _, ln := range listeners {
+		endpointID := ln.EndpointID()
+		go func() {
+			_ = http.Serve(ln, http.HandlerFunc(
+				func(w http.ResponseWriter, _ *http.Request) {
+					// nolint
+					w.Write([]byte(endpointID))
+				},
+			))
+		}()
+	}
+
+	// The endpoints share a single connection.
+	var sessions []struct {
+		RemoteAddr string `json:"remote_addr"`
+	}
+	resp, err := http.Get("http://" + node.AdminAddr() + "/status/upstream/sessions")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&sessions))
+	resp.Body.Close()
+	require.Len(t, sessions, len(endpointIDs))
+	for _, sess := range sessions {
+		assert.Equal(t, sessions[0].RemoteAddr, sess.RemoteAddr)
+	}
+
+	for _, endpointID := range endpointIDs {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+node.ProxyAddr(), nil)
+		req.Header.Add("x-piko-endpoint", endpointID)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, endpointID, string(body))
+	}
+
+	// Closing a listener only closes the connection once all listeners are
+	// closed.
+	require.NoError(t, listeners[0].Close())
+	req, _ := http.NewRequest(http.MethodGet, "http://"+node.ProxyAddr(), nil)
+	req.Header.Add("x-piko-endpoint", "endpoint-2")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for _, ln := range listeners[1:] {
+		require.NoError(t, ln.Close())
+	}
+}
+
 func randomBytes(n int) []byte {
 	b := make([]byte, n)
 	_, err := rand.Read(b)
@@ -89,3 +232,53 @@ func randomBytes(n int) []byte {
 	}
 	return b
 }
+
+// TestUpstream_ListenWildcard tests listening on every endpoint in a
+// namespace.
+func TestUpstream_ListenWildcard(t *testing.T) {
+	node := cluster.NewNode()
+	node.Start()
+	defer node.Stop()
+
+	upstream := client.Upstream{
+		URL: &url.URL{
+			Scheme: "http",
+			Host:   node.UpstreamAddr(),
+		},
+	}
+
+	ln, err := upstream.Listen(context.Background(), "team-a/*")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// The endpoint header identifies the endpoint in the namespace.
+			_, _ = w.Write([]byte(r.Header.Get("x-piko-endpoint")))
+		},
+	))
+	server.Listener = ln
+	server.Start()
+	defer server.Close()
+
+	for _, endpointID := range []string{"team-a/service-b", "team-a/service-c"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+node.ProxyAddr(), nil)
+		req.Header.Add("x-piko-endpoint", endpointID)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		respBody, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, endpointID, string(respBody))
+	}
+
+	// Endpoints outside the namespace aren't routed to the listener.
+	req, _ := http.NewRequest(http.MethodGet, "http://"+node.ProxyAddr(), nil)
+	req.Header.Add("x-piko-endpoint", "team-b/service-b")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
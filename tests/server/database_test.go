@@ -0,0 +1,245 @@
+//go:build system
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/client"
+	"github.com/andydunstall/piko/pikotest/cluster"
+	"github.com/andydunstall/piko/pkg/testutil"
+	serverconfig "github.com/andydunstall/piko/server/config"
+)
+
+// postgresSSLRequest is the Postgres 'SSLRequest' message sent by clients to
+// upgrade the connection to TLS in-band.
+var postgresSSLRequest = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+
+// serveTCPEndpoint accepts connections from the endpoint listener and
+// handles each with handler until the listener is closed.
+func serveTCPEndpoint(t *testing.T, node *cluster.Node, handler func(conn net.Conn)) {
+	upstream := client.Upstream{
+		URL: &url.URL{
+			Scheme: "http",
+			Host:   node.UpstreamAddr(),
+		},
+	}
+	ln, err := upstream.Listen(context.TODO(), "my-database")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				// Closed listener.
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+}
+
+func dialDatabase(t *testing.T, node *cluster.Node) net.Conn {
+	dialer := client.Dialer{
+		URL: &url.URL{
+			Scheme: "http",
+			Host:   node.ProxyAddr(),
+		},
+	}
+	conn, err := dialer.Dial(context.TODO(), "my-database")
+	require.NoError(t, err)
+	return conn
+}
+
+// Tests the traffic patterns of database protocols over TCP endpoints.
+//
+// The upstreams emulate the Postgres, MySQL and Redis wire protocols in
+// process, rather than running the databases themselves, since Piko forwards
+// the bytes without parsing the protocol. What matters is framing across
+// WebSocket messages, which side speaks first, in-band TLS upgrades and long
+// idle connections.
+func TestProxy_Database(t *testing.T) {
+	// Use a short write timeout to check idle connections outlive the proxy
+	// timeouts.
+	httpConfig := serverconfig.Default().Proxy.HTTP
+	httpConfig.WriteTimeout = time.Millisecond * 200
+
+	t.Run("postgres tls", func(t *testing.T) {
+		node := cluster.NewNode(cluster.WithProxyHTTPConfig(httpConfig))
+		node.Start()
+		defer node.Stop()
+
+		rootCAPool, cert, err := testutil.LocalTLSServerCert()
+		require.NoError(t, err)
+
+		serveTCPEndpoint(t, node, func(conn net.Conn) {
+			b := make([]byte, len(postgresSSLRequest))
+			if _, err := io.ReadFull(conn, b); err != nil {
+				return
+			}
+			assert.Equal(t, postgresSSLRequest, b)
+			if _, err := conn.Write([]byte("S")); err != nil {
+				return
+			}
+
+			tlsConn := tls.Server(conn, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			})
+			// nolint
+			io.Copy(tlsConn, tlsConn)
+		})
+
+		conn := dialDatabase(t, node)
+		defer conn.Close()
+
+		_, err = conn.Write(postgresSSLRequest)
+		require.NoError(t, err)
+		b := make([]byte, 1)
+		_, err = io.ReadFull(conn, b)
+		require.NoError(t, err)
+		require.Equal(t, "S", string(b))
+
+		tlsConn := tls.Client(conn, &tls.Config{
+			RootCAs:    rootCAPool,
+			ServerName: "127.0.0.1",
+		})
+		require.NoError(t, tlsConn.Handshake())
+
+		// Hold a long transaction open past the write timeout.
+		for _, wait := range []time.Duration{0, httpConfig.WriteTimeout * 2} {
+			time.Sleep(wait)
+
+			query := bytes.Repeat([]byte("q"), 64*1024)
+			go func() {
+				// nolint
+				tlsConn.Write(query)
+			}()
+			received := make([]byte, len(query))
+			_, err = io.ReadFull(tlsConn, received)
+			require.NoError(t, err)
+			assert.Equal(t, query, received)
+		}
+	})
+
+	t.Run("mysql server greeting", func(t *testing.T) {
+		node := cluster.NewNode()
+		node.Start()
+		defer node.Stop()
+
+		greeting := []byte("\x0a8.0.0\x00greeting")
+
+		serveTCPEndpoint(t, node, func(conn net.Conn) {
+			// MySQL servers send a handshake packet before the client
+			// writes anything.
+			packet := make([]byte, 4+len(greeting))
+			binary.LittleEndian.PutUint32(packet, uint32(len(greeting)))
+			copy(packet[4:], greeting)
+			if _, err := conn.Write(packet); err != nil {
+				return
+			}
+			// nolint
+			io.Copy(conn, conn)
+		})
+
+		conn := dialDatabase(t, node)
+		defer conn.Close()
+
+		header := make([]byte, 4)
+		_, err := io.ReadFull(conn, header)
+		require.NoError(t, err)
+		// The low three bytes are the payload length and the high byte the
+		// sequence ID.
+		assert.Equal(t, uint32(len(greeting)), binary.LittleEndian.Uint32(header)&0xffffff)
+
+		payload := make([]byte, len(greeting))
+		_, err = io.ReadFull(conn, payload)
+		require.NoError(t, err)
+		assert.Equal(t, greeting, payload)
+	})
+
+	t.Run("redis pipeline", func(t *testing.T) {
+		node := cluster.NewNode()
+		node.Start()
+		defer node.Stop()
+
+		serveTCPEndpoint(t, node, func(conn net.Conn) {
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line != "PING\r\n" {
+					return
+				}
+				if _, err := conn.Write([]byte("+PONG\r\n")); err != nil {
+					return
+				}
+			}
+		})
+
+		conn := dialDatabase(t, node)
+		defer conn.Close()
+
+		// Pipeline many small commands so they are split and coalesced
+		// across WebSocket messages.
+		const commands = 1000
+		go func() {
+			for i := 0; i != commands; i++ {
+				if _, err := conn.Write([]byte("PING\r\n")); err != nil {
+					return
+				}
+			}
+		}()
+
+		r := bufio.NewReader(conn)
+		for i := 0; i != commands; i++ {
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			require.Equal(t, "+PONG\r\n", line)
+		}
+	})
+
+	t.Run("client close", func(t *testing.T) {
+		node := cluster.NewNode()
+		node.Start()
+		defer node.Stop()
+
+		closedCh := make(chan struct{})
+		serveTCPEndpoint(t, node, func(conn net.Conn) {
+			// nolint
+			io.Copy(io.Discard, conn)
+			close(closedCh)
+		})
+
+		conn := dialDatabase(t, node)
+		_, err := conn.Write([]byte("X"))
+		require.NoError(t, err)
+
+		// Closing the client connection, such as a Postgres 'Terminate',
+		// must propagate to the upstream so the database releases the
+		// session.
+		conn.Close()
+
+		select {
+		case <-closedCh:
+		case <-time.After(time.Second * 5):
+			t.Fatal("upstream not closed")
+		}
+	})
+}
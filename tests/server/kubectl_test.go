@@ -0,0 +1,286 @@
+//go:build system
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/agent/reverseproxy"
+	"github.com/andydunstall/piko/client"
+	"github.com/andydunstall/piko/pikotest/cluster"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
+	serverconfig "github.com/andydunstall/piko/server/config"
+)
+
+// fakeAPIServer simulates the kube-apiserver endpoints used by
+// 'kubectl logs', 'kubectl exec' and 'kubectl port-forward'.
+//
+// Upgraded streams echo the bytes received, rather than implementing the
+// SPDY framing, since Piko copies the upgraded connection without parsing it.
+func fakeAPIServer(t *testing.T) *httptest.Server {
+	wsUpgrader := websocket.Upgrader{
+		Subprotocols: []string{"v5.channel.k8s.io"},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(
+		"GET /api/v1/namespaces/default/pods/my-pod/log",
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "true", r.URL.Query().Get("follow"))
+
+			w.Header().Set("Content-Type", "text/plain")
+			for i := 0; i != 3; i++ {
+				fmt.Fprintf(w, "line %d\n", i)
+				w.(http.Flusher).Flush()
+				time.Sleep(time.Millisecond * 10)
+			}
+		},
+	)
+	upgrade := func(protocol string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			// Newer kubectl versions use WebSockets rather than SPDY.
+			if websocket.IsWebSocketUpgrade(r) {
+				conn, err := wsUpgrader.Upgrade(w, r, nil)
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer conn.Close()
+
+				for {
+					mt, b, err := conn.ReadMessage()
+					if err != nil {
+						return
+					}
+					if err := conn.WriteMessage(mt, b); err != nil {
+						return
+					}
+				}
+			}
+
+			assert.Equal(t, "SPDY/3.1", r.Header.Get("Upgrade"))
+			assert.Contains(t, r.Header.Values("X-Stream-Protocol-Version"), protocol)
+
+			w.Header().Set("Connection", "Upgrade")
+			w.Header().Set("Upgrade", "SPDY/3.1")
+			w.Header().Set("X-Stream-Protocol-Version", protocol)
+			w.WriteHeader(http.StatusSwitchingProtocols)
+
+			conn, rw, err := http.NewResponseController(w).Hijack()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+
+			// nolint
+			io.Copy(conn, rw)
+		}
+	}
+	mux.HandleFunc(
+		"/api/v1/namespaces/default/pods/my-pod/exec",
+		upgrade("v4.channel.k8s.io"),
+	)
+	mux.HandleFunc(
+		"POST /api/v1/namespaces/default/pods/my-pod/portforward",
+		upgrade("portforward.k8s.io"),
+	)
+	return httptest.NewServer(mux)
+}
+
+// startAPIServerEndpoint starts an agent reverse proxy forwarding the
+// endpoint to the fake API server.
+func startAPIServerEndpoint(t *testing.T, node *cluster.Node) func() {
+	apiServer := fakeAPIServer(t)
+
+	upstream := client.Upstream{
+		URL: &url.URL{
+			Scheme: "http",
+			Host:   node.UpstreamAddr(),
+		},
+	}
+	ln, err := upstream.Listen(context.TODO(), "kube-apiserver")
+	require.NoError(t, err)
+
+	proxy := reverseproxy.NewServer(config.ListenerConfig{
+		EndpointID: "kube-apiserver",
+		Addr:       apiServer.URL,
+		Timeout:    time.Second * 30,
+	}, nil, nil, protocol.Headers{}, nil, nil, nil, nil, log.NewNopLogger())
+	go func() {
+		// nolint
+		proxy.Serve(ln)
+	}()
+
+	return func() {
+		// nolint
+		proxy.Shutdown(context.TODO())
+		apiServer.Close()
+	}
+}
+
+// dialSPDY sends an SPDY upgrade request via Piko, similar to
+// 'kubectl exec' and 'kubectl port-forward', and returns the upgraded
+// connection.
+func dialSPDY(t *testing.T, addr string, path string, protocol string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+addr+path, nil)
+	req.Header.Set("x-piko-endpoint", "kube-apiserver")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "SPDY/3.1")
+	req.Header.Add("X-Stream-Protocol-Version", "v5.channel.k8s.io")
+	req.Header.Add("X-Stream-Protocol-Version", protocol)
+	require.NoError(t, req.Write(conn))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "SPDY/3.1", resp.Header.Get("Upgrade"))
+	assert.Equal(t, protocol, resp.Header.Get("X-Stream-Protocol-Version"))
+
+	return conn, br
+}
+
+func assertEcho(t *testing.T, conn net.Conn, br *bufio.Reader) {
+	for i := 0; i != 3; i++ {
+		_, err := conn.Write([]byte("foo"))
+		require.NoError(t, err)
+
+		buf := make([]byte, 3)
+		_, err = io.ReadFull(br, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "foo", string(buf))
+	}
+}
+
+// Tests the kubectl streaming and upgrade protocols via a Piko endpoint
+// fronting the Kubernetes API server.
+func TestProxy_Kubectl(t *testing.T) {
+	// Use a short write timeout to check long lived upgraded connections
+	// outlive the proxy timeouts.
+	httpConfig := serverconfig.Default().Proxy.HTTP
+	httpConfig.WriteTimeout = time.Millisecond * 200
+
+	node := cluster.NewNode(cluster.WithProxyHTTPConfig(httpConfig))
+	node.Start()
+	defer node.Stop()
+
+	stop := startAPIServerEndpoint(t, node)
+	defer stop()
+
+	t.Run("logs", func(t *testing.T) {
+		req, _ := http.NewRequest(
+			http.MethodGet,
+			"http://"+node.ProxyAddr()+"/api/v1/namespaces/default/pods/my-pod/log?follow=true",
+			nil,
+		)
+		req.Header.Set("x-piko-endpoint", "kube-apiserver")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// Each line must be streamed as it is written. Note unlike upgraded
+		// connections, streamed responses such as 'kubectl logs -f' and
+		// watches are still bound by the proxy timeouts.
+		br := bufio.NewReader(resp.Body)
+		for i := 0; i != 3; i++ {
+			line, err := br.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("line %d\n", i), line)
+		}
+	})
+
+	t.Run("exec", func(t *testing.T) {
+		conn, br := dialSPDY(
+			t,
+			node.ProxyAddr(),
+			"/api/v1/namespaces/default/pods/my-pod/exec?command=sh&stdin=true",
+			"v4.channel.k8s.io",
+		)
+		defer conn.Close()
+
+		assertEcho(t, conn, br)
+
+		// Wait for longer than the write timeout.
+		time.Sleep(httpConfig.WriteTimeout * 2)
+
+		assertEcho(t, conn, br)
+	})
+
+	t.Run("exec websocket", func(t *testing.T) {
+		header := http.Header{}
+		header.Set("x-piko-endpoint", "kube-apiserver")
+		dialer := websocket.Dialer{
+			Subprotocols: []string{"v5.channel.k8s.io"},
+		}
+		conn, resp, err := dialer.Dial(
+			"ws://"+node.ProxyAddr()+"/api/v1/namespaces/default/pods/my-pod/exec?command=sh",
+			header,
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, "v5.channel.k8s.io", resp.Header.Get("Sec-WebSocket-Protocol"))
+
+		for _, wait := range []time.Duration{0, httpConfig.WriteTimeout * 2} {
+			time.Sleep(wait)
+
+			// Channel 0 is stdin.
+			msg := append([]byte{0}, []byte("foo")...)
+			require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, msg))
+			_, b, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, msg, b)
+		}
+	})
+
+	t.Run("port-forward", func(t *testing.T) {
+		conn, br := dialSPDY(
+			t,
+			node.ProxyAddr(),
+			"/api/v1/namespaces/default/pods/my-pod/portforward",
+			"portforward.k8s.io",
+		)
+		defer conn.Close()
+
+		assertEcho(t, conn, br)
+
+		time.Sleep(httpConfig.WriteTimeout * 2)
+
+		assertEcho(t, conn, br)
+	})
+
+	t.Run("upgrade rejected", func(t *testing.T) {
+		req, _ := http.NewRequest(
+			http.MethodPost,
+			"http://"+node.ProxyAddr()+"/api/v1/namespaces/default/pods/unknown/exec",
+			strings.NewReader(""),
+		)
+		req.Header.Set("x-piko-endpoint", "kube-apiserver")
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "SPDY/3.1")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
@@ -0,0 +1,164 @@
+//go:build system
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/client"
+	"github.com/andydunstall/piko/pikotest/cluster"
+	"github.com/andydunstall/piko/pikotest/cluster/config"
+	"github.com/andydunstall/piko/pikotest/cluster/network"
+	pikocluster "github.com/andydunstall/piko/server/cluster"
+)
+
+// convergeTimeout is the maximum time for the cluster to converge after a
+// network change.
+const convergeTimeout = time.Second * 10
+
+func listenEndpoint(t *testing.T, node *cluster.Node, endpointID string) {
+	upstream := client.Upstream{
+		URL: &url.URL{
+			Scheme: "http",
+			Host:   node.UpstreamAddr(),
+		},
+	}
+	ln, err := upstream.Listen(context.TODO(), endpointID)
+	require.NoError(t, err)
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			// nolint
+			w.Write([]byte(node.ID()))
+		}),
+	}
+	go func() {
+		// nolint
+		server.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		server.Close()
+	})
+}
+
+// request sends a request to the endpoint via node, returning the ID of
+// the node whose upstream handled the request, or an empty string if the
+// request failed.
+func request(node *cluster.Node, endpointID string) string {
+	req, _ := http.NewRequest(http.MethodGet, "http://"+node.ProxyAddr(), nil)
+	req.Header.Set("x-piko-endpoint", endpointID)
+	httpClient := &http.Client{
+		Timeout: time.Second,
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	return string(b)
+}
+
+func nodeStatus(node *cluster.Node, id string) pikocluster.NodeStatus {
+	remote, ok := node.ClusterState().Node(id)
+	if !ok {
+		return ""
+	}
+	return remote.Status
+}
+
+// Tests routing converges when the cluster is partitioned, and requests
+// succeed via nodes that are still reachable.
+func TestCluster_Partition(t *testing.T) {
+	fabric := network.New(1)
+
+	manager := cluster.NewManager(cluster.WithNetwork(fabric))
+	defer manager.Close()
+
+	manager.Update(&config.Config{
+		Nodes: 3,
+	})
+	nodes := manager.Nodes()
+
+	// Connect upstreams for the endpoint to nodes 0 and 2, and send requests
+	// via node 1, which must forward the requests to another node.
+	listenEndpoint(t, nodes[0], "my-endpoint")
+	listenEndpoint(t, nodes[2], "my-endpoint")
+
+	require.Eventually(t, func() bool {
+		return request(nodes[1], "my-endpoint") != ""
+	}, convergeTimeout, time.Millisecond*10)
+
+	t.Run("partition", func(t *testing.T) {
+		fabric.Partition(
+			[]string{nodes[1].ID()},
+			[]string{nodes[0].ID()},
+		)
+		defer fabric.Heal()
+
+		// Wait for node 1 to detect node 0 is unreachable.
+		require.Eventually(t, func() bool {
+			return nodeStatus(nodes[1], nodes[0].ID()) == pikocluster.NodeStatusUnreachable
+		}, convergeTimeout, time.Millisecond*10)
+
+		// Once converged, all requests must be forwarded to node 2.
+		for i := 0; i != 20; i++ {
+			assert.Equal(t, nodes[2].ID(), request(nodes[1], "my-endpoint"))
+		}
+
+		// Node 0 and node 2 can still communicate.
+		assert.Equal(t, pikocluster.NodeStatusActive, nodeStatus(nodes[2], nodes[0].ID()))
+	})
+
+	t.Run("heal", func(t *testing.T) {
+		fabric.Heal()
+
+		require.Eventually(t, func() bool {
+			return nodeStatus(nodes[1], nodes[0].ID()) == pikocluster.NodeStatusActive
+		}, convergeTimeout, time.Millisecond*10)
+
+		// Requests succeed via either node.
+		for i := 0; i != 20; i++ {
+			assert.NotEmpty(t, request(nodes[1], "my-endpoint"))
+		}
+	})
+
+	t.Run("degraded", func(t *testing.T) {
+		// Add latency, jitter and packet loss between every node, which must
+		// not cause nodes to be marked unreachable or requests to fail.
+		degraded := network.Link{
+			Delay:  time.Millisecond * 5,
+			Jitter: time.Millisecond * 10,
+			Loss:   0.1,
+		}
+		for _, from := range nodes {
+			for _, to := range nodes {
+				if from != to {
+					fabric.SetLink(from.ID(), to.ID(), degraded)
+				}
+			}
+		}
+		defer fabric.Heal()
+
+		succeeded := 0
+		const requests = 50
+		for i := 0; i != requests; i++ {
+			if request(nodes[1], "my-endpoint") != "" {
+				succeeded++
+			}
+		}
+		assert.Equal(t, requests, succeeded)
+	})
+}
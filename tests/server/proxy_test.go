@@ -14,6 +14,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -87,6 +88,54 @@ func TestProxy_HTTP(t *testing.T) {
 		assert.Equal(t, reqBody, respBody)
 	})
 
+	t.Run("trailers", func(t *testing.T) {
+		node := cluster.NewNode()
+		node.Start()
+		defer node.Stop()
+
+		upstream := client.Upstream{
+			URL: &url.URL{
+				Scheme: "http",
+				Host:   node.UpstreamAddr(),
+			},
+		}
+		ln, err := upstream.Listen(context.TODO(), "my-endpoint")
+		assert.NoError(t, err)
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "trailers", r.Header.Get("TE"))
+
+				w.Header().Set("Trailer", "Grpc-Status")
+				// nolint
+				w.Write([]byte("foo"))
+				w.(http.Flusher).Flush()
+				// nolint
+				w.Write([]byte("bar"))
+				w.Header().Set("Grpc-Status", "0")
+				w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+			},
+		))
+		server.Listener = ln
+		go server.Start()
+		defer server.Close()
+
+		req, _ := http.NewRequest(http.MethodGet, "http://"+node.ProxyAddr(), nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		req.Header.Set("TE", "trailers")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		respBody, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "foobar", string(respBody))
+		assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+		assert.Equal(t, "ok", resp.Trailer.Get("Grpc-Message"))
+	})
+
 	t.Run("https", func(t *testing.T) {
 		node := cluster.NewNode(cluster.WithTLS(true))
 		node.Start()
@@ -297,6 +346,106 @@ func TestProxy_TCP(t *testing.T) {
 	})
 }
 
+// Tests streaming large transfers from an upstream to a client via Piko
+// without buffering the transfer in memory.
+func TestProxy_Stream(t *testing.T) {
+	const size = 512 << 20
+	// maxHeapGrowth is the maximum increase in heap usage while streaming,
+	// which covers the client, Piko server and upstream as they all run in
+	// this process.
+	const maxHeapGrowth = 64 << 20
+
+	t.Run("http", func(t *testing.T) {
+		node := cluster.NewNode()
+		node.Start()
+		defer node.Stop()
+
+		upstream := client.Upstream{
+			URL: &url.URL{
+				Scheme: "http",
+				Host:   node.UpstreamAddr(),
+			},
+		}
+		ln, err := upstream.Listen(context.TODO(), "my-endpoint")
+		assert.NoError(t, err)
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				_, err := io.CopyN(w, zeroReader{}, size)
+				assert.NoError(t, err)
+			},
+		))
+		server.Listener = ln
+		go server.Start()
+		defer server.Close()
+
+		sampler := newHeapSampler()
+
+		req, _ := http.NewRequest(
+			http.MethodGet,
+			"http://"+node.ProxyAddr(),
+			nil,
+		)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		httpClient := &http.Client{}
+		resp, err := httpClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		n, err := io.Copy(io.Discard, resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(size), n)
+
+		assert.Less(t, sampler.Stop(), uint64(maxHeapGrowth))
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		node := cluster.NewNode()
+		node.Start()
+		defer node.Stop()
+
+		upstream := client.Upstream{
+			URL: &url.URL{
+				Scheme: "http",
+				Host:   node.UpstreamAddr(),
+			},
+		}
+		ln, err := upstream.Listen(context.TODO(), "my-endpoint")
+		assert.NoError(t, err)
+
+		go func() {
+			conn, err := ln.Accept()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+
+			_, err = io.CopyN(conn, zeroReader{}, size)
+			assert.NoError(t, err)
+		}()
+
+		sampler := newHeapSampler()
+
+		dialer := client.Dialer{
+			URL: &url.URL{
+				Scheme: "http",
+				Host:   node.ProxyAddr(),
+			},
+		}
+		conn, err := dialer.Dial(context.TODO(), "my-endpoint")
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		n, err := io.CopyN(io.Discard, conn, size)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(size), n)
+
+		assert.Less(t, sampler.Stop(), uint64(maxHeapGrowth))
+	})
+}
+
 // Tests proxy authentication.
 func TestProxy_Auth(t *testing.T) {
 	endpointClaims := auth.JWTClaims{
@@ -398,3 +547,59 @@ func randomBytes(n int) []byte {
 	}
 	return b
 }
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+// heapSampler samples the in-use heap to record the peak growth since the
+// sampler was created.
+type heapSampler struct {
+	baseline uint64
+	peak     uint64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newHeapSampler() *heapSampler {
+	runtime.GC()
+	s := &heapSampler{
+		baseline: heapInuse(),
+		done:     make(chan struct{}),
+	}
+	s.peak = s.baseline
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.peak = max(s.peak, heapInuse())
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// Stop stops sampling and returns the peak heap growth in bytes.
+func (s *heapSampler) Stop() uint64 {
+	close(s.done)
+	s.wg.Wait()
+	return s.peak - s.baseline
+}
+
+func heapInuse() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
@@ -0,0 +1,127 @@
+//go:build system
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/agent/udpproxy"
+	"github.com/andydunstall/piko/client"
+	"github.com/andydunstall/piko/forward"
+	"github.com/andydunstall/piko/pikotest/cluster"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// udpEchoServer echos each datagram back to the sender, prefixed by the
+// sender address, so tests can check each client has its own peer.
+func udpEchoServer(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		buf := make([]byte, 0xffff)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// nolint
+			conn.WriteTo([]byte(addr.String()+" "+string(buf[:n])), addr)
+		}
+	}()
+	return conn
+}
+
+// Tests forwarding datagrams from 'piko forward udp' to an agent UDP
+// listener.
+func TestProxy_UDP(t *testing.T) {
+	node := cluster.NewNode()
+	node.Start()
+	defer node.Stop()
+
+	echo := udpEchoServer(t)
+	defer echo.Close()
+
+	upstream := client.Upstream{
+		URL: &url.URL{
+			Scheme: "http",
+			Host:   node.UpstreamAddr(),
+		},
+	}
+	ln, err := upstream.Listen(context.TODO(), "my-endpoint")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	server := udpproxy.NewServer(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       echo.LocalAddr().String(),
+		Protocol:   config.ListenerProtocolUDP,
+		Timeout:    time.Second,
+	}, nil, nil, log.NewNopLogger())
+	go func() {
+		// nolint
+		server.Serve(ln)
+	}()
+	defer server.Close()
+
+	dialer := &client.Dialer{
+		URL: &url.URL{
+			Scheme: "http",
+			Host:   node.ProxyAddr(),
+		},
+	}
+	forwarder := forward.NewUDPForwarder(
+		"my-endpoint", dialer, time.Second, log.NewNopLogger(),
+	)
+	forwardConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		// nolint
+		forwarder.Forward(forwardConn)
+	}()
+	defer forwarder.Close()
+
+	exchange := func(conn net.Conn, msg string) string {
+		buf := make([]byte, 0xffff)
+		// Retry since datagrams may be dropped while the session connects.
+		for i := 0; i != 20; i++ {
+			_, err := conn.Write([]byte(msg))
+			require.NoError(t, err)
+
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Millisecond*250)))
+			n, err := conn.Read(buf)
+			if err == nil {
+				return string(buf[:n])
+			}
+		}
+		require.FailNow(t, "no response")
+		return ""
+	}
+
+	conn1, err := net.Dial("udp", forwardConn.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn1.Close()
+	conn2, err := net.Dial("udp", forwardConn.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn2.Close()
+
+	var peer1, peer2 string
+	for i := 0; i != 3; i++ {
+		msg := fmt.Sprintf("foo-%d", i)
+		_, err := fmt.Sscanf(exchange(conn1, msg), "%s "+msg, &peer1)
+		require.NoError(t, err)
+		_, err = fmt.Sscanf(exchange(conn2, msg), "%s "+msg, &peer2)
+		require.NoError(t, err)
+	}
+	// Each client has its own peer address at the upstream.
+	assert.NotEqual(t, peer1, peer2)
+}
@@ -0,0 +1,223 @@
+//go:build soak
+
+// Package soak runs long running tests that churn upstream connections and
+// requests through a Piko server, asserting the goroutine, file descriptor
+// and heap usage are stable to catch leaks before release.
+//
+// Run with 'make soak-test', or configure the duration and load with the
+// '-soak.*' flags, such as:
+//
+//	go test ./tests/soak -tags soak -v -count 1 -timeout 0 -soak.duration 1h
+package soak
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/client"
+	"github.com/andydunstall/piko/pikotest/cluster"
+)
+
+var (
+	duration = flag.Duration(
+		"soak.duration", time.Minute, "Duration to run the soak test for.",
+	)
+	upstreams = flag.Int(
+		"soak.upstreams", 200, "Number of upstream connections opened per round.",
+	)
+	requests = flag.Int(
+		"soak.requests", 5, "Number of requests sent to each upstream per round.",
+	)
+
+	maxGoroutineGrowth = flag.Int(
+		"soak.max-goroutine-growth", 50,
+		"Maximum increase in goroutines after the test compared to the baseline.",
+	)
+	maxFDGrowth = flag.Int(
+		"soak.max-fd-growth", 50,
+		"Maximum increase in open file descriptors after the test compared to the baseline.",
+	)
+	maxHeapGrowth = flag.Uint64(
+		"soak.max-heap-growth", 64<<20,
+		"Maximum increase in the in-use heap in bytes after the test compared to the baseline.",
+	)
+)
+
+// settleTimeout is the maximum time to wait for connections to close after
+// the test before checking for leaks.
+const settleTimeout = time.Second * 30
+
+type usage struct {
+	goroutines int
+	// fds is the number of open file descriptors, or -1 if unknown.
+	fds  int
+	heap uint64
+}
+
+func (u usage) String() string {
+	return fmt.Sprintf(
+		"goroutines=%d fds=%d heap=%d", u.goroutines, u.fds, u.heap,
+	)
+}
+
+func readUsage() usage {
+	runtime.GC()
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	fds := -1
+	// Only supported on Linux.
+	if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+		fds = len(entries)
+	}
+
+	return usage{
+		goroutines: runtime.NumGoroutine(),
+		fds:        fds,
+		heap:       stats.HeapInuse,
+	}
+}
+
+// leaked returns whether usage exceeds the baseline by more than the
+// thresholds.
+func (u usage) leaked(baseline usage) bool {
+	if u.goroutines-baseline.goroutines > *maxGoroutineGrowth {
+		return true
+	}
+	if u.fds != -1 && u.fds-baseline.fds > *maxFDGrowth {
+		return true
+	}
+	return u.heap > baseline.heap && u.heap-baseline.heap > *maxHeapGrowth
+}
+
+// runRound opens the upstream connections, sends requests to each, then
+// closes the connections.
+func runRound(t *testing.T, node *cluster.Node, httpClient *http.Client) {
+	upstream := client.Upstream{
+		URL: &url.URL{
+			Scheme: "http",
+			Host:   node.UpstreamAddr(),
+		},
+	}
+
+	var servers []*http.Server
+	for i := 0; i != *upstreams; i++ {
+		endpointID := fmt.Sprintf("endpoint-%d", i)
+		ln, err := upstream.Listen(context.TODO(), endpointID)
+		require.NoError(t, err)
+
+		server := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				// nolint
+				w.Write([]byte(endpointID))
+			}),
+		}
+		go func() {
+			// nolint
+			server.Serve(ln)
+		}()
+		servers = append(servers, server)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i != *upstreams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			endpointID := fmt.Sprintf("endpoint-%d", i)
+			for j := 0; j != *requests; j++ {
+				req, _ := http.NewRequest(http.MethodGet, "http://"+node.ProxyAddr(), nil)
+				req.Header.Set("x-piko-endpoint", endpointID)
+				resp, err := httpClient.Do(req)
+				if !assert.NoError(t, err) {
+					return
+				}
+				b, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				assert.NoError(t, err)
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, endpointID, string(b))
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, server := range servers {
+		// Close rather than shutdown to also close the upstream connection.
+		server.Close()
+	}
+}
+
+// Tests churning upstream connections and requests doesn't leak goroutines,
+// file descriptors or memory.
+func TestSoak_Churn(t *testing.T) {
+	node := cluster.NewNode()
+	node.Start()
+	defer node.Stop()
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: 10,
+		},
+	}
+
+	// Warm up before recording the baseline, so lazily created resources,
+	// such as pooled connections and buffers, aren't reported as leaks.
+	runRound(t, node, httpClient)
+	httpClient.CloseIdleConnections()
+	baseline := readUsage()
+	t.Logf("baseline: %s", baseline)
+
+	start := time.Now()
+	rounds := 0
+	for time.Since(start) < *duration {
+		runRound(t, node, httpClient)
+		rounds++
+
+		if rounds%10 == 0 {
+			t.Logf("round %d: %s", rounds, readUsage())
+		}
+	}
+	httpClient.CloseIdleConnections()
+
+	// Connections close asynchronously so wait for usage to settle.
+	var current usage
+	settleStart := time.Now()
+	for {
+		current = readUsage()
+		if !current.leaked(baseline) || time.Since(settleStart) > settleTimeout {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	t.Logf("rounds: %d; final: %s", rounds, current)
+
+	assert.LessOrEqual(
+		t, current.goroutines-baseline.goroutines, *maxGoroutineGrowth,
+		"goroutine leak",
+	)
+	if current.fds != -1 {
+		assert.LessOrEqual(
+			t, current.fds-baseline.fds, *maxFDGrowth, "file descriptor leak",
+		)
+	}
+	if current.heap > baseline.heap {
+		assert.LessOrEqual(
+			t, current.heap-baseline.heap, *maxHeapGrowth, "heap leak",
+		)
+	}
+}